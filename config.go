@@ -26,6 +26,7 @@ import (
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/storagepath"
 )
 
 /*
@@ -74,7 +75,11 @@ func LogOutputOption(args []string) (log.Output, error) {
 			// Log file paths are converted to absolute to make sure
 			// we will be able to recreate them in right location
 			// after changing working directory to the state dir.
-			absPath, err := filepath.Abs(arg)
+			path := arg
+			if logsDir := storagepath.Dir(storagepath.Logs, ""); logsDir != "" && !filepath.IsAbs(path) {
+				path = filepath.Join(logsDir, path)
+			}
+			absPath, err := filepath.Abs(path)
 			if err != nil {
 				return nil, err
 			}
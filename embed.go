@@ -0,0 +1,181 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maddy
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/activity"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/storagepath"
+	"github.com/foxcpp/maddy/internal/transcript"
+)
+
+// ErrAlreadyStarted is returned by Start if another server is already
+// running in this process.
+//
+// Module instances and hooks are registered globally so only one server
+// can run at a time. A new server can be started once the previous one is
+// closed.
+var ErrAlreadyStarted = errors.New("maddy: server is already running in this process")
+
+var started atomic.Bool
+
+// Server is the running server started using Start, StartReader or
+// StartFile.
+type Server struct {
+	ctlServer *control.Server
+	closeOnce sync.Once
+
+	reload reloadState
+}
+
+// Start initializes all modules defined in the parsed configuration and
+// starts the endpoints. It returns once the server is ready to accept
+// connections.
+//
+// Start changes the working directory of the process to the state directory,
+// relative paths in the configuration are interpreted relative to it.
+//
+// Modules implemented outside of maddy can be registered using
+// module.Register and module.RegisterEndpoint before calling Start. Objects
+// created by the calling program can be made available for references from
+// the configuration using module.RegisterInstance. Such instances are
+// removed from the registry when the server is closed.
+//
+// The server does not handle signals, the caller should call Server.Close to
+// stop it and Server.Reload to apply the changed configuration.
+func Start(cfg []config.Node) (*Server, error) {
+	if !started.CompareAndSwap(false, true) {
+		return nil, ErrAlreadyStarted
+	}
+
+	globals, modBlocks, err := ReadGlobals(cfg)
+	if err != nil {
+		reset()
+		return nil, err
+	}
+
+	if err := InitDirs(); err != nil {
+		reset()
+		return nil, err
+	}
+
+	transcript.Init()
+	activity.Init()
+
+	endpoints, mods, err := RegisterModules(globals, modBlocks)
+	if err != nil {
+		reset()
+		return nil, err
+	}
+
+	if err := initModules(globals, endpoints, mods); err != nil {
+		// Stop modules that were initialized successfully.
+		hooks.RunHooks(hooks.EventShutdown)
+		reset()
+		return nil, err
+	}
+
+	if err := writePIDFile(); err != nil {
+		log.Println("failed to write PID file:", err)
+	}
+
+	srv := &Server{}
+	srv.reload.init(globals, cfg, endpoints, mods)
+	control.Handle("config.reload", func(map[string]string) (interface{}, error) {
+		return srv.ReloadFile()
+	})
+	srv.ctlServer, err = control.Listen(control.SocketPath())
+	if err != nil {
+		log.Println("failed to create control socket:", err)
+	}
+
+	return srv, nil
+}
+
+// StartReader is a variant of Start that reads the configuration in the
+// maddy.conf format from r.
+//
+// location is used in error messages and to resolve relative paths in
+// 'import' directives.
+func StartReader(r io.Reader, location string) (*Server, error) {
+	cfg, err := parser.Read(r, location)
+	if err != nil {
+		return nil, err
+	}
+	return Start(cfg)
+}
+
+// StartFile is a variant of Start that reads the configuration from the
+// file.
+func StartFile(path string) (*Server, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	srv, err := StartReader(f, path)
+	if err != nil {
+		return nil, err
+	}
+	srv.reload.configPath = path
+	return srv, nil
+}
+
+// Close stops all endpoints and closes all modules, waiting for running
+// transactions to complete. Another server can be started after Close
+// returns.
+//
+// Errors are logged and not returned, it is safe to call Close multiple
+// times.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		s.reload.stop()
+		hooks.RunHooks(hooks.EventShutdown)
+
+		if s.ctlServer != nil {
+			s.ctlServer.Close()
+		}
+		os.Remove(PIDFile())
+
+		reset()
+	})
+	return nil
+}
+
+// reset removes the global state left by the stopped server.
+func reset() {
+	hooks.Reset()
+	module.ResetInstances()
+	dns.SetSharedCache(nil)
+	storagepath.Set(nil)
+	started.Store(false)
+}
@@ -0,0 +1,416 @@
+package maddy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-smtp"
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+type testTable struct {
+	instName string
+	values   map[string]bool
+}
+
+func (t *testTable) Name() string {
+	return "test_table"
+}
+
+func (t *testTable) InstanceName() string {
+	return t.instName
+}
+
+func (t *testTable) Init(*config.Map) error {
+	return nil
+}
+
+func (t *testTable) Lookup(_ context.Context, key string) (string, bool, error) {
+	if t.values[key] {
+		return "", true, nil
+	}
+	return "", false, nil
+}
+
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestStartReader(t *testing.T) {
+	// Start changes the working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	module.RegisterInstance(&testTable{
+		instName: "local_rcpts",
+		values:   map[string]bool{"test@example.org": true},
+	}, config.NewMap(nil, config.Node{}))
+
+	dir := t.TempDir()
+	addr := "127.0.0.1:" + freePort(t)
+	srv, err := StartReader(strings.NewReader(`
+		state_dir `+dir+`
+		runtime_dir `+dir+`
+
+		smtp tcp://`+addr+` {
+			hostname mx.example.org
+			tls off
+
+			destination_in &local_rcpts {
+				deliver_to dummy
+			}
+			default_destination {
+				reject
+			}
+		}`), "embed_test.conf")
+	if err != nil {
+		t.Fatal("StartReader:", err)
+	}
+	defer srv.Close()
+
+	if _, err := StartReader(strings.NewReader(""), "embed_test2.conf"); !errors.Is(err, ErrAlreadyStarted) {
+		t.Fatal("Start while running returned unexpected error:", err)
+	}
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("client.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("sender@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("test@example.org", nil); err != nil {
+		t.Fatal("Rcpt for a known address failed:", err)
+	}
+	if err := c.Rcpt("unknown@example.org", nil); err == nil {
+		t.Fatal("Rcpt for an unknown address succeeded")
+	}
+	c.Quit()
+
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(PIDFile()); !os.IsNotExist(err) {
+		t.Fatal("PID file is not removed after Close:", err)
+	}
+
+	// The instance registered above is removed by Close.
+	dir = t.TempDir()
+	_, err = StartReader(strings.NewReader(`
+		state_dir `+dir+`
+		runtime_dir `+dir+`
+
+		smtp tcp://`+addr+` {
+			hostname mx.example.org
+			tls off
+			destination_in &local_rcpts {
+				deliver_to dummy
+			}
+		}`), "embed_test3.conf")
+	if err == nil {
+		t.Fatal("Start succeeded with a reference to the removed instance")
+	}
+
+	srv, err = StartReader(strings.NewReader(`
+		state_dir `+dir+`
+		runtime_dir `+dir+`
+
+		smtp tcp://`+addr+` {
+			hostname mx.example.org
+			tls off
+			deliver_to dummy
+		}`), "embed_test4.conf")
+	if err != nil {
+		t.Fatal("Start after Close failed:", err)
+	}
+	srv.Close()
+}
+
+func TestServerReload(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	dir := t.TempDir()
+	addrA := "127.0.0.1:" + freePort(t)
+	addrB := "127.0.0.1:" + freePort(t)
+	cfgText := func(rcpt string) string {
+		return `
+			state_dir ` + dir + `
+			runtime_dir ` + dir + `
+
+			table.file local_rcpts {
+				file ` + filepath.Join(dir, rcpt) + `
+			}
+
+			smtp tcp://` + addrA + ` {
+				hostname mx.example.org
+				tls off
+
+				destination_in &local_rcpts {
+					deliver_to dummy
+				}
+				default_destination {
+					reject
+				}
+			}
+
+			smtp tcp://` + addrB + ` {
+				hostname mx.example.org
+				tls off
+				deliver_to dummy
+			}`
+	}
+	parse := func(s string) []config.Node {
+		t.Helper()
+		cfg, err := parser.Read(strings.NewReader(s), "embed_test.conf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	session := func(addr string) *smtp.Client {
+		t.Helper()
+		c, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Hello("client.example.org"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Mail("sender@example.com", nil); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	for _, rcpt := range []string{"old@example.org", "new@example.org"} {
+		if err := os.WriteFile(filepath.Join(dir, rcpt), []byte(rcpt+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv, err := Start(parse(cfgText("old@example.org")))
+	if err != nil {
+		t.Fatal("Start:", err)
+	}
+	defer srv.Close()
+
+	oldA := session(addrA)
+	defer oldA.Close()
+	oldB := session(addrB)
+	defer oldB.Close()
+
+	status, err := srv.Reload(parse(cfgText("new@example.org")))
+	if err != nil {
+		t.Fatal("Reload:", err)
+	}
+	if want := []string{"local_rcpts", "smtp tcp://" + addrA}; !reflect.DeepEqual(status.Restarted, want) {
+		t.Fatalf("wrong list of restarted blocks: %v, want %v", status.Restarted, want)
+	}
+	if len(status.Removed) != 0 {
+		t.Fatal("unexpected removed blocks:", status.Removed)
+	}
+
+	// The session started before the reload uses the old configuration.
+	if err := oldA.Rcpt("old@example.org", nil); err != nil {
+		t.Fatal("Rcpt in the old session failed:", err)
+	}
+	if err := oldB.Rcpt("test@example.org", nil); err != nil {
+		t.Fatal("Rcpt in the unchanged endpoint failed:", err)
+	}
+
+	newA := session(addrA)
+	defer newA.Close()
+	if err := newA.Rcpt("new@example.org", nil); err != nil {
+		t.Fatal("Rcpt in the new session failed:", err)
+	}
+	if err := newA.Rcpt("old@example.org", nil); err == nil {
+		t.Fatal("Rcpt for the removed address succeeded")
+	}
+
+	status, err = srv.Reload(parse(cfgText("new@example.org")))
+	if err != nil {
+		t.Fatal("Reload without changes:", err)
+	}
+	if len(status.Restarted) != 0 || len(status.Removed) != 0 {
+		t.Fatal("blocks restarted without changes:", status)
+	}
+
+	// Invalid configuration is not applied.
+	if _, err := srv.Reload(parse(strings.Replace(cfgText("new@example.org"), "&local_rcpts", "&unknown_rcpts", 1))); err == nil {
+		t.Fatal("Reload with a reference to an unknown block succeeded")
+	}
+	c := session(addrA)
+	if err := c.Rcpt("new@example.org", nil); err != nil {
+		t.Fatal("Rcpt after failed reload failed:", err)
+	}
+	c.Close()
+
+	if _, err := srv.Reload(parse("hostname mx2.example.org\n" + cfgText("new@example.org"))); !errors.Is(err, ErrRestartRequired) {
+		t.Fatal("Reload with changed global directives returned unexpected error:", err)
+	}
+}
+
+func TestServerReload_IMAPStorage(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	dir := t.TempDir()
+	addr := "127.0.0.1:" + freePort(t)
+	cfgText := func(junkMbox string) string {
+		return `
+			state_dir ` + dir + `
+			runtime_dir ` + dir + `
+			tls off
+
+			auth.pass_table local_authdb {
+				table sql_table {
+					driver sqlite3
+					dsn credentials.db
+					table_name passwords
+				}
+			}
+
+			storage.imapsql local_mailboxes {
+				driver sqlite3
+				dsn imapsql.db
+				junk_mailbox ` + junkMbox + `
+			}
+
+			imap tcp://` + addr + ` {
+				auth &local_authdb
+				storage &local_mailboxes
+			}`
+	}
+	parse := func(s string) []config.Node {
+		t.Helper()
+		cfg, err := parser.Read(strings.NewReader(s), "embed_test.conf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	login := func() *imapclient.Client {
+		t.Helper()
+		c, err := imapclient.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Login("user@example.org", "password"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Select("INBOX", false); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	appendMsg := func(c *imapclient.Client) {
+		t.Helper()
+		msg := bytes.NewBufferString("Subject: Test\r\n\r\nHello\r\n")
+		if err := c.Append("INBOX", nil, time.Now(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitMessages := func(c *imapclient.Client, n uint32) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			if err := c.Noop(); err != nil {
+				t.Fatal(err)
+			}
+			if c.Mailbox().Messages == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d messages, got %d", n, c.Mailbox().Messages)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	srv, err := Start(parse(cfgText("Junk")))
+	if err != nil {
+		t.Fatal("Start:", err)
+	}
+	defer srv.Close()
+
+	authMod, err := module.GetInstance("local_authdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authMod.(module.PlainUserDB).CreateUser("user@example.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	storageMod, err := module.GetInstance("local_mailboxes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storageMod.(module.ManageableStorage).CreateIMAPAcct("user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	oldC := login()
+	defer oldC.Logout()
+
+	// The new storage instance takes over the update pipe socket while the
+	// old one is still used by the session started before the reload.
+	status, err := srv.Reload(parse(cfgText("Spam")))
+	if err != nil {
+		t.Fatal("Reload:", err)
+	}
+	if want := []string{"local_mailboxes", "imap tcp://" + addr}; !reflect.DeepEqual(status.Restarted, want) {
+		t.Fatalf("wrong list of restarted blocks: %v, want %v", status.Restarted, want)
+	}
+
+	newC := login()
+	defer newC.Logout()
+
+	// Both instances see changes made using the other one.
+	appendMsg(newC)
+	waitMessages(oldC, 1)
+	appendMsg(oldC)
+	waitMessages(newC, 2)
+
+	// Instances started by the next reload continue to receive updates
+	// from the old ones.
+	if _, err := srv.Reload(parse(cfgText("Junk"))); err != nil {
+		t.Fatal("Reload:", err)
+	}
+	lastC := login()
+	defer lastC.Logout()
+	appendMsg(oldC)
+	waitMessages(lastC, 3)
+	waitMessages(newC, 3)
+	appendMsg(lastC)
+	waitMessages(oldC, 4)
+}
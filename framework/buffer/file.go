@@ -74,12 +74,73 @@ func BufferInFile(r io.Reader, dir string) (Buffer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("buffer: failed to create file: %v", err)
 	}
-	if _, err = io.Copy(f, r); err != nil {
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		os.Remove(path)
 		return nil, fmt.Errorf("buffer: failed to write file: %v", err)
 	}
 	if err := f.Close(); err != nil {
+		os.Remove(path)
 		return nil, fmt.Errorf("buffer: failed to close file: %v", err)
 	}
 
-	return FileBuffer{Path: path}, nil
+	return FileBuffer{Path: path, LenHint: int(n)}, nil
+}
+
+// StoreInFile saves the buffer contents to the file at the specified path.
+//
+// If b is a FileBuffer and the target path is on the same file system, the
+// file is hard-linked instead of being copied so the message body is written
+// to the disk only once. The returned FileBuffer is independent of b and
+// remains valid after b.Remove is called.
+func StoreInFile(b Buffer, path string) (FileBuffer, error) {
+	if fb, ok := b.(FileBuffer); ok {
+		if err := os.Link(fb.Path, path); err == nil {
+			// The spool file is not synced when created.
+			if err := syncFile(path); err != nil {
+				os.Remove(path)
+				return FileBuffer{}, err
+			}
+			return FileBuffer{Path: path, LenHint: fb.LenHint}, nil
+		}
+		// Cross-device link or FS that does not support hard links,
+		// fallback to copying.
+	}
+
+	r, err := b.Open()
+	if err != nil {
+		return FileBuffer{}, err
+	}
+	defer r.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return FileBuffer{}, err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(path)
+		return FileBuffer{}, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(path)
+		return FileBuffer{}, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return FileBuffer{}, err
+	}
+
+	return FileBuffer{Path: path, LenHint: b.Len()}, nil
+}
+
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
 }
@@ -0,0 +1,16 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzParse(f *testing.F) {
+	for _, c := range cases {
+		f.Add(c.cfg)
+	}
+
+	f.Fuzz(func(t *testing.T, cfg string) {
+		_, _ = Parse(strings.NewReader(cfg), "fuzz.conf", nil)
+	})
+}
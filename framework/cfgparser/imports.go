@@ -19,7 +19,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package parser
 
 import (
-	"os"
+	"errors"
+	"io/fs"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -83,12 +84,13 @@ func (ctx *parseContext) resolveImport(node Node, name string, expansionDepth in
 	if !filepath.IsAbs(name) {
 		file = filepath.Join(filepath.Dir(ctx.fileLocation), name)
 	}
-	src, err := os.Open(file)
+	src, err := ctx.open(file)
 	if err != nil {
-		if os.IsNotExist(err) {
-			src, err = os.Open(file + ".conf")
+		if errors.Is(err, fs.ErrNotExist) {
+			file += ".conf"
+			src, err = ctx.open(file)
 			if err != nil {
-				if os.IsNotExist(err) {
+				if errors.Is(err, fs.ErrNotExist) {
 					return nil, NodeErr(node, "unknown import: %s", name)
 				}
 				return nil, err
@@ -97,7 +99,9 @@ func (ctx *parseContext) resolveImport(node Node, name string, expansionDepth in
 			return nil, err
 		}
 	}
-	nodes, snips, macros, err := readTree(src, file, expansionDepth+1)
+	defer src.Close()
+
+	nodes, snips, macros, err := readTree(src, file, ctx.open, expansionDepth+1)
 	if err != nil {
 		return nodes, err
 	}
@@ -23,6 +23,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"os"
 	"strings"
 	"unicode"
 
@@ -69,6 +71,7 @@ type parseContext struct {
 	macros   map[string][]string
 
 	fileLocation string
+	open         OpenFunc
 }
 
 func validateNodeName(s string) error {
@@ -348,13 +351,14 @@ func (ctx *parseContext) readNodes() ([]Node, error) {
 	return res, nil
 }
 
-func readTree(r io.Reader, location string, expansionDepth int) (nodes []Node, snips map[string][]Node, macros map[string][]string, err error) {
+func readTree(r io.Reader, location string, open OpenFunc, expansionDepth int) (nodes []Node, snips map[string][]Node, macros map[string][]string, err error) {
 	ctx := parseContext{
 		Dispenser:    lexer.NewDispenser(location, r),
 		snippets:     make(map[string][]Node),
 		macros:       map[string][]string{},
 		nesting:      -1,
 		fileLocation: location,
+		open:         open,
 	}
 
 	root := Node{}
@@ -384,8 +388,36 @@ func readTree(r io.Reader, location string, expansionDepth int) (nodes []Node, s
 	return root.Children, ctx.snippets, ctx.macros, nil
 }
 
+// OpenFunc is used to open files referenced by 'import' directives.
+type OpenFunc func(name string) (io.ReadCloser, error)
+
+func openFile(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func openNothing(string) (io.ReadCloser, error) {
+	return nil, fs.ErrNotExist
+}
+
+// Parse reads the configuration from r. Unlike Read, it does not access
+// the file system or environment: files referenced by 'import' directives
+// are opened using open (imports of files always fail if it is nil) and
+// {env:...} placeholders are not expanded.
+//
+// location is used in error messages and to resolve relative paths in
+// 'import' directives.
+func Parse(r io.Reader, location string, open OpenFunc) ([]Node, error) {
+	if open == nil {
+		open = openNothing
+	}
+	nodes, _, _, err := readTree(r, location, open, 0)
+	return nodes, err
+}
+
+// Read reads the configuration from r, importing files from the file
+// system and expanding environment variables.
 func Read(r io.Reader, location string) (nodes []Node, err error) {
-	nodes, _, _, err = readTree(r, location, 0)
+	nodes, err = Parse(r, location, openFile)
 	nodes = expandEnvironment(nodes)
 	return
 }
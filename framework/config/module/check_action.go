@@ -55,6 +55,8 @@ import (
 type FailAction struct {
 	Quarantine bool
 	Reject     bool
+	// Folder to put the message into if the check fails.
+	Folder string
 
 	ReasonOverride *exterrors.SMTPError
 }
@@ -87,6 +89,11 @@ func ParseActionDirective(args []string) (FailAction, error) {
 				return FailAction{}, err
 			}
 		}
+	case "folder":
+		if len(args) != 2 || args[1] == "" {
+			return FailAction{}, errors.New("folder action requires exactly one argument - folder name")
+		}
+		res.Folder = args[1]
 	case "ignore":
 	default:
 		return FailAction{}, errors.New("invalid action")
@@ -106,19 +113,40 @@ func (cfa FailAction) Apply(originalRes module.CheckResult) module.CheckResult {
 
 	if cfa.ReasonOverride != nil {
 		// Wrap instead of replace to preserve other fields.
+		checkName, _ := exterrors.Fields(originalRes.Reason)["check"].(string)
 		originalRes.Reason = &exterrors.SMTPError{
 			Code:         cfa.ReasonOverride.Code,
 			EnhancedCode: cfa.ReasonOverride.EnhancedCode,
-			Message:      cfa.ReasonOverride.Message,
+			Message:      expandReason(cfa.ReasonOverride.Message, originalRes.Reason),
+			CheckName:    checkName,
 			Err:          originalRes.Reason,
 		}
 	}
 
 	originalRes.Quarantine = cfa.Quarantine || originalRes.Quarantine
 	originalRes.Reject = cfa.Reject || originalRes.Reject
+	if originalRes.Folder == "" {
+		originalRes.Folder = cfa.Folder
+	}
 	return originalRes
 }
 
+// expandReason replaces the {reason} placeholder in the configured message
+// with the message the check would have returned.
+//
+// Other placeholders ({msg_id}, {contact_url}) are replaced by the endpoint
+// when the reply is sent.
+func expandReason(msg string, reason error) string {
+	if !strings.Contains(msg, "{reason}") {
+		return msg
+	}
+	origMsg, ok := exterrors.Fields(reason)["smtp_msg"].(string)
+	if !ok {
+		origMsg = "Message rejected due to a local policy"
+	}
+	return strings.ReplaceAll(msg, "{reason}", origMsg)
+}
+
 func ParseRejectDirective(args []string) (*exterrors.SMTPError, error) {
 	code := 554
 	enchCode := exterrors.EnhancedCode{0, 7, 0}
@@ -0,0 +1,59 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modconfig
+
+import (
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func TestFailAction_ApplyReasonOverride(t *testing.T) {
+	action, err := ParseActionDirective([]string{"reject", "550", "5.7.1", "{reason}, see {contact_url}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := action.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         450,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "DKIM signature is broken",
+			CheckName:    "verify_dkim",
+		},
+	})
+	if !res.Reject {
+		t.Fatal("Reject is not set")
+	}
+
+	fields := exterrors.Fields(res.Reason)
+	if fields["smtp_code"] != 550 {
+		t.Error("Wrong code:", fields["smtp_code"])
+	}
+	if fields["smtp_enchcode"] != (exterrors.EnhancedCode{5, 7, 1}) {
+		t.Error("Wrong enhanced code:", fields["smtp_enchcode"])
+	}
+	if fields["smtp_msg"] != "DKIM signature is broken, see {contact_url}" {
+		t.Error("Wrong message:", fields["smtp_msg"])
+	}
+	if fields["check"] != "verify_dkim" {
+		t.Error("Check name is lost:", fields["check"])
+	}
+}
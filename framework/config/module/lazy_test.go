@@ -0,0 +1,120 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modconfig
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+type lazyTestTable struct {
+	instName string
+	inits    int
+	initErr  error
+}
+
+func (t *lazyTestTable) Name() string {
+	return "table.lazy_test"
+}
+
+func (t *lazyTestTable) InstanceName() string {
+	return t.instName
+}
+
+func (t *lazyTestTable) Init(*config.Map) error {
+	t.inits++
+	return t.initErr
+}
+
+func (t *lazyTestTable) Lookup(_ context.Context, key string) (string, bool, error) {
+	return key + "-value", true, nil
+}
+
+func TestModuleFromNode_Lazy(t *testing.T) {
+	tbl := &lazyTestTable{instName: "lazy_table_test"}
+	module.RegisterInstance(tbl, config.NewMap(nil, config.Node{}))
+	module.SetLazy(tbl.instName)
+
+	var ref module.Table
+	if err := ModuleFromNode("table", []string{"&lazy_table_test"}, config.Node{}, nil, &ref); err != nil {
+		t.Fatal(err)
+	}
+	if tbl.inits != 0 {
+		t.Fatal("lazy module is initialized on reference")
+	}
+	if !module.LazyReferenced(tbl.instName) {
+		t.Error("lazy module is not marked as referenced")
+	}
+
+	val, ok, err := ref.Lookup(context.Background(), "a")
+	if err != nil || !ok || val != "a-value" {
+		t.Fatal("unexpected lookup result:", val, ok, err)
+	}
+	vals, err := ref.(module.MultiTable).LookupMulti(context.Background(), "b")
+	if err != nil || len(vals) != 1 || vals[0] != "b-value" {
+		t.Fatal("unexpected lookup result:", vals, err)
+	}
+	if tbl.inits != 1 {
+		t.Error("Init called", tbl.inits, "times")
+	}
+}
+
+func TestModuleFromNode_LazyFail(t *testing.T) {
+	tbl := &lazyTestTable{instName: "lazy_table_fail_test", initErr: errors.New("connection refused")}
+	module.RegisterInstance(tbl, config.NewMap(nil, config.Node{}))
+	module.SetLazy(tbl.instName)
+
+	var ref module.Table
+	if err := ModuleFromNode("table", []string{"&lazy_table_fail_test"}, config.Node{}, nil, &ref); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		_, _, err := ref.Lookup(context.Background(), "a")
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if !exterrors.IsTemporary(err) {
+			t.Error("initialization error is not temporary:", err)
+		}
+	}
+	if tbl.inits != 1 {
+		t.Error("Init called", tbl.inits, "times")
+	}
+}
+
+func TestModuleFromNode_LazyUnsupported(t *testing.T) {
+	tbl := &lazyTestTable{instName: "lazy_module_test"}
+	module.RegisterInstance(tbl, config.NewMap(nil, config.Node{}))
+	module.SetLazy(tbl.instName)
+
+	// Lazy initialization is supported only for tables, other modules are
+	// initialized immediately.
+	var ref module.Module
+	if err := ModuleFromNode("table", []string{"&lazy_module_test"}, config.Node{}, nil, &ref); err != nil {
+		t.Fatal(err)
+	}
+	if tbl.inits != 1 {
+		t.Error("Init called", tbl.inits, "times")
+	}
+}
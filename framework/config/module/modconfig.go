@@ -27,6 +27,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package modconfig
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"reflect"
@@ -52,8 +53,10 @@ func createInlineModule(preferredNamespace, modName string, args []string) (modu
 	}
 
 	// Then try global namespace for compatibility and complex modules.
+	resolvedName := modName
 	if newMod == nil {
 		newMod = module.Get(originalModName)
+		resolvedName = originalModName
 	}
 
 	// Bail if both failed.
@@ -61,6 +64,10 @@ func createInlineModule(preferredNamespace, modName string, args []string) (modu
 		return nil, fmt.Errorf("unknown module: %s (namespace: %s)", originalModName, preferredNamespace)
 	}
 
+	if err := module.CheckProfile(resolvedName); err != nil {
+		return nil, err
+	}
+
 	return newMod(modName, "", nil, args)
 }
 
@@ -112,18 +119,31 @@ func ModuleFromNode(preferredNamespace string, args []string, inlineCfg config.N
 	referenceExisting := strings.HasPrefix(args[0], "&")
 
 	var modObj module.Module
+	var optional bool
 	var err error
 	if referenceExisting {
 		if len(args) != 1 || inlineCfg.Children != nil {
 			return parser.NodeErr(inlineCfg, "exactly one argument is required to use existing config block")
 		}
+		if module.IsLazy(args[0][1:]) && lazyReference(args[0][1:], inlineCfg, moduleIface) {
+			log.Debugf("%s:%d: lazy reference %s", inlineCfg.File, inlineCfg.Line, args[0])
+			return nil
+		}
 		modObj, err = module.GetInstance(args[0][1:])
 		log.Debugf("%s:%d: reference %s", inlineCfg.File, inlineCfg.Line, args[0])
 	} else {
 		log.Debugf("%s:%d: new module %s %v", inlineCfg.File, inlineCfg.Line, args[0], args[1:])
+		inlineCfg, optional, err = module.ParseOptional(inlineCfg)
+		if err != nil {
+			return err
+		}
 		modObj, err = createInlineModule(preferredNamespace, args[0], args[1:])
 	}
 	if err != nil {
+		var profileErr *module.ProfileError
+		if errors.As(err, &profileErr) {
+			return parser.NodeErr(inlineCfg, "%v", err)
+		}
 		return err
 	}
 
@@ -141,17 +161,39 @@ func ModuleFromNode(preferredNamespace string, args []string, inlineCfg config.N
 		return parser.NodeErr(inlineCfg, "module %s (%s) is not %v", modObj.Name(), modObj.InstanceName(), modIfaceType)
 	}
 
-	reflect.ValueOf(moduleIface).Elem().Set(reflect.ValueOf(modObj))
-
 	if !referenceExisting {
 		if err := initInlineModule(modObj, globals, inlineCfg); err != nil {
+			if optional {
+				return module.DisableOptional(modObj, err)
+			}
 			return err
 		}
 	}
 
+	reflect.ValueOf(moduleIface).Elem().Set(reflect.ValueOf(modObj))
+
 	return nil
 }
 
+// lazyReference stores the proxy object that initializes the module
+// instance on first use into moduleIface, if it is supported for the module
+// interface. Otherwise, false is returned and the module is initialized as
+// usual.
+func lazyReference(name string, node config.Node, moduleIface interface{}) bool {
+	switch ptr := moduleIface.(type) {
+	case *module.Table:
+		*ptr = module.LazyTable(name)
+		return true
+	case *module.MultiTable:
+		*ptr = module.LazyTable(name).(module.MultiTable)
+		return true
+	}
+
+	log.Printf("%s:%d: lazy initialization is not supported for %v, %s is initialized on start-up",
+		node.File, node.Line, reflect.TypeOf(moduleIface).Elem(), name)
+	return false
+}
+
 // GroupFromNode provides a special kind of ModuleFromNode syntax that allows
 // to omit the module name when defining inine configuration.  If it is not
 // present, name in defaultModule is used.
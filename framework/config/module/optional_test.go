@@ -0,0 +1,123 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modconfig
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+type failingModule struct {
+	module.Dummy
+	instName string
+	inits    int
+}
+
+func (m *failingModule) InstanceName() string {
+	return m.instName
+}
+
+func (m *failingModule) Init(cfg *config.Map) error {
+	m.inits++
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	return errors.New("connection refused")
+}
+
+func TestModuleFromNode_Optional(t *testing.T) {
+	module.Register("target.optional_test", func(_, instName string, _, _ []string) (module.Module, error) {
+		return &failingModule{instName: instName}, nil
+	})
+
+	test := func(name string, children []config.Node, disabled bool) {
+		t.Helper()
+		node := config.Node{Name: "deliver_to", Args: []string{"optional_test"}, Children: children}
+
+		var tgt module.DeliveryTarget
+		err := ModuleFromNode("target", node.Args, node, nil, &tgt)
+		if err == nil {
+			t.Fatal(name, ": expected an error")
+		}
+		if errors.Is(err, module.ErrDisabled) != disabled {
+			t.Error(name, ": unexpected error:", err)
+		}
+		if disabled && tgt != nil {
+			t.Error(name, ": disabled module is returned")
+		}
+	}
+
+	test("not optional", nil, false)
+	test("optional", []config.Node{{Name: "optional"}}, true)
+	test("optional yes", []config.Node{{Name: "optional", Args: []string{"yes"}}}, true)
+	test("optional no", []config.Node{{Name: "optional", Args: []string{"no"}}}, false)
+}
+
+func TestModuleFromNode_OptionalInstance(t *testing.T) {
+	mod := &failingModule{instName: "optional_instance_test"}
+	module.RegisterInstance(mod, config.NewMap(nil, config.Node{}))
+	module.SetOptional(mod.instName)
+
+	for i := 0; i < 2; i++ {
+		var tgt module.DeliveryTarget
+		err := ModuleFromNode("target", []string{"&optional_instance_test"}, config.Node{}, nil, &tgt)
+		if !errors.Is(err, module.ErrDisabled) {
+			t.Fatal("expected ErrDisabled, got", err)
+		}
+	}
+	if mod.inits != 1 {
+		t.Error("Init called", mod.inits, "times")
+	}
+}
+
+func TestParseOptional(t *testing.T) {
+	block := config.Node{
+		Name: "rspamd",
+		Children: []config.Node{
+			{Name: "api_path", Args: []string{"http://127.0.0.1:11333"}},
+			{Name: "optional"},
+		},
+	}
+	stripped, optional, err := module.ParseOptional(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !optional {
+		t.Error("module is not optional")
+	}
+	if len(stripped.Children) != 1 || stripped.Children[0].Name != "api_path" {
+		t.Error("optional directive is not removed:", stripped.Children)
+	}
+	if len(block.Children) != 2 {
+		t.Error("original block is modified")
+	}
+
+	for _, bad := range [][]config.Node{
+		{{Name: "optional", Args: []string{"maybe"}}},
+		{{Name: "optional"}, {Name: "optional"}},
+		{{Name: "optional", Args: []string{"yes", "no"}}},
+	} {
+		if _, _, err := module.ParseOptional(config.Node{Children: bad}); err == nil {
+			t.Error("expected an error for", bad)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modconfig
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func TestModuleFromNode_Profile(t *testing.T) {
+	module.Register("storage.profile_test", func(_, instName string, _, _ []string) (module.Module, error) {
+		return &module.Dummy{}, nil
+	})
+	defer func() { module.CurrentProfile = module.ProfileFull }()
+
+	node := config.Node{Name: "deliver_to", Args: []string{"profile_test"}, File: "maddy.conf", Line: 10}
+
+	var tgt module.DeliveryTarget
+	if err := ModuleFromNode("storage", node.Args, node, nil, &tgt); err != nil {
+		t.Fatal("full profile:", err)
+	}
+	module.CurrentProfile = module.ProfileInbound
+	if err := ModuleFromNode("storage", node.Args, node, nil, &tgt); err != nil {
+		t.Fatal("inbound profile:", err)
+	}
+
+	module.CurrentProfile = module.ProfileOutbound
+	err := ModuleFromNode("storage", node.Args, node, nil, &tgt)
+	if err == nil || !strings.Contains(err.Error(), "outbound profile") {
+		t.Fatal("expected profile error, got", err)
+	}
+	if !strings.HasPrefix(err.Error(), "maddy.conf:10: ") {
+		t.Error("error does not include the location:", err)
+	}
+}
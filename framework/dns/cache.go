@@ -0,0 +1,174 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dns
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/ttlcache"
+	"github.com/miekg/dns"
+)
+
+// Cache stores DNS responses received by ExtResolver for the duration of
+// their TTL.
+//
+// Negative responses (NXDOMAIN and empty answers) are cached for the
+// duration specified by the SOA record in the authority section (RFC 2308),
+// but no longer than NegativeTTL. Other errors are not cached.
+type Cache struct {
+	// MaxEntries is the maximum amount of cached responses, least recently
+	// used ones are removed first. It is applied by NewCache, changing it
+	// later has no effect.
+	MaxEntries int
+	// MaxTTL limits the time responses are cached for.
+	MaxTTL time.Duration
+	// NegativeTTL limits the time negative responses are cached for. If it
+	// is zero, negative responses are not cached.
+	NegativeTTL time.Duration
+
+	entries *ttlcache.Cache[cacheKey, *dns.Msg]
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+// CacheStats contains Cache usage counters.
+type CacheStats struct {
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+func NewCache(maxEntries int, maxTTL, negativeTTL time.Duration) *Cache {
+	return &Cache{
+		MaxEntries:  maxEntries,
+		MaxTTL:      maxTTL,
+		NegativeTTL: negativeTTL,
+		entries:     ttlcache.New[cacheKey, *dns.Msg](maxEntries),
+	}
+}
+
+var (
+	sharedCache    *Cache
+	sharedCacheLck sync.RWMutex
+)
+
+// SetSharedCache sets the cache used by ExtResolver instances created
+// after the call. nil disables caching.
+func SetSharedCache(c *Cache) {
+	sharedCacheLck.Lock()
+	defer sharedCacheLck.Unlock()
+	sharedCache = c
+}
+
+// SharedCache returns the cache set using SetSharedCache.
+func SharedCache() *Cache {
+	sharedCacheLck.RLock()
+	defer sharedCacheLck.RUnlock()
+	return sharedCache
+}
+
+func keyFor(q dns.Question) cacheKey {
+	return cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype}
+}
+
+func (c *Cache) get(q dns.Question) (*dns.Msg, bool) {
+	resp, ok := c.entries.Get(keyFor(q))
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return resp, true
+}
+
+// put stores the response if it is cacheable.
+func (c *Cache) put(resp *dns.Msg) {
+	if len(resp.Question) != 1 {
+		return
+	}
+	ttl, ok := c.ttlFor(resp)
+	if !ok {
+		return
+	}
+	c.entries.Put(keyFor(resp.Question[0]), resp, ttl)
+}
+
+func (c *Cache) ttlFor(resp *dns.Msg) (time.Duration, bool) {
+	negative := resp.Rcode == dns.RcodeNameError || (resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0)
+	if negative {
+		if c.NegativeTTL == 0 {
+			return 0, false
+		}
+		for _, rr := range resp.Ns {
+			soa, ok := rr.(*dns.SOA)
+			if !ok {
+				continue
+			}
+			ttl := time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+			return min(ttl, c.NegativeTTL), true
+		}
+		// No SOA - the response should not be cached (RFC 2308 Section 5).
+		return 0, false
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return 0, false
+	}
+
+	ttl := time.Duration(resp.Answer[0].Header().Ttl) * time.Second
+	for _, rr := range resp.Answer[1:] {
+		ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+	}
+	if c.MaxTTL != 0 {
+		ttl = min(ttl, c.MaxTTL)
+	}
+	return ttl, true
+}
+
+// Purge removes cached responses for the domain and its subdomains (e.g.
+// TLSA records stored under _25._tcp.mx.example.org are removed when
+// purging mx.example.org). If domain is empty, all responses are removed.
+//
+// It returns the amount of removed entries.
+func (c *Cache) Purge(domain string) int {
+	if domain == "" {
+		return c.entries.Clear()
+	}
+
+	fqdn := strings.ToLower(dns.Fqdn(domain))
+	return c.entries.RemoveFunc(func(key cacheKey) bool {
+		return key.name == fqdn || strings.HasSuffix(key.name, "."+fqdn)
+	})
+}
+
+func (c *Cache) Stats() CacheStats {
+	return CacheStats{
+		Entries: c.entries.Len(),
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+	}
+}
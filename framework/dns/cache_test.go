@@ -0,0 +1,152 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type cacheTestServer struct {
+	udpServ dns.Server
+	queries atomic.Int32
+}
+
+func (s *cacheTestServer) ServeDNS(w dns.ResponseWriter, m *dns.Msg) {
+	s.queries.Add(1)
+	q := m.Question[0]
+
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	switch q.Name {
+	case "example.org.":
+		reply.Answer = append(reply.Answer, &dns.MX{
+			Hdr:        dns.RR_Header{Name: q.Name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: 300},
+			Preference: 10,
+			Mx:         "mx.example.org.",
+		}, &dns.MX{
+			Hdr:        dns.RR_Header{Name: q.Name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: 60},
+			Preference: 20,
+			Mx:         "mx2.example.org.",
+		})
+	case "nxdomain.example.org.":
+		reply.Rcode = dns.RcodeNameError
+		reply.Ns = append(reply.Ns, &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns:     "ns.example.org.",
+			Mbox:   "hostmaster.example.org.",
+			Minttl: 1800,
+		})
+	case "servfail.example.org.":
+		reply.Rcode = dns.RcodeServerFailure
+	default:
+		reply.Answer = append(reply.Answer, &dns.MX{
+			Hdr:        dns.RR_Header{Name: q.Name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: 300},
+			Preference: 10,
+			Mx:         "mx." + q.Name,
+		})
+	}
+
+	if err := w.WriteMsg(reply); err != nil {
+		panic(err)
+	}
+}
+
+func testCachingResolver(t *testing.T, c *Cache) (*ExtResolver, *cacheTestServer) {
+	t.Helper()
+
+	s := &cacheTestServer{}
+	pconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.udpServ.PacketConn = pconn
+	s.udpServ.Handler = s
+	go s.udpServ.ActivateAndServe() //nolint:errcheck
+	t.Cleanup(func() { pconn.Close() })
+
+	res := &ExtResolver{
+		cl: new(dns.Client),
+		Cfg: &dns.ClientConfig{
+			Servers: []string{"127.0.0.1"},
+			Port:    strconv.Itoa(pconn.LocalAddr().(*net.UDPAddr).Port),
+			Timeout: 1,
+		},
+		cache: c,
+	}
+	res.cl.Dialer = &net.Dialer{Timeout: 500 * time.Millisecond}
+	return res, s
+}
+
+func TestCache(t *testing.T) {
+	now := time.Now()
+	c := NewCache(10, time.Hour, 5*time.Minute)
+	c.entries.SetClock(func() time.Time { return now })
+	res, s := testCachingResolver(t, c)
+	ctx := context.Background()
+
+	lookup := func(name string, wantQueries int32, wantErr bool) {
+		t.Helper()
+		_, mxs, err := res.AuthLookupMX(ctx, name)
+		if (err != nil) != wantErr {
+			t.Fatal("unexpected error:", err)
+		}
+		if !wantErr && len(mxs) == 0 {
+			t.Fatal("no records returned")
+		}
+		if q := s.queries.Load(); q != wantQueries {
+			t.Fatalf("%d queries sent to the server, want %d", q, wantQueries)
+		}
+	}
+
+	lookup("example.org", 1, false)
+	lookup("EXAMPLE.ORG", 1, false)
+
+	// The smallest TTL in the response is used.
+	now = now.Add(59 * time.Second)
+	lookup("example.org", 1, false)
+	now = now.Add(time.Second)
+	lookup("example.org", 2, false)
+
+	// Negative TTL is limited to 5 minutes.
+	lookup("nxdomain.example.org", 3, true)
+	lookup("nxdomain.example.org", 3, true)
+	now = now.Add(5 * time.Minute)
+	lookup("nxdomain.example.org", 4, true)
+
+	lookup("servfail.example.org", 5, true)
+	lookup("servfail.example.org", 6, true)
+
+	if stats := c.Stats(); stats.Hits != 3 || stats.Entries != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	if n := c.Purge("nxdomain.example.org"); n != 1 {
+		t.Errorf("Purge removed %d entries, want 1", n)
+	}
+	lookup("nxdomain.example.org", 7, true)
+	lookup("example.org", 8, false)
+	lookup("example.org", 8, false)
+	if n := c.Purge("org"); n != 2 {
+		t.Errorf("Purge removed %d entries, want 2", n)
+	}
+	lookup("example.org", 9, false)
+
+	// Least recently used entries are evicted.
+	for i := 0; i < 10; i++ {
+		lookup("d"+strconv.Itoa(i)+".example.net", int32(10+i), false)
+	}
+	if stats := c.Stats(); stats.Entries != 10 {
+		t.Errorf("cache contains %d entries, want 10", stats.Entries)
+	}
+	lookup("d9.example.net", 19, false)
+	lookup("example.org", 20, false)
+
+	if n := c.Purge(""); n != 10 {
+		t.Errorf("Purge removed %d entries, want 10", n)
+	}
+}
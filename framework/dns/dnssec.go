@@ -35,8 +35,9 @@ type TLSA = dns.TLSA
 // access to certain low-level functionality (notably, AD flag in responses,
 // indicating whether DNSSEC verification was performed by the server).
 type ExtResolver struct {
-	cl  *dns.Client
-	Cfg *dns.ClientConfig
+	cl    *dns.Client
+	Cfg   *dns.ClientConfig
+	cache *Cache
 }
 
 // RCodeError is returned by ExtResolver when the RCODE in response is not
@@ -85,6 +86,15 @@ func isLoopback(addr string) bool {
 }
 
 func (e ExtResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if e.cache != nil {
+		if resp, ok := e.cache.get(msg.Question[0]); ok {
+			if resp.Rcode != dns.RcodeSuccess {
+				return resp, RCodeError{msg.Question[0].Name, resp.Rcode}
+			}
+			return resp, nil
+		}
+	}
+
 	var resp *dns.Msg
 	var lastErr error
 	for _, srv := range e.Cfg.Servers {
@@ -107,6 +117,10 @@ func (e ExtResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 
 		break
 	}
+
+	if e.cache != nil && resp != nil && (lastErr == nil || IsNotFound(lastErr)) {
+		e.cache.put(resp)
+	}
 	return resp, lastErr
 }
 
@@ -397,7 +411,8 @@ func NewExtResolver() (*ExtResolver, error) {
 		Timeout: time.Duration(cfg.Timeout) * time.Second,
 	}
 	return &ExtResolver{
-		cl:  cl,
-		Cfg: cfg,
+		cl:    cl,
+		Cfg:   cfg,
+		cache: SharedCache(),
 	}, nil
 }
@@ -0,0 +1,94 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package exterrors
+
+import (
+	"strings"
+)
+
+// ID is the maddy-specific identifier of the error cause, e.g. MDY-Q001.
+//
+// IDs are included in SMTP replies, DSNs and logs so reports containing
+// only the text returned to the client can be matched to the precise
+// cause. Each ID is documented at DocsURL.
+type ID string
+
+const (
+	// SMTP endpoint.
+	IDSMTPInternal ID = "MDY-S001"
+	IDSMTPDeadline ID = "MDY-S002"
+
+	// Queue.
+	IDQueueInternal ID = "MDY-Q001"
+
+	// Message storage.
+	IDStorageInternal    ID = "MDY-T001"
+	IDStorageQuota       ID = "MDY-T002"
+	IDLocalDiskFull      ID = "MDY-T003"
+	IDStorageUnavailable ID = "MDY-T004"
+
+	// Network connections to other servers used for delivery.
+	IDBackendConnection ID = "MDY-N001"
+
+	// Table lookups.
+	IDLookupFailed ID = "MDY-L001"
+
+	// Message checks.
+	IDCheckCommand ID = "MDY-C001"
+)
+
+// Catalog contains the short description for each known ID.
+var Catalog = map[ID]string{
+	IDSMTPInternal:       "Unexpected error without SMTP status during message processing",
+	IDSMTPDeadline:       "Message processing took longer than allowed",
+	IDQueueInternal:      "Unexpected error without SMTP status during delivery attempt",
+	IDStorageInternal:    "Message storage database error",
+	IDStorageQuota:       "Storage size limit reached",
+	IDLocalDiskFull:      "Server ran out of disk space",
+	IDStorageUnavailable: "Local storage or its database is unavailable",
+	IDBackendConnection:  "Connection to the backend server failed",
+	IDLookupFailed:       "Table lookup failed, the recipient cannot be routed",
+	IDCheckCommand:       "check.command failed to execute the command",
+}
+
+// DocsBaseURL is the address of the page listing all IDs.
+const DocsBaseURL = "https://maddy.email/reference/errors/"
+
+// DocsURL returns the link to the documentation for the ID.
+func DocsURL(id ID) string {
+	return DocsBaseURL + "#" + strings.ToLower(string(id))
+}
+
+// WithID attaches the ID to err, it is reported in the error_id field.
+func WithID(err error, id ID) error {
+	return WithFields(err, map[string]interface{}{"error_id": id})
+}
+
+// IDOf returns the ID attached to err or any of the errors it wraps, empty
+// string if there is none.
+func IDOf(err error) ID {
+	id, _ := Fields(err)["error_id"].(ID)
+	return id
+}
+
+// ReplySuffix returns the text to append to the message returned to the
+// client to reference the ID.
+func ReplySuffix(id ID) string {
+	return "[" + string(id) + " " + DocsURL(id) + "]"
+}
@@ -80,6 +80,9 @@ type SMTPError struct {
 	// Err.Error() value if Err is not nil, empty string otherwise.
 	Reason string
 
+	// maddy-specific identifier of the error cause, see Catalog.
+	ErrorID ID
+
 	Misc map[string]interface{}
 }
 
@@ -101,6 +104,9 @@ func (se *SMTPError) Fields() map[string]interface{} {
 	if se.TargetName != "" {
 		ctx["target"] = se.TargetName
 	}
+	if se.ErrorID != "" {
+		ctx["error_id"] = se.ErrorID
+	}
 	if se.Reason != "" {
 		ctx["reason"] = se.Reason
 	} else if se.Err != nil {
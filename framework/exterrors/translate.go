@@ -0,0 +1,102 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package exterrors
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io/fs"
+	"net"
+	"syscall"
+)
+
+// Translate returns the SMTP status for err if it does not have one but
+// belongs to a well-known class of local failures, such as disk space
+// exhaustion or a lost connection to the storage database or LMTP server.
+//
+// The returned error wraps err and has ErrorID set. nil is returned if err
+// already has SMTP status or is not recognized. Callers should use the
+// generic "Internal server error" reply then.
+//
+// All recognized failures are temporary, so the result does not change how
+// the error is handled, only what is reported to the client.
+func Translate(err error) *SMTPError {
+	if err == nil {
+		return nil
+	}
+	if _, ok := Fields(err)["smtp_code"]; ok {
+		return nil
+	}
+
+	switch {
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return &SMTPError{
+			Code:         452,
+			EnhancedCode: EnhancedCode{4, 3, 1},
+			Message:      "Insufficient system storage, try again later",
+			Err:          err,
+			ErrorID:      IDLocalDiskFull,
+		}
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone):
+		return &SMTPError{
+			Code:         451,
+			EnhancedCode: EnhancedCode{4, 3, 0},
+			Message:      "Storage is temporarily unavailable, try again later",
+			Err:          err,
+			ErrorID:      IDStorageUnavailable,
+		}
+	case isConnError(err):
+		return &SMTPError{
+			Code:         451,
+			EnhancedCode: EnhancedCode{4, 4, 2},
+			Message:      "Connection to the backend server failed, try again later",
+			Err:          err,
+			ErrorID:      IDBackendConnection,
+		}
+	}
+
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return &SMTPError{
+			Code:         451,
+			EnhancedCode: EnhancedCode{4, 3, 0},
+			Message:      "Local storage error, try again later",
+			Err:          err,
+			ErrorID:      IDStorageUnavailable,
+		}
+	}
+
+	return nil
+}
+
+// isConnError reports whether err indicates that the network connection
+// was closed or could not be established.
+func isConnError(err error) bool {
+	// io.EOF is not included since it is also returned when the client
+	// closes the connection, modules talking to other servers should
+	// annotate it themselves.
+	if errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
@@ -0,0 +1,69 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package exterrors
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestTranslate(t *testing.T) {
+	for _, case_ := range []struct {
+		err  error
+		code int
+		id   ID
+	}{
+		{fmt.Errorf("write: %w", syscall.ENOSPC), 452, IDLocalDiskFull},
+		{&os.PathError{Op: "open", Path: "/var/lib/maddy/x", Err: syscall.EDQUOT}, 452, IDLocalDiskFull},
+		{&os.PathError{Op: "open", Path: "/var/lib/maddy/x", Err: syscall.EACCES}, 451, IDStorageUnavailable},
+		{fmt.Errorf("query: %w", driver.ErrBadConn), 451, IDStorageUnavailable},
+		{&net.OpError{Op: "dial", Net: "unix", Err: syscall.ECONNREFUSED}, 451, IDBackendConnection},
+		{fmt.Errorf("write: %w", syscall.EPIPE), 451, IDBackendConnection},
+		{errors.New("something broke"), 0, ""},
+		{io.EOF, 0, ""},
+		{WithTemporary(&SMTPError{Code: 550, Err: syscall.ENOSPC}, false), 0, ""},
+	} {
+		tErr := Translate(case_.err)
+		if case_.code == 0 {
+			if tErr != nil {
+				t.Errorf("%v: unexpected translation: %d %s", case_.err, tErr.Code, tErr.ErrorID)
+			}
+			continue
+		}
+		if tErr == nil {
+			t.Errorf("%v: not translated", case_.err)
+			continue
+		}
+		if tErr.Code != case_.code || tErr.ErrorID != case_.id {
+			t.Errorf("%v: wrong translation: %d %s", case_.err, tErr.Code, tErr.ErrorID)
+		}
+		if !IsTemporary(tErr) {
+			t.Errorf("%v: translated error is not temporary", case_.err)
+		}
+		if !errors.Is(tErr, case_.err) {
+			t.Errorf("%v: translated error does not wrap the original one", case_.err)
+		}
+	}
+}
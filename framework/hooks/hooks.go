@@ -30,9 +30,9 @@ const (
 	// signal (on POSIX platforms) and indicates the request to reload the
 	// server configuration from persistent storage.
 	//
-	// Since it is by design problematic to reload the modules configuration,
-	// this event only applies to secondary files such as aliases mapping and
-	// TLS certificates.
+	// This event only applies to secondary files such as aliases mapping and
+	// TLS certificates. Changes to the modules configuration are applied on
+	// SIGHUP by replacing changed module instances.
 	EventReload
 
 	// EventLogRotate is triggered when the server process receives the SIGUSR1
@@ -41,9 +41,17 @@ const (
 	EventLogRotate
 )
 
+type hook struct {
+	owner interface{}
+	f     func()
+}
+
 var (
-	hooks    = make(map[Event][]func())
+	hooks    = make(map[Event][]hook)
 	hooksLck sync.Mutex
+
+	// owner is attributed to hooks installed by AddHook, see WithOwner.
+	owner interface{}
 )
 
 func hooksToRun(eventName Event) []func() {
@@ -57,7 +65,9 @@ func hooksToRun(eventName Event) []func() {
 	// The slice is copied so hooks can be run without holding the lock what
 	// might be important since they are likely to do a lot of I/O.
 	hooksEvCpy := make([]func(), 0, len(hooksEv))
-	hooksEvCpy = append(hooksEvCpy, hooksEv...)
+	for _, h := range hooksEv {
+		hooksEvCpy = append(hooksEvCpy, h.f)
+	}
 
 	return hooksEvCpy
 }
@@ -76,5 +86,80 @@ func AddHook(eventName Event, f func()) {
 	hooksLck.Lock()
 	defer hooksLck.Unlock()
 
-	hooks[eventName] = append(hooks[eventName], f)
+	hooks[eventName] = append(hooks[eventName], hook{owner: owner, f: f})
+}
+
+// WithOwner calls f and attributes all hooks installed while it runs to
+// owner so they can be removed using Detach.
+//
+// It is used to track hooks installed by module instances during
+// initialization. Calls can be nested, the innermost owner is used.
+func WithOwner(o interface{}, f func() error) error {
+	hooksLck.Lock()
+	prev := owner
+	owner = o
+	hooksLck.Unlock()
+
+	defer func() {
+		hooksLck.Lock()
+		owner = prev
+		hooksLck.Unlock()
+	}()
+
+	return f()
+}
+
+// Detach removes all hooks installed by the specified owners and returns
+// their EventShutdown hooks in the order they should be run.
+//
+// It is used when module instances are replaced during configuration
+// reload.
+func Detach(owners ...interface{}) []func() {
+	hooksLck.Lock()
+	defer hooksLck.Unlock()
+
+	isOwned := func(h hook) bool {
+		for _, o := range owners {
+			if h.owner == o {
+				return true
+			}
+		}
+		return false
+	}
+
+	var shutdown []func()
+	for eventName, hooksEv := range hooks {
+		kept := hooksEv[:0]
+		for _, h := range hooksEv {
+			if h.owner == nil || !isOwned(h) {
+				kept = append(kept, h)
+				continue
+			}
+			if eventName == EventShutdown {
+				shutdown = append(shutdown, h.f)
+			}
+		}
+		hooks[eventName] = kept
+	}
+
+	// Same order as RunHooks.
+	for i, j := 0, len(shutdown)-1; i < j; i, j = i+1, j-1 {
+		shutdown[i], shutdown[j] = shutdown[j], shutdown[i]
+	}
+	return shutdown
+}
+
+// Reset removes all installed hooks and notification handlers.
+//
+// It is used once the server is stopped to allow starting a new one in the
+// same process.
+func Reset() {
+	hooksLck.Lock()
+	hooks = make(map[Event][]hook)
+	owner = nil
+	hooksLck.Unlock()
+
+	notifyHandlersLck.Lock()
+	notifyHandlers = nil
+	notifyHandlersLck.Unlock()
 }
@@ -0,0 +1,127 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package hooks
+
+import "sync"
+
+// Notifications are events interesting for the server operator. Unlike
+// Event hooks, they are not used for the server operation and can be
+// passed to external programs (see the global 'hook' directive).
+const (
+	// NotifyCertReload is sent when the TLS certificate is replaced with
+	// a new one.
+	//
+	// Parameters: module.
+	NotifyCertReload = "cert_reload"
+
+	// NotifyReloadFailed is sent when the module fails to reload its
+	// configuration files.
+	//
+	// Parameters: module, error.
+	NotifyReloadFailed = "reload_failed"
+
+	// NotifyBacklogEnter is sent when the amount of messages in the queue
+	// reaches the configured threshold.
+	//
+	// Parameters: module, length, threshold.
+	NotifyBacklogEnter = "queue_backlog_enter"
+
+	// NotifyBacklogLeave is sent when the queue leaves the backlog state.
+	//
+	// Parameters: module, length, threshold.
+	NotifyBacklogLeave = "queue_backlog_leave"
+
+	// NotifyAccountCreated is sent when the storage account is created.
+	//
+	// Parameters: module, username, welcome ("no" if the welcome message
+	// is disabled by the account template).
+	NotifyAccountCreated = "account_created"
+
+	// NotifyNewLoginLocation is sent when the account logs in from the
+	// IP address or country not seen before.
+	//
+	// Parameters: module, username, protocol, ip, country.
+	NotifyNewLoginLocation = "login_new_location"
+
+	// NotifyPasswordChanged is sent when the account password is changed.
+	//
+	// Parameters: module, username.
+	NotifyPasswordChanged = "password_changed"
+
+	// NotifyDKIMKeyPublished is sent when a new DKIM key is generated during
+	// key rotation and its record should be added to DNS.
+	//
+	// Parameters: module, domain, selector, record.
+	NotifyDKIMKeyPublished = "dkim_key_published"
+
+	// NotifyDKIMKeyRemoved is sent when a retired DKIM key is deleted and
+	// its record can be removed from DNS.
+	//
+	// Parameters: module, domain, selector.
+	NotifyDKIMKeyRemoved = "dkim_key_removed"
+
+	// NotifyTLSAChanged is sent when TLSA records for served certificates
+	// change and DNS should be updated.
+	//
+	// Parameters: module, records (newline-separated, zone file format).
+	NotifyTLSAChanged = "tlsa_changed"
+)
+
+// Notifications is the list of all known notification names.
+var Notifications = []string{
+	NotifyCertReload,
+	NotifyReloadFailed,
+	NotifyBacklogEnter,
+	NotifyBacklogLeave,
+	NotifyAccountCreated,
+	NotifyNewLoginLocation,
+	NotifyPasswordChanged,
+	NotifyDKIMKeyPublished,
+	NotifyDKIMKeyRemoved,
+	NotifyTLSAChanged,
+}
+
+type NotifyHandler func(name string, params map[string]string)
+
+var (
+	notifyHandlers    []NotifyHandler
+	notifyHandlersLck sync.Mutex
+)
+
+// AddNotifyHandler installs the handler to be called for all notifications.
+func AddNotifyHandler(h NotifyHandler) {
+	notifyHandlersLck.Lock()
+	defer notifyHandlersLck.Unlock()
+
+	notifyHandlers = append(notifyHandlers, h)
+}
+
+// Notify passes the notification to all installed handlers.
+//
+// Handlers are called synchronously and are expected to not block.
+func Notify(name string, params map[string]string) {
+	notifyHandlersLck.Lock()
+	handlers := make([]NotifyHandler, len(notifyHandlers))
+	copy(handlers, notifyHandlers)
+	notifyHandlersLck.Unlock()
+
+	for _, h := range handlers {
+		h(name, params)
+	}
+}
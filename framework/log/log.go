@@ -46,6 +46,12 @@ type Logger struct {
 	Name  string
 	Debug bool
 
+	// DebugFunc, if set, enables debug messages when it returns true even
+	// if Debug is false. It is checked for each message so debug logging
+	// can be enabled for copies of the Logger that were already made, see
+	// target.DeliveryLogger.
+	DebugFunc func() bool
+
 	// Additional fields that will be added
 	// to the Msg output.
 	Fields map[string]interface{}
@@ -56,15 +62,20 @@ func (l Logger) Zap() *zap.Logger {
 	return zap.New(zapLogger{L: l})
 }
 
+// IsDebug reports whether debug messages are written.
+func (l Logger) IsDebug() bool {
+	return l.Debug || (l.DebugFunc != nil && l.DebugFunc())
+}
+
 func (l Logger) Debugf(format string, val ...interface{}) {
-	if !l.Debug {
+	if !l.IsDebug() {
 		return
 	}
 	l.log(true, l.formatMsg(fmt.Sprintf(format, val...), nil))
 }
 
 func (l Logger) Debugln(val ...interface{}) {
-	if !l.Debug {
+	if !l.IsDebug() {
 		return
 	}
 	l.log(true, l.formatMsg(strings.TrimRight(fmt.Sprintln(val...), "\n"), nil))
@@ -134,7 +145,7 @@ func (l Logger) Error(msg string, err error, fields ...interface{}) {
 }
 
 func (l Logger) DebugMsg(kind string, fields ...interface{}) {
-	if !l.Debug {
+	if !l.IsDebug() {
 		return
 	}
 	m := make(map[string]interface{}, len(fields)/2)
@@ -197,10 +208,10 @@ func (l Logger) Write(s []byte) (int, error) {
 }
 
 // DebugWriter returns a writer that will act like Logger.Write
-// but will use debug flag on messages. If Logger.Debug is false,
-// Write method of returned object will be no-op.
+// but will use debug flag on messages. If debug messages are disabled
+// (see IsDebug), Write method of returned object will be no-op.
 func (l Logger) DebugWriter() io.Writer {
-	if !l.Debug {
+	if !l.IsDebug() {
 		return io.Discard
 	}
 	l.Debug = true
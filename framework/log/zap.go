@@ -11,7 +11,7 @@ type zapLogger struct {
 }
 
 func (l zapLogger) Enabled(level zapcore.Level) bool {
-	if l.L.Debug {
+	if l.L.IsDebug() {
 		return true
 	}
 	return level > zapcore.DebugLevel
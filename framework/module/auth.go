@@ -33,6 +33,32 @@ type PlainAuth interface {
 	AuthPlain(username, password string) error
 }
 
+// SCRAMCredentials are the values stored by the server for SCRAM
+// authentication (RFC 5802 Section 3). They can not be used to authenticate
+// using other mechanisms.
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// SCRAMAuth is the interface implemented by modules that store SCRAM
+// credentials and so can be used for SCRAM-* SASL mechanisms.
+//
+// Hash functions are identified using names from the IANA "Hash Function
+// Textual Names" registry ("SHA-256", "SHA-512").
+type SCRAMAuth interface {
+	// SCRAMHashes returns the list of hash functions the module can have
+	// credentials for.
+	SCRAMHashes() []string
+
+	// SCRAMCredentials returns the stored credentials for the user.
+	// ErrUnknownCredentials is returned if there are none for the user
+	// and hash function.
+	SCRAMCredentials(username, hashName string) (SCRAMCredentials, error)
+}
+
 // PlainUserDB is a local credentials store that can be managed using maddy command
 // utility.
 type PlainUserDB interface {
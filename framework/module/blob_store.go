@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"time"
 )
 
 type Blob interface {
@@ -44,3 +45,19 @@ type BlobStore interface {
 	// Delete removes a set of keys from store. Non-existent keys are ignored.
 	Delete(ctx context.Context, keys []string) error
 }
+
+// BlobInfo describes a single object stored in the BlobStore.
+type BlobInfo struct {
+	Key     string
+	ModTime time.Time
+}
+
+// BlobLister is an optional interface that can be implemented by BlobStore
+// implementations to allow enumerating stored objects.
+//
+// It is used by storage maintenance routines to detect objects that are no
+// longer referenced.
+type BlobLister interface {
+	// ListBlobs returns information about all objects in the store.
+	ListBlobs(ctx context.Context) ([]BlobInfo, error)
+}
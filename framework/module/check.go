@@ -63,6 +63,18 @@ type EarlyCheck interface {
 	CheckConnection(ctx context.Context, state *ConnState) error
 }
 
+// HeaderOnlyCheck is an optional module interface that can be implemented
+// by module implementing Check.
+//
+// HeaderOnly should return true if CheckBody of the check states looks only at
+// the message envelope and header and never reads the body. For such checks
+// the message pipeline passes an empty Buffer to CheckBody and may run it
+// before the body is received (see HeaderDelivery), allowing to reject the
+// message earlier.
+type HeaderOnlyCheck interface {
+	HeaderOnly() bool
+}
+
 type CheckState interface {
 	// CheckConnection is executed once when client sends a new message.
 	CheckConnection(ctx context.Context) CheckResult
@@ -87,6 +99,38 @@ type CheckState interface {
 	Close() error
 }
 
+// PreDataCheckState is an optional interface that can be implemented by
+// CheckState to inspect the message before the body is fully received.
+//
+// CheckPreData is called once the message header and the beginning of the
+// body are received. prefix contains up to a few kilobytes of the body and
+// is not a complete body on its own. It can be used to look at the first
+// MIME parts without waiting for the whole message.
+//
+// Returned result is merged with results of other checks. Rejection causes
+// the message to be rejected without reading the rest of the body.
+// CheckBody is still called later.
+type PreDataCheckState interface {
+	CheckPreData(ctx context.Context, header textproto.Header, prefix []byte) CheckResult
+}
+
+// AuthResPolicy is an optional interface that can be implemented by Check
+// to control how the message pipeline generates the Authentication-Results
+// header field.
+//
+// If any check used for the message implements it, pre-existing
+// Authentication-Results fields are removed unless KeepAuthRes returns true
+// for their authserv-id. Fields using the AuthServID value are always
+// removed since they are forged.
+type AuthResPolicy interface {
+	// AuthServID returns the authserv-id to use in the generated field.
+	AuthServID() string
+
+	// KeepAuthRes reports whether the pre-existing field with the specified
+	// authserv-id should be preserved.
+	KeepAuthRes(authServID string) bool
+}
+
 type CheckResult struct {
 	// Reason is the error that is reported to the message source
 	// if check decided that the message should be rejected.
@@ -103,6 +147,13 @@ type CheckResult struct {
 	// This value is copied into MsgMetadata by the msgpipeline.
 	Quarantine bool
 
+	// Folder is the name of the storage folder the message should be put
+	// into. It is a hint and storage modules may ignore it.
+	//
+	// This value is copied into MsgMetadata by the msgpipeline. If multiple
+	// checks set it, the value from the check listed first is used.
+	Folder string
+
 	// AuthResult is the information that is supposed to
 	// be included in Authentication-Results header.
 	AuthResult []authres.Result
@@ -91,3 +91,20 @@ type Delivery interface {
 	// atomicity of the delivery if multiple targets are used.
 	Commit(ctx context.Context) error
 }
+
+// HeaderDelivery is an optional interface that may be implemented by the
+// object returned by DeliveryTarget.Start.
+//
+// Message sources that parse the message header before receiving the body
+// (such as the SMTP endpoint) call Header before Body. Implementation can
+// use it to reject the message before the body is buffered.
+//
+// bodyPrefix is the beginning of the message body (possibly empty or
+// the entire body if it is small). It should not be retained after Header
+// returns.
+//
+// Header argument passed to the following Body call contains the same
+// fields, but it is not guaranteed to be the same object.
+type HeaderDelivery interface {
+	Header(ctx context.Context, header textproto.Header, bodyPrefix []byte) error
+}
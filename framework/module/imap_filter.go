@@ -19,6 +19,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package module
 
 import (
+	"errors"
+
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
 )
@@ -38,6 +40,11 @@ type IMAPFilter interface {
 	// them.
 	//
 	// Errors returned by IMAPFilter will be just logged and will not cause delivery
-	// to fail.
+	// to fail. The exception is ErrIMAPFilterDiscard that causes the message
+	// not to be stored for the recipient.
 	IMAPFilter(accountName string, rcptTo string, meta *MsgMetadata, hdr textproto.Header, body buffer.Buffer) (folder string, flags []string, err error)
 }
+
+// ErrIMAPFilterDiscard is returned by IMAPFilter if the message should be
+// silently discarded for the recipient.
+var ErrIMAPFilterDiscard = errors.New("imap filter: message discarded")
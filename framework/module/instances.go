@@ -32,7 +32,9 @@ var (
 		mod Module
 		cfg *config.Map
 	})
-	aliases = make(map[string]string)
+	aliases  = make(map[string]string)
+	optional = make(map[string]bool)
+	initErrs = make(map[string]error)
 
 	Initialized = make(map[string]bool)
 )
@@ -48,6 +50,31 @@ func RegisterInstance(inst Module, cfg *config.Map) {
 	}{inst, cfg}
 }
 
+// ResetInstances removes all module instances and aliases from the global
+// registry. Instances are not closed, this is done by EventShutdown hooks.
+func ResetInstances() {
+	instances = make(map[string]struct {
+		mod Module
+		cfg *config.Map
+	})
+	aliases = make(map[string]string)
+	optional = make(map[string]bool)
+	initErrs = make(map[string]error)
+	Initialized = make(map[string]bool)
+	deps = make(map[interface{}]map[string]struct{})
+
+	lazyLck.Lock()
+	lazy = make(map[string]bool)
+	lazyReferenced = make(map[string]bool)
+	lazyLck.Unlock()
+}
+
+// SetOptional marks the module instance as optional. If its initialization
+// fails, the error is logged and GetInstance returns ErrDisabled.
+func SetOptional(instName string) {
+	optional[instName] = true
+}
+
 // RegisterAlias creates an association between a certain name and instance name.
 //
 // After RegisterAlias, module.GetInstance(aliasName) will return the same
@@ -81,24 +108,40 @@ func GetInstance(name string) (Module, error) {
 	if !ok {
 		return nil, fmt.Errorf("unknown config block: %s", name)
 	}
+	addDependency(name)
 
 	// Break circular dependencies.
 	if Initialized[name] {
+		if err := initErrs[name]; err != nil {
+			return nil, err
+		}
 		return mod.mod, nil
 	}
 
 	Initialized[name] = true
-	if err := mod.mod.Init(mod.cfg); err != nil {
-		return mod.mod, err
-	}
-
-	if closer, ok := mod.mod.(io.Closer); ok {
-		hooks.AddHook(hooks.EventShutdown, func() {
-			log.Debugf("close %s (%s)", mod.mod.Name(), mod.mod.InstanceName())
-			if err := closer.Close(); err != nil {
-				log.Printf("module %s (%s) close failed: %v", mod.mod.Name(), mod.mod.InstanceName(), err)
-			}
-		})
+	err := InitScoped(mod.mod, func() error {
+		if err := mod.mod.Init(mod.cfg); err != nil {
+			return err
+		}
+
+		if closer, ok := mod.mod.(io.Closer); ok {
+			hooks.AddHook(hooks.EventShutdown, func() {
+				log.Debugf("close %s (%s)", mod.mod.Name(), mod.mod.InstanceName())
+				if err := closer.Close(); err != nil {
+					log.Printf("module %s (%s) close failed: %v", mod.mod.Name(), mod.mod.InstanceName(), err)
+				}
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		if optional[name] {
+			err = DisableOptional(mod.mod, err)
+		}
+		// Remember the error so the failed module is not returned later
+		// (for lazily initialized modules).
+		initErrs[name] = err
+		return nil, err
 	}
 
 	return mod.mod, nil
@@ -0,0 +1,135 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+var (
+	lazy           = make(map[string]bool)
+	lazyReferenced = make(map[string]bool)
+
+	// lazyLck serializes initialization of lazy module instances since
+	// the registry is not safe for concurrent use.
+	lazyLck sync.Mutex
+)
+
+// ParseLazy removes the 'lazy' directive from the module configuration block
+// and reports whether the module should be initialized on first use.
+//
+// Like 'optional', the directive is handled by the framework and is not
+// passed to the module.
+func ParseLazy(block config.Node) (config.Node, bool, error) {
+	return parseFlagDirective(block, "lazy")
+}
+
+// SetLazy marks the module instance to be initialized on first use instead
+// of the server start-up.
+func SetLazy(instName string) {
+	lazy[instName] = true
+}
+
+// IsLazy reports whether the module instance is initialized on first use.
+func IsLazy(name string) bool {
+	if aliasedName := aliases[name]; aliasedName != "" {
+		name = aliasedName
+	}
+	return lazy[name]
+}
+
+// LazyReferenced reports whether LazyTable was called for the module
+// instance, i.e. it is used by other modules but is not initialized yet.
+func LazyReferenced(name string) bool {
+	return lazyReferenced[name]
+}
+
+// LazyTable returns the Table that initializes the module instance on the
+// first lookup.
+//
+// If the initialization fails, lookups return the initialization error.
+func LazyTable(name string) Table {
+	instName := name
+	if aliasedName := aliases[name]; aliasedName != "" {
+		instName = aliasedName
+	}
+	lazyReferenced[instName] = true
+	addDependency(instName)
+	return &lazyTable{name: name}
+}
+
+type lazyTable struct {
+	name string
+
+	once sync.Once
+	tbl  Table
+	err  error
+}
+
+func (t *lazyTable) get() (Table, error) {
+	t.once.Do(func() {
+		lazyLck.Lock()
+		defer lazyLck.Unlock()
+
+		log.DefaultLogger.Msg("initializing module on first use", "instance", t.name)
+		mod, err := GetInstance(t.name)
+		if err != nil {
+			log.DefaultLogger.Error("lazy module initialization failed", err, "instance", t.name)
+			t.err = exterrors.WithTemporary(err, true)
+			return
+		}
+		tbl, ok := mod.(Table)
+		if !ok {
+			t.err = fmt.Errorf("module %s (%s) is not a table", mod.Name(), t.name)
+			return
+		}
+		t.tbl = tbl
+	})
+	return t.tbl, t.err
+}
+
+func (t *lazyTable) Lookup(ctx context.Context, key string) (string, bool, error) {
+	tbl, err := t.get()
+	if err != nil {
+		return "", false, err
+	}
+	return tbl.Lookup(ctx, key)
+}
+
+func (t *lazyTable) LookupMulti(ctx context.Context, key string) ([]string, error) {
+	tbl, err := t.get()
+	if err != nil {
+		return nil, err
+	}
+	if multi, ok := tbl.(MultiTable); ok {
+		return multi.LookupMulti(ctx, key)
+	}
+
+	val, ok, err := tbl.Lookup(ctx, key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return []string{val}, nil
+}
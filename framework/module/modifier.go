@@ -28,14 +28,14 @@ import (
 // Modifier is the module interface for modules that can mutate the
 // processed message or its meta-data.
 //
-// Currently, the message body can't be mutated for efficiency and
-// correctness reasons: It would require "rebuffering" (see buffer.Buffer doc),
+// Generally, the message body should not be mutated for efficiency and
+// correctness reasons: It requires "rebuffering" (see buffer.Buffer doc),
 // can invalidate assertions made on the body contents before modification and
-// will break DKIM signatures.
+// will break DKIM signatures. Modifiers that have to do it implement
+// BodyModifierState.
 //
-// Only message header can be modified. Furthermore, it is highly discouraged for
-// modifiers to remove or change existing fields to prevent issues outlined
-// above.
+// Furthermore, it is highly discouraged for modifiers to remove or change
+// existing header fields to prevent issues outlined above.
 //
 // Calls on ModifierState are always strictly ordered.
 // RewriteRcpt is newer called before RewriteSender and RewriteBody is never called
@@ -81,3 +81,25 @@ type ModifierState interface {
 	// Rewrite* functions return an error.
 	Close() error
 }
+
+// BodyModifierState is implemented by ModifierState implementations that
+// change the message body.
+//
+// ModifyBody is called instead of RewriteBody and returns the buffer to use
+// for the following modifiers and delivery (or the passed one if no changes
+// are made). The returned buffer is not removed by the caller and may be
+// read after Close is called so it should be stored in memory.
+type BodyModifierState interface {
+	ModifierState
+
+	ModifyBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error)
+}
+
+// ModifyBody calls ModifyBody if state implements BodyModifierState and
+// RewriteBody otherwise.
+func ModifyBody(ctx context.Context, state ModifierState, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	if bodyState, ok := state.(BodyModifierState); ok {
+		return bodyState.ModifyBody(ctx, h, body)
+	}
+	return body, state.RewriteBody(ctx, h, body)
+}
@@ -31,9 +31,15 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 // proxy module, local for local delivery perhaps, etc). Each module instance
 // also can have its own unique name can be used to refer to it in
 // configuration.
+//
+// Interfaces defined in this package, together with Register,
+// RegisterEndpoint and RegisterInstance, are the stable API for modules
+// implemented outside of maddy. See docs/internals/embedding.md.
 package module
 
 import (
+	"context"
+
 	"github.com/foxcpp/maddy/framework/config"
 )
 
@@ -88,3 +94,17 @@ type FuncNewModule func(modName, instName string, aliases, inlineArgs []string)
 // As a consequence of having no per-instance name, InstanceName of the module
 // object always returns the same value as Name.
 type FuncNewEndpoint func(modName string, addrs []string) (Module, error)
+
+// DrainableEndpoint is implemented by endpoint modules that can be replaced
+// during configuration reload without interrupting active sessions.
+//
+// Endpoints that do not implement it are closed immediately when replaced.
+type DrainableEndpoint interface {
+	// StopListening closes all listeners so a new endpoint instance can use
+	// the same addresses. Active sessions are not affected.
+	StopListening() error
+
+	// Drain waits for active sessions to complete or ctx to be done,
+	// whichever happens first. Close is called after Drain returns.
+	Drain(ctx context.Context) error
+}
@@ -67,9 +67,44 @@ type ConnState struct {
 	// This field should be cleaned if the ConnState object is serialized
 	AuthPassword string
 
+	// TrustedRelay is set if the client is a trusted relay (e.g. another MX
+	// or a filtering gateway) and the message was not submitted by it but
+	// relayed from another client. Checks that depend on the client IP should
+	// use MsgMetadata.RelayedClient instead of RemoteAddr.
+	TrustedRelay bool
+
 	ModData ModSpecificData
 }
 
+// RelayedClient contains the information about the client that submitted
+// the message to a trusted relay.
+type RelayedClient struct {
+	IP net.IP
+	// HELO/EHLO hostname used by the client, can be empty if the relay
+	// did not record it.
+	Hostname string
+}
+
+// SenderAuth is the result of the envelope sender verification, see
+// MsgMetadata.SenderAuth.
+type SenderAuth string
+
+const (
+	// SenderAuthUnknown means the sender is not verified, e.g. because
+	// the SPF and DKIM checks are not used or their results are not
+	// conclusive.
+	SenderAuthUnknown SenderAuth = ""
+
+	// SenderAuthPass means the client is authenticated or the sender
+	// domain is confirmed by SPF or an aligned DKIM signature.
+	SenderAuthPass SenderAuth = "pass"
+
+	// SenderAuthFail means the SPF check failed for the sender domain and
+	// there is no aligned DKIM signature, the sender address is likely
+	// forged.
+	SenderAuthFail SenderAuth = "fail"
+)
+
 // MsgMetadata structure contains all information about the origin of
 // the message and all associated flags indicating how it should be handled
 // by components.
@@ -106,6 +141,37 @@ type MsgMetadata struct {
 	// the message. It is set only by the message pipeline.
 	Quarantine bool
 
+	// QuarantineReason is the short explanation of why the message was
+	// quarantined, e.g. "check.rspamd: Message is spam". It is meant to be
+	// shown to the recipient and so it does not include details about the
+	// server configuration.
+	//
+	// It is set by the message pipeline alongside Quarantine and can be
+	// empty.
+	QuarantineReason string
+
+	// Folder is the name of the folder the message should be put into by
+	// storage modules, e.g. "Newsletters". Empty value means the default
+	// folder (INBOX). Quarantine takes precedence over this field.
+	//
+	// It is set by the message pipeline based on check results and can be
+	// also set by modifiers.
+	Folder string
+
+	// Flags contains IMAP flags and keywords storage modules should set on
+	// the message in addition to ones set by IMAP filters, e.g. "\Flagged".
+	// Quarantine takes precedence over this field.
+	//
+	// It is set by modules generating messages (e.g. system_mail) to make
+	// them distinct from regular mail.
+	Flags []string
+
+	// SenderAuth is the result of the envelope sender (MAIL FROM)
+	// verification. It is used to avoid sending DSNs to forged addresses.
+	//
+	// It is set by the message pipeline based on check results.
+	SenderAuth SenderAuth
+
 	// OriginalRcpts contains the mapping from the final recipient to the
 	// recipient that was presented by the client.
 	//
@@ -132,10 +198,23 @@ type MsgMetadata struct {
 	// It can be nil for locally generated messages.
 	Conn *ConnState
 
+	// RelayedClient is the client that submitted the message to the trusted
+	// relay (see ConnState.TrustedRelay), as recorded in the Received header
+	// fields. It is set by endpoint/smtp once the message header is received,
+	// so it is available only to header and body checks. It is nil if the
+	// message is not relayed or the client can't be determined.
+	RelayedClient *RelayedClient
+
 	// This is set by endpoint/smtp to indicate that body contains "TLS-Required: No"
 	// header. It is only meaningful if server has seen the body at least once
 	// (e.g. the message was passed via queue).
 	TLSRequireOverride bool
+
+	// Trace enables debug logging for this message in all modules and
+	// saves the log lines so they can be inspected afterwards, see
+	// internal/msgtrace. It should be set before the message body is
+	// passed to the pipeline.
+	Trace bool
 }
 
 // DeepCopy creates a copy of the MsgMetadata structure, also
@@ -0,0 +1,106 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// ErrDisabled is returned instead of the module instance if the module
+// is marked as optional and its initialization failed.
+//
+// Modules that use a list of other modules (e.g. check and modifier groups)
+// skip disabled ones, for others it is a usual initialization error.
+var ErrDisabled = errors.New("module is disabled due to initialization failure")
+
+// ParseOptional removes the 'optional' directive from the module
+// configuration block and reports whether the module is optional.
+//
+// The directive is handled by the framework and is not passed to the
+// module:
+//
+//	rspamd {
+//	    optional
+//	    api_path http://127.0.0.1:11333
+//	}
+func ParseOptional(block config.Node) (config.Node, bool, error) {
+	return parseFlagDirective(block, "optional")
+}
+
+// parseFlagDirective removes the boolean directive from the configuration
+// block and returns its value.
+func parseFlagDirective(block config.Node, name string) (config.Node, bool, error) {
+	value := false
+	found := false
+	children := make([]config.Node, 0, len(block.Children))
+	for _, child := range block.Children {
+		if child.Name != name {
+			children = append(children, child)
+			continue
+		}
+
+		if found {
+			return block, false, config.NodeErr(child, "duplicate directive: %s", name)
+		}
+		found = true
+		switch len(child.Args) {
+		case 0:
+			value = true
+		case 1:
+			val, err := config.ParseBool(child.Args[0])
+			if err != nil {
+				return block, false, config.NodeErr(child, "%v", err)
+			}
+			value = val
+		default:
+			return block, false, config.NodeErr(child, "expected at most one argument")
+		}
+		if len(child.Children) != 0 {
+			return block, false, config.NodeErr(child, "can't declare block here")
+		}
+	}
+	if !found {
+		return block, false, nil
+	}
+
+	if len(children) == 0 {
+		children = nil
+	}
+	block.Children = children
+	return block, value, nil
+}
+
+// DisableOptional logs the initialization error of the optional module and
+// returns the error to be returned instead of the module instance.
+func DisableOptional(mod Module, err error) error {
+	name := mod.InstanceName()
+	if name == "" {
+		log.DefaultLogger.Error("optional module initialization failed, it is disabled", err,
+			"module", mod.Name())
+		name = mod.Name()
+	} else {
+		log.DefaultLogger.Error("optional module initialization failed, it is disabled", err,
+			"module", mod.Name(), "instance", name)
+	}
+	return fmt.Errorf("%s: %w", name, ErrDisabled)
+}
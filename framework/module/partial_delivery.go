@@ -20,6 +20,7 @@ package module
 
 import (
 	"context"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
@@ -44,6 +45,43 @@ type StatusCollector interface {
 	SetStatus(rcptTo string, err error)
 }
 
+// DeliveryInfo describes how the message was handed off to the next hop.
+type DeliveryInfo struct {
+	// Hostname of the server (e.g. MX) that accepted the message.
+	RemoteServer string `json:",omitempty"`
+	// Network address of the server.
+	RemoteAddr string `json:",omitempty"`
+
+	// TLS version and cipher suite names, empty if TLS was not used.
+	TLSVersion string `json:",omitempty"`
+	TLSCipher  string `json:",omitempty"`
+
+	// Effective security levels of the connection, see TLSLevel and
+	// MXLevel.
+	TLSLevel string `json:",omitempty"`
+	MXLevel  string `json:",omitempty"`
+	// How the server certificate was authenticated: "pki" for X.509
+	// verification, "dane" for matching TLSA records, empty if it was not.
+	TLSAuth string `json:",omitempty"`
+
+	// Time when the message was accepted by the server.
+	Time time.Time
+
+	// DSNPassed is set if the server supports DSN (RFC 3461) and the
+	// DSN parameters were passed to it. It is responsible for reporting
+	// the delivery status to the sender in this case.
+	DSNPassed bool `json:",omitempty"`
+}
+
+// DeliveryInfoCollector is an optional interface that can be implemented by
+// StatusCollector to receive information about successful deliveries.
+//
+// SetDeliveryInfo is called before the corresponding SetStatus call and
+// follows the same rules.
+type DeliveryInfoCollector interface {
+	SetDeliveryInfo(rcptTo string, info DeliveryInfo)
+}
+
 // PartialDelivery is an optional interface that may be implemented
 // by the object returned by DeliveryTarget.Start. See PartialDelivery.BodyNonAtomic
 // documentation for details.
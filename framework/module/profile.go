@@ -0,0 +1,92 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Profile is the operation profile of the server. It restricts the set of
+// modules that can be used so misconfiguration (e.g. a send-only relay that
+// stores messages locally) is detected on start-up.
+type Profile string
+
+const (
+	// ProfileFull allows all modules to be used.
+	ProfileFull Profile = "full"
+	// ProfileOutbound is a send-only relay: messages are accepted from
+	// clients and delivered to remote servers, nothing is stored locally.
+	ProfileOutbound Profile = "outbound"
+	// ProfileInbound is a receive-only MX: messages are accepted from
+	// other servers and stored or relayed to the downstream server, no
+	// messages are sent to the Internet.
+	ProfileInbound Profile = "inbound"
+)
+
+// Profiles maps values of the profile global directive to profiles.
+var Profiles = map[string]Profile{
+	string(ProfileFull):     ProfileFull,
+	string(ProfileOutbound): ProfileOutbound,
+	string(ProfileInbound):  ProfileInbound,
+}
+
+// CurrentProfile is the profile set using the profile global directive.
+var CurrentProfile = ProfileFull
+
+// profileDenied lists modules that can't be used with each profile. Names
+// ending with a dot match all modules in the namespace.
+var profileDenied = map[Profile][]string{
+	ProfileOutbound: {
+		"imap", "lmtp", "imap_filters",
+		"storage.", "target.imapsql", "target.lmtp",
+	},
+	ProfileInbound: {
+		"submission",
+		"target.remote", "mx_auth", "mx_auth.",
+	},
+}
+
+var profileDescription = map[Profile]string{
+	ProfileOutbound: "send-only relay",
+	ProfileInbound:  "receive-only MX",
+}
+
+// ProfileError is returned if the module can't be used with the current
+// profile.
+type ProfileError struct {
+	Module  string
+	Profile Profile
+}
+
+func (err *ProfileError) Error() string {
+	return fmt.Sprintf("%s can't be used with the %s profile (%s), remove it or change the profile global directive",
+		err.Module, err.Profile, profileDescription[err.Profile])
+}
+
+// CheckProfile returns ProfileError if the module can't be used with the
+// current profile.
+func CheckProfile(modName string) error {
+	for _, denied := range profileDenied[CurrentProfile] {
+		if modName == denied || (strings.HasSuffix(denied, ".") && strings.HasPrefix(modName, denied)) {
+			return &ProfileError{Module: modName, Profile: CurrentProfile}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"github.com/foxcpp/maddy/framework/hooks"
+)
+
+var (
+	// initOwner is the module instance (or endpoint) being initialized by
+	// InitScoped.
+	initOwner interface{}
+
+	// deps contains names of instances referenced by each initialized
+	// module instance or endpoint.
+	deps = make(map[interface{}]map[string]struct{})
+)
+
+// InitScoped calls init and attributes hooks installed and module instances
+// referenced (using GetInstance or LazyTable) during its execution to owner.
+//
+// It should be used to initialize top-level configuration blocks so they can
+// be replaced when the configuration is reloaded.
+func InitScoped(owner interface{}, init func() error) error {
+	prev := initOwner
+	initOwner = owner
+	defer func() {
+		initOwner = prev
+	}()
+	return hooks.WithOwner(owner, init)
+}
+
+func addDependency(instName string) {
+	if initOwner == nil {
+		return
+	}
+	ownerDeps := deps[initOwner]
+	if ownerDeps == nil {
+		ownerDeps = make(map[string]struct{})
+		deps[initOwner] = ownerDeps
+	}
+	ownerDeps[instName] = struct{}{}
+}
+
+// Dependencies returns names of module instances referenced by owner during
+// initialization (see InitScoped).
+func Dependencies(owner interface{}) []string {
+	names := make([]string, 0, len(deps[owner]))
+	for name := range deps[owner] {
+		names = append(names, name)
+	}
+	return names
+}
+
+// ForgetDependencies removes dependency information for the owner once it
+// is no longer used.
+func ForgetDependencies(owner interface{}) {
+	delete(deps, owner)
+}
+
+// UnregisterInstance removes the module instance and all its aliases from
+// the global registry. The instance is not closed.
+//
+// It is used to replace instances during configuration reload.
+func UnregisterInstance(instName string) {
+	delete(instances, instName)
+	for alias, target := range aliases {
+		if target == instName {
+			delete(aliases, alias)
+		}
+	}
+	delete(optional, instName)
+	delete(initErrs, instName)
+	delete(Initialized, instName)
+	delete(lazy, instName)
+	delete(lazyReferenced, instName)
+}
+
+// SaveRegistry saves the state of the global instances registry. Calling
+// the returned function restores it.
+//
+// It is used to roll back failed configuration reload.
+func SaveRegistry() (restore func()) {
+	savedInstances := copyMap(instances)
+	savedAliases := copyMap(aliases)
+	savedOptional := copyMap(optional)
+	savedInitErrs := copyMap(initErrs)
+	savedInitialized := copyMap(Initialized)
+	savedLazy := copyMap(lazy)
+	savedLazyReferenced := copyMap(lazyReferenced)
+	savedDeps := copyMap(deps)
+
+	return func() {
+		instances = savedInstances
+		aliases = savedAliases
+		optional = savedOptional
+		initErrs = savedInitErrs
+		Initialized = savedInitialized
+		lazy = savedLazy
+		lazyReferenced = savedLazyReferenced
+		deps = savedDeps
+	}
+}
+
+func copyMap[K comparable, V any](m map[K]V) map[K]V {
+	cpy := make(map[K]V, len(m))
+	for k, v := range m {
+		cpy[k] = v
+	}
+	return cpy
+}
+
+// LockRegistry prevents lazy initialization of module instances until
+// UnlockRegistry is called. It should be held while the registry is
+// modified after the server is started.
+func LockRegistry() {
+	lazyLck.Lock()
+}
+
+func UnlockRegistry() {
+	lazyLck.Unlock()
+}
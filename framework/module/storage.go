@@ -27,6 +27,15 @@ import (
 //
 // Modules implementing this interface should be registered with prefix
 // "storage." in name.
+//
+// Mailboxes should implement imapbackend.MoveMailbox to support MOVE natively,
+// both IMAP endpoint and 'maddy imap-msgs move' rely on it. UIDPLUS (COPYUID,
+// APPENDUID) is not supported since go-imap backend interfaces do not report
+// UIDs assigned to new messages.
+//
+// TODO: Advertise UIDPLUS once go-imap-sql returns UIDs assigned by
+// CreateMessage, CopyMessages and MoveMessages and go-imap server allows
+// the backend to provide COPYUID and APPENDUID response codes.
 type Storage interface {
 	// GetOrCreateIMAPAcct returns User associated with storage account specified by
 	// the name.
@@ -40,11 +49,52 @@ type Storage interface {
 }
 
 // ManageableStorage is an extended Storage interface that allows to
-// list existing accounts, create and delete them.
+// list existing accounts, create, rename and delete them.
 type ManageableStorage interface {
 	Storage
 
 	ListIMAPAccts() ([]string, error)
 	CreateIMAPAcct(username string) error
 	DeleteIMAPAcct(username string) error
+
+	// RenameIMAPAcct changes the name of the account keeping all its
+	// mailboxes and messages. It should fail if the account with the new
+	// name already exists.
+	RenameIMAPAcct(oldName, newName string) error
+}
+
+// AccountProvisioner is implemented by storage backends that prepare new
+// accounts using configured templates.
+type AccountProvisioner interface {
+	// TemplateCreatesFolders reports whether the template for the account
+	// defines its folders so default ones should not be created by
+	// 'maddy imap-acct create'.
+	TemplateCreatesFolders(username string) bool
+}
+
+// Quota resource names, as defined by RFC 2087.
+const (
+	QuotaResourceStorage  = "STORAGE"
+	QuotaResourceMessages = "MESSAGE"
+)
+
+// QuotaUsage contains the resource usage of the account and the effective
+// limits. Zero limit value means there is no limit.
+type QuotaUsage struct {
+	// In bytes.
+	StorageUsed  int64
+	StorageLimit int64
+
+	MessagesUsed  int64
+	MessagesLimit int64
+}
+
+// QuotaStorage is implemented by storage backends that support per-account
+// quotas.
+type QuotaStorage interface {
+	GetQuota(username string) (QuotaUsage, error)
+
+	// SetQuotaLimit changes the limit of the resource for the account.
+	// Zero limit means no limit, -1 restores the default limit.
+	SetQuotaLimit(username, resource string, limit int64) error
 }
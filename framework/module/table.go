@@ -41,3 +41,11 @@ type MutableTable interface {
 	RemoveKey(k string) error
 	SetKey(k, v string) error
 }
+
+// MutableMultiTable is the interface that MutableTable can implement in
+// addition to MultiTable if it can store multiple values for a key.
+type MutableMultiTable interface {
+	MutableTable
+	MultiTable
+	SetKeyMulti(k string, v []string) error
+}
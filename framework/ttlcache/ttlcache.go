@@ -0,0 +1,167 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package ttlcache implements a bounded in-memory cache with per-entry
+// expiration time.
+//
+// It is used by modules that cache results of lookups that are expensive to
+// repeat (DNS queries, SMTP callouts, password hashing).
+package ttlcache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type entry[K comparable, V any] struct {
+	key     K
+	val     V
+	expires time.Time
+}
+
+// Cache is a key-value cache with per-entry TTL. If the amount of entries
+// reaches the configured limit, least recently used ones are removed first.
+//
+// Cache is safe for concurrent use.
+type Cache[K comparable, V any] struct {
+	maxEntries int
+
+	lck     sync.Mutex
+	entries map[K]*list.Element
+	lru     *list.List
+
+	now func() time.Time
+}
+
+// New creates a Cache holding at most maxEntries entries. If maxEntries is
+// zero or negative, the amount of entries is not limited.
+func New[K comparable, V any](maxEntries int) *Cache[K, V] {
+	return &Cache[K, V]{
+		maxEntries: maxEntries,
+		entries:    make(map[K]*list.Element),
+		lru:        list.New(),
+		now:        time.Now,
+	}
+}
+
+// SetClock replaces the function used to get the current time. It is meant
+// to be used in tests.
+func (c *Cache[K, V]) SetClock(now func() time.Time) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.now = now
+}
+
+// Get returns the value stored for the key if it is not expired.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	e := elem.Value.(*entry[K, V])
+	if !c.now().Before(e.expires) {
+		c.remove(elem)
+		var zero V
+		return zero, false
+	}
+
+	c.lru.MoveToFront(elem)
+	return e.val, true
+}
+
+// Put stores the value for the key replacing the existing one, if any.
+// If ttl is zero or negative, the value is not stored.
+func (c *Cache[K, V]) Put(key K, val V, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&entry[K, V]{
+		key:     key,
+		val:     val,
+		expires: c.now().Add(ttl),
+	})
+
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *Cache[K, V]) remove(elem *list.Element) {
+	delete(c.entries, elem.Value.(*entry[K, V]).key)
+	c.lru.Remove(elem)
+}
+
+// Remove removes the entry for the key and reports whether it was present.
+func (c *Cache[K, V]) Remove(key K) bool {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	c.remove(elem)
+	return true
+}
+
+// RemoveFunc removes all entries with keys for which f returns true. It
+// returns the amount of removed entries.
+func (c *Cache[K, V]) RemoveFunc(f func(key K) bool) int {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	removed := 0
+	for key, elem := range c.entries {
+		if f(key) {
+			c.remove(elem)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Clear removes all entries and returns their amount.
+func (c *Cache[K, V]) Clear() int {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	removed := c.lru.Len()
+	c.entries = make(map[K]*list.Element)
+	c.lru.Init()
+	return removed
+}
+
+// Len returns the amount of stored entries, including expired ones that
+// were not removed yet.
+func (c *Cache[K, V]) Len() int {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	return c.lru.Len()
+}
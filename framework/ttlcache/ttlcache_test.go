@@ -0,0 +1,71 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ttlcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := New[string, int](2)
+	c.SetClock(func() time.Time { return now })
+
+	check := func(key string, want int, wantOk bool) {
+		t.Helper()
+		val, ok := c.Get(key)
+		if val != want || ok != wantOk {
+			t.Errorf("Get(%q) = (%v, %v), want (%v, %v)", key, val, ok, want, wantOk)
+		}
+	}
+
+	c.Put("a", 1, time.Minute)
+	c.Put("b", 2, 10*time.Second)
+	c.Put("zero", 3, 0)
+	check("a", 1, true)
+	check("b", 2, true)
+	check("zero", 0, false)
+
+	now = now.Add(10 * time.Second)
+	check("b", 0, false)
+	check("a", 1, true)
+
+	// "b" is the least recently used one.
+	c.Put("b", 2, time.Minute)
+	c.Put("c", 3, time.Minute)
+	check("a", 0, false)
+	check("b", 2, true)
+	check("c", 3, true)
+	if c.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", c.Len())
+	}
+
+	if !c.Remove("b") || c.Remove("b") {
+		t.Error("Remove reported wrong result")
+	}
+	c.Put("d", 4, time.Minute)
+	if n := c.RemoveFunc(func(key string) bool { return key == "d" }); n != 1 {
+		t.Errorf("RemoveFunc removed %d entries, want 1", n)
+	}
+	if n := c.Clear(); n != 1 {
+		t.Errorf("Clear removed %d entries, want 1", n)
+	}
+	check("c", 0, false)
+}
@@ -0,0 +1,93 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package acctstatus implements the account status flag that allows to
+// restrict use of the account without removing it.
+//
+// Statuses are stored in a table (usually defined using the global
+// account_status directive) keyed by the account name. Accounts without
+// an entry are active.
+package acctstatus
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+type Status string
+
+const (
+	// Active accounts have no restrictions.
+	Active Status = "active"
+	// Suspended accounts cannot log in and do not receive messages.
+	Suspended Status = "suspended"
+	// ReceiveOnly accounts receive messages and can access them but cannot
+	// submit messages.
+	ReceiveOnly Status = "receive-only"
+	// SendOnly accounts can submit messages but do not receive ones.
+	SendOnly Status = "send-only"
+)
+
+// Statuses lists all valid account statuses.
+var Statuses = []Status{Active, Suspended, ReceiveOnly, SendOnly}
+
+// Parse converts the string to the Status.
+func Parse(s string) (Status, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for _, st := range Statuses {
+		if string(st) == s {
+			return st, nil
+		}
+	}
+	return "", fmt.Errorf("acctstatus: unknown account status: %s", s)
+}
+
+// Lookup returns the status of the account stored in the table.
+//
+// Active is returned if tbl is nil or has no entry for the account.
+func Lookup(ctx context.Context, tbl module.Table, account string) (Status, error) {
+	if tbl == nil {
+		return Active, nil
+	}
+	val, ok, err := tbl.Lookup(ctx, account)
+	if err != nil {
+		return "", fmt.Errorf("acctstatus: %w", err)
+	}
+	if !ok {
+		return Active, nil
+	}
+	return Parse(val)
+}
+
+// AllowsLogin reports whether the account can access its mailboxes.
+func (s Status) AllowsLogin() bool {
+	return s != Suspended
+}
+
+// AllowsSending reports whether the account can submit messages.
+func (s Status) AllowsSending() bool {
+	return s == Active || s == SendOnly
+}
+
+// AllowsReceiving reports whether messages can be delivered to the account.
+func (s Status) AllowsReceiving() bool {
+	return s == Active || s == ReceiveOnly
+}
@@ -0,0 +1,92 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package acctstatus
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestLookup(t *testing.T) {
+	tbl := testutils.Table{M: map[string]string{
+		"a@example.org": "suspended",
+		"b@example.org": "Receive-Only",
+		"c@example.org": "send-only",
+		"d@example.org": "whatever",
+	}}
+
+	test := func(account string, expected Status, fail bool) {
+		t.Helper()
+		st, err := Lookup(context.Background(), tbl, account)
+		if fail {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", account, st)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", account, err)
+			return
+		}
+		if st != expected {
+			t.Errorf("%s: expected %v, got %v", account, expected, st)
+		}
+	}
+
+	test("a@example.org", Suspended, false)
+	test("b@example.org", ReceiveOnly, false)
+	test("c@example.org", SendOnly, false)
+	test("d@example.org", "", true)
+	test("e@example.org", Active, false)
+
+	st, err := Lookup(context.Background(), nil, "a@example.org")
+	if err != nil || st != Active {
+		t.Errorf("nil table: expected active, got %v, %v", st, err)
+	}
+
+	_, err = Lookup(context.Background(), testutils.Table{Err: errors.New("oops")}, "a@example.org")
+	if err == nil {
+		t.Error("expected lookup error to be returned")
+	}
+}
+
+func TestStatusRestrictions(t *testing.T) {
+	for _, c := range []struct {
+		status                    Status
+		login, sending, receiving bool
+	}{
+		{Active, true, true, true},
+		{Suspended, false, false, false},
+		{ReceiveOnly, true, false, true},
+		{SendOnly, true, true, false},
+	} {
+		if c.status.AllowsLogin() != c.login {
+			t.Errorf("%v: AllowsLogin = %v", c.status, !c.login)
+		}
+		if c.status.AllowsSending() != c.sending {
+			t.Errorf("%v: AllowsSending = %v", c.status, !c.sending)
+		}
+		if c.status.AllowsReceiving() != c.receiving {
+			t.Errorf("%v: AllowsReceiving = %v", c.status, !c.receiving)
+		}
+	}
+}
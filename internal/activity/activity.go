@@ -0,0 +1,247 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package activity keeps track of the last successful logins for each
+// account.
+//
+// Logins are kept in memory and periodically saved to the state directory so
+// they can be inspected using the maddy command.
+package activity
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/authz"
+)
+
+const (
+	fileName = "activity.json"
+
+	// flushDelay is the maximum amount of time recorded logins are kept
+	// only in memory.
+	flushDelay = 30 * time.Second
+)
+
+// Enabled controls whether logins are recorded. It is set using the global
+// activity_tracking directive.
+var Enabled = true
+
+// Login is the information about the successful login.
+type Login struct {
+	Time time.Time `json:"time"`
+	IP   string    `json:"ip,omitempty"`
+}
+
+// Logins contains the last login for each account and protocol.
+type Logins map[string]map[string]Login
+
+// Last returns the most recent login of the account and the protocol used.
+// Zero Login is returned if the account never logged in.
+func (l Logins) Last(account string) (Login, string) {
+	var (
+		last  Login
+		proto string
+	)
+	for p, login := range l[account] {
+		if login.Time.After(last.Time) {
+			last = login
+			proto = p
+		}
+	}
+	return last, proto
+}
+
+// Protocols returns protocols used by the account sorted by name.
+func (l Logins) Protocols(account string) []string {
+	protos := make([]string, 0, len(l[account]))
+	for p := range l[account] {
+		protos = append(protos, p)
+	}
+	sort.Strings(protos)
+	return protos
+}
+
+var (
+	lck        sync.Mutex
+	logins     Logins
+	flushTimer *time.Timer
+)
+
+// Init discards the state left by the previously started server and
+// installs the hook to save recorded logins on shutdown.
+func Init() {
+	lck.Lock()
+	logins = nil
+	lck.Unlock()
+
+	loginHandlersLck.Lock()
+	loginHandlers = nil
+	loginHandlersLck.Unlock()
+
+	hooks.AddHook(hooks.EventShutdown, func() {
+		if err := Flush(); err != nil {
+			log.DefaultLogger.Error("failed to save login activity", err)
+		}
+	})
+}
+
+// FilePath returns the path of the file where logins are saved.
+func FilePath() string {
+	return filepath.Join(config.StateDirectory, fileName)
+}
+
+// Load reads saved logins. Logins recorded but not saved yet are not
+// included.
+func Load() (Logins, error) {
+	blob, err := os.ReadFile(FilePath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Logins{}, nil
+		}
+		return nil, err
+	}
+	l := Logins{}
+	if err := json.Unmarshal(blob, &l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Normalize converts the account name into the form used as a key for
+// saved logins.
+func Normalize(account string) string {
+	norm, err := authz.NormalizeAuto(account)
+	if err != nil {
+		return account
+	}
+	return norm
+}
+
+// LoginHandler is called for each successful login. It is called
+// synchronously and is expected to not block.
+type LoginHandler func(account, protocol string, login Login)
+
+var (
+	loginHandlers    []LoginHandler
+	loginHandlersLck sync.Mutex
+)
+
+// AddLoginHandler installs the handler to be called for all successful
+// logins. Handlers are called even if recording is disabled.
+func AddLoginHandler(h LoginHandler) {
+	loginHandlersLck.Lock()
+	defer loginHandlersLck.Unlock()
+	loginHandlers = append(loginHandlers, h)
+}
+
+// RecordLogin records the successful login to the account using the
+// specified protocol.
+func RecordLogin(account, protocol string, addr net.Addr) {
+	if account == "" {
+		return
+	}
+
+	login := Login{Time: time.Now().UTC().Truncate(time.Second)}
+	if addr != nil {
+		if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+			login.IP = tcpAddr.IP.String()
+		} else {
+			login.IP = addr.String()
+		}
+	}
+
+	loginHandlersLck.Lock()
+	handlers := loginHandlers
+	loginHandlersLck.Unlock()
+	for _, h := range handlers {
+		h(account, protocol, login)
+	}
+
+	if !Enabled {
+		return
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	if logins == nil {
+		var err error
+		logins, err = Load()
+		if err != nil {
+			log.DefaultLogger.Error("failed to read login activity, starting from scratch", err)
+			logins = Logins{}
+		}
+	}
+
+	account = Normalize(account)
+	if logins[account] == nil {
+		logins[account] = map[string]Login{}
+	}
+	logins[account][protocol] = login
+
+	if flushTimer == nil {
+		flushTimer = time.AfterFunc(flushDelay, func() {
+			if err := Flush(); err != nil {
+				log.DefaultLogger.Error("failed to save login activity", err)
+			}
+		})
+	}
+}
+
+// Flush saves recorded logins to the state directory.
+func Flush() error {
+	lck.Lock()
+	defer lck.Unlock()
+
+	if flushTimer == nil {
+		return nil
+	}
+	flushTimer.Stop()
+	flushTimer = nil
+
+	blob, err := json.Marshal(logins)
+	if err != nil {
+		return err
+	}
+
+	path := FilePath()
+	tmp, err := os.CreateTemp(filepath.Dir(path), fileName+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(blob); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,86 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package activity
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func TestRecordLogin(t *testing.T) {
+	config.StateDirectory = t.TempDir()
+	defer func() {
+		logins = nil
+	}()
+
+	RecordLogin("User@Example.org", "imap", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1234})
+	time.Sleep(1 * time.Second)
+	RecordLogin("user@example.org", "submission", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 1234})
+
+	saved, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 0 {
+		t.Fatal("Logins saved before Flush:", saved)
+	}
+
+	if err := Flush(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err = Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if protos := saved.Protocols("user@example.org"); len(protos) != 2 || protos[0] != "imap" || protos[1] != "submission" {
+		t.Fatal("Wrong protocols:", protos)
+	}
+	last, proto := saved.Last("user@example.org")
+	if proto != "submission" || last.IP != "127.0.0.3" {
+		t.Error("Wrong last login:", last, proto)
+	}
+	if last, proto := saved.Last("other@example.org"); !last.Time.IsZero() || proto != "" {
+		t.Error("Unexpected login for other account:", last, proto)
+	}
+}
+
+func TestRecordLogin_Disabled(t *testing.T) {
+	config.StateDirectory = t.TempDir()
+	Enabled = false
+	defer func() {
+		Enabled = true
+		logins = nil
+	}()
+
+	RecordLogin("user@example.org", "imap", nil)
+	if err := Flush(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 0 {
+		t.Error("Login recorded while disabled:", saved)
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"unicode"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var disallowedIPLogins = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "auth",
+		Name:      "disallowed_ip_logins",
+		Help:      "Authentication attempts with valid credentials from addresses not allowed for the account",
+	},
+	[]string{"module"},
+)
+
+func init() {
+	prometheus.MustRegister(disallowedIPLogins)
+}
+
+// lookupAllowedIPs returns the list of networks the account is allowed to
+// log in from. ok is false if the account has no restrictions.
+//
+// Each table value is a list of IP addresses or CIDR ranges separated by
+// commas or whitespace. Tables that support multiple values per key can
+// also return each range as a separate value.
+func lookupAllowedIPs(ctx context.Context, tbl module.Table, username string) (nets []*net.IPNet, ok bool, err error) {
+	var values []string
+	if multi, isMulti := tbl.(module.MultiTable); isMulti {
+		values, err = multi.LookupMulti(ctx, username)
+		if err != nil {
+			return nil, false, err
+		}
+	} else {
+		value, found, err := tbl.Lookup(ctx, username)
+		if err != nil {
+			return nil, false, err
+		}
+		if found {
+			values = []string{value}
+		}
+	}
+	if len(values) == 0 {
+		return nil, false, nil
+	}
+
+	for _, value := range values {
+		for _, entry := range strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		}) {
+			n, err := parseIPNet(entry)
+			if err != nil {
+				return nil, false, fmt.Errorf("auth: malformed allowed IPs entry for %s: %w", username, err)
+			}
+			nets = append(nets, n)
+		}
+	}
+
+	// An entry with no valid ranges still restricts the account, denying
+	// all logins.
+	return nets, true, nil
+}
+
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case nil:
+		return nil
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// checkIP verifies that the account is allowed to log in from remoteAddr
+// according to the AllowedIPs table.
+//
+// Logins from addresses that are not known (e.g. Unix sockets) are rejected
+// for restricted accounts.
+func (s *SASLAuth) checkIP(ctx context.Context, username string, remoteAddr net.Addr) error {
+	if s.AllowedIPs == nil {
+		return nil
+	}
+
+	nets, ok, err := lookupAllowedIPs(ctx, s.AllowedIPs, username)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	if ip := addrIP(remoteAddr); ip != nil {
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return nil
+			}
+		}
+	}
+
+	s.Log.Msg("login from disallowed address", "username", username, "src_ip", remoteAddr)
+	disallowedIPLogins.WithLabelValues(s.Log.Name).Inc()
+	return ErrDisallowedIP
+}
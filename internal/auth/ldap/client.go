@@ -0,0 +1,245 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Client is the directory server connection pool shared by auth.ldap and
+// table.ldap.
+type Client struct {
+	modName string
+
+	urls []string
+	// readBind is used to authenticate connections for searches. nil
+	// means anonymous access.
+	readBind       func(*ldap.Conn) error
+	startls        bool
+	tlsCfg         tls.Config
+	dialer         *net.Dialer
+	requestTimeout time.Duration
+	maxIdle        int
+
+	log *log.Logger
+
+	poolLck sync.Mutex
+	idle    []*ldap.Conn
+	closed  bool
+}
+
+func NewClient(modName string, urls []string, logger *log.Logger) *Client {
+	return &Client{
+		modName: modName,
+		urls:    urls,
+		log:     logger,
+	}
+}
+
+// Configure adds directives for connection configuration to cfg.
+func (c *Client) Configure(cfg *config.Map) {
+	c.dialer = &net.Dialer{}
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
+		return tls.Config{}, nil
+	}, tls2.TLSClientBlock, &c.tlsCfg)
+	cfg.Callback("urls", func(m *config.Map, node config.Node) error {
+		c.urls = append(c.urls, node.Args...)
+		return nil
+	})
+	cfg.Custom("bind", false, false, func() (interface{}, error) {
+		return (func(*ldap.Conn) error)(nil), nil
+	}, c.readBindDirective, &c.readBind)
+	cfg.Bool("starttls", false, false, &c.startls)
+	cfg.Duration("connect_timeout", false, false, time.Minute, &c.dialer.Timeout)
+	cfg.Duration("request_timeout", false, false, time.Minute, &c.requestTimeout)
+	cfg.Int("max_idle_conns", false, false, 4, &c.maxIdle)
+}
+
+// Init checks the configuration and opens the first connection to make sure
+// the directory server is reachable. It should be called after cfg.Process.
+func (c *Client) Init() error {
+	if len(c.urls) == 0 {
+		return fmt.Errorf("%s: no server URLs specified", c.modName)
+	}
+	if c.maxIdle < 0 {
+		return fmt.Errorf("%s: max_idle_conns cannot be negative", c.modName)
+	}
+
+	if module.NoRun {
+		return nil
+	}
+
+	conn, err := c.newConn()
+	if err != nil {
+		return err
+	}
+	c.Put(conn, false)
+	return nil
+}
+
+func (c *Client) readBindDirective(_ *config.Map, n config.Node) (interface{}, error) {
+	if len(n.Args) == 0 {
+		return nil, fmt.Errorf("%s: bind expects at least one argument", c.modName)
+	}
+	switch n.Args[0] {
+	case "off":
+		return (func(*ldap.Conn) error)(nil), nil
+	case "unauth":
+		if len(n.Args) == 2 {
+			return func(c *ldap.Conn) error {
+				return c.UnauthenticatedBind(n.Args[1])
+			}, nil
+		}
+		return func(c *ldap.Conn) error {
+			return c.UnauthenticatedBind("")
+		}, nil
+	case "plain":
+		if len(n.Args) != 3 {
+			return nil, fmt.Errorf("%s: username and password expected for plaintext bind", c.modName)
+		}
+		return func(c *ldap.Conn) error {
+			return c.Bind(n.Args[1], n.Args[2])
+		}, nil
+	case "external":
+		return (*ldap.Conn).ExternalBind, nil
+	}
+	return nil, fmt.Errorf("%s: unknown bind authentication: %v", c.modName, n.Args[0])
+}
+
+func (c *Client) newConn() (*ldap.Conn, error) {
+	var (
+		conn   *ldap.Conn
+		tlsCfg *tls.Config
+	)
+	for _, u := range c.urls {
+		parsedURL, err := url.Parse(u)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid server URL: %w", c.modName, err)
+		}
+		tlsCfg = c.tlsCfg.Clone()
+		tlsCfg.ServerName = parsedURL.Hostname()
+
+		conn, err = ldap.DialURL(u, ldap.DialWithDialer(c.dialer), ldap.DialWithTLSConfig(tlsCfg))
+		if err != nil {
+			c.log.Error("cannot contact directory server", err, "url", u)
+			continue
+		}
+		break
+	}
+	if conn == nil {
+		return nil, fmt.Errorf("%s: all directory servers are unreachable", c.modName)
+	}
+
+	if c.requestTimeout != 0 {
+		conn.SetTimeout(c.requestTimeout)
+	}
+
+	if c.startls {
+		if err := conn.StartTLS(tlsCfg); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: %w", c.modName, err)
+		}
+	}
+
+	if c.readBind != nil {
+		if err := c.readBind(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: %w", c.modName, err)
+		}
+	}
+
+	return conn, nil
+}
+
+// Get returns an idle connection from the pool or opens a new one.
+func (c *Client) Get() (*ldap.Conn, error) {
+	c.poolLck.Lock()
+	for len(c.idle) != 0 {
+		conn := c.idle[len(c.idle)-1]
+		c.idle = c.idle[:len(c.idle)-1]
+		if conn.IsClosing() {
+			conn.Close()
+			continue
+		}
+		c.poolLck.Unlock()
+		return conn, nil
+	}
+	c.poolLck.Unlock()
+
+	c.log.DebugMsg("opening new connection")
+	return c.newConn()
+}
+
+// Put returns the connection to the pool. rebind should be set if the
+// connection was used to bind as a user so it is reauthenticated for
+// searches.
+func (c *Client) Put(conn *ldap.Conn, rebind bool) {
+	if conn.IsClosing() {
+		conn.Close()
+		return
+	}
+
+	if rebind {
+		var err error
+		if c.readBind != nil {
+			err = c.readBind(conn)
+		} else {
+			// Drop the user authentication.
+			err = conn.UnauthenticatedBind("")
+		}
+		if err != nil {
+			c.log.Error("failed to rebind for reading", err)
+			conn.Close()
+			return
+		}
+	}
+
+	c.poolLck.Lock()
+	defer c.poolLck.Unlock()
+	if c.closed || len(c.idle) >= c.maxIdle {
+		conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+// Search runs the search request using a pooled connection.
+func (c *Client) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	conn, err := c.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Put(conn, false)
+
+	res, err := conn.Search(req)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) && res != nil {
+			c.log.Msg("search size limit exceeded, results are truncated", "filter", req.Filter)
+			return res, nil
+		}
+		return nil, fmt.Errorf("%s: search: %w", c.modName, err)
+	}
+	return res, nil
+}
+
+func (c *Client) Close() error {
+	c.poolLck.Lock()
+	defer c.poolLck.Unlock()
+	for _, conn := range c.idle {
+		conn.Close()
+	}
+	c.idle = nil
+	c.closed = true
+	return nil
+}
@@ -0,0 +1,209 @@
+package ldap
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	testServiceDN = "cn=maddy,dc=example,dc=org"
+	testAliceDN   = "uid=alice,ou=people,dc=example,dc=org"
+)
+
+func newTestServer(t *testing.T, extra ...testutils.LDAPEntry) *testutils.LDAPServer {
+	t.Helper()
+	return testutils.NewLDAPServer(t, append([]testutils.LDAPEntry{
+		{DN: testServiceDN, Password: "service"},
+		{
+			DN:       testAliceDN,
+			Password: "alicepass",
+			Attrs:    map[string][]string{"uid": {"alice"}},
+		},
+	}, extra...)...)
+}
+
+func newTestAuth(t *testing.T, srv *testutils.LDAPServer, directives ...config.Node) *Auth {
+	t.Helper()
+	mod, err := New(modName, "", nil, []string{srv.URL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+	a.log = testutils.Logger(t, modName)
+	if err := a.Init(config.NewMap(nil, config.Node{Children: directives})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+var searchConfig = []config.Node{
+	{Name: "base_dn", Args: []string{"dc=example,dc=org"}},
+	{Name: "filter", Args: []string{"(uid={username})"}},
+}
+
+func TestAuth_PoolReuse(t *testing.T) {
+	srv := newTestServer(t)
+	a := newTestAuth(t, srv, append([]config.Node{
+		{Name: "bind", Args: []string{"plain", testServiceDN, "service"}},
+	}, searchConfig...)...)
+
+	for i := 0; i < 3; i++ {
+		if err := a.AuthPlain("alice", "alicepass"); err != nil {
+			t.Fatal("AuthPlain:", err)
+		}
+		if err := a.AuthPlain("alice", "wrong"); !errors.Is(err, module.ErrUnknownCredentials) {
+			t.Fatal("AuthPlain with wrong password:", err)
+		}
+		dn, ok, err := a.Lookup(context.Background(), "alice")
+		if err != nil || !ok || dn != testAliceDN {
+			t.Fatal("Lookup:", dn, ok, err)
+		}
+	}
+
+	if conns := srv.Conns(); conns != 1 {
+		t.Errorf("expected 1 connection to be used, got %d", conns)
+	}
+
+	// Searches after the user bind should be done using the service account
+	// again.
+	searches := srv.Searches()
+	if len(searches) != 9 {
+		t.Fatalf("expected 9 searches, got %d", len(searches))
+	}
+	for i, s := range searches {
+		if s.BindDN != testServiceDN {
+			t.Errorf("search %d done as %q, want %q", i, s.BindDN, testServiceDN)
+		}
+	}
+}
+
+func TestAuth_RebindAnonymous(t *testing.T) {
+	srv := newTestServer(t)
+	a := newTestAuth(t, srv, searchConfig...)
+
+	if err := a.AuthPlain("alice", "alicepass"); err != nil {
+		t.Fatal("AuthPlain:", err)
+	}
+	if _, _, err := a.Lookup(context.Background(), "alice"); err != nil {
+		t.Fatal("Lookup:", err)
+	}
+
+	searches := srv.Searches()
+	if len(searches) != 2 {
+		t.Fatalf("expected 2 searches, got %d", len(searches))
+	}
+	if searches[1].BindDN != "" {
+		t.Errorf("search after AuthPlain done as %q, want anonymous", searches[1].BindDN)
+	}
+}
+
+func TestAuth_DNTemplate(t *testing.T) {
+	srv := newTestServer(t, testutils.LDAPEntry{
+		DN:       "uid=bob,ou=admins,ou=people,dc=example,dc=org",
+		Password: "bobpass",
+	})
+	a := newTestAuth(t, srv,
+		config.Node{Name: "dn_template", Args: []string{"uid={username},ou=people,dc=example,dc=org"}})
+
+	if err := a.AuthPlain("alice", "alicepass"); err != nil {
+		t.Fatal("AuthPlain:", err)
+	}
+	// DN components in the username should not be interpreted.
+	if err := a.AuthPlain("bob,ou=admins", "bobpass"); !errors.Is(err, module.ErrUnknownCredentials) {
+		t.Fatal("AuthPlain with DN injection:", err)
+	}
+	if len(srv.Searches()) != 0 {
+		t.Error("unexpected searches with dn_template")
+	}
+}
+
+func TestAuth_FilterEscaping(t *testing.T) {
+	const special = "x*()\\\x00"
+	srv := newTestServer(t, testutils.LDAPEntry{
+		DN:    "uid=special,ou=people,dc=example,dc=org",
+		Attrs: map[string][]string{"uid": {special}},
+	})
+	a := newTestAuth(t, srv, searchConfig...)
+
+	for _, tc := range []struct {
+		username string
+		filter   string
+		found    bool
+	}{
+		{"a*", `(uid=a\2a)`, false},
+		{"*", `(uid=\2a)`, false},
+		{"alice)(uid=*", `(uid=alice\29\28uid=\2a)`, false},
+		{"alice\\", `(uid=alice\5c)`, false},
+		{"alice\x00", `(uid=alice\00)`, false},
+		{special, `(uid=x\2a\28\29\5c\00)`, true},
+	} {
+		before := len(srv.Searches())
+		_, ok, err := a.Lookup(context.Background(), tc.username)
+		if err != nil {
+			t.Errorf("%q: %v", tc.username, err)
+			continue
+		}
+		if ok != tc.found {
+			t.Errorf("%q: expected found=%v, got %v", tc.username, tc.found, ok)
+		}
+		searches := srv.Searches()
+		if len(searches) != before+1 {
+			t.Errorf("%q: expected a search request", tc.username)
+			continue
+		}
+		if f := searches[before].Filter; f != tc.filter {
+			t.Errorf("%q: expected filter %s, got %s", tc.username, tc.filter, f)
+		}
+	}
+}
+
+func TestClient_MaxIdle(t *testing.T) {
+	srv := newTestServer(t)
+	a := newTestAuth(t, srv, append([]config.Node{
+		{Name: "max_idle_conns", Args: []string{"2"}},
+	}, searchConfig...)...)
+
+	// Take 4 connections at once and return them, only 2 should be kept.
+	var conns []*ldap.Conn
+	for i := 0; i < 4; i++ {
+		conn, err := a.cl.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		a.cl.Put(conn, false)
+	}
+
+	a.cl.poolLck.Lock()
+	idle := len(a.cl.idle)
+	a.cl.poolLck.Unlock()
+	if idle != 2 {
+		t.Errorf("expected 2 idle connections, got %d", idle)
+	}
+	// Connections are counted by the server asynchronously.
+	for deadline := time.Now().Add(5 * time.Second); srv.Conns() != 4; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 4 connections to be opened, got %d", srv.Conns())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, _, err := a.Lookup(context.Background(), "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c := srv.Conns(); c != 4 {
+		t.Errorf("idle connections are not reused, %d connections opened", c)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pass_table
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/ttlcache"
+	"golang.org/x/text/secure/precis"
+)
+
+// maxCacheEntries limits the amount of cached verifications.
+const maxCacheEntries = 10000
+
+// authCache remembers successful password verifications so expensive hash
+// functions (bcrypt, argon2) are not computed for each connection of clients
+// that connect often.
+//
+// Neither passwords nor hashes are stored directly, entries contain HMAC of
+// the stored hash and the supplied password keyed by a random secret
+// generated on start-up. Since the stored hash is a part of the HMAC input,
+// changing the password in the table invalidates the entry even if the
+// change is made by another process.
+type authCache struct {
+	ttl    time.Duration
+	secret []byte
+
+	entries *ttlcache.Cache[string, []byte]
+}
+
+func newAuthCache(ttl time.Duration) (*authCache, error) {
+	c := &authCache{
+		ttl:     ttl,
+		secret:  make([]byte, 32),
+		entries: ttlcache.New[string, []byte](maxCacheEntries),
+	}
+	if _, err := rand.Read(c.secret); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *authCache) mac(hash, password string) []byte {
+	h := hmac.New(sha256.New, c.secret)
+	h.Write([]byte(hash))
+	h.Write([]byte{0})
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
+
+// check reports whether the password was recently verified against the
+// hash for the user.
+func (c *authCache) check(key, hash, password string) bool {
+	if c == nil || c.ttl <= 0 {
+		return false
+	}
+
+	mac, ok := c.entries.Get(key)
+	if !ok {
+		return false
+	}
+	return hmac.Equal(mac, c.mac(hash, password))
+}
+
+func (c *authCache) put(key, hash, password string) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	c.entries.Put(key, c.mac(hash, password), c.ttl)
+}
+
+func (c *authCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+	c.entries.Remove(key)
+}
+
+// FlushCache implements cacheflush.Flusher. The key is the username.
+func (c *authCache) FlushCache(username string) int {
+	if username == "" {
+		return c.entries.Clear()
+	}
+
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return 0
+	}
+	if !c.entries.Remove(key) {
+		return 0
+	}
+	return 1
+}
@@ -28,6 +28,8 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/scram"
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -37,6 +39,10 @@ const (
 	HashBcrypt = "bcrypt"
 	HashArgon2 = "argon2"
 
+	HashSCRAMSHA1   = "scram-sha-1"
+	HashSCRAMSHA256 = "scram-sha-256"
+	HashSCRAMSHA512 = "scram-sha-512"
+
 	DefaultHash = HashBcrypt
 
 	Argon2Salt = 16
@@ -56,6 +62,10 @@ type (
 		Argon2Time    uint32
 		Argon2Memory  uint32
 		Argon2Threads uint8
+
+		// Iteration count for SCRAM credentials. scram.MinIterations is
+		// used if it is not set.
+		SCRAMIterations int
 	}
 
 	FuncHashCompute func(opts HashOpts, pass string) (string, error)
@@ -64,15 +74,21 @@ type (
 
 var (
 	HashCompute = map[string]FuncHashCompute{
-		HashBcrypt: computeBcrypt,
-		HashArgon2: computeArgon2,
+		HashBcrypt:      computeBcrypt,
+		HashArgon2:      computeArgon2,
+		HashSCRAMSHA1:   computeSCRAM(scram.SHA1),
+		HashSCRAMSHA256: computeSCRAM(scram.SHA256),
+		HashSCRAMSHA512: computeSCRAM(scram.SHA512),
 	}
 	HashVerify = map[string]FuncHashVerify{
-		HashBcrypt: verifyBcrypt,
-		HashArgon2: verifyArgon2,
+		HashBcrypt:      verifyBcrypt,
+		HashArgon2:      verifyArgon2,
+		HashSCRAMSHA1:   verifySCRAM(scram.SHA1),
+		HashSCRAMSHA256: verifySCRAM(scram.SHA256),
+		HashSCRAMSHA512: verifySCRAM(scram.SHA512),
 	}
 
-	Hashes = []string{HashSHA256, HashBcrypt, HashArgon2}
+	Hashes = []string{HashSHA256, HashBcrypt, HashArgon2, HashSCRAMSHA1, HashSCRAMSHA256, HashSCRAMSHA512}
 )
 
 func computeArgon2(opts HashOpts, pass string) (string, error) {
@@ -174,6 +190,80 @@ func verifyBcrypt(pass, hashSalt string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hashSalt), []byte(pass))
 }
 
+// scramHashName returns the hash name for SCRAM credentials with the
+// specified tag (e.g. "scram-sha-256" -> "SHA-256").
+func scramHashName(tag string) (string, bool) {
+	if !strings.HasPrefix(tag, "scram-") {
+		return "", false
+	}
+	hashName := strings.ToUpper(strings.TrimPrefix(tag, "scram-"))
+	return hashName, scram.Supported(hashName)
+}
+
+// scramTag is the inverse of scramHashName.
+func scramTag(hashName string) string {
+	return "scram-" + strings.ToLower(hashName)
+}
+
+func computeSCRAM(hashName string) FuncHashCompute {
+	return func(opts HashOpts, pass string) (string, error) {
+		iterations := opts.SCRAMIterations
+		if iterations == 0 {
+			iterations = scram.MinIterations
+		}
+		creds, err := scram.NewCredentials(hashName, pass, iterations)
+		if err != nil {
+			return "", fmt.Errorf("pass_table: %w", err)
+		}
+		return formatSCRAM(creds), nil
+	}
+}
+
+func verifySCRAM(hashName string) FuncHashVerify {
+	return func(pass, hashSalt string) error {
+		creds, err := parseSCRAM(hashSalt)
+		if err != nil {
+			return err
+		}
+		if err := scram.VerifyPassword(hashName, pass, creds); err != nil {
+			return fmt.Errorf("pass_table: hash mismatch")
+		}
+		return nil
+	}
+}
+
+// formatSCRAM encodes SCRAM credentials as
+// iterations:salt:stored_key:server_key with all binary values in base64.
+func formatSCRAM(creds module.SCRAMCredentials) string {
+	return strconv.Itoa(creds.Iterations) + ":" +
+		base64.StdEncoding.EncodeToString(creds.Salt) + ":" +
+		base64.StdEncoding.EncodeToString(creds.StoredKey) + ":" +
+		base64.StdEncoding.EncodeToString(creds.ServerKey)
+}
+
+func parseSCRAM(hashSalt string) (module.SCRAMCredentials, error) {
+	parts := strings.Split(hashSalt, ":")
+	if len(parts) != 4 {
+		return module.SCRAMCredentials{}, fmt.Errorf("pass_table: malformed SCRAM credentials")
+	}
+
+	var (
+		creds module.SCRAMCredentials
+		err   error
+	)
+	creds.Iterations, err = strconv.Atoi(parts[0])
+	if err != nil || creds.Iterations <= 0 {
+		return module.SCRAMCredentials{}, fmt.Errorf("pass_table: malformed SCRAM credentials: invalid iteration count")
+	}
+	for i, dst := range []*[]byte{&creds.Salt, &creds.StoredKey, &creds.ServerKey} {
+		*dst, err = base64.StdEncoding.DecodeString(parts[i+1])
+		if err != nil {
+			return module.SCRAMCredentials{}, fmt.Errorf("pass_table: malformed SCRAM credentials: %w", err)
+		}
+	}
+	return creds, nil
+}
+
 func addSHA256() {
 	HashCompute[HashSHA256] = computeSHA256
 	HashVerify[HashSHA256] = verifySHA256
@@ -20,22 +20,35 @@ package pass_table
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/scram"
+	"github.com/foxcpp/maddy/internal/cacheflush"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/text/secure/precis"
 )
 
+// ErrCredentialsExist is returned when creating or renaming credentials to
+// a username that is already taken.
+var ErrCredentialsExist = errors.New("already exist")
+
 type Auth struct {
 	modName    string
 	instName   string
 	inlineArgs []string
 
 	table module.Table
+	cache *authCache
+
+	// Hash functions to generate SCRAM credentials for.
+	scramHashes []string
 }
 
 func New(modName, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -47,13 +60,52 @@ func New(modName, instName string, _, inlineArgs []string) (module.Module, error
 }
 
 func (a *Auth) Init(cfg *config.Map) error {
+	var cacheTTL time.Duration
+	cfg.Duration("cache_ttl", false, false, 0, &cacheTTL)
+	cfg.Callback("scram", func(m *config.Map, node config.Node) error {
+		if len(node.Args) == 0 {
+			return config.NodeErr(node, "at least one hash function is required")
+		}
+		for _, arg := range node.Args {
+			hashName := strings.ToUpper(arg)
+			if !scram.Supported(hashName) {
+				return config.NodeErr(node, "unsupported hash function: %s", arg)
+			}
+			a.scramHashes = append(a.scramHashes, hashName)
+		}
+		return nil
+	})
 	if len(a.inlineArgs) != 0 {
-		return modconfig.ModuleFromNode("table", a.inlineArgs, cfg.Block, cfg.Globals, &a.table)
+		// Remaining directives are passed to the table module.
+		cfg.AllowUnknown()
+		unknown, err := cfg.Process()
+		if err != nil {
+			return err
+		}
+		tableCfg := cfg.Block
+		tableCfg.Children = nil
+		if len(unknown) != 0 {
+			tableCfg.Children = unknown
+		}
+		if err := modconfig.ModuleFromNode("table", a.inlineArgs, tableCfg, cfg.Globals, &a.table); err != nil {
+			return err
+		}
+	} else {
+		cfg.Custom("table", false, true, nil, modconfig.TableDirective, &a.table)
+		if _, err := cfg.Process(); err != nil {
+			return err
+		}
 	}
 
-	cfg.Custom("table", false, true, nil, modconfig.TableDirective, &a.table)
-	_, err := cfg.Process()
-	return err
+	if cacheTTL > 0 {
+		var err error
+		a.cache, err = newAuthCache(cacheTTL)
+		if err != nil {
+			return fmt.Errorf("%s: %w", a.modName, err)
+		}
+		cacheflush.Register("auth", a.instName, a.cache)
+	}
+	return nil
 }
 
 func (a *Auth) Name() string {
@@ -87,7 +139,10 @@ func (a *Auth) AuthPlain(username, password string) error {
 		return err
 	}
 
-	parts := strings.SplitN(hash, ":", 2)
+	// The first entry is used for password verification, others are
+	// SCRAM credentials.
+	primary, _, _ := strings.Cut(hash, ";")
+	parts := strings.SplitN(primary, ":", 2)
 	if len(parts) != 2 {
 		return fmt.Errorf("%s: auth plain %s: no hash tag", a.modName, key)
 	}
@@ -95,7 +150,72 @@ func (a *Auth) AuthPlain(username, password string) error {
 	if hashVerify == nil {
 		return fmt.Errorf("%s: auth plain %s: unknown hash: %s", a.modName, key, parts[0])
 	}
-	return hashVerify(password, parts[1])
+
+	if a.cache.check(key, hash, password) {
+		return nil
+	}
+	if err := hashVerify(password, parts[1]); err != nil {
+		return err
+	}
+	a.cache.put(key, hash, password)
+	return nil
+}
+
+func (a *Auth) SCRAMHashes() []string {
+	return a.scramHashes
+}
+
+func (a *Auth) SCRAMCredentials(username, hashName string) (module.SCRAMCredentials, error) {
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return module.SCRAMCredentials{}, err
+	}
+
+	value, ok, err := a.table.Lookup(context.TODO(), key)
+	if err != nil {
+		return module.SCRAMCredentials{}, err
+	}
+	if !ok {
+		return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+	}
+
+	tag := scramTag(hashName)
+	for _, entry := range strings.Split(value, ";") {
+		entryTag, params, _ := strings.Cut(entry, ":")
+		if entryTag != tag {
+			continue
+		}
+		creds, err := parseSCRAM(params)
+		if err != nil {
+			return module.SCRAMCredentials{}, fmt.Errorf("%s: scram credentials %s: %w", a.modName, key, err)
+		}
+		return creds, nil
+	}
+	return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+}
+
+// computeHashes computes the value stored in the table for the password: the
+// hash using hashAlgo followed by SCRAM credentials for hash functions
+// enabled using the 'scram' directive.
+func (a *Auth) computeHashes(password, hashAlgo string, opts HashOpts) (string, error) {
+	hash, err := HashCompute[hashAlgo](opts, password)
+	if err != nil {
+		return "", err
+	}
+	value := hashAlgo + ":" + hash
+
+	for _, hashName := range a.scramHashes {
+		tag := scramTag(hashName)
+		if tag == hashAlgo {
+			continue
+		}
+		creds, err := HashCompute[tag](opts, password)
+		if err != nil {
+			return "", err
+		}
+		value += ";" + tag + ":" + creds
+	}
+	return value, nil
 }
 
 func (a *Auth) ListUsers() ([]string, error) {
@@ -137,15 +257,67 @@ func (a *Auth) CreateUserHash(username, password string, hashAlgo string, opts H
 		return fmt.Errorf("%s: create user %s: %w", a.modName, key, err)
 	}
 	if ok {
-		return fmt.Errorf("%s: credentials for %s already exist", a.modName, key)
+		return fmt.Errorf("%s: credentials for %s %w", a.modName, key, ErrCredentialsExist)
 	}
 
-	hash, err := HashCompute[hashAlgo](opts, password)
+	value, err := a.computeHashes(password, hashAlgo, opts)
 	if err != nil {
 		return fmt.Errorf("%s: create user %s: hash generation: %w", a.modName, key, err)
 	}
 
-	if err := tbl.SetKey(key, hashAlgo+":"+hash); err != nil {
+	if err := tbl.SetKey(key, value); err != nil {
+		return fmt.Errorf("%s: create user %s: %w", a.modName, key, err)
+	}
+	return nil
+}
+
+// UserHash returns the stored password hash for the user in the same format
+// as CreateUserWithHash accepts it.
+func (a *Auth) UserHash(username string) (string, bool, error) {
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return "", false, fmt.Errorf("%s: user hash %s (raw): %w", a.modName, username, err)
+	}
+
+	hash, ok, err := a.table.Lookup(context.TODO(), key)
+	if err != nil {
+		return "", false, fmt.Errorf("%s: user hash %s: %w", a.modName, key, err)
+	}
+	return hash, ok, nil
+}
+
+// CreateUserWithHash creates the user using the already computed password
+// hash (e.g. produced by 'maddy hash' or exported from another server).
+func (a *Auth) CreateUserWithHash(username, hash string) error {
+	tbl, ok := a.table.(module.MutableTable)
+	if !ok {
+		return fmt.Errorf("%s: table is not mutable, no management functionality available", a.modName)
+	}
+
+	for _, entry := range strings.Split(hash, ";") {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%s: create user %s: no hash tag", a.modName, username)
+		}
+		if _, ok := HashVerify[parts[0]]; !ok {
+			return fmt.Errorf("%s: create user %s: unknown hash: %s", a.modName, username, parts[0])
+		}
+	}
+
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return fmt.Errorf("%s: create user %s (raw): %w", a.modName, username, err)
+	}
+
+	_, ok, err = tbl.Lookup(context.TODO(), key)
+	if err != nil {
+		return fmt.Errorf("%s: create user %s: %w", a.modName, key, err)
+	}
+	if ok {
+		return fmt.Errorf("%s: credentials for %s %w", a.modName, key, ErrCredentialsExist)
+	}
+
+	if err := tbl.SetKey(key, hash); err != nil {
 		return fmt.Errorf("%s: create user %s: %w", a.modName, key, err)
 	}
 	return nil
@@ -163,16 +335,72 @@ func (a *Auth) SetUserPassword(username, password string) error {
 	}
 
 	// TODO: Allow to customize hash function.
-	hash, err := HashCompute[HashBcrypt](HashOpts{
+	value, err := a.computeHashes(password, HashBcrypt, HashOpts{
 		BcryptCost: bcrypt.DefaultCost,
-	}, password)
+	})
 	if err != nil {
 		return fmt.Errorf("%s: set password %s: hash generation: %w", a.modName, key, err)
 	}
 
-	if err := tbl.SetKey(key, "bcrypt:"+hash); err != nil {
+	if err := tbl.SetKey(key, value); err != nil {
 		return fmt.Errorf("%s: set password %s: %w", a.modName, key, err)
 	}
+	a.cache.invalidate(key)
+	hooks.Notify(hooks.NotifyPasswordChanged, map[string]string{
+		"module":   a.instName,
+		"username": key,
+	})
+	return nil
+}
+
+// RenameUser moves the credentials to the new username.
+//
+// Credentials are stored under the new name before they are removed for the
+// old one so they are never lost. If the removal fails, the new entry is
+// removed.
+func (a *Auth) RenameUser(oldName, newName string) error {
+	tbl, ok := a.table.(module.MutableTable)
+	if !ok {
+		return fmt.Errorf("%s: table is not mutable, no management functionality available", a.modName)
+	}
+
+	oldKey, err := precis.UsernameCaseMapped.CompareKey(oldName)
+	if err != nil {
+		return fmt.Errorf("%s: rename user %s (raw): %w", a.modName, oldName, err)
+	}
+	newKey, err := precis.UsernameCaseMapped.CompareKey(newName)
+	if err != nil {
+		return fmt.Errorf("%s: rename user %s (raw): %w", a.modName, newName, err)
+	}
+	if oldKey == newKey {
+		return fmt.Errorf("%s: rename user %s: old and new names are the same", a.modName, oldKey)
+	}
+
+	hash, ok, err := tbl.Lookup(context.TODO(), oldKey)
+	if err != nil {
+		return fmt.Errorf("%s: rename user %s: %w", a.modName, oldKey, err)
+	}
+	if !ok {
+		return fmt.Errorf("%s: rename user %s: no such user", a.modName, oldKey)
+	}
+	_, ok, err = tbl.Lookup(context.TODO(), newKey)
+	if err != nil {
+		return fmt.Errorf("%s: rename user %s: %w", a.modName, newKey, err)
+	}
+	if ok {
+		return fmt.Errorf("%s: credentials for %s %w", a.modName, newKey, ErrCredentialsExist)
+	}
+
+	if err := tbl.SetKey(newKey, hash); err != nil {
+		return fmt.Errorf("%s: rename user %s: %w", a.modName, oldKey, err)
+	}
+	if err := tbl.RemoveKey(oldKey); err != nil {
+		if rbErr := tbl.RemoveKey(newKey); rbErr != nil {
+			return fmt.Errorf("%s: rename user %s: %w (rollback failed: %v)", a.modName, oldKey, err, rbErr)
+		}
+		return fmt.Errorf("%s: rename user %s: %w", a.modName, oldKey, err)
+	}
+	a.cache.invalidate(oldKey)
 	return nil
 }
 
@@ -190,6 +418,7 @@ func (a *Auth) DeleteUser(username string) error {
 	if err := tbl.RemoveKey(key); err != nil {
 		return fmt.Errorf("%s: del user %s: %w", a.modName, key, err)
 	}
+	a.cache.invalidate(key)
 	return nil
 }
 
@@ -19,10 +19,19 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package pass_table
 
 import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/scram"
 	"github.com/foxcpp/maddy/internal/testutils"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestAuth_AuthPlain(t *testing.T) {
@@ -62,3 +71,253 @@ func TestAuth_AuthPlain(t *testing.T) {
 	check("not-foxcpp", "different-password", false)
 	check("not-foxcpp-2", "password", true)
 }
+
+func TestAuth_InlineConfig(t *testing.T) {
+	initMod := func(children ...config.Node) *Auth {
+		t.Helper()
+		mod, err := New("pass_table", "", nil, []string{"dummy"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mod.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+			t.Fatal(err)
+		}
+		return mod.(*Auth)
+	}
+
+	a := initMod()
+	if a.cache != nil {
+		t.Error("Cache should be disabled by default")
+	}
+
+	a = initMod(
+		config.Node{Name: "cache_ttl", Args: []string{"2m"}},
+		config.Node{Name: "scram", Args: []string{"sha-256"}},
+	)
+	if a.cache == nil || a.cache.ttl != 2*time.Minute {
+		t.Error("cache_ttl is not applied for inline definition")
+	}
+	if !reflect.DeepEqual(a.scramHashes, []string{scram.SHA256}) {
+		t.Error("scram is not applied for inline definition:", a.scramHashes)
+	}
+}
+
+type mutableTable struct {
+	testutils.Table
+}
+
+func (m mutableTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(m.M))
+	for k := range m.M {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m mutableTable) SetKey(k, v string) error {
+	m.M[k] = v
+	return nil
+}
+
+func (m mutableTable) RemoveKey(k string) error {
+	delete(m.M, k)
+	return nil
+}
+
+func TestAuth_CreateUserWithHash(t *testing.T) {
+	a := &Auth{
+		modName: "pass_table",
+		table:   mutableTable{testutils.Table{M: map[string]string{}}},
+	}
+
+	const hash = "bcrypt:$2y$10$4tEJtJ6dApmhETg8tJ4WHOeMtmYXQwmHDKIyfg09Bw1F/smhLjlaa"
+	if err := a.CreateUserWithHash("FoxCpp", hash); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AuthPlain("foxcpp", "password"); err != nil {
+		t.Error("AuthPlain failed:", err)
+	}
+
+	stored, ok, err := a.UserHash("foxcpp")
+	if err != nil || !ok || stored != hash {
+		t.Errorf("UserHash: %v %v %v", stored, ok, err)
+	}
+
+	if err := a.CreateUserWithHash("foxcpp", hash); err == nil {
+		t.Error("Expected an error for existing user")
+	}
+	for _, invalid := range []string{"plaintext", "unknown:aaaa"} {
+		if err := a.CreateUserWithHash("foxcpp-2", invalid); err == nil {
+			t.Errorf("Expected an error for %s", invalid)
+		}
+	}
+	if _, ok, _ := a.table.Lookup(context.Background(), "foxcpp-2"); ok {
+		t.Error("User with invalid hash created")
+	}
+}
+
+func TestAuth_RenameUser(t *testing.T) {
+	const hash = "bcrypt:$2y$10$4tEJtJ6dApmhETg8tJ4WHOeMtmYXQwmHDKIyfg09Bw1F/smhLjlaa"
+	a := &Auth{
+		modName: "pass_table",
+		table: mutableTable{testutils.Table{M: map[string]string{
+			"foxcpp": hash,
+			"other":  hash,
+		}}},
+	}
+
+	if err := a.RenameUser("FoxCpp", "fox"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AuthPlain("fox", "password"); err != nil {
+		t.Error("AuthPlain for the new name failed:", err)
+	}
+	if _, ok, _ := a.UserHash("foxcpp"); ok {
+		t.Error("Credentials for the old name are not removed")
+	}
+
+	if err := a.RenameUser("fox", "other"); err == nil {
+		t.Error("Expected an error for existing user")
+	}
+	if err := a.RenameUser("foxcpp", "fox2"); err == nil {
+		t.Error("Expected an error for non-existent user")
+	}
+	if err := a.RenameUser("fox", "FOX"); err == nil {
+		t.Error("Expected an error for the same name")
+	}
+}
+
+func TestAuth_Cache(t *testing.T) {
+	addSHA256()
+
+	verifications := 0
+	HashVerify["counting"] = func(pass, hashSalt string) error {
+		verifications++
+		return HashVerify[HashSHA256](pass, hashSalt)
+	}
+	defer delete(HashVerify, "counting")
+
+	cache, err := newAuthCache(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl := mutableTable{testutils.Table{M: map[string]string{
+		"foxcpp": "counting:U0FMVA==:8PDRAgaUqaLSk34WpYniXjaBgGM93Lc6iF4pw2slthw=",
+	}}}
+	a := &Auth{
+		modName: "pass_table",
+		table:   tbl,
+		cache:   cache,
+	}
+
+	check := func(pass string, ok bool, expectedVerifications int) {
+		t.Helper()
+		err := a.AuthPlain("FoxCpp", pass)
+		if (err == nil) != ok {
+			t.Errorf("ok=%v, err: %v", ok, err)
+		}
+		if verifications != expectedVerifications {
+			t.Errorf("expected %d hash verifications, got %d", expectedVerifications, verifications)
+		}
+	}
+
+	check("password", true, 1)
+	check("password", true, 1)
+	// Failures are not cached and do not affect cached success.
+	check("different-password", false, 2)
+	check("different-password", false, 3)
+	check("password", true, 3)
+
+	// Changing the stored hash (e.g. by another process) invalidates the entry.
+	tbl.M["foxcpp"] = "counting:U0FMVA==:8PDRAgaUqaLSk34WpYniXjaBgGM93Lc6iF4pw2slthw="
+	check("password", true, 3)
+	tbl.M["foxcpp"] = "bcrypt:$2y$10$4tEJtJ6dApmhETg8tJ4WHOeMtmYXQwmHDKIyfg09Bw1F/smhLjlaa"
+	check("password", true, 3)
+	tbl.M["foxcpp"] = "counting:U0FMVA==:8PDRAgaUqaLSk34WpYniXjaBgGM93Lc6iF4pw2slthw="
+	check("password", true, 4)
+
+	if err := a.SetUserPassword("foxcpp", "new-password"); err != nil {
+		t.Fatal(err)
+	}
+	check("password", false, 4)
+	check("new-password", true, 4)
+
+	if err := a.DeleteUser("foxcpp"); err != nil {
+		t.Fatal(err)
+	}
+	check("new-password", false, 4)
+}
+
+func TestAuth_SCRAM(t *testing.T) {
+	tbl := mutableTable{testutils.Table{M: map[string]string{}}}
+	a := &Auth{
+		modName:     "pass_table",
+		table:       tbl,
+		scramHashes: []string{scram.SHA256, scram.SHA512, scram.SHA1},
+	}
+
+	if err := a.CreateUserHash("FoxCpp", "password", HashBcrypt, HashOpts{BcryptCost: bcrypt.MinCost}); err != nil {
+		t.Fatal(err)
+	}
+	entries := strings.Split(tbl.M["foxcpp"], ";")
+	if len(entries) != 4 || !strings.HasPrefix(entries[0], "bcrypt:") ||
+		!strings.HasPrefix(entries[1], "scram-sha-256:") || !strings.HasPrefix(entries[2], "scram-sha-512:") ||
+		!strings.HasPrefix(entries[3], "scram-sha-1:") {
+		t.Fatal("Unexpected stored value:", tbl.M["foxcpp"])
+	}
+
+	if err := a.AuthPlain("foxcpp", "password"); err != nil {
+		t.Error("AuthPlain failed:", err)
+	}
+	if err := a.AuthPlain("foxcpp", "wrong"); err == nil {
+		t.Error("AuthPlain succeeded for wrong password")
+	}
+
+	for _, hashName := range []string{scram.SHA256, scram.SHA512, scram.SHA1} {
+		creds, err := a.SCRAMCredentials("foxcpp", hashName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if creds.Iterations != scram.MinIterations {
+			t.Error("Wrong iteration count:", creds.Iterations)
+		}
+		if err := scram.VerifyPassword(hashName, "password", creds); err != nil {
+			t.Error("Stored credentials do not match the password:", err)
+		}
+	}
+	if _, err := a.SCRAMCredentials("nobody", scram.SHA256); !errors.Is(err, module.ErrUnknownCredentials) {
+		t.Error("Expected ErrUnknownCredentials, got", err)
+	}
+
+	// SCRAM credentials are updated together with the password.
+	oldCreds, _ := a.SCRAMCredentials("foxcpp", scram.SHA256)
+	if err := a.SetUserPassword("foxcpp", "new-password"); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := a.SCRAMCredentials("foxcpp", scram.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(creds, oldCreds) || scram.VerifyPassword(scram.SHA256, "new-password", creds) != nil {
+		t.Error("SCRAM credentials are not updated")
+	}
+
+	// SCRAM credentials alone can be used for password verification.
+	value, err := HashCompute[HashSCRAMSHA256](HashOpts{}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.CreateUserWithHash("scram-only", HashSCRAMSHA256+":"+value); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AuthPlain("scram-only", "password"); err != nil {
+		t.Error("AuthPlain failed:", err)
+	}
+	if _, err := a.SCRAMCredentials("scram-only", scram.SHA512); !errors.Is(err, module.ErrUnknownCredentials) {
+		t.Error("Expected ErrUnknownCredentials, got", err)
+	}
+	if err := a.CreateUserWithHash("invalid", "bcrypt:aaa;unknown:aaa"); err == nil {
+		t.Error("Expected an error for unknown hash")
+	}
+}
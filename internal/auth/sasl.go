@@ -20,6 +20,7 @@ package auth
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -29,13 +30,17 @@ import (
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/acctstatus"
 	"github.com/foxcpp/maddy/internal/auth/sasllogin"
+	"github.com/foxcpp/maddy/internal/auth/scram"
 	"github.com/foxcpp/maddy/internal/authz"
 )
 
 var (
 	ErrUnsupportedMech = errors.New("Unsupported SASL mechanism")
 	ErrInvalidAuthCred = errors.New("auth: invalid credentials")
+	ErrAccountDisabled = errors.New("auth: account is disabled")
+	ErrDisallowedIP    = errors.New("auth: login from disallowed address")
 )
 
 // SASLAuth is a wrapper that initializes sasl.Server using authenticators that
@@ -55,6 +60,21 @@ type SASLAuth struct {
 	AuthNormalize authz.NormalizeFunc
 
 	Plain []module.PlainAuth
+	SCRAM []module.SCRAMAuth
+
+	// AccountStatus is the table with account statuses, see acctstatus
+	// package. If StatusAllowed is set, authentication succeeds only
+	// for accounts with the status it accepts.
+	AccountStatus module.Table
+	StatusAllowed func(acctstatus.Status) bool
+
+	// AllowedIPs is the table with IP ranges accounts are allowed to log in
+	// from. Accounts not in the table are not restricted.
+	AllowedIPs module.Table
+
+	// DisabledErr is returned by SASL servers if the account status does
+	// not permit authentication. ErrAccountDisabled is used if it is nil.
+	DisabledErr error
 }
 
 func (s *SASLAuth) SASLMechanisms() []string {
@@ -67,9 +87,49 @@ func (s *SASLAuth) SASLMechanisms() []string {
 		}
 	}
 
+	for _, hashName := range scram.Hashes {
+		if s.scramSupported(hashName) {
+			mechs = append(mechs, scram.Mechanism(hashName, false), scram.Mechanism(hashName, true))
+		}
+	}
+
 	return mechs
 }
 
+func (s *SASLAuth) scramSupported(hashName string) bool {
+	for _, p := range s.SCRAM {
+		for _, h := range p.SCRAMHashes() {
+			if h == hashName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scramCredentials returns SCRAM credentials for the user from the first
+// provider that has them.
+func (s *SASLAuth) scramCredentials(ctx context.Context, hashName, username string) (module.SCRAMCredentials, error) {
+	username, err := s.usernameForAuth(ctx, username)
+	if err != nil {
+		if errors.Is(err, ErrInvalidAuthCred) {
+			return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+		}
+		return module.SCRAMCredentials{}, err
+	}
+
+	for _, p := range s.SCRAM {
+		creds, err := p.SCRAMCredentials(username, hashName)
+		if err == nil {
+			return creds, nil
+		}
+		if !errors.Is(err, module.ErrUnknownCredentials) {
+			return module.SCRAMCredentials{}, err
+		}
+	}
+	return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+}
+
 func (s *SASLAuth) usernameForAuth(ctx context.Context, saslUsername string) (string, error) {
 	if s.AuthNormalize != nil {
 		var err error
@@ -98,7 +158,9 @@ func (s *SASLAuth) usernameForAuth(ctx context.Context, saslUsername string) (st
 	return mapped, nil
 }
 
-func (s *SASLAuth) AuthPlain(username, password string) error {
+// AuthPlain verifies the credentials using configured PlainAuth providers
+// and checks whether the account is allowed to log in from remoteAddr.
+func (s *SASLAuth) AuthPlain(username, password string, remoteAddr net.Addr) error {
 	if len(s.Plain) == 0 {
 		return ErrUnsupportedMech
 	}
@@ -112,13 +174,43 @@ func (s *SASLAuth) AuthPlain(username, password string) error {
 
 		lastErr = p.AuthPlain(username, password)
 		if lastErr == nil {
-			return nil
+			return s.checkAccount(context.TODO(), username, remoteAddr)
 		}
 	}
 
 	return fmt.Errorf("no auth. provider accepted creds, last err: %w", lastErr)
 }
 
+// checkAccount verifies that the authenticated account can be used for the
+// session.
+func (s *SASLAuth) checkAccount(ctx context.Context, username string, remoteAddr net.Addr) error {
+	if err := s.checkStatus(ctx, username); err != nil {
+		return err
+	}
+	return s.checkIP(ctx, username, remoteAddr)
+}
+
+func (s *SASLAuth) checkStatus(ctx context.Context, username string) error {
+	if s.StatusAllowed == nil {
+		return nil
+	}
+	status, err := acctstatus.Lookup(ctx, s.AccountStatus, username)
+	if err != nil {
+		return err
+	}
+	if !s.StatusAllowed(status) {
+		return fmt.Errorf("%w (status: %v)", ErrAccountDisabled, status)
+	}
+	return nil
+}
+
+func (s *SASLAuth) disabledErr() error {
+	if s.DisabledErr != nil {
+		return s.DisabledErr
+	}
+	return ErrAccountDisabled
+}
+
 type ContextData struct {
 	// Authentication username. May be different from identity.
 	Username string
@@ -128,7 +220,57 @@ type ContextData struct {
 }
 
 // CreateSASL creates the sasl.Server instance for the corresponding mechanism.
-func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(identity string, data ContextData) error) sasl.Server {
+//
+// tlsState should be set if the connection uses TLS, it is required for
+// mechanisms with channel binding (SCRAM-*-PLUS).
+func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, tlsState *tls.ConnectionState, successCb func(identity string, data ContextData) error) sasl.Server {
+	if hashName, plus, ok := scram.ParseMechanism(mech); ok && s.scramSupported(hashName) {
+		if plus && tlsState == nil {
+			return FailingSASLServ{Err: ErrUnsupportedMech}
+		}
+
+		var (
+			username string
+			verified bool
+		)
+		srv := scram.NewServer(hashName, plus, tlsState, func(saslUsername string) (module.SCRAMCredentials, error) {
+			username = saslUsername
+			return s.scramCredentials(context.TODO(), hashName, saslUsername)
+		}, func(identity, username string) error {
+			verified = true
+			if identity == "" {
+				identity = username
+			}
+			if identity != username {
+				return ErrInvalidAuthCred
+			}
+
+			username, err := s.usernameForAuth(context.TODO(), username)
+			if err != nil {
+				return err
+			}
+			if err := s.checkAccount(context.TODO(), username, remoteAddr); err != nil {
+				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
+				if errors.Is(err, ErrAccountDisabled) {
+					return s.disabledErr()
+				}
+				return ErrInvalidAuthCred
+			}
+
+			return successCb(identity, ContextData{
+				Username: username,
+			})
+		})
+		return errorMappingServ{Server: srv, mapErr: func(err error) error {
+			if verified {
+				// Error from the success callback.
+				return err
+			}
+			s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr, "mech", mech)
+			return ErrInvalidAuthCred
+		}}
+	}
+
 	switch mech {
 	case sasl.Plain:
 		return sasl.NewPlainServer(func(identity, username, password string) error {
@@ -144,9 +286,12 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 				return err
 			}
 
-			err = s.AuthPlain(username, password)
+			err = s.AuthPlain(username, password, remoteAddr)
 			if err != nil {
 				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
+				if errors.Is(err, ErrAccountDisabled) {
+					return s.disabledErr()
+				}
 				return ErrInvalidAuthCred
 			}
 
@@ -166,9 +311,12 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 				return err
 			}
 
-			err = s.AuthPlain(username, password)
+			err = s.AuthPlain(username, password, remoteAddr)
 			if err != nil {
 				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
+				if errors.Is(err, ErrAccountDisabled) {
+					return s.disabledErr()
+				}
 				return ErrInvalidAuthCred
 			}
 
@@ -194,6 +342,10 @@ func (s *SASLAuth) AddProvider(m *config.Map, node config.Node) error {
 		s.Plain = append(s.Plain, plainAuth)
 		hasAny = true
 	}
+	if scramAuth, ok := any.(module.SCRAMAuth); ok && len(scramAuth.SCRAMHashes()) != 0 {
+		s.SCRAM = append(s.SCRAM, scramAuth)
+		hasAny = true
+	}
 
 	if !hasAny {
 		return config.NodeErr(node, "auth: specified module does not provide any SASL mechanism")
@@ -201,6 +353,21 @@ func (s *SASLAuth) AddProvider(m *config.Map, node config.Node) error {
 	return nil
 }
 
+// errorMappingServ passes errors returned by the wrapped sasl.Server through
+// mapErr.
+type errorMappingServ struct {
+	sasl.Server
+	mapErr func(error) error
+}
+
+func (s errorMappingServ) Next(response []byte) ([]byte, bool, error) {
+	challenge, done, err := s.Server.Next(response)
+	if err != nil {
+		err = s.mapErr(err)
+	}
+	return challenge, done, err
+}
+
 type FailingSASLServ struct{ Err error }
 
 func (s FailingSASLServ) Next([]byte) ([]byte, bool, error) {
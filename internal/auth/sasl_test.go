@@ -19,12 +19,22 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package auth
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"net"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/emersion/go-sasl"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/acctstatus"
+	"github.com/foxcpp/maddy/internal/auth/scram"
 	"github.com/foxcpp/maddy/internal/testutils"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 type mockAuth struct {
@@ -52,7 +62,7 @@ func TestCreateSASL(t *testing.T) {
 	}
 
 	t.Run("XWHATEVER", func(t *testing.T) {
-		srv := a.CreateSASL("XWHATEVER", &net.TCPAddr{}, func(string, ContextData) error { return nil })
+		srv := a.CreateSASL("XWHATEVER", &net.TCPAddr{}, nil, func(string, ContextData) error { return nil })
 		_, _, err := srv.Next([]byte(""))
 		if err == nil {
 			t.Error("No error for XWHATEVER use")
@@ -60,7 +70,7 @@ func TestCreateSASL(t *testing.T) {
 	})
 
 	t.Run("PLAIN", func(t *testing.T) {
-		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, func(id string, data ContextData) error {
+		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, nil, func(id string, data ContextData) error {
 			if id != "user1" {
 				t.Fatal("Wrong auth. identities passed to callback:", id)
 			}
@@ -74,7 +84,7 @@ func TestCreateSASL(t *testing.T) {
 	})
 
 	t.Run("PLAIN with authorization identity", func(t *testing.T) {
-		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, func(id string, data ContextData) error {
+		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, nil, func(id string, data ContextData) error {
 			if id != "user1" {
 				t.Fatal("Wrong authorization identity passed:", id)
 			}
@@ -87,3 +97,208 @@ func TestCreateSASL(t *testing.T) {
 		}
 	})
 }
+
+func TestSASLAuthAccountStatus(t *testing.T) {
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		Plain: []module.PlainAuth{
+			&mockAuth{
+				db: map[string]bool{
+					"user1": true,
+					"user2": true,
+				},
+			},
+		},
+		AccountStatus: testutils.Table{M: map[string]string{
+			"user2": "receive-only",
+		}},
+		StatusAllowed: acctstatus.Status.AllowsSending,
+	}
+
+	if err := a.AuthPlain("user1", "aa", &net.TCPAddr{}); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	if err := a.AuthPlain("user2", "aa", &net.TCPAddr{}); !errors.Is(err, ErrAccountDisabled) {
+		t.Error("Expected ErrAccountDisabled, got", err)
+	}
+
+	disabledErr := errors.New("disabled")
+	a.DisabledErr = disabledErr
+	srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, nil, func(string, ContextData) error {
+		t.Fatal("Callback called for disabled account")
+		return nil
+	})
+	if _, _, err := srv.Next([]byte("\x00user2\x00aa")); err != disabledErr {
+		t.Error("Expected DisabledErr, got", err)
+	}
+}
+
+func TestSASLAuthAllowedIPs(t *testing.T) {
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		Plain: []module.PlainAuth{
+			&mockAuth{
+				db: map[string]bool{
+					"user1":   true,
+					"relay":   true,
+					"blocked": true,
+				},
+			},
+		},
+		AllowedIPs: testutils.Table{M: map[string]string{
+			"relay":   "192.0.2.0/24, 2001:db8::1",
+			"blocked": "",
+		}},
+	}
+
+	for _, c := range []struct {
+		user string
+		addr net.Addr
+		ok   bool
+	}{
+		{"user1", &net.TCPAddr{IP: net.IPv4(203, 0, 113, 1)}, true},
+		{"relay", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10)}, true},
+		{"relay", &net.TCPAddr{IP: net.ParseIP("2001:db8::1")}, true},
+		{"relay", &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.10")}, true},
+		{"relay", &net.TCPAddr{IP: net.IPv4(203, 0, 113, 1)}, false},
+		{"relay", &net.TCPAddr{IP: net.ParseIP("2001:db8::2")}, false},
+		{"relay", &net.UnixAddr{Name: "/run/maddy/sasl.sock", Net: "unix"}, false},
+		{"relay", nil, false},
+		{"blocked", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10)}, false},
+	} {
+		err := a.AuthPlain(c.user, "aa", c.addr)
+		if c.ok && err != nil {
+			t.Errorf("%s from %v: unexpected error: %v", c.user, c.addr, err)
+		}
+		if !c.ok && !errors.Is(err, ErrDisallowedIP) {
+			t.Errorf("%s from %v: expected ErrDisallowedIP, got %v", c.user, c.addr, err)
+		}
+	}
+
+	srv := a.CreateSASL("PLAIN", &net.TCPAddr{IP: net.IPv4(203, 0, 113, 1)}, nil, func(string, ContextData) error {
+		t.Fatal("Callback called for disallowed address")
+		return nil
+	})
+	if _, _, err := srv.Next([]byte("\x00relay\x00aa")); !errors.Is(err, ErrInvalidAuthCred) {
+		t.Error("Expected ErrInvalidAuthCred, got", err)
+	}
+
+	a.AllowedIPs = testutils.Table{M: map[string]string{
+		"relay": "192.0.2.0/33",
+	}}
+	if err := a.AuthPlain("relay", "aa", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10)}); err == nil || errors.Is(err, ErrDisallowedIP) {
+		t.Error("Expected malformed entry error, got", err)
+	}
+}
+
+type mockSCRAM map[string]module.SCRAMCredentials
+
+func (m mockSCRAM) SCRAMHashes() []string {
+	return []string{scram.SHA256}
+}
+
+func (m mockSCRAM) SCRAMCredentials(username, hashName string) (module.SCRAMCredentials, error) {
+	creds, ok := m[username]
+	if !ok || hashName != scram.SHA256 {
+		return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+	}
+	return creds, nil
+}
+
+// scramSHA256 performs SCRAM-SHA-256 exchange without channel binding.
+func scramSHA256(srv sasl.Server, username, password string) error {
+	hmacSum := func(key []byte, data string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(data))
+		return mac.Sum(nil)
+	}
+
+	clientFirstBare := "n=" + username + ",r=nonce"
+	challenge, _, err := srv.Next([]byte("n,," + clientFirstBare))
+	if err != nil {
+		return err
+	}
+	serverFirst := string(challenge)
+	fields := strings.Split(serverFirst, ",")
+	salt, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(fields[1], "s="))
+	iterations, _ := strconv.Atoi(strings.TrimPrefix(fields[2], "i="))
+
+	clientFinal := "c=biws," + fields[0]
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinal
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := hmacSum(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	clientSig := hmacSum(storedKey[:], authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= clientSig[i]
+	}
+
+	if _, _, err := srv.Next([]byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(clientKey))); err != nil {
+		return err
+	}
+	_, _, err = srv.Next([]byte{})
+	return err
+}
+
+func TestCreateSASL_SCRAM(t *testing.T) {
+	creds, err := scram.NewCredentials(scram.SHA256, "password", scram.MinIterations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		SCRAM: []module.SCRAMAuth{mockSCRAM{
+			"user1": creds,
+			"user2": creds,
+		}},
+		AccountStatus: testutils.Table{M: map[string]string{
+			"user2": "suspended",
+		}},
+		StatusAllowed: acctstatus.Status.AllowsLogin,
+	}
+
+	mechs := a.SASLMechanisms()
+	if !reflect.DeepEqual(mechs, []string{"SCRAM-SHA-256", "SCRAM-SHA-256-PLUS"}) {
+		t.Error("Wrong mechanisms list:", mechs)
+	}
+
+	var authUser string
+	create := func(mech string) sasl.Server {
+		authUser = ""
+		return a.CreateSASL(mech, &net.TCPAddr{}, nil, func(id string, data ContextData) error {
+			if id != data.Username {
+				t.Errorf("Wrong identity passed to callback: %s, %s", id, data.Username)
+			}
+			authUser = id
+			return nil
+		})
+	}
+
+	if err := scramSHA256(create("SCRAM-SHA-256"), "user1", "password"); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	if authUser != "user1" {
+		t.Error("Callback not called")
+	}
+
+	if err := scramSHA256(create("SCRAM-SHA-256"), "user1", "wrong"); !errors.Is(err, ErrInvalidAuthCred) {
+		t.Error("Expected ErrInvalidAuthCred, got", err)
+	}
+	if err := scramSHA256(create("SCRAM-SHA-256"), "user3", "password"); !errors.Is(err, ErrInvalidAuthCred) {
+		t.Error("Expected ErrInvalidAuthCred, got", err)
+	}
+	if err := scramSHA256(create("SCRAM-SHA-256"), "user2", "password"); !errors.Is(err, ErrAccountDisabled) {
+		t.Error("Expected ErrAccountDisabled, got", err)
+	}
+	if authUser != "" {
+		t.Error("Callback called for failed authentication")
+	}
+
+	// Channel binding is not possible without TLS.
+	if _, _, err := create("SCRAM-SHA-256-PLUS").Next(nil); !errors.Is(err, ErrUnsupportedMech) {
+		t.Error("Expected ErrUnsupportedMech, got", err)
+	}
+	if _, _, err := create("SCRAM-SHA-512").Next(nil); !errors.Is(err, ErrUnsupportedMech) {
+		t.Error("Expected ErrUnsupportedMech, got", err)
+	}
+}
@@ -0,0 +1,473 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package scram implements the server side of SCRAM SASL mechanisms
+// (RFC 5802, RFC 7677) including channel binding (-PLUS variants) to the
+// TLS connection.
+package scram
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"github.com/foxcpp/maddy/framework/module"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/text/secure/precis"
+)
+
+const (
+	SHA1   = "SHA-1"
+	SHA256 = "SHA-256"
+	SHA512 = "SHA-512"
+
+	// MinIterations is the minimal iteration count recommended by RFC 7677.
+	MinIterations = 4096
+	// SaltSize is the size of salts generated by NewCredentials.
+	SaltSize = 16
+)
+
+// Hashes lists supported hash functions in the order of preference.
+//
+// SHA-1 is the least preferred and is supported only for compatibility
+// with clients that do not implement other mechanisms.
+var Hashes = []string{SHA256, SHA512, SHA1}
+
+var hashFuncs = map[string]func() hash.Hash{
+	SHA1:   sha1.New,
+	SHA256: sha256.New,
+	SHA512: sha512.New,
+}
+
+// Channel binding types, see RFC 5929 and RFC 9266.
+const (
+	bindingTLSUnique   = "tls-unique"
+	bindingTLSExporter = "tls-exporter"
+)
+
+var (
+	ErrInvalidProof   = errors.New("scram: invalid proof")
+	ErrBindingFailed  = errors.New("scram: channel binding mismatch")
+	ErrNoBinding      = errors.New("scram: channel binding is not supported for this connection")
+	ErrBindingMissing = errors.New("scram: channel binding is required")
+	ErrDowngrade      = errors.New("scram: channel binding downgrade detected")
+	ErrMalformed      = errors.New("scram: malformed message")
+)
+
+// Mechanism returns the SASL mechanism name for the hash function.
+func Mechanism(hashName string, plus bool) string {
+	if plus {
+		return "SCRAM-" + hashName + "-PLUS"
+	}
+	return "SCRAM-" + hashName
+}
+
+// ParseMechanism returns the hash function name used by the SASL mechanism
+// and whether it requires channel binding.
+func ParseMechanism(mech string) (hashName string, plus, ok bool) {
+	if !strings.HasPrefix(mech, "SCRAM-") {
+		return "", false, false
+	}
+	hashName = strings.TrimPrefix(mech, "SCRAM-")
+	if strings.HasSuffix(hashName, "-PLUS") {
+		hashName = strings.TrimSuffix(hashName, "-PLUS")
+		plus = true
+	}
+	if _, ok := hashFuncs[hashName]; !ok {
+		return "", false, false
+	}
+	return hashName, plus, true
+}
+
+// Supported reports whether the hash function can be used.
+func Supported(hashName string) bool {
+	_, ok := hashFuncs[hashName]
+	return ok
+}
+
+func hmacSum(h func() hash.Hash, key, data []byte) []byte {
+	mac := hmac.New(h, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func hashSum(h func() hash.Hash, data []byte) []byte {
+	hs := h()
+	hs.Write(data)
+	return hs.Sum(nil)
+}
+
+// ComputeCredentials derives credentials stored by the server from the
+// password.
+func ComputeCredentials(hashName, password string, salt []byte, iterations int) (module.SCRAMCredentials, error) {
+	h, ok := hashFuncs[hashName]
+	if !ok {
+		return module.SCRAMCredentials{}, fmt.Errorf("scram: unsupported hash: %s", hashName)
+	}
+
+	// RFC 5802 requires SASLprep which is superseded by the OpaqueString
+	// profile (RFC 8265).
+	prepared, err := precis.OpaqueString.String(password)
+	if err != nil {
+		prepared = password
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(prepared), salt, iterations, h().Size(), h)
+	clientKey := hmacSum(h, saltedPassword, []byte("Client Key"))
+	return module.SCRAMCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  hashSum(h, clientKey),
+		ServerKey:  hmacSum(h, saltedPassword, []byte("Server Key")),
+	}, nil
+}
+
+// NewCredentials is similar to ComputeCredentials but generates a random salt.
+func NewCredentials(hashName, password string, iterations int) (module.SCRAMCredentials, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return module.SCRAMCredentials{}, fmt.Errorf("scram: failed to generate salt: %w", err)
+	}
+	return ComputeCredentials(hashName, password, salt, iterations)
+}
+
+// VerifyPassword checks whether the password matches the credentials.
+func VerifyPassword(hashName, password string, creds module.SCRAMCredentials) error {
+	computed, err := ComputeCredentials(hashName, password, creds.Salt, creds.Iterations)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(computed.StoredKey, creds.StoredKey) != 1 {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// bindingData returns channel binding data of the specified type for the
+// TLS connection.
+func bindingData(state *tls.ConnectionState, cbType string) ([]byte, error) {
+	if state == nil || !state.HandshakeComplete {
+		return nil, ErrNoBinding
+	}
+	switch cbType {
+	case bindingTLSExporter:
+		data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		if err != nil {
+			return nil, ErrNoBinding
+		}
+		return data, nil
+	case bindingTLSUnique:
+		if state.Version >= tls.VersionTLS13 || len(state.TLSUnique) == 0 {
+			return nil, ErrNoBinding
+		}
+		return state.TLSUnique, nil
+	}
+	return nil, ErrNoBinding
+}
+
+// LookupFunc returns the stored credentials for the user.
+//
+// It should return module.ErrUnknownCredentials if the user does not exist,
+// in this case the exchange continues with fake credentials so the
+// existence of the user is not revealed.
+type LookupFunc func(username string) (module.SCRAMCredentials, error)
+
+// SuccessFunc is called after the client is successfully authenticated.
+type SuccessFunc func(identity, username string) error
+
+const (
+	stateClientFirst = iota
+	stateClientFinal
+	stateClientEnd
+	stateDone
+)
+
+type server struct {
+	hash     func() hash.Hash
+	plus     bool
+	tlsState *tls.ConnectionState
+	lookup   LookupFunc
+	success  SuccessFunc
+
+	state int
+
+	identity        string
+	username        string
+	gs2Header       string
+	cbData          []byte
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	creds           module.SCRAMCredentials
+	unknownUser     bool
+}
+
+// NewServer creates the server side of the SCRAM-<hashName>[-PLUS]
+// exchange.
+//
+// tlsState is the state of the underlying TLS connection or nil if there is
+// none. If it is set, the client is assumed to have seen -PLUS mechanisms
+// advertised.
+func NewServer(hashName string, plus bool, tlsState *tls.ConnectionState, lookup LookupFunc, success SuccessFunc) sasl.Server {
+	return &server{
+		hash:     hashFuncs[hashName],
+		plus:     plus,
+		tlsState: tlsState,
+		lookup:   lookup,
+		success:  success,
+	}
+}
+
+// decodeName decodes the saslname production of RFC 5802.
+func decodeName(name string) (string, error) {
+	if !strings.Contains(name, "=") {
+		return name, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			b.WriteByte(name[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(name[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", ErrMalformed
+		}
+		i += 2
+	}
+	return b.String(), nil
+}
+
+func attr(field string, name byte) (string, bool) {
+	if len(field) < 2 || field[0] != name || field[1] != '=' {
+		return "", false
+	}
+	return field[2:], true
+}
+
+func (s *server) clientFirst(msg string) ([]byte, error) {
+	// gs2-cbind-flag "," [authzid] "," client-first-message-bare
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	switch {
+	case parts[0] == "n":
+		if s.plus {
+			return nil, ErrBindingMissing
+		}
+	case parts[0] == "y":
+		if s.plus {
+			return nil, ErrBindingMissing
+		}
+		// The client supports channel binding but thinks the server
+		// does not. Since we advertise -PLUS variants on TLS
+		// connections, that means the mechanism list was tampered with.
+		if s.tlsState != nil && s.tlsState.HandshakeComplete {
+			return nil, ErrDowngrade
+		}
+	case strings.HasPrefix(parts[0], "p="):
+		if !s.plus {
+			return nil, ErrMalformed
+		}
+		var err error
+		s.cbData, err = bindingData(s.tlsState, parts[0][2:])
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrMalformed
+	}
+
+	if parts[1] != "" {
+		authzid, ok := attr(parts[1], 'a')
+		if !ok {
+			return nil, ErrMalformed
+		}
+		identity, err := decodeName(authzid)
+		if err != nil {
+			return nil, err
+		}
+		s.identity = identity
+	}
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+
+	s.clientFirstBare = parts[2]
+	bare := strings.Split(parts[2], ",")
+	if len(bare) < 2 {
+		return nil, ErrMalformed
+	}
+	name, ok := attr(bare[0], 'n')
+	if !ok {
+		// Also covers the mandatory extension "m=" we do not support.
+		return nil, ErrMalformed
+	}
+	username, err := decodeName(name)
+	if err != nil || username == "" {
+		return nil, ErrMalformed
+	}
+	s.username = username
+	clientNonce, ok := attr(bare[1], 'r')
+	if !ok || clientNonce == "" {
+		return nil, ErrMalformed
+	}
+
+	s.creds, err = s.lookup(username)
+	if err != nil {
+		if !errors.Is(err, module.ErrUnknownCredentials) {
+			return nil, err
+		}
+		s.unknownUser = true
+		if err := s.fakeCredentials(); err != nil {
+			return nil, err
+		}
+	}
+
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, err
+	}
+	s.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(serverNonce)
+
+	s.serverFirst = "r=" + s.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(s.creds.Salt) +
+		",i=" + strconv.Itoa(s.creds.Iterations)
+	return []byte(s.serverFirst), nil
+}
+
+// fakeCredentials generates credentials for a non-existent user.
+//
+// The salt should stay the same across attempts for the same username,
+// otherwise it is trivial to tell that the user does not exist.
+func (s *server) fakeCredentials() error {
+	key := make([]byte, s.hash().Size())
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	s.creds = module.SCRAMCredentials{
+		Salt:       hmacSum(s.hash, fakeSaltKey, []byte(s.username))[:SaltSize],
+		Iterations: MinIterations,
+		StoredKey:  key,
+		ServerKey:  key,
+	}
+	return nil
+}
+
+var fakeSaltKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+func (s *server) clientFinal(msg string) ([]byte, error) {
+	// channel-binding "," nonce ["," extensions] "," proof
+	proofIdx := strings.LastIndex(msg, ",p=")
+	if proofIdx == -1 {
+		return nil, ErrMalformed
+	}
+	withoutProof := msg[:proofIdx]
+	proof, err := base64.StdEncoding.DecodeString(msg[proofIdx+3:])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	fields := strings.Split(withoutProof, ",")
+	if len(fields) < 2 {
+		return nil, ErrMalformed
+	}
+	cbEncoded, ok := attr(fields[0], 'c')
+	if !ok {
+		return nil, ErrMalformed
+	}
+	cbInput, err := base64.StdEncoding.DecodeString(cbEncoded)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	expectedCB := append([]byte(s.gs2Header), s.cbData...)
+	if subtle.ConstantTimeCompare(cbInput, expectedCB) != 1 {
+		return nil, ErrBindingFailed
+	}
+	nonce, ok := attr(fields[1], 'r')
+	if !ok || nonce != s.nonce {
+		return nil, ErrMalformed
+	}
+
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+	clientSignature := hmacSum(s.hash, s.creds.StoredKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return nil, ErrInvalidProof
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	if subtle.ConstantTimeCompare(hashSum(s.hash, clientKey), s.creds.StoredKey) != 1 || s.unknownUser {
+		return nil, ErrInvalidProof
+	}
+
+	serverSignature := hmacSum(s.hash, s.creds.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+func (s *server) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch s.state {
+	case stateClientFirst:
+		if response == nil {
+			// No initial response, request it.
+			return []byte{}, false, nil
+		}
+		challenge, err = s.clientFirst(string(response))
+	case stateClientFinal:
+		// Server signature is sent as a challenge since SASL
+		// implementations in go-smtp and go-imap do not support
+		// additional data with success.
+		challenge, err = s.clientFinal(string(response))
+	case stateClientEnd:
+		if len(response) != 0 {
+			return nil, true, ErrMalformed
+		}
+		return nil, true, s.success(s.identity, s.username)
+	default:
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+	if err != nil {
+		s.state = stateDone
+		return nil, true, err
+	}
+	s.state++
+	return challenge, false, nil
+}
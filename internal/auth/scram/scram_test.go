@@ -0,0 +1,339 @@
+package scram
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// clientProof computes the client proof and the expected server signature
+// as described in RFC 5802 Section 3.
+func clientProof(h func() hash.Hash, password string, salt []byte, iterations int, authMessage string) (proof, serverSig []byte) {
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iterations, h().Size(), h)
+	clientKey := hmacSum(h, saltedPassword, []byte("Client Key"))
+	storedKey := hashSum(h, clientKey)
+	clientSig := hmacSum(h, storedKey, []byte(authMessage))
+	proof = make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSig[i]
+	}
+	serverKey := hmacSum(h, saltedPassword, []byte("Server Key"))
+	return proof, hmacSum(h, serverKey, []byte(authMessage))
+}
+
+func TestComputeCredentials(t *testing.T) {
+	// Example from RFC 7677 Section 3.
+	const (
+		clientFirstBare = "n=user,r=rOprNGfwEbeRWgbNEkqO"
+		serverFirst     = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+		clientFinal     = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+		authMessage     = clientFirstBare + "," + serverFirst + "," + clientFinal
+	)
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+
+	proof, serverSig := clientProof(hashFuncs[SHA256], "pencil", salt, 4096, authMessage)
+	if enc := base64.StdEncoding.EncodeToString(proof); enc != "dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=" {
+		t.Fatal("Wrong client proof:", enc)
+	}
+
+	creds, err := ComputeCredentials(SHA256, "pencil", salt, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := hmacSum(hashFuncs[SHA256], creds.ServerKey, []byte(authMessage))
+	if !bytes.Equal(sig, serverSig) {
+		t.Fatal("Server key does not match")
+	}
+	if enc := base64.StdEncoding.EncodeToString(sig); enc != "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=" {
+		t.Fatal("Wrong server signature:", enc)
+	}
+
+	if err := VerifyPassword(SHA256, "pencil", creds); err != nil {
+		t.Error("VerifyPassword failed:", err)
+	}
+	if err := VerifyPassword(SHA256, "pencil2", creds); err == nil {
+		t.Error("VerifyPassword succeeded for wrong password")
+	}
+}
+
+func TestComputeCredentials_SHA1(t *testing.T) {
+	// Example from RFC 5802 Section 5.
+	const (
+		clientFirstBare = "n=user,r=fyko+d2lbbFgONRv9qkxdawL"
+		serverFirst     = "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096"
+		clientFinal     = "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j"
+		authMessage     = clientFirstBare + "," + serverFirst + "," + clientFinal
+	)
+	salt, _ := base64.StdEncoding.DecodeString("QSXCR+Q6sek8bf92")
+
+	proof, _ := clientProof(hashFuncs[SHA1], "pencil", salt, 4096, authMessage)
+	if enc := base64.StdEncoding.EncodeToString(proof); enc != "v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=" {
+		t.Fatal("Wrong client proof:", enc)
+	}
+
+	creds, err := ComputeCredentials(SHA1, "pencil", salt, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := hmacSum(hashFuncs[SHA1], creds.ServerKey, []byte(authMessage))
+	if enc := base64.StdEncoding.EncodeToString(sig); enc != "rmF9pqV8S7suAoZWja4dJRkFsKQ=" {
+		t.Fatal("Wrong server signature:", enc)
+	}
+}
+
+type exchange struct {
+	hashName  string
+	username  string
+	password  string
+	gs2Header string
+	cbData    []byte
+
+	// Modifies the client-final-message without proof.
+	tamper func(string) string
+}
+
+// run performs the exchange and returns the error returned by the server
+// and the salt sent by the server.
+func (e exchange) run(t *testing.T, srv interface {
+	Next([]byte) ([]byte, bool, error)
+}) ([]byte, error) {
+	t.Helper()
+
+	h := hashFuncs[e.hashName]
+	clientFirstBare := "n=" + e.username + ",r=clientnonce"
+
+	challenge, done, err := srv.Next(nil)
+	if err != nil || done || len(challenge) != 0 {
+		t.Fatal("Unexpected response to empty initial response:", challenge, done, err)
+	}
+
+	challenge, done, err = srv.Next([]byte(e.gs2Header + clientFirstBare))
+	if err != nil {
+		return nil, err
+	}
+	if done {
+		t.Fatal("Unexpected done")
+	}
+	serverFirst := string(challenge)
+	fields := strings.Split(serverFirst, ",")
+	if len(fields) != 3 || !strings.HasPrefix(fields[0], "r=clientnonce") {
+		t.Fatal("Malformed server-first-message:", serverFirst)
+	}
+	salt, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(fields[1], "s="))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iterations, err := strconv.Atoi(strings.TrimPrefix(fields[2], "i="))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cbInput := base64.StdEncoding.EncodeToString(append([]byte(e.gs2Header), e.cbData...))
+	clientFinal := "c=" + cbInput + "," + fields[0]
+	if e.tamper != nil {
+		clientFinal = e.tamper(clientFinal)
+	}
+	proof, serverSig := clientProof(h, e.password, salt, iterations, clientFirstBare+","+serverFirst+","+clientFinal)
+
+	challenge, done, err = srv.Next([]byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return salt, err
+	}
+	if done {
+		t.Fatal("Unexpected done")
+	}
+	if !hmac.Equal(challenge, []byte("v="+base64.StdEncoding.EncodeToString(serverSig))) {
+		t.Fatal("Wrong server signature")
+	}
+
+	_, done, err = srv.Next([]byte{})
+	if !done {
+		t.Fatal("Expected done")
+	}
+	return salt, err
+}
+
+func testLookup(t *testing.T, hashName string) LookupFunc {
+	creds, err := NewCredentials(hashName, "password", MinIterations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(username string) (module.SCRAMCredentials, error) {
+		if username != "user" && username != "user,name" {
+			return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+		}
+		return creds, nil
+	}
+}
+
+func TestServer(t *testing.T) {
+	for _, hashName := range Hashes {
+		t.Run(hashName, func(t *testing.T) {
+			lookup := testLookup(t, hashName)
+			newServer := func(expectedID string) *server {
+				return NewServer(hashName, false, nil, lookup, func(identity, username string) error {
+					if identity != expectedID {
+						t.Errorf("Wrong identity: %s", identity)
+					}
+					return nil
+				}).(*server)
+			}
+
+			_, err := exchange{hashName: hashName, username: "user", password: "password", gs2Header: "n,,"}.run(t, newServer(""))
+			if err != nil {
+				t.Error("Unexpected error:", err)
+			}
+			_, err = exchange{hashName: hashName, username: "user=2Cname", password: "password", gs2Header: "n,a=other,"}.run(t, newServer("other"))
+			if err != nil {
+				t.Error("Unexpected error:", err)
+			}
+			// Client supports channel binding, but it is not available.
+			_, err = exchange{hashName: hashName, username: "user", password: "password", gs2Header: "y,,"}.run(t, newServer(""))
+			if err != nil {
+				t.Error("Unexpected error:", err)
+			}
+
+			_, err = exchange{hashName: hashName, username: "user", password: "wrong", gs2Header: "n,,"}.run(t, newServer(""))
+			if !errors.Is(err, ErrInvalidProof) {
+				t.Error("Expected ErrInvalidProof, got", err)
+			}
+			_, err = exchange{
+				hashName: hashName, username: "user", password: "password", gs2Header: "n,,",
+				tamper: func(s string) string { return strings.Replace(s, "clientnonce", "othernonce", 1) },
+			}.run(t, newServer(""))
+			if !errors.Is(err, ErrMalformed) {
+				t.Error("Expected ErrMalformed, got", err)
+			}
+
+			// Non-existent users get the same salt each time.
+			salt1, err := exchange{hashName: hashName, username: "nobody", password: "password", gs2Header: "n,,"}.run(t, newServer(""))
+			if !errors.Is(err, ErrInvalidProof) {
+				t.Error("Expected ErrInvalidProof, got", err)
+			}
+			salt2, _ := exchange{hashName: hashName, username: "nobody", password: "password", gs2Header: "n,,"}.run(t, newServer(""))
+			if !bytes.Equal(salt1, salt2) {
+				t.Error("Salt for non-existent user is different")
+			}
+
+			for _, msg := range []string{"", "x,,n=user,r=a", "n,,r=a", "n,,n=user", "n,,m=ext,n=user,r=a", "n,,n=us=er,r=a", "n,x,n=user,r=a", "p=tls-unique,,n=user,r=a"} {
+				_, _, err := newServer("").Next([]byte(msg))
+				if err == nil {
+					t.Errorf("Expected an error for %q", msg)
+				}
+			}
+		})
+	}
+}
+
+func testTLSState(t *testing.T, maxVersion uint16) (client, server tls.ConnectionState) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	srv := tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MaxVersion:   maxVersion,
+	})
+	cl := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.Handshake() }()
+	if err := cl.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	return cl.ConnectionState(), srv.ConnectionState()
+}
+
+func TestServer_ChannelBinding(t *testing.T) {
+	lookup := testLookup(t, SHA256)
+	success := func(string, string) error { return nil }
+
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		clientState, serverState := testTLSState(t, version)
+		otherClientState, _ := testTLSState(t, version)
+
+		exporter, err := clientState.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherExporter, err := otherClientState.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		run := func(plus bool, e exchange) error {
+			t.Helper()
+			e.hashName = SHA256
+			e.username = "user"
+			e.password = "password"
+			_, err := e.run(t, NewServer(SHA256, plus, &serverState, lookup, success))
+			return err
+		}
+
+		if err := run(true, exchange{gs2Header: "p=tls-exporter,,", cbData: exporter}); err != nil {
+			t.Error("tls-exporter:", err)
+		}
+		if err := run(true, exchange{gs2Header: "p=tls-exporter,,", cbData: otherExporter}); !errors.Is(err, ErrBindingFailed) {
+			t.Error("Expected ErrBindingFailed, got", err)
+		}
+		if version == tls.VersionTLS12 {
+			if err := run(true, exchange{gs2Header: "p=tls-unique,,", cbData: clientState.TLSUnique}); err != nil {
+				t.Error("tls-unique:", err)
+			}
+			if err := run(true, exchange{gs2Header: "p=tls-unique,,", cbData: otherClientState.TLSUnique}); !errors.Is(err, ErrBindingFailed) {
+				t.Error("Expected ErrBindingFailed, got", err)
+			}
+		} else {
+			if err := run(true, exchange{gs2Header: "p=tls-unique,,"}); !errors.Is(err, ErrNoBinding) {
+				t.Error("Expected ErrNoBinding for tls-unique with TLS 1.3, got", err)
+			}
+		}
+
+		if err := run(true, exchange{gs2Header: "n,,"}); !errors.Is(err, ErrBindingMissing) {
+			t.Error("Expected ErrBindingMissing, got", err)
+		}
+		if err := run(false, exchange{gs2Header: "y,,"}); !errors.Is(err, ErrDowngrade) {
+			t.Error("Expected ErrDowngrade, got", err)
+		}
+		if err := run(false, exchange{gs2Header: "n,,"}); err != nil {
+			t.Error("Unexpected error without channel binding:", err)
+		}
+	}
+}
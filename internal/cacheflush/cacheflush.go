@@ -0,0 +1,127 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package cacheflush keeps track of caches maintained by modules so they
+// can be flushed at run time using the control socket, e.g. after a
+// misconfigured DNS record or MTA-STS policy of a remote domain was fixed.
+package cacheflush
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Flusher is implemented by caches that can be flushed at run time.
+type Flusher interface {
+	// FlushCache removes cached entries related to the key or all entries if
+	// the key is empty. The meaning of the key depends on the cache kind
+	// (e.g. domain name or username). The amount of removed entries is
+	// returned.
+	FlushCache(key string) int
+}
+
+// ErrNoCache is returned by Flush if there are no caches matching the
+// request.
+var ErrNoCache = errors.New("cacheflush: no matching caches")
+
+// Cache describes the registered cache.
+type Cache struct {
+	Kind string `json:"kind"`
+	Name string `json:"name,omitempty"`
+}
+
+// FlushResult is the result of the cache.flush control command.
+type FlushResult struct {
+	Caches  int `json:"caches"`
+	Removed int `json:"removed"`
+}
+
+type regKey struct {
+	Cache
+
+	// Set for caches without a name (e.g. owned by inline modules) so they
+	// do not replace each other.
+	unnamed Flusher
+}
+
+var (
+	caches    = make(map[regKey]Flusher)
+	cachesLck sync.Mutex
+)
+
+// Register makes the cache available for flushing. Cache registered
+// previously with the same kind and non-empty name is replaced.
+//
+// f should be comparable (e.g. a pointer) if name is empty.
+func Register(kind, name string, f Flusher) {
+	key := regKey{Cache: Cache{Kind: kind, Name: name}}
+	if name == "" {
+		key.unnamed = f
+	}
+
+	cachesLck.Lock()
+	defer cachesLck.Unlock()
+	caches[key] = f
+}
+
+// List returns all registered caches sorted by kind and name.
+func List() []Cache {
+	cachesLck.Lock()
+	res := make([]Cache, 0, len(caches))
+	for k := range caches {
+		res = append(res, k.Cache)
+	}
+	cachesLck.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Kind != res[j].Kind {
+			return res[i].Kind < res[j].Kind
+		}
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// Flush removes entries related to the key (all entries if it is empty) from
+// caches of the specified kind. If name is not empty, only the cache with
+// that name is flushed. If kind is empty, all caches are flushed.
+func Flush(kind, name, key string) (FlushResult, error) {
+	cachesLck.Lock()
+	var matched []Flusher
+	for k, f := range caches {
+		if kind != "" && k.Kind != kind {
+			continue
+		}
+		if name != "" && k.Name != name {
+			continue
+		}
+		matched = append(matched, f)
+	}
+	cachesLck.Unlock()
+
+	if len(matched) == 0 {
+		return FlushResult{}, ErrNoCache
+	}
+
+	res := FlushResult{Caches: len(matched)}
+	for _, f := range matched {
+		res.Removed += f.FlushCache(key)
+	}
+	return res, nil
+}
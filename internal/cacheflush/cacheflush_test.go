@@ -0,0 +1,109 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cacheflush
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type testCache struct {
+	entries map[string]struct{}
+}
+
+func (c *testCache) FlushCache(key string) int {
+	if key == "" {
+		removed := len(c.entries)
+		c.entries = map[string]struct{}{}
+		return removed
+	}
+	if _, ok := c.entries[key]; !ok {
+		return 0
+	}
+	delete(c.entries, key)
+	return 1
+}
+
+func newTestCache(keys ...string) *testCache {
+	c := &testCache{entries: map[string]struct{}{}}
+	for _, k := range keys {
+		c.entries[k] = struct{}{}
+	}
+	return c
+}
+
+func TestFlush(t *testing.T) {
+	caches = make(map[regKey]Flusher)
+	defer func() { caches = make(map[regKey]Flusher) }()
+
+	a := newTestCache("x", "y")
+	b := newTestCache("x")
+	inline1 := newTestCache("x")
+	inline2 := newTestCache("x")
+	other := newTestCache("x")
+	Register("table", "a", newTestCache())
+	Register("table", "a", a) // replaces the previous one
+	Register("table", "b", b)
+	Register("table", "", inline1)
+	Register("table", "", inline2)
+	Register("auth", "", other)
+
+	expectedList := []Cache{
+		{Kind: "auth"},
+		{Kind: "table"},
+		{Kind: "table"},
+		{Kind: "table", Name: "a"},
+		{Kind: "table", Name: "b"},
+	}
+	if list := List(); !reflect.DeepEqual(list, expectedList) {
+		t.Errorf("wrong list: %+v", list)
+	}
+
+	res, err := Flush("table", "", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (FlushResult{Caches: 4, Removed: 4}) {
+		t.Errorf("wrong result: %+v", res)
+	}
+	if len(other.entries) != 1 {
+		t.Error("cache of other kind flushed")
+	}
+
+	res, err = Flush("table", "a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (FlushResult{Caches: 1, Removed: 1}) {
+		t.Errorf("wrong result: %+v", res)
+	}
+
+	res, err = Flush("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (FlushResult{Caches: 5, Removed: 1}) {
+		t.Errorf("wrong result: %+v", res)
+	}
+
+	if _, err := Flush("dkim", "", ""); !errors.Is(err, ErrNoCache) {
+		t.Errorf("expected ErrNoCache, got %v", err)
+	}
+}
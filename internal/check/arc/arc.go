@@ -0,0 +1,179 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package arc implements the check.arc module that validates ARC (RFC 8617)
+// chains of incoming messages.
+package arc
+
+import (
+	"context"
+	"errors"
+	"runtime/trace"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	modarc "github.com/foxcpp/maddy/internal/modify/arc"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	failAction modconfig.FailAction
+	failOpen   bool
+
+	resolver dns.Resolver
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("check.arc: inline arguments are not used")
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: "check.arc"},
+		resolver: dns.DefaultResolver(),
+	}, nil
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Bool("fail_open", false, false, &c.failOpen)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	_, err := cfg.Process()
+	return err
+}
+
+func (c *Check) Name() string {
+	return "check.arc"
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+type state struct {
+	c   *Check
+	log log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return state{
+		c:   c,
+		log: target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s state) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, "check.arc/CheckBody").End()
+
+	res, err := modarc.Verify(ctx, s.c.resolver, &header, body)
+	if err != nil {
+		if !s.c.failOpen {
+			return module.CheckResult{
+				Reject: true,
+				Reason: &exterrors.SMTPError{
+					Code:         421,
+					EnhancedCode: exterrors.EnhancedCode{4, 7, 29},
+					Message:      "Temporary error during ARC validation",
+					CheckName:    "check.arc",
+					Err:          err,
+				},
+			}
+		}
+		s.log.Error("unable to validate ARC chain", err)
+		return module.CheckResult{
+			AuthResult: []authres.Result{
+				&authres.GenericResult{
+					Method: "arc",
+					Value:  authres.ResultTempError,
+				},
+			},
+		}
+	}
+
+	switch res.Value {
+	case "pass":
+		s.log.DebugMsg("chain passed validation", "instances", res.Instances, "sealer", res.Sealer)
+		return module.CheckResult{
+			AuthResult: []authres.Result{
+				&authres.GenericResult{
+					Method: "arc",
+					Value:  authres.ResultPass,
+				},
+			},
+		}
+	case "fail":
+		s.log.Msg("chain failed validation", "instances", res.Instances, "reason", res.Reason.Error())
+		return s.c.failAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 29},
+				Message:      "ARC chain validation failed",
+				CheckName:    "check.arc",
+				Err:          res.Reason,
+			},
+			AuthResult: []authres.Result{
+				&authres.GenericResult{
+					Method: "arc",
+					Value:  authres.ResultFail,
+				},
+			},
+		})
+	default:
+		return module.CheckResult{
+			AuthResult: []authres.Result{
+				&authres.GenericResult{
+					Method: "arc",
+					Value:  authres.ResultNone,
+				},
+			},
+		}
+	}
+}
+
+func (s state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("check.arc", New)
+}
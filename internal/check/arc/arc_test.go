@@ -0,0 +1,171 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package arc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	modarc "github.com/foxcpp/maddy/internal/modify/arc"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func sealedMsg(t *testing.T, zones map[string]mockdns.Zone, body []byte) textproto.Header {
+	t.Helper()
+
+	dir := t.TempDir()
+	mod, err := modarc.New("modify.arc", "", nil, []string{"a.test", "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "authserv_id", Args: []string{"mx.a.test"}},
+			{Name: "key_path", Args: []string{filepath.Join(dir, "a.test.key")}},
+			{Name: "newkey_algo", Args: []string{"ed25519"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsRecord, err := os.ReadFile(filepath.Join(dir, "a.test.dns"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zones["default._domainkey.a.test."] = mockdns.Zone{TXT: []string{string(dnsRecord)}}
+
+	h := textproto.Header{}
+	h.Add("From", "<sender@example.org>")
+	h.Add("Subject", "heya")
+	h.Add("Authentication-Results", "mx.a.test; spf=pass smtp.mailfrom=sender@example.org")
+
+	state, err := mod.(module.Modifier).ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.RewriteBody(context.Background(), &h, buffer.MemoryBuffer{Slice: body}); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := textproto.WriteHeader(&b, h); err != nil {
+		t.Fatal(err)
+	}
+	h, err = textproto.ReadHeader(bufio.NewReader(&b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func testCheck(t *testing.T, zones map[string]mockdns.Zone, cfg []config.Node) *Check {
+	t.Helper()
+
+	mod, err := New("check.arc", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, "check.arc")
+	c.resolver = &mockdns.Resolver{Zones: zones}
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func checkBody(t *testing.T, c *Check, h textproto.Header, body []byte) module.CheckResult {
+	t.Helper()
+
+	state, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "testing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	return state.CheckBody(context.Background(), h, buffer.MemoryBuffer{Slice: body})
+}
+
+func arcResult(t *testing.T, res module.CheckResult) authres.ResultValue {
+	t.Helper()
+
+	if len(res.AuthResult) != 1 {
+		t.Fatalf("expected 1 auth result, got %d", len(res.AuthResult))
+	}
+	r, ok := res.AuthResult[0].(*authres.GenericResult)
+	if !ok || r.Method != "arc" {
+		t.Fatalf("unexpected auth result: %#v", res.AuthResult[0])
+	}
+	return r.Value
+}
+
+func TestArcCheck(t *testing.T) {
+	zones := map[string]mockdns.Zone{}
+	body := []byte("hello there\r\n")
+	h := sealedMsg(t, zones, body)
+	c := testCheck(t, zones, []config.Node{
+		{Name: "fail_action", Args: []string{"reject"}},
+	})
+
+	res := checkBody(t, c, h, body)
+	if res.Reject || arcResult(t, res) != authres.ResultPass {
+		t.Errorf("expected pass, got %+v", res)
+	}
+
+	res = checkBody(t, c, textproto.Header{}, body)
+	if res.Reject || arcResult(t, res) != authres.ResultNone {
+		t.Errorf("expected none, got %+v", res)
+	}
+
+	res = checkBody(t, c, h, []byte("hello there, modified\r\n"))
+	if !res.Reject || arcResult(t, res) != authres.ResultFail {
+		t.Errorf("expected rejected fail, got %+v", res)
+	}
+}
+
+func TestArcCheck_TempError(t *testing.T) {
+	zones := map[string]mockdns.Zone{}
+	body := []byte("hello there\r\n")
+	h := sealedMsg(t, zones, body)
+	zones["default._domainkey.a.test."] = mockdns.Zone{
+		Err: &net.DNSError{Err: "timeout", IsTimeout: true, IsTemporary: true},
+	}
+
+	c := testCheck(t, zones, nil)
+	res := checkBody(t, c, h, body)
+	if !res.Reject {
+		t.Errorf("expected reject, got %+v", res)
+	}
+
+	c = testCheck(t, zones, []config.Node{{Name: "fail_open", Args: []string{"yes"}}})
+	res = checkBody(t, c, h, body)
+	if res.Reject || arcResult(t, res) != authres.ResultTempError {
+		t.Errorf("expected temperror, got %+v", res)
+	}
+}
@@ -0,0 +1,242 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package attachments implements a check that rejects messages containing
+// attachments of banned types.
+//
+// Since the MIME structure is usually at the beginning of the message,
+// the check is able to reject most messages before the body is fully
+// received (see module.PreDataCheckState).
+package attachments
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.attachments"
+
+var defaultExtensions = []string{
+	"ade", "adp", "bat", "chm", "cmd", "com", "cpl", "exe", "hta", "ins",
+	"isp", "jse", "lib", "lnk", "mde", "msc", "msi", "msp", "mst", "pif",
+	"scr", "sct", "shb", "sys", "vb", "vbe", "vbs", "vxd", "wsc", "wsf",
+	"wsh",
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	extensions   map[string]struct{}
+	contentTypes map[string]struct{}
+	failAction   modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var extensions, contentTypes []string
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.StringList("extensions", false, false, defaultExtensions, &extensions)
+	cfg.StringList("content_types", false, false, nil, &contentTypes)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	c.extensions = make(map[string]struct{}, len(extensions))
+	for _, ext := range extensions {
+		c.extensions[strings.ToLower(strings.TrimPrefix(ext, "."))] = struct{}{}
+	}
+	c.contentTypes = make(map[string]struct{}, len(contentTypes))
+	for _, t := range contentTypes {
+		c.contentTypes[strings.ToLower(t)] = struct{}{}
+	}
+
+	return nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	rejected bool
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+var errBanned = errors.New("banned attachment found")
+
+// banned returns the description of the first banned part found in the
+// message.
+//
+// The returned error is non-nil only if the MIME structure cannot be
+// parsed. Parts found before the error are still checked.
+func (c *Check) banned(header textproto.Header, body io.Reader) (string, error) {
+	ent, err := message.New(message.Header{Header: header}, body)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return "", err
+	}
+
+	var found string
+	err = ent.Walk(func(_ []int, part *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+
+		mediaType, params, _ := part.Header.ContentType()
+		if _, ok := c.contentTypes[strings.ToLower(mediaType)]; ok {
+			found = "content type " + mediaType
+			return errBanned
+		}
+
+		_, dispParams, _ := part.Header.ContentDisposition()
+		for _, name := range []string{dispParams["filename"], params["name"]} {
+			if name == "" {
+				continue
+			}
+			ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+			if _, ok := c.extensions[ext]; ok {
+				found = "file name " + name
+				return errBanned
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errBanned) {
+		return found, nil
+	}
+	return "", err
+}
+
+func (s *state) result(found string) module.CheckResult {
+	s.rejected = true
+	return s.c.failAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         552,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
+			Message:      "Message contains a forbidden attachment type",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"found": found,
+			},
+		},
+	})
+}
+
+// CheckPreData implements module.PreDataCheckState.
+func (s *state) CheckPreData(ctx context.Context, header textproto.Header, prefix []byte) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckPreData").End()
+
+	// Errors are expected here since the prefix is likely to end in the
+	// middle of a part. Everything before that is still checked.
+	found, _ := s.c.banned(header, bytes.NewReader(prefix))
+	if found == "" {
+		return module.CheckResult{}
+	}
+	return s.result(found)
+}
+
+func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	if s.rejected {
+		return module.CheckResult{}
+	}
+
+	defer trace.StartRegion(ctx, modName+"/CheckBody").End()
+
+	r, err := body.Open()
+	if err != nil {
+		s.log.Error("failed to open body", err)
+		return module.CheckResult{}
+	}
+	defer r.Close()
+
+	found, err := s.c.banned(header, r)
+	if err != nil {
+		// Malformed messages are not our business.
+		s.log.DebugMsg("failed to parse MIME structure", "reason", err)
+	}
+	if found == "" {
+		return module.CheckResult{}
+	}
+	return s.result(found)
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	var _ module.PreDataCheckState = &state{}
+	module.Register(modName, New)
+}
@@ -0,0 +1,122 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package attachments
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const testMsg = "Content-Type: multipart/mixed; boundary=BOUNDARY\r\n" +
+	"\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hello!\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename=\"invoice.PDF.exe\"\r\n" +
+	"\r\n" +
+	"TVqQAAMAAAAEAAAA//8AALgAAAAAAAAAQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA\r\n" +
+	"--BOUNDARY--\r\n"
+
+func testCheck(t *testing.T) *Check {
+	mod, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	if err := c.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	c.log = testutils.Logger(t, modName)
+	return c
+}
+
+func readMsg(t *testing.T, msg string) (textproto.Header, string) {
+	br := bufio.NewReader(strings.NewReader(msg))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body strings.Builder
+	if _, err := br.WriteTo(&body); err != nil {
+		t.Fatal(err)
+	}
+	return hdr, body.String()
+}
+
+func TestCheckBody(t *testing.T) {
+	c := testCheck(t)
+	hdr, body := readMsg(t, testMsg)
+
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := s.CheckBody(context.Background(), hdr, buffer.MemoryBuffer{Slice: []byte(body)})
+	if !res.Reject {
+		t.Fatal("Message with an executable attachment is not rejected")
+	}
+
+	clean := strings.Replace(body, "invoice.PDF.exe", "invoice.pdf", 1)
+	s, err = c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = s.CheckBody(context.Background(), hdr, buffer.MemoryBuffer{Slice: []byte(clean)})
+	if res.Reject || res.Reason != nil {
+		t.Fatal("Clean message is rejected:", res.Reason)
+	}
+}
+
+func TestCheckPreData(t *testing.T) {
+	c := testCheck(t)
+	hdr, body := readMsg(t, testMsg)
+
+	// Cut the body in the middle of the attachment contents.
+	prefix := body[:strings.Index(body, "TVqQ")+10]
+
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := s.(module.PreDataCheckState).CheckPreData(context.Background(), hdr, []byte(prefix))
+	if !res.Reject {
+		t.Fatal("Message with an executable attachment is not rejected early")
+	}
+
+	// Attachment header is not in the prefix.
+	s, err = c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = s.(module.PreDataCheckState).CheckPreData(context.Background(), hdr, []byte(body[:20]))
+	if res.Reject || res.Reason != nil {
+		t.Fatal("Unexpected result for a truncated prefix:", res.Reason)
+	}
+}
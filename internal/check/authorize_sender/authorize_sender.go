@@ -106,6 +106,12 @@ type state struct {
 	log     log.Logger
 }
 
+// HeaderOnly implements module.HeaderOnlyCheck, only the From header field is
+// inspected.
+func (c *Check) HeaderOnly() bool {
+	return true
+}
+
 func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
 	return &state{
 		c:       c,
@@ -0,0 +1,136 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package authres implements a pseudo-check that controls generation of the
+// Authentication-Results header field by the message pipeline.
+//
+// See module.AuthResPolicy for details.
+package authres
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const modName = "check.authres"
+
+type Check struct {
+	instName string
+
+	authServID string
+	trusted    map[string]struct{}
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		hostname string
+		trusted  []string
+	)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.String("authserv_id", false, false, "", &c.authServID)
+	cfg.StringList("trusted_forwarders", false, false, nil, &trusted)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if c.authServID == "" {
+		c.authServID = hostname
+	}
+	if c.authServID == "" {
+		return fmt.Errorf("%s: authserv_id or global hostname is required", modName)
+	}
+
+	c.trusted = make(map[string]struct{}, len(trusted))
+	for _, id := range trusted {
+		c.trusted[strings.ToLower(id)] = struct{}{}
+	}
+
+	return nil
+}
+
+// AuthServID implements module.AuthResPolicy.
+func (c *Check) AuthServID() string {
+	return c.authServID
+}
+
+// KeepAuthRes implements module.AuthResPolicy.
+func (c *Check) KeepAuthRes(authServID string) bool {
+	_, ok := c.trusted[strings.ToLower(authServID)]
+	return ok
+}
+
+// HeaderOnly implements module.HeaderOnlyCheck.
+func (c *Check) HeaderOnly() bool {
+	return true
+}
+
+type state struct {
+	c *Check
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{c: c}, nil
+}
+
+func (*state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (*state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (*state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (*state) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (*state) Close() error {
+	return nil
+}
+
+func init() {
+	var _ module.AuthResPolicy = &Check{}
+	module.Register(modName, New)
+}
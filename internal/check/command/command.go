@@ -216,6 +216,7 @@ func (s *state) run(cmdName string, args []string, stdin io.Reader) module.Check
 			Reason: &exterrors.SMTPError{
 				Code:      450,
 				Message:   "Internal server error",
+				ErrorID:   exterrors.IDCheckCommand,
 				CheckName: "command",
 				Err:       err,
 				Misc: map[string]interface{}{
@@ -231,6 +232,7 @@ func (s *state) run(cmdName string, args []string, stdin io.Reader) module.Check
 			Reason: &exterrors.SMTPError{
 				Code:      450,
 				Message:   "Internal server error",
+				ErrorID:   exterrors.IDCheckCommand,
 				CheckName: "command",
 				Err:       err,
 				Misc: map[string]interface{}{
@@ -252,6 +254,7 @@ func (s *state) run(cmdName string, args []string, stdin io.Reader) module.Check
 			Reason: &exterrors.SMTPError{
 				Code:      450,
 				Message:   "Internal server error",
+				ErrorID:   exterrors.IDCheckCommand,
 				CheckName: "command",
 				Err:       err,
 				Misc: map[string]interface{}{
@@ -285,6 +288,7 @@ func (s *state) errorRes(err error, res module.CheckResult, cmdLine string) modu
 		res.Reason = &exterrors.SMTPError{
 			Code:      450,
 			Message:   "Internal server error",
+			ErrorID:   exterrors.IDCheckCommand,
 			CheckName: "command",
 			Err:       err,
 			Misc: map[string]interface{}{
@@ -300,6 +304,7 @@ func (s *state) errorRes(err error, res module.CheckResult, cmdLine string) modu
 		res.Reason = &exterrors.SMTPError{
 			Code:      450,
 			Message:   "Internal server error",
+			ErrorID:   exterrors.IDCheckCommand,
 			CheckName: "command",
 			Err:       err,
 			Reason:    "unexpected exit code",
@@ -379,6 +384,7 @@ func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer
 			Reason: &exterrors.SMTPError{
 				Code:      450,
 				Message:   "Internal server error",
+				ErrorID:   exterrors.IDCheckCommand,
 				CheckName: "command",
 				Err:       err,
 				Misc: map[string]interface{}{
@@ -0,0 +1,149 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/ttlcache"
+)
+
+// maxCacheEntries limits the size of each cache.
+const maxCacheEntries = 10000
+
+type keyCacheEntry struct {
+	recs []string
+	err  error
+}
+
+// keyCache caches DKIM public key records looked up via DNS.
+//
+// Busy servers receive many messages signed using the same selector and
+// domain, so caching the lookup results for a short period saves a lot of
+// identical queries.
+type keyCache struct {
+	ttl     time.Duration
+	entries *ttlcache.Cache[string, keyCacheEntry]
+}
+
+func newKeyCache(ttl time.Duration) *keyCache {
+	return &keyCache{
+		ttl:     ttl,
+		entries: ttlcache.New[string, keyCacheEntry](maxCacheEntries),
+	}
+}
+
+func (kc *keyCache) lookupTXT(ctx context.Context, resolver dns.Resolver, name string) ([]string, error) {
+	if kc.ttl <= 0 {
+		return resolver.LookupTXT(ctx, name)
+	}
+
+	key := strings.ToLower(name)
+	if entry, ok := kc.entries.Get(key); ok {
+		return entry.recs, entry.err
+	}
+
+	recs, err := resolver.LookupTXT(ctx, name)
+	// Temporary errors are not cached.
+	if err != nil && !dns.IsNotFound(err) {
+		return nil, err
+	}
+	kc.entries.Put(key, keyCacheEntry{recs: recs, err: err}, kc.ttl)
+
+	return recs, err
+}
+
+// flush removes cached records for the domain and its subdomains (which
+// include the selector._domainkey records) or all records if domain is
+// empty.
+func (kc *keyCache) flush(domain string) int {
+	if domain == "" {
+		return kc.entries.Clear()
+	}
+
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	return kc.entries.RemoveFunc(func(key string) bool {
+		name := strings.TrimSuffix(key, ".")
+		return name == domain || strings.HasSuffix(name, "."+domain)
+	})
+}
+
+// resultCache caches verification results for identical messages.
+//
+// The same message is often received multiple times in a short period,
+// e.g. if the sender delivers it to each recipient separately. The message
+// hash is cheaper to compute than signature verification that
+// requires a hash per signature and DNS lookups.
+type resultCache struct {
+	ttl     time.Duration
+	entries *ttlcache.Cache[[sha256.Size]byte, []*dkim.Verification]
+}
+
+func newResultCache(ttl time.Duration) *resultCache {
+	return &resultCache{
+		ttl:     ttl,
+		entries: ttlcache.New[[sha256.Size]byte, []*dkim.Verification](maxCacheEntries),
+	}
+}
+
+func messageHash(msg io.Reader) ([sha256.Size]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, msg); err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum, nil
+}
+
+func (rc *resultCache) get(key [sha256.Size]byte) ([]*dkim.Verification, bool) {
+	return rc.entries.Get(key)
+}
+
+func (rc *resultCache) put(key [sha256.Size]byte, verifs []*dkim.Verification) {
+	// Results of temporary failures should be rechecked next time.
+	for _, verif := range verifs {
+		if verif.Err != nil && dkim.IsTempFail(verif.Err) {
+			return
+		}
+	}
+	rc.entries.Put(key, verifs, rc.ttl)
+}
+
+func (rc *resultCache) flush() int {
+	return rc.entries.Clear()
+}
+
+// FlushCache implements cacheflush.Flusher. The key is the signing domain.
+//
+// Cached verification results are not indexed by domain so all of them are
+// removed.
+func (c *Check) FlushCache(domain string) int {
+	removed := c.keys.flush(domain)
+	if c.results != nil {
+		removed += c.results.flush()
+	}
+	return removed
+}
@@ -21,11 +21,13 @@ package dkim
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"io"
 	nettextproto "net/textproto"
 	"runtime/trace"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
@@ -37,6 +39,7 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/cacheflush"
 	"github.com/foxcpp/maddy/internal/target"
 )
 
@@ -49,7 +52,13 @@ type Check struct {
 	noSigAction     modconfig.FailAction
 	failOpen        bool
 
+	// Table mapping From header field domains to policies for messages
+	// without a valid signature from that domain.
+	requiredSigs module.Table
+
 	resolver dns.Resolver
+	keys     *keyCache
+	results  *resultCache
 }
 
 func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -64,7 +73,11 @@ func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 }
 
 func (c *Check) Init(cfg *config.Map) error {
-	var requiredFields []string
+	var (
+		requiredFields []string
+		keyCacheTTL    time.Duration
+		resultCacheTTL time.Duration
+	)
 
 	cfg.Bool("debug", true, false, &c.log.Debug)
 	cfg.StringList("required_fields", false, false, []string{"From", "Subject"}, &requiredFields)
@@ -77,11 +90,22 @@ func (c *Check) Init(cfg *config.Map) error {
 		func() (interface{}, error) {
 			return modconfig.FailAction{}, nil
 		}, modconfig.FailActionDirective, &c.noSigAction)
+	cfg.Custom("required_signatures", false, false, nil, modconfig.TableDirective, &c.requiredSigs)
+	cfg.Duration("key_cache_ttl", false, false, 10*time.Minute, &keyCacheTTL)
+	cfg.Duration("result_cache_ttl", false, false, 5*time.Minute, &resultCacheTTL)
 	_, err := cfg.Process()
 	if err != nil {
 		return err
 	}
 
+	c.keys = newKeyCache(keyCacheTTL)
+	if resultCacheTTL > 0 {
+		c.results = newResultCache(resultCacheTTL)
+	}
+	if keyCacheTTL > 0 || c.results != nil {
+		cacheflush.Register("dkim", c.instName, c)
+	}
+
 	c.requiredFields = make(map[string]struct{})
 	for _, field := range requiredFields {
 		c.requiredFields[nettextproto.CanonicalMIMEHeaderKey(field)] = struct{}{}
@@ -102,6 +126,10 @@ type dkimCheckState struct {
 	c       *Check
 	msgMeta *module.MsgMetadata
 	log     log.Logger
+
+	// Set if the result for an unsigned message was returned by
+	// CheckPreData already.
+	preDataDone bool
 }
 
 func (d *dkimCheckState) CheckConnection(ctx context.Context) module.CheckResult {
@@ -116,58 +144,65 @@ func (d *dkimCheckState) CheckRcpt(ctx context.Context, rcptTo string) module.Ch
 	return module.CheckResult{}
 }
 
+// CheckPreData implements module.PreDataCheckState.
+//
+// The result for messages without signatures does not depend on the body so
+// it is reported early. This also makes it possible to evaluate DMARC policy
+// before the body is received.
+func (d *dkimCheckState) CheckPreData(ctx context.Context, header textproto.Header, _ []byte) module.CheckResult {
+	if header.Has("DKIM-Signature") {
+		return module.CheckResult{}
+	}
+	d.preDataDone = true
+	return d.applyRequired(ctx, header, d.noSigResult())
+}
+
+func (d *dkimCheckState) noSigResult() module.CheckResult {
+	if d.c.noSigAction.Reject || d.c.noSigAction.Quarantine {
+		d.log.Printf("no signatures present")
+	} else {
+		d.log.Debugf("no signatures present")
+	}
+	return d.c.noSigAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 20},
+			Message:      "No DKIM signatures",
+			CheckName:    "check.dkim",
+		},
+		AuthResult: []authres.Result{
+			&authres.DKIMResult{
+				Value: authres.ResultNone,
+			},
+		},
+	})
+}
+
 func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	if d.preDataDone {
+		return module.CheckResult{}
+	}
+
 	defer trace.StartRegion(ctx, "check.dkim/CheckBody").End()
 
 	if !header.Has("DKIM-Signature") {
-		if d.c.noSigAction.Reject || d.c.noSigAction.Quarantine {
-			d.log.Printf("no signatures present")
-		} else {
-			d.log.Debugf("no signatures present")
-		}
-		return d.c.noSigAction.Apply(module.CheckResult{
-			Reason: &exterrors.SMTPError{
-				Code:         550,
-				EnhancedCode: exterrors.EnhancedCode{5, 7, 20},
-				Message:      "No DKIM signatures",
-				CheckName:    "check.dkim",
-			},
-			AuthResult: []authres.Result{
-				&authres.DKIMResult{
-					Value: authres.ResultNone,
-				},
-			},
-		})
+		return d.applyRequired(ctx, header, d.noSigResult())
 	}
 
-	b := bytes.Buffer{}
-	_ = textproto.WriteHeader(&b, header)
-	bodyRdr, err := body.Open()
+	verifications, err := d.verify(ctx, header, body)
 	if err != nil {
-		return module.CheckResult{
-			Reject: true,
-			Reason: exterrors.WithTemporary(
-				exterrors.WithFields(err, map[string]interface{}{
-					"check":    "check.dkim",
-					"smtp_msg": "Internal I/O error",
-				}),
-				true,
-			),
+		smtpMsg := "Internal error during policy check"
+		var ioErr bodyIOError
+		if errors.As(err, &ioErr) {
+			err = ioErr.err
+			smtpMsg = "Internal I/O error"
 		}
-	}
-
-	verifications, err := dkim.VerifyWithOptions(io.MultiReader(&b, bodyRdr), &dkim.VerifyOptions{
-		LookupTXT: func(domain string) ([]string, error) {
-			return d.c.resolver.LookupTXT(ctx, domain)
-		},
-	})
-	if err != nil {
 		return module.CheckResult{
 			Reject: true,
 			Reason: exterrors.WithTemporary(
 				exterrors.WithFields(err, map[string]interface{}{
 					"check":    "check.dkim",
-					"smtp_msg": "Internal error during policy check",
+					"smtp_msg": smtpMsg,
 				}),
 				true,
 			),
@@ -246,9 +281,61 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 			Message:      "No passing DKIM signatures",
 			CheckName:    "check.dkim",
 		}
-		return d.c.brokenSigAction.Apply(res)
+		res = d.c.brokenSigAction.Apply(res)
+	}
+	return d.applyRequired(ctx, header, res)
+}
+
+// bodyIOError is returned by verify if the message body cannot be read.
+type bodyIOError struct {
+	err error
+}
+
+func (err bodyIOError) Error() string {
+	return err.err.Error()
+}
+
+func (d *dkimCheckState) verify(ctx context.Context, header textproto.Header, body buffer.Buffer) ([]*dkim.Verification, error) {
+	b := bytes.Buffer{}
+	_ = textproto.WriteHeader(&b, header)
+
+	var msgHash [sha256.Size]byte
+	if d.c.results != nil {
+		bodyRdr, err := body.Open()
+		if err != nil {
+			return nil, bodyIOError{err}
+		}
+		msgHash, err = messageHash(io.MultiReader(bytes.NewReader(b.Bytes()), bodyRdr))
+		bodyRdr.Close()
+		if err != nil {
+			return nil, bodyIOError{err}
+		}
+
+		if verifs, ok := d.c.results.get(msgHash); ok {
+			d.log.DebugMsg("using cached verification results")
+			return verifs, nil
+		}
+	}
+
+	bodyRdr, err := body.Open()
+	if err != nil {
+		return nil, bodyIOError{err}
+	}
+	defer bodyRdr.Close()
+
+	verifs, err := dkim.VerifyWithOptions(io.MultiReader(&b, bodyRdr), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return d.c.keys.lookupTXT(ctx, d.c.resolver, domain)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if d.c.results != nil {
+		d.c.results.put(msgHash, verifs)
 	}
-	return res
+	return verifs, nil
 }
 
 func (d *dkimCheckState) Name() string {
@@ -362,3 +362,93 @@ func TestDkimVerify_FailOpen(t *testing.T) {
 		t.Fatal("Result is not temp. error:", resVal)
 	}
 }
+
+type countingResolver struct {
+	*mockdns.Resolver
+	txtLookups int
+}
+
+func (r *countingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.txtLookups++
+	return r.Resolver.LookupTXT(ctx, name)
+}
+
+func TestDkimVerify_Cache(t *testing.T) {
+	test := func(cfg []config.Node, expectedLookups int) {
+		t.Helper()
+
+		check := testCheck(t, testZones, cfg)
+		resolver := &countingResolver{Resolver: &mockdns.Resolver{Zones: testZones}}
+		check.resolver = resolver
+
+		for i := 0; i < 3; i++ {
+			s, err := check.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			hdr, buf := testutils.BodyFromStr(t, verifiedMailString)
+			result := s.CheckBody(context.Background(), hdr, buf)
+			if result.Reason != nil {
+				t.Fatal("Check fail reason set:", result.Reason, exterrors.Fields(result.Reason))
+			}
+		}
+
+		if resolver.txtLookups != expectedLookups {
+			t.Fatalf("Expected %d TXT lookups, got %d", expectedLookups, resolver.txtLookups)
+		}
+	}
+
+	// Key cache only.
+	test([]config.Node{{Name: "result_cache_ttl", Args: []string{"0"}}}, 1)
+	// No caching.
+	test([]config.Node{
+		{Name: "result_cache_ttl", Args: []string{"0"}},
+		{Name: "key_cache_ttl", Args: []string{"0"}},
+	}, 3)
+	// Results cache only.
+	test([]config.Node{{Name: "key_cache_ttl", Args: []string{"0"}}}, 1)
+}
+
+func TestDkimVerify_RequiredSignatures(t *testing.T) {
+	test := func(msg string, tbl testutils.Table, reject bool, code int) {
+		t.Helper()
+
+		check := testCheck(t, testZones, nil)
+		check.requiredSigs = tbl
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		s, err := check.CheckStateForMsg(ctx, &module.MsgMetadata{
+			ID: "test_required",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hdr, buf := testutils.BodyFromStr(t, msg)
+		result := s.CheckBody(ctx, hdr, buf)
+
+		if result.Reject != reject {
+			t.Fatalf("Reject = %v, want %v, reason: %v", result.Reject, reject, result.Reason)
+		}
+		if code != 0 && (result.Reason == nil || result.Reason.(*exterrors.SMTPError).Code != code) {
+			t.Fatal("Different fail reason:", result.Reason)
+		}
+	}
+
+	// No signature.
+	test(unsignedMailString, testutils.Table{M: map[string]string{"football.example.com": "reject"}}, true, 550)
+	test(unsignedMailString, testutils.Table{M: map[string]string{"football.example.com": "ignore"}}, false, 0)
+	test(unsignedMailString, testutils.Table{M: map[string]string{"example.org": "reject"}}, false, 0)
+	test(unsignedMailString, testutils.Table{M: map[string]string{"football.example.com": "reject 553"}}, true, 553)
+
+	// d=example.com is aligned with football.example.com only in relaxed mode.
+	test(verifiedMailString, testutils.Table{M: map[string]string{"football.example.com": "reject"}}, false, 0)
+	test(verifiedMailString, testutils.Table{M: map[string]string{"football.example.com": "relaxed reject"}}, false, 0)
+	test(verifiedMailString, testutils.Table{M: map[string]string{"football.example.com": "strict reject"}}, true, 550)
+
+	// Lookup errors and malformed policies.
+	test(unsignedMailString, testutils.Table{Err: errors.New("lookup failed")}, true, 421)
+	test(unsignedMailString, testutils.Table{M: map[string]string{"football.example.com": "strict"}}, true, 421)
+}
@@ -0,0 +1,151 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	maddydmarc "github.com/foxcpp/maddy/internal/dmarc"
+)
+
+// requiredPolicy is the parsed value of the required_signatures table.
+type requiredPolicy struct {
+	alignment maddydmarc.AlignmentMode
+	action    modconfig.FailAction
+}
+
+// parseRequiredPolicy parses the policy in the format
+//
+//	[strict|relaxed] <action> [action arguments]
+//
+// e.g. "reject" or "strict quarantine".
+func parseRequiredPolicy(value string) (requiredPolicy, error) {
+	policy := requiredPolicy{
+		alignment: maddydmarc.AlignmentRelaxed,
+	}
+
+	args := strings.Fields(value)
+	if len(args) != 0 {
+		switch args[0] {
+		case "strict":
+			policy.alignment = maddydmarc.AlignmentStrict
+			args = args[1:]
+		case "relaxed":
+			args = args[1:]
+		}
+	}
+	if len(args) == 0 {
+		return requiredPolicy{}, errors.New("missing action")
+	}
+
+	var err error
+	policy.action, err = modconfig.ParseActionDirective(args)
+	if err != nil {
+		return requiredPolicy{}, err
+	}
+	return policy, nil
+}
+
+func (c *Check) requiredPolicy(ctx context.Context, fromDomain string) (requiredPolicy, bool, error) {
+	value, ok, err := c.requiredSigs.Lookup(ctx, strings.ToLower(fromDomain))
+	if err != nil {
+		return requiredPolicy{}, false, err
+	}
+	if !ok {
+		return requiredPolicy{}, false, nil
+	}
+
+	policy, err := parseRequiredPolicy(value)
+	if err != nil {
+		return requiredPolicy{}, false, fmt.Errorf("malformed policy for %s: %w", fromDomain, err)
+	}
+	return policy, true, nil
+}
+
+// applyRequired checks whether the message has a valid signature if it is
+// required for the From header field domain by required_signatures and
+// applies the configured action if it does not.
+//
+// res should contain DKIM results for all signatures in the message.
+func (d *dkimCheckState) applyRequired(ctx context.Context, header textproto.Header, res module.CheckResult) module.CheckResult {
+	if d.c.requiredSigs == nil {
+		return res
+	}
+
+	fromDomain, err := maddydmarc.ExtractFromDomain(header)
+	if err != nil {
+		// Malformed messages are handled by check.dmarc.
+		d.log.DebugMsg("cannot check required signatures", "reason", err)
+		return res
+	}
+
+	policy, ok, err := d.c.requiredPolicy(ctx, fromDomain)
+	if err != nil {
+		if d.c.failOpen {
+			d.log.Error("required signatures lookup failed, skipping", err, "domain", fromDomain)
+			return res
+		}
+		return module.CheckResult{
+			Reject: true,
+			Reason: &exterrors.SMTPError{
+				Code:         421,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 20},
+				Message:      "Temporary error during DKIM verification",
+				CheckName:    "check.dkim",
+				Err:          err,
+				Misc: map[string]interface{}{
+					"domain": fromDomain,
+				},
+			},
+		}
+	}
+	if !ok {
+		return res
+	}
+
+	for _, r := range res.AuthResult {
+		dkimRes, ok := r.(*authres.DKIMResult)
+		if !ok {
+			continue
+		}
+		if dkimRes.Value == authres.ResultPass && maddydmarc.IsAligned(fromDomain, dkimRes.Domain, policy.alignment) {
+			return res
+		}
+	}
+
+	d.log.Msg("required signature is missing", "domain", fromDomain)
+	res.Reason = &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 20},
+		Message:      "No valid DKIM signature required for the sender domain",
+		CheckName:    "check.dkim",
+		Misc: map[string]interface{}{
+			"domain": fromDomain,
+		},
+	}
+	return policy.action.Apply(res)
+}
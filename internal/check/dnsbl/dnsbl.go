@@ -366,6 +366,12 @@ func (bl *DNSBL) checkLists(ctx context.Context, ip net.IP, ehlo, mailFrom strin
 func (bl *DNSBL) CheckConnection(ctx context.Context, state *module.ConnState) error {
 	defer trace.StartRegion(ctx, "dnsbl/CheckConnection (Early)").End()
 
+	if state.TrustedRelay {
+		// The original client is checked once the message header is
+		// received.
+		return nil
+	}
+
 	ip, ok := state.RemoteAddr.(*net.TCPAddr)
 	if !ok {
 		bl.log.Msg("non-TCP/IP source",
@@ -374,13 +380,18 @@ func (bl *DNSBL) CheckConnection(ctx context.Context, state *module.ConnState) e
 		return nil
 	}
 
-	result := bl.checkLists(ctx, ip.IP, state.Hostname, "")
+	// Early checks are also run on AUTH, reuse the result from the
+	// connection start instead of doing all lookups again. Temporary
+	// errors are retried.
+	result, ok := state.ModData.Get(bl, true).(module.CheckResult)
+	if !ok || (result.Reason != nil && exterrors.IsTemporary(result.Reason)) {
+		result = bl.checkLists(ctx, ip.IP, state.Hostname, "")
+		state.ModData.Set(bl, true, result)
+	}
 	if result.Reject && bl.checkEarly {
 		return result.Reason
 	}
 
-	state.ModData.Set(bl, true, result)
-
 	return nil
 }
 
@@ -390,6 +401,12 @@ type state struct {
 	log     log.Logger
 }
 
+// HeaderOnly implements module.HeaderOnlyCheck. All lookups are done before
+// the message body is received.
+func (bl *DNSBL) HeaderOnly() bool {
+	return true
+}
+
 func (bl *DNSBL) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
 	return &state{
 		bl:      bl,
@@ -406,9 +423,9 @@ func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 		return module.CheckResult{}
 	}
 
-	result := s.msgMeta.Conn.ModData.Get(s.bl, true)
-	if result != nil {
-		return result.(module.CheckResult)
+	result, ok := s.msgMeta.Conn.ModData.Get(s.bl, true).(module.CheckResult)
+	if ok {
+		return result
 	}
 
 	return module.CheckResult{}
@@ -422,8 +439,19 @@ func (*state) CheckRcpt(context.Context, string) module.CheckResult {
 	return module.CheckResult{}
 }
 
-func (*state) CheckBody(context.Context, textproto.Header, buffer.Buffer) module.CheckResult {
-	return module.CheckResult{}
+func (s *state) CheckBody(ctx context.Context, _ textproto.Header, _ buffer.Buffer) module.CheckResult {
+	if s.msgMeta.Conn == nil || !s.msgMeta.Conn.TrustedRelay {
+		return module.CheckResult{}
+	}
+
+	defer trace.StartRegion(ctx, "dnsbl/CheckBody (Relayed)").End()
+
+	client := s.msgMeta.RelayedClient
+	if client == nil {
+		s.log.Msg("message from trusted relay, but the original client is unknown, ignoring")
+		return module.CheckResult{}
+	}
+	return s.bl.checkLists(ctx, client.IP, client.Hostname, s.msgMeta.OriginalFrom)
 }
 
 func (*state) Close() error {
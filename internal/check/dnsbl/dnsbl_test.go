@@ -25,6 +25,7 @@ import (
 	"testing"
 
 	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -211,3 +212,49 @@ func TestCheckLists(t *testing.T) {
 		true, false,
 	)
 }
+
+func TestCheckConnection_Cached(t *testing.T) {
+	resolver := &testutils.Resolver{Resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A: []string{"127.0.0.1"},
+		},
+	}}}
+	mod := &DNSBL{
+		bls:             []List{{Zone: "example.org", ClientIPv4: true, ScoreAdj: 1}},
+		resolver:        resolver,
+		log:             testutils.Logger(t, "dnsbl"),
+		quarantineThres: 1,
+		rejectThres:     2,
+	}
+	conn := &module.ConnState{
+		RemoteAddr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 25},
+	}
+
+	if err := mod.CheckConnection(context.Background(), conn); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	queries := resolver.QueryCount()
+
+	// Early checks are run again on AUTH.
+	for i := 0; i < 2; i++ {
+		if err := mod.CheckConnection(context.Background(), conn); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+	}
+	if resolver.QueryCount() != queries {
+		t.Fatal("Expected", queries, "queries, got", resolver.QueryCount())
+	}
+
+	for i := 0; i < 3; i++ {
+		state, err := mod.CheckStateForMsg(context.Background(), &module.MsgMetadata{Conn: conn})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res := state.CheckConnection(context.Background()); !res.Quarantine {
+			t.Fatal("Expected message to be quarantined")
+		}
+	}
+	if resolver.QueryCount() != queries {
+		t.Fatal("Expected", queries, "queries, got", resolver.QueryCount())
+	}
+}
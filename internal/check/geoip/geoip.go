@@ -0,0 +1,359 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package geoip implements the check that rejects or throttles connections
+// based on the country or the autonomous system of the client IP address.
+//
+// It is an early check (see module.EarlyCheck): it is executed before the SMTP
+// session is established and before each authentication attempt. It can also
+// be used for IMAP connections (see the connection_check directive).
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	geoipdb "github.com/foxcpp/maddy/internal/geoip"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
+)
+
+const modName = "check.geoip"
+
+type action int
+
+const (
+	actionAccept action = iota
+	actionReject
+	actionThrottle
+)
+
+// rules is the set of countries and autonomous systems.
+type rules struct {
+	countries map[string]struct{}
+	asns      map[uint]struct{}
+}
+
+func (r rules) match(country string, asn uint) bool {
+	if _, ok := r.countries[country]; ok && country != "" {
+		return true
+	}
+	if _, ok := r.asns[asn]; ok && asn != 0 {
+		return true
+	}
+	return false
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	countryDB *geoipdb.DB
+	asnDB     *geoipdb.DB
+
+	allowIPs []net.IPNet
+	allow    rules
+	reject   rules
+	throttle rules
+
+	throttleTimeout time.Duration
+	throttled       *limiters.BucketSet
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		countryDB, asnDB string
+		allowIPs         []string
+
+		allowCountries, rejectCountries, throttleCountries []string
+		allowASNs, rejectASNs, throttleASNs                []string
+
+		throttleRate []string
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("country_db", false, false, "", &countryDB)
+	cfg.String("asn_db", false, false, "", &asnDB)
+	cfg.StringList("allow_ip", false, false, nil, &allowIPs)
+	cfg.StringList("allow_country", false, false, nil, &allowCountries)
+	cfg.StringList("allow_asn", false, false, nil, &allowASNs)
+	cfg.StringList("reject_country", false, false, nil, &rejectCountries)
+	cfg.StringList("reject_asn", false, false, nil, &rejectASNs)
+	cfg.StringList("throttle_country", false, false, nil, &throttleCountries)
+	cfg.StringList("throttle_asn", false, false, nil, &throttleASNs)
+	cfg.StringList("throttle_rate", false, false, []string{"5", "1m"}, &throttleRate)
+	cfg.Duration("throttle_timeout", false, false, 10*time.Second, &c.throttleTimeout)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var err error
+	for _, ip := range allowIPs {
+		// Plain IP address is a network with a single address.
+		if !strings.Contains(ip, "/") {
+			if strings.Contains(ip, ":") {
+				ip += "/128"
+			} else {
+				ip += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(ip)
+		if err != nil {
+			return fmt.Errorf("%s: allow_ip: %w", modName, err)
+		}
+		c.allowIPs = append(c.allowIPs, *ipNet)
+	}
+	if c.allow, err = parseRules(allowCountries, allowASNs); err != nil {
+		return fmt.Errorf("%s: allow: %w", modName, err)
+	}
+	if c.reject, err = parseRules(rejectCountries, rejectASNs); err != nil {
+		return fmt.Errorf("%s: reject: %w", modName, err)
+	}
+	if c.throttle, err = parseRules(throttleCountries, throttleASNs); err != nil {
+		return fmt.Errorf("%s: throttle: %w", modName, err)
+	}
+
+	hasCountries := len(allowCountries)+len(rejectCountries)+len(throttleCountries) != 0
+	hasASNs := len(allowASNs)+len(rejectASNs)+len(throttleASNs) != 0
+	if hasCountries && countryDB == "" {
+		return fmt.Errorf("%s: country_db is required for country rules", modName)
+	}
+	if hasASNs && asnDB == "" {
+		return fmt.Errorf("%s: asn_db is required for ASN rules", modName)
+	}
+
+	burst, period, err := parseRate(throttleRate)
+	if err != nil {
+		return fmt.Errorf("%s: throttle_rate: %w", modName, err)
+	}
+	c.throttled = limiters.NewBucketSet(func() limiters.L {
+		return limiters.NewRate(burst, period)
+	}, 1*time.Minute, 20000)
+
+	if countryDB != "" {
+		if c.countryDB, err = geoipdb.Open(countryDB); err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+	}
+	if asnDB != "" {
+		if c.asnDB, err = geoipdb.Open(asnDB); err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+	}
+
+	return nil
+}
+
+func parseRules(countries, asns []string) (rules, error) {
+	r := rules{
+		countries: make(map[string]struct{}, len(countries)),
+		asns:      make(map[uint]struct{}, len(asns)),
+	}
+	for _, country := range countries {
+		r.countries[strings.ToUpper(country)] = struct{}{}
+	}
+	for _, asn := range asns {
+		num, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(asn), "AS"), 10, 32)
+		if err != nil {
+			return rules{}, fmt.Errorf("malformed ASN: %s", asn)
+		}
+		r.asns[uint(num)] = struct{}{}
+	}
+	return r, nil
+}
+
+func parseRate(args []string) (int, time.Duration, error) {
+	period := 1 * time.Second
+	switch len(args) {
+	case 2:
+		var err error
+		period, err = time.ParseDuration(args[1])
+		if err != nil {
+			return 0, 0, err
+		}
+		fallthrough
+	case 1:
+		burst, err := strconv.Atoi(args[0])
+		if err != nil {
+			return 0, 0, err
+		}
+		if burst <= 0 {
+			return 0, 0, fmt.Errorf("burst size should be positive")
+		}
+		return burst, period, nil
+	default:
+		return 0, 0, fmt.Errorf("expected burst size and optional period")
+	}
+}
+
+func (c *Check) Close() error {
+	c.throttled.Close()
+	if c.countryDB != nil {
+		c.countryDB.Close()
+	}
+	if c.asnDB != nil {
+		c.asnDB.Close()
+	}
+	return nil
+}
+
+// classify determines the action for the IP address. Allow rules take
+// precedence over reject and throttle ones.
+func (c *Check) classify(ip net.IP) (action, string, uint) {
+	for _, ipNet := range c.allowIPs {
+		if ipNet.Contains(ip) {
+			return actionAccept, "", 0
+		}
+	}
+
+	var (
+		country string
+		asn     uint
+		err     error
+	)
+	if c.countryDB != nil {
+		country, err = c.countryDB.Country(ip)
+		if err != nil {
+			c.log.Error("country lookup failed", err, "src_ip", ip)
+		}
+	}
+	if c.asnDB != nil {
+		asn, err = c.asnDB.ASN(ip)
+		if err != nil {
+			c.log.Error("ASN lookup failed", err, "src_ip", ip)
+		}
+	}
+
+	switch {
+	case c.allow.match(country, asn):
+		return actionAccept, country, asn
+	case c.reject.match(country, asn):
+		return actionReject, country, asn
+	case c.throttle.match(country, asn):
+		return actionThrottle, country, asn
+	}
+	return actionAccept, country, asn
+}
+
+// CheckConnection implements module.EarlyCheck.
+func (c *Check) CheckConnection(ctx context.Context, state *module.ConnState) error {
+	defer trace.StartRegion(ctx, "geoip/CheckConnection (Early)").End()
+
+	tcpAddr, ok := state.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		c.log.DebugMsg("non-TCP/IP source", "src_addr", state.RemoteAddr)
+		return nil
+	}
+
+	// Early checks are also run on AUTH, the connection was already
+	// admitted (and counted against the throttling limit).
+	if admitted, _ := state.ModData.Get(c, true).(bool); admitted {
+		return nil
+	}
+
+	act, country, asn := c.classify(tcpAddr.IP)
+	switch act {
+	case actionReject:
+		c.log.DebugMsg("connection rejected", "src_ip", tcpAddr.IP, "country", country, "asn", asn)
+		return &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Connections from your network are not allowed",
+			CheckName:    "geoip",
+			Misc: map[string]interface{}{
+				"country": country,
+				"asn":     asn,
+			},
+		}
+	case actionThrottle:
+		ctx, cancel := context.WithTimeout(ctx, c.throttleTimeout)
+		defer cancel()
+		if err := c.throttled.TakeContext(ctx, tcpAddr.IP.String()); err != nil {
+			c.log.DebugMsg("connection throttled", "src_ip", tcpAddr.IP, "country", country, "asn", asn)
+			return &exterrors.SMTPError{
+				Code:         421,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Too many connections from your network, try again later",
+				CheckName:    "geoip",
+				Err:          err,
+				Misc: map[string]interface{}{
+					"country": country,
+					"asn":     asn,
+				},
+			}
+		}
+	}
+	state.ModData.Set(c, true, true)
+	return nil
+}
+
+type state struct{}
+
+func (c *Check) CheckStateForMsg(context.Context, *module.MsgMetadata) (module.CheckState, error) {
+	return &state{}, nil
+}
+
+// Everything is done in CheckConnection of the Check itself.
+
+func (*state) CheckConnection(context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (*state) CheckSender(context.Context, string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (*state) CheckRcpt(context.Context, string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (*state) CheckBody(context.Context, textproto.Header, buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (*state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,178 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package geoip
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T, directives ...config.Node) *Check {
+	t.Helper()
+
+	db := testutils.WriteMMDB(t, map[string]map[string]interface{}{
+		"192.0.2.0/24": {
+			"country":                  map[string]interface{}{"iso_code": "XA"},
+			"autonomous_system_number": uint(64500),
+		},
+		"198.51.100.0/24": {
+			"country":                  map[string]interface{}{"iso_code": "XB"},
+			"autonomous_system_number": uint(64501),
+		},
+		"203.0.113.0/24": {
+			"country":                  map[string]interface{}{"iso_code": "XC"},
+			"autonomous_system_number": uint(64502),
+		},
+	})
+
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+
+	children := append([]config.Node{
+		{Name: "country_db", Args: []string{db}},
+		{Name: "asn_db", Args: []string{db}},
+	}, directives...)
+	if err := c.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func checkIP(c *Check, ip string) error {
+	return c.CheckConnection(context.Background(), &module.ConnState{
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234},
+	})
+}
+
+func TestCheck_Reject(t *testing.T) {
+	c := testCheck(t,
+		config.Node{Name: "reject_country", Args: []string{"xa"}},
+		config.Node{Name: "reject_asn", Args: []string{"AS64501"}},
+		config.Node{Name: "allow_ip", Args: []string{"192.0.2.10", "198.51.100.128/25"}},
+		config.Node{Name: "allow_asn", Args: []string{"64500"}},
+	)
+
+	for ip, rejected := range map[string]bool{
+		"192.0.2.1":      false, // allowed by ASN
+		"198.51.100.1":   true,
+		"198.51.100.200": false, // allowed by IP
+		"203.0.113.1":    false,
+		"127.0.0.1":      false,
+	} {
+		err := checkIP(c, ip)
+		if (err != nil) != rejected {
+			t.Errorf("%s: rejected = %v, err = %v", ip, rejected, err)
+		}
+		if err != nil && exterrors.IsTemporary(err) {
+			t.Errorf("%s: expected permanent error, got %v", ip, err)
+		}
+	}
+}
+
+func TestCheck_Throttle(t *testing.T) {
+	c := testCheck(t,
+		config.Node{Name: "throttle_country", Args: []string{"XC"}},
+		config.Node{Name: "throttle_rate", Args: []string{"2", "1h"}},
+		config.Node{Name: "throttle_timeout", Args: []string{"10ms"}},
+	)
+
+	for i := 0; i < 2; i++ {
+		if err := checkIP(c, "203.0.113.1"); err != nil {
+			t.Fatalf("connection %d throttled: %v", i, err)
+		}
+	}
+	start := time.Now()
+	err := checkIP(c, "203.0.113.1")
+	if err == nil {
+		t.Fatal("connection is not throttled")
+	}
+	if !exterrors.IsTemporary(err) {
+		t.Errorf("expected temporary error, got %v", err)
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Error("connection is not delayed")
+	}
+
+	// Limits are per IP.
+	if err := checkIP(c, "203.0.113.2"); err != nil {
+		t.Errorf("other IP throttled: %v", err)
+	}
+	// Other countries are not throttled.
+	for i := 0; i < 3; i++ {
+		if err := checkIP(c, "192.0.2.1"); err != nil {
+			t.Errorf("unrelated IP throttled: %v", err)
+		}
+	}
+}
+
+func TestCheck_ThrottleAuth(t *testing.T) {
+	c := testCheck(t,
+		config.Node{Name: "throttle_country", Args: []string{"XC"}},
+		config.Node{Name: "throttle_rate", Args: []string{"1", "1h"}},
+		config.Node{Name: "throttle_timeout", Args: []string{"10ms"}},
+	)
+
+	// Early checks are run again on AUTH, the connection should not be
+	// counted twice.
+	state := &module.ConnState{
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 1234},
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.CheckConnection(context.Background(), state); err != nil {
+			t.Fatalf("check %d failed: %v", i, err)
+		}
+	}
+
+	if err := checkIP(c, "203.0.113.1"); err == nil {
+		t.Fatal("new connection is not throttled")
+	}
+}
+
+func TestCheck_Config(t *testing.T) {
+	for _, directives := range [][]config.Node{
+		{{Name: "reject_country", Args: []string{"XA"}}},
+		{{Name: "reject_asn", Args: []string{"64500"}}},
+	} {
+		mod, _ := New(modName, "", nil, nil)
+		err := mod.Init(config.NewMap(nil, config.Node{Children: directives}))
+		if err == nil {
+			t.Errorf("%v: expected an error without database", directives)
+		}
+	}
+
+	mod, _ := New(modName, "", nil, nil)
+	err := mod.Init(config.NewMap(nil, config.Node{Children: []config.Node{
+		{Name: "reject_asn", Args: []string{"not-a-number"}},
+	}}))
+	if err == nil {
+		t.Error("expected an error for malformed ASN")
+	}
+}
@@ -0,0 +1,420 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package greylist implements the check that temporarily rejects messages
+// from unknown (client network, sender, recipient) combinations.
+//
+// Legitimate servers retry the delivery after the temporary failure while
+// most spam software does not. Triplets and client networks that passed
+// greylisting are kept in the state directory, so retries are recognized
+// after a restart.
+package greylist
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"runtime/trace"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dmarc"
+	"github.com/foxcpp/maddy/internal/target"
+	"golang.org/x/net/idna"
+)
+
+const (
+	modName = "check.greylist"
+
+	// saveInterval is how often the state is written to the disk.
+	saveInterval = 1 * time.Minute
+)
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	ipv4Prefix int
+	ipv6Prefix int
+	exemptSPF  bool
+	exemptDKIM bool
+
+	resolver dns.Resolver
+	now      func() time.Time
+
+	store    *store
+	saveStop chan struct{}
+	saveDone sync.WaitGroup
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		resolver: dns.DefaultResolver(),
+		now:      time.Now,
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	defaultFile := "greylist.json"
+	if c.instName != "" {
+		defaultFile = "greylist_" + c.instName + ".json"
+	}
+
+	var statePath string
+	c.store = newStore("")
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Duration("delay", false, false, 5*time.Minute, &c.store.delay)
+	cfg.Duration("retry_window", false, false, 48*time.Hour, &c.store.retryWindow)
+	cfg.Duration("whitelist_ttl", false, false, 35*24*time.Hour, &c.store.whitelistTTL)
+	cfg.Bool("auto_whitelist", false, true, &c.store.autoWhitelist)
+	cfg.Int("ipv4_prefix", false, false, 24, &c.ipv4Prefix)
+	cfg.Int("ipv6_prefix", false, false, 64, &c.ipv6Prefix)
+	cfg.Bool("exempt_spf", false, true, &c.exemptSPF)
+	cfg.Bool("exempt_dkim", false, true, &c.exemptDKIM)
+	cfg.String("state_file", false, false, filepath.Join(config.StateDirectory, defaultFile), &statePath)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if c.ipv4Prefix < 0 || c.ipv4Prefix > 32 {
+		return fmt.Errorf("%s: ipv4_prefix should be between 0 and 32", modName)
+	}
+	if c.ipv6Prefix < 0 || c.ipv6Prefix > 128 {
+		return fmt.Errorf("%s: ipv6_prefix should be between 0 and 128", modName)
+	}
+	if c.store.retryWindow <= c.store.delay {
+		return fmt.Errorf("%s: retry_window should be longer than delay", modName)
+	}
+	c.store.path = statePath
+
+	if module.NoRun {
+		return nil
+	}
+
+	if err := c.store.load(); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	c.saveStop = make(chan struct{})
+	c.saveDone.Add(1)
+	go c.saveLoop()
+
+	return nil
+}
+
+func (c *Check) saveLoop() {
+	defer c.saveDone.Done()
+	t := time.NewTicker(saveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := c.store.save(c.now()); err != nil {
+				c.log.Error("failed to save state", err)
+			}
+		case <-c.saveStop:
+			return
+		}
+	}
+}
+
+func (c *Check) Close() error {
+	if c.saveStop == nil {
+		return nil
+	}
+	close(c.saveStop)
+	c.saveDone.Wait()
+	c.saveStop = nil
+	return c.store.save(c.now())
+}
+
+// clientNet returns the network of the client IP address triplets are
+// recorded for, so retries from other servers of the same sender are
+// recognized.
+func (c *Check) clientNet(ip net.IP) string {
+	mask := net.CIDRMask(c.ipv6Prefix, 128)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		mask = net.CIDRMask(c.ipv4Prefix, 32)
+	}
+	ipNet := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	return ipNet.String()
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	skip      bool
+	ip        net.IP
+	clientNet string
+	sender    string
+
+	spfChecked bool
+	spfPass    bool
+
+	// Triplets that did not pass greylisting, the decision is deferred
+	// until the DKIM signatures can be verified.
+	pending []pendingTriplet
+}
+
+type pendingTriplet struct {
+	key  string
+	wait time.Duration
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	defer trace.StartRegion(ctx, "check.greylist/CheckConnection").End()
+
+	conn := s.msgMeta.Conn
+	switch {
+	case conn == nil:
+		s.skip = true
+		s.log.DebugMsg("locally generated message, skipping")
+		return module.CheckResult{}
+	case conn.AuthUser != "":
+		s.skip = true
+		s.log.DebugMsg("authenticated client, skipping")
+		return module.CheckResult{}
+	case conn.TrustedRelay:
+		// Retries are done by the relay, not the original client.
+		s.skip = true
+		s.log.DebugMsg("message from trusted relay, skipping")
+		return module.CheckResult{}
+	}
+
+	tcpAddr, ok := conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		s.skip = true
+		s.log.DebugMsg("non-TCP/IP source, skipping", "src_addr", conn.RemoteAddr)
+		return module.CheckResult{}
+	}
+	s.ip = tcpAddr.IP
+	s.clientNet = s.c.clientNet(tcpAddr.IP)
+
+	if s.c.store.clientWhitelisted(s.clientNet, s.c.now()) {
+		s.skip = true
+		s.log.DebugMsg("client network is whitelisted", "client_net", s.clientNet)
+		return module.CheckResult{}
+	}
+
+	var err error
+	s.sender, err = address.ForLookup(s.msgMeta.OriginalFrom)
+	if err != nil {
+		s.sender = strings.ToLower(s.msgMeta.OriginalFrom)
+	}
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(context.Context, string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	if s.skip {
+		return module.CheckResult{}
+	}
+
+	defer trace.StartRegion(ctx, "check.greylist/CheckRcpt").End()
+
+	rcpt, err := address.ForLookup(rcptTo)
+	if err != nil {
+		rcpt = strings.ToLower(rcptTo)
+	}
+	key := s.clientNet + " " + s.sender + " " + rcpt
+
+	passed, wait := s.c.store.check(s.clientNet, key, s.c.now())
+	if passed {
+		return module.CheckResult{}
+	}
+
+	if s.c.exemptSPF && s.spfPassed(ctx) {
+		s.log.DebugMsg("SPF passed, not greylisting", "rcpt", rcptTo)
+		s.c.store.forget(key)
+		return module.CheckResult{}
+	}
+	if s.c.exemptDKIM {
+		s.pending = append(s.pending, pendingTriplet{key: key, wait: wait})
+		return module.CheckResult{}
+	}
+
+	s.log.DebugMsg("greylisted", "rcpt", rcptTo, "client_net", s.clientNet, "retry_in", wait)
+	return greylisted(s.clientNet, wait)
+}
+
+// spfPassed evaluates the SPF policy for the sender domain (or the HELO
+// hostname for the null sender).
+func (s *state) spfPassed(ctx context.Context) bool {
+	if s.spfChecked {
+		return s.spfPass
+	}
+	s.spfChecked = true
+
+	helo := s.msgMeta.Conn.Hostname
+	sender := s.msgMeta.OriginalFrom
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	mbox, domain, err := address.Split(sender)
+	if err != nil || domain == "" {
+		return false
+	}
+	domain, err = idna.ToASCII(domain)
+	if err != nil {
+		return false
+	}
+	if !address.IsASCII(mbox) {
+		mbox = ""
+	}
+
+	res, err := spf.CheckHostWithSender(s.ip, dns.FQDN(helo), mbox+"@"+dns.FQDN(domain),
+		spf.WithContext(ctx), spf.WithResolver(s.c.resolver))
+	s.log.DebugMsg("SPF result", "result", res, "reason", err)
+	s.spfPass = res == spf.Pass
+	return s.spfPass
+}
+
+// dkimPassed reports whether the message has a valid DKIM signature aligned
+// with the envelope sender or the From header field.
+func (s *state) dkimPassed(ctx context.Context, header textproto.Header, body buffer.Buffer) bool {
+	if !header.Has("DKIM-Signature") {
+		return false
+	}
+
+	var domains []string
+	if _, domain, err := address.Split(s.msgMeta.OriginalFrom); err == nil && domain != "" {
+		domains = append(domains, domain)
+	}
+	if domain, err := dmarc.ExtractFromDomain(header); err == nil {
+		domains = append(domains, domain)
+	}
+	if len(domains) == 0 {
+		return false
+	}
+
+	b := bytes.Buffer{}
+	_ = textproto.WriteHeader(&b, header)
+	bodyRdr, err := body.Open()
+	if err != nil {
+		s.log.Error("failed to open body", err)
+		return false
+	}
+	defer bodyRdr.Close()
+
+	verifs, err := dkim.VerifyWithOptions(io.MultiReader(&b, bodyRdr), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return s.c.resolver.LookupTXT(ctx, domain)
+		},
+	})
+	if err != nil {
+		s.log.Error("DKIM verification failed", err)
+		return false
+	}
+	for _, verif := range verifs {
+		if verif.Err != nil {
+			continue
+		}
+		for _, domain := range domains {
+			if dmarc.IsAligned(domain, verif.Domain, dmarc.AlignmentRelaxed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	if len(s.pending) == 0 {
+		return module.CheckResult{}
+	}
+
+	defer trace.StartRegion(ctx, "check.greylist/CheckBody").End()
+
+	if s.dkimPassed(ctx, header, body) {
+		s.log.DebugMsg("DKIM passed, not greylisting")
+		for _, t := range s.pending {
+			s.c.store.forget(t.key)
+		}
+		return module.CheckResult{}
+	}
+
+	var wait time.Duration
+	for _, t := range s.pending {
+		if t.wait > wait {
+			wait = t.wait
+		}
+	}
+	s.log.DebugMsg("greylisted", "client_net", s.clientNet, "rcpts", len(s.pending), "retry_in", wait)
+	return greylisted(s.clientNet, wait)
+}
+
+func greylisted(clientNet string, wait time.Duration) module.CheckResult {
+	return module.CheckResult{
+		Reject: true,
+		Reason: &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+			Message:      "Greylisted, please try again later",
+			CheckName:    "greylist",
+			Misc: map[string]interface{}{
+				"client_net": clientNet,
+				"retry_in":   wait.Round(time.Second).String(),
+			},
+		},
+	}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,269 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package greylist
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time {
+	return c.t
+}
+
+func testCheck(t *testing.T, statePath string, clock *testClock, zones map[string]mockdns.Zone, cfg []config.Node) *Check {
+	t.Helper()
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.resolver = &mockdns.Resolver{Zones: zones}
+	c.log = testutils.Logger(t, modName)
+	c.now = clock.now
+
+	cfg = append(cfg, config.Node{Name: "state_file", Args: []string{statePath}})
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+	})
+	return c
+}
+
+var noExempt = []config.Node{
+	{Name: "exempt_spf", Args: []string{"no"}},
+	{Name: "exempt_dkim", Args: []string{"no"}},
+}
+
+// deliver runs the check for the message and returns the rejection error,
+// if any.
+func deliver(t *testing.T, c *Check, ip, from, rcpt string, header textproto.Header) error {
+	t.Helper()
+	ctx := context.Background()
+	st, err := c.CheckStateForMsg(ctx, &module.MsgMetadata{
+		ID:           "test",
+		OriginalFrom: from,
+		Conn: &module.ConnState{
+			Hostname:   "mx.example.org",
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	for _, res := range []func() module.CheckResult{
+		func() module.CheckResult { return st.CheckConnection(ctx) },
+		func() module.CheckResult { return st.CheckSender(ctx, from) },
+		func() module.CheckResult { return st.CheckRcpt(ctx, rcpt) },
+		func() module.CheckResult {
+			return st.CheckBody(ctx, header, buffer.MemoryBuffer{Slice: []byte("Hello!\r\n")})
+		},
+	} {
+		if r := res(); r.Reject {
+			return r.Reason
+		}
+	}
+	return nil
+}
+
+func expectGreylisted(t *testing.T, err error) {
+	t.Helper()
+	if err == nil {
+		t.Fatal("expected the message to be greylisted")
+	}
+	if !exterrors.IsTemporary(err) {
+		t.Fatalf("expected a temporary error, got %v", err)
+	}
+}
+
+func TestGreylist(t *testing.T) {
+	clock := &testClock{t: time.Unix(1700000000, 0)}
+	c := testCheck(t, filepath.Join(t.TempDir(), "greylist.json"), clock, nil, append(noExempt,
+		config.Node{Name: "auto_whitelist", Args: []string{"no"}}))
+
+	expectGreylisted(t, deliver(t, c, "192.0.2.1", "alice@example.com", "bob@example.org", textproto.Header{}))
+
+	// Too early.
+	clock.t = clock.t.Add(1 * time.Minute)
+	expectGreylisted(t, deliver(t, c, "192.0.2.1", "alice@example.com", "bob@example.org", textproto.Header{}))
+
+	// Retry from the same network after the delay.
+	clock.t = clock.t.Add(5 * time.Minute)
+	if err := deliver(t, c, "192.0.2.2", "Alice@example.com", "bob@example.org", textproto.Header{}); err != nil {
+		t.Fatal("retry is rejected:", err)
+	}
+
+	// Other triplets are still greylisted.
+	expectGreylisted(t, deliver(t, c, "192.0.2.1", "alice@example.com", "carol@example.org", textproto.Header{}))
+	expectGreylisted(t, deliver(t, c, "198.51.100.1", "alice@example.com", "bob@example.org", textproto.Header{}))
+
+	// Passed triplets are remembered.
+	clock.t = clock.t.Add(30 * 24 * time.Hour)
+	if err := deliver(t, c, "192.0.2.1", "alice@example.com", "bob@example.org", textproto.Header{}); err != nil {
+		t.Fatal("known triplet is rejected:", err)
+	}
+
+	// Pending triplets expire after the retry window.
+	clock.t = clock.t.Add(49 * time.Hour)
+	expectGreylisted(t, deliver(t, c, "192.0.2.1", "alice@example.com", "carol@example.org", textproto.Header{}))
+}
+
+func TestGreylist_AutoWhitelist(t *testing.T) {
+	clock := &testClock{t: time.Unix(1700000000, 0)}
+	c := testCheck(t, filepath.Join(t.TempDir(), "greylist.json"), clock, nil, noExempt)
+
+	expectGreylisted(t, deliver(t, c, "2001:db8::1", "alice@example.com", "bob@example.org", textproto.Header{}))
+	clock.t = clock.t.Add(10 * time.Minute)
+	if err := deliver(t, c, "2001:db8::2", "alice@example.com", "bob@example.org", textproto.Header{}); err != nil {
+		t.Fatal("retry is rejected:", err)
+	}
+
+	if err := deliver(t, c, "2001:db8::3", "dave@example.net", "carol@example.org", textproto.Header{}); err != nil {
+		t.Fatal("message from whitelisted network is rejected:", err)
+	}
+	expectGreylisted(t, deliver(t, c, "2001:db8:1::1", "dave@example.net", "carol@example.org", textproto.Header{}))
+
+	clock.t = clock.t.Add(36 * 24 * time.Hour)
+	expectGreylisted(t, deliver(t, c, "2001:db8::3", "erin@example.net", "carol@example.org", textproto.Header{}))
+}
+
+func TestGreylist_Persistent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greylist.json")
+	clock := &testClock{t: time.Unix(1700000000, 0)}
+	c := testCheck(t, path, clock, nil, noExempt)
+
+	expectGreylisted(t, deliver(t, c, "192.0.2.1", "alice@example.com", "bob@example.org", textproto.Header{}))
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.t = clock.t.Add(10 * time.Minute)
+	c = testCheck(t, path, clock, nil, noExempt)
+	if err := deliver(t, c, "192.0.2.1", "alice@example.com", "bob@example.org", textproto.Header{}); err != nil {
+		t.Fatal("retry after restart is rejected:", err)
+	}
+}
+
+func TestGreylist_ExemptSPF(t *testing.T) {
+	clock := &testClock{t: time.Unix(1700000000, 0)}
+	c := testCheck(t, filepath.Join(t.TempDir(), "greylist.json"), clock, map[string]mockdns.Zone{
+		"example.com.": {
+			TXT: []string{"v=spf1 ip4:192.0.2.0/24 -all"},
+		},
+	}, []config.Node{{Name: "exempt_dkim", Args: []string{"no"}}})
+
+	if err := deliver(t, c, "192.0.2.1", "alice@example.com", "bob@example.org", textproto.Header{}); err != nil {
+		t.Fatal("SPF-passing sender is greylisted:", err)
+	}
+	expectGreylisted(t, deliver(t, c, "198.51.100.1", "alice@example.com", "bob@example.org", textproto.Header{}))
+	expectGreylisted(t, deliver(t, c, "192.0.2.1", "mallory@example.net", "bob@example.org", textproto.Header{}))
+}
+
+func TestGreylist_ExemptDKIM(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "From: <alice@example.com>\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Hello!\r\n"
+	signed := bytes.Buffer{}
+	if err := dkim.Sign(&signed, strings.NewReader(msg), &dkim.SignOptions{
+		Domain:   "mail.example.com",
+		Selector: "test",
+		Signer:   priv,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rdr := bufio.NewReader(&signed)
+	header, err := textproto.ReadHeader(rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := &testClock{t: time.Unix(1700000000, 0)}
+	c := testCheck(t, filepath.Join(t.TempDir(), "greylist.json"), clock, map[string]mockdns.Zone{
+		"test._domainkey.mail.example.com.": {
+			TXT: []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+		},
+	}, []config.Node{{Name: "exempt_spf", Args: []string{"no"}}})
+
+	if err := deliver(t, c, "192.0.2.1", "alice@example.com", "bob@example.org", header.Copy()); err != nil {
+		t.Fatal("message with aligned DKIM signature is greylisted:", err)
+	}
+	// Unsigned message.
+	expectGreylisted(t, deliver(t, c, "192.0.2.1", "mallory@example.net", "bob@example.org", textproto.Header{}))
+	// Signature is broken.
+	header.Set("Subject", "Changed")
+	expectGreylisted(t, deliver(t, c, "192.0.2.1", "alice@example.com", "bob@example.org", header))
+}
+
+func TestGreylist_DeferredDKIM(t *testing.T) {
+	clock := &testClock{t: time.Unix(1700000000, 0)}
+	c := testCheck(t, filepath.Join(t.TempDir(), "greylist.json"), clock, nil, []config.Node{
+		{Name: "exempt_spf", Args: []string{"no"}},
+	})
+
+	ctx := context.Background()
+	st, err := c.CheckStateForMsg(ctx, &module.MsgMetadata{
+		ID:           "test",
+		OriginalFrom: "alice@example.com",
+		Conn: &module.ConnState{
+			Hostname:   "mx.example.com",
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	st.CheckConnection(ctx)
+	if res := st.CheckRcpt(ctx, "bob@example.org"); res.Reject {
+		t.Fatal("the decision should be deferred until DATA:", res.Reason)
+	}
+	// Unsigned message.
+	res := st.CheckBody(ctx, textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("Hello!\r\n")})
+	expectGreylisted(t, res.Reason)
+}
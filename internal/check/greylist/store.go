@@ -0,0 +1,217 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package greylist
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// triplet is the state of the (client network, sender, recipient)
+// combination.
+type triplet struct {
+	// The time the triplet was first seen (or seen again after the retry
+	// window passed).
+	FirstSeen time.Time `json:"first_seen"`
+	// The last time the triplet passed greylisting, zero if it did not
+	// pass yet.
+	Passed time.Time `json:"passed"`
+}
+
+type storeData struct {
+	Triplets map[string]*triplet `json:"triplets"`
+	// The last time a message from the client network was accepted, for
+	// auto-whitelisted networks.
+	Clients map[string]time.Time `json:"clients"`
+}
+
+// store keeps greylisting triplets and auto-whitelisted client networks.
+//
+// The state is kept in memory and periodically written to the file in the
+// state directory.
+type store struct {
+	path string
+
+	delay         time.Duration
+	retryWindow   time.Duration
+	whitelistTTL  time.Duration
+	autoWhitelist bool
+
+	lck   sync.Mutex
+	dirty bool
+	data  storeData
+}
+
+func newStore(path string) *store {
+	return &store{
+		path: path,
+		data: storeData{
+			Triplets: map[string]*triplet{},
+			Clients:  map[string]time.Time{},
+		},
+	}
+}
+
+// clientWhitelisted reports whether messages from the client network are
+// accepted without greylisting.
+func (s *store) clientWhitelisted(clientNet string, now time.Time) bool {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	last, ok := s.data.Clients[clientNet]
+	if !ok || now.Sub(last) > s.whitelistTTL {
+		return false
+	}
+	s.data.Clients[clientNet] = now
+	s.dirty = true
+	return true
+}
+
+// check records the triplet and reports whether it passed greylisting. If
+// it did not, the time left until the retry is accepted is returned.
+//
+// Once the triplet passes, the client network is whitelisted if
+// autoWhitelist is set.
+func (s *store) check(clientNet, key string, now time.Time) (bool, time.Duration) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	s.dirty = true
+
+	t, ok := s.data.Triplets[key]
+	switch {
+	case ok && !t.Passed.IsZero() && now.Sub(t.Passed) <= s.whitelistTTL:
+	case ok && t.Passed.IsZero() && now.Sub(t.FirstSeen) <= s.retryWindow:
+		if wait := s.delay - now.Sub(t.FirstSeen); wait > 0 {
+			return false, wait
+		}
+	default:
+		// New triplet or the old one expired.
+		s.data.Triplets[key] = &triplet{FirstSeen: now}
+		return false, s.delay
+	}
+
+	t.Passed = now
+	if s.autoWhitelist {
+		s.data.Clients[clientNet] = now
+	}
+	return true, 0
+}
+
+// forget removes the triplet, it is used for messages exempted from
+// greylisting.
+func (s *store) forget(key string) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	if _, ok := s.data.Triplets[key]; ok {
+		delete(s.data.Triplets, key)
+		s.dirty = true
+	}
+}
+
+// expire removes triplets and client networks that are no longer
+// relevant.
+func (s *store) expire(now time.Time) {
+	for key, t := range s.data.Triplets {
+		if t.Passed.IsZero() && now.Sub(t.FirstSeen) > s.retryWindow ||
+			!t.Passed.IsZero() && now.Sub(t.Passed) > s.whitelistTTL {
+			delete(s.data.Triplets, key)
+			s.dirty = true
+		}
+	}
+	for clientNet, last := range s.data.Clients {
+		if now.Sub(last) > s.whitelistTTL {
+			delete(s.data.Clients, clientNet)
+			s.dirty = true
+		}
+	}
+}
+
+func (s *store) load() error {
+	blob, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	data := storeData{}
+	if err := json.Unmarshal(blob, &data); err != nil {
+		return err
+	}
+	if data.Triplets == nil {
+		data.Triplets = map[string]*triplet{}
+	}
+	if data.Clients == nil {
+		data.Clients = map[string]time.Time{}
+	}
+
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	s.data = data
+	return nil
+}
+
+// save removes expired entries and writes the state to the file if it
+// changed since the last time.
+func (s *store) save(now time.Time) error {
+	s.lck.Lock()
+	s.expire(now)
+	if !s.dirty {
+		s.lck.Unlock()
+		return nil
+	}
+	blob, err := json.Marshal(s.data)
+	s.dirty = false
+	s.lck.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := s.write(blob); err != nil {
+		// Try again next time.
+		s.lck.Lock()
+		s.dirty = true
+		s.lck.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *store) write(blob []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(blob); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
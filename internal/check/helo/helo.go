@@ -0,0 +1,315 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package helo implements check.helo module that validates the hostname
+// provided by the SMTP client in the HELO/EHLO command.
+package helo
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+	"golang.org/x/net/idna"
+)
+
+const modName = "check.helo"
+
+type violation int
+
+const (
+	violationNone violation = iota
+	// Hostname is not a syntactically valid domain or address literal.
+	violationInvalid
+	// Hostname is a single label (e.g. "localhost").
+	violationNonFQDN
+	// Address literal does not match the client IP.
+	violationLiteralMismatch
+	// Hostname has no A/AAAA records.
+	violationUnresolvable
+	// Hostname does not resolve to the client IP.
+	violationMismatch
+)
+
+func (v violation) String() string {
+	switch v {
+	case violationNone:
+		return "none"
+	case violationInvalid:
+		return "invalid"
+	case violationNonFQDN:
+		return "non_fqdn"
+	case violationLiteralMismatch:
+		return "literal_mismatch"
+	case violationUnresolvable:
+		return "unresolvable"
+	case violationMismatch:
+		return "mismatch"
+	}
+	return "unknown"
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+	resolver dns.Resolver
+
+	invalidAction         modconfig.FailAction
+	nonFQDNAction         modconfig.FailAction
+	literalMismatchAction modconfig.FailAction
+	unresolvableAction    modconfig.FailAction
+	mismatchAction        modconfig.FailAction
+	errAction             modconfig.FailAction
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		resolver: dns.DefaultResolver(),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func failActionDefault(action modconfig.FailAction) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		return action, nil
+	}
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("invalid_action", false, false, failActionDefault(modconfig.FailAction{Reject: true}),
+		modconfig.FailActionDirective, &c.invalidAction)
+	cfg.Custom("non_fqdn_action", false, false, failActionDefault(modconfig.FailAction{Reject: true}),
+		modconfig.FailActionDirective, &c.nonFQDNAction)
+	cfg.Custom("literal_mismatch_action", false, false, failActionDefault(modconfig.FailAction{Quarantine: true}),
+		modconfig.FailActionDirective, &c.literalMismatchAction)
+	cfg.Custom("unresolvable_action", false, false, failActionDefault(modconfig.FailAction{Quarantine: true}),
+		modconfig.FailActionDirective, &c.unresolvableAction)
+	cfg.Custom("mismatch_action", false, false, failActionDefault(modconfig.FailAction{}),
+		modconfig.FailActionDirective, &c.mismatchAction)
+	cfg.Custom("err_action", false, false, failActionDefault(modconfig.FailAction{}),
+		modconfig.FailActionDirective, &c.errAction)
+	_, err := cfg.Process()
+	return err
+}
+
+// checkLiteral validates the address literal (RFC 5321 Section 4.1.3) and
+// compares it against the client IP.
+func checkLiteral(literal string, ip net.IP) violation {
+	literal = strings.TrimSuffix(strings.TrimPrefix(literal, "["), "]")
+	if len(literal) > 5 && strings.EqualFold(literal[:5], "IPv6:") {
+		literal = literal[5:]
+		if !strings.Contains(literal, ":") {
+			return violationInvalid
+		}
+	} else if strings.Contains(literal, ":") {
+		return violationInvalid
+	}
+
+	literalIP := net.ParseIP(literal)
+	if literalIP == nil {
+		return violationInvalid
+	}
+	if ip != nil && !literalIP.Equal(ip) {
+		return violationLiteralMismatch
+	}
+	return violationNone
+}
+
+// checkHostname validates the hostname syntax and checks that it resolves
+// to the client IP.
+//
+// Only temporary errors are returned, all other lookup failures are
+// reflected in the returned violation.
+func (c *Check) checkHostname(ctx context.Context, hostname string, ip net.IP) (violation, error) {
+	if strings.HasPrefix(hostname, "[") && strings.HasSuffix(hostname, "]") {
+		return checkLiteral(hostname, ip), nil
+	}
+
+	hostname = strings.TrimSuffix(hostname, ".")
+	aHostname, err := idna.Lookup.ToASCII(hostname)
+	if err != nil || aHostname == "" || len(aHostname) > 253 {
+		return violationInvalid, nil
+	}
+	labels := strings.Split(aHostname, ".")
+	if len(labels) == 1 {
+		return violationNonFQDN, nil
+	}
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		// Top-level domain is never numeric, this is likely an IP address
+		// not enclosed in brackets.
+		return violationInvalid, nil
+	}
+
+	addrs, err := c.resolver.LookupIPAddr(ctx, aHostname)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return violationUnresolvable, nil
+		}
+		return violationNone, err
+	}
+	if len(addrs) == 0 {
+		return violationUnresolvable, nil
+	}
+
+	if ip == nil {
+		return violationNone, nil
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(ip) {
+			return violationNone, nil
+		}
+	}
+	return violationMismatch, nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	conn := s.msgMeta.Conn
+	if conn == nil {
+		s.log.Msg("skipping locally generated message")
+		return module.CheckResult{}
+	}
+	if conn.AuthUser != "" {
+		// Clients of authenticated users (e.g. MUAs on laptops) commonly
+		// use arbitrary names.
+		return module.CheckResult{}
+	}
+
+	var ip net.IP
+	if tcpAddr, ok := conn.RemoteAddr.(*net.TCPAddr); ok {
+		ip = tcpAddr.IP
+	}
+
+	v, err := s.c.checkHostname(ctx, conn.Hostname, ip)
+	if err != nil {
+		reason, misc := exterrors.UnwrapDNSErr(err)
+		return s.c.errAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 4, 3},
+				Message:      "Unable to verify the EHLO hostname, try again later",
+				CheckName:    modName,
+				Err:          err,
+				Reason:       reason,
+				Misc:         misc,
+			},
+		})
+	}
+	s.log.DebugMsg("EHLO hostname checked", "ehlo", conn.Hostname, "violation", v.String())
+
+	switch v {
+	case violationInvalid:
+		return s.c.invalidAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         504,
+				EnhancedCode: exterrors.EnhancedCode{5, 5, 2},
+				Message:      "Invalid EHLO hostname",
+				CheckName:    modName,
+			},
+		})
+	case violationNonFQDN:
+		return s.c.nonFQDNAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         504,
+				EnhancedCode: exterrors.EnhancedCode{5, 5, 2},
+				Message:      "EHLO hostname should be a fully qualified domain name",
+				CheckName:    modName,
+			},
+		})
+	case violationLiteralMismatch:
+		return s.c.literalMismatchAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "EHLO address literal does not match the client address",
+				CheckName:    modName,
+			},
+		})
+	case violationUnresolvable:
+		return s.c.unresolvableAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "EHLO hostname does not resolve",
+				CheckName:    modName,
+			},
+		})
+	case violationMismatch:
+		return s.c.mismatchAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "EHLO hostname does not resolve to the client address",
+				CheckName:    modName,
+			},
+		})
+	}
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(context.Context, string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(context.Context, string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(context.Context, textproto.Header, buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,145 @@
+package helo
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T, cfg ...config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	c.resolver = &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+		"mx.example.org.": {
+			A:    []string{"203.0.113.1"},
+			AAAA: []string{"2001:db8::1"},
+		},
+		"other.example.org.": {
+			A: []string{"203.0.113.2"},
+		},
+		"xn--e1afmkfd.example.org.": {
+			A: []string{"203.0.113.1"},
+		},
+		"broken.example.org.": {
+			Err: &net.DNSError{Err: "oops", IsTemporary: true},
+		},
+	}}
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func checkHELO(t *testing.T, c *Check, conn *module.ConnState) module.CheckResult {
+	t.Helper()
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test", Conn: conn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	return st.CheckConnection(context.Background())
+}
+
+func TestCheckHELO(t *testing.T) {
+	c := testCheck(t,
+		config.Node{Name: "unresolvable_action", Args: []string{"reject"}},
+		config.Node{Name: "literal_mismatch_action", Args: []string{"reject"}},
+		config.Node{Name: "mismatch_action", Args: []string{"reject"}},
+		config.Node{Name: "err_action", Args: []string{"reject"}},
+	)
+
+	for _, test := range []struct {
+		hostname string
+		ip       string
+		code     int
+	}{
+		{hostname: "mx.example.org", ip: "203.0.113.1"},
+		{hostname: "MX.example.org.", ip: "203.0.113.1"},
+		{hostname: "mx.example.org", ip: "2001:db8::1"},
+		{hostname: "пример.example.org", ip: "203.0.113.1"},
+		{hostname: "[203.0.113.1]", ip: "203.0.113.1"},
+		{hostname: "[IPv6:2001:db8::1]", ip: "2001:db8::1"},
+		{hostname: "mx.example.org", ip: "203.0.113.2", code: 550},
+		{hostname: "other.example.org", ip: "203.0.113.1", code: 550},
+		{hostname: "missing.example.org", ip: "203.0.113.1", code: 550},
+		{hostname: "[203.0.113.2]", ip: "203.0.113.1", code: 550},
+		{hostname: "broken.example.org", ip: "203.0.113.1", code: 451},
+		{hostname: "localhost", ip: "203.0.113.1", code: 504},
+		{hostname: "", ip: "203.0.113.1", code: 504},
+		{hostname: "203.0.113.1", ip: "203.0.113.1", code: 504},
+		{hostname: "under_score.example.org", ip: "203.0.113.1", code: 504},
+		{hostname: "[2001:db8::1]", ip: "2001:db8::1", code: 504},
+		{hostname: "[IPv6:203.0.113.1]", ip: "203.0.113.1", code: 504},
+		{hostname: "[example.org]", ip: "203.0.113.1", code: 504},
+	} {
+		t.Run(test.hostname, func(t *testing.T) {
+			res := checkHELO(t, c, &module.ConnState{
+				Hostname:   test.hostname,
+				RemoteAddr: &net.TCPAddr{IP: net.ParseIP(test.ip), Port: 25},
+			})
+			if test.code == 0 {
+				if res.Reason != nil || res.Reject {
+					t.Errorf("expected hostname to be accepted, got %v", res.Reason)
+				}
+				return
+			}
+			if !res.Reject {
+				t.Errorf("expected hostname to be rejected with %d", test.code)
+				return
+			}
+			var smtpErr *exterrors.SMTPError
+			if !errors.As(res.Reason, &smtpErr) || smtpErr.Code != test.code {
+				t.Errorf("expected %d error, got %v", test.code, res.Reason)
+			}
+		})
+	}
+}
+
+func TestCheckHELO_Defaults(t *testing.T) {
+	c := testCheck(t)
+
+	res := checkHELO(t, c, &module.ConnState{
+		Hostname:   "other.example.org",
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 25},
+	})
+	if res.Reject || res.Quarantine {
+		t.Errorf("expected mismatch to be ignored, got %+v", res)
+	}
+
+	res = checkHELO(t, c, &module.ConnState{
+		Hostname:   "missing.example.org",
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 25},
+	})
+	if res.Reject || !res.Quarantine {
+		t.Errorf("expected unresolvable hostname to be quarantined, got %+v", res)
+	}
+
+	// Authenticated clients and local messages are not checked.
+	res = checkHELO(t, c, &module.ConnState{
+		Hostname:   "laptop",
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 587},
+		AuthUser:   "user",
+	})
+	if res.Reason != nil {
+		t.Errorf("expected authenticated client to be accepted, got %v", res.Reason)
+	}
+	res = checkHELO(t, c, nil)
+	if res.Reason != nil {
+		t.Errorf("expected local message to be accepted, got %v", res.Reason)
+	}
+}
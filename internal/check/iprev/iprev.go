@@ -0,0 +1,274 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package iprev implements check.iprev module that performs the "iprev"
+// authentication of the SMTP client (RFC 8601 Section 3): the client IP
+// should have a PTR record pointing to a name that resolves back to the
+// same IP (forward-confirmed reverse DNS).
+package iprev
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.iprev"
+
+// maxPTRNames limits the amount of PTR names that are resolved, as
+// recommended by RFC 8601 Section 3.
+const maxPTRNames = 10
+
+type Check struct {
+	instName string
+	log      log.Logger
+	resolver dns.Resolver
+
+	genericNames module.Table
+
+	failAction    modconfig.FailAction
+	temperrAction modconfig.FailAction
+	genericAction modconfig.FailAction
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		resolver: dns.DefaultResolver(),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("generic_names", false, false, nil, modconfig.TableDirective, &c.genericNames)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	cfg.Custom("temperr_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.temperrAction)
+	cfg.Custom("generic_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.genericAction)
+	_, err := cfg.Process()
+	return err
+}
+
+// verify performs the iprev check for the IP.
+//
+// It returns the authentication result and the name that should be used
+// for the generic names check, the forward-confirmed name if there is one or
+// the first PTR name otherwise.
+func (c *Check) verify(ctx context.Context, ip net.IP) (*authres.IPRevResult, string, error) {
+	res := &authres.IPRevResult{
+		IP: ip.String(),
+	}
+
+	names, err := c.resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		if dns.IsNotFound(err) {
+			res.Value = authres.ResultFail
+			res.Reason = "no PTR record"
+			return res, "", nil
+		}
+		res.Value = authres.ResultTempError
+		return res, "", err
+	}
+	if len(names) == 0 {
+		res.Value = authres.ResultFail
+		res.Reason = "no PTR record"
+		return res, "", nil
+	}
+	if len(names) > maxPTRNames {
+		names = names[:maxPTRNames]
+	}
+
+	var lastErr error
+	for _, name := range names {
+		addrs, err := c.resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			if !dns.IsNotFound(err) {
+				lastErr = err
+			}
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				res.Value = authres.ResultPass
+				return res, strings.TrimSuffix(name, "."), nil
+			}
+		}
+	}
+	if lastErr != nil {
+		res.Value = authres.ResultTempError
+		return res, "", lastErr
+	}
+
+	res.Value = authres.ResultFail
+	res.Reason = "PTR does not match forward DNS"
+	return res, strings.TrimSuffix(names[0], "."), nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	conn := s.msgMeta.Conn
+	if conn == nil {
+		s.log.Msg("skipping locally generated message")
+		return module.CheckResult{}
+	}
+	if conn.AuthUser != "" {
+		return module.CheckResult{}
+	}
+	tcpAddr, ok := conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		s.log.Msg("non-IP SMTP connection, skipping")
+		return module.CheckResult{}
+	}
+
+	authRes, name, err := s.c.verify(ctx, tcpAddr.IP)
+	s.log.DebugMsg("iprev result", "result", authRes.Value, "name", name, "reason", authRes.Reason)
+
+	var res module.CheckResult
+	switch authRes.Value {
+	case authres.ResultTempError:
+		reason, misc := exterrors.UnwrapDNSErr(err)
+		res = s.c.temperrAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 25},
+				Message:      "DNS error during policy check",
+				CheckName:    modName,
+				Err:          err,
+				Reason:       reason,
+				Misc:         misc,
+			},
+		})
+	case authres.ResultFail:
+		res = s.c.failAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 25},
+				Message:      "Reverse DNS validation failed",
+				CheckName:    modName,
+				Misc: map[string]interface{}{
+					"reason": authRes.Reason,
+				},
+			},
+		})
+	}
+
+	if !res.Reject && name != "" {
+		genericRes := s.checkGeneric(ctx, name)
+		if genericRes.Reject || genericRes.Quarantine {
+			genericRes.Quarantine = genericRes.Quarantine || res.Quarantine
+			res = genericRes
+		}
+	}
+
+	res.AuthResult = []authres.Result{authRes}
+	return res
+}
+
+// checkGeneric checks whether the rDNS name looks like one assigned to
+// dynamic or residential IPs.
+func (s *state) checkGeneric(ctx context.Context, name string) module.CheckResult {
+	if s.c.genericNames == nil {
+		return module.CheckResult{}
+	}
+
+	key, err := dns.ForLookup(name)
+	if err != nil {
+		key = strings.ToLower(name)
+	}
+	_, ok, err := s.c.genericNames.Lookup(ctx, key)
+	if err != nil {
+		s.log.Error("generic_names lookup failed", err, "name", name)
+		return module.CheckResult{}
+	}
+	if !ok {
+		return module.CheckResult{}
+	}
+
+	return s.c.genericAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 25},
+			Message:      "Client host name looks generic, please use your provider's relay",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"rdns_name": name,
+			},
+		},
+	})
+}
+
+func (s *state) CheckSender(context.Context, string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(context.Context, string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(context.Context, textproto.Header, buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,183 @@
+package iprev
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	_ "github.com/foxcpp/maddy/internal/table"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+var testZones = map[string]mockdns.Zone{
+	// 203.0.113.1 - forward-confirmed.
+	"1.113.0.203.in-addr.arpa.": {
+		PTR: []string{"mx.example.org."},
+	},
+	"mx.example.org.": {
+		A: []string{"203.0.113.1"},
+	},
+	// 203.0.113.2 - PTR points to a name that does not resolve back.
+	"2.113.0.203.in-addr.arpa.": {
+		PTR: []string{"mx.example.org."},
+	},
+	// 203.0.113.3 - no PTR.
+	// 203.0.113.4 - temporary error.
+	"4.113.0.203.in-addr.arpa.": {
+		Err: &net.DNSError{Err: "oops", IsTemporary: true},
+	},
+	// 203.0.113.5 - generic name, forward-confirmed.
+	"5.113.0.203.in-addr.arpa.": {
+		PTR: []string{"dyn-203-0-113-5.pool.example.net."},
+	},
+	"dyn-203-0-113-5.pool.example.net.": {
+		A: []string{"203.0.113.5"},
+	},
+	// 203.0.113.6 - one of multiple names is forward-confirmed.
+	"6.113.0.203.in-addr.arpa.": {
+		PTR: []string{"missing.example.org.", "mx2.example.org."},
+	},
+	"mx2.example.org.": {
+		A: []string{"203.0.113.6"},
+	},
+}
+
+func testCheck(t *testing.T, cfg ...config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	c.resolver = &mockdns.Resolver{Zones: testZones}
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func checkConn(t *testing.T, c *Check, ip string) module.CheckResult {
+	t.Helper()
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		ID: "test",
+		Conn: &module.ConnState{
+			Hostname:   "mx.example.org",
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	return st.CheckConnection(context.Background())
+}
+
+func checkAuthRes(t *testing.T, res module.CheckResult, value authres.ResultValue) {
+	t.Helper()
+	if len(res.AuthResult) != 1 {
+		t.Fatalf("expected exactly one auth result, got %v", res.AuthResult)
+	}
+	ipRev, ok := res.AuthResult[0].(*authres.IPRevResult)
+	if !ok {
+		t.Fatalf("expected IPRevResult, got %T", res.AuthResult[0])
+	}
+	if ipRev.Value != value {
+		t.Errorf("expected %v, got %v (reason: %v)", value, ipRev.Value, ipRev.Reason)
+	}
+}
+
+func checkCode(t *testing.T, res module.CheckResult, code int) {
+	t.Helper()
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(res.Reason, &smtpErr) || smtpErr.Code != code {
+		t.Errorf("expected %d error, got %v", code, res.Reason)
+	}
+}
+
+func TestIPRev(t *testing.T) {
+	c := testCheck(t)
+
+	res := checkConn(t, c, "203.0.113.1")
+	checkAuthRes(t, res, authres.ResultPass)
+	if res.Reason != nil || res.Quarantine || res.Reject {
+		t.Errorf("expected pass, got %+v", res)
+	}
+
+	res = checkConn(t, c, "203.0.113.6")
+	checkAuthRes(t, res, authres.ResultPass)
+
+	for _, ip := range []string{"203.0.113.2", "203.0.113.3"} {
+		res = checkConn(t, c, ip)
+		checkAuthRes(t, res, authres.ResultFail)
+		if !res.Quarantine || res.Reject {
+			t.Errorf("%s: expected quarantine, got %+v", ip, res)
+		}
+		checkCode(t, res, 550)
+	}
+
+	res = checkConn(t, c, "203.0.113.4")
+	checkAuthRes(t, res, authres.ResultTempError)
+	if res.Quarantine || res.Reject {
+		t.Errorf("expected temperror to be ignored, got %+v", res)
+	}
+
+	// Generic names are not checked unless the table is configured.
+	res = checkConn(t, c, "203.0.113.5")
+	checkAuthRes(t, res, authres.ResultPass)
+	if res.Reject {
+		t.Errorf("expected pass, got %+v", res)
+	}
+}
+
+func TestIPRev_Enforce(t *testing.T) {
+	c := testCheck(t,
+		config.Node{Name: "fail_action", Args: []string{"reject"}},
+		config.Node{Name: "temperr_action", Args: []string{"reject"}},
+	)
+
+	res := checkConn(t, c, "203.0.113.3")
+	checkAuthRes(t, res, authres.ResultFail)
+	if !res.Reject {
+		t.Errorf("expected reject, got %+v", res)
+	}
+
+	res = checkConn(t, c, "203.0.113.4")
+	checkAuthRes(t, res, authres.ResultTempError)
+	if !res.Reject {
+		t.Errorf("expected reject, got %+v", res)
+	}
+	checkCode(t, res, 451)
+}
+
+func TestIPRev_GenericNames(t *testing.T) {
+	c := testCheck(t, config.Node{
+		Name: "generic_names",
+		Args: []string{"regexp", `(^|[.-])(dyn|dynamic|dsl|pool)[.-]`},
+		Children: []config.Node{
+			{Name: "full_match", Args: []string{"no"}},
+		},
+	})
+
+	res := checkConn(t, c, "203.0.113.5")
+	checkAuthRes(t, res, authres.ResultPass)
+	if !res.Reject {
+		t.Errorf("expected reject, got %+v", res)
+	}
+	checkCode(t, res, 550)
+
+	res = checkConn(t, c, "203.0.113.1")
+	checkAuthRes(t, res, authres.ResultPass)
+	if res.Reject || res.Quarantine {
+		t.Errorf("expected pass, got %+v", res)
+	}
+}
@@ -0,0 +1,327 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// isSPFRecord reports whether the TXT record is an SPF record, using the
+// same rules as the SPF library.
+func isSPFRecord(txt string) bool {
+	txt = strings.ToLower(txt)
+	return txt == "v=spf1" || strings.HasPrefix(txt, "v=spf1 ")
+}
+
+var (
+	modifierName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9\-_.]*$`)
+	dualCIDR     = regexp.MustCompile(`^(.*?)((?:/[0-9]+)?(?://[0-9]+)?)$`)
+)
+
+// normalizeRecord checks the syntax of the whole SPF record as required by
+// RFC 7208 Section 4.6 and returns the record in the form the SPF library
+// can evaluate.
+//
+// The library evaluates records lazily and would not notice a syntax error
+// past the matching term. It also fails on unknown modifiers that must be
+// ignored per RFC 7208 Section 6, so these are removed from the record.
+func normalizeRecord(txt string) (string, error) {
+	terms := strings.Split(txt, " ")
+	if !strings.EqualFold(terms[0], "v=spf1") {
+		return "", errors.New("not an SPF record")
+	}
+
+	res := []string{terms[0]}
+	seenRedirect, seenExp := false, false
+	for _, term := range terms[1:] {
+		if term == "" {
+			continue
+		}
+
+		if name, value, ok := strings.Cut(term, "="); ok && modifierName.MatchString(name) {
+			switch strings.ToLower(name) {
+			case "redirect":
+				if seenRedirect {
+					return "", errors.New("multiple redirect modifiers")
+				}
+				seenRedirect = true
+				if err := checkDomainSpec(value); err != nil {
+					return "", fmt.Errorf("%s: %w", term, err)
+				}
+			case "exp":
+				if seenExp {
+					return "", errors.New("multiple exp modifiers")
+				}
+				seenExp = true
+				if err := checkDomainSpec(value); err != nil {
+					return "", fmt.Errorf("%s: %w", term, err)
+				}
+			default:
+				if err := checkMacroString(value, false); err != nil {
+					return "", fmt.Errorf("%s: %w", term, err)
+				}
+				// Unknown modifiers must be ignored.
+				continue
+			}
+			res = append(res, term)
+			continue
+		}
+
+		if err := checkDirective(term); err != nil {
+			return "", fmt.Errorf("%s: %w", term, err)
+		}
+		res = append(res, term)
+	}
+
+	return strings.Join(res, " "), nil
+}
+
+func checkDirective(term string) error {
+	switch term[0] {
+	case '+', '-', '~', '?':
+		term = term[1:]
+	}
+
+	name, arg, hasArg := strings.Cut(term, ":")
+	switch strings.ToLower(name) {
+	case "all":
+		if hasArg {
+			return errors.New("unexpected argument")
+		}
+		return nil
+	case "include", "exists":
+		if !hasArg {
+			return errors.New("missing domain")
+		}
+		return checkDomainSpec(arg)
+	case "ptr":
+		if !hasArg {
+			return nil
+		}
+		return checkDomainSpec(arg)
+	case "ip4", "ip6":
+		if !hasArg {
+			return errors.New("missing address")
+		}
+		return checkIP(strings.ToLower(name), arg)
+	}
+
+	// a and mx have an optional domain and CIDR lengths, possibly without
+	// the colon (e.g. "a/24").
+	lname := strings.ToLower(term)
+	for _, mech := range []string{"a", "mx"} {
+		if !strings.HasPrefix(lname, mech) {
+			continue
+		}
+		rest := term[len(mech):]
+		if rest != "" && rest[0] != ':' && rest[0] != '/' {
+			continue
+		}
+
+		groups := dualCIDR.FindStringSubmatch(rest)
+		domain, cidr := groups[1], groups[2]
+		if err := checkDualCIDR(cidr); err != nil {
+			return err
+		}
+		if domain == "" {
+			return nil
+		}
+		if domain[0] != ':' {
+			return errors.New("malformed mechanism")
+		}
+		return checkDomainSpec(domain[1:])
+	}
+
+	return errors.New("unknown mechanism")
+}
+
+func checkIP(mech, arg string) error {
+	addr, length, hasLength := strings.Cut(arg, "/")
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return errors.New("malformed address")
+	}
+	isV4 := !strings.Contains(addr, ":")
+	if (mech == "ip4") != isV4 {
+		return errors.New("address family mismatch")
+	}
+	if !hasLength {
+		return nil
+	}
+	limit := 128
+	if isV4 {
+		limit = 32
+	}
+	return checkCIDRLength(length, limit)
+}
+
+func checkDualCIDR(cidr string) error {
+	if cidr == "" {
+		return nil
+	}
+	v4, v6, _ := strings.Cut(cidr, "//")
+	if v4 != "" {
+		if err := checkCIDRLength(v4[1:], 32); err != nil {
+			return err
+		}
+	}
+	if v6 != "" {
+		return checkCIDRLength(v6, 128)
+	}
+	return nil
+}
+
+func checkCIDRLength(length string, limit int) error {
+	// Leading zeroes are not allowed by the RFC 7208 grammar.
+	if length == "" || (len(length) > 1 && length[0] == '0') {
+		return errors.New("malformed CIDR length")
+	}
+	l, err := strconv.Atoi(length)
+	if err != nil || l < 0 || l > limit {
+		return errors.New("malformed CIDR length")
+	}
+	return nil
+}
+
+// checkDomainSpec checks the domain-spec production from RFC 7208 Section 7.1.
+func checkDomainSpec(spec string) error {
+	if spec == "" {
+		return errors.New("empty domain")
+	}
+	if err := checkMacroString(spec, false); err != nil {
+		return err
+	}
+
+	// domain-end = ( "." toplabel [ "." ] ) / macro-expand
+	if strings.HasSuffix(spec, "}") {
+		return nil
+	}
+	if strings.HasSuffix(spec, "%%") || strings.HasSuffix(spec, "%_") || strings.HasSuffix(spec, "%-") {
+		return nil
+	}
+	spec = strings.TrimSuffix(spec, ".")
+	dot := strings.LastIndexByte(spec, '.')
+	if dot == -1 || !isTopLabel(spec[dot+1:]) {
+		return errors.New("malformed domain")
+	}
+	return nil
+}
+
+func isAlphaNum(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func isTopLabel(label string) bool {
+	if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	hasAlpha, hasHyphen := false, false
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		switch {
+		case c == '-':
+			hasHyphen = true
+		case !isAlphaNum(c):
+			return false
+		case c > '9':
+			hasAlpha = true
+		}
+	}
+	// All-numeric labels are not allowed so the top label cannot be confused
+	// with an IP address.
+	return hasAlpha || hasHyphen
+}
+
+// checkMacroString checks the macro-string production from RFC 7208 Section
+// 7.1. c, r and t macros are allowed only in the explanation string.
+func checkMacroString(s string, exp bool) error {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x21 || c > 0x7E {
+			return errors.New("invalid character")
+		}
+		if c != '%' {
+			continue
+		}
+
+		i++
+		if i == len(s) {
+			return errors.New("malformed macro")
+		}
+		switch s[i] {
+		case '%', '_', '-':
+			continue
+		case '{':
+		default:
+			return errors.New("malformed macro")
+		}
+
+		end := strings.IndexByte(s[i:], '}')
+		if end == -1 {
+			return errors.New("malformed macro")
+		}
+		if err := checkMacro(s[i+1:i+end], exp); err != nil {
+			return err
+		}
+		i += end
+	}
+	return nil
+}
+
+func checkMacro(m string, exp bool) error {
+	if m == "" {
+		return errors.New("malformed macro")
+	}
+
+	switch strings.ToLower(m[:1]) {
+	case "s", "l", "o", "d", "i", "p", "h", "v":
+	case "c", "r", "t":
+		if !exp {
+			return fmt.Errorf("%%{%s} macro is allowed only in explanation", m[:1])
+		}
+	default:
+		return fmt.Errorf("unknown macro: %%{%s}", m)
+	}
+	m = m[1:]
+
+	digits := 0
+	for digits < len(m) && m[digits] >= '0' && m[digits] <= '9' {
+		digits++
+	}
+	if digits != 0 {
+		if n, err := strconv.Atoi(m[:digits]); err != nil || n == 0 {
+			return errors.New("malformed macro transformer")
+		}
+	}
+	m = m[digits:]
+	if m != "" && (m[0] == 'r' || m[0] == 'R') {
+		m = m[1:]
+	}
+	for i := 0; i < len(m); i++ {
+		if !strings.ContainsRune(".-+,/_=", rune(m[i])) {
+			return errors.New("malformed macro delimiter")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+var errQueryLimit = errors.New("DNS query limit reached")
+
+// maxNameLen is the maximum length of the domain name in the textual form,
+// without the trailing dot.
+const maxNameLen = 253
+
+// evalResolver is the resolver used for a single SPF evaluation.
+//
+// It enforces the limit on the total amount of DNS queries made (including
+// ones not counted towards the RFC 7208 lookup limit, such as MX target
+// resolution) and checks the syntax of SPF records before passing them to
+// the library.
+type evalResolver struct {
+	r dns.Resolver
+
+	limit    int
+	queries  int
+	exceeded bool
+}
+
+func (r *evalResolver) query() error {
+	if r.limit == 0 {
+		return nil
+	}
+	r.queries++
+	if r.queries > r.limit {
+		r.exceeded = true
+		return errQueryLimit
+	}
+	return nil
+}
+
+// truncateName shortens the domain name that is the result of macro
+// expansion as required by RFC 7208 Section 7.3.
+func truncateName(name string) string {
+	trailingDot := strings.HasSuffix(name, ".")
+	name = strings.TrimSuffix(name, ".")
+	for len(name) > maxNameLen {
+		dot := strings.IndexByte(name, '.')
+		if dot == -1 {
+			break
+		}
+		name = name[dot+1:]
+	}
+	if trailingDot {
+		name += "."
+	}
+	return name
+}
+
+func (r *evalResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if err := r.query(); err != nil {
+		return nil, err
+	}
+	name = truncateName(name)
+	txts, err := r.r.LookupTXT(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0, len(txts))
+	for _, txt := range txts {
+		if isSPFRecord(txt) {
+			txt, err = normalizeRecord(txt)
+			if err != nil {
+				// Not a *net.DNSError, so the library reports it as permerror.
+				return nil, fmt.Errorf("malformed SPF record for %s: %w", dns.FQDN(name), err)
+			}
+		}
+		res = append(res, txt)
+	}
+	return res, nil
+}
+
+func (r *evalResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if err := r.query(); err != nil {
+		return nil, err
+	}
+	return r.r.LookupMX(ctx, truncateName(name))
+}
+
+func (r *evalResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if err := r.query(); err != nil {
+		return nil, err
+	}
+	return r.r.LookupIPAddr(ctx, truncateName(host))
+}
+
+func (r *evalResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if err := r.query(); err != nil {
+		return nil, err
+	}
+	return r.r.LookupAddr(ctx, addr)
+}
@@ -25,6 +25,7 @@ import (
 	"net"
 	"runtime/debug"
 	"runtime/trace"
+	"sync"
 
 	"blitiri.com.ar/go/spf"
 	"github.com/emersion/go-message/textproto"
@@ -56,6 +57,10 @@ type Check struct {
 	permerrAction  modconfig.FailAction
 	temperrAction  modconfig.FailAction
 
+	lookupLimit     uint
+	voidLookupLimit uint
+	queryLimit      int
+
 	log      log.Logger
 	resolver dns.Resolver
 }
@@ -103,26 +108,94 @@ func (c *Check) Init(cfg *config.Map) error {
 		func() (interface{}, error) {
 			return modconfig.FailAction{}, nil
 		}, modconfig.FailActionDirective, &c.temperrAction)
+	cfg.UInt("lookup_limit", false, false, 10, &c.lookupLimit)
+	cfg.UInt("void_lookup_limit", false, false, 2, &c.voidLookupLimit)
+	cfg.Int("query_limit", false, false, 111, &c.queryLimit)
 	_, err := cfg.Process()
 	if err != nil {
 		return err
 	}
+	if c.queryLimit < 0 {
+		return fmt.Errorf("%s: query_limit should not be negative", modName)
+	}
 
 	return nil
 }
 
+// checkHost evaluates the SPF policy for the sender.
+func (c *Check) checkHost(ctx context.Context, ip net.IP, helo, mailFrom string) (spf.Result, error) {
+	r := &evalResolver{r: c.resolver, limit: c.queryLimit}
+	res, err := spf.CheckHostWithSender(ip, helo, mailFrom,
+		spf.WithContext(ctx), spf.WithResolver(r),
+		spf.OverrideLookupLimit(c.lookupLimit),
+		spf.OverrideVoidLookupLimit(c.voidLookupLimit))
+	if r.exceeded {
+		// The library reports the refused query as either permerror or
+		// temperror depending on the mechanism, make it consistent.
+		return spf.PermError, errQueryLimit
+	}
+	return res, err
+}
+
 type spfRes struct {
 	res spf.Result
 	err error
 }
 
+// connResults keeps SPF results for the connection so messages sent in the
+// same session from the same sender are not evaluated again.
+//
+// It is accessed concurrently by asynchronous evaluations.
+type connResults struct {
+	lck     sync.Mutex
+	results map[string]spfRes
+}
+
+// cachedCheckHost is checkHost that reuses results from previous messages
+// received over the same connection. Temporary errors are not cached.
+func (c *Check) cachedCheckHost(ctx context.Context, conn *module.ConnState, ip net.IP, helo, mailFrom string) (spf.Result, error) {
+	cache, ok := conn.ModData.Get(c, true).(*connResults)
+	if !ok {
+		cache = &connResults{results: map[string]spfRes{}}
+		conn.ModData.Set(c, true, cache)
+	}
+
+	key := ip.String() + " " + helo + " " + mailFrom
+	cache.lck.Lock()
+	cached, ok := cache.results[key]
+	cache.lck.Unlock()
+	if ok {
+		return cached.res, cached.err
+	}
+
+	res, err := c.checkHost(ctx, ip, helo, mailFrom)
+	if res != spf.TempError {
+		cache.lck.Lock()
+		cache.results[key] = spfRes{res, err}
+		cache.lck.Unlock()
+	}
+	return res, err
+}
+
 type state struct {
 	c        *Check
 	msgMeta  *module.MsgMetadata
 	spfFetch chan spfRes
 	log      log.Logger
 
+	// HELO hostname of the client SPF is evaluated for.
+	helo string
+
 	skip bool
+	// The message is received from a trusted relay, evaluation is deferred
+	// until the original client is known.
+	relayed bool
+}
+
+// HeaderOnly implements module.HeaderOnlyCheck, the header is used only to
+// look up the DMARC policy.
+func (c *Check) HeaderOnly() bool {
+	return true
 }
 
 func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
@@ -138,7 +211,7 @@ func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 	_, fromDomain, _ := address.Split(s.msgMeta.OriginalFrom)
 	spfAuth := &authres.SPFResult{
 		Value: authres.ResultNone,
-		Helo:  s.msgMeta.Conn.Hostname,
+		Helo:  s.helo,
 		From:  fromDomain,
 	}
 
@@ -298,6 +371,20 @@ func prepareMailFrom(from string) (string, error) {
 	return fromMbox + "@" + dns.FQDN(fromDomain), nil
 }
 
+// mailFrom returns the MAIL FROM identity to check.
+func (s *state) mailFrom() (string, error) {
+	mailFrom := s.msgMeta.OriginalFrom
+	if mailFrom == "" {
+		// RFC 7208 Section 2.4.
+		// >When the reverse-path is null, this document
+		// >defines the "MAIL FROM" identity to be the mailbox composed of the
+		// >local-part "postmaster" and the "HELO" identity (which might or might
+		// >not have been checked separately before).
+		mailFrom = "postmaster@" + s.helo
+	}
+	return prepareMailFrom(mailFrom)
+}
+
 func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 	defer trace.StartRegion(ctx, "check.spf/CheckConnection").End()
 
@@ -307,6 +394,12 @@ func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 		return module.CheckResult{}
 	}
 
+	if s.msgMeta.Conn.TrustedRelay {
+		s.relayed = true
+		s.log.DebugMsg("message from trusted relay, deferring until the header is received")
+		return module.CheckResult{}
+	}
+
 	ip, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
 	if !ok {
 		s.skip = true
@@ -314,17 +407,8 @@ func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 		return module.CheckResult{}
 	}
 
-	mailFromOriginal := s.msgMeta.OriginalFrom
-	if mailFromOriginal == "" {
-		// RFC 7208 Section 2.4.
-		// >When the reverse-path is null, this document
-		// >defines the "MAIL FROM" identity to be the mailbox composed of the
-		// >local-part "postmaster" and the "HELO" identity (which might or might
-		// >not have been checked separately before).
-		mailFromOriginal = "postmaster@" + s.msgMeta.Conn.Hostname
-	}
-
-	mailFrom, err := prepareMailFrom(mailFromOriginal)
+	s.helo = s.msgMeta.Conn.Hostname
+	mailFrom, err := s.mailFrom()
 	if err != nil {
 		s.skip = true
 		return module.CheckResult{
@@ -334,9 +418,7 @@ func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 	}
 
 	if s.c.enforceEarly {
-		res, err := spf.CheckHostWithSender(ip.IP,
-			dns.FQDN(s.msgMeta.Conn.Hostname), mailFrom,
-			spf.WithContext(ctx), spf.WithResolver(s.c.resolver))
+		res, err := s.c.cachedCheckHost(ctx, s.msgMeta.Conn, ip.IP, dns.FQDN(s.msgMeta.Conn.Hostname), mailFrom)
 		s.log.Debugf("result: %s (%v)", res, err)
 		return s.spfResult(res, err)
 	}
@@ -357,8 +439,7 @@ func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 
 		defer trace.StartRegion(ctx, "check.spf/CheckConnection (Async)").End()
 
-		res, err := spf.CheckHostWithSender(ip.IP, dns.FQDN(s.msgMeta.Conn.Hostname), mailFrom,
-			spf.WithContext(ctx), spf.WithResolver(s.c.resolver))
+		res, err := s.c.cachedCheckHost(ctx, s.msgMeta.Conn, ip.IP, dns.FQDN(s.msgMeta.Conn.Hostname), mailFrom)
 		s.log.Debugf("result: %s (%v)", res, err)
 		s.spfFetch <- spfRes{res, err}
 	}()
@@ -375,6 +456,10 @@ func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult
 }
 
 func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	if s.relayed {
+		return s.checkRelayed(ctx, header)
+	}
+
 	if s.c.enforceEarly || s.skip {
 		// Already applied in CheckConnection.
 		return module.CheckResult{}
@@ -395,6 +480,44 @@ func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buf
 			),
 		}
 	}
+	return s.applyResult(ctx, header, res)
+}
+
+// checkRelayed evaluates SPF for the client that submitted the message to
+// the trusted relay.
+func (s *state) checkRelayed(ctx context.Context, header textproto.Header) module.CheckResult {
+	defer trace.StartRegion(ctx, "check.spf/CheckBody (Relayed)").End()
+
+	client := s.msgMeta.RelayedClient
+	if client == nil {
+		s.log.Println("message from trusted relay, but the original client is unknown, skipping")
+		return module.CheckResult{}
+	}
+	if s.msgMeta.OriginalFrom == "" && client.Hostname == "" {
+		s.log.Println("null sender and unknown HELO hostname of the original client, skipping")
+		return module.CheckResult{}
+	}
+
+	s.helo = client.Hostname
+	mailFrom, err := s.mailFrom()
+	if err != nil {
+		return module.CheckResult{
+			Reason: err,
+			Reject: true,
+		}
+	}
+
+	res, err := s.c.cachedCheckHost(ctx, s.msgMeta.Conn, client.IP, dns.FQDN(client.Hostname), mailFrom)
+	s.log.Debugf("result for %v (relayed): %s (%v)", client.IP, res, err)
+	if s.c.enforceEarly {
+		return s.spfResult(res, err)
+	}
+	return s.applyResult(ctx, header, spfRes{res, err})
+}
+
+// applyResult converts the SPF result into the check result, deferring the
+// action to DMARC if the sender domain has a policy.
+func (s *state) applyResult(ctx context.Context, header textproto.Header, res spfRes) module.CheckResult {
 	if s.relyOnDMARC(ctx, header) {
 		if res.res != spf.Pass {
 			s.log.Msg("deferring action due to a DMARC policy", "result", res.res, "err", res.err)
@@ -0,0 +1,332 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T, zones map[string]mockdns.Zone, cfg []config.Node) *Check {
+	t.Helper()
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := mod.(*Check)
+	check.resolver = &mockdns.Resolver{Zones: zones}
+	check.log = testutils.Logger(t, mod.Name())
+
+	if err := check.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+
+	return check
+}
+
+func checkResult(t *testing.T, c *Check, ip string, expected spf.Result) error {
+	t.Helper()
+	res, err := c.checkHost(context.Background(), net.ParseIP(ip), "mx.example.org.", "user@example.org.")
+	if res != expected {
+		t.Errorf("Expected %v, got %v (%v)", expected, res, err)
+	}
+	return err
+}
+
+func TestCheckHost_Macros(t *testing.T) {
+	c := testCheck(t, map[string]mockdns.Zone{
+		"example.org.": {
+			TXT: []string{"v=spf1 exists:%{ir}.%{l1r+-}._spf.%{d} -all"},
+		},
+		"1.2.0.192.user._spf.example.org.": {
+			A: []string{"127.0.0.2"},
+		},
+	}, nil)
+
+	checkResult(t, c, "192.0.2.1", spf.Pass)
+	checkResult(t, c, "192.0.2.2", spf.Fail)
+}
+
+func TestCheckHost_UnknownModifier(t *testing.T) {
+	c := testCheck(t, map[string]mockdns.Zone{
+		"example.org.": {
+			TXT: []string{"v=spf1 ip4:192.0.2.0/24 x-vendor=%{d} -all"},
+		},
+	}, nil)
+
+	checkResult(t, c, "192.0.2.1", spf.Pass)
+	checkResult(t, c, "198.51.100.1", spf.Fail)
+}
+
+func TestCheckHost_SyntaxAfterMatch(t *testing.T) {
+	c := testCheck(t, map[string]mockdns.Zone{
+		"example.org.": {
+			TXT: []string{"v=spf1 ip4:192.0.2.0/24 include:spf.example.com -al"},
+		},
+	}, nil)
+
+	checkResult(t, c, "192.0.2.1", spf.PermError)
+}
+
+func TestCheckHost_SyntaxInInclude(t *testing.T) {
+	c := testCheck(t, map[string]mockdns.Zone{
+		"example.org.": {
+			TXT: []string{"v=spf1 include:spf.example.com -all"},
+		},
+		"spf.example.com.": {
+			TXT: []string{"v=spf1 ip4:192.0.2.0/24 a:%{x}.example.com ~all"},
+		},
+	}, nil)
+
+	checkResult(t, c, "192.0.2.1", spf.PermError)
+}
+
+func TestCheckHost_VoidLookupLimit(t *testing.T) {
+	zones := map[string]mockdns.Zone{
+		"example.org.": {
+			TXT: []string{"v=spf1 a:a.example.org a:b.example.org a:c.example.org ip4:192.0.2.0/24 -all"},
+		},
+	}
+
+	c := testCheck(t, zones, nil)
+	checkResult(t, c, "192.0.2.1", spf.PermError)
+
+	c = testCheck(t, zones, []config.Node{
+		{Name: "void_lookup_limit", Args: []string{"3"}},
+	})
+	checkResult(t, c, "192.0.2.1", spf.Pass)
+}
+
+func TestCheckHost_QueryLimit(t *testing.T) {
+	zones := map[string]mockdns.Zone{
+		"example.org.": {
+			TXT: []string{"v=spf1 mx -all"},
+			MX:  make([]net.MX, 0, 10),
+		},
+	}
+	zone := zones["example.org."]
+	for i := 0; i < 10; i++ {
+		host := fmt.Sprintf("mx%d.example.org.", i)
+		zone.MX = append(zone.MX, net.MX{Host: host, Pref: 10})
+		zones[host] = mockdns.Zone{A: []string{fmt.Sprintf("192.0.2.%d", i+1)}}
+	}
+	zones["example.org."] = zone
+
+	c := testCheck(t, zones, nil)
+	checkResult(t, c, "192.0.2.10", spf.Pass)
+
+	c = testCheck(t, zones, []config.Node{
+		{Name: "query_limit", Args: []string{"5"}},
+	})
+	if err := checkResult(t, c, "192.0.2.10", spf.PermError); err != errQueryLimit {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestCheck_TrustedRelay(t *testing.T) {
+	c := testCheck(t, map[string]mockdns.Zone{
+		"example.org.": {
+			TXT: []string{"v=spf1 ip4:192.0.2.0/24 -all"},
+		},
+	}, nil)
+
+	check := func(client *module.RelayedClient) module.CheckResult {
+		t.Helper()
+		msgMeta := &module.MsgMetadata{
+			ID:           "test",
+			OriginalFrom: "user@example.org",
+			Conn: &module.ConnState{
+				Hostname:     "relay.example.com",
+				RemoteAddr:   &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 25},
+				TrustedRelay: true,
+			},
+		}
+		st, err := c.CheckStateForMsg(context.Background(), msgMeta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res := st.CheckConnection(context.Background()); res.Reason != nil || len(res.AuthResult) != 0 {
+			t.Fatalf("CheckConnection should not evaluate the policy for relays: %+v", res)
+		}
+
+		// Set by endpoint/smtp once the header is received.
+		msgMeta.RelayedClient = client
+		hdr := textproto.Header{}
+		hdr.Add("From", "<user@example.org>")
+		return st.CheckBody(context.Background(), hdr, nil)
+	}
+
+	spfValue := func(res module.CheckResult) authres.ResultValue {
+		t.Helper()
+		if len(res.AuthResult) != 1 {
+			t.Fatalf("expected a single auth result, got %+v", res.AuthResult)
+		}
+		return res.AuthResult[0].(*authres.SPFResult).Value
+	}
+
+	res := check(&module.RelayedClient{IP: net.IPv4(192, 0, 2, 1), Hostname: "mx.example.org"})
+	if v := spfValue(res); v != authres.ResultPass {
+		t.Errorf("expected pass for the original client, got %v", v)
+	}
+	if helo := res.AuthResult[0].(*authres.SPFResult).Helo; helo != "mx.example.org" {
+		t.Errorf("wrong HELO in the result: %v", helo)
+	}
+
+	res = check(&module.RelayedClient{IP: net.IPv4(203, 0, 113, 1), Hostname: "mx.example.net"})
+	if v := spfValue(res); v != authres.ResultFail {
+		t.Errorf("expected fail for the original client, got %v", v)
+	}
+	if !res.Quarantine {
+		t.Error("expected the message to be quarantined")
+	}
+
+	res = check(nil)
+	if res.Reason != nil || res.Quarantine || len(res.AuthResult) != 0 {
+		t.Errorf("expected no result if the original client is unknown, got %+v", res)
+	}
+}
+
+func TestCheck_ConnCache(t *testing.T) {
+	c := testCheck(t, map[string]mockdns.Zone{
+		"example.org.": {
+			TXT: []string{"v=spf1 ip4:192.0.2.0/24 -all"},
+		},
+		"example.net.": {
+			TXT: []string{"v=spf1 ip4:192.0.2.0/24 -all"},
+		},
+	}, []config.Node{{Name: "enforce_early"}})
+	resolver := &testutils.Resolver{Resolver: c.resolver}
+	c.resolver = resolver
+
+	conn := &module.ConnState{
+		Hostname:   "mx.example.org",
+		RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 25},
+	}
+	check := func(mailFrom string) {
+		t.Helper()
+		st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			ID:           "test",
+			OriginalFrom: mailFrom,
+			Conn:         conn,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := st.CheckConnection(context.Background())
+		if len(res.AuthResult) != 1 {
+			t.Fatalf("expected a single auth result, got %+v", res.AuthResult)
+		}
+		if v := res.AuthResult[0].(*authres.SPFResult).Value; v != authres.ResultPass {
+			t.Fatalf("expected pass, got %v", v)
+		}
+	}
+
+	check("user@example.org")
+	queries := resolver.QueryCount()
+	if queries == 0 {
+		t.Fatal("no queries made")
+	}
+	check("user@example.org")
+	check("user@example.org")
+	if resolver.QueryCount() != queries {
+		t.Errorf("expected the result to be reused, got %d queries instead of %d", resolver.QueryCount(), queries)
+	}
+
+	check("user@example.net")
+	if resolver.QueryCount() == queries {
+		t.Error("expected the policy to be evaluated for a different sender")
+	}
+}
+
+func TestNormalizeRecord(t *testing.T) {
+	for _, rec := range []string{
+		"v=spf1",
+		"v=spf1 -all",
+		"V=SPF1 +A MX/24 ~ALL",
+		"v=spf1 a:example.org/24//64 mx:example.org.//64 -all",
+		"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 ?all",
+		"v=spf1 include:_spf.example.org redirect=_spf.example.com",
+		"v=spf1 exists:%{ir}.%{l1r+-}._spf.%{d} exp=explain._spf.%{d} -all",
+		"v=spf1 ptr ptr:example.org  -all",
+		"v=spf1 exists:%{i}._spf.%{d2} -all",
+	} {
+		if _, err := normalizeRecord(rec); err != nil {
+			t.Errorf("%s: unexpected error: %v", rec, err)
+		}
+	}
+
+	for _, rec := range []string{
+		"v=spf1 al",
+		"v=spf1 all:example.org",
+		"v=spf1 include",
+		"v=spf1 ip4:2001:db8::1",
+		"v=spf1 ip6:192.0.2.1",
+		"v=spf1 ip4:192.0.2.0/33",
+		"v=spf1 ip4:192.0.2.0/024",
+		"v=spf1 a:example.org/",
+		"v=spf1 a:example.123",
+		"v=spf1 exists:%{c}.example.org",
+		"v=spf1 exists:%{i0}.example.org",
+		"v=spf1 exists:%{ix}.example.org",
+		"v=spf1 exists:%{i.example.org",
+		"v=spf1 exists:%x.example.org",
+		"v=spf1 redirect=a.example.org redirect=b.example.org",
+		"v=spf1 exp=a.example.org exp=b.example.org",
+		"v=spf1 -all\t",
+	} {
+		if _, err := normalizeRecord(rec); err == nil {
+			t.Errorf("%s: expected an error", rec)
+		}
+	}
+
+	norm, err := normalizeRecord("v=spf1 x-vendor=%{d} -all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if norm != "v=spf1 -all" {
+		t.Error("Unknown modifier is not removed:", norm)
+	}
+}
+
+func TestTruncateName(t *testing.T) {
+	label := strings.Repeat("a", 63)
+	long := strings.Join([]string{"x", label, label, label, label, "example.org."}, ".")
+	name := truncateName(long)
+	if len(name) > maxNameLen+1 {
+		t.Fatal("Name is not truncated:", len(name))
+	}
+	if !strings.HasSuffix(long, name) || !strings.HasPrefix(name, label+".") {
+		t.Fatal("Name is not truncated by labels:", name)
+	}
+
+	if name := truncateName("example.org."); name != "example.org." {
+		t.Fatal("Short name is changed:", name)
+	}
+}
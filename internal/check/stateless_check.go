@@ -22,12 +22,14 @@ import (
 	"context"
 	"fmt"
 	"runtime/trace"
+	"sync"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/target"
@@ -81,10 +83,53 @@ func (s *statelessCheckState) String() string {
 	return s.c.modName + ":" + s.c.instName
 }
 
+// connResults keeps results of connection and sender checks for the
+// connection so they are not repeated for each message sent in the same
+// session.
+type connResults struct {
+	lck     sync.Mutex
+	conn    *module.CheckResult
+	senders map[string]module.CheckResult
+}
+
+// connResults returns the cache for the connection or nil if the message
+// was not received over network.
+//
+// Messages in a session are handled sequentially, so creating the cache is
+// not racy.
+func (s *statelessCheckState) connResults() *connResults {
+	if s.msgMeta.Conn == nil {
+		return nil
+	}
+	if cache, ok := s.msgMeta.Conn.ModData.Get(s.c, true).(*connResults); ok {
+		return cache
+	}
+	cache := &connResults{senders: map[string]module.CheckResult{}}
+	s.msgMeta.Conn.ModData.Set(s.c, true, cache)
+	return cache
+}
+
+// cacheable reports whether the result can be reused for other messages.
+// Temporary errors are retried.
+func cacheable(res module.CheckResult) bool {
+	return res.Reason == nil || !exterrors.IsTemporary(res.Reason)
+}
+
 func (s *statelessCheckState) CheckConnection(ctx context.Context) module.CheckResult {
 	if s.c.connCheck == nil {
 		return module.CheckResult{}
 	}
+
+	cache := s.connResults()
+	if cache != nil {
+		cache.lck.Lock()
+		cached := cache.conn
+		cache.lck.Unlock()
+		if cached != nil {
+			return s.c.failAction.Apply(*cached)
+		}
+	}
+
 	defer trace.StartRegion(ctx, s.c.modName+"/CheckConnection").End()
 
 	originalRes := s.c.connCheck(StatelessCheckContext{
@@ -93,6 +138,11 @@ func (s *statelessCheckState) CheckConnection(ctx context.Context) module.CheckR
 		MsgMeta:  s.msgMeta,
 		Logger:   target.DeliveryLogger(s.c.logger, s.msgMeta),
 	})
+	if cache != nil && cacheable(originalRes) {
+		cache.lck.Lock()
+		cache.conn = &originalRes
+		cache.lck.Unlock()
+	}
 	return s.c.failAction.Apply(originalRes)
 }
 
@@ -100,6 +150,17 @@ func (s *statelessCheckState) CheckSender(ctx context.Context, mailFrom string)
 	if s.c.senderCheck == nil {
 		return module.CheckResult{}
 	}
+
+	cache := s.connResults()
+	if cache != nil {
+		cache.lck.Lock()
+		cached, ok := cache.senders[mailFrom]
+		cache.lck.Unlock()
+		if ok {
+			return s.c.failAction.Apply(cached)
+		}
+	}
+
 	defer trace.StartRegion(ctx, s.c.modName+"/CheckSender").End()
 
 	originalRes := s.c.senderCheck(StatelessCheckContext{
@@ -108,6 +169,11 @@ func (s *statelessCheckState) CheckSender(ctx context.Context, mailFrom string)
 		MsgMeta:  s.msgMeta,
 		Logger:   target.DeliveryLogger(s.c.logger, s.msgMeta),
 	}, mailFrom)
+	if cache != nil && cacheable(originalRes) {
+		cache.lck.Lock()
+		cache.senders[mailFrom] = originalRes
+		cache.lck.Unlock()
+	}
 	return s.c.failAction.Apply(originalRes)
 }
 
@@ -152,6 +218,10 @@ func (c *statelessCheck) CheckStateForMsg(ctx context.Context, msgMeta *module.M
 	}, nil
 }
 
+func (c *statelessCheck) HeaderOnly() bool {
+	return c.bodyCheck == nil
+}
+
 func (c *statelessCheck) Init(cfg *config.Map) error {
 	cfg.Bool("debug", true, false, &c.logger.Debug)
 	cfg.Custom("fail_action", false, false,
@@ -176,6 +246,11 @@ func (c *statelessCheck) InstanceName() string {
 // It creates the module and its instance with the specified name that implement module.Check interface
 // and runs passed functions when corresponding module.CheckState methods are called.
 //
+// Results of connCheck and senderCheck are cached for the connection (the
+// latter for each sender address), so they should depend only on the
+// connection state and the sender address. Results with temporary errors are
+// not cached.
+//
 // Note about CheckResult that is returned by the functions:
 // StatelessCheck supports different action types based on the user configuration, but the particular check
 // code doesn't need to know about it. It should assume that it is always "Reject" and hence it should
@@ -0,0 +1,95 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package check
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestStatelessCheck_ConnCache(t *testing.T) {
+	var connCalls, senderCalls int
+	var temporary bool
+	c := &statelessCheck{
+		modName: "test_check",
+		logger:  testutils.Logger(t, "test_check"),
+		connCheck: func(StatelessCheckContext) module.CheckResult {
+			connCalls++
+			return module.CheckResult{}
+		},
+		senderCheck: func(_ StatelessCheckContext, mailFrom string) module.CheckResult {
+			senderCalls++
+			if temporary {
+				return module.CheckResult{
+					Reason: &exterrors.SMTPError{Code: 451, Message: "Try again"},
+				}
+			}
+			return module.CheckResult{}
+		},
+	}
+	conn := &module.ConnState{
+		RemoteAddr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 25},
+	}
+
+	check := func(mailFrom string) {
+		t.Helper()
+		state, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{Conn: conn})
+		if err != nil {
+			t.Fatal(err)
+		}
+		state.CheckConnection(context.Background())
+		state.CheckSender(context.Background(), mailFrom)
+	}
+
+	check("foo@example.org")
+	check("foo@example.org")
+	check("bar@example.org")
+	if connCalls != 1 {
+		t.Error("Expected 1 connection check, got", connCalls)
+	}
+	if senderCalls != 2 {
+		t.Error("Expected 2 sender checks, got", senderCalls)
+	}
+
+	// Temporary errors are not cached.
+	temporary = true
+	check("baz@example.org")
+	check("baz@example.org")
+	if senderCalls != 4 {
+		t.Error("Expected 4 sender checks, got", senderCalls)
+	}
+
+	// Results are per connection.
+	conn = &module.ConnState{
+		RemoteAddr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 25},
+	}
+	temporary = false
+	check("foo@example.org")
+	if connCalls != 2 {
+		t.Error("Expected 2 connection checks, got", connCalls)
+	}
+	if senderCalls != 5 {
+		t.Error("Expected 5 sender checks, got", senderCalls)
+	}
+}
@@ -0,0 +1,310 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package verify_rcpt implements check.verify_rcpt module that verifies that
+// recipients exist before the message is accepted.
+//
+// It is meant to be used on a border MX that relays messages to the
+// downstream mail system. Without verification, such MX has to accept
+// messages for any address in the domain and then bounce messages for
+// non-existent recipients, producing backscatter.
+package verify_rcpt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/ttlcache"
+	"github.com/foxcpp/maddy/internal/smtpconn"
+	"github.com/foxcpp/maddy/internal/target"
+	"golang.org/x/net/idna"
+)
+
+const modName = "check.verify_rcpt"
+
+// maxCacheEntries limits the size of the verification results cache.
+const maxCacheEntries = 10000
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	table module.Table
+
+	calloutEndpoints []config.Endpoint
+	calloutHostname  string
+	calloutSender    string
+	calloutStartTLS  bool
+	calloutTLS       tls.Config
+	calloutTimeout   time.Duration
+
+	// cache keeps verification results for each recipient so the lookup
+	// or callout is not repeated for every message.
+	cache       *ttlcache.Cache[string, bool]
+	cacheTTL    time.Duration
+	negativeTTL time.Duration
+
+	noUserAction modconfig.FailAction
+	errAction    modconfig.FailAction
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var callout []string
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("table", false, false, nil, modconfig.TableDirective, &c.table)
+	cfg.StringList("callout", false, false, nil, &callout)
+	cfg.String("hostname", true, false, "", &c.calloutHostname)
+	cfg.String("callout_sender", false, false, "", &c.calloutSender)
+	cfg.Bool("callout_starttls", false, true, &c.calloutStartTLS)
+	cfg.Custom("callout_tls_client", false, false, func() (interface{}, error) {
+		return tls.Config{}, nil
+	}, tls2.TLSClientBlock, &c.calloutTLS)
+	cfg.Duration("callout_timeout", false, false, 30*time.Second, &c.calloutTimeout)
+	cfg.Duration("cache_ttl", false, false, 10*time.Minute, &c.cacheTTL)
+	cfg.Duration("negative_cache_ttl", false, false, 1*time.Minute, &c.negativeTTL)
+	cfg.Custom("no_user_action", false, false, func() (interface{}, error) {
+		return modconfig.FailAction{Reject: true}, nil
+	}, modconfig.FailActionDirective, &c.noUserAction)
+	cfg.Custom("err_action", false, false, func() (interface{}, error) {
+		return modconfig.FailAction{Reject: true}, nil
+	}, modconfig.FailActionDirective, &c.errAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if (c.table == nil) == (len(callout) == 0) {
+		return fmt.Errorf("%s: exactly one of table or callout is required", modName)
+	}
+
+	for _, tgt := range callout {
+		endp, err := config.ParseEndpoint(tgt)
+		if err != nil {
+			return fmt.Errorf("%s: callout: %w", modName, err)
+		}
+		c.calloutEndpoints = append(c.calloutEndpoints, endp)
+	}
+	if len(c.calloutEndpoints) != 0 {
+		if c.calloutHostname == "" {
+			return fmt.Errorf("%s: hostname is required for callout", modName)
+		}
+		// INTERNATIONALIZATION: See RFC 6531 Section 3.7.1.
+		var err error
+		c.calloutHostname, err = idna.ToASCII(c.calloutHostname)
+		if err != nil {
+			return fmt.Errorf("%s: cannot represent the hostname as an A-label name: %w", modName, err)
+		}
+	}
+
+	c.cache = ttlcache.New[string, bool](maxCacheEntries)
+
+	return nil
+}
+
+// connect opens the connection to the downstream server and starts the
+// transaction so RCPT TO can be used to verify recipients.
+func (c *Check) connect(ctx context.Context, log log.Logger) (*smtpconn.C, error) {
+	conn := smtpconn.New()
+	conn.Log = log
+	conn.Hostname = c.calloutHostname
+	conn.ConnectTimeout = c.calloutTimeout
+	conn.CommandTimeout = c.calloutTimeout
+
+	var lastErr error
+	for _, endp := range c.calloutEndpoints {
+		_, err := conn.Connect(ctx, endp, c.calloutStartTLS, &c.calloutTLS)
+		if err != nil {
+			if len(c.calloutEndpoints) != 1 {
+				log.Msg("connect error", err, "downstream_server", net.JoinHostPort(endp.Host, endp.Port))
+			}
+			lastErr = err
+			continue
+		}
+		lastErr = nil
+		break
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+
+	if err := conn.Mail(ctx, c.calloutSender, smtp.MailOptions{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	// Connection used for callouts, shared by all recipients of the message.
+	conn *smtpconn.C
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(context.Context, string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+// callout checks whether the downstream server accepts the recipient.
+func (s *state) callout(ctx context.Context, rcptTo string) (bool, error) {
+	if s.conn == nil {
+		conn, err := s.c.connect(ctx, s.log)
+		if err != nil {
+			return false, err
+		}
+		s.conn = conn
+	}
+
+	err := s.conn.Rcpt(ctx, rcptTo, smtp.RcptOptions{})
+	if err == nil {
+		return true, nil
+	}
+
+	var smtpErr *exterrors.SMTPError
+	if errors.As(err, &smtpErr) {
+		if smtpErr.Code/100 == 5 {
+			s.log.DebugMsg("recipient rejected by downstream server", "rcpt", rcptTo, "reason", err)
+			return false, nil
+		}
+		if smtpErr.Code/100 == 4 && smtpErr.Code != 421 {
+			return false, err
+		}
+	}
+
+	// The connection is likely broken, reconnect for the next recipient.
+	s.conn.DirectClose()
+	s.conn = nil
+	return false, err
+}
+
+func (s *state) lookup(ctx context.Context, key, rcptTo string) (bool, error) {
+	if s.c.table != nil {
+		_, ok, err := s.c.table.Lookup(ctx, key)
+		return ok, err
+	}
+	return s.callout(ctx, rcptTo)
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	key, err := address.ForLookup(rcptTo)
+	if err != nil {
+		return s.c.errAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         553,
+				EnhancedCode: exterrors.EnhancedCode{5, 1, 3},
+				Message:      "Unable to normalize the recipient address",
+				CheckName:    modName,
+				Err:          err,
+			},
+		})
+	}
+
+	exists, cached := s.c.cache.Get(key)
+	if !cached {
+		exists, err = s.lookup(ctx, key, rcptTo)
+		if err != nil {
+			return s.c.errAction.Apply(module.CheckResult{
+				Reason: &exterrors.SMTPError{
+					Code:         451,
+					EnhancedCode: exterrors.EnhancedCode{4, 4, 3},
+					Message:      "Unable to verify the recipient, try again later",
+					CheckName:    modName,
+					Err:          err,
+				},
+			})
+		}
+		ttl := s.c.cacheTTL
+		if !exists {
+			ttl = s.c.negativeTTL
+		}
+		s.c.cache.Put(key, exists, ttl)
+	}
+	s.log.DebugMsg("recipient verified", "rcpt", rcptTo, "exists", exists, "cached", cached)
+
+	if !exists {
+		return s.c.noUserAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+				Message:      "No such user here",
+				CheckName:    modName,
+			},
+		})
+	}
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(context.Context, textproto.Header, buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,191 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package verify_rcpt
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"math/rand"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	_ "github.com/foxcpp/maddy/internal/table"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+var testPort string
+
+func testCheck(t *testing.T, tbl module.Table, cfg ...config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	if tbl != nil {
+		// Replaced with the mock below.
+		cfg = append(cfg, config.Node{Name: "table", Args: []string{"static"}})
+	}
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	if tbl != nil {
+		c.table = tbl
+	}
+	return c
+}
+
+func checkRcpts(t *testing.T, c *Check, rcpts ...string) []module.CheckResult {
+	t.Helper()
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	res := make([]module.CheckResult, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		res = append(res, st.CheckRcpt(context.Background(), rcpt))
+	}
+	return res
+}
+
+func checkRejected(t *testing.T, res module.CheckResult, code int) {
+	t.Helper()
+	if code == 0 {
+		if res.Reason != nil || res.Reject {
+			t.Errorf("expected recipient to be accepted, got %v", res.Reason)
+		}
+		return
+	}
+	if !res.Reject {
+		t.Errorf("expected recipient to be rejected with %d", code)
+		return
+	}
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(res.Reason, &smtpErr) || smtpErr.Code != code {
+		t.Errorf("expected %d error, got %v", code, res.Reason)
+	}
+}
+
+func TestVerifyRcpt_Table(t *testing.T) {
+	tbl := &testutils.Table{M: map[string]string{"user@example.org": ""}}
+	c := testCheck(t, tbl, config.Node{Name: "negative_cache_ttl", Args: []string{"0"}})
+
+	res := checkRcpts(t, c, "USER@example.org", "nobody@example.org")
+	checkRejected(t, res[0], 0)
+	checkRejected(t, res[1], 550)
+
+	// Positive results are cached, negative are not.
+	tbl.M = map[string]string{"nobody@example.org": ""}
+	res = checkRcpts(t, c, "user@example.org", "nobody@example.org")
+	checkRejected(t, res[0], 0)
+	checkRejected(t, res[1], 0)
+
+	// Lookup errors are not cached.
+	tbl.M = nil
+	tbl.Err = errors.New("oops")
+	res = checkRcpts(t, c, "other@example.org")
+	checkRejected(t, res[0], 451)
+	tbl.Err = nil
+	tbl.M = map[string]string{"other@example.org": ""}
+	res = checkRcpts(t, c, "other@example.org")
+	checkRejected(t, res[0], 0)
+}
+
+func TestVerifyRcpt_Callout(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	be.RcptErr = map[string]error{
+		"nobody@example.org": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+		"greylisted@example.org": &smtp.SMTPError{
+			Code:         450,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+			Message:      "Try again later",
+		},
+	}
+
+	c := testCheck(t, nil,
+		config.Node{Name: "callout", Args: []string{"tcp://127.0.0.1:" + testPort}},
+		config.Node{Name: "hostname", Args: []string{"mx.example.com"}},
+		config.Node{Name: "callout_starttls", Args: []string{"no"}},
+	)
+
+	res := checkRcpts(t, c, "user@example.org", "nobody@example.org", "greylisted@example.org")
+	checkRejected(t, res[0], 0)
+	checkRejected(t, res[1], 550)
+	checkRejected(t, res[2], 451)
+	if be.SessionCounter != 1 || be.MailFromCounter != 1 {
+		t.Errorf("expected a single session and transaction, got %d, %d", be.SessionCounter, be.MailFromCounter)
+	}
+
+	// Cached results do not need a connection.
+	res = checkRcpts(t, c, "user@example.org", "nobody@example.org")
+	checkRejected(t, res[0], 0)
+	checkRejected(t, res[1], 550)
+	if be.SessionCounter != 1 {
+		t.Errorf("expected cached results to be used, got %d sessions", be.SessionCounter)
+	}
+}
+
+func TestVerifyRcpt_Config(t *testing.T) {
+	for _, cfg := range [][]config.Node{
+		nil,
+		{
+			{Name: "callout", Args: []string{"tcp://127.0.0.1:25"}},
+		},
+		{
+			{Name: "callout", Args: []string{"tcp://127.0.0.1:25"}},
+			{Name: "hostname", Args: []string{"mx.example.com"}},
+			{Name: "table", Args: []string{"static"}},
+		},
+	} {
+		mod, _ := New(modName, "", nil, nil)
+		if err := mod.Init(config.NewMap(nil, config.Node{Children: cfg})); err == nil {
+			t.Errorf("%v: expected an error", cfg)
+		}
+	}
+}
+
+func TestMain(m *testing.M) {
+	remoteSmtpPort := flag.String("test.smtpport", "random", "(maddy) SMTP port to use for connections in tests")
+	flag.Parse()
+
+	if *remoteSmtpPort == "random" {
+		*remoteSmtpPort = strconv.Itoa(rand.Intn(65536-10000) + 10000)
+	}
+
+	testPort = *remoteSmtpPort
+	os.Exit(m.Run())
+}
@@ -0,0 +1,330 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package verify_sender_domain implements check.verify_sender_domain module
+// that verifies that the MAIL FROM domain exists and is able to receive mail.
+//
+// Spam is commonly sent using made-up sender domains or domains that have
+// no working mail servers, making bounces and replies impossible.
+package verify_sender_domain
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/ttlcache"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.verify_sender_domain"
+
+// maxCacheEntries limits the size of the verification results cache.
+const maxCacheEntries = 10000
+
+// maxMailHosts limits the amount of MX hosts resolved for a single domain.
+const maxMailHosts = 5
+
+type verdict int
+
+const (
+	verdictOK verdict = iota
+	// Domain has neither MX nor address records.
+	verdictNoDomain
+	// Domain explicitly declares it does not accept mail (RFC 7505).
+	verdictNullMX
+	// Mail hosts do not resolve or resolve only to loopback, private and
+	// similar addresses.
+	verdictUnroutable
+)
+
+func (v verdict) String() string {
+	switch v {
+	case verdictOK:
+		return "ok"
+	case verdictNoDomain:
+		return "no_domain"
+	case verdictNullMX:
+		return "null_mx"
+	case verdictUnroutable:
+		return "unroutable"
+	}
+	return "unknown"
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+	resolver dns.Resolver
+
+	// cache keeps verification results for each sender domain so DNS
+	// lookups are done only when the domain is seen for the first time.
+	cache       *ttlcache.Cache[string, verdict]
+	cacheTTL    time.Duration
+	negativeTTL time.Duration
+
+	noDomainAction   modconfig.FailAction
+	unroutableAction modconfig.FailAction
+	errAction        modconfig.FailAction
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		resolver: dns.DefaultResolver(),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Duration("cache_ttl", false, false, 1*time.Hour, &c.cacheTTL)
+	cfg.Duration("negative_cache_ttl", false, false, 10*time.Minute, &c.negativeTTL)
+	cfg.Custom("no_domain_action", false, false, func() (interface{}, error) {
+		return modconfig.FailAction{Reject: true}, nil
+	}, modconfig.FailActionDirective, &c.noDomainAction)
+	cfg.Custom("unroutable_action", false, false, func() (interface{}, error) {
+		return modconfig.FailAction{Reject: true}, nil
+	}, modconfig.FailActionDirective, &c.unroutableAction)
+	cfg.Custom("err_action", false, false, func() (interface{}, error) {
+		return modconfig.FailAction{Reject: true}, nil
+	}, modconfig.FailActionDirective, &c.errAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	c.cache = ttlcache.New[string, verdict](maxCacheEntries)
+	return nil
+}
+
+// routable reports whether the address can be used to deliver mail over the
+// public Internet.
+func routable(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsUnspecified() && !ip.IsPrivate() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsMulticast()
+}
+
+// verify looks up mail hosts for the domain and checks that at least one of
+// them has a routable address.
+//
+// Only temporary errors are returned, all other lookup failures are
+// reflected in the verdict.
+func (c *Check) verify(ctx context.Context, domain string) (verdict, error) {
+	mxs, err := c.resolver.LookupMX(ctx, domain)
+	if err != nil && !dns.IsNotFound(err) {
+		return verdictOK, err
+	}
+
+	var hosts []string
+	if len(mxs) == 0 {
+		// Implicit MX, see RFC 5321 Section 5.1.
+		hosts = []string{domain}
+	} else {
+		sort.Slice(mxs, func(i, j int) bool {
+			return mxs[i].Pref < mxs[j].Pref
+		})
+		for _, mx := range mxs {
+			if mx.Host == "." {
+				return verdictNullMX, nil
+			}
+			hosts = append(hosts, mx.Host)
+		}
+		if len(hosts) > maxMailHosts {
+			hosts = hosts[:maxMailHosts]
+		}
+	}
+
+	var (
+		lastErr  error
+		hasAddrs bool
+	)
+	for _, host := range hosts {
+		addrs, err := c.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			if !dns.IsNotFound(err) {
+				lastErr = err
+			}
+			continue
+		}
+		for _, addr := range addrs {
+			if routable(addr.IP) {
+				return verdictOK, nil
+			}
+			hasAddrs = true
+		}
+	}
+	if lastErr != nil {
+		return verdictOK, lastErr
+	}
+
+	if len(mxs) == 0 && !hasAddrs {
+		return verdictNoDomain, nil
+	}
+	return verdictUnroutable, nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	if mailFrom == "" {
+		// Permit null reverse-path for bounces.
+		return module.CheckResult{}
+	}
+
+	_, domain, err := address.Split(mailFrom)
+	if err != nil || domain == "" {
+		return module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         501,
+				EnhancedCode: exterrors.EnhancedCode{5, 1, 8},
+				Message:      "Malformed sender address",
+				CheckName:    modName,
+				Err:          err,
+			},
+		}
+	}
+	if strings.HasPrefix(domain, "[") {
+		// Address literals have no DNS records to verify.
+		return module.CheckResult{}
+	}
+
+	key, err := dns.ForLookup(domain)
+	if err != nil {
+		return module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         501,
+				EnhancedCode: exterrors.EnhancedCode{5, 1, 8},
+				Message:      "Malformed sender domain",
+				CheckName:    modName,
+				Err:          err,
+			},
+		}
+	}
+
+	v, cached := s.c.cache.Get(key)
+	if !cached {
+		aDomain, err := dns.SelectIDNA(false, key)
+		if err != nil {
+			aDomain = key
+		}
+
+		v, err = s.c.verify(ctx, aDomain)
+		if err != nil {
+			reason, misc := exterrors.UnwrapDNSErr(err)
+			return s.c.errAction.Apply(module.CheckResult{
+				Reason: &exterrors.SMTPError{
+					Code:         451,
+					EnhancedCode: exterrors.EnhancedCode{4, 4, 3},
+					Message:      "Unable to verify the sender domain, try again later",
+					CheckName:    modName,
+					Err:          err,
+					Reason:       reason,
+					Misc:         misc,
+				},
+			})
+		}
+		ttl := s.c.cacheTTL
+		if v != verdictOK {
+			ttl = s.c.negativeTTL
+		}
+		s.c.cache.Put(key, v, ttl)
+	}
+	s.log.DebugMsg("sender domain verified", "domain", key, "verdict", v.String(), "cached", cached)
+
+	switch v {
+	case verdictNoDomain:
+		return s.c.noDomainAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 1, 8},
+				Message:      "Sender domain does not exist",
+				CheckName:    modName,
+			},
+		})
+	case verdictNullMX:
+		return s.c.unroutableAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 27},
+				Message:      "Sender address has null MX",
+				CheckName:    modName,
+			},
+		})
+	case verdictUnroutable:
+		return s.c.unroutableAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 1, 8},
+				Message:      "Sender domain has no usable mail servers",
+				CheckName:    modName,
+			},
+		})
+	}
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(context.Context, string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(context.Context, textproto.Header, buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
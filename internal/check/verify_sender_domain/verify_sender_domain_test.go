@@ -0,0 +1,167 @@
+package verify_sender_domain
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T, zones map[string]mockdns.Zone, cfg ...config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	c.resolver = &mockdns.Resolver{Zones: zones}
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func checkSender(t *testing.T, c *Check, mailFrom string) module.CheckResult {
+	t.Helper()
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	return st.CheckSender(context.Background(), mailFrom)
+}
+
+func checkResult(t *testing.T, res module.CheckResult, code int, enchCode exterrors.EnhancedCode) {
+	t.Helper()
+	if code == 0 {
+		if res.Reason != nil || res.Reject || res.Quarantine {
+			t.Errorf("expected sender to be accepted, got %v", res.Reason)
+		}
+		return
+	}
+	if !res.Reject {
+		t.Errorf("expected sender to be rejected with %d", code)
+		return
+	}
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(res.Reason, &smtpErr) || smtpErr.Code != code || smtpErr.EnhancedCode != enchCode {
+		t.Errorf("expected %d %v error, got %v", code, enchCode, res.Reason)
+	}
+}
+
+func TestVerifySenderDomain(t *testing.T) {
+	c := testCheck(t, map[string]mockdns.Zone{
+		"mx.example.org.": {
+			MX: []net.MX{{Host: "mx1.example.org.", Pref: 10}, {Host: "mx2.example.org.", Pref: 20}},
+		},
+		"mx1.example.org.": {
+			// Broken primary MX should not prevent the check from passing.
+			A: []string{"127.0.0.1"},
+		},
+		"mx2.example.org.": {
+			AAAA: []string{"2001:db8::1"},
+		},
+		"implicit.example.org.": {
+			A: []string{"203.0.113.1"},
+		},
+		"nullmx.example.org.": {
+			MX: []net.MX{{Host: ".", Pref: 0}},
+		},
+		"private.example.org.": {
+			MX: []net.MX{{Host: "mx.private.example.org.", Pref: 10}},
+		},
+		"mx.private.example.org.": {
+			A: []string{"10.0.0.1", "192.168.1.1"},
+		},
+		"dangling.example.org.": {
+			MX: []net.MX{{Host: "missing.example.org.", Pref: 10}},
+		},
+		"loopback.example.org.": {
+			A: []string{"127.0.0.1"},
+		},
+		"empty.example.org.": {
+			TXT: []string{"v=spf1 -all"},
+		},
+		"xn--e1afmkfd.example.org.": {
+			A: []string{"203.0.113.1"},
+		},
+	})
+
+	for _, test := range []struct {
+		mailFrom string
+		code     int
+		enchCode exterrors.EnhancedCode
+	}{
+		{mailFrom: ""},
+		{mailFrom: "test@mx.example.org"},
+		{mailFrom: "test@MX.EXAMPLE.ORG"},
+		{mailFrom: "test@implicit.example.org"},
+		{mailFrom: "test@пример.example.org"},
+		{mailFrom: "test@[203.0.113.1]"},
+		{mailFrom: "test@nullmx.example.org", code: 550, enchCode: exterrors.EnhancedCode{5, 7, 27}},
+		{mailFrom: "test@private.example.org", code: 550, enchCode: exterrors.EnhancedCode{5, 1, 8}},
+		{mailFrom: "test@dangling.example.org", code: 550, enchCode: exterrors.EnhancedCode{5, 1, 8}},
+		{mailFrom: "test@loopback.example.org", code: 550, enchCode: exterrors.EnhancedCode{5, 1, 8}},
+		{mailFrom: "test@empty.example.org", code: 550, enchCode: exterrors.EnhancedCode{5, 1, 8}},
+		{mailFrom: "test@nonexistent.example.org", code: 550, enchCode: exterrors.EnhancedCode{5, 1, 8}},
+	} {
+		t.Run(test.mailFrom, func(t *testing.T) {
+			checkResult(t, checkSender(t, c, test.mailFrom), test.code, test.enchCode)
+		})
+	}
+}
+
+func TestVerifySenderDomain_Actions(t *testing.T) {
+	c := testCheck(t, map[string]mockdns.Zone{
+		"nullmx.example.org.": {
+			MX: []net.MX{{Host: ".", Pref: 0}},
+		},
+	},
+		config.Node{Name: "no_domain_action", Args: []string{"ignore"}},
+		config.Node{Name: "unroutable_action", Args: []string{"quarantine"}},
+	)
+
+	res := checkSender(t, c, "test@nonexistent.example.org")
+	if res.Quarantine || res.Reject {
+		t.Errorf("expected sender to be accepted, got %+v", res)
+	}
+
+	res = checkSender(t, c, "test@nullmx.example.org")
+	if !res.Quarantine || res.Reject {
+		t.Errorf("expected sender to be quarantined, got %+v", res)
+	}
+}
+
+func TestVerifySenderDomain_Cache(t *testing.T) {
+	zones := map[string]mockdns.Zone{
+		"example.org.": {
+			A: []string{"203.0.113.1"},
+		},
+		"example.com.": {
+			Err: &net.DNSError{Err: "oops", IsTemporary: true},
+		},
+	}
+	c := testCheck(t, zones, config.Node{Name: "negative_cache_ttl", Args: []string{"0"}})
+
+	checkResult(t, checkSender(t, c, "test@example.org"), 0, exterrors.EnhancedCode{})
+	checkResult(t, checkSender(t, c, "test@example.net"), 550, exterrors.EnhancedCode{5, 1, 8})
+	checkResult(t, checkSender(t, c, "test@example.com"), 451, exterrors.EnhancedCode{4, 4, 3})
+
+	// Positive results are cached, negative results and errors are not.
+	zones["example.org."] = mockdns.Zone{}
+	zones["example.net."] = mockdns.Zone{A: []string{"203.0.113.2"}}
+	zones["example.com."] = mockdns.Zone{A: []string{"203.0.113.3"}}
+	checkResult(t, checkSender(t, c, "test@example.org"), 0, exterrors.EnhancedCode{})
+	checkResult(t, checkSender(t, c, "test@example.net"), 0, exterrors.EnhancedCode{})
+	checkResult(t, checkSender(t, c, "test@example.com"), 0, exterrors.EnhancedCode{})
+}
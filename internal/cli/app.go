@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/exthook"
 	"github.com/urfave/cli/v2"
 )
 
@@ -110,4 +111,7 @@ func Run() {
 	if err := app.Run(os.Args); err != nil {
 		log.DefaultLogger.Error("app.Run failed", err)
 	}
+
+	// Let hook scripts triggered by the command complete.
+	exthook.Wait()
 }
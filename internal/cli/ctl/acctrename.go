@@ -0,0 +1,294 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/foxcpp/maddy"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/urfave/cli/v2"
+)
+
+type RenamableUserDB interface {
+	RenameUser(oldName, newName string) error
+}
+
+// undoLog collects functions reverting changes made so far so multi-step
+// operations can be rolled back if one of the steps fails.
+type undoLog []func() error
+
+func (u *undoLog) add(f func() error) {
+	*u = append(*u, f)
+}
+
+func (u undoLog) run() {
+	for i := len(u) - 1; i >= 0; i-- {
+		if err := u[i](); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to revert changes: %v\n", err)
+		}
+	}
+}
+
+// optionalCfgBlock returns the module defined by the block named by the
+// flag value. nil is returned if the flag is empty or the block with the
+// default name does not exist.
+func optionalCfgBlock(ctx *cli.Context, mods []maddy.ModInfo, flag string) (*maddy.ModInfo, error) {
+	name := ctx.String(flag)
+	if name == "" {
+		return nil, nil
+	}
+	mod := findCfgBlock(mods, name)
+	if mod == nil && ctx.IsSet(flag) {
+		return nil, cli.Exit(fmt.Sprintf("Error: unknown configuration block: %s", name), 2)
+	}
+	return mod, nil
+}
+
+func imapAcctRename(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return cli.Exit("Error: OLD and NEW are required", 2)
+	}
+	oldName, newName := ctx.Args().Get(0), ctx.Args().Get(1)
+
+	globals, mods, err := readCfgModules(ctx)
+	if err != nil {
+		return err
+	}
+
+	storageMod := findCfgBlock(mods, ctx.String("cfg-block"))
+	if storageMod == nil {
+		return cli.Exit(fmt.Sprintf("Error: unknown configuration block: %s", ctx.String("cfg-block")), 2)
+	}
+	authMod, err := optionalCfgBlock(ctx, mods, "auth-block")
+	if err != nil {
+		return err
+	}
+	aliasesMod, err := optionalCfgBlock(ctx, mods, "aliases-block")
+	if err != nil {
+		return err
+	}
+	statusMod, err := optionalCfgBlock(ctx, mods, "status-block")
+	if err != nil {
+		return err
+	}
+
+	be, err := initStorage(ctx.String("cfg-block"), globals, storageMod)
+	if err != nil {
+		return err
+	}
+	defer closeIfNeeded(be)
+	mbe, ok := be.(module.ManageableStorage)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support accounts management using maddy command", 2)
+	}
+
+	var userDB RenamableUserDB
+	if authMod != nil {
+		db, err := initUserDB(ctx.String("auth-block"), globals, authMod)
+		if err != nil {
+			return err
+		}
+		defer closeIfNeeded(db)
+		userDB, ok = db.(RenamableUserDB)
+		if !ok {
+			return cli.Exit("Error: credentials store does not support renaming, use --auth-block '' to skip it", 2)
+		}
+	}
+
+	var aliases, statuses module.MutableTable
+	for _, t := range []struct {
+		mod   *maddy.ModInfo
+		flag  string
+		store *module.MutableTable
+	}{
+		{aliasesMod, "aliases-block", &aliases},
+		{statusMod, "status-block", &statuses},
+	} {
+		if t.mod == nil {
+			continue
+		}
+		tbl, err := initTable(ctx.String(t.flag), globals, t.mod)
+		if err != nil {
+			return err
+		}
+		defer closeIfNeeded(tbl)
+		mtbl, ok := tbl.(module.MutableTable)
+		if !ok {
+			return cli.Exit(fmt.Sprintf("Error: table %s is not mutable, use --%s '' to skip it", ctx.String(t.flag), t.flag), 2)
+		}
+		*t.store = mtbl
+	}
+
+	var undo undoLog
+	err = renameAccount(&undo, mbe, userDB, aliases, statuses, oldName, newName)
+	if err != nil {
+		undo.run()
+		return err
+	}
+
+	if aliases != nil {
+		reloadTable(aliases)
+	}
+	if statuses != nil {
+		reloadTable(statuses)
+	}
+	return nil
+}
+
+// renameAccount renames the account in all specified stores. nil stores are
+// skipped.
+func renameAccount(undo *undoLog, mbe module.ManageableStorage, userDB RenamableUserDB, aliases, statuses module.MutableTable, oldName, newName string) error {
+	if userDB != nil {
+		if err := userDB.RenameUser(oldName, newName); err != nil {
+			return err
+		}
+		undo.add(func() error { return userDB.RenameUser(newName, oldName) })
+	}
+
+	if err := mbe.RenameIMAPAcct(oldName, newName); err != nil {
+		return err
+	}
+	undo.add(func() error { return mbe.RenameIMAPAcct(newName, oldName) })
+
+	if aliases != nil {
+		if err := renameAliasRefs(undo, aliases, oldName, newName); err != nil {
+			return err
+		}
+	}
+
+	if statuses != nil {
+		if err := renameAcctStatus(undo, statuses, oldName, newName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameAliasRefs moves the alias named after the account and replaces the
+// account address in alias targets.
+func renameAliasRefs(undo *undoLog, tbl module.MutableTable, oldName, newName string) error {
+	oldKey, err := aliasKey(oldName)
+	if err != nil {
+		return err
+	}
+	newKey, err := aliasKey(newName)
+	if err != nil {
+		return err
+	}
+
+	keys, err := tbl.Keys()
+	if err != nil {
+		return err
+	}
+
+	moved := false
+	updated := map[string][]string{}
+	original := map[string][]string{}
+	for _, key := range keys {
+		if key == newKey && containsStr(keys, oldKey) {
+			return cli.Exit(fmt.Sprintf("Error: alias %s already exists", newKey), 1)
+		}
+
+		targets, err := aliasTargets(tbl, key)
+		if err != nil {
+			return err
+		}
+		changed := false
+		newTargets := make([]string, 0, len(targets))
+		for _, target := range targets {
+			if normTarget, err := address.ForLookup(target); err == nil && normTarget == oldKey {
+				target = newName
+				changed = true
+			}
+			if !containsStr(newTargets, target) {
+				newTargets = append(newTargets, target)
+			}
+		}
+
+		if key == oldKey {
+			moved = true
+			original[key] = targets
+			updated[newKey] = newTargets
+			continue
+		}
+		if changed {
+			original[key] = targets
+			updated[key] = newTargets
+		}
+	}
+
+	for key, targets := range updated {
+		if err := setAliasTargets(tbl, key, targets); err != nil {
+			return err
+		}
+		if moved && key == newKey {
+			undo.add(func() error { return tbl.RemoveKey(key) })
+			continue
+		}
+		prev := original[key]
+		undo.add(func() error { return setAliasTargets(tbl, key, prev) })
+	}
+	if moved {
+		if err := tbl.RemoveKey(oldKey); err != nil {
+			return err
+		}
+		prev := original[oldKey]
+		undo.add(func() error { return setAliasTargets(tbl, oldKey, prev) })
+	}
+	return nil
+}
+
+// renameAcctStatus moves the account status entry to the new name.
+func renameAcctStatus(undo *undoLog, tbl module.MutableTable, oldName, newName string) error {
+	oldKey, err := acctStatusKey(oldName)
+	if err != nil {
+		return err
+	}
+	newKey, err := acctStatusKey(newName)
+	if err != nil {
+		return err
+	}
+
+	status, ok, err := tbl.Lookup(context.TODO(), oldKey)
+	if err != nil || !ok {
+		return err
+	}
+	prev, hadPrev, err := tbl.Lookup(context.TODO(), newKey)
+	if err != nil {
+		return err
+	}
+	if err := tbl.SetKey(newKey, status); err != nil {
+		return err
+	}
+	undo.add(func() error {
+		if hadPrev {
+			return tbl.SetKey(newKey, prev)
+		}
+		return tbl.RemoveKey(newKey)
+	})
+	if err := tbl.RemoveKey(oldKey); err != nil {
+		return err
+	}
+	undo.add(func() error { return tbl.SetKey(oldKey, status) })
+	return nil
+}
@@ -0,0 +1,144 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+type mapTable map[string]string
+
+func (m mapTable) Lookup(_ context.Context, k string) (string, bool, error) {
+	v, ok := m[k]
+	return v, ok, nil
+}
+
+func (m mapTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m mapTable) SetKey(k, v string) error {
+	m[k] = v
+	return nil
+}
+
+func (m mapTable) RemoveKey(k string) error {
+	delete(m, k)
+	return nil
+}
+
+type renameStorage struct {
+	module.ManageableStorage
+	accts map[string]bool
+	err   error
+}
+
+func (s *renameStorage) RenameIMAPAcct(oldName, newName string) error {
+	if s.err != nil {
+		return s.err
+	}
+	if !s.accts[oldName] || s.accts[newName] {
+		return errors.New("cannot rename")
+	}
+	delete(s.accts, oldName)
+	s.accts[newName] = true
+	return nil
+}
+
+type renameUserDB map[string]bool
+
+func (db renameUserDB) RenameUser(oldName, newName string) error {
+	if !db[oldName] || db[newName] {
+		return errors.New("cannot rename")
+	}
+	delete(db, oldName)
+	db[newName] = true
+	return nil
+}
+
+func TestRenameAccount(t *testing.T) {
+	storage := &renameStorage{accts: map[string]bool{"a@example.org": true}}
+	userDB := renameUserDB{"a@example.org": true}
+	aliases := mapTable{
+		"a@example.org":    "fwd@example.com",
+		"info@example.org": "A@example.org",
+		"x@example.org":    "y@example.org",
+	}
+	statuses := mapTable{"a@example.org": "receive-only"}
+
+	var undo undoLog
+	if err := renameAccount(&undo, storage, userDB, aliases, statuses, "a@example.org", "b@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !storage.accts["b@example.org"] || !userDB["b@example.org"] {
+		t.Error("Account is not renamed")
+	}
+	expectedAliases := mapTable{
+		"b@example.org":    "fwd@example.com",
+		"info@example.org": "b@example.org",
+		"x@example.org":    "y@example.org",
+	}
+	if !reflect.DeepEqual(aliases, expectedAliases) {
+		t.Errorf("Wrong aliases: %v", aliases)
+	}
+	if !reflect.DeepEqual(statuses, mapTable{"b@example.org": "receive-only"}) {
+		t.Errorf("Wrong statuses: %v", statuses)
+	}
+
+	undo.run()
+	if !storage.accts["a@example.org"] || !userDB["a@example.org"] {
+		t.Error("Account rename is not reverted")
+	}
+	if !reflect.DeepEqual(aliases, mapTable{
+		"a@example.org":    "fwd@example.com",
+		"info@example.org": "A@example.org",
+		"x@example.org":    "y@example.org",
+	}) {
+		t.Errorf("Aliases are not reverted: %v", aliases)
+	}
+	if !reflect.DeepEqual(statuses, mapTable{"a@example.org": "receive-only"}) {
+		t.Errorf("Statuses are not reverted: %v", statuses)
+	}
+}
+
+func TestRenameAccount_StorageFailure(t *testing.T) {
+	storage := &renameStorage{err: errors.New("oops")}
+	userDB := renameUserDB{"a@example.org": true}
+
+	var undo undoLog
+	if err := renameAccount(&undo, storage, userDB, nil, nil, "a@example.org", "b@example.org"); err == nil {
+		t.Fatal("Expected an error")
+	}
+	undo.run()
+	if !userDB["a@example.org"] || userDB["b@example.org"] {
+		t.Error("Credentials rename is not reverted")
+	}
+}
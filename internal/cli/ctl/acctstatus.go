@@ -0,0 +1,210 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/acctstatus"
+	"github.com/foxcpp/maddy/internal/authz"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "account-status",
+			Usage: "Account status (suspension) management",
+			Description: `These commands manipulate the table used to store account statuses
+(see account_status directive).
+
+Possible statuses are:
+- active: no restrictions (default for accounts not in the table)
+- suspended: account can't log in and does not receive messages
+- receive-only: account receives messages and can access them but
+  can't submit messages
+- send-only: account can submit messages but does not receive ones
+
+The table should be defined in maddy.conf as a top-level config block and be
+referenced from other places using &block_name syntax. By default the block
+name should be local_account_status (can be changed using --cfg-block
+argument for subcommands). table.file and SQL tables with configured
+modification queries are supported.
+
+If the running server uses table.file, it is asked to reload it immediately.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "List accounts with non-default status",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_account_status",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						tbl, err := openTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return acctStatusList(tbl, ctx)
+					},
+				},
+				{
+					Name:      "get",
+					Usage:     "Show the account status",
+					ArgsUsage: "USERNAME",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_account_status",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						tbl, err := openTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return acctStatusGet(tbl, ctx)
+					},
+				},
+				{
+					Name:      "set",
+					Usage:     "Change the account status",
+					ArgsUsage: "USERNAME STATUS",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_account_status",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						tbl, err := openTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return acctStatusSet(tbl, ctx)
+					},
+				},
+			},
+		})
+}
+
+// acctStatusKey normalizes the username the same way authentication does by
+// default.
+func acctStatusKey(username string) (string, error) {
+	key, err := authz.NormalizeAuto(username)
+	if err != nil || key == "" {
+		return "", cli.Exit(fmt.Sprintf("Error: invalid username: %s", username), 2)
+	}
+	return key, nil
+}
+
+func acctStatusList(tbl module.Table, ctx *cli.Context) error {
+	mtbl, ok := tbl.(module.MutableTable)
+	if !ok {
+		return cli.Exit("Error: table is not mutable, no management functionality available", 2)
+	}
+	keys, err := mtbl.Keys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 && !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "All accounts are active.")
+	}
+	for _, key := range keys {
+		val, _, err := tbl.Lookup(context.TODO(), key)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s\n", key, val)
+	}
+	return nil
+}
+
+func acctStatusGet(tbl module.Table, ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	key, err := acctStatusKey(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	status, err := acctstatus.Lookup(context.TODO(), tbl, key)
+	if err != nil {
+		return err
+	}
+	fmt.Println(status)
+	return nil
+}
+
+func acctStatusSet(tbl module.Table, ctx *cli.Context) error {
+	mtbl, ok := tbl.(module.MutableTable)
+	if !ok {
+		return cli.Exit("Error: table is not mutable, no management functionality available", 2)
+	}
+	if ctx.NArg() != 2 {
+		return cli.Exit("Error: USERNAME and STATUS are required", 2)
+	}
+	key, err := acctStatusKey(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	status, err := acctstatus.Parse(ctx.Args().Get(1))
+	if err != nil {
+		statuses := make([]string, 0, len(acctstatus.Statuses))
+		for _, st := range acctstatus.Statuses {
+			statuses = append(statuses, string(st))
+		}
+		return cli.Exit(fmt.Sprintf("Error: invalid status, should be one of: %s", strings.Join(statuses, ", ")), 2)
+	}
+
+	if status == acctstatus.Active {
+		_, exists, err := tbl.Lookup(context.TODO(), key)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return nil
+		}
+		err = mtbl.RemoveKey(key)
+	} else {
+		err = mtbl.SetKey(key, string(status))
+	}
+	if err != nil {
+		return err
+	}
+	reloadTable(tbl)
+	return nil
+}
@@ -0,0 +1,306 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/foxcpp/maddy"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/module"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/table"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "alias",
+			Usage: "Address aliases management",
+			Description: `These commands manipulate the table used to store address aliases
+(e.g. by replace_rcpt).
+
+The table should be defined in maddy.conf as a top-level config block and be
+referenced from other places using &block_name syntax. By default the block
+name should be local_aliases (can be changed using --cfg-block argument for
+subcommands). table.file and SQL tables with configured modification queries
+are supported.
+
+If the running server uses table.file, it is asked to reload it immediately.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:      "list",
+					Usage:     "List aliases or targets of the alias",
+					ArgsUsage: "[ALIAS]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_aliases",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						tbl, err := openTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return aliasList(tbl, ctx)
+					},
+				},
+				{
+					Name:  "add",
+					Usage: "Add alias targets",
+					Description: `Adds targets to the list of targets for the alias, the alias is
+created if needed.
+
+If the table can contain only one target per alias, the existing alias is not
+changed unless --replace is used.
+`,
+					ArgsUsage: "ALIAS TARGET...",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_aliases",
+						},
+						&cli.BoolFlag{
+							Name:  "replace",
+							Usage: "Replace existing targets instead of adding to them",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						tbl, err := openTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return aliasAdd(tbl, ctx)
+					},
+				},
+				{
+					Name:    "remove",
+					Aliases: []string{"del"},
+					Usage:   "Remove alias or some of its targets",
+					Description: `Removes specified targets from the alias. If no targets are specified
+or no targets are left, the alias is removed.
+`,
+					ArgsUsage: "ALIAS [TARGET...]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_aliases",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						tbl, err := openTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return aliasRemove(tbl, ctx)
+					},
+				},
+			},
+		})
+}
+
+// aliasKey normalizes the alias the same way replace_rcpt does for lookups.
+func aliasKey(alias string) (string, error) {
+	key, err := address.ForLookup(alias)
+	if err != nil || key == "" {
+		return "", cli.Exit(fmt.Sprintf("Error: invalid alias: %s", alias), 2)
+	}
+	return key, nil
+}
+
+func aliasTargets(tbl module.Table, key string) ([]string, error) {
+	if multi, ok := tbl.(module.MultiTable); ok {
+		return multi.LookupMulti(context.TODO(), key)
+	}
+	target, ok, err := tbl.Lookup(context.TODO(), key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return []string{target}, nil
+}
+
+func aliasList(tbl module.Table, ctx *cli.Context) error {
+	if alias := ctx.Args().First(); alias != "" {
+		key, err := aliasKey(alias)
+		if err != nil {
+			return err
+		}
+		targets, err := aliasTargets(tbl, key)
+		if err != nil {
+			return err
+		}
+		if len(targets) == 0 {
+			return cli.Exit(fmt.Sprintf("Error: no such alias: %s", key), 1)
+		}
+		for _, target := range targets {
+			fmt.Println(target)
+		}
+		return nil
+	}
+
+	mtbl, ok := tbl.(module.MutableTable)
+	if !ok {
+		return cli.Exit("Error: table is not mutable, no management functionality available", 2)
+	}
+	keys, err := mtbl.Keys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 && !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "No aliases.")
+	}
+	for _, key := range keys {
+		targets, err := aliasTargets(tbl, key)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s\n", key, strings.Join(targets, ", "))
+	}
+	return nil
+}
+
+func aliasAdd(tbl module.Table, ctx *cli.Context) error {
+	mtbl, ok := tbl.(module.MutableTable)
+	if !ok {
+		return cli.Exit("Error: table is not mutable, no management functionality available", 2)
+	}
+	if ctx.NArg() < 2 {
+		return cli.Exit("Error: ALIAS and TARGET are required", 2)
+	}
+	key, err := aliasKey(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	newTargets := ctx.Args().Tail()
+
+	var targets []string
+	if !ctx.Bool("replace") {
+		targets, err = aliasTargets(tbl, key)
+		if err != nil {
+			return err
+		}
+	}
+	for _, target := range newTargets {
+		if !containsStr(targets, target) {
+			targets = append(targets, target)
+		}
+	}
+
+	if err := setAliasTargets(mtbl, key, targets); err != nil {
+		return err
+	}
+	reloadTable(tbl)
+	return nil
+}
+
+func aliasRemove(tbl module.Table, ctx *cli.Context) error {
+	mtbl, ok := tbl.(module.MutableTable)
+	if !ok {
+		return cli.Exit("Error: table is not mutable, no management functionality available", 2)
+	}
+	if ctx.NArg() < 1 {
+		return cli.Exit("Error: ALIAS is required", 2)
+	}
+	key, err := aliasKey(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+
+	targets, err := aliasTargets(tbl, key)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return cli.Exit(fmt.Sprintf("Error: no such alias: %s", key), 1)
+	}
+
+	var left []string
+	if ctx.NArg() > 1 {
+		removed := ctx.Args().Tail()
+		for _, target := range removed {
+			if !containsStr(targets, target) {
+				return cli.Exit(fmt.Sprintf("Error: %s is not a target of %s", target, key), 1)
+			}
+		}
+		for _, target := range targets {
+			if !containsStr(removed, target) {
+				left = append(left, target)
+			}
+		}
+	}
+
+	if len(left) == 0 {
+		err = mtbl.RemoveKey(key)
+	} else {
+		err = setAliasTargets(mtbl, key, left)
+	}
+	if err != nil {
+		return err
+	}
+	reloadTable(tbl)
+	return nil
+}
+
+func setAliasTargets(tbl module.MutableTable, key string, targets []string) error {
+	if multi, ok := tbl.(module.MutableMultiTable); ok {
+		return multi.SetKeyMulti(key, targets)
+	}
+	if len(targets) != 1 {
+		return cli.Exit("Error: table supports only one target per alias, use --replace to change it", 2)
+	}
+	return tbl.SetKey(key, targets[0])
+}
+
+func containsStr(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadTable asks the running server to re-read the table if it caches the
+// contents.
+func reloadTable(tbl module.Table) {
+	if _, ok := tbl.(*table.File); !ok {
+		return
+	}
+	if err := maddy.SignalReload(); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "Failed to signal the server to reload the table, changes will be applied shortly: %v\n", err)
+		}
+	}
+}
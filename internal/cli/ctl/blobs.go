@@ -0,0 +1,131 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	"github.com/urfave/cli/v2"
+)
+
+// BlobChecker is implemented by storage backends that keep message bodies
+// in a separate blob store and can check it for consistency.
+type BlobChecker interface {
+	CheckBlobs(ctx context.Context, grace time.Duration, cleanup bool) (imapsql.BlobReport, error)
+}
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "imap-blobs",
+			Usage: "Message blob store maintenance",
+			Description: `These subcommands can be used to check the consistency between
+the storage database and the blob store used for message bodies.
+
+Server crashes in the middle of delivery or message removal can leave
+blobs that are not referenced by the database. Such blobs waste
+storage space and can be safely removed.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "check",
+					Usage: "Find orphaned and missing blobs",
+					Description: `Report blobs not referenced by the database
+and database entries whose blob is missing.
+
+Blobs modified recently (see --grace) are ignored since they may belong
+to a delivery in progress. With --cleanup, orphaned blobs are removed.
+Missing blobs are only reported.`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.DurationFlag{
+							Name:  "grace",
+							Usage: "Ignore blobs modified within the specified period",
+							Value: 1 * time.Hour,
+						},
+						&cli.BoolFlag{
+							Name:  "cleanup",
+							Usage: "Remove orphaned blobs",
+						},
+						&cli.BoolFlag{
+							Name:    "yes",
+							Aliases: []string{"y"},
+							Usage:   "Don't ask for confirmation",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return blobsCheck(be, ctx)
+					},
+				},
+			},
+		})
+}
+
+func blobsCheck(be module.Storage, ctx *cli.Context) error {
+	checker, ok := be.(BlobChecker)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support blob store checks", 2)
+	}
+
+	report, err := checker.CheckBlobs(ctx.Context, ctx.Duration("grace"), false)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range report.Orphaned {
+		fmt.Println("orphaned:", key)
+	}
+	for _, key := range report.Missing {
+		fmt.Println("missing:", key)
+	}
+	fmt.Printf("%d orphaned, %d missing\n", len(report.Orphaned), len(report.Missing))
+
+	if !ctx.Bool("cleanup") || len(report.Orphaned) == 0 {
+		return nil
+	}
+
+	if !ctx.Bool("yes") {
+		if !clitools2.Confirmation(fmt.Sprintf("Remove %d orphaned blobs?", len(report.Orphaned)), false) {
+			return cli.Exit("Cancelled", 2)
+		}
+	}
+
+	report, err = checker.CheckBlobs(ctx.Context, ctx.Duration("grace"), true)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d orphaned blobs removed\n", len(report.Orphaned))
+	return nil
+}
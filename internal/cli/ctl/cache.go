@@ -0,0 +1,130 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/foxcpp/maddy/internal/cacheflush"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "cache",
+			Usage: "Runtime caches management",
+			Description: `These commands allow to flush caches of the running server, e.g.
+after the DNS records or MTA-STS policy of a remote domain were fixed and
+waiting for the cached data to expire is not desirable.
+
+The following kinds of caches are supported, the meaning of KEY is shown in
+parentheses:
+- dns - DNS responses used for outbound delivery (domain and its subdomains)
+- mtasts - MTA-STS policies of remote domains (domain)
+- mx_failures - recent connection failures of MX hosts (MX hostname)
+- dkim - DKIM public keys and verification results (signing domain)
+- auth - recent password verifications of auth.pass_table (username)
+- table - lookup results of table.cache (lookup key)
+
+` + controlSocketNote,
+			Subcommands: []*cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List caches used by the server",
+					Action: cacheList,
+				},
+				{
+					Name:  "flush",
+					Usage: "Remove cached entries",
+					Description: `Remove entries related to KEY from all caches of the specified KIND.
+If KEY is not specified, the caches are cleared completely. If KIND is
+"all", all caches are cleared.
+
+Use --name to flush only the cache of the specified configuration block.
+`,
+					ArgsUsage: "KIND [KEY]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "Flush only the cache of the configuration block with this name",
+						},
+					},
+					Action: cacheFlush,
+				},
+			},
+		})
+}
+
+func cacheList(ctx *cli.Context) error {
+	if _, _, err := readCfgGlobals(ctx); err != nil {
+		return err
+	}
+
+	var list []cacheflush.Cache
+	if err := callControl("cache.list", nil, &list); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAME")
+	for _, c := range list {
+		name := c.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", c.Kind, name)
+	}
+	return w.Flush()
+}
+
+func cacheFlush(ctx *cli.Context) error {
+	kind := ctx.Args().First()
+	if kind == "" {
+		return cli.Exit("Error: KIND is required", 2)
+	}
+	if ctx.NArg() > 2 {
+		return cli.Exit("Error: too many arguments", 2)
+	}
+	key := ctx.Args().Get(1)
+	if kind == "all" {
+		if key != "" {
+			return cli.Exit("Error: KEY cannot be used with 'all'", 2)
+		}
+		kind = ""
+	}
+	if _, _, err := readCfgGlobals(ctx); err != nil {
+		return err
+	}
+
+	var res cacheflush.FlushResult
+	err := callControl("cache.flush", map[string]string{
+		"kind": kind,
+		"name": ctx.String("name"),
+		"key":  key,
+	}, &res)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d entries from %d caches.\n", res.Removed, res.Caches)
+	return nil
+}
@@ -0,0 +1,510 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/pass_table"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+)
+
+// credRecord is the account entry used by 'creds export' and 'creds import'.
+type credRecord struct {
+	Username string `json:"username"`
+	// Password hash in the format used by auth.pass_table.
+	Hash string `json:"hash,omitempty"`
+	// Plain-text password, used only for import.
+	Password string `json:"password,omitempty"`
+	// Address to send the generated password to, used only for import.
+	Email       string `json:"email,omitempty"`
+	IMAPAccount bool   `json:"imap_account,omitempty"`
+}
+
+var csvColumns = []string{"username", "hash", "password", "email", "imap_account"}
+
+// recordsFormat returns the format to use for the file, either set explicitly
+// or guessed from the file extension.
+func recordsFormat(ctx *cli.Context, path string) (string, error) {
+	switch format := ctx.String("format"); format {
+	case formatJSON, formatCSV:
+		return format, nil
+	case "":
+		if strings.EqualFold(filepath.Ext(path), ".csv") {
+			return formatCSV, nil
+		}
+		return formatJSON, nil
+	default:
+		return "", cli.Exit(fmt.Sprintf("Error: unknown format: %s", format), 2)
+	}
+}
+
+func writeCredRecords(w io.Writer, format string, records []credRecord) error {
+	if format == formatJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvColumns); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		imapAcct := ""
+		if rec.IMAPAccount {
+			imapAcct = "true"
+		}
+		if err := cw.Write([]string{rec.Username, rec.Hash, rec.Password, rec.Email, imapAcct}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func readCredRecords(r io.Reader, format string) ([]credRecord, error) {
+	if format == formatJSON {
+		var records []credRecord
+		dec := json.NewDecoder(r)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&records); err != nil {
+			return nil, err
+		}
+		return records, nil
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("CSV header: %w", err)
+	}
+	for _, col := range header {
+		known := false
+		for _, c := range csvColumns {
+			if c == col {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown CSV column: %s", col)
+		}
+	}
+
+	var records []credRecord
+	for {
+		row, err := cr.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		var rec credRecord
+		for i, value := range row {
+			if i >= len(header) {
+				line, _ := cr.FieldPos(0)
+				return nil, fmt.Errorf("line %d: too many fields", line)
+			}
+			switch header[i] {
+			case "username":
+				rec.Username = value
+			case "hash":
+				rec.Hash = value
+			case "password":
+				rec.Password = value
+			case "email":
+				rec.Email = value
+			case "imap_account":
+				if value == "" {
+					continue
+				}
+				rec.IMAPAccount, err = strconv.ParseBool(value)
+				if err != nil {
+					line, _ := cr.FieldPos(i)
+					return nil, fmt.Errorf("line %d: imap_account: %w", line, err)
+				}
+			}
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func usersExport(be module.PlainUserDB, storage module.Storage, ctx *cli.Context) error {
+	passTbl, ok := be.(*pass_table.Auth)
+	if !ok {
+		return cli.Exit("Error: export is supported only for auth.pass_table credentials DB", 2)
+	}
+
+	path := ctx.Args().First()
+	format, err := recordsFormat(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	users, err := passTbl.ListUsers()
+	if err != nil {
+		return err
+	}
+	records := make(map[string]*credRecord, len(users))
+	for _, user := range users {
+		hash, ok, err := passTbl.UserHash(user)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// Removed in the meantime.
+			continue
+		}
+		records[user] = &credRecord{Username: user, Hash: hash}
+	}
+
+	if storage != nil {
+		mbe, ok := storage.(module.ManageableStorage)
+		if !ok {
+			return cli.Exit("Error: storage backend does not support accounts management using maddy command", 2)
+		}
+		accts, err := mbe.ListIMAPAccts()
+		if err != nil {
+			return err
+		}
+		for _, acct := range accts {
+			rec := records[acct]
+			if rec == nil {
+				rec = &credRecord{Username: acct}
+				records[acct] = rec
+			}
+			rec.IMAPAccount = true
+		}
+	}
+
+	list := make([]credRecord, 0, len(records))
+	for _, rec := range records {
+		list = append(list, *rec)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Username < list[j].Username
+	})
+
+	if path == "" || path == "-" {
+		return writeCredRecords(os.Stdout, format, list)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := writeCredRecords(f, format, list); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// passwordAlphabet is used for generated passwords. Characters that are easy
+// to confuse (0/O, 1/l/I) are excluded.
+const passwordAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+func generatePassword(length int) (string, error) {
+	var b strings.Builder
+	alphabetLen := big.NewInt(int64(len(passwordAlphabet)))
+	for i := 0; i < length; i++ {
+		n, err := rand.Int(rand.Reader, alphabetLen)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(passwordAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// passwordNotice sends generated passwords to users by email.
+type passwordNotice struct {
+	tmpl     *template.Template
+	from     string
+	smtpAddr string
+	auth     sasl.Client
+}
+
+// passwordNoticeData is the information available in the password
+// notification template.
+type passwordNoticeData struct {
+	Username string
+	Password string
+	Email    string
+}
+
+func newPasswordNotice(ctx *cli.Context) (*passwordNotice, error) {
+	path := ctx.String("notify-template")
+	if path == "" {
+		return nil, nil
+	}
+
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filepath.Base(path)).Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+
+	n := &passwordNotice{
+		tmpl:     tmpl,
+		from:     ctx.String("notify-from"),
+		smtpAddr: ctx.String("smtp"),
+	}
+	if n.from == "" {
+		return nil, cli.Exit("Error: --notify-from is required to send notifications", 2)
+	}
+	if _, _, err := address.Split(n.from); err != nil {
+		return nil, cli.Exit(fmt.Sprintf("Error: invalid --notify-from address: %v", err), 2)
+	}
+	if user := ctx.String("smtp-user"); user != "" {
+		n.auth = sasl.NewPlainClient("", user, ctx.String("smtp-password"))
+	}
+	return n, nil
+}
+
+// message renders the notification message.
+func (n *passwordNotice) message(data passwordNoticeData) ([]byte, error) {
+	var body bytes.Buffer
+	if err := n.tmpl.Execute(&body, data); err != nil {
+		return nil, err
+	}
+
+	subject := "Your account has been created"
+	if subjTmpl := n.tmpl.Lookup("subject"); subjTmpl != nil {
+		var b bytes.Buffer
+		if err := subjTmpl.Execute(&b, data); err != nil {
+			return nil, err
+		}
+		if s := strings.Join(strings.Fields(b.String()), " "); s != "" {
+			subject = s
+		}
+	}
+
+	rawID := make([]byte, 16)
+	if _, err := rand.Read(rawID); err != nil {
+		return nil, err
+	}
+	_, domain, _ := address.Split(n.from)
+
+	var hdr textproto.Header
+	hdr.Add("Date", time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	hdr.Add("From", n.from)
+	hdr.Add("To", data.Email)
+	hdr.Add("Subject", mime.QEncoding.Encode("utf-8", subject))
+	hdr.Add("Message-Id", "<"+hex.EncodeToString(rawID)+"@"+domain+">")
+	hdr.Add("MIME-Version", "1.0")
+	hdr.Add("Content-Type", "text/plain; charset=utf-8")
+	hdr.Add("Content-Transfer-Encoding", "8bit")
+
+	var msg bytes.Buffer
+	if err := textproto.WriteHeader(&msg, hdr); err != nil {
+		return nil, err
+	}
+	msg.Write(bytes.ReplaceAll(body.Bytes(), []byte("\n"), []byte("\r\n")))
+	return msg.Bytes(), nil
+}
+
+func (n *passwordNotice) send(data passwordNoticeData) error {
+	msg, err := n.message(data)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(n.smtpAddr, n.auth, n.from, []string{data.Email}, bytes.NewReader(msg))
+}
+
+// credImporter creates accounts for imported records.
+type credImporter struct {
+	ctx     *cli.Context
+	be      module.PlainUserDB
+	passTbl *pass_table.Auth
+	mbe     module.ManageableStorage
+	folders []specialFolder
+}
+
+// importRecord creates credentials and the storage account for the record.
+// Generated password is returned if it was generated.
+func (imp *credImporter) importRecord(rec credRecord) (string, error) {
+	if rec.Username == "" {
+		return "", errors.New("username is missing")
+	}
+
+	var generated string
+	switch {
+	case rec.Hash != "":
+		if imp.passTbl == nil {
+			return "", errors.New("password hashes can be imported only into auth.pass_table credentials DB")
+		}
+		if err := imp.passTbl.CreateUserWithHash(rec.Username, rec.Hash); err != nil {
+			return "", err
+		}
+	case rec.Password != "" || imp.ctx.Bool("random-password"):
+		pass := rec.Password
+		if pass == "" {
+			var err error
+			generated, err = generatePassword(imp.ctx.Int("password-length"))
+			if err != nil {
+				return "", err
+			}
+			pass = generated
+		}
+
+		var err error
+		if imp.passTbl != nil {
+			err = imp.passTbl.CreateUserHash(rec.Username, pass, imp.ctx.String("hash"), pass_table.HashOpts{
+				BcryptCost: imp.ctx.Int("bcrypt-cost"),
+			})
+		} else {
+			err = imp.be.CreateUser(rec.Username, pass)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if rec.IMAPAccount && imp.mbe != nil {
+		if err := createIMAPAcct(imp.mbe, rec.Username, imp.folders); err != nil {
+			return generated, fmt.Errorf("storage account: %w", err)
+		}
+	}
+	return generated, nil
+}
+
+func usersImport(be module.PlainUserDB, storage module.Storage, ctx *cli.Context) error {
+	path := ctx.Args().First()
+	if path == "" {
+		return cli.Exit("Error: FILE is required", 2)
+	}
+	format, err := recordsFormat(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	imp := credImporter{
+		ctx:     ctx,
+		be:      be,
+		folders: specialFolders(ctx),
+	}
+	if passTbl, ok := be.(*pass_table.Auth); ok {
+		imp.passTbl = passTbl
+	} else if ctx.IsSet("hash") || ctx.IsSet("bcrypt-cost") {
+		return cli.Exit("Error: --hash cannot be used with non-pass_table credentials DB", 2)
+	}
+	if storage != nil {
+		mbe, ok := storage.(module.ManageableStorage)
+		if !ok {
+			return cli.Exit("Error: storage backend does not support accounts management using maddy command", 2)
+		}
+		imp.mbe = mbe
+	}
+
+	notice, err := newPasswordNotice(ctx)
+	if err != nil {
+		return err
+	}
+
+	in := io.Reader(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	records, err := readCredRecords(in, format)
+	if err != nil {
+		return fmt.Errorf("Error: failed to read %s: %w", path, err)
+	}
+
+	// Generated passwords that were not sent by email are printed so they
+	// are not lost.
+	var (
+		unsent []credRecord
+		failed int
+	)
+	for _, rec := range records {
+		if rec.IMAPAccount && imp.mbe == nil {
+			fmt.Fprintf(os.Stderr, "%s: --storage-block is not set, not creating storage account\n", rec.Username)
+		}
+
+		pass, err := imp.importRecord(rec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", rec.Username, err)
+			failed++
+		}
+		if pass == "" {
+			continue
+		}
+
+		if notice == nil || rec.Email == "" {
+			unsent = append(unsent, credRecord{Username: rec.Username, Password: pass})
+			continue
+		}
+		err = notice.send(passwordNoticeData{
+			Username: rec.Username,
+			Password: pass,
+			Email:    rec.Email,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: failed to send password to %s: %v\n", rec.Username, rec.Email, err)
+			unsent = append(unsent, credRecord{Username: rec.Username, Password: pass})
+		}
+	}
+	if len(unsent) != 0 {
+		if err := writeCredRecords(os.Stdout, formatCSV, unsent); err != nil {
+			return err
+		}
+	}
+
+	if failed != 0 {
+		return cli.Exit(fmt.Sprintf("Error: failed to import %d of %d records", failed, len(records)), 1)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestCredRecords_Roundtrip(t *testing.T) {
+	records := []credRecord{
+		{Username: "a@example.org", Hash: "bcrypt:$2a$10$xxx", IMAPAccount: true},
+		{Username: "b@example.org", Password: "pass,with\"quotes"},
+		{Username: "c@example.org", Email: "c@example.com"},
+	}
+
+	for _, format := range []string{formatJSON, formatCSV} {
+		var buf bytes.Buffer
+		if err := writeCredRecords(&buf, format, records); err != nil {
+			t.Fatal(err)
+		}
+		read, err := readCredRecords(&buf, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(read, records) {
+			t.Errorf("%s: wrong records after roundtrip: %+v", format, read)
+		}
+	}
+}
+
+func TestReadCredRecords_CSV(t *testing.T) {
+	read, err := readCredRecords(strings.NewReader("email,username,imap_account\nb@example.com,a@example.org,yes\n"), formatCSV)
+	if err == nil {
+		t.Fatal("Expected an error for invalid imap_account")
+	}
+
+	read, err = readCredRecords(strings.NewReader("email,username,imap_account\nb@example.com,a@example.org,1\n,c@example.org\n"), formatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []credRecord{
+		{Username: "a@example.org", Email: "b@example.com", IMAPAccount: true},
+		{Username: "c@example.org"},
+	}
+	if !reflect.DeepEqual(read, expected) {
+		t.Errorf("Wrong records: %+v", read)
+	}
+
+	if _, err := readCredRecords(strings.NewReader("username,passwd\na,b\n"), formatCSV); err == nil {
+		t.Error("Expected an error for unknown column")
+	}
+}
+
+func TestGeneratePassword(t *testing.T) {
+	pass, err := generatePassword(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pass) != 20 {
+		t.Errorf("Wrong length: %d", len(pass))
+	}
+	for _, ch := range pass {
+		if !strings.ContainsRune(passwordAlphabet, ch) {
+			t.Errorf("Unexpected character: %c", ch)
+		}
+	}
+}
+
+func TestPasswordNotice_Message(t *testing.T) {
+	n := passwordNotice{
+		tmpl: template.Must(template.New("notice").Parse(
+			`{{define "subject"}}Welcome, {{.Username}}{{end}}Your password is {{.Password}}
+`)),
+		from: "postmaster@example.org",
+	}
+	msg, err := n.message(passwordNoticeData{
+		Username: "user@example.org",
+		Password: "secret",
+		Email:    "user@example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"From: postmaster@example.org\r\n",
+		"To: user@example.com\r\n",
+		"Subject: Welcome, user@example.org\r\n",
+		"\r\n\r\nYour password is secret\r\n",
+	} {
+		if !bytes.Contains(msg, []byte(line)) {
+			t.Errorf("Message does not contain %q:\n%s", line, msg)
+		}
+	}
+}
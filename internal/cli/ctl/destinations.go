@@ -0,0 +1,119 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/deststats"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "destinations",
+			Usage: "Show delivery statistics for remote destinations",
+			Description: `Query the running server for delivery latency and failures
+per destination domain as recorded by target.remote modules.
+
+Statistics are collected since the last periodic report (see
+destination_report_interval) or the server start.
+`,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "sort",
+					Usage: "Sort order: 'latency' (90th percentile) or 'failures'",
+					Value: "latency",
+				},
+				&cli.IntFlag{
+					Name:  "limit",
+					Usage: "Show only top N domains for each module, 0 to show all",
+					Value: 20,
+				},
+				&cli.StringFlag{
+					Name:  "module",
+					Usage: "Show statistics only for the specified target.remote configuration block",
+				},
+			},
+			Action: destinations,
+		})
+}
+
+func destinations(ctx *cli.Context) error {
+	sortBy := ctx.String("sort")
+	if sortBy != "latency" && sortBy != "failures" {
+		return cli.Exit("Error: --sort should be 'latency' or 'failures'", 2)
+	}
+	limit := ctx.Int("limit")
+
+	if _, _, err := readCfgGlobals(ctx); err != nil {
+		return err
+	}
+
+	var reports []deststats.Report
+	if err := callControl("deststats.report", nil, &reports); err != nil {
+		return err
+	}
+
+	shown := 0
+	for _, r := range reports {
+		if mod := ctx.String("module"); mod != "" && r.Module != mod {
+			continue
+		}
+
+		n := len(r.Domains)
+		if limit > 0 && limit < n {
+			n = limit
+		}
+		var domains []deststats.Domain
+		if sortBy == "failures" {
+			domains = deststats.MostFailing(r.Domains, n)
+		} else {
+			domains = deststats.Slowest(r.Domains, n)
+		}
+		if len(domains) == 0 {
+			continue
+		}
+
+		if shown != 0 {
+			fmt.Println()
+		}
+		shown++
+		fmt.Printf("%s (since %s):\n", r.Module, r.Since.Format(time.RFC3339))
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "DOMAIN\tATTEMPTS\tTEMP FAIL\tPERM FAIL\tP50\tP90\tP99")
+		for _, d := range domains {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%v\t%v\t%v\n", d.Domain, d.Attempts, d.TempFailures, d.PermFailures,
+				d.P50.Round(time.Millisecond), d.P90.Round(time.Millisecond), d.P99.Round(time.Millisecond))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if shown == 0 && !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "No deliveries recorded.")
+	}
+	return nil
+}
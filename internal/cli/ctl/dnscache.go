@@ -0,0 +1,97 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+
+	"github.com/foxcpp/maddy/framework/dns"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/dnscache"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "dns-cache",
+			Usage: "DNS cache management",
+			Description: `The running server caches DNS responses used for outbound delivery
+(MX, A/AAAA and TLSA records) for the duration of their TTL, see the
+dns_cache global directive.
+
+` + controlSocketNote,
+			Subcommands: []*cli.Command{
+				{
+					Name:   "stats",
+					Usage:  "Show cache statistics",
+					Action: dnsCacheStats,
+				},
+				{
+					Name:  "purge",
+					Usage: "Remove cached responses",
+					Description: `Remove cached responses for the domain and its subdomains, e.g. after
+the DNS records of the destination were fixed. If the domain is not
+specified, the whole cache is purged.
+`,
+					ArgsUsage: "[DOMAIN]",
+					Action:    dnsCachePurge,
+				},
+			},
+		})
+}
+
+func dnsCacheStats(ctx *cli.Context) error {
+	if _, _, err := readCfgGlobals(ctx); err != nil {
+		return err
+	}
+
+	var stats dns.CacheStats
+	if err := callControl("dns_cache.stats", nil, &stats); err != nil {
+		return err
+	}
+
+	ratio := "n/a"
+	if total := stats.Hits + stats.Misses; total != 0 {
+		ratio = fmt.Sprintf("%.1f%%", float64(stats.Hits)*100/float64(total))
+	}
+	fmt.Println("Entries:", stats.Entries)
+	fmt.Println("Hits:", stats.Hits)
+	fmt.Println("Misses:", stats.Misses)
+	fmt.Println("Hit ratio:", ratio)
+	return nil
+}
+
+func dnsCachePurge(ctx *cli.Context) error {
+	if ctx.NArg() > 1 {
+		return cli.Exit("Error: too many arguments", 2)
+	}
+	if _, _, err := readCfgGlobals(ctx); err != nil {
+		return err
+	}
+
+	var res dnscache.PurgeResult
+	if err := callControl("dns_cache.purge", map[string]string{"domain": ctx.Args().First()}, &res); err != nil {
+		return err
+	}
+	if !ctx.Bool("quiet") {
+		fmt.Printf("Removed %d entries.\n", res.Removed)
+	}
+	return nil
+}
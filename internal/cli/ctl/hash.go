@@ -24,6 +24,7 @@ import (
 	"strings"
 
 	"github.com/foxcpp/maddy/internal/auth/pass_table"
+	"github.com/foxcpp/maddy/internal/auth/scram"
 	maddycli "github.com/foxcpp/maddy/internal/cli"
 	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
 	"github.com/urfave/cli/v2"
@@ -67,6 +68,11 @@ func init() {
 					Usage: "Threads to use for Argon2id",
 					Value: 1,
 				},
+				&cli.IntFlag{
+					Name:  "scram-iterations",
+					Usage: "Iteration count for SCRAM credentials",
+					Value: scram.MinIterations,
+				},
 			},
 		})
 }
@@ -111,6 +117,12 @@ func hashCommand(ctx *cli.Context) error {
 	if ctx.IsSet("argon2-threads") {
 		opts.Argon2Threads = uint8(ctx.Int("argon2-threads"))
 	}
+	if ctx.IsSet("scram-iterations") {
+		if ctx.Int("scram-iterations") < scram.MinIterations {
+			return cli.Exit(fmt.Sprintf("Error: SCRAM iteration count should be at least %d", scram.MinIterations), 2)
+		}
+		opts.SCRAMIterations = ctx.Int("scram-iterations")
+	}
 
 	var pass string
 	if ctx.IsSet("password") {
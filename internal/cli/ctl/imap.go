@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
 	imapsql "github.com/foxcpp/go-imap-sql"
 	"github.com/foxcpp/maddy/framework/module"
 	maddycli "github.com/foxcpp/maddy/internal/cli"
@@ -181,11 +182,12 @@ func init() {
 				},
 			},
 			{
-				Name:        "add-flags",
-				Usage:       "Add flags to messages",
-				ArgsUsage:   "USERNAME MAILBOX SEQ FLAGS...",
-				Description: "Add flags to all messages matched by SEQ.",
-				Flags: []cli.Flag{
+				Name:      "add-flags",
+				Usage:     "Add flags to messages",
+				ArgsUsage: "USERNAME MAILBOX SEQ FLAGS...",
+				Description: "Add flags to all messages matched by SEQ. Use 1:* as SEQ to match all messages\n" +
+					"and narrow down the set using search flags (--before, --since, --header, etc).",
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:    "cfg-block",
 						Usage:   "Module configuration block to use",
@@ -197,7 +199,7 @@ func init() {
 						Aliases: []string{"u"},
 						Usage:   "Use UIDs for SEQSET instead of sequence numbers",
 					},
-				},
+				}, msgSearchFlags()...),
 				Action: func(ctx *cli.Context) error {
 					be, err := openStorage(ctx)
 					if err != nil {
@@ -208,11 +210,12 @@ func init() {
 				},
 			},
 			{
-				Name:        "rem-flags",
-				Usage:       "Remove flags from messages",
-				ArgsUsage:   "USERNAME MAILBOX SEQ FLAGS...",
-				Description: "Remove flags from all messages matched by SEQ.",
-				Flags: []cli.Flag{
+				Name:      "rem-flags",
+				Usage:     "Remove flags from messages",
+				ArgsUsage: "USERNAME MAILBOX SEQ FLAGS...",
+				Description: "Remove flags from all messages matched by SEQ. Use 1:* as SEQ to match all messages\n" +
+					"and narrow down the set using search flags (--before, --since, --header, etc).",
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:    "cfg-block",
 						Usage:   "Module configuration block to use",
@@ -224,7 +227,7 @@ func init() {
 						Aliases: []string{"u"},
 						Usage:   "Use UIDs for SEQSET instead of sequence numbers",
 					},
-				},
+				}, msgSearchFlags()...),
 				Action: func(ctx *cli.Context) error {
 					be, err := openStorage(ctx)
 					if err != nil {
@@ -235,11 +238,12 @@ func init() {
 				},
 			},
 			{
-				Name:        "set-flags",
-				Usage:       "Set flags on messages",
-				ArgsUsage:   "USERNAME MAILBOX SEQ FLAGS...",
-				Description: "Set flags on all messages matched by SEQ.",
-				Flags: []cli.Flag{
+				Name:      "set-flags",
+				Usage:     "Set flags on messages",
+				ArgsUsage: "USERNAME MAILBOX SEQ FLAGS...",
+				Description: "Set flags on all messages matched by SEQ. Use 1:* as SEQ to match all messages\n" +
+					"and narrow down the set using search flags (--before, --since, --header, etc).",
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:    "cfg-block",
 						Usage:   "Module configuration block to use",
@@ -251,7 +255,7 @@ func init() {
 						Aliases: []string{"u"},
 						Usage:   "Use UIDs for SEQSET instead of sequence numbers",
 					},
-				},
+				}, msgSearchFlags()...),
 				Action: func(ctx *cli.Context) error {
 					be, err := openStorage(ctx)
 					if err != nil {
@@ -262,10 +266,11 @@ func init() {
 				},
 			},
 			{
-				Name:      "remove",
-				Usage:     "Remove messages from mailbox",
-				ArgsUsage: "USERNAME MAILBOX SEQSET",
-				Flags: []cli.Flag{
+				Name:        "remove",
+				Usage:       "Remove messages from mailbox",
+				Description: "SEQSET can be omitted if search flags (--before, --since, --header, etc) are used.\n\nExample: remove all messages older than 2019 from Archive:\n  maddy imap-msgs remove --before 2019-01-01 foxcpp@example.org Archive",
+				ArgsUsage:   "USERNAME MAILBOX [SEQSET]",
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:    "cfg-block",
 						Usage:   "Module configuration block to use",
@@ -282,7 +287,7 @@ func init() {
 						Aliases: []string{"y"},
 						Usage:   "Don't ask for confirmation",
 					},
-				},
+				}, msgSearchFlags()...),
 				Action: func(ctx *cli.Context) error {
 					be, err := openStorage(ctx)
 					if err != nil {
@@ -293,11 +298,12 @@ func init() {
 				},
 			},
 			{
-				Name:        "copy",
-				Usage:       "Copy messages between mailboxes",
-				Description: "Note: You can't copy between mailboxes of different users. APPENDLIMIT of target mailbox is not enforced.",
-				ArgsUsage:   "USERNAME SRCMAILBOX SEQSET TGTMAILBOX",
-				Flags: []cli.Flag{
+				Name:  "copy",
+				Usage: "Copy messages between mailboxes",
+				Description: "Note: You can't copy between mailboxes of different users. APPENDLIMIT of target mailbox is not enforced.\n" +
+					"Search flags (--before, --since, --header, etc) can be used to copy only some of messages matched by SEQSET.",
+				ArgsUsage: "USERNAME SRCMAILBOX SEQSET TGTMAILBOX",
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:    "cfg-block",
 						Usage:   "Module configuration block to use",
@@ -309,7 +315,7 @@ func init() {
 						Aliases: []string{"u"},
 						Usage:   "Use UIDs for SEQSET instead of sequence numbers",
 					},
-				},
+				}, msgSearchFlags()...),
 				Action: func(ctx *cli.Context) error {
 					be, err := openStorage(ctx)
 					if err != nil {
@@ -320,11 +326,12 @@ func init() {
 				},
 			},
 			{
-				Name:        "move",
-				Usage:       "Move messages between mailboxes",
-				Description: "Note: You can't move between mailboxes of different users. APPENDLIMIT of target mailbox is not enforced.",
-				ArgsUsage:   "USERNAME SRCMAILBOX SEQSET TGTMAILBOX",
-				Flags: []cli.Flag{
+				Name:  "move",
+				Usage: "Move messages between mailboxes",
+				Description: "Note: You can't move between mailboxes of different users. APPENDLIMIT of target mailbox is not enforced.\n" +
+					"Search flags (--before, --since, --header, etc) can be used to move only some of messages matched by SEQSET.",
+				ArgsUsage: "USERNAME SRCMAILBOX SEQSET TGTMAILBOX",
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:    "cfg-block",
 						Usage:   "Module configuration block to use",
@@ -336,7 +343,7 @@ func init() {
 						Aliases: []string{"u"},
 						Usage:   "Use UIDs for SEQSET instead of sequence numbers",
 					},
-				},
+				}, msgSearchFlags()...),
 				Action: func(ctx *cli.Context) error {
 					be, err := openStorage(ctx)
 					if err != nil {
@@ -349,9 +356,9 @@ func init() {
 			{
 				Name:        "list",
 				Usage:       "List messages in mailbox",
-				Description: "If SEQSET is specified - only show messages that match it.",
+				Description: "If SEQSET or search flags (--before, --since, --header, etc) are specified - only show messages that match them.",
 				ArgsUsage:   "USERNAME MAILBOX [SEQSET]",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:    "cfg-block",
 						Usage:   "Module configuration block to use",
@@ -368,7 +375,7 @@ func init() {
 						Aliases: []string{"f"},
 						Usage:   "Show entire envelope and all server meta-data",
 					},
-				},
+				}, msgSearchFlags()...),
 				Action: func(ctx *cli.Context) error {
 					be, err := openStorage(ctx)
 					if err != nil {
@@ -378,12 +385,53 @@ func init() {
 					return msgsList(be, ctx)
 				},
 			},
+			{
+				Name:  "export",
+				Usage: "Export messages to mbox or EML files",
+				Description: "Exports messages matched by SEQSET and search flags (--before, --since, --header, etc).\n" +
+					"All messages are exported if neither is specified.\n\n" +
+					"With mbox format (mboxrd variant), messages are written to stdout or to the file specified\n" +
+					"using --output. With eml format, each message is written to a separate UID.eml file\n" +
+					"in the directory specified using --output.",
+				ArgsUsage: "USERNAME MAILBOX [SEQSET]",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "cfg-block",
+						Usage:   "Module configuration block to use",
+						EnvVars: []string{"MADDY_CFGBLOCK"},
+						Value:   "local_mailboxes",
+					},
+					&cli.BoolFlag{
+						Name:    "uid",
+						Aliases: []string{"u"},
+						Usage:   "Use UIDs for SEQSET instead of sequence numbers",
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "Output format, mbox or eml",
+						Value: "mbox",
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Output file (mbox) or directory (eml)",
+					},
+				}, msgSearchFlags()...),
+				Action: func(ctx *cli.Context) error {
+					be, err := openStorage(ctx)
+					if err != nil {
+						return err
+					}
+					defer closeIfNeeded(be)
+					return msgsExport(be, ctx)
+				},
+			},
 			{
 				Name:        "dump",
 				Usage:       "Dump message body",
 				Description: "If passed SEQ matches multiple messages - they will be joined.",
 				ArgsUsage:   "USERNAME MAILBOX SEQ",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:    "cfg-block",
 						Usage:   "Module configuration block to use",
@@ -395,7 +443,7 @@ func init() {
 						Aliases: []string{"u"},
 						Usage:   "Use UIDs for SEQ instead of sequence numbers",
 					},
-				},
+				}, msgSearchFlags()...),
 				Action: func(ctx *cli.Context) error {
 					be, err := openStorage(ctx)
 					if err != nil {
@@ -596,37 +644,56 @@ func msgsRemove(be module.Storage, ctx *cli.Context) error {
 		return cli.Exit("Error: MAILBOX is required", 2)
 	}
 	seqset := ctx.Args().Get(2)
-	if seqset == "" {
+	if seqset == "" && !hasSearchCriteria(ctx) {
 		return cli.Exit("Error: SEQSET is required", 2)
 	}
 
-	if !ctx.Bool("uid") {
-		fmt.Fprintln(os.Stderr, "WARNING: --uid=true will be the default in 0.7")
+	uid := ctx.Bool("uid")
+	var seq *imap.SeqSet
+	if seqset != "" {
+		if !uid {
+			fmt.Fprintln(os.Stderr, "WARNING: --uid=true will be the default in 0.7")
+		}
+
+		var err error
+		seq, err = imap.ParseSeqSet(seqset)
+		if err != nil {
+			return err
+		}
 	}
 
-	seq, err := imap.ParseSeqSet(seqset)
+	u, err := be.GetIMAPAcct(username)
 	if err != nil {
 		return err
 	}
 
-	u, err := be.GetIMAPAcct(username)
+	_, mbox, err := u.GetMailbox(name, true, nil)
 	if err != nil {
 		return err
 	}
 
-	_, mbox, err := u.GetMailbox(name, true, nil)
+	uid, seq, err = selectMessages(ctx, mbox, uid, seq)
 	if err != nil {
 		return err
 	}
+	if seq == nil {
+		if !ctx.Bool("quiet") {
+			fmt.Fprintln(os.Stderr, "No messages matched.")
+		}
+		return nil
+	}
 
 	if !ctx.Bool("yes") {
+		if hasSearchCriteria(ctx) {
+			fmt.Fprintf(os.Stderr, "%d messages matched.\n", seqSetLen(seq))
+		}
 		if !clitools2.Confirmation("Are you sure you want to delete these messages?", false) {
 			return errors.New("Cancelled")
 		}
 	}
 
 	mboxB := mbox.(*imapsql.Mailbox)
-	return mboxB.DelMessages(ctx.Bool("uid"), seq)
+	return mboxB.DelMessages(uid, seq)
 }
 
 func msgsCopy(be module.Storage, ctx *cli.Context) error {
@@ -666,7 +733,18 @@ func msgsCopy(be module.Storage, ctx *cli.Context) error {
 		return err
 	}
 
-	return srcMbox.CopyMessages(ctx.Bool("uid"), seq, tgtName)
+	uid, seq, err := selectMessages(ctx, srcMbox, ctx.Bool("uid"), seq)
+	if err != nil {
+		return err
+	}
+	if seq == nil {
+		if !ctx.Bool("quiet") {
+			fmt.Fprintln(os.Stderr, "No messages matched.")
+		}
+		return nil
+	}
+
+	return srcMbox.CopyMessages(uid, seq, tgtName)
 }
 
 func msgsMove(be module.Storage, ctx *cli.Context) error {
@@ -706,9 +784,25 @@ func msgsMove(be module.Storage, ctx *cli.Context) error {
 		return err
 	}
 
-	moveMbox := srcMbox.(*imapsql.Mailbox)
+	// Use the same primitive as the IMAP MOVE command so messages are moved
+	// atomically instead of being copied and expunged.
+	moveMbox, ok := srcMbox.(imapbackend.MoveMailbox)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support moving messages", 2)
+	}
 
-	return moveMbox.MoveMessages(ctx.Bool("uid"), seq, tgtName)
+	uid, seq, err := selectMessages(ctx, srcMbox, ctx.Bool("uid"), seq)
+	if err != nil {
+		return err
+	}
+	if seq == nil {
+		if !ctx.Bool("quiet") {
+			fmt.Fprintln(os.Stderr, "No messages matched.")
+		}
+		return nil
+	}
+
+	return moveMbox.MoveMessages(uid, seq, tgtName)
 }
 
 func msgsList(be module.Storage, ctx *cli.Context) error {
@@ -744,6 +838,14 @@ func msgsList(be module.Storage, ctx *cli.Context) error {
 		return err
 	}
 
+	uid, seq, err = selectMessages(ctx, mbox, uid, seq)
+	if err != nil {
+		return err
+	}
+	if seq == nil {
+		return nil
+	}
+
 	ch := make(chan *imap.Message, 10)
 	go func() {
 		err = mbox.ListMessages(uid, seq, []imap.FetchItem{imap.FetchEnvelope, imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchFlags, imap.FetchUid}, ch)
@@ -824,6 +926,14 @@ func msgsDump(be module.Storage, ctx *cli.Context) error {
 		return err
 	}
 
+	uid, seq, err = selectMessages(ctx, mbox, uid, seq)
+	if err != nil {
+		return err
+	}
+	if seq == nil {
+		return nil
+	}
+
 	ch := make(chan *imap.Message, 10)
 	go func() {
 		err = mbox.ListMessages(uid, seq, []imap.FetchItem{imap.FetchRFC822}, ch)
@@ -877,6 +987,17 @@ func msgsFlags(be module.Storage, ctx *cli.Context) error {
 		return cli.Exit("Error: at least once FLAG is required", 2)
 	}
 
+	uid, seq, err := selectMessages(ctx, mbox, ctx.Bool("uid"), seq)
+	if err != nil {
+		return err
+	}
+	if seq == nil {
+		if !ctx.Bool("quiet") {
+			fmt.Fprintln(os.Stderr, "No messages matched.")
+		}
+		return nil
+	}
+
 	var op imap.FlagsOp
 	switch ctx.Command.Name {
 	case "add-flags":
@@ -889,5 +1010,5 @@ func msgsFlags(be module.Storage, ctx *cli.Context) error {
 		panic("unknown command: " + ctx.Command.Name)
 	}
 
-	return mbox.UpdateMessagesFlags(ctx.Bool("uid"), seq, op, true, flags)
+	return mbox.UpdateMessagesFlags(uid, seq, op, true, flags)
 }
@@ -22,9 +22,11 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/activity"
 	maddycli "github.com/foxcpp/maddy/internal/cli"
 	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
 	"github.com/urfave/cli/v2"
@@ -51,6 +53,10 @@ be created using 'creds' subcommand.
 				{
 					Name:  "list",
 					Usage: "List storage accounts",
+					Description: `With --verbose, the last successful login for each protocol
+is shown as recorded by the server (see activity_tracking directive). Logins
+are saved periodically so the most recent ones may be missing.
+`,
 					Flags: []cli.Flag{
 						&cli.StringFlag{
 							Name:    "cfg-block",
@@ -58,6 +64,15 @@ be created using 'creds' subcommand.
 							EnvVars: []string{"MADDY_CFGBLOCK"},
 							Value:   "local_mailboxes",
 						},
+						&cli.BoolFlag{
+							Name:    "verbose",
+							Aliases: []string{"v"},
+							Usage:   "Show last login time, client IP and protocol",
+						},
+						&cli.DurationFlag{
+							Name:  "inactive",
+							Usage: "List only accounts that did not log in for the specified time (e.g. 2160h)",
+						},
 					},
 					Action: func(ctx *cli.Context) error {
 						be, err := openStorage(ctx)
@@ -74,44 +89,14 @@ be created using 'creds' subcommand.
 					Description: `In addition to account creation, this command
 creates a set of default folder (mailboxes) with special-use attribute set.`,
 					ArgsUsage: "USERNAME",
-					Flags: []cli.Flag{
+					Flags: append([]cli.Flag{
 						&cli.StringFlag{
 							Name:    "cfg-block",
 							Usage:   "Module configuration block to use",
 							EnvVars: []string{"MADDY_CFGBLOCK"},
 							Value:   "local_mailboxes",
 						},
-						&cli.BoolFlag{
-							Name:  "no-specialuse",
-							Usage: "Do not create special-use folders",
-							Value: false,
-						},
-						&cli.StringFlag{
-							Name:  "sent-name",
-							Usage: "Name of special mailbox for sent messages, use empty string to not create any",
-							Value: "Sent",
-						},
-						&cli.StringFlag{
-							Name:  "trash-name",
-							Usage: "Name of special mailbox for trash, use empty string to not create any",
-							Value: "Trash",
-						},
-						&cli.StringFlag{
-							Name:  "junk-name",
-							Usage: "Name of special mailbox for 'junk' (spam), use empty string to not create any",
-							Value: "Junk",
-						},
-						&cli.StringFlag{
-							Name:  "drafts-name",
-							Usage: "Name of special mailbox for drafts, use empty string to not create any",
-							Value: "Drafts",
-						},
-						&cli.StringFlag{
-							Name:  "archive-name",
-							Usage: "Name of special mailbox for archive, use empty string to not create any",
-							Value: "Archive",
-						},
-					},
+					}, specialUseFlags()...),
 					Action: func(ctx *cli.Context) error {
 						be, err := openStorage(ctx)
 						if err != nil {
@@ -150,6 +135,45 @@ or other buffering takes effect.`,
 						return imapAcctRemove(be, ctx)
 					},
 				},
+				{
+					Name:  "rename",
+					Usage: "Rename IMAP storage account",
+					Description: `Renames the storage account keeping all mailboxes and messages.
+
+Credentials, aliases (both alias named after the account and alias targets) and
+account status are renamed too. Corresponding configuration blocks are
+specified using --auth-block, --aliases-block and --status-block flags, blocks
+with default names are skipped if they do not exist in the configuration,
+empty value can be used to skip the block explicitly.
+
+If any step fails, changes made so far are reverted.
+`,
+					ArgsUsage: "OLD NEW",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.StringFlag{
+							Name:  "auth-block",
+							Usage: "Module configuration block with credentials",
+							Value: "local_authdb",
+						},
+						&cli.StringFlag{
+							Name:  "aliases-block",
+							Usage: "Module configuration block with aliases",
+							Value: "local_aliases",
+						},
+						&cli.StringFlag{
+							Name:  "status-block",
+							Usage: "Module configuration block with account statuses",
+							Value: "local_account_status",
+						},
+					},
+					Action: imapAcctRename,
+				},
 				{
 					Name:  "appendlimit",
 					Usage: "Query or set accounts's APPENDLIMIT value",
@@ -186,6 +210,43 @@ APPENDLIMIT value (either global or per-account) cannot be larger than
 						return imapAcctAppendlimit(be, ctx)
 					},
 				},
+				{
+					Name:  "quota",
+					Usage: "Query or set account's storage quota",
+					Description: `Without flags, the current usage and the effective limits are printed.
+
+Storage limit is specified with a unit suffix (B, K, M, G), e.g. 1G.
+Zero means no limit, 'default' makes the account use the limit set in the
+server configuration.
+
+Messages exceeding the quota are rejected at delivery time and by IMAP APPEND.
+`,
+					ArgsUsage: "USERNAME",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.StringFlag{
+							Name:  "set",
+							Usage: "Set storage limit to the specified value",
+						},
+						&cli.StringFlag{
+							Name:  "messages",
+							Usage: "Set the limit of messages count to the specified value",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctQuota(be, ctx)
+					},
+				},
 			},
 		})
 }
@@ -205,16 +266,120 @@ func imapAcctList(be module.Storage, ctx *cli.Context) error {
 		return err
 	}
 
+	var logins activity.Logins
+	if ctx.Bool("verbose") || ctx.IsSet("inactive") {
+		logins, err = activity.Load()
+		if err != nil {
+			return fmt.Errorf("failed to read login activity: %w", err)
+		}
+	}
+	if ctx.IsSet("inactive") {
+		since := time.Now().Add(-ctx.Duration("inactive"))
+		inactive := list[:0]
+		for _, user := range list {
+			if last, _ := logins.Last(activity.Normalize(user)); last.Time.Before(since) {
+				inactive = append(inactive, user)
+			}
+		}
+		list = inactive
+	}
+
 	if len(list) == 0 && !ctx.Bool("quiet") {
 		fmt.Fprintln(os.Stderr, "No users.")
 	}
 
 	for _, user := range list {
 		fmt.Println(user)
+		if !ctx.Bool("verbose") {
+			continue
+		}
+
+		account := activity.Normalize(user)
+		protos := logins.Protocols(account)
+		if len(protos) == 0 {
+			fmt.Println("\tnever logged in")
+			continue
+		}
+		for _, proto := range protos {
+			login := logins[account][proto]
+			fmt.Printf("\t%s: %s from %s\n", proto, login.Time.Local().Format(time.RFC3339), login.IP)
+		}
 	}
 	return nil
 }
 
+// specialUseFlags returns flags controlling special-use folders created for
+// new accounts.
+func specialUseFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "no-specialuse",
+			Usage: "Do not create special-use folders",
+			Value: false,
+		},
+		&cli.StringFlag{
+			Name:  "sent-name",
+			Usage: "Name of special mailbox for sent messages, use empty string to not create any",
+			Value: "Sent",
+		},
+		&cli.StringFlag{
+			Name:  "trash-name",
+			Usage: "Name of special mailbox for trash, use empty string to not create any",
+			Value: "Trash",
+		},
+		&cli.StringFlag{
+			Name:  "junk-name",
+			Usage: "Name of special mailbox for 'junk' (spam), use empty string to not create any",
+			Value: "Junk",
+		},
+		&cli.StringFlag{
+			Name:  "drafts-name",
+			Usage: "Name of special mailbox for drafts, use empty string to not create any",
+			Value: "Drafts",
+		},
+		&cli.StringFlag{
+			Name:  "archive-name",
+			Usage: "Name of special mailbox for archive, use empty string to not create any",
+			Value: "Archive",
+		},
+	}
+}
+
+type specialFolder struct {
+	Name string
+	Attr string
+
+	// Explicit is set if the name was specified on the command line and the
+	// folder should be created even if the account template defines its own
+	// folders.
+	Explicit bool
+}
+
+// specialFolders returns the list of special-use folders to create as
+// configured by specialUseFlags.
+func specialFolders(ctx *cli.Context) []specialFolder {
+	if ctx.Bool("no-specialuse") {
+		return nil
+	}
+
+	var folders []specialFolder
+	for _, f := range []struct {
+		flag string
+		attr string
+	}{
+		{"sent-name", imap.SentAttr},
+		{"trash-name", imap.TrashAttr},
+		{"junk-name", imap.JunkAttr},
+		{"drafts-name", imap.DraftsAttr},
+		{"archive-name", imap.ArchiveAttr},
+	} {
+		if name := ctx.String(f.flag); name != "" {
+			folders = append(folders, specialFolder{Name: name, Attr: f.attr, Explicit: ctx.IsSet(f.flag)})
+		}
+	}
+	return folders
+}
+
 func imapAcctCreate(be module.Storage, ctx *cli.Context) error {
 	mbe, ok := be.(module.ManageableStorage)
 	if !ok {
@@ -226,10 +391,29 @@ func imapAcctCreate(be module.Storage, ctx *cli.Context) error {
 		return cli.Exit("Error: USERNAME is required", 2)
 	}
 
+	return createIMAPAcct(mbe, username, specialFolders(ctx))
+}
+
+// createIMAPAcct creates the storage account and the special-use folders.
+// Failures to create folders are reported but not returned.
+//
+// If the account template configured for the storage creates folders, only
+// folders explicitly specified on the command line are created.
+func createIMAPAcct(mbe module.ManageableStorage, username string, folders []specialFolder) error {
 	if err := mbe.CreateIMAPAcct(username); err != nil {
 		return err
 	}
 
+	if prov, ok := mbe.(module.AccountProvisioner); ok && prov.TemplateCreatesFolders(username) {
+		explicit := folders[:0:0]
+		for _, f := range folders {
+			if f.Explicit {
+				explicit = append(explicit, f)
+			}
+		}
+		folders = explicit
+	}
+
 	act, err := mbe.GetIMAPAcct(username)
 	if err != nil {
 		return fmt.Errorf("failed to get user: %w", err)
@@ -240,40 +424,15 @@ func imapAcctCreate(be module.Storage, ctx *cli.Context) error {
 		fmt.Fprintf(os.Stderr, "Note: Storage backend does not support SPECIAL-USE IMAP extension")
 	}
 
-	if ctx.Bool("no-specialuse") {
-		return nil
-	}
-
-	createMbox := func(name, specialUseAttr string) error {
+	for _, f := range folders {
+		var err error
 		if suu == nil {
-			return act.CreateMailbox(name)
+			err = act.CreateMailbox(f.Name)
+		} else {
+			err = suu.CreateMailboxSpecial(f.Name, f.Attr)
 		}
-		return suu.CreateMailboxSpecial(name, specialUseAttr)
-	}
-
-	if name := ctx.String("sent-name"); name != "" {
-		if err := createMbox(name, imap.SentAttr); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to create sent folder: %v", err)
-		}
-	}
-	if name := ctx.String("trash-name"); name != "" {
-		if err := createMbox(name, imap.TrashAttr); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to create trash folder: %v", err)
-		}
-	}
-	if name := ctx.String("junk-name"); name != "" {
-		if err := createMbox(name, imap.JunkAttr); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to create junk folder: %v", err)
-		}
-	}
-	if name := ctx.String("drafts-name"); name != "" {
-		if err := createMbox(name, imap.DraftsAttr); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to create drafts folder: %v", err)
-		}
-	}
-	if name := ctx.String("archive-name"); name != "" {
-		if err := createMbox(name, imap.ArchiveAttr); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to create archive folder: %v", err)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create %s folder: %v", f.Name, err)
 		}
 	}
 
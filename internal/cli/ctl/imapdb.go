@@ -0,0 +1,142 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"errors"
+	"fmt"
+
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "imap-db",
+			Usage: "Storage database maintenance",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "migrate",
+					Usage: "Upgrade the database schema",
+					Description: `Upgrade the storage database schema to the version used by this
+maddy version.
+
+By default, the schema is upgraded automatically on start-up. If
+auto_migrate is disabled in the storage configuration, the server refuses
+to start with an outdated schema and this command should be used instead.
+Stop the server before running it.
+
+The pre-upgrade hook (schema_upgrade_hook) is run before the upgrade,
+the upgrade is not done if it fails. Note that the upgrade can't be
+reverted, make sure to have a backup.
+
+With --dry-run, only the current and target versions are printed.`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "Do not change the database, only report what would be done",
+						},
+						&cli.IntFlag{
+							Name:  "to",
+							Usage: "Target schema version, only the latest version is supported",
+						},
+						&cli.BoolFlag{
+							Name:    "yes",
+							Aliases: []string{"y"},
+							Usage:   "Don't ask for confirmation",
+						},
+					},
+					Action: imapDBMigrate,
+				},
+			},
+		})
+}
+
+var errDryRun = errors.New("dry run")
+
+func imapDBMigrate(ctx *cli.Context) error {
+	// The storage is opened only once, the decision whether to upgrade is
+	// made by the callback invoked from the module initialization.
+	var (
+		from, to int
+		stopErr  error
+	)
+	imapsql.SchemaUpgradeFunc = func(current, latest int) error {
+		from, to = current, latest
+		if target := ctx.Int("to"); target != 0 && target != latest {
+			stopErr = cli.Exit(fmt.Sprintf("Error: only upgrade to version %d is supported by this maddy version", latest), 2)
+			return stopErr
+		}
+
+		fmt.Printf("Database schema will be upgraded from version %d to %d\n", current, latest)
+		if ctx.Bool("dry-run") {
+			stopErr = errDryRun
+			return stopErr
+		}
+
+		if !ctx.Bool("yes") {
+			if !clitools2.Confirmation("The upgrade can't be reverted, continue?", false) {
+				stopErr = cli.Exit("Cancelled", 2)
+				return stopErr
+			}
+		}
+		return nil
+	}
+
+	be, err := openStorage(ctx)
+	if stopErr != nil {
+		if stopErr == errDryRun {
+			return nil
+		}
+		return stopErr
+	}
+	if err != nil {
+		return exitError(err)
+	}
+	closeIfNeeded(be)
+
+	if from == 0 {
+		if target := ctx.Int("to"); target != 0 && target != imapsql.LatestSchemaVersion {
+			return cli.Exit(fmt.Sprintf("Error: schema is at version %d, downgrade is not supported", imapsql.LatestSchemaVersion), 2)
+		}
+		fmt.Printf("Database schema is up to date (version %d)\n", imapsql.LatestSchemaVersion)
+		return nil
+	}
+
+	fmt.Printf("Database schema upgraded to version %d\n", to)
+	return nil
+}
+
+// exitError makes sure the command exits with non-zero status on error.
+func exitError(err error) error {
+	var exitErr cli.ExitCoder
+	if errors.As(err, &exitErr) {
+		return err
+	}
+	return cli.Exit(err.Error(), 1)
+}
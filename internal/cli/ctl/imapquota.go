@@ -0,0 +1,97 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/urfave/cli/v2"
+)
+
+// parseQuotaLimit parses the limit value for SetQuotaLimit. "default" is
+// converted to -1.
+func parseQuotaLimit(val string, size bool) (int64, error) {
+	if val == "default" {
+		return -1, nil
+	}
+	if size {
+		limit, err := config.ParseDataSize(val)
+		return int64(limit), err
+	}
+	limit, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if limit < 0 {
+		return 0, fmt.Errorf("value must not be negative")
+	}
+	return limit, nil
+}
+
+func formatQuota(used, limit int64) string {
+	if limit == 0 {
+		return fmt.Sprintf("%d (no limit)", used)
+	}
+	return fmt.Sprintf("%d of %d (%d%%)", used, limit, used*100/limit)
+}
+
+func imapAcctQuota(be module.Storage, ctx *cli.Context) error {
+	qs, ok := be.(module.QuotaStorage)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support quotas", 2)
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+
+	if ctx.IsSet("set") {
+		limit, err := parseQuotaLimit(ctx.String("set"), true)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: invalid storage limit: %v", err), 2)
+		}
+		if err := qs.SetQuotaLimit(username, module.QuotaResourceStorage, limit); err != nil {
+			return err
+		}
+	}
+	if ctx.IsSet("messages") {
+		limit, err := parseQuotaLimit(ctx.String("messages"), false)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: invalid messages limit: %v", err), 2)
+		}
+		if err := qs.SetQuotaLimit(username, module.QuotaResourceMessages, limit); err != nil {
+			return err
+		}
+	}
+	if ctx.IsSet("set") || ctx.IsSet("messages") {
+		return nil
+	}
+
+	usage, err := qs.GetQuota(username)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Storage (bytes):", formatQuota(usage.StorageUsed, usage.StorageLimit))
+	fmt.Println("Messages:", formatQuota(usage.MessagesUsed, usage.MessagesLimit))
+	return nil
+}
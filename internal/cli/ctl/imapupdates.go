@@ -0,0 +1,93 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	mess "github.com/foxcpp/go-imap-mess"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/updatepipe"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "imap-updates",
+			Usage: "Follow mailbox updates made by the running server",
+			Description: `Print mailbox updates (new messages, flag changes, expunges) passing
+through the update pipe of the running server as JSON objects, one per line.
+
+Updates made by other maddy commands are printed too. The command runs until
+interrupted and reconnects if the server is restarted.
+
+Only storage.imapsql with sqlite3 driver is supported.
+`,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "cfg-block",
+					Usage:   "Module configuration block to use",
+					EnvVars: []string{"MADDY_CFGBLOCK"},
+					Value:   "local_mailboxes",
+				},
+			},
+			Action: imapUpdates,
+		})
+}
+
+func imapUpdates(ctx *cli.Context) error {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return err
+	}
+	sub, ok := mod.Instance.(updatepipe.Subscriber)
+	if !ok {
+		return cli.Exit(fmt.Sprintf("Error: configuration block %s does not support updates subscription", ctx.String("cfg-block")), 2)
+	}
+	if err := initCfgBlock(globals, mod); err != nil {
+		return fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	upds := make(chan mess.Update, 32)
+	closer, err := sub.SubscribeUpdates(upds)
+	if err != nil {
+		return fmt.Errorf("Error: %w", err)
+	}
+	defer closer.Close()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		select {
+		case upd := <-upds:
+			if err := enc.Encode(upd); err != nil {
+				return err
+			}
+		case <-sig:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/endpoint/system_mail"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:      "inject",
+			Usage:     "Deliver the message using the running server",
+			ArgsUsage: "RCPT...",
+			Description: `Reads the message from the standard input (or the file specified using --file)
+and asks the running server to deliver it to the specified recipients as is.
+
+The message is delivered using the deliver_to target of the system_mail
+module so it should be configured. Use --trace to enable debug logging for
+this message only and inspect the log afterwards using 'maddy msg-trace show'.
+`,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "from",
+					Usage: "Envelope sender address, empty by default",
+				},
+				&cli.PathFlag{
+					Name:    "file",
+					Aliases: []string{"f"},
+					Usage:   "Read the message from the file instead of the standard input",
+				},
+				&cli.BoolFlag{
+					Name:  "trace",
+					Usage: "Enable tracing for the message",
+				},
+			},
+			Action: injectMessage,
+		})
+}
+
+func injectMessage(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return cli.Exit("Error: at least one recipient is required", 2)
+	}
+
+	var (
+		msg []byte
+		err error
+	)
+	if path := ctx.Path("file"); path != "" {
+		msg, err = os.ReadFile(path)
+	} else {
+		msg, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+
+	if _, _, err := readCfgGlobals(ctx); err != nil {
+		return err
+	}
+
+	args := map[string]string{
+		"from":    ctx.String("from"),
+		"rcpts":   strings.Join(ctx.Args().Slice(), "\n"),
+		"message": base64.StdEncoding.EncodeToString(msg),
+	}
+	if ctx.Bool("trace") {
+		args["trace"] = "true"
+	}
+
+	var res struct {
+		MsgID string `json:"msg_id"`
+	}
+	err = callControl(system_mail.CommandInject, args, &res)
+	var exitErr cli.ExitCoder
+	if err != nil && !errors.As(err, &exitErr) {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Message ID:", res.MsgID)
+	return nil
+}
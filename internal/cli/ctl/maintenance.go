@@ -0,0 +1,120 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+	"time"
+
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/maintenance"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "maintenance",
+			Usage: "Read-only maintenance mode management",
+			Description: `While the maintenance mode is enabled, the running server does not
+modify the storage: IMAP mailboxes are served read-only and all incoming
+messages are rejected by SMTP endpoints with a temporary error, so senders
+will retry the delivery later.
+
+This allows to perform storage migrations and upgrades without fully
+shutting down the server. The mode is not persistent and it is
+disabled when the server is restarted.
+
+` + controlSocketNote,
+			Subcommands: []*cli.Command{
+				{
+					Name:   "status",
+					Usage:  "Show whether the maintenance mode is enabled",
+					Action: maintenanceStatus,
+				},
+				{
+					Name:  "enable",
+					Usage: "Enable the maintenance mode",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "reason",
+							Usage: "Reason to record in the server log",
+						},
+					},
+					Action: maintenanceEnable,
+				},
+				{
+					Name:   "disable",
+					Usage:  "Disable the maintenance mode",
+					Action: maintenanceDisable,
+				},
+			},
+		})
+}
+
+func printMaintenanceStatus(status maintenance.Status) {
+	if !status.Enabled {
+		fmt.Println("Maintenance mode is disabled")
+		return
+	}
+	fmt.Printf("Maintenance mode is enabled since %v (%v)\n",
+		status.Since.Format(time.RFC3339), time.Since(status.Since).Truncate(time.Second))
+	if status.Reason != "" {
+		fmt.Println("Reason:", status.Reason)
+	}
+}
+
+func maintenanceStatus(ctx *cli.Context) error {
+	if _, _, err := readCfgGlobals(ctx); err != nil {
+		return err
+	}
+
+	var status maintenance.Status
+	if err := callControl("maintenance.status", nil, &status); err != nil {
+		return err
+	}
+	printMaintenanceStatus(status)
+	return nil
+}
+
+func maintenanceEnable(ctx *cli.Context) error {
+	if _, _, err := readCfgGlobals(ctx); err != nil {
+		return err
+	}
+
+	var status maintenance.Status
+	if err := callControl("maintenance.enable", map[string]string{"reason": ctx.String("reason")}, &status); err != nil {
+		return err
+	}
+	printMaintenanceStatus(status)
+	return nil
+}
+
+func maintenanceDisable(ctx *cli.Context) error {
+	if _, _, err := readCfgGlobals(ctx); err != nil {
+		return err
+	}
+
+	var status maintenance.Status
+	if err := callControl("maintenance.disable", nil, &status); err != nil {
+		return err
+	}
+	printMaintenanceStatus(status)
+	return nil
+}
@@ -40,6 +40,41 @@ func closeIfNeeded(i interface{}) {
 }
 
 func getCfgBlockModule(ctx *cli.Context) (map[string]interface{}, *maddy.ModInfo, error) {
+	cfgBlock := ctx.String("cfg-block")
+	if cfgBlock == "" {
+		return nil, nil, cli.Exit("Error: cfg-block is required", 2)
+	}
+
+	globals, mods, err := getCfgBlockModules(ctx, cfgBlock)
+	if err != nil {
+		return nil, nil, err
+	}
+	return globals, mods[0], nil
+}
+
+// getCfgBlockModules reads the configuration and returns modules defined
+// by top-level blocks with the specified names.
+func getCfgBlockModules(ctx *cli.Context, cfgBlocks ...string) (map[string]interface{}, []*maddy.ModInfo, error) {
+	globals, mods, err := readCfgModules(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := make([]*maddy.ModInfo, 0, len(cfgBlocks))
+	for _, cfgBlock := range cfgBlocks {
+		mod := findCfgBlock(mods, cfgBlock)
+		if mod == nil {
+			return nil, nil, cli.Exit(fmt.Sprintf("Error: unknown configuration block: %s", cfgBlock), 2)
+		}
+		res = append(res, mod)
+	}
+
+	return globals, res, nil
+}
+
+// readCfgGlobals reads the configuration and processes global directives
+// (e.g. to locate the state and runtime directories).
+func readCfgGlobals(ctx *cli.Context) (map[string]interface{}, []parser.Node, error) {
 	cfgPath := ctx.String("config")
 	if cfgPath == "" {
 		return nil, nil, cli.Exit("Error: config is required", 2)
@@ -62,6 +97,18 @@ func getCfgBlockModule(ctx *cli.Context) (map[string]interface{}, *maddy.ModInfo
 	if err := maddy.InitDirs(); err != nil {
 		return nil, nil, err
 	}
+	forwardNotifications()
+
+	return globals, cfgNodes, nil
+}
+
+// readCfgModules reads the configuration and registers all modules defined
+// in it without initializing them.
+func readCfgModules(ctx *cli.Context) (map[string]interface{}, []maddy.ModInfo, error) {
+	globals, cfgNodes, err := readCfgGlobals(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	module.NoRun = true
 	_, mods, err := maddy.RegisterModules(globals, cfgNodes)
@@ -70,22 +117,29 @@ func getCfgBlockModule(ctx *cli.Context) (map[string]interface{}, *maddy.ModInfo
 	}
 	defer hooks.RunHooks(hooks.EventShutdown)
 
-	cfgBlock := ctx.String("cfg-block")
-	if cfgBlock == "" {
-		return nil, nil, cli.Exit("Error: cfg-block is required", 2)
-	}
-	var mod maddy.ModInfo
-	for _, m := range mods {
-		if m.Instance.InstanceName() == cfgBlock {
-			mod = m
-			break
+	return globals, mods, nil
+}
+
+// findCfgBlock returns the module defined by the top-level block with the
+// specified name or nil if there is no such block.
+func findCfgBlock(mods []maddy.ModInfo, cfgBlock string) *maddy.ModInfo {
+	for i := range mods {
+		if mods[i].Instance.InstanceName() == cfgBlock {
+			return &mods[i]
 		}
 	}
-	if mod.Instance == nil {
-		return nil, nil, cli.Exit(fmt.Sprintf("Error: unknown configuration block: %s", cfgBlock), 2)
-	}
+	return nil
+}
 
-	return globals, &mod, nil
+// initCfgBlock initializes the module unless it was already initialized
+// as a dependency of another one.
+func initCfgBlock(globals map[string]interface{}, mod *maddy.ModInfo) error {
+	name := mod.Instance.InstanceName()
+	if module.Initialized[name] {
+		return nil
+	}
+	module.Initialized[name] = true
+	return mod.Instance.Init(config.NewMap(globals, mod.Cfg))
 }
 
 func openStorage(ctx *cli.Context) (module.Storage, error) {
@@ -93,13 +147,16 @@ func openStorage(ctx *cli.Context) (module.Storage, error) {
 	if err != nil {
 		return nil, err
 	}
+	return initStorage(ctx.String("cfg-block"), globals, mod)
+}
 
+func initStorage(cfgBlock string, globals map[string]interface{}, mod *maddy.ModInfo) (module.Storage, error) {
 	storage, ok := mod.Instance.(module.Storage)
 	if !ok {
-		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not an IMAP storage", ctx.String("cfg-block")), 2)
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not an IMAP storage", cfgBlock), 2)
 	}
 
-	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+	if err := initCfgBlock(globals, mod); err != nil {
 		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
 	}
 
@@ -119,15 +176,69 @@ func openUserDB(ctx *cli.Context) (module.PlainUserDB, error) {
 	if err != nil {
 		return nil, err
 	}
+	return initUserDB(ctx.String("cfg-block"), globals, mod)
+}
 
+func initUserDB(cfgBlock string, globals map[string]interface{}, mod *maddy.ModInfo) (module.PlainUserDB, error) {
 	userDB, ok := mod.Instance.(module.PlainUserDB)
 	if !ok {
-		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not a local credentials store", ctx.String("cfg-block")), 2)
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not a local credentials store", cfgBlock), 2)
 	}
 
-	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+	if err := initCfgBlock(globals, mod); err != nil {
 		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
 	}
 
 	return userDB, nil
 }
+
+func openTable(ctx *cli.Context) (module.Table, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return initTable(ctx.String("cfg-block"), globals, mod)
+}
+
+func initTable(cfgBlock string, globals map[string]interface{}, mod *maddy.ModInfo) (module.Table, error) {
+	tbl, ok := mod.Instance.(module.Table)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not a table", cfgBlock), 2)
+	}
+
+	if err := initCfgBlock(globals, mod); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return tbl, nil
+}
+
+// openUserDBAndStorage opens the credentials store defined by cfg-block and
+// the storage defined by storage-block. Storage is nil if storage-block is
+// not set.
+func openUserDBAndStorage(ctx *cli.Context) (module.PlainUserDB, module.Storage, error) {
+	cfgBlock := ctx.String("cfg-block")
+	if cfgBlock == "" {
+		return nil, nil, cli.Exit("Error: cfg-block is required", 2)
+	}
+	storageBlock := ctx.String("storage-block")
+	if storageBlock == "" {
+		userDB, err := openUserDB(ctx)
+		return userDB, nil, err
+	}
+
+	globals, mods, err := getCfgBlockModules(ctx, cfgBlock, storageBlock)
+	if err != nil {
+		return nil, nil, err
+	}
+	userDB, err := initUserDB(cfgBlock, globals, mods[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	storage, err := initStorage(storageBlock, globals, mods[1])
+	if err != nil {
+		closeIfNeeded(userDB)
+		return nil, nil, err
+	}
+	return userDB, storage, nil
+}
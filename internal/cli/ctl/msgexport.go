@@ -0,0 +1,225 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/urfave/cli/v2"
+)
+
+// mboxFromLine returns the separator line for the message in the mbox file.
+func mboxFromLine(sender string, date time.Time) string {
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+	return "From " + sender + " " + date.UTC().Format(time.ANSIC) + "\n"
+}
+
+// writeMboxMessage writes the message to w using the mboxrd format: lines
+// starting with "From " (possibly quoted using '>') are quoted by prepending
+// '>' and CRLF line endings are converted to LF.
+func writeMboxMessage(w io.Writer, sender string, date time.Time, body io.Reader) error {
+	if _, err := io.WriteString(w, mboxFromLine(sender, date)); err != nil {
+		return err
+	}
+
+	rd := bufio.NewReader(body)
+	lastEmpty := false
+	for {
+		line, err := rd.ReadBytes('\n')
+		if len(line) != 0 {
+			line = bytes.TrimSuffix(line, []byte{'\n'})
+			line = bytes.TrimSuffix(line, []byte{'\r'})
+
+			if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+				if _, err := w.Write([]byte{'>'}); err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+			if _, err := w.Write([]byte{'\n'}); err != nil {
+				return err
+			}
+			lastEmpty = len(line) == 0
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Messages are separated by an empty line.
+	if !lastEmpty {
+		if _, err := w.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func envelopeSender(env *imap.Envelope) string {
+	if env == nil {
+		return ""
+	}
+	for _, addrs := range [][]*imap.Address{env.Sender, env.From} {
+		for _, addr := range addrs {
+			if addr.MailboxName != "" && addr.HostName != "" {
+				return addr.MailboxName + "@" + addr.HostName
+			}
+		}
+	}
+	return ""
+}
+
+func writeEml(dir string, msg *imap.Message, body io.Reader) error {
+	path := filepath.Join(dir, strconv.FormatUint(uint64(msg.Uid), 10)+".eml")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if !msg.InternalDate.IsZero() {
+		return os.Chtimes(path, msg.InternalDate, msg.InternalDate)
+	}
+	return nil
+}
+
+func msgsExport(be module.Storage, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	mboxName := ctx.Args().Get(1)
+	if mboxName == "" {
+		return cli.Exit("Error: MAILBOX is required", 2)
+	}
+	seqset := ctx.Args().Get(2)
+	uid := ctx.Bool("uid")
+	if seqset == "" {
+		seqset = "1:*"
+		uid = true
+	} else if !uid {
+		fmt.Fprintln(os.Stderr, "WARNING: --uid=true will be the default in 0.7")
+	}
+
+	format := ctx.String("format")
+	output := ctx.String("output")
+	switch format {
+	case "mbox":
+	case "eml":
+		if output == "" || output == "-" {
+			return cli.Exit("Error: --output directory is required for eml format", 2)
+		}
+		if err := os.MkdirAll(output, 0o700); err != nil {
+			return err
+		}
+	default:
+		return cli.Exit("Error: unknown format: "+format, 2)
+	}
+
+	seq, err := imap.ParseSeqSet(seqset)
+	if err != nil {
+		return err
+	}
+
+	u, err := be.GetIMAPAcct(username)
+	if err != nil {
+		return err
+	}
+
+	_, mbox, err := u.GetMailbox(mboxName, true, nil)
+	if err != nil {
+		return err
+	}
+
+	uid, seq, err = selectMessages(ctx, mbox, uid, seq)
+	if err != nil {
+		return err
+	}
+	if seq == nil {
+		return nil
+	}
+
+	var mboxOut *bufio.Writer
+	if format == "mbox" {
+		out := os.Stdout
+		if output != "" && output != "-" {
+			out, err = os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+		}
+		mboxOut = bufio.NewWriter(out)
+	}
+
+	ch := make(chan *imap.Message, 10)
+	go func() {
+		err = mbox.ListMessages(uid, seq, []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate, imap.FetchEnvelope, imap.FetchRFC822}, ch)
+	}()
+
+	count := 0
+	for msg := range ch {
+		for _, body := range msg.Body {
+			var writeErr error
+			if format == "mbox" {
+				writeErr = writeMboxMessage(mboxOut, envelopeSender(msg.Envelope), msg.InternalDate, body)
+			} else {
+				writeErr = writeEml(output, msg, body)
+			}
+			if writeErr != nil {
+				return writeErr
+			}
+		}
+		count++
+	}
+	if err != nil {
+		return err
+	}
+
+	if mboxOut != nil {
+		if err := mboxOut.Flush(); err != nil {
+			return err
+		}
+	}
+	if output != "" && output != "-" {
+		fmt.Fprintf(os.Stderr, "Exported %d messages.\n", count)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestWriteMboxMessage(t *testing.T) {
+	date := time.Date(2019, 3, 4, 5, 6, 7, 0, time.FixedZone("", 3*60*60))
+	msg := "From: <test@example.org>\r\n" +
+		"Subject: Test\r\n" +
+		"\r\n" +
+		"From the start\r\n" +
+		">From quoted\r\n" +
+		" From not a separator\r\n" +
+		"Last line"
+
+	var buf bytes.Buffer
+	if err := writeMboxMessage(&buf, "test@example.org", date, strings.NewReader(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "From test@example.org Mon Mar  4 02:06:07 2019\n" +
+		"From: <test@example.org>\n" +
+		"Subject: Test\n" +
+		"\n" +
+		">From the start\n" +
+		">>From quoted\n" +
+		" From not a separator\n" +
+		"Last line\n" +
+		"\n"
+	if buf.String() != expected {
+		t.Errorf("Wrong output:\n%q\nexpected:\n%q", buf.String(), expected)
+	}
+}
+
+func TestWriteMboxMessage_NullSender(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeMboxMessage(&buf, "", time.Unix(0, 0), strings.NewReader("Subject: Test\r\n\r\nBody\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "From MAILER-DAEMON Thu Jan  1 00:00:00 1970\n" +
+		"Subject: Test\n" +
+		"\n" +
+		"Body\n" +
+		"\n"
+	if buf.String() != expected {
+		t.Errorf("Wrong output:\n%q\nexpected:\n%q", buf.String(), expected)
+	}
+}
+
+func TestEnvelopeSender(t *testing.T) {
+	env := &imap.Envelope{
+		From:   []*imap.Address{{MailboxName: "from", HostName: "example.org"}},
+		Sender: []*imap.Address{{MailboxName: "sender", HostName: "example.org"}},
+	}
+	if s := envelopeSender(env); s != "sender@example.org" {
+		t.Error("Wrong sender:", s)
+	}
+	env.Sender = nil
+	if s := envelopeSender(env); s != "from@example.org" {
+		t.Error("Wrong sender:", s)
+	}
+	if s := envelopeSender(nil); s != "" {
+		t.Error("Wrong sender:", s)
+	}
+}
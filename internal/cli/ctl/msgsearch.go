@@ -0,0 +1,158 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/urfave/cli/v2"
+)
+
+const searchDateLayout = "2006-01-02"
+
+// msgSearchFlags returns flags that allow to narrow down the set of messages
+// affected by imap-msgs subcommands using IMAP SEARCH criteria.
+func msgSearchFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.TimestampFlag{
+			Layout: searchDateLayout,
+			Name:   "before",
+			Usage:  "Only match messages with internal date before the specified one (YYYY-MM-DD)",
+		},
+		&cli.TimestampFlag{
+			Layout:  searchDateLayout,
+			Name:    "since",
+			Aliases: []string{"after"},
+			Usage:   "Only match messages with internal date on or after the specified one (YYYY-MM-DD)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "with-flag",
+			Usage: "Only match messages that have the specified flag set. Can be specified multiple times",
+		},
+		&cli.StringSliceFlag{
+			Name:  "without-flag",
+			Usage: "Only match messages that don't have the specified flag set. Can be specified multiple times",
+		},
+		&cli.StringSliceFlag{
+			Name:  "header",
+			Usage: "Only match messages with header field containing the value ('Name: value'). Can be specified multiple times",
+		},
+	}
+}
+
+func hasSearchCriteria(ctx *cli.Context) bool {
+	for _, name := range []string{"before", "since", "with-flag", "without-flag", "header"} {
+		if ctx.IsSet(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func searchCriteriaFromCtx(ctx *cli.Context) (*imap.SearchCriteria, error) {
+	var before, since time.Time
+	if ctx.IsSet("before") {
+		before = *ctx.Timestamp("before")
+	}
+	if ctx.IsSet("since") {
+		since = *ctx.Timestamp("since")
+	}
+	return buildSearchCriteria(before, since,
+		ctx.StringSlice("with-flag"), ctx.StringSlice("without-flag"),
+		ctx.StringSlice("header"))
+}
+
+func buildSearchCriteria(before, since time.Time, withFlags, withoutFlags, headers []string) (*imap.SearchCriteria, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.Before = before
+	criteria.Since = since
+	criteria.WithFlags = withFlags
+	criteria.WithoutFlags = withoutFlags
+
+	for _, h := range headers {
+		name, value, ok := strings.Cut(h, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("malformed header criteria, expected 'Name: value': %s", h)
+		}
+		if criteria.Header == nil {
+			criteria.Header = make(textproto.MIMEHeader)
+		}
+		criteria.Header.Add(name, strings.TrimSpace(value))
+	}
+
+	if !before.IsZero() && !since.IsZero() && !since.Before(before) {
+		return nil, errors.New("--since should be before --before, no messages can match")
+	}
+
+	return criteria, nil
+}
+
+// selectMessages narrows down the set of messages using search criteria
+// specified via command-line flags.
+//
+// If no criteria are specified, uid and seq are returned as is. Otherwise,
+// messages matching seq (all messages if seq is nil) are searched and
+// the resulting UID set is returned. The returned set is nil if no messages
+// matched.
+func selectMessages(ctx *cli.Context, mbox imapbackend.Mailbox, uid bool, seq *imap.SeqSet) (bool, *imap.SeqSet, error) {
+	if !hasSearchCriteria(ctx) {
+		return uid, seq, nil
+	}
+
+	criteria, err := searchCriteriaFromCtx(ctx)
+	if err != nil {
+		return false, nil, cli.Exit("Error: "+err.Error(), 2)
+	}
+	if seq != nil {
+		if uid {
+			criteria.Uid = seq
+		} else {
+			criteria.SeqNum = seq
+		}
+	}
+
+	uids, err := mbox.SearchMessages(true, criteria)
+	if err != nil {
+		return false, nil, err
+	}
+	if len(uids) == 0 {
+		return true, nil, nil
+	}
+
+	res := new(imap.SeqSet)
+	res.AddNum(uids...)
+	return true, res, nil
+}
+
+// seqSetLen returns the amount of numbers in the set. It should not be used
+// with sets that contain dynamic values ("*").
+func seqSetLen(seq *imap.SeqSet) int {
+	count := 0
+	for _, s := range seq.Set {
+		count += int(s.Stop-s.Start) + 1
+	}
+	return count
+}
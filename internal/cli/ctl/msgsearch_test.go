@@ -0,0 +1,77 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestBuildSearchCriteria(t *testing.T) {
+	before := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	criteria, err := buildSearchCriteria(before, time.Time{}, []string{imap.SeenFlag}, []string{imap.FlaggedFlag},
+		[]string{"List-Id: <announce.example.org>", "X-Spam:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !criteria.Before.Equal(before) {
+		t.Error("Wrong Before:", criteria.Before)
+	}
+	if !criteria.Since.IsZero() {
+		t.Error("Since should not be set:", criteria.Since)
+	}
+	if len(criteria.WithFlags) != 1 || criteria.WithFlags[0] != imap.SeenFlag {
+		t.Error("Wrong WithFlags:", criteria.WithFlags)
+	}
+	if len(criteria.WithoutFlags) != 1 || criteria.WithoutFlags[0] != imap.FlaggedFlag {
+		t.Error("Wrong WithoutFlags:", criteria.WithoutFlags)
+	}
+	if v := criteria.Header.Get("List-Id"); v != "<announce.example.org>" {
+		t.Error("Wrong List-Id criteria:", v)
+	}
+	if v, ok := criteria.Header["X-Spam"]; !ok || v[0] != "" {
+		t.Error("Wrong X-Spam criteria:", v)
+	}
+}
+
+func TestBuildSearchCriteria_Invalid(t *testing.T) {
+	if _, err := buildSearchCriteria(time.Time{}, time.Time{}, nil, nil, []string{"no colon"}); err == nil {
+		t.Error("Expected error for malformed header")
+	}
+	if _, err := buildSearchCriteria(time.Time{}, time.Time{}, nil, nil, []string{": value"}); err == nil {
+		t.Error("Expected error for empty header name")
+	}
+
+	since := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	before := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := buildSearchCriteria(before, since, nil, nil, nil); err == nil {
+		t.Error("Expected error for empty date range")
+	}
+}
+
+func TestSeqSetLen(t *testing.T) {
+	seq := new(imap.SeqSet)
+	seq.AddNum(1, 2, 3, 7, 10, 11)
+	if l := seqSetLen(seq); l != 6 {
+		t.Error("Wrong length:", l)
+	}
+}
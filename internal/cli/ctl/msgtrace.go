@@ -0,0 +1,134 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/msgtrace"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "msg-trace",
+			Usage: "Inspect logs of traced messages",
+			Description: `Tracing is enabled for the message if it is submitted by an authenticated
+client with the X-Maddy-Trace header field or injected using 'maddy inject --trace'.
+All modules log debug messages for such messages and the log is saved to the
+msgtraces subdirectory of the runtime directory.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List IDs of traced messages",
+					Action: msgTraceList,
+				},
+				{
+					Name:      "show",
+					Usage:     "Print the trace for the message",
+					ArgsUsage: "MSGID",
+					Action:    msgTraceShow,
+				},
+				{
+					Name:      "remove",
+					Usage:     "Remove traces for the messages",
+					ArgsUsage: "MSGID...",
+					Action:    msgTraceRemove,
+				},
+			},
+		})
+}
+
+func msgTraceList(ctx *cli.Context) error {
+	if _, _, err := readCfgGlobals(ctx); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(msgtrace.Dir())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if id, ok := strings.CutSuffix(e.Name(), ".log"); ok && !e.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		fmt.Println(id)
+	}
+	return nil
+}
+
+func msgTraceShow(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.Exit("Error: MSGID is required", 2)
+	}
+	if _, _, err := readCfgGlobals(ctx); err != nil {
+		return err
+	}
+
+	path, err := msgtrace.Path(ctx.Args().First())
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return cli.Exit("Error: no trace for the message", 1)
+		}
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	defer f.Close()
+
+	_, err = io.Copy(os.Stdout, f)
+	return err
+}
+
+func msgTraceRemove(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return cli.Exit("Error: MSGID is required", 2)
+	}
+	if _, _, err := readCfgGlobals(ctx); err != nil {
+		return err
+	}
+
+	for _, id := range ctx.Args().Slice() {
+		path, err := msgtrace.Path(id)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+		}
+		if err := os.Remove(path); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return cli.Exit(fmt.Sprintf("Error: no trace for %s", id), 1)
+			}
+			return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/foxcpp/maddy/framework/module"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/pgpenc"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	pgpKeysFlags := []cli.Flag{
+		&cli.StringFlag{
+			Name:    "cfg-block",
+			Usage:   "Module configuration block to use",
+			EnvVars: []string{"MADDY_CFGBLOCK"},
+			Value:   "local_pgp_keys",
+		},
+	}
+
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "pgp-keys",
+			Usage: "Public keys for encryption of stored messages",
+			Description: `These commands manipulate the table used to store public OpenPGP keys
+of users that want incoming messages to be stored encrypted (see pgp_keys
+directive of storage.imapsql).
+
+The table should be defined in maddy.conf as a top-level config block and be
+referenced from other places using &block_name syntax. By default the block
+name should be local_pgp_keys (can be changed using --cfg-block argument for
+subcommands). table.file and SQL tables with configured modification queries
+are supported.
+
+If the running server uses table.file, it is asked to reload it immediately.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "List accounts with keys set",
+					Flags: pgpKeysFlags,
+					Action: func(ctx *cli.Context) error {
+						tbl, err := openTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return pgpKeysList(tbl, ctx)
+					},
+				},
+				{
+					Name:      "set",
+					Usage:     "Set the key of the account",
+					ArgsUsage: "USERNAME [FILE]",
+					Description: `Read the public key (ASCII-armored or binary) from FILE or stdin and
+enable encryption of messages stored for the account.
+
+Only messages received after that are encrypted.
+`,
+					Flags: pgpKeysFlags,
+					Action: func(ctx *cli.Context) error {
+						tbl, err := openTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return pgpKeysSet(tbl, ctx)
+					},
+				},
+				{
+					Name:      "remove",
+					Usage:     "Remove the key of the account",
+					ArgsUsage: "USERNAME",
+					Description: `Disable encryption of messages stored for the account.
+
+Messages that are already stored encrypted are not changed.
+`,
+					Flags: pgpKeysFlags,
+					Action: func(ctx *cli.Context) error {
+						tbl, err := openTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return pgpKeysRemove(tbl, ctx)
+					},
+				},
+			},
+		})
+}
+
+func pgpKeysList(tbl module.Table, ctx *cli.Context) error {
+	mtbl, ok := tbl.(module.MutableTable)
+	if !ok {
+		return cli.Exit("Error: table is not mutable, no management functionality available", 2)
+	}
+	keys, err := mtbl.Keys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 && !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "No keys.")
+	}
+	for _, key := range keys {
+		entities, err := pgpenc.Lookup(context.TODO(), tbl, key)
+		if err != nil {
+			fmt.Printf("%s: %v\n", key, err)
+			continue
+		}
+		for _, e := range entities {
+			fmt.Printf("%s: %X\n", key, e.PrimaryKey.Fingerprint)
+		}
+	}
+	return nil
+}
+
+func pgpKeysSet(tbl module.Table, ctx *cli.Context) error {
+	mtbl, ok := tbl.(module.MutableTable)
+	if !ok {
+		return cli.Exit("Error: table is not mutable, no management functionality available", 2)
+	}
+	if ctx.NArg() != 1 && ctx.NArg() != 2 {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	key, err := acctStatusKey(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if ctx.NArg() == 2 {
+		f, err := os.Open(ctx.Args().Get(1))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	blob, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	entities, err := pgpenc.ParseKey(string(blob))
+	if err != nil {
+		// Binary key.
+		entities, err = pgpenc.ParseKey(base64.StdEncoding.EncodeToString(blob))
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+		}
+	}
+	val, err := pgpenc.FormatKey(entities)
+	if err != nil {
+		return err
+	}
+	if err := mtbl.SetKey(key, val); err != nil {
+		return err
+	}
+	reloadTable(tbl)
+	return nil
+}
+
+func pgpKeysRemove(tbl module.Table, ctx *cli.Context) error {
+	mtbl, ok := tbl.(module.MutableTable)
+	if !ok {
+		return cli.Exit("Error: table is not mutable, no management functionality available", 2)
+	}
+	if ctx.NArg() != 1 {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	key, err := acctStatusKey(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	if err := mtbl.RemoveKey(key); err != nil {
+		return err
+	}
+	reloadTable(tbl)
+	return nil
+}
@@ -0,0 +1,99 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/target/queue"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "queue",
+			Usage: "Outbound delivery queue management",
+			Description: `These commands manage messages waiting for delivery in queues of the
+running server.
+
+` + controlSocketNote,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "cancel",
+					Usage: "Cancel delivery of messages",
+					Description: `Remove messages with the specified IDs from the queue so no further
+delivery attempts are made. Recipients that already received the message
+are not affected, no DSN is sent for the cancelled recipients.
+
+Messages with a delivery attempt in progress cannot be cancelled, try again
+once the attempt is completed.
+`,
+					ArgsUsage: "ID...",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "Look for messages only in the queue with this configuration block name",
+						},
+					},
+					Action: queueCancel,
+				},
+			},
+		})
+}
+
+func queueCancel(ctx *cli.Context) error {
+	if ctx.Args().Len() == 0 {
+		return cli.Exit("Error: ID is required", 2)
+	}
+	if _, _, err := readCfgGlobals(ctx); err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, id := range ctx.Args().Slice() {
+		var res queue.CancelResult
+		err := callControl("queue.cancel", map[string]string{
+			"name": ctx.String("name"),
+			"id":   id,
+		}, &res)
+		if err != nil {
+			var exitErr cli.ExitCoder
+			if errors.As(err, &exitErr) {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Failed to cancel %s: %v\n", id, err)
+			lastErr = err
+			continue
+		}
+
+		fmt.Printf("Cancelled %s for %s\n", res.ID, strings.Join(res.Cancelled, ", "))
+		if len(res.Delivered) != 0 {
+			fmt.Printf("  already delivered to %s\n", strings.Join(res.Delivered, ", "))
+		}
+		if len(res.Failed) != 0 {
+			fmt.Printf("  already failed for %s\n", strings.Join(res.Failed, ", "))
+		}
+	}
+	return lastErr
+}
@@ -0,0 +1,74 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+
+	"github.com/foxcpp/maddy"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "reload",
+			Usage: "Apply the changed configuration to the running server",
+			Description: `The running server re-reads the configuration file and restarts
+configuration blocks that were added, changed or removed (along with blocks
+that use them). Other modules continue to run without interruption.
+
+Replaced endpoints stop accepting new connections immediately and continue
+serving active sessions for up to 5 minutes. Messages in the queue are
+handed over to the new queue instance.
+
+Changes to global directives (such as state_dir or hostname) require a
+full restart. If the new configuration is invalid, the server continues to
+run with the old one.
+
+Same as sending SIGHUP to the server process.
+
+` + controlSocketNote,
+			Action: reloadConfig,
+		})
+}
+
+func reloadConfig(ctx *cli.Context) error {
+	if _, _, err := readCfgGlobals(ctx); err != nil {
+		return err
+	}
+
+	var status maddy.ReloadStatus
+	if err := callControl("config.reload", nil, &status); err != nil {
+		return err
+	}
+
+	if len(status.Restarted) == 0 && len(status.Removed) == 0 {
+		fmt.Println("No changes.")
+		return nil
+	}
+	for _, name := range status.Restarted {
+		fmt.Println("Restarted:", name)
+	}
+	for _, name := range status.Removed {
+		fmt.Println("Removed:", name)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/authz"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/sessions"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "sessions",
+			Usage: "Active client sessions management",
+			Description: `These commands query the running server for client sessions
+(IMAP, SMTP, Submission and LMTP connections) and allow to terminate them,
+e.g. after the user password is reset or the account is suspended.
+
+` + controlSocketNote,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "List active sessions",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "user",
+							Usage: "List only sessions of the specified user",
+						},
+					},
+					Action: sessionsList,
+				},
+				{
+					Name:  "kill",
+					Usage: "Terminate sessions",
+					Description: `Sessions are specified by IDs as shown by 'list' subcommand.
+Alternatively, all sessions of the user can be terminated using --user flag.
+
+Connections are closed immediately, commands in progress are aborted.
+`,
+					ArgsUsage: "[ID...]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "user",
+							Usage: "Terminate all sessions of the specified user",
+						},
+					},
+					Action: sessionsKill,
+				},
+			},
+		})
+}
+
+// controlSocketNote ends descriptions of commands that talk to the running
+// server.
+const controlSocketNote = `The server is reached using the control socket in the runtime directory so
+maddy should be run by the same user as the server.
+`
+
+// callControl sends the request to the server using the control socket.
+// readCfgGlobals should be called before to locate the runtime directory.
+func callControl(command string, args map[string]string, result interface{}) error {
+	err := control.Call(control.SocketPath(), command, args, result)
+	if errors.Is(err, control.ErrNotRunning) {
+		return cli.Exit("Error: server is not running", 1)
+	}
+	return err
+}
+
+func sessionsList(ctx *cli.Context) error {
+	if _, _, err := readCfgGlobals(ctx); err != nil {
+		return err
+	}
+
+	var list []sessions.Info
+	if err := callControl("sessions.list", nil, &list); err != nil {
+		return err
+	}
+
+	if user := ctx.String("user"); user != "" {
+		key := normalizeUser(user)
+		filtered := list[:0]
+		for _, s := range list {
+			if s.Username != "" && normalizeUser(s.Username) == key {
+				filtered = append(filtered, s)
+			}
+		}
+		list = filtered
+	}
+
+	if len(list) == 0 {
+		if !ctx.Bool("quiet") {
+			fmt.Fprintln(os.Stderr, "No sessions.")
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPROTOCOL\tUSER\tREMOTE ADDR\tIDLE")
+	for _, s := range list {
+		user := s.Username
+		if user == "" {
+			user = "-"
+		}
+		idle := time.Since(s.LastActive).Truncate(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\n", s.ID, s.Protocol, user, s.RemoteAddr, idle)
+	}
+	return w.Flush()
+}
+
+func normalizeUser(username string) string {
+	norm, err := authz.NormalizeAuto(username)
+	if err != nil {
+		return username
+	}
+	return norm
+}
+
+func sessionsKill(ctx *cli.Context) error {
+	user := ctx.String("user")
+	switch {
+	case user != "" && ctx.Args().Len() != 0:
+		return cli.Exit("Error: --user can't be used together with session IDs", 2)
+	case user == "" && ctx.Args().Len() == 0:
+		return cli.Exit("Error: ID or --user is required", 2)
+	}
+
+	if _, _, err := readCfgGlobals(ctx); err != nil {
+		return err
+	}
+
+	var requests []map[string]string
+	if user != "" {
+		requests = append(requests, map[string]string{"username": user})
+	}
+	for _, id := range ctx.Args().Slice() {
+		requests = append(requests, map[string]string{"id": id})
+	}
+
+	var lastErr error
+	killed := 0
+	for _, args := range requests {
+		var list []sessions.Info
+		if err := callControl("sessions.kill", args, &list); err != nil {
+			var exitErr cli.ExitCoder
+			if errors.As(err, &exitErr) {
+				return err
+			}
+			if id := args["id"]; id != "" {
+				fmt.Fprintf(os.Stderr, "Failed to terminate session %s: %v\n", id, err)
+			} else {
+				fmt.Fprintf(os.Stderr, "Failed to terminate sessions: %v\n", err)
+			}
+			lastErr = err
+			continue
+		}
+		for _, s := range list {
+			fmt.Printf("Terminated %s session %s from %s\n", s.Protocol, s.ID, s.RemoteAddr)
+		}
+		killed += len(list)
+	}
+	if killed == 0 && lastErr == nil && !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "No sessions.")
+	}
+	return lastErr
+}
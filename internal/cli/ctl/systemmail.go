@@ -0,0 +1,134 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/foxcpp/maddy/framework/hooks"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/endpoint/system_mail"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "system-mail",
+			Usage: "Templated messages sent by the server",
+			Description: `These commands ask the running server to send messages using the
+system_mail module templates.
+
+` + controlSocketNote,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "send",
+					Usage: "Send the message for the event to the account",
+					Description: `Messages for the account_created, password_changed and quota_warning
+events are available by default, other events can be used if the template
+file exists.
+
+Additional template parameters can be specified using --param flag, e.g.
+for quota_warning:
+
+  maddy system-mail send --param percent=90 --param usage=900M \
+    --param limit=1G quota_warning user@example.org
+`,
+					ArgsUsage: "EVENT ADDRESS",
+					Flags: []cli.Flag{
+						&cli.StringSliceFlag{
+							Name:  "param",
+							Usage: "Template parameter in the KEY=VALUE form",
+						},
+					},
+					Action: systemMailSend,
+				},
+			},
+		})
+}
+
+func systemMailSend(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return cli.Exit("Error: EVENT and ADDRESS are required", 2)
+	}
+
+	args := map[string]string{}
+	for _, param := range ctx.StringSlice("param") {
+		k, v, ok := strings.Cut(param, "=")
+		if !ok || k == "" {
+			return cli.Exit(fmt.Sprintf("Error: malformed parameter: %s", param), 2)
+		}
+		args[k] = v
+	}
+	args["event"] = ctx.Args().Get(0)
+	args["username"] = ctx.Args().Get(1)
+
+	if _, _, err := readCfgGlobals(ctx); err != nil {
+		return err
+	}
+	err := callControl(system_mail.CommandSend, args, nil)
+	var exitErr cli.ExitCoder
+	if err != nil && !errors.As(err, &exitErr) {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	return err
+}
+
+// forwardedNotifications are notifications the running server may need to
+// know about if they are reported by the maddy command (e.g. when the
+// account is created using 'imap-acct create').
+var forwardedNotifications = map[string]bool{
+	hooks.NotifyAccountCreated:  true,
+	hooks.NotifyPasswordChanged: true,
+}
+
+var forwardOnce sync.Once
+
+// forwardNotifications installs the handler that passes notifications to the
+// running server so it can send the corresponding messages (see the
+// system_mail module).
+func forwardNotifications() {
+	forwardOnce.Do(func() {
+		hooks.AddNotifyHandler(forwardNotification)
+	})
+}
+
+func forwardNotification(name string, params map[string]string) {
+	if !forwardedNotifications[name] {
+		return
+	}
+
+	args := make(map[string]string, len(params)+1)
+	for k, v := range params {
+		args[k] = v
+	}
+	args["event"] = name
+
+	err := control.Call(control.SocketPath(), system_mail.CommandNotify, args, nil)
+	if err == nil || errors.Is(err, control.ErrNotRunning) || errors.Is(err, control.ErrUnknownCommand) {
+		// The server is not running or system_mail is not used.
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Failed to pass %s event to the server: %v\n", name, err)
+}
@@ -0,0 +1,127 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/tlsa"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:      "tlsa",
+			Usage:     "Generate TLSA records for certificates",
+			ArgsUsage: "HOSTNAME...",
+			Description: "Prints TLSA records for the certificate chain in the zone file format.\n" +
+				"Use tlsa module to keep published records up to date automatically.",
+			Action: tlsaCommand,
+			Flags: []cli.Flag{
+				&cli.PathFlag{
+					Name:     "cert",
+					Aliases:  []string{"c"},
+					Usage:    "PEM file with the certificate chain (leaf certificate first)",
+					Required: true,
+				},
+				&cli.IntSliceFlag{
+					Name:    "port",
+					Aliases: []string{"p"},
+					Usage:   "TCP port of the service. Can be specified multiple times",
+					Value:   cli.NewIntSlice(25),
+				},
+				&cli.StringSliceFlag{
+					Name:  "usage",
+					Usage: "Certificate usage (dane-ee or dane-ta). Can be specified multiple times",
+					Value: cli.NewStringSlice("dane-ee", "dane-ta"),
+				},
+			},
+		})
+}
+
+func readCertChain(path string) ([]*x509.Certificate, error) {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, blob = pem.Decode(blob)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+	return chain, nil
+}
+
+func tlsaCommand(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return cli.Exit("Error: HOSTNAME is required", 2)
+	}
+
+	chain, err := readCertChain(ctx.Path("cert"))
+	if err != nil {
+		return err
+	}
+
+	usages := make([]uint8, 0, len(ctx.StringSlice("usage")))
+	for _, name := range ctx.StringSlice("usage") {
+		usage, err := tlsa.ParseUsage(name)
+		if err != nil {
+			return cli.Exit("Error: "+err.Error(), 2)
+		}
+		usages = append(usages, usage)
+	}
+
+	var recs []tlsa.Record
+	for _, hostname := range ctx.Args().Slice() {
+		for _, port := range ctx.IntSlice("port") {
+			hostRecs, err := tlsa.ForChain(hostname, port, chain, usages)
+			if err != nil {
+				return err
+			}
+			recs = append(recs, hostRecs...)
+		}
+	}
+	if len(recs) == 0 {
+		return errors.New("no records generated, certificate chain contains only the leaf certificate")
+	}
+
+	fmt.Print(tlsa.Zone(recs))
+	return nil
+}
@@ -162,6 +162,134 @@ using command flags. Otherwise, these options cannot be used.
 						return usersPassword(be, ctx)
 					},
 				},
+				{
+					Name:  "export",
+					Usage: "Export credentials and storage accounts",
+					Description: `Writes password hashes of all users to FILE (or stdout if FILE
+is not specified or is "-") as JSON or CSV.
+
+If --storage-block is set, storage accounts are also listed. Exported file can be
+loaded using 'creds import' command. Keep it private, it contains password hashes.
+
+Only auth.pass_table credentials DB is supported.
+`,
+					ArgsUsage: "[FILE]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_authdb",
+						},
+						&cli.StringFlag{
+							Name:  "storage-block",
+							Usage: "Also export accounts from the storage defined by this configuration block",
+						},
+						&cli.StringFlag{
+							Name:  "format",
+							Usage: "Use specified file format: json or csv. Guessed from the file extension by default",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, storage, err := openUserDBAndStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						defer closeIfNeeded(storage)
+						return usersExport(be, storage, ctx)
+					},
+				},
+				{
+					Name:  "import",
+					Usage: "Create users in bulk",
+					Description: `Reads user list from FILE ("-" for stdin) as JSON or CSV and
+creates credentials for them. Errors are reported for each user and do not stop
+the import.
+
+Each record has the following fields: username, hash (password hash as written by
+'creds export' or 'maddy hash'), password, email, imap_account (true or false).
+
+If neither hash nor password is set, credentials are not created unless
+--random-password is specified. Generated passwords are sent to the user's
+email address if --notify-template is set and printed as CSV to stdout otherwise.
+
+The notification template uses Go text/template syntax and can refer to
+{{.Username}}, {{.Password}} and {{.Email}}. Define the "subject" template to
+set the message subject.
+
+Storage accounts are created for records with imap_account set to true if
+--storage-block is specified.
+`,
+					ArgsUsage: "FILE",
+					Flags: append([]cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_authdb",
+						},
+						&cli.StringFlag{
+							Name:  "storage-block",
+							Usage: "Create storage accounts using the storage defined by this configuration block",
+						},
+						&cli.StringFlag{
+							Name:  "format",
+							Usage: "Use specified file format: json or csv. Guessed from the file extension by default",
+						},
+						&cli.StringFlag{
+							Name:  "hash",
+							Usage: "Use specified hash algorithm for passwords. Valid values: " + strings.Join(pass_table.Hashes, ", "),
+							Value: "bcrypt",
+						},
+						&cli.IntFlag{
+							Name:  "bcrypt-cost",
+							Usage: "Specify bcrypt cost value",
+							Value: bcrypt.DefaultCost,
+						},
+						&cli.BoolFlag{
+							Name:  "random-password",
+							Usage: "Generate passwords for users without password or hash",
+						},
+						&cli.IntFlag{
+							Name:  "password-length",
+							Usage: "Length of generated passwords",
+							Value: 16,
+						},
+						&cli.StringFlag{
+							Name:  "notify-template",
+							Usage: "Send generated passwords by email using the template from `FILE`",
+						},
+						&cli.StringFlag{
+							Name:  "notify-from",
+							Usage: "Sender address for password notifications",
+						},
+						&cli.StringFlag{
+							Name:  "smtp",
+							Usage: "Submission server to send password notifications through",
+							Value: "127.0.0.1:587",
+						},
+						&cli.StringFlag{
+							Name:    "smtp-user",
+							Usage:   "Username to authenticate to the submission server",
+							EnvVars: []string{"MADDY_SMTP_USER"},
+						},
+						&cli.StringFlag{
+							Name:    "smtp-password",
+							Usage:   "Password to authenticate to the submission server",
+							EnvVars: []string{"MADDY_SMTP_PASSWORD"},
+						},
+					}, specialUseFlags()...),
+					Action: func(ctx *cli.Context) error {
+						be, storage, err := openUserDBAndStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						defer closeIfNeeded(storage)
+						return usersImport(be, storage, ctx)
+					},
+				},
 			},
 		})
 }
@@ -0,0 +1,210 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package control implements the control socket used by the maddy command
+// to query and change the state of the running server.
+//
+// Each connection carries one JSON-encoded request and one JSON-encoded
+// response.
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+const (
+	socketName = "control.sock"
+
+	// timeout limits the time spent on a single request.
+	timeout = 30 * time.Second
+)
+
+// ErrNotRunning is returned by Call if there is no running server.
+var ErrNotRunning = errors.New("control: server is not running")
+
+// ErrUnknownCommand is returned by Call if the server does not handle the
+// command, e.g. because the module providing it is not used.
+var ErrUnknownCommand = errors.New("control: unknown command")
+
+const unknownCommandPrefix = "unknown command: "
+
+// Handler processes the request. The returned value is encoded as JSON
+// and sent to the client.
+type Handler func(args map[string]string) (interface{}, error)
+
+var (
+	handlers    = map[string]Handler{}
+	handlersLck sync.RWMutex
+)
+
+// Handle registers the handler for the command.
+func Handle(command string, h Handler) {
+	handlersLck.Lock()
+	defer handlersLck.Unlock()
+	handlers[command] = h
+}
+
+type request struct {
+	Command string            `json:"command"`
+	Args    map[string]string `json:"args,omitempty"`
+}
+
+type response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// SocketPath returns the path of the control socket.
+func SocketPath() string {
+	return filepath.Join(config.RuntimeDirectory, socketName)
+}
+
+type Server struct {
+	Log log.Logger
+
+	l  net.Listener
+	wg sync.WaitGroup
+}
+
+// Listen creates the control socket and starts serving requests.
+//
+// The socket is accessible only to the user running the server.
+func Listen(path string) (*Server, error) {
+	// Left over from the server that was not stopped cleanly.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("control: %w", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("control: %w", err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("control: %w", err)
+	}
+
+	s := &Server{Log: log.Logger{Name: "control"}, l: l}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.Log.Error("accept failed", err)
+			}
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		s.Log.Error("set deadline failed", err)
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		s.Log.Error("malformed request", err)
+		return
+	}
+
+	handlersLck.RLock()
+	h := handlers[req.Command]
+	handlersLck.RUnlock()
+
+	var resp response
+	if h == nil {
+		resp.Error = unknownCommandPrefix + req.Command
+	} else if result, err := h(req.Args); err != nil {
+		resp.Error = err.Error()
+	} else if resp.Result, err = json.Marshal(result); err != nil {
+		resp.Error = err.Error()
+	}
+
+	s.Log.DebugMsg("request", "command", req.Command, "args", req.Args, "error", resp.Error)
+
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		s.Log.Error("failed to send response", err)
+	}
+}
+
+// Close removes the socket and waits for running requests to complete.
+func (s *Server) Close() error {
+	err := s.l.Close()
+	s.wg.Wait()
+	return err
+}
+
+// Call sends the request to the running server and decodes the result into
+// the value pointed to by result.
+func Call(path, command string, args map[string]string, result interface{}) error {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return ErrNotRunning
+		}
+		return fmt.Errorf("control: %w", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("control: %w", err)
+	}
+
+	if err := json.NewEncoder(conn).Encode(request{Command: command, Args: args}); err != nil {
+		return fmt.Errorf("control: %w", err)
+	}
+	var resp response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("control: %w", err)
+	}
+	if strings.HasPrefix(resp.Error, unknownCommandPrefix) {
+		return fmt.Errorf("%w: %s", ErrUnknownCommand, command)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if result == nil || resp.Result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
@@ -0,0 +1,61 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package control
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestCall(t *testing.T) {
+	Handle("test.echo", func(args map[string]string) (interface{}, error) {
+		if args["fail"] != "" {
+			return nil, errors.New(args["fail"])
+		}
+		return args, nil
+	})
+
+	path := filepath.Join(t.TempDir(), "control.sock")
+	srv, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	var res map[string]string
+	if err := Call(path, "test.echo", map[string]string{"a": "b"}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res["a"] != "b" {
+		t.Errorf("wrong result: %v", res)
+	}
+
+	if err := Call(path, "test.echo", map[string]string{"fail": "oops"}, nil); err == nil || err.Error() != "oops" {
+		t.Errorf("expected handler error, got %v", err)
+	}
+	if err := Call(path, "test.unknown", nil, nil); !errors.Is(err, ErrUnknownCommand) {
+		t.Error("expected an error for unknown command, got", err)
+	}
+
+	srv.Close()
+	if err := Call(path, "test.echo", nil, nil); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("expected ErrNotRunning, got %v", err)
+	}
+}
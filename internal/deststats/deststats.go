@@ -0,0 +1,262 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package deststats tracks the latency and results of delivery attempts
+// to remote destination domains.
+//
+// Statistics are kept for a time window (usually, one day) and are used to
+// find out which destinations are slow or failing. Prometheus metrics are
+// not suitable for that since a per-domain label would create unbounded
+// amount of time series.
+package deststats
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+const (
+	// maxSamples is the amount of latest attempts per domain used to
+	// calculate latency percentiles.
+	maxSamples = 1000
+
+	// maxDomains limits the memory used by a single Tracker. Attempts to
+	// other domains are not tracked until the window is reset.
+	maxDomains = 10000
+)
+
+type domainStats struct {
+	attempts     int
+	tempFailures int
+	permFailures int
+
+	// Ring buffer of the latest attempt latencies.
+	samples []time.Duration
+	next    int
+}
+
+// Tracker collects statistics for a single module instance.
+type Tracker struct {
+	name string
+
+	lck       sync.Mutex
+	since     time.Time
+	domains   map[string]*domainStats
+	untracked int
+}
+
+// NewTracker creates a Tracker for the module instance with the specified
+// name.
+func NewTracker(name string) *Tracker {
+	return &Tracker{
+		name:    name,
+		since:   time.Now(),
+		domains: make(map[string]*domainStats),
+	}
+}
+
+// Record saves the result of a delivery attempt. err is the error returned
+// for the attempt or nil if it succeeded.
+func (t *Tracker) Record(domain string, latency time.Duration, err error) {
+	t.lck.Lock()
+	defer t.lck.Unlock()
+
+	s := t.domains[domain]
+	if s == nil {
+		if len(t.domains) >= maxDomains {
+			t.untracked++
+			return
+		}
+		s = &domainStats{}
+		t.domains[domain] = s
+	}
+
+	s.attempts++
+	if err != nil {
+		if exterrors.IsTemporaryOrUnspec(err) {
+			s.tempFailures++
+		} else {
+			s.permFailures++
+		}
+	}
+
+	if len(s.samples) < maxSamples {
+		s.samples = append(s.samples, latency)
+	} else {
+		s.samples[s.next] = latency
+		s.next = (s.next + 1) % maxSamples
+	}
+}
+
+// Domain is the summary of attempts to deliver to a destination domain.
+type Domain struct {
+	Domain       string `json:"domain"`
+	Attempts     int    `json:"attempts"`
+	TempFailures int    `json:"temp_failures"`
+	PermFailures int    `json:"perm_failures"`
+
+	// Latency percentiles for the latest attempts, both successful and
+	// failed.
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+}
+
+// Failures returns the total amount of failed attempts.
+func (d Domain) Failures() int {
+	return d.TempFailures + d.PermFailures
+}
+
+// FailureRate returns the share of failed attempts.
+func (d Domain) FailureRate() float64 {
+	if d.Attempts == 0 {
+		return 0
+	}
+	return float64(d.Failures()) / float64(d.Attempts)
+}
+
+// Report contains the statistics collected by a Tracker since Since.
+type Report struct {
+	Module  string    `json:"module"`
+	Since   time.Time `json:"since"`
+	Domains []Domain  `json:"domains"`
+
+	// Untracked is the amount of attempts not included in the report
+	// because of the domains limit.
+	Untracked int `json:"untracked,omitempty"`
+}
+
+// Report returns the statistics for the current window. Domains are sorted
+// by name.
+func (t *Tracker) Report() Report {
+	t.lck.Lock()
+	defer t.lck.Unlock()
+
+	r := Report{
+		Module:    t.name,
+		Since:     t.since,
+		Domains:   make([]Domain, 0, len(t.domains)),
+		Untracked: t.untracked,
+	}
+	for name, s := range t.domains {
+		samples := make([]time.Duration, len(s.samples))
+		copy(samples, s.samples)
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+		r.Domains = append(r.Domains, Domain{
+			Domain:       name,
+			Attempts:     s.attempts,
+			TempFailures: s.tempFailures,
+			PermFailures: s.permFailures,
+			P50:          percentile(samples, 50),
+			P90:          percentile(samples, 90),
+			P99:          percentile(samples, 99),
+		})
+	}
+	sort.Slice(r.Domains, func(i, j int) bool { return r.Domains[i].Domain < r.Domains[j].Domain })
+	return r
+}
+
+// Reset discards collected statistics and starts a new window.
+func (t *Tracker) Reset() {
+	t.lck.Lock()
+	defer t.lck.Unlock()
+
+	t.since = time.Now()
+	t.domains = make(map[string]*domainStats)
+	t.untracked = 0
+}
+
+// percentile returns the nearest-rank percentile of sorted samples.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Slowest returns up to n domains with the highest 90th percentile
+// latency.
+func Slowest(domains []Domain, n int) []Domain {
+	res := make([]Domain, len(domains))
+	copy(res, domains)
+	sort.SliceStable(res, func(i, j int) bool { return res[i].P90 > res[j].P90 })
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// MostFailing returns up to n domains with the highest amount of failed
+// attempts. Domains without failures are not included.
+func MostFailing(domains []Domain, n int) []Domain {
+	res := make([]Domain, 0, len(domains))
+	for _, d := range domains {
+		if d.Failures() != 0 {
+			res = append(res, d)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Failures() != res[j].Failures() {
+			return res[i].Failures() > res[j].Failures()
+		}
+		return res[i].FailureRate() > res[j].FailureRate()
+	})
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+var (
+	trackers    = make(map[string]*Tracker)
+	trackersLck sync.Mutex
+)
+
+// Register makes the Tracker available via the control socket. Tracker
+// registered previously with the same name is replaced.
+func Register(t *Tracker) {
+	trackersLck.Lock()
+	defer trackersLck.Unlock()
+	trackers[t.name] = t
+}
+
+// Reports returns reports for all registered trackers sorted by module
+// name.
+func Reports() []Report {
+	trackersLck.Lock()
+	list := make([]*Tracker, 0, len(trackers))
+	for _, t := range trackers {
+		list = append(list, t)
+	}
+	trackersLck.Unlock()
+
+	res := make([]Report, 0, len(list))
+	for _, t := range list {
+		res = append(res, t.Report())
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Module < res[j].Module })
+	return res
+}
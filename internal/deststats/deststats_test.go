@@ -0,0 +1,83 @@
+package deststats
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+func TestTracker(t *testing.T) {
+	tr := NewTracker("test")
+	for i := 1; i <= 100; i++ {
+		tr.Record("slow.example.org", time.Duration(i)*time.Second, nil)
+	}
+	tr.Record("fast.example.org", time.Millisecond, nil)
+	tr.Record("fast.example.org", 2*time.Millisecond, exterrors.WithTemporary(errors.New("try again"), true))
+	tr.Record("broken.example.org", time.Millisecond, exterrors.WithTemporary(errors.New("no such user"), false))
+
+	r := tr.Report()
+	if r.Module != "test" || len(r.Domains) != 3 {
+		t.Fatalf("Unexpected report: %+v", r)
+	}
+	// Sorted by name.
+	broken, fast, slow := r.Domains[0], r.Domains[1], r.Domains[2]
+
+	if slow.Attempts != 100 || slow.Failures() != 0 {
+		t.Errorf("Wrong counters: %+v", slow)
+	}
+	if slow.P50 != 50*time.Second || slow.P90 != 90*time.Second || slow.P99 != 99*time.Second {
+		t.Errorf("Wrong percentiles: %+v", slow)
+	}
+	if fast.Attempts != 2 || fast.TempFailures != 1 || fast.PermFailures != 0 || fast.FailureRate() != 0.5 {
+		t.Errorf("Wrong counters: %+v", fast)
+	}
+	if fast.P50 != time.Millisecond || fast.P99 != 2*time.Millisecond {
+		t.Errorf("Wrong percentiles: %+v", fast)
+	}
+	if broken.PermFailures != 1 || broken.TempFailures != 0 {
+		t.Errorf("Wrong counters: %+v", broken)
+	}
+
+	if s := Slowest(r.Domains, 1); len(s) != 1 || s[0].Domain != "slow.example.org" {
+		t.Errorf("Wrong Slowest result: %+v", s)
+	}
+	if f := MostFailing(r.Domains, 10); len(f) != 2 || f[0].Domain != "broken.example.org" || f[1].Domain != "fast.example.org" {
+		t.Errorf("Wrong MostFailing result: %+v", f)
+	}
+
+	tr.Reset()
+	if r := tr.Report(); len(r.Domains) != 0 {
+		t.Errorf("Domains left after Reset: %+v", r.Domains)
+	}
+}
+
+func TestTracker_Samples(t *testing.T) {
+	tr := NewTracker("test")
+	for i := 0; i < maxSamples; i++ {
+		tr.Record("example.org", time.Hour, nil)
+	}
+	// Old samples are replaced.
+	for i := 0; i < maxSamples; i++ {
+		tr.Record("example.org", time.Second, nil)
+	}
+
+	d := tr.Report().Domains[0]
+	if d.Attempts != 2*maxSamples || d.P99 != time.Second {
+		t.Errorf("Unexpected stats: %+v", d)
+	}
+}
+
+func TestTracker_DomainsLimit(t *testing.T) {
+	tr := NewTracker("test")
+	for i := 0; i < maxDomains+5; i++ {
+		tr.Record(fmt.Sprintf("d%d.example.org", i), time.Second, nil)
+	}
+
+	r := tr.Report()
+	if len(r.Domains) != maxDomains || r.Untracked != 5 {
+		t.Errorf("Unexpected report: %d domains, %d untracked", len(r.Domains), r.Untracked)
+	}
+}
@@ -39,4 +39,7 @@ const (
 	PolicyNone       = dmarc.PolicyNone
 	PolicyReject     = dmarc.PolicyReject
 	PolicyQuarantine = dmarc.PolicyQuarantine
+
+	AlignmentStrict  = dmarc.AlignmentStrict
+	AlignmentRelaxed = dmarc.AlignmentRelaxed
 )
@@ -133,7 +133,7 @@ func EvaluateAlignment(fromDomain string, record *Record, results []authres.Resu
 			if dkimResult.Value == "" {
 				dkimResult = *dkimRes
 			}
-			if isAligned(fromDomain, dkimRes.Domain, record.DKIMAlignment) {
+			if IsAligned(fromDomain, dkimRes.Domain, record.DKIMAlignment) {
 				dkimResult = *dkimRes
 				switch dkimRes.Value {
 				case authres.ResultPass:
@@ -147,9 +147,9 @@ func EvaluateAlignment(fromDomain string, record *Record, results []authres.Resu
 			spfResult = *spfRes
 			var aligned bool
 			if spfRes.From == "" {
-				aligned = isAligned(fromDomain, spfRes.Helo, record.SPFAlignment)
+				aligned = IsAligned(fromDomain, spfRes.Helo, record.SPFAlignment)
 			} else {
-				aligned = isAligned(fromDomain, spfRes.From, record.SPFAlignment)
+				aligned = IsAligned(fromDomain, spfRes.From, record.SPFAlignment)
 			}
 			if aligned && spfRes.Value == authres.ResultPass {
 				spfAligned = true
@@ -202,7 +202,41 @@ func EvaluateAlignment(fromDomain string, record *Record, results []authres.Resu
 	return res
 }
 
-func isAligned(fromDomain, authDomain string, mode AlignmentMode) bool {
+// EvaluateSender checks whether the envelope sender domain is authenticated
+// by SPF or a DKIM signature in relaxed alignment with it.
+//
+// It returns authres.ResultPass if it is, authres.ResultFail if SPF check
+// failed and there is no aligned DKIM signature and authres.ResultNone
+// otherwise.
+func EvaluateSender(mailFromDomain string, results []authres.Result) authres.ResultValue {
+	spfFail := false
+	for _, res := range results {
+		switch res := res.(type) {
+		case *authres.DKIMResult:
+			if res.Value == authres.ResultPass && IsAligned(mailFromDomain, res.Domain, dmarc.AlignmentRelaxed) {
+				return authres.ResultPass
+			}
+		case *authres.SPFResult:
+			if res.From == "" || !strings.EqualFold(res.From, mailFromDomain) {
+				continue
+			}
+			switch res.Value {
+			case authres.ResultPass:
+				return authres.ResultPass
+			case authres.ResultFail:
+				spfFail = true
+			}
+		}
+	}
+	if spfFail {
+		return authres.ResultFail
+	}
+	return authres.ResultNone
+}
+
+// IsAligned reports whether authDomain is in alignment with fromDomain as
+// defined by RFC 7489 Section 3.1.
+func IsAligned(fromDomain, authDomain string, mode AlignmentMode) bool {
 	if mode == dmarc.AlignmentStrict {
 		return strings.EqualFold(fromDomain, authDomain)
 	}
@@ -456,6 +456,39 @@ func TestEvaluateAlignment(t *testing.T) {
 	}
 }
 
+func TestEvaluateSender(t *testing.T) {
+	test := func(results []authres.Result, expected authres.ResultValue) {
+		t.Helper()
+		if out := EvaluateSender("example.org", results); out != expected {
+			t.Errorf("Wrong result for %+v: want '%s', got '%s'", results, expected, out)
+		}
+	}
+
+	test(nil, authres.ResultNone)
+	test([]authres.Result{
+		&authres.SPFResult{Value: authres.ResultPass, From: "example.org"},
+	}, authres.ResultPass)
+	test([]authres.Result{
+		&authres.SPFResult{Value: authres.ResultSoftFail, From: "example.org"},
+	}, authres.ResultNone)
+	test([]authres.Result{
+		&authres.SPFResult{Value: authres.ResultFail, From: "EXAMPLE.org"},
+	}, authres.ResultFail)
+	// SPF result for another domain (e.g. HELO) is not relevant.
+	test([]authres.Result{
+		&authres.SPFResult{Value: authres.ResultFail, Helo: "mx.example.com"},
+	}, authres.ResultNone)
+	test([]authres.Result{
+		&authres.SPFResult{Value: authres.ResultFail, From: "example.org"},
+		&authres.DKIMResult{Value: authres.ResultPass, Domain: "mail.example.org"},
+	}, authres.ResultPass)
+	test([]authres.Result{
+		&authres.SPFResult{Value: authres.ResultFail, From: "example.org"},
+		&authres.DKIMResult{Value: authres.ResultPass, Domain: "example.com"},
+		&authres.DKIMResult{Value: authres.ResultFail, Domain: "example.org"},
+	}, authres.ResultFail)
+}
+
 func TestExtractDomains(t *testing.T) {
 	type tCase struct {
 		hdr string
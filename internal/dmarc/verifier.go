@@ -55,6 +55,11 @@ type Verifier struct {
 	fetchCh     chan verifyData
 	fetchCancel context.CancelFunc
 
+	// Set by the first Apply call.
+	data       *verifyData
+	pctSampled bool
+	pctApply   bool
+
 	resolver Resolver
 
 	// TODO(GH #206): DMARC reporting
@@ -126,8 +131,15 @@ func (v *Verifier) FetchRecord(ctx context.Context, header textproto.Header) {
 //
 // Additionally, it relies on the math/rand default source to be initialized to determine
 // whether to apply a policy with the pct key.
+//
+// Apply can be called multiple times (e.g. once more results are available),
+// the fetched record and the pct sampling outcome are reused.
 func (v *Verifier) Apply(authRes []authres.Result) (EvalResult, Policy) {
-	data := <-v.fetchCh
+	if v.data == nil {
+		data := <-v.fetchCh
+		v.data = &data
+	}
+	data := *v.data
 	if data.recordErr != nil {
 		result := authres.DMARCResult{
 			Value:  authres.ResultPermError,
@@ -161,8 +173,14 @@ func (v *Verifier) Apply(authRes []authres.Result) (EvalResult, Policy) {
 		return result, dmarc.PolicyNone
 	}
 
-	if data.record.Percent != nil && rand.Int31n(100) > int32(*data.record.Percent) {
-		return result, dmarc.PolicyNone
+	if data.record.Percent != nil {
+		if !v.pctSampled {
+			v.pctApply = rand.Int31n(100) <= int32(*data.record.Percent)
+			v.pctSampled = true
+		}
+		if !v.pctApply {
+			return result, dmarc.PolicyNone
+		}
 	}
 
 	policy := data.record.Policy
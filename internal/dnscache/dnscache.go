@@ -0,0 +1,160 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package dnscache configures the DNS responses cache shared by modules
+// (see dns.Cache), exports its statistics and allows to purge it via
+// the control socket.
+package dnscache
+
+import (
+	"errors"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/internal/cacheflush"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DefaultMaxEntries  = 10000
+	DefaultMaxTTL      = time.Hour
+	DefaultNegativeTTL = 5 * time.Minute
+)
+
+// ErrDisabled is returned by control commands if the cache is disabled.
+var ErrDisabled = errors.New("dns_cache: cache is disabled")
+
+// PurgeResult is the result of the dns_cache.purge control command.
+type PurgeResult struct {
+	Removed int `json:"removed"`
+}
+
+// Default returns the cache used if the dns_cache directive is not
+// specified.
+func Default() (interface{}, error) {
+	return dns.NewCache(DefaultMaxEntries, DefaultMaxTTL, DefaultNegativeTTL), nil
+}
+
+// Directive parses the dns_cache global directive. The returned value is
+// *dns.Cache, nil if the cache is disabled.
+//
+//	dns_cache off
+//	dns_cache {
+//	    max_entries 10000
+//	    max_ttl 1h
+//	    negative_ttl 5m
+//	}
+func Directive(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) == 1 && node.Args[0] == "off" && len(node.Children) == 0 {
+		return (*dns.Cache)(nil), nil
+	}
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "expected 'off' or a configuration block")
+	}
+
+	var (
+		maxEntries          int
+		maxTTL, negativeTTL time.Duration
+	)
+	childM := config.NewMap(nil, node)
+	childM.Int("max_entries", false, false, DefaultMaxEntries, &maxEntries)
+	childM.Duration("max_ttl", false, false, DefaultMaxTTL, &maxTTL)
+	childM.Duration("negative_ttl", false, false, DefaultNegativeTTL, &negativeTTL)
+	if _, err := childM.Process(); err != nil {
+		return nil, err
+	}
+
+	if maxEntries <= 0 {
+		return nil, config.NodeErr(node, "max_entries should be positive")
+	}
+	if maxTTL <= 0 {
+		return nil, config.NodeErr(node, "max_ttl should be positive")
+	}
+	if negativeTTL < 0 {
+		return nil, config.NodeErr(node, "negative_ttl cannot be negative")
+	}
+
+	return dns.NewCache(maxEntries, maxTTL, negativeTTL), nil
+}
+
+// sharedCache flushes the cache set using dns.SetSharedCache.
+type sharedCache struct{}
+
+func (sharedCache) FlushCache(domain string) int {
+	c := dns.SharedCache()
+	if c == nil {
+		return 0
+	}
+	return c.Purge(domain)
+}
+
+func stats() dns.CacheStats {
+	c := dns.SharedCache()
+	if c == nil {
+		return dns.CacheStats{}
+	}
+	return c.Stats()
+}
+
+func init() {
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "dns_cache",
+			Name:      "hits_total",
+			Help:      "DNS lookups answered using the cache",
+		},
+		func() float64 { return float64(stats().Hits) },
+	))
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "dns_cache",
+			Name:      "misses_total",
+			Help:      "DNS lookups that were not found in the cache",
+		},
+		func() float64 { return float64(stats().Misses) },
+	))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "dns_cache",
+			Name:      "entries",
+			Help:      "Amount of DNS responses stored in the cache",
+		},
+		func() float64 { return float64(stats().Entries) },
+	))
+
+	cacheflush.Register("dns", "", sharedCache{})
+
+	control.Handle("dns_cache.stats", func(map[string]string) (interface{}, error) {
+		if dns.SharedCache() == nil {
+			return nil, ErrDisabled
+		}
+		return stats(), nil
+	})
+	control.Handle("dns_cache.purge", func(args map[string]string) (interface{}, error) {
+		c := dns.SharedCache()
+		if c == nil {
+			return nil, ErrDisabled
+		}
+		return PurgeResult{Removed: c.Purge(args["domain"])}, nil
+	})
+}
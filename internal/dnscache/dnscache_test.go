@@ -0,0 +1,43 @@
+package dnscache
+
+import (
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+func TestDirective(t *testing.T) {
+	val, err := Directive(nil, config.Node{Name: "dns_cache", Args: []string{"off"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val.(*dns.Cache) != nil {
+		t.Error("cache is not disabled")
+	}
+
+	val, err = Directive(nil, config.Node{
+		Name: "dns_cache",
+		Children: []config.Node{
+			{Name: "max_entries", Args: []string{"100"}},
+			{Name: "negative_ttl", Args: []string{"0s"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := val.(*dns.Cache)
+	if c.MaxEntries != 100 || c.MaxTTL != DefaultMaxTTL || c.NegativeTTL != 0 {
+		t.Errorf("wrong cache parameters: %d, %v, %v", c.MaxEntries, c.MaxTTL, c.NegativeTTL)
+	}
+
+	for _, children := range [][]config.Node{
+		{{Name: "max_entries", Args: []string{"0"}}},
+		{{Name: "max_ttl", Args: []string{"0s"}}},
+		{{Name: "negative_ttl", Args: []string{"-1m"}}},
+	} {
+		if _, err := Directive(nil, config.Node{Name: "dns_cache", Children: children}); err == nil {
+			t.Errorf("invalid configuration accepted: %v", children)
+		}
+	}
+}
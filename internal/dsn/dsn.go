@@ -25,8 +25,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"strings"
-	"text/template"
 	"time"
 
 	"github.com/emersion/go-message/textproto"
@@ -39,6 +39,10 @@ type ReportingMTAInfo struct {
 	ReportingMTA    string
 	ReceivedFromMTA string
 
+	// Envelope identifier set by the sender using the ENVID parameter
+	// (RFC 3461), included as 'Original-Envelope-Id' field.
+	EnvelopeID string
+
 	// Message sender address, included as 'X-Maddy-Sender: rfc822; ADDR' field.
 	XSender string
 
@@ -66,6 +70,10 @@ func (info ReportingMTAInfo) WriteTo(utf8 bool, w io.Writer) error {
 		return fmt.Errorf("dsn: cannot convert Reporting-MTA to a suitable representation: %w", err)
 	}
 
+	if info.EnvelopeID != "" {
+		h.Add("Original-Envelope-Id", encodeXtext(info.EnvelopeID))
+	}
+
 	h.Add("Reporting-MTA", "dns; "+reportingMTA)
 
 	if info.ReceivedFromMTA != "" {
@@ -117,11 +125,20 @@ type RecipientInfo struct {
 	FinalRecipient string
 	RemoteMTA      string
 
+	// Recipient address set by the sender using the ORCPT parameter
+	// (RFC 3461) and its type (e.g. "rfc822").
+	OriginalRecipientType string
+	OriginalRecipient     string
+
 	Action Action
 	Status smtp.EnhancedCode
 
 	// DiagnosticCode is the error that will be returned to the sender.
 	DiagnosticCode error
+
+	// WillRetryUntil is the time delivery attempts will stop for delayed
+	// recipients, zero if unknown.
+	WillRetryUntil time.Time
 }
 
 func (info RecipientInfo) WriteTo(utf8 bool, w io.Writer) error {
@@ -129,6 +146,10 @@ func (info RecipientInfo) WriteTo(utf8 bool, w io.Writer) error {
 	// MIME generator here.
 	h := textproto.Header{}
 
+	if info.OriginalRecipient != "" {
+		h.Add("Original-Recipient", strings.ToLower(info.OriginalRecipientType)+"; "+info.OriginalRecipient)
+	}
+
 	if info.FinalRecipient == "" {
 		return errors.New("dsn: Final-Recipient is required")
 	}
@@ -157,7 +178,7 @@ func (info RecipientInfo) WriteTo(utf8 bool, w io.Writer) error {
 		h.Add("Diagnostic-Code", fmt.Sprintf("smtp; %d %d.%d.%d %s",
 			smtpErr.Code, smtpErr.EnhancedCode[0], smtpErr.EnhancedCode[1], smtpErr.EnhancedCode[2],
 			strings.ReplaceAll(strings.ReplaceAll(smtpErr.Message, "\n", " "), "\r", " ")))
-	} else if utf8 {
+	} else if utf8 && info.DiagnosticCode != nil {
 		// It might contain Unicode, so don't include it if we are not allowed to.
 		// ... I didn't bother implementing mangling logic to remove Unicode
 		// characters.
@@ -176,6 +197,10 @@ func (info RecipientInfo) WriteTo(utf8 bool, w io.Writer) error {
 		h.Add("Remote-MTA", "dns; "+remoteMTA)
 	}
 
+	if info.Action == ActionDelayed && !info.WillRetryUntil.IsZero() {
+		h.Add("Will-Retry-Until", info.WillRetryUntil.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	}
+
 	return textproto.WriteHeader(w, h)
 }
 
@@ -187,8 +212,31 @@ type Envelope struct {
 
 // GenerateDSN is a top-level function that should be used for generation of the DSNs.
 //
+// tmpl is used for the human-readable part, DefaultTemplate is used if it
+// is nil. If all recipients have ActionDelayed, the report is a warning
+// about delayed delivery and the text for it is used. Similarly, if all
+// recipients have ActionDelivered or ActionRelayed, the report is about
+// successful delivery. DefaultTemplate is used if tmpl does not define the
+// text for these reports.
+//
+// If body is not nil, the message body is included after the header as
+// requested using RET=FULL (RFC 3461).
+//
 // DSN header will be returned, body itself will be written to outWriter.
-func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
+func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, header textproto.Header, body io.Reader, tmpl *Template, outWriter io.Writer) (textproto.Header, error) {
+	if tmpl == nil {
+		tmpl = DefaultTemplate
+	}
+	kind := kindOf(rcptsInfo)
+	if !tmpl.has(kind) {
+		tmpl = DefaultTemplate
+	}
+	data := templateData(mtaInfo, rcptsInfo)
+	subject, err := tmpl.subject(data, kind)
+	if err != nil {
+		return textproto.Header{}, fmt.Errorf("dsn: %w", err)
+	}
+
 	partWriter := textproto.NewMultipartWriter(outWriter)
 
 	reportHeader := textproto.Header{}
@@ -200,17 +248,58 @@ func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsIn
 	reportHeader.Add("Auto-Submitted", "auto-replied")
 	reportHeader.Add("To", envelope.To)
 	reportHeader.Add("From", envelope.From)
-	reportHeader.Add("Subject", "Undelivered Mail Returned to Sender")
+	reportHeader.Add("Subject", mime.QEncoding.Encode("utf-8", subject))
 
 	defer partWriter.Close()
 
-	if err := writeHumanReadablePart(partWriter, mtaInfo, rcptsInfo); err != nil {
+	if err := writeHumanReadablePart(partWriter, tmpl, data, kind); err != nil {
 		return textproto.Header{}, err
 	}
 	if err := writeMachineReadablePart(utf8, partWriter, mtaInfo, rcptsInfo); err != nil {
 		return textproto.Header{}, err
 	}
-	return reportHeader, writeHeader(utf8, partWriter, failedHeader)
+	if body != nil {
+		return reportHeader, writeMessage(utf8, partWriter, header, body)
+	}
+	return reportHeader, writeHeader(utf8, partWriter, header)
+}
+
+// kindOf returns the type of the report for the recipients.
+func kindOf(rcptsInfo []RecipientInfo) reportKind {
+	if len(rcptsInfo) == 0 {
+		return reportFailed
+	}
+	kind := reportFailed
+	for i, rcpt := range rcptsInfo {
+		var rcptKind reportKind
+		switch rcpt.Action {
+		case ActionDelayed:
+			rcptKind = reportDelayed
+		case ActionDelivered, ActionRelayed, ActionExpanded:
+			rcptKind = reportDelivered
+		default:
+			return reportFailed
+		}
+		if i != 0 && rcptKind != kind {
+			return reportFailed
+		}
+		kind = rcptKind
+	}
+	return kind
+}
+
+// encodeXtext encodes the value as xtext defined in RFC 3461, Section 4.
+func encodeXtext(raw string) string {
+	var b strings.Builder
+	for i := 0; i < len(raw); i++ {
+		ch := raw[i]
+		if ch < '!' || ch > '~' || ch == '+' || ch == '=' {
+			fmt.Fprintf(&b, "+%02X", ch)
+			continue
+		}
+		b.WriteByte(ch)
+	}
+	return b.String()
 }
 
 func writeHeader(utf8 bool, w *textproto.MultipartWriter, header textproto.Header) error {
@@ -229,6 +318,26 @@ func writeHeader(utf8 bool, w *textproto.MultipartWriter, header textproto.Heade
 	return textproto.WriteHeader(headerWriter, header)
 }
 
+func writeMessage(utf8 bool, w *textproto.MultipartWriter, header textproto.Header, body io.Reader) error {
+	partHeader := textproto.Header{}
+	partHeader.Add("Content-Description", "Undelivered message")
+	if utf8 {
+		partHeader.Add("Content-Type", "message/global")
+	} else {
+		partHeader.Add("Content-Type", "message/rfc822")
+	}
+	partHeader.Add("Content-Transfer-Encoding", "8bit")
+	msgWriter, err := w.CreatePart(partHeader)
+	if err != nil {
+		return err
+	}
+	if err := textproto.WriteHeader(msgWriter, header); err != nil {
+		return err
+	}
+	_, err = io.Copy(msgWriter, body)
+	return err
+}
+
 func writeMachineReadablePart(utf8 bool, w *textproto.MultipartWriter, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) error {
 	machineHeader := textproto.Header{}
 	if utf8 {
@@ -255,44 +364,18 @@ func writeMachineReadablePart(utf8 bool, w *textproto.MultipartWriter, mtaInfo R
 	return nil
 }
 
-// failedText is the text of the human-readable part of DSN.
-var failedText = template.Must(template.New("dsn-text").Parse(`
-This is the mail delivery system at {{.ReportingMTA}}.
-
-Unfortunately, your message could not be delivered to one or more
-recipients. The usual cause of this problem is invalid
-recipient address or maintenance at the recipient side.
-
-Contact the postmaster for further assistance, provide the Message ID (below):
-
-Message ID: {{.XMessageID}}
-Arrival: {{.ArrivalDate}}
-Last delivery attempt: {{.LastAttemptDate}}
-
-`))
-
-func writeHumanReadablePart(w *textproto.MultipartWriter, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) error {
+func writeHumanReadablePart(w *textproto.MultipartWriter, tmpl *Template, data TemplateData, kind reportKind) error {
 	humanHeader := textproto.Header{}
 	humanHeader.Add("Content-Transfer-Encoding", "8bit")
 	humanHeader.Add("Content-Type", `text/plain; charset="utf-8"`)
 	humanHeader.Add("Content-Description", "Notification")
+	if tmpl.Lang != "" {
+		humanHeader.Add("Content-Language", tmpl.Lang)
+	}
 	humanWriter, err := w.CreatePart(humanHeader)
 	if err != nil {
 		return err
 	}
 
-	mtaInfo.ArrivalDate = mtaInfo.ArrivalDate.Truncate(time.Second)
-	mtaInfo.LastAttemptDate = mtaInfo.LastAttemptDate.Truncate(time.Second)
-
-	if err := failedText.Execute(humanWriter, mtaInfo); err != nil {
-		return err
-	}
-
-	for _, rcpt := range rcptsInfo {
-		if _, err := fmt.Fprintf(humanWriter, "Delivery to %s failed with error: %v\n", rcpt.FinalRecipient, rcpt.DiagnosticCode); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return tmpl.execute(humanWriter, data, kind)
 }
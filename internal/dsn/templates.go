@@ -0,0 +1,377 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dsn
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/dns"
+	"golang.org/x/text/language"
+)
+
+const (
+	defaultSubject          = "Undelivered Mail Returned to Sender"
+	defaultDelayedSubject   = "Delayed Mail (still being retried)"
+	defaultDeliveredSubject = "Successful Mail Delivery Report"
+
+	// delayedTemplateName and delayedSubjectName are names of templates
+	// used for reports about delayed delivery.
+	delayedTemplateName = "delayed"
+	delayedSubjectName  = "delayed_subject"
+
+	// deliveredTemplateName and deliveredSubjectName are names of templates
+	// used for reports about successful delivery.
+	deliveredTemplateName = "delivered"
+	deliveredSubjectName  = "delivered_subject"
+
+	// templateExt is the extension of template files.
+	templateExt = ".tmpl"
+
+	// defaultTemplateName is the name (without extension) of the template
+	// used if no template matches the preferred languages.
+	defaultTemplateName = "default"
+)
+
+// defaultText is the text of the human-readable part of DSN used if no
+// templates are configured.
+var defaultText = template.Must(template.New("dsn-text").Parse(`
+This is the mail delivery system at {{.ReportingMTA}}.
+
+Unfortunately, your message could not be delivered to one or more
+recipients. The usual cause of this problem is invalid
+recipient address or maintenance at the recipient side.
+
+Contact the postmaster for further assistance, provide the Message ID (below):
+
+Message ID: {{.XMessageID}}
+Arrival: {{.ArrivalDate}}
+Last delivery attempt: {{.LastAttemptDate}}
+
+{{range .Recipients -}}
+Delivery to {{.FinalRecipient}} failed with error: {{.DiagnosticCode}}
+{{end -}}
+
+{{- define "delayed"}}
+This is the mail delivery system at {{.ReportingMTA}}.
+
+Your message could not be delivered to one or more recipients yet.
+Delivery will be retried, this is a warning only and you do not need
+to resend the message. You will be notified if the message cannot be
+delivered.
+
+Message ID: {{.XMessageID}}
+Arrival: {{.ArrivalDate}}
+Last delivery attempt: {{.LastAttemptDate}}
+{{- if not .WillRetryUntil.IsZero}}
+Will retry until: {{.WillRetryUntil}}
+{{- end}}
+
+{{range .Recipients -}}
+Delivery to {{.FinalRecipient}} is delayed: {{.DiagnosticCode}}
+{{end -}}
+{{end}}
+
+{{- define "delivered"}}
+This is the mail delivery system at {{.ReportingMTA}}.
+
+Your message was delivered to the recipients listed below. This report
+was sent because it was requested when the message was submitted.
+
+Message ID: {{.XMessageID}}
+Arrival: {{.ArrivalDate}}
+
+{{range .Recipients -}}
+{{if eq .Action "relayed" -}}
+Message for {{.FinalRecipient}} was relayed to a server that does not send delivery reports.
+{{else -}}
+Delivered to {{.FinalRecipient}}.
+{{end -}}
+{{end -}}
+{{end}}`))
+
+// Template is the template for the human-readable part of DSN.
+//
+// Template body is the text of the part. If the template defines a
+// "subject" template, it is used for the DSN subject. Reports about
+// delayed delivery use "delayed" and "delayed_subject" templates instead,
+// reports about successful delivery use "delivered" and "delivered_subject".
+type Template struct {
+	// Language tag of the template text, empty if unknown.
+	Lang string
+
+	tmpl *template.Template
+}
+
+// DefaultTemplate is the built-in English template.
+var DefaultTemplate = &Template{Lang: "en", tmpl: defaultText}
+
+// TemplateRecipient is the per-recipient information available in templates.
+type TemplateRecipient struct {
+	FinalRecipient string
+	Action         Action
+	Status         string
+	DiagnosticCode string
+}
+
+// TemplateData is the information available in templates.
+type TemplateData struct {
+	ReportingMTA    string
+	XSender         string
+	XMessageID      string
+	ArrivalDate     time.Time
+	LastAttemptDate time.Time
+	// WillRetryUntil is the time delivery attempts will stop for delayed
+	// recipients, zero if unknown.
+	WillRetryUntil time.Time
+	Recipients     []TemplateRecipient
+}
+
+func templateData(mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) TemplateData {
+	data := TemplateData{
+		ReportingMTA:    mtaInfo.ReportingMTA,
+		XSender:         mtaInfo.XSender,
+		XMessageID:      mtaInfo.XMessageID,
+		ArrivalDate:     mtaInfo.ArrivalDate.Truncate(time.Second),
+		LastAttemptDate: mtaInfo.LastAttemptDate.Truncate(time.Second),
+		Recipients:      make([]TemplateRecipient, 0, len(rcptsInfo)),
+	}
+	for _, rcpt := range rcptsInfo {
+		tr := TemplateRecipient{
+			FinalRecipient: rcpt.FinalRecipient,
+			Action:         rcpt.Action,
+			Status:         fmt.Sprintf("%d.%d.%d", rcpt.Status[0], rcpt.Status[1], rcpt.Status[2]),
+		}
+		if rcpt.DiagnosticCode != nil {
+			tr.DiagnosticCode = rcpt.DiagnosticCode.Error()
+		}
+		data.Recipients = append(data.Recipients, tr)
+
+		if rcpt.WillRetryUntil.After(data.WillRetryUntil) {
+			data.WillRetryUntil = rcpt.WillRetryUntil.Truncate(time.Second)
+		}
+	}
+	return data
+}
+
+// reportKind is the type of report the human-readable part is generated
+// for.
+type reportKind int
+
+const (
+	reportFailed reportKind = iota
+	reportDelayed
+	reportDelivered
+)
+
+// names returns names of the text and subject templates for the report
+// and the subject to use if the template does not define it.
+func (k reportKind) names() (text, subject, defSubject string) {
+	switch k {
+	case reportDelayed:
+		return delayedTemplateName, delayedSubjectName, defaultDelayedSubject
+	case reportDelivered:
+		return deliveredTemplateName, deliveredSubjectName, defaultDeliveredSubject
+	default:
+		return "", "subject", defaultSubject
+	}
+}
+
+// has reports whether the template defines the text for the report.
+func (t *Template) has(kind reportKind) bool {
+	name, _, _ := kind.names()
+	return name == "" || t.tmpl.Lookup(name) != nil
+}
+
+func (t *Template) execute(w io.Writer, data TemplateData, kind reportKind) error {
+	if name, _, _ := kind.names(); name != "" {
+		return t.tmpl.ExecuteTemplate(w, name, data)
+	}
+	return t.tmpl.Execute(w, data)
+}
+
+// subject returns the DSN subject as defined by the template.
+func (t *Template) subject(data TemplateData, kind reportKind) (string, error) {
+	_, name, def := kind.names()
+
+	subjTmpl := t.tmpl.Lookup(name)
+	if subjTmpl == nil {
+		return def, nil
+	}
+	var b bytes.Buffer
+	if err := subjTmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	subject := strings.Join(strings.Fields(b.String()), " ")
+	if subject == "" {
+		return def, nil
+	}
+	return subject, nil
+}
+
+// Templates is a set of per-domain DSN templates for different languages.
+type Templates struct {
+	// Domain -> template name -> template. Empty domain is used for the
+	// global templates.
+	domains map[string]map[string]*Template
+}
+
+// LoadTemplates reads DSN templates from the directory.
+//
+// Templates are read from files named "LANG.tmpl" where LANG is the BCP 47
+// language tag (e.g. "de.tmpl"). "default.tmpl" is used if no template matches
+// the preferred languages. Templates for a specific domain are read from
+// the subdirectory named after the domain and take precedence over
+// global ones.
+func LoadTemplates(dir string) (*Templates, error) {
+	t := &Templates{domains: map[string]map[string]*Template{}}
+
+	global, err := loadTemplatesDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	t.domains[""] = global
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		domain, err := dns.ForLookup(entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("dsn: invalid domain directory %s: %w", entry.Name(), err)
+		}
+		templates, err := loadTemplatesDir(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		t.domains[domain] = templates
+	}
+
+	return t, nil
+}
+
+func loadTemplatesDir(dir string) (map[string]*Template, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+templateExt))
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make(map[string]*Template, len(files))
+	for _, path := range files {
+		name := strings.TrimSuffix(filepath.Base(path), templateExt)
+
+		lang := ""
+		if name != defaultTemplateName {
+			tag, err := language.Parse(name)
+			if err != nil {
+				return nil, fmt.Errorf("dsn: template file name %s is not a language tag: %w", path, err)
+			}
+			lang = tag.String()
+			name = lang
+		}
+
+		text, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New(filepath.Base(path)).Parse(string(text))
+		if err != nil {
+			return nil, fmt.Errorf("dsn: %w", err)
+		}
+		templates[name] = &Template{Lang: lang, tmpl: tmpl}
+	}
+	return templates, nil
+}
+
+// Select returns the template to use for the DSN.
+//
+// domains are checked in order, global templates are used if there are no
+// templates for any of them. Template is selected using the language
+// preferences, a list of BCP 47 language tags (as in Accept-Language header
+// field).
+func (t *Templates) Select(domains []string, langs []string) *Template {
+	if t == nil {
+		return DefaultTemplate
+	}
+
+	for _, domain := range domains {
+		domain, err := dns.ForLookup(domain)
+		if err != nil {
+			continue
+		}
+		if templates := t.domains[domain]; len(templates) != 0 {
+			return selectLang(templates, langs)
+		}
+	}
+	if templates := t.domains[""]; len(templates) != 0 {
+		return selectLang(templates, langs)
+	}
+	return DefaultTemplate
+}
+
+func selectLang(templates map[string]*Template, langs []string) *Template {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		if name != defaultTemplateName {
+			names = append(names, name)
+		}
+	}
+	// Make the choice deterministic in case of equally good matches.
+	sort.Strings(names)
+
+	supported := make([]language.Tag, 0, len(names))
+	for _, name := range names {
+		supported = append(supported, language.Make(name))
+	}
+
+	var preferred []language.Tag
+	for _, lang := range langs {
+		tags, _, err := language.ParseAcceptLanguage(lang)
+		if err != nil {
+			continue
+		}
+		preferred = append(preferred, tags...)
+	}
+
+	if len(supported) != 0 && len(preferred) != 0 {
+		_, indx, conf := language.NewMatcher(supported).Match(preferred...)
+		if conf != language.No {
+			return templates[names[indx]]
+		}
+	}
+
+	if tmpl := templates[defaultTemplateName]; tmpl != nil {
+		return tmpl
+	}
+	if tmpl := templates["en"]; tmpl != nil {
+		return tmpl
+	}
+	return DefaultTemplate
+}
@@ -0,0 +1,307 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dsn
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func writeTemplate(t *testing.T, path, text string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTemplates_Select(t *testing.T) {
+	dir := testutils.Dir(t)
+	writeTemplate(t, filepath.Join(dir, "default.tmpl"), "global default")
+	writeTemplate(t, filepath.Join(dir, "de.tmpl"), "global de")
+	writeTemplate(t, filepath.Join(dir, "example.org", "en.tmpl"), "example.org en")
+	writeTemplate(t, filepath.Join(dir, "example.org", "fr.tmpl"), "example.org fr")
+
+	templates, err := LoadTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test := func(domains, langs []string, expected string) {
+		t.Helper()
+		var b bytes.Buffer
+		if err := templates.Select(domains, langs).execute(&b, TemplateData{}, reportFailed); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != expected {
+			t.Errorf("Wrong template selected for %v, %v: %q, expected %q", domains, langs, b.String(), expected)
+		}
+	}
+
+	test(nil, nil, "global default")
+	test([]string{"example.com"}, []string{"de-DE"}, "global de")
+	test([]string{"example.com"}, []string{"ja"}, "global default")
+	test([]string{"EXAMPLE.org"}, nil, "example.org en")
+	test([]string{"example.com", "example.org"}, []string{"fr-CA, en;q=0.5"}, "example.org fr")
+	test([]string{"example.org"}, []string{"de"}, "example.org en")
+}
+
+func TestLoadTemplates_InvalidName(t *testing.T) {
+	dir := testutils.Dir(t)
+	writeTemplate(t, filepath.Join(dir, "not a language.tmpl"), "text")
+	if _, err := LoadTemplates(dir); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
+func TestGenerateDSN_Template(t *testing.T) {
+	dir := testutils.Dir(t)
+	writeTemplate(t, filepath.Join(dir, "de.tmpl"), `{{define "subject"}}Unzustellbar: {{.XMessageID}}{{end -}}
+Nachricht konnte nicht zugestellt werden:
+{{range .Recipients}}{{.FinalRecipient}}: {{.Status}}
+{{end}}`)
+	templates, err := LoadTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	hdr, err := GenerateDSN(false, Envelope{
+		MsgID: "<dsn@example.org>",
+		From:  "MAILER-DAEMON@example.org",
+		To:    "sender@example.org",
+	}, ReportingMTAInfo{
+		ReportingMTA: "mx.example.org",
+		XMessageID:   "abcdef",
+	}, []RecipientInfo{{
+		FinalRecipient: "rcpt@example.com",
+		Action:         ActionFailed,
+		Status:         smtp.EnhancedCode{5, 1, 1},
+		DiagnosticCode: &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"},
+	}}, textproto.Header{}, nil, templates.Select(nil, []string{"de"}), &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if subj := hdr.Get("Subject"); subj != "Unzustellbar: abcdef" {
+		t.Errorf("Wrong subject: %q", subj)
+	}
+	body := b.String()
+	for _, part := range []string{
+		"Content-Language: de",
+		"Nachricht konnte nicht zugestellt werden:\nrcpt@example.com: 5.1.1\n",
+		"Final-Recipient: rfc822; rcpt@example.com",
+		"Diagnostic-Code: smtp; 550 5.1.1 No such user",
+	} {
+		if !strings.Contains(body, part) {
+			t.Errorf("DSN body does not contain %q:\n%s", part, body)
+		}
+	}
+}
+
+func TestGenerateDSN_Delayed(t *testing.T) {
+	dir := testutils.Dir(t)
+	writeTemplate(t, filepath.Join(dir, "de.tmpl"), `Nachricht konnte nicht zugestellt werden.`)
+	writeTemplate(t, filepath.Join(dir, "fr.tmpl"), `{{define "delayed_subject"}}Retardé: {{.XMessageID}}{{end -}}
+{{define "delayed"}}Livraison retardée:
+{{range .Recipients}}{{.FinalRecipient}}: {{.Status}}
+{{end}}{{end -}}
+Message non délivré.`)
+	templates, err := LoadTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generate := func(lang string) (textproto.Header, string) {
+		t.Helper()
+		var b bytes.Buffer
+		hdr, err := GenerateDSN(false, Envelope{
+			MsgID: "<dsn@example.org>",
+			From:  "MAILER-DAEMON@example.org",
+			To:    "sender@example.org",
+		}, ReportingMTAInfo{
+			ReportingMTA: "mx.example.org",
+			XMessageID:   "abcdef",
+		}, []RecipientInfo{{
+			FinalRecipient: "rcpt@example.com",
+			Action:         ActionDelayed,
+			Status:         smtp.EnhancedCode{4, 4, 1},
+			DiagnosticCode: &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 4, 1}, Message: "Connection timed out"},
+		}}, textproto.Header{}, nil, templates.Select(nil, []string{lang}), &b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hdr, b.String()
+	}
+
+	// Template without the delayed text, built-in one is used.
+	hdr, body := generate("de")
+	if subj := hdr.Get("Subject"); subj != defaultDelayedSubject {
+		t.Errorf("Wrong subject: %q", subj)
+	}
+	for _, part := range []string{
+		"Content-Language: en",
+		"Delivery to rcpt@example.com is delayed: SMTP error 451: Connection timed out",
+		"Action: delayed",
+		"Status: 4.4.1",
+	} {
+		if !strings.Contains(body, part) {
+			t.Errorf("DSN body does not contain %q:\n%s", part, body)
+		}
+	}
+
+	hdr, body = generate("fr")
+	if subj := hdr.Get("Subject"); !strings.Contains(subj, "abcdef") {
+		t.Errorf("Wrong subject: %q", subj)
+	}
+	if !strings.Contains(body, "Livraison retardée:\nrcpt@example.com: 4.4.1\n") {
+		t.Errorf("Delayed template is not used:\n%s", body)
+	}
+	if strings.Contains(body, "Message non délivré.") {
+		t.Errorf("Failure text is used for the delayed DSN:\n%s", body)
+	}
+}
+
+func TestGenerateDSN_WillRetryUntil(t *testing.T) {
+	until := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	generate := func(action Action) string {
+		t.Helper()
+		var b bytes.Buffer
+		_, err := GenerateDSN(false, Envelope{
+			MsgID: "<dsn@example.org>",
+			From:  "MAILER-DAEMON@example.org",
+			To:    "sender@example.org",
+		}, ReportingMTAInfo{
+			ReportingMTA: "mx.example.org",
+			XMessageID:   "abcdef",
+		}, []RecipientInfo{{
+			FinalRecipient: "rcpt@example.com",
+			Action:         action,
+			Status:         smtp.EnhancedCode{4, 4, 1},
+			DiagnosticCode: &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 4, 1}, Message: "Connection timed out"},
+			WillRetryUntil: until,
+		}}, textproto.Header{}, nil, nil, &b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+
+	body := generate(ActionDelayed)
+	for _, part := range []string{
+		"Will-Retry-Until: Thu, 2 Jan 2020 03:04:05 +0000",
+		"Will retry until: " + until.String(),
+	} {
+		if !strings.Contains(body, part) {
+			t.Errorf("DSN body does not contain %q:\n%s", part, body)
+		}
+	}
+
+	body = generate(ActionFailed)
+	if strings.Contains(body, "Will-Retry-Until") {
+		t.Errorf("Will-Retry-Until is included for the failed recipient:\n%s", body)
+	}
+}
+
+func TestGenerateDSN_Delivered(t *testing.T) {
+	var b bytes.Buffer
+	hdr, err := GenerateDSN(false, Envelope{
+		MsgID: "<dsn@example.org>",
+		From:  "MAILER-DAEMON@example.org",
+		To:    "sender@example.org",
+	}, ReportingMTAInfo{
+		ReportingMTA: "mx.example.org",
+		XMessageID:   "abcdef",
+		EnvelopeID:   "QQ314159",
+	}, []RecipientInfo{{
+		FinalRecipient:        "rcpt@example.com",
+		OriginalRecipientType: "rfc822",
+		OriginalRecipient:     "orig@example.com",
+		Action:                ActionDelivered,
+		Status:                smtp.EnhancedCode{2, 0, 0},
+	}}, textproto.Header{}, nil, nil, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if subj := hdr.Get("Subject"); subj != defaultDeliveredSubject {
+		t.Errorf("Wrong subject: %q", subj)
+	}
+	body := b.String()
+	for _, part := range []string{
+		"Original-Envelope-Id: QQ314159",
+		"Original-Recipient: rfc822; orig@example.com",
+		"Action: delivered",
+		"Status: 2.0.0",
+	} {
+		if !strings.Contains(body, part) {
+			t.Errorf("DSN body does not contain %q:\n%s", part, body)
+		}
+	}
+	if strings.Contains(body, "Diagnostic-Code") {
+		t.Errorf("Diagnostic-Code is included for the delivered recipient:\n%s", body)
+	}
+}
+
+func TestGenerateDSN_ReturnFull(t *testing.T) {
+	var b bytes.Buffer
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Hello")
+	_, err := GenerateDSN(false, Envelope{
+		MsgID: "<dsn@example.org>",
+		From:  "MAILER-DAEMON@example.org",
+		To:    "sender@example.org",
+	}, ReportingMTAInfo{
+		ReportingMTA: "mx.example.org",
+		XMessageID:   "abcdef",
+	}, []RecipientInfo{{
+		FinalRecipient: "rcpt@example.com",
+		Action:         ActionFailed,
+		Status:         smtp.EnhancedCode{5, 1, 1},
+		DiagnosticCode: &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"},
+	}}, hdr, strings.NewReader("original body\r\n"), nil, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := b.String()
+	for _, part := range []string{
+		"Content-Type: message/rfc822",
+		"Subject: Hello",
+		"original body",
+	} {
+		if !strings.Contains(body, part) {
+			t.Errorf("DSN body does not contain %q:\n%s", part, body)
+		}
+	}
+	if strings.Contains(body, "text/rfc822-headers") {
+		t.Errorf("Headers-only part is included along with the full message:\n%s", body)
+	}
+}
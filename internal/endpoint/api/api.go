@@ -0,0 +1,206 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package api implements the HTTP endpoint for management of a running
+// server.
+//
+// It exposes the operations otherwise available only via maddy subcommands:
+// credentials management, storage accounts and mailboxes management and
+// queue inspection. Requests are authenticated using the bearer token set in
+// the configuration.
+package api
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	stdlog "log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target/queue"
+)
+
+const modName = "api"
+
+// Queue is the interface of queue modules that allow to inspect and
+// cancel their contents, see queue.Queue.
+type Queue interface {
+	Messages() ([]queue.MessageInfo, error)
+	Message(id string) (queue.MessageInfo, error)
+	Cancel(id string) (queue.CancelResult, error)
+}
+
+type Endpoint struct {
+	addrs  []string
+	logger log.Logger
+
+	token     string
+	tlsConfig *tls.Config
+
+	creds   module.PlainUserDB
+	storage module.ManageableStorage
+	queue   Queue
+
+	listenersWg sync.WaitGroup
+	serv        http.Server
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	return &Endpoint{
+		addrs:  args,
+		logger: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	cfg.Bool("debug", false, false, &e.logger.Debug)
+	cfg.String("token", false, true, "", &e.token)
+	cfg.Custom("tls", true, false, nil, tls2.TLSDirective, &e.tlsConfig)
+	cfg.Custom("credentials", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var db module.PlainUserDB
+		if err := modconfig.ModuleFromNode("auth", node.Args, node, m.Globals, &db); err != nil {
+			return nil, err
+		}
+		return db, nil
+	}, &e.creds)
+	cfg.Custom("storage", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var backend module.ManageableStorage
+		if err := modconfig.ModuleFromNode("storage", node.Args, node, m.Globals, &backend); err != nil {
+			return nil, err
+		}
+		return backend, nil
+	}, &e.storage)
+	cfg.Custom("queue", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var q Queue
+		if err := modconfig.ModuleFromNode("target", node.Args, node, m.Globals, &q); err != nil {
+			return nil, err
+		}
+		return q, nil
+	}, &e.queue)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(e.token) < 16 {
+		return fmt.Errorf("%s: token should be at least 16 characters long", modName)
+	}
+
+	e.serv.Handler = e.handler()
+	e.serv.ReadHeaderTimeout = 30 * time.Second
+	e.serv.ErrorLog = stdlog.New(e.logger.DebugWriter(), "", 0)
+
+	if module.NoRun {
+		return nil
+	}
+
+	for _, a := range e.addrs {
+		endp, err := config.ParseEndpoint(a)
+		if err != nil {
+			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
+		}
+		l, err := net.Listen(endp.Network(), endp.Address())
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+		if endp.IsTLS() {
+			if e.tlsConfig == nil {
+				l.Close()
+				return fmt.Errorf("%s: can't bind on TLS endpoint without TLS configuration", modName)
+			}
+			l = tls.NewListener(l, e.tlsConfig)
+		}
+
+		e.listenersWg.Add(1)
+		go func() {
+			e.logger.Println("listening on", endp.String())
+			err := e.serv.Serve(l)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				e.logger.Error("serve failed", err, "endpoint", a)
+			}
+			e.listenersWg.Done()
+		}()
+	}
+
+	return nil
+}
+
+// handler returns the HTTP handler serving all API requests.
+func (e *Endpoint) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /v1/credentials", e.credsList)
+	mux.HandleFunc("POST /v1/credentials", e.credsCreate)
+	mux.HandleFunc("PUT /v1/credentials/{username}/password", e.credsPassword)
+	mux.HandleFunc("DELETE /v1/credentials/{username}", e.credsDelete)
+
+	mux.HandleFunc("GET /v1/accounts", e.acctsList)
+	mux.HandleFunc("POST /v1/accounts", e.acctsCreate)
+	mux.HandleFunc("DELETE /v1/accounts/{username}", e.acctsDelete)
+	mux.HandleFunc("GET /v1/accounts/{username}/mailboxes", e.mboxesList)
+	mux.HandleFunc("POST /v1/accounts/{username}/mailboxes", e.mboxesCreate)
+	mux.HandleFunc("DELETE /v1/accounts/{username}/mailboxes/{name...}", e.mboxesDelete)
+
+	mux.HandleFunc("GET /v1/queue", e.queueList)
+	mux.HandleFunc("GET /v1/queue/{id}", e.queueGet)
+	mux.HandleFunc("DELETE /v1/queue/{id}", e.queueCancel)
+
+	return e.authenticated(mux)
+}
+
+func (e *Endpoint) authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(e.token)) != 1 {
+			e.logger.Msg("authentication failed", "src_ip", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="maddy"`)
+			writeError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return ""
+}
+
+func (e *Endpoint) Close() error {
+	if err := e.serv.Close(); err != nil {
+		return err
+	}
+	e.listenersWg.Wait()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
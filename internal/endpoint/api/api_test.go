@@ -0,0 +1,372 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/pass_table"
+	"github.com/foxcpp/maddy/internal/target/queue"
+)
+
+const testToken = "0123456789abcdef"
+
+type memUserDB map[string]string
+
+func (db memUserDB) AuthPlain(username, password string) error {
+	if pass, ok := db[username]; !ok || pass != password {
+		return errors.New("invalid credentials")
+	}
+	return nil
+}
+
+func (db memUserDB) ListUsers() ([]string, error) {
+	users := make([]string, 0, len(db))
+	for u := range db {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+func (db memUserDB) CreateUser(username, password string) error {
+	if _, ok := db[username]; ok {
+		return pass_table.ErrCredentialsExist
+	}
+	db[username] = password
+	return nil
+}
+
+func (db memUserDB) SetUserPassword(username, password string) error {
+	db[username] = password
+	return nil
+}
+
+func (db memUserDB) DeleteUser(username string) error {
+	delete(db, username)
+	return nil
+}
+
+type memUser struct {
+	imapbackend.User
+	mboxes map[string]string
+}
+
+func (u *memUser) ListMailboxes(bool) ([]imap.MailboxInfo, error) {
+	var res []imap.MailboxInfo
+	for name, attr := range u.mboxes {
+		info := imap.MailboxInfo{Name: name}
+		if attr != "" {
+			info.Attributes = []string{attr}
+		}
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+func (u *memUser) CreateMailbox(name string) error {
+	return u.CreateMailboxSpecial(name, "")
+}
+
+func (u *memUser) CreateMailboxSpecial(name, attr string) error {
+	if _, ok := u.mboxes[name]; ok {
+		return imapbackend.ErrMailboxAlreadyExists
+	}
+	u.mboxes[name] = attr
+	return nil
+}
+
+func (u *memUser) DeleteMailbox(name string) error {
+	if _, ok := u.mboxes[name]; !ok {
+		return imapbackend.ErrNoSuchMailbox
+	}
+	delete(u.mboxes, name)
+	return nil
+}
+
+type memStorage struct {
+	module.ManageableStorage
+	accts map[string]*memUser
+}
+
+func (s *memStorage) ListIMAPAccts() ([]string, error) {
+	accts := make([]string, 0, len(s.accts))
+	for a := range s.accts {
+		accts = append(accts, a)
+	}
+	sort.Strings(accts)
+	return accts, nil
+}
+
+func (s *memStorage) CreateIMAPAcct(username string) error {
+	if _, ok := s.accts[username]; ok {
+		return imapsql.ErrUserAlreadyExists
+	}
+	s.accts[username] = &memUser{mboxes: map[string]string{"INBOX": ""}}
+	return nil
+}
+
+func (s *memStorage) DeleteIMAPAcct(username string) error {
+	if _, ok := s.accts[username]; !ok {
+		return imapsql.ErrUserDoesntExists
+	}
+	delete(s.accts, username)
+	return nil
+}
+
+func (s *memStorage) GetIMAPAcct(username string) (imapbackend.User, error) {
+	u, ok := s.accts[username]
+	if !ok {
+		return nil, imapsql.ErrUserDoesntExists
+	}
+	return u, nil
+}
+
+type memQueue []queue.MessageInfo
+
+func (q memQueue) Messages() ([]queue.MessageInfo, error) {
+	return q, nil
+}
+
+func (q memQueue) Message(id string) (queue.MessageInfo, error) {
+	for _, msg := range q {
+		if msg.ID == id {
+			return msg, nil
+		}
+	}
+	return queue.MessageInfo{}, queue.ErrNoSuchMessage
+}
+
+func (q memQueue) Cancel(id string) (queue.CancelResult, error) {
+	if id == "busy" {
+		return queue.CancelResult{}, queue.ErrDeliveryInProgress
+	}
+	msg, err := q.Message(id)
+	if err != nil {
+		return queue.CancelResult{}, err
+	}
+	return queue.CancelResult{ID: msg.ID, Cancelled: msg.To}, nil
+}
+
+func testEndpoint() *Endpoint {
+	return &Endpoint{
+		logger:  log.Logger{Out: log.NopOutput{}},
+		token:   testToken,
+		creds:   memUserDB{},
+		storage: &memStorage{accts: map[string]*memUser{}},
+	}
+}
+
+func doRequest(t *testing.T, h http.Handler, method, path, body string, out interface{}) int {
+	t.Helper()
+
+	var req *http.Request
+	if body != "" {
+		req = httptest.NewRequest(method, path, strings.NewReader(body))
+	} else {
+		req = httptest.NewRequest(method, path, nil)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if out != nil && rec.Code < 300 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: malformed response: %v", method, path, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAuthentication(t *testing.T) {
+	h := testEndpoint().handler()
+
+	for _, auth := range []string{"", "Bearer wrong", "Basic " + testToken, testToken} {
+		req := httptest.NewRequest("GET", "/v1/credentials", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: expected 401, got %d", auth, rec.Code)
+		}
+	}
+
+	if code := doRequest(t, h, "GET", "/v1/credentials", "", nil); code != http.StatusOK {
+		t.Errorf("expected 200, got %d", code)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	e := testEndpoint()
+	h := e.handler()
+
+	if code := doRequest(t, h, "POST", "/v1/credentials", `{"username":"foxcpp@example.org","password":"123"}`, nil); code != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d", code)
+	}
+	if code := doRequest(t, h, "POST", "/v1/credentials", `{"username":"foxcpp@example.org","password":"123"}`, nil); code != http.StatusConflict {
+		t.Errorf("duplicate create: expected 409, got %d", code)
+	}
+	if code := doRequest(t, h, "POST", "/v1/credentials", `{"username":"foxcpp@example.org"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("create without password: expected 400, got %d", code)
+	}
+	if code := doRequest(t, h, "POST", "/v1/credentials", `{"user":"x"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("create with unknown field: expected 400, got %d", code)
+	}
+
+	var users []string
+	if code := doRequest(t, h, "GET", "/v1/credentials", "", &users); code != http.StatusOK {
+		t.Fatalf("list: expected 200, got %d", code)
+	}
+	if !reflect.DeepEqual(users, []string{"foxcpp@example.org"}) {
+		t.Errorf("wrong users list: %v", users)
+	}
+
+	if code := doRequest(t, h, "PUT", "/v1/credentials/foxcpp@example.org/password", `{"password":"456"}`, nil); code != http.StatusNoContent {
+		t.Fatalf("password: expected 204, got %d", code)
+	}
+	if pass := e.creds.(memUserDB)["foxcpp@example.org"]; pass != "456" {
+		t.Errorf("password not changed: %s", pass)
+	}
+
+	if code := doRequest(t, h, "DELETE", "/v1/credentials/foxcpp@example.org", "", nil); code != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", code)
+	}
+	users = nil
+	doRequest(t, h, "GET", "/v1/credentials", "", &users)
+	if len(users) != 0 {
+		t.Errorf("user not deleted: %v", users)
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	h := testEndpoint().handler()
+
+	if code := doRequest(t, h, "POST", "/v1/accounts", `{"username":"foxcpp@example.org"}`, nil); code != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d", code)
+	}
+	if code := doRequest(t, h, "POST", "/v1/accounts", `{"username":"foxcpp@example.org"}`, nil); code != http.StatusConflict {
+		t.Errorf("duplicate create: expected 409, got %d", code)
+	}
+	if code := doRequest(t, h, "POST", "/v1/accounts", `{"username":"bare@example.org","no_specialuse":true}`, nil); code != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d", code)
+	}
+
+	var accts []string
+	doRequest(t, h, "GET", "/v1/accounts", "", &accts)
+	if !reflect.DeepEqual(accts, []string{"bare@example.org", "foxcpp@example.org"}) {
+		t.Errorf("wrong accounts list: %v", accts)
+	}
+
+	var mboxes []mailboxInfo
+	doRequest(t, h, "GET", "/v1/accounts/foxcpp@example.org/mailboxes", "", &mboxes)
+	if len(mboxes) != 6 {
+		t.Fatalf("expected INBOX and 5 special-use folders, got %v", mboxes)
+	}
+	if mboxes[2].Name != "INBOX" || mboxes[4].Name != "Sent" || !reflect.DeepEqual(mboxes[4].Attributes, []string{imap.SentAttr}) {
+		t.Errorf("wrong mailboxes: %v", mboxes)
+	}
+	mboxes = nil
+	doRequest(t, h, "GET", "/v1/accounts/bare@example.org/mailboxes", "", &mboxes)
+	if len(mboxes) != 1 {
+		t.Errorf("expected only INBOX, got %v", mboxes)
+	}
+
+	if code := doRequest(t, h, "POST", "/v1/accounts/bare@example.org/mailboxes", `{"name":"Lists/maddy"}`, nil); code != http.StatusCreated {
+		t.Fatalf("mailbox create: expected 201, got %d", code)
+	}
+	if code := doRequest(t, h, "POST", "/v1/accounts/bare@example.org/mailboxes", `{"name":"Spam","special":"junk"}`, nil); code != http.StatusCreated {
+		t.Fatalf("mailbox create: expected 201, got %d", code)
+	}
+	mboxes = nil
+	doRequest(t, h, "GET", "/v1/accounts/bare@example.org/mailboxes", "", &mboxes)
+	if len(mboxes) != 3 || !reflect.DeepEqual(mboxes[2].Attributes, []string{imap.JunkAttr}) {
+		t.Errorf("wrong mailboxes: %v", mboxes)
+	}
+
+	if code := doRequest(t, h, "DELETE", "/v1/accounts/bare@example.org/mailboxes/Lists/maddy", "", nil); code != http.StatusNoContent {
+		t.Errorf("mailbox delete: expected 204, got %d", code)
+	}
+	if code := doRequest(t, h, "DELETE", "/v1/accounts/bare@example.org/mailboxes/Lists/maddy", "", nil); code != http.StatusNotFound {
+		t.Errorf("missing mailbox delete: expected 404, got %d", code)
+	}
+	if code := doRequest(t, h, "GET", "/v1/accounts/nobody@example.org/mailboxes", "", nil); code != http.StatusNotFound {
+		t.Errorf("missing account: expected 404, got %d", code)
+	}
+
+	if code := doRequest(t, h, "DELETE", "/v1/accounts/bare@example.org", "", nil); code != http.StatusNoContent {
+		t.Errorf("delete: expected 204, got %d", code)
+	}
+	accts = nil
+	doRequest(t, h, "GET", "/v1/accounts", "", &accts)
+	if !reflect.DeepEqual(accts, []string{"foxcpp@example.org"}) {
+		t.Errorf("wrong accounts list: %v", accts)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	e := testEndpoint()
+	h := e.handler()
+
+	if code := doRequest(t, h, "GET", "/v1/queue", "", nil); code != http.StatusNotImplemented {
+		t.Errorf("queue not configured: expected 501, got %d", code)
+	}
+
+	first := time.Unix(1700000000, 0)
+	e.queue = memQueue{{
+		ID:           "1234abcd-6554b7a0",
+		From:         "sender@example.org",
+		To:           []string{"rcpt@example.com"},
+		Size:         42,
+		FirstAttempt: first,
+		LastAttempt:  first.Add(time.Hour),
+		Tries:        map[string]int{"rcpt@example.com": 2},
+		Errors:       map[string]string{"rcpt@example.com": "451 4.0.0 try again"},
+	}}
+
+	var msgs []queueMessage
+	if code := doRequest(t, h, "GET", "/v1/queue", "", &msgs); code != http.StatusOK {
+		t.Fatalf("list: expected 200, got %d", code)
+	}
+	if len(msgs) != 1 || msgs[0].ID != "1234abcd-6554b7a0" || msgs[0].FirstAttempt != 1700000000 {
+		t.Fatalf("wrong queue list: %+v", msgs)
+	}
+
+	var msg queueMessage
+	if code := doRequest(t, h, "GET", "/v1/queue/1234abcd-6554b7a0", "", &msg); code != http.StatusOK {
+		t.Fatalf("get: expected 200, got %d", code)
+	}
+	if msg.Errors["rcpt@example.com"] != "451 4.0.0 try again" {
+		t.Errorf("wrong message info: %+v", msg)
+	}
+	if code := doRequest(t, h, "GET", "/v1/queue/missing", "", nil); code != http.StatusNotFound {
+		t.Errorf("missing message: expected 404, got %d", code)
+	}
+
+	var res queueCancelResult
+	if code := doRequest(t, h, "DELETE", "/v1/queue/1234abcd-6554b7a0", "", &res); code != http.StatusOK {
+		t.Fatalf("cancel: expected 200, got %d", code)
+	}
+	if res.ID != "1234abcd-6554b7a0" || len(res.Cancelled) != 1 || res.Delivered == nil {
+		t.Errorf("wrong cancel result: %+v", res)
+	}
+	if code := doRequest(t, h, "DELETE", "/v1/queue/busy", "", nil); code != http.StatusConflict {
+		t.Errorf("cancel in progress: expected 409, got %d", code)
+	}
+	if code := doRequest(t, h, "DELETE", "/v1/queue/missing", "", nil); code != http.StatusNotFound {
+		t.Errorf("cancel missing: expected 404, got %d", code)
+	}
+}
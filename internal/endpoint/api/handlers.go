@@ -0,0 +1,457 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/internal/auth/pass_table"
+	"github.com/foxcpp/maddy/internal/target/queue"
+)
+
+// maxRequestSize limits the size of JSON request bodies.
+const maxRequestSize = 64 * 1024
+
+// defaultFolders are created for new storage accounts unless the request
+// disables it, matching the defaults of 'maddy imap-acct create'.
+var defaultFolders = []struct {
+	Name string
+	Attr string
+}{
+	{"Sent", imap.SentAttr},
+	{"Trash", imap.TrashAttr},
+	{"Junk", imap.JunkAttr},
+	{"Drafts", imap.DraftsAttr},
+	{"Archive", imap.ArchiveAttr},
+}
+
+type specialUseUser interface {
+	CreateMailboxSpecial(name, specialUseAttr string) error
+}
+
+var errNotConfigured = errors.New("not configured for this endpoint")
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("malformed request: %w", err))
+		return false
+	}
+	return true
+}
+
+// writeBackendError reports the error returned by the credentials DB,
+// storage or queue, mapping well-known errors to the matching status code.
+func (e *Endpoint) writeBackendError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errNotConfigured):
+		status = http.StatusNotImplemented
+	case errors.Is(err, imapsql.ErrUserDoesntExists),
+		errors.Is(err, backend.ErrNoSuchMailbox),
+		errors.Is(err, queue.ErrNoSuchMessage):
+		status = http.StatusNotFound
+	case errors.Is(err, pass_table.ErrCredentialsExist),
+		errors.Is(err, imapsql.ErrUserAlreadyExists),
+		errors.Is(err, backend.ErrMailboxAlreadyExists),
+		errors.Is(err, queue.ErrDeliveryInProgress):
+		status = http.StatusConflict
+	}
+	if status == http.StatusInternalServerError {
+		e.logger.Error("request failed", err, "method", r.Method, "path", r.URL.Path)
+	}
+	writeError(w, status, err)
+}
+
+func (e *Endpoint) credsList(w http.ResponseWriter, r *http.Request) {
+	if e.creds == nil {
+		e.writeBackendError(w, r, fmt.Errorf("credentials: %w", errNotConfigured))
+		return
+	}
+
+	users, err := e.creds.ListUsers()
+	if err != nil {
+		e.writeBackendError(w, r, err)
+		return
+	}
+	if users == nil {
+		users = []string{}
+	}
+	writeJSON(w, http.StatusOK, users)
+}
+
+func (e *Endpoint) credsCreate(w http.ResponseWriter, r *http.Request) {
+	if e.creds == nil {
+		e.writeBackendError(w, r, fmt.Errorf("credentials: %w", errNotConfigured))
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Username == "" || req.Password == "" {
+		writeError(w, http.StatusBadRequest, errors.New("username and password are required"))
+		return
+	}
+
+	if err := e.creds.CreateUser(req.Username, req.Password); err != nil {
+		e.writeBackendError(w, r, err)
+		return
+	}
+	e.logger.Msg("credentials created", "username", req.Username, "src_ip", r.RemoteAddr)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (e *Endpoint) credsPassword(w http.ResponseWriter, r *http.Request) {
+	if e.creds == nil {
+		e.writeBackendError(w, r, fmt.Errorf("credentials: %w", errNotConfigured))
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Password == "" {
+		writeError(w, http.StatusBadRequest, errors.New("password is required"))
+		return
+	}
+
+	username := r.PathValue("username")
+	if err := e.creds.SetUserPassword(username, req.Password); err != nil {
+		e.writeBackendError(w, r, err)
+		return
+	}
+	e.logger.Msg("password changed", "username", username, "src_ip", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (e *Endpoint) credsDelete(w http.ResponseWriter, r *http.Request) {
+	if e.creds == nil {
+		e.writeBackendError(w, r, fmt.Errorf("credentials: %w", errNotConfigured))
+		return
+	}
+
+	username := r.PathValue("username")
+	if err := e.creds.DeleteUser(username); err != nil {
+		e.writeBackendError(w, r, err)
+		return
+	}
+	e.logger.Msg("credentials deleted", "username", username, "src_ip", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (e *Endpoint) acctsList(w http.ResponseWriter, r *http.Request) {
+	if e.storage == nil {
+		e.writeBackendError(w, r, fmt.Errorf("storage: %w", errNotConfigured))
+		return
+	}
+
+	accts, err := e.storage.ListIMAPAccts()
+	if err != nil {
+		e.writeBackendError(w, r, err)
+		return
+	}
+	if accts == nil {
+		accts = []string{}
+	}
+	writeJSON(w, http.StatusOK, accts)
+}
+
+func (e *Endpoint) acctsCreate(w http.ResponseWriter, r *http.Request) {
+	if e.storage == nil {
+		e.writeBackendError(w, r, fmt.Errorf("storage: %w", errNotConfigured))
+		return
+	}
+
+	var req struct {
+		Username     string `json:"username"`
+		NoSpecialUse bool   `json:"no_specialuse"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Username == "" {
+		writeError(w, http.StatusBadRequest, errors.New("username is required"))
+		return
+	}
+
+	if err := e.storage.CreateIMAPAcct(req.Username); err != nil {
+		e.writeBackendError(w, r, err)
+		return
+	}
+	e.logger.Msg("account created", "username", req.Username, "src_ip", r.RemoteAddr)
+
+	if !req.NoSpecialUse {
+		e.createDefaultFolders(req.Username)
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// createDefaultFolders creates special-use folders for the new account.
+// Failures are logged but not reported to the client since the account
+// itself is usable.
+func (e *Endpoint) createDefaultFolders(username string) {
+	u, err := e.storage.GetIMAPAcct(username)
+	if err != nil {
+		e.logger.Error("failed to get account", err, "username", username)
+		return
+	}
+
+	suu, _ := u.(specialUseUser)
+	for _, f := range defaultFolders {
+		if suu != nil {
+			err = suu.CreateMailboxSpecial(f.Name, f.Attr)
+		} else {
+			err = u.CreateMailbox(f.Name)
+		}
+		if err != nil {
+			e.logger.Error("failed to create folder", err, "username", username, "mailbox", f.Name)
+		}
+	}
+}
+
+func (e *Endpoint) acctsDelete(w http.ResponseWriter, r *http.Request) {
+	if e.storage == nil {
+		e.writeBackendError(w, r, fmt.Errorf("storage: %w", errNotConfigured))
+		return
+	}
+
+	username := r.PathValue("username")
+	if err := e.storage.DeleteIMAPAcct(username); err != nil {
+		e.writeBackendError(w, r, err)
+		return
+	}
+	e.logger.Msg("account deleted", "username", username, "src_ip", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type mailboxInfo struct {
+	Name       string   `json:"name"`
+	Attributes []string `json:"attributes"`
+}
+
+func (e *Endpoint) mboxesList(w http.ResponseWriter, r *http.Request) {
+	if e.storage == nil {
+		e.writeBackendError(w, r, fmt.Errorf("storage: %w", errNotConfigured))
+		return
+	}
+
+	u, err := e.storage.GetIMAPAcct(r.PathValue("username"))
+	if err != nil {
+		e.writeBackendError(w, r, err)
+		return
+	}
+	mboxes, err := u.ListMailboxes(r.URL.Query().Get("subscribed") == "true")
+	if err != nil {
+		e.writeBackendError(w, r, err)
+		return
+	}
+
+	resp := make([]mailboxInfo, 0, len(mboxes))
+	for _, info := range mboxes {
+		attrs := info.Attributes
+		if attrs == nil {
+			attrs = []string{}
+		}
+		resp = append(resp, mailboxInfo{Name: info.Name, Attributes: attrs})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (e *Endpoint) mboxesCreate(w http.ResponseWriter, r *http.Request) {
+	if e.storage == nil {
+		e.writeBackendError(w, r, fmt.Errorf("storage: %w", errNotConfigured))
+		return
+	}
+
+	var req struct {
+		Name    string `json:"name"`
+		Special string `json:"special"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("name is required"))
+		return
+	}
+
+	u, err := e.storage.GetIMAPAcct(r.PathValue("username"))
+	if err != nil {
+		e.writeBackendError(w, r, err)
+		return
+	}
+
+	if req.Special != "" {
+		suu, ok := u.(specialUseUser)
+		if !ok {
+			writeError(w, http.StatusNotImplemented, errors.New("storage backend does not support SPECIAL-USE IMAP extension"))
+			return
+		}
+		attr := "\\" + strings.ToUpper(req.Special[:1]) + strings.ToLower(req.Special[1:])
+		err = suu.CreateMailboxSpecial(req.Name, attr)
+	} else {
+		err = u.CreateMailbox(req.Name)
+	}
+	if err != nil {
+		e.writeBackendError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (e *Endpoint) mboxesDelete(w http.ResponseWriter, r *http.Request) {
+	if e.storage == nil {
+		e.writeBackendError(w, r, fmt.Errorf("storage: %w", errNotConfigured))
+		return
+	}
+
+	u, err := e.storage.GetIMAPAcct(r.PathValue("username"))
+	if err != nil {
+		e.writeBackendError(w, r, err)
+		return
+	}
+	if err := u.DeleteMailbox(r.PathValue("name")); err != nil {
+		e.writeBackendError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type queueMessage struct {
+	ID           string            `json:"id"`
+	From         string            `json:"from"`
+	To           []string          `json:"to"`
+	Class        string            `json:"class,omitempty"`
+	Size         int64             `json:"size"`
+	FirstAttempt int64             `json:"first_attempt"`
+	LastAttempt  int64             `json:"last_attempt"`
+	Tries        map[string]int    `json:"tries,omitempty"`
+	Errors       map[string]string `json:"errors,omitempty"`
+}
+
+func toQueueMessage(info queue.MessageInfo) queueMessage {
+	return queueMessage{
+		ID:           info.ID,
+		From:         info.From,
+		To:           info.To,
+		Class:        info.Class,
+		Size:         info.Size,
+		FirstAttempt: info.FirstAttempt.Unix(),
+		LastAttempt:  info.LastAttempt.Unix(),
+		Tries:        info.Tries,
+		Errors:       info.Errors,
+	}
+}
+
+func (e *Endpoint) queueList(w http.ResponseWriter, r *http.Request) {
+	if e.queue == nil {
+		e.writeBackendError(w, r, fmt.Errorf("queue: %w", errNotConfigured))
+		return
+	}
+
+	msgs, err := e.queue.Messages()
+	if err != nil {
+		e.writeBackendError(w, r, err)
+		return
+	}
+
+	resp := make([]queueMessage, 0, len(msgs))
+	for _, info := range msgs {
+		resp = append(resp, toQueueMessage(info))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (e *Endpoint) queueGet(w http.ResponseWriter, r *http.Request) {
+	if e.queue == nil {
+		e.writeBackendError(w, r, fmt.Errorf("queue: %w", errNotConfigured))
+		return
+	}
+
+	info, err := e.queue.Message(r.PathValue("id"))
+	if err != nil {
+		e.writeBackendError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toQueueMessage(info))
+}
+
+type queueCancelResult struct {
+	ID        string   `json:"id"`
+	Delivered []string `json:"delivered"`
+	Failed    []string `json:"failed"`
+	Cancelled []string `json:"cancelled"`
+}
+
+func (e *Endpoint) queueCancel(w http.ResponseWriter, r *http.Request) {
+	if e.queue == nil {
+		e.writeBackendError(w, r, fmt.Errorf("queue: %w", errNotConfigured))
+		return
+	}
+
+	res, err := e.queue.Cancel(r.PathValue("id"))
+	if err != nil {
+		e.writeBackendError(w, r, err)
+		return
+	}
+
+	resp := queueCancelResult{
+		ID:        res.ID,
+		Delivered: res.Delivered,
+		Failed:    res.Failed,
+		Cancelled: res.Cancelled,
+	}
+	for _, l := range []*[]string{&resp.Delivered, &resp.Failed, &resp.Cancelled} {
+		if *l == nil {
+			*l = []string{}
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -73,6 +73,7 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	config.EnumMapped(cfg, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto,
 		&endp.saslAuth.AuthNormalize)
 	modconfig.Table(cfg, "auth_map", true, false, nil, &endp.saslAuth.AuthMap)
+	modconfig.Table(cfg, "auth_allowed_ips", true, false, nil, &endp.saslAuth.AllowedIPs)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -81,13 +82,18 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	endp.srv.Log = stdlog.New(endp.log, "", 0)
 
 	for _, mech := range endp.saslAuth.SASLMechanisms() {
+		if strings.HasSuffix(mech, "-PLUS") {
+			// Channel binding is not possible since the TLS connection is
+			// handled by the client of the protocol.
+			continue
+		}
 		endp.srv.AddMechanism(mech, mechInfo[mech], func(req *dovecotsasl.AuthReq) sasl.Server {
 			var remoteAddr net.Addr
 			if req.RemoteIP != nil && req.RemotePort != 0 {
 				remoteAddr = &net.TCPAddr{IP: req.RemoteIP, Port: int(req.RemotePort)}
 			}
 
-			return endp.saslAuth.CreateSASL(mech, remoteAddr, func(_ string, _ auth.ContextData) error { return nil })
+			return endp.saslAuth.CreateSASL(mech, remoteAddr, nil, func(_ string, _ auth.ContextData) error { return nil })
 		})
 	}
 
@@ -30,4 +30,13 @@ var mechInfo = map[string]dovecotsasl.Mechanism{
 	sasl.Login: {
 		Plaintext: true,
 	},
+	"SCRAM-SHA-1": {
+		MutualAuth: true,
+	},
+	"SCRAM-SHA-256": {
+		MutualAuth: true,
+	},
+	"SCRAM-SHA-512": {
+		MutualAuth: true,
+	},
 }
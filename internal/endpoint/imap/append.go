@@ -0,0 +1,313 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/commands"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+)
+
+const multiAppendCapability = "MULTIAPPEND"
+
+// appendExtension implements MULTIAPPEND (RFC 3502), replaces STATUS
+// handler to report the effective APPENDLIMIT (RFC 7889) value and applies
+// keywordLimits to APPEND and STORE.
+type appendExtension struct {
+	endp *Endpoint
+}
+
+func (ext *appendExtension) Capabilities(c imapserver.Conn) []string {
+	return []string{multiAppendCapability}
+}
+
+func (ext *appendExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "APPEND":
+		return func() imapserver.Handler {
+			return &multiAppend{endp: ext.endp}
+		}
+	case "STATUS":
+		return func() imapserver.Handler {
+			return &appendLimitStatus{endp: ext.endp}
+		}
+	case "STORE":
+		if !ext.endp.keywordLimits.enabled() {
+			return nil
+		}
+		return func() imapserver.Handler {
+			return &limitedStore{endp: ext.endp}
+		}
+	}
+	return nil
+}
+
+// CreateMessageLimit implements backend.AppendLimitBackend so the global
+// limit is advertised before authentication.
+func (endp *Endpoint) CreateMessageLimit() *uint32 {
+	be, ok := endp.Store.(interface{ CreateMessageLimit() *uint32 })
+	if !ok {
+		return nil
+	}
+	return be.CreateMessageLimit()
+}
+
+// appendLimit returns the effective limit of the message size for the
+// mailbox: mailbox limit, then user limit, then global limit.
+//
+// nil is returned if there is no limit.
+func (endp *Endpoint) appendLimit(u imapbackend.User, status *imap.MailboxStatus) *uint32 {
+	// Storage does not distinguish "no limit" and "zero limit" for mailboxes.
+	if status.AppendLimit != 0 {
+		return &status.AppendLimit
+	}
+	if u, ok := u.(imapbackend.AppendLimitUser); ok {
+		if limit := u.CreateMessageLimit(); limit != nil {
+			return limit
+		}
+	}
+	return endp.CreateMessageLimit()
+}
+
+type multiAppend struct {
+	endp     *Endpoint
+	mailbox  string
+	messages []commands.Append
+}
+
+func (cmd *multiAppend) Parse(fields []interface{}) error {
+	var err error
+	cmd.mailbox, cmd.messages, err = parseMultiAppend(fields)
+	return err
+}
+
+// parseMultiAppend parses arguments of the APPEND command, possibly
+// containing multiple messages (RFC 3502).
+func parseMultiAppend(fields []interface{}) (string, []commands.Append, error) {
+	if len(fields) < 2 {
+		return "", nil, errors.New("No enough arguments")
+	}
+
+	// Split arguments into groups that end with a literal and let the
+	// APPEND parser handle each of them.
+	var messages []commands.Append
+	start := 1
+	for i := 1; i < len(fields); i++ {
+		if _, ok := fields[i].(imap.Literal); !ok {
+			continue
+		}
+
+		args := make([]interface{}, 0, i-start+2)
+		args = append(args, fields[0])
+		args = append(args, fields[start:i+1]...)
+
+		var msg commands.Append
+		if err := msg.Parse(args); err != nil {
+			return "", nil, err
+		}
+		messages = append(messages, msg)
+		start = i + 1
+	}
+	if start != len(fields) || len(messages) == 0 {
+		return "", nil, errors.New("Message must be a literal")
+	}
+
+	return messages[0].Mailbox, messages, nil
+}
+
+// Handle stores parsed messages.
+//
+// Literals are read into memory by go-imap before the command is parsed,
+// so they cannot be spooled to a file-backed buffer like message bodies
+// received over SMTP. CreateMessage reads them directly, without making
+// additional copies.
+func (cmd *multiAppend) Handle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	if err := cmd.limitKeywords(conn); err != nil {
+		return err
+	}
+
+	var size int64
+	for _, msg := range cmd.messages {
+		size += int64(msg.Message.Len())
+	}
+	if err := cmd.endp.checkQuota(conn, int64(len(cmd.messages)), size); err != nil {
+		return err
+	}
+
+	if len(cmd.messages) == 1 {
+		hdlr := imapserver.Append{Append: cmd.messages[0]}
+		return hdlr.Handle(conn)
+	}
+	cmd.endp.clients.use(conn.Info(), multiAppendCapability)
+
+	// There is no way to append multiple messages atomically, so check
+	// everything that can be checked in advance to not fail in the middle.
+	status, err := ctx.User.Status(cmd.mailbox, []imap.StatusItem{imap.StatusAppendLimit})
+	if err != nil {
+		return appendErr(err)
+	}
+	if limit := cmd.endp.appendLimit(ctx.User, status); limit != nil {
+		for _, msg := range cmd.messages {
+			if uint32(msg.Message.Len()) > *limit {
+				return appendErr(imapbackend.ErrTooBig)
+			}
+		}
+	}
+
+	for i, msg := range cmd.messages {
+		if err := ctx.User.CreateMessage(cmd.mailbox, msg.Flags, msg.Date, msg.Message, ctx.Mailbox); err != nil {
+			if i != 0 {
+				cmd.endp.Log.Error("MULTIAPPEND failed in the middle", err,
+					"username", ctx.User.Username(), "mailbox", cmd.mailbox,
+					"appended", i, "total", len(cmd.messages))
+			}
+			return appendErr(err)
+		}
+	}
+
+	if ctx.Mailbox != nil && ctx.Mailbox.Name() == cmd.mailbox {
+		return ctx.Mailbox.Poll(true)
+	}
+	return nil
+}
+
+func (cmd *multiAppend) limitKeywords(conn imapserver.Conn) error {
+	limits := cmd.endp.keywordLimits
+	if !limits.enabled() {
+		return nil
+	}
+
+	var mboxKeywords map[string]struct{}
+	for i, msg := range cmd.messages {
+		if !hasKeywords(msg.Flags) {
+			continue
+		}
+		if mboxKeywords == nil {
+			var err error
+			mboxKeywords, err = mailboxKeywords(conn.Context().User, cmd.mailbox)
+			if err != nil {
+				return appendErr(err)
+			}
+		}
+
+		flags, err := limits.check(cmd.endp.Log, conn, cmd.mailbox, msg.Flags, mboxKeywords, 0)
+		if err != nil {
+			return err
+		}
+		cmd.messages[i].Flags = flags
+	}
+	return nil
+}
+
+// appendErr converts the storage error into the response as the default
+// APPEND handler does.
+func appendErr(err error) error {
+	switch err {
+	case imapbackend.ErrNoSuchMailbox:
+		return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeTryCreate,
+			Info: "No such mailbox",
+		}}
+	case imapbackend.ErrTooBig:
+		return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: "TOOBIG",
+			Info: "Message size exceeding limit",
+		}}
+	}
+	return err
+}
+
+// appendLimitStatus is the STATUS command handler that reports the effective
+// APPENDLIMIT instead of the mailbox-specific one.
+type appendLimitStatus struct {
+	imapserver.Status
+	endp *Endpoint
+}
+
+func (cmd *appendLimitStatus) Handle(conn imapserver.Conn) error {
+	hasAppendLimit := false
+	for _, item := range cmd.Items {
+		if item == imap.StatusAppendLimit {
+			hasAppendLimit = true
+		}
+	}
+	if !hasAppendLimit {
+		return cmd.Status.Handle(conn)
+	}
+
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	status, err := ctx.User.Status(cmd.Mailbox, cmd.Items)
+	if err != nil {
+		return err
+	}
+
+	// Only keep items that have been requested.
+	items := make(map[imap.StatusItem]interface{})
+	for _, k := range cmd.Items {
+		items[k] = status.Items[k]
+	}
+	status.Items = items
+
+	limit := cmd.endp.appendLimit(ctx.User, status)
+	if limit != nil {
+		status.AppendLimit = *limit
+	}
+	return conn.WriteResp(&statusResp{Mailbox: status, noAppendLimit: limit == nil})
+}
+
+// statusResp is the STATUS response that can contain APPENDLIMIT NIL.
+type statusResp struct {
+	Mailbox       *imap.MailboxStatus
+	noAppendLimit bool
+}
+
+func (r *statusResp) WriteTo(w *imap.Writer) error {
+	name, err := utf7.Encoding.NewEncoder().String(r.Mailbox.Name)
+	if err != nil {
+		return fmt.Errorf("imap: %w", err)
+	}
+
+	items := r.Mailbox.Format()
+	if r.noAppendLimit {
+		for i := 0; i < len(items); i += 2 {
+			if items[i] == imap.RawString(imap.StatusAppendLimit) {
+				items[i+1] = nil
+			}
+		}
+	}
+
+	fields := []interface{}{imap.RawString("STATUS"), imap.FormatMailboxName(name), items}
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
@@ -0,0 +1,65 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMultiAppend_Parse(t *testing.T) {
+	lit := func(s string) *bytes.Buffer {
+		return bytes.NewBufferString(s)
+	}
+
+	var cmd multiAppend
+	if err := cmd.Parse([]interface{}{
+		"INBOX",
+		[]interface{}{`\Seen`}, "01-Jan-2020 00:00:00 +0000", lit("a"),
+		lit("b"),
+		[]interface{}{`\Flagged`}, lit("c"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if cmd.mailbox != "INBOX" || len(cmd.messages) != 3 {
+		t.Fatalf("Wrong result: %+v", cmd)
+	}
+	if !reflect.DeepEqual(cmd.messages[0].Flags, []string{`\Seen`}) || cmd.messages[0].Date.IsZero() {
+		t.Error("Wrong first message:", cmd.messages[0])
+	}
+	if cmd.messages[1].Flags != nil || !cmd.messages[1].Date.IsZero() {
+		t.Error("Wrong second message:", cmd.messages[1])
+	}
+	if !reflect.DeepEqual(cmd.messages[2].Flags, []string{`\Flagged`}) {
+		t.Error("Wrong third message:", cmd.messages[2])
+	}
+
+	for _, fields := range [][]interface{}{
+		{"INBOX"},
+		{"INBOX", []interface{}{`\Seen`}},
+		{"INBOX", lit("a"), []interface{}{`\Seen`}},
+		{"INBOX", "not a date", lit("a")},
+	} {
+		var cmd multiAppend
+		if err := cmd.Parse(fields); err == nil {
+			t.Errorf("Expected an error for %v", fields)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/sessions"
+)
+
+const (
+	idCommand = "ID"
+
+	// Limits from RFC 2971 Section 3.3.
+	idMaxFields   = 30
+	idMaxKeyLen   = 30
+	idMaxValueLen = 1024
+)
+
+// serverID is the server identification sent in response to the ID command.
+// Version is not included to not make fingerprinting of vulnerable
+// installations easier.
+var serverID = []interface{}{
+	"name", "maddy",
+	"support-url", "https://maddy.email",
+}
+
+// clientSession contains information about the client that is used to
+// diagnose client-specific issues.
+type clientSession struct {
+	lock sync.Mutex
+
+	srcAddr  string
+	username string
+	tracked  *sessions.Session
+	id       map[string]string
+	// IMAP extensions and authentication mechanisms used by the client.
+	used map[string]struct{}
+	// "client identified" message is already logged.
+	identLogged bool
+	// Enabled workarounds, see compat.go.
+	workarounds map[string]struct{}
+}
+
+// fingerprint returns a short hash of the set of features used by the client.
+//
+// Clients with the same fingerprint behave (mostly) the same way, so it
+// can be used to group sessions even if the client does not send the ID
+// command or lies about its name.
+func (s *clientSession) fingerprint() (string, []string) {
+	used := make([]string, 0, len(s.used))
+	for feature := range s.used {
+		used = append(used, feature)
+	}
+	sort.Strings(used)
+
+	sum := sha256.Sum256([]byte(strings.Join(used, " ")))
+	return hex.EncodeToString(sum[:8]), used
+}
+
+func (s *clientSession) idFields() []interface{} {
+	fields := make([]interface{}, 0, 8)
+	for _, key := range [...]string{"name", "version", "os", "vendor"} {
+		if val := s.id[key]; val != "" {
+			fields = append(fields, "client_"+key, val)
+		}
+	}
+	return fields
+}
+
+// clientTracker implements the ID extension (RFC 2971), keeps track of
+// features used by each connected client and enables workarounds for client
+// bugs.
+type clientTracker struct {
+	log               log.Logger
+	compat            module.Table
+	keepaliveInterval time.Duration
+
+	lock     sync.Mutex
+	sessions map[string]*clientSession
+}
+
+func newClientTracker(log log.Logger, compat module.Table) *clientTracker {
+	return &clientTracker{
+		log:               log,
+		compat:            compat,
+		keepaliveInterval: idleKeepaliveInterval,
+		sessions:          make(map[string]*clientSession),
+	}
+}
+
+// session returns the session object for the connection.
+//
+// Connections are identified by the remote address since it is the only
+// thing available to the backend during the LOGIN command.
+func (t *clientTracker) session(info *imap.ConnInfo) *clientSession {
+	return t.sessionByAddr(info.RemoteAddr.String())
+}
+
+func (t *clientTracker) sessionByAddr(addr string) *clientSession {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.sessions[addr]
+}
+
+func (t *clientTracker) Capabilities(c imapserver.Conn) []string {
+	return []string{idCommand}
+}
+
+func (t *clientTracker) Command(name string) imapserver.HandlerFactory {
+	switch {
+	case name == idCommand:
+		return func() imapserver.Handler {
+			return &idHandler{t: t}
+		}
+	case name == "FETCH" && t.compat != nil:
+		return func() imapserver.Handler {
+			return &compatFetch{t: t}
+		}
+	}
+	return nil
+}
+
+func (t *clientTracker) NewConn(c imapserver.Conn) imapserver.Conn {
+	addr := c.Info().RemoteAddr.String()
+	tc := &trackedConn{Conn: c, t: t, addr: addr}
+
+	t.lock.Lock()
+	t.sessions[addr] = &clientSession{
+		srcAddr: addr,
+		used:    make(map[string]struct{}),
+		tracked: sessions.Register("imap", c.Info().RemoteAddr, tc.Close),
+	}
+	t.lock.Unlock()
+
+	return tc
+}
+
+// use records the usage of the feature by the client.
+func (t *clientTracker) use(info *imap.ConnInfo, feature string) {
+	s := t.session(info)
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.used[feature] = struct{}{}
+}
+
+// loggedIn should be called after the successful authentication.
+func (t *clientTracker) loggedIn(info *imap.ConnInfo, username, mech string) {
+	s := t.session(info)
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.username = username
+	s.tracked.SetUsername(username)
+	s.used[mech] = struct{}{}
+	t.logIdentified(s)
+	t.updateWorkarounds(s)
+}
+
+func (t *clientTracker) identified(info *imap.ConnInfo, id map[string]string) {
+	s := t.session(info)
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// Do not forget the identification if the client repeats ID with NIL.
+	if s.id == nil || len(id) != 0 {
+		s.id = id
+	}
+	s.used[idCommand] = struct{}{}
+	t.logIdentified(s)
+	t.updateWorkarounds(s)
+}
+
+// logIdentified logs the client identification once both the ID command
+// and the authentication are done, whatever the order is.
+func (t *clientTracker) logIdentified(s *clientSession) {
+	if s.identLogged || s.username == "" || s.id == nil {
+		return
+	}
+	s.identLogged = true
+
+	fields := []interface{}{"username", s.username, "src_ip", s.srcAddr}
+	t.log.Msg("client identified", append(fields, s.idFields()...)...)
+}
+
+func (t *clientTracker) closed(addr string) {
+	t.lock.Lock()
+	s := t.sessions[addr]
+	delete(t.sessions, addr)
+	t.lock.Unlock()
+
+	if s == nil {
+		return
+	}
+	s.tracked.Close()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.username == "" {
+		return
+	}
+	fingerprint, used := s.fingerprint()
+	fields := []interface{}{
+		"username", s.username,
+		"src_ip", s.srcAddr,
+		"fingerprint", fingerprint,
+		"features", strings.Join(used, ","),
+	}
+	t.log.Msg("client session closed", append(fields, s.idFields()...)...)
+}
+
+// track wraps the extension so usage of its commands is recorded.
+func (t *clientTracker) track(ext imapserver.Extension) imapserver.Extension {
+	return &trackedExtension{Extension: ext, t: t}
+}
+
+type trackedConn struct {
+	imapserver.Conn
+	t    *clientTracker
+	addr string
+}
+
+// Context is called for nearly every command so it is used to track the
+// client activity.
+func (c *trackedConn) Context() *imapserver.Context {
+	if s := c.t.sessionByAddr(c.addr); s != nil {
+		s.tracked.Touch()
+	}
+	return c.Conn.Context()
+}
+
+func (c *trackedConn) Close() error {
+	c.t.closed(c.addr)
+	return c.Conn.Close()
+}
+
+type trackedExtension struct {
+	imapserver.Extension
+	t *clientTracker
+}
+
+func (ext *trackedExtension) Command(name string) imapserver.HandlerFactory {
+	newHandler := ext.Extension.Command(name)
+	if newHandler == nil {
+		return nil
+	}
+	return func() imapserver.Handler {
+		// Optional interfaces implemented by the handler should be preserved.
+		hdlr := trackedHandler{Handler: newHandler(), t: ext.t, name: name}
+		switch hdlr.Handler.(type) {
+		case imapserver.Upgrader:
+			return &trackedUpgrader{hdlr}
+		case imapserver.UidHandler:
+			return &trackedUidHandler{hdlr}
+		default:
+			return &hdlr
+		}
+	}
+}
+
+type trackedHandler struct {
+	imapserver.Handler
+	t    *clientTracker
+	name string
+}
+
+func (h *trackedHandler) Handle(conn imapserver.Conn) error {
+	h.t.use(conn.Info(), h.name)
+	return h.Handler.Handle(conn)
+}
+
+type trackedUpgrader struct {
+	trackedHandler
+}
+
+func (h *trackedUpgrader) Upgrade(conn imapserver.Conn) error {
+	return h.Handler.(imapserver.Upgrader).Upgrade(conn)
+}
+
+type trackedUidHandler struct {
+	trackedHandler
+}
+
+func (h *trackedUidHandler) UidHandle(conn imapserver.Conn) error {
+	h.t.use(conn.Info(), "UID "+h.name)
+	return h.Handler.(imapserver.UidHandler).UidHandle(conn)
+}
+
+// parseClientID parses the argument of the ID command.
+//
+// Empty map is returned if the client sent NIL.
+func parseClientID(fields []interface{}) (map[string]string, error) {
+	if len(fields) != 1 {
+		return nil, errors.New("ID: expected exactly one argument")
+	}
+	if fields[0] == nil {
+		return map[string]string{}, nil
+	}
+	list, ok := fields[0].([]interface{})
+	if !ok {
+		return nil, errors.New("ID: expected a list or NIL")
+	}
+	if len(list)%2 != 0 {
+		return nil, errors.New("ID: missing value for a field")
+	}
+	if len(list)/2 > idMaxFields {
+		return nil, errors.New("ID: too many fields")
+	}
+
+	id := make(map[string]string, len(list)/2)
+	for i := 0; i < len(list); i += 2 {
+		key, err := imap.ParseString(list[i])
+		if err != nil {
+			return nil, errors.New("ID: field name should be a string")
+		}
+		if len(key) > idMaxKeyLen {
+			return nil, errors.New("ID: field name is too long")
+		}
+		if list[i+1] == nil {
+			continue
+		}
+		value, err := imap.ParseString(list[i+1])
+		if err != nil {
+			return nil, errors.New("ID: field value should be a string or NIL")
+		}
+		if len(value) > idMaxValueLen {
+			return nil, errors.New("ID: field value is too long")
+		}
+		id[strings.ToLower(key)] = value
+	}
+	return id, nil
+}
+
+type idHandler struct {
+	t  *clientTracker
+	id map[string]string
+}
+
+func (h *idHandler) Parse(fields []interface{}) error {
+	var err error
+	h.id, err = parseClientID(fields)
+	return err
+}
+
+func (h *idHandler) Handle(conn imapserver.Conn) error {
+	h.t.identified(conn.Info(), h.id)
+	return conn.WriteResp(idResponse{})
+}
+
+type idResponse struct{}
+
+func (idResponse) WriteTo(w *imap.Writer) error {
+	return imap.NewUntaggedResp([]interface{}{imap.RawString(idCommand), serverID}).WriteTo(w)
+}
@@ -0,0 +1,115 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestParseClientID(t *testing.T) {
+	test := func(fields []interface{}, expected map[string]string) {
+		t.Helper()
+		id, err := parseClientID(fields)
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if !reflect.DeepEqual(id, expected) {
+			t.Errorf("Wrong result: %v", id)
+		}
+	}
+	testErr := func(fields []interface{}) {
+		t.Helper()
+		if _, err := parseClientID(fields); err == nil {
+			t.Errorf("Expected an error for %v", fields)
+		}
+	}
+
+	test([]interface{}{nil}, map[string]string{})
+	test([]interface{}{[]interface{}{}}, map[string]string{})
+	test([]interface{}{[]interface{}{
+		"Name", "Thunderbird",
+		"version", "115.0",
+		"os", nil,
+	}}, map[string]string{
+		"name":    "Thunderbird",
+		"version": "115.0",
+	})
+
+	testErr(nil)
+	testErr([]interface{}{"name"})
+	testErr([]interface{}{[]interface{}{"name"}})
+	testErr([]interface{}{[]interface{}{"name", []interface{}{}}})
+	testErr([]interface{}{[]interface{}{strings.Repeat("a", 31), "value"}})
+	testErr([]interface{}{[]interface{}{"name", strings.Repeat("a", 1025)}})
+
+	tooMany := make([]interface{}, 0, 62)
+	for i := 0; i < 31; i++ {
+		tooMany = append(tooMany, "key", "value")
+	}
+	testErr([]interface{}{tooMany})
+}
+
+func TestClientTracker(t *testing.T) {
+	tracker := newClientTracker(testutils.Logger(t, "imap"), nil)
+	info := &imap.ConnInfo{RemoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}}
+	otherInfo := &imap.ConnInfo{RemoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1235}}
+	for _, info := range []*imap.ConnInfo{info, otherInfo} {
+		tracker.sessions[info.RemoteAddr.String()] = &clientSession{
+			srcAddr: info.RemoteAddr.String(),
+			used:    make(map[string]struct{}),
+		}
+	}
+
+	tracker.identified(info, map[string]string{"name": "Thunderbird"})
+	tracker.use(info, "COMPRESS")
+	tracker.loggedIn(info, "user@example.org", "AUTH=PLAIN")
+
+	s := tracker.session(info)
+	if !s.identLogged {
+		t.Error("Client identification is not logged")
+	}
+	fp, used := s.fingerprint()
+	if !reflect.DeepEqual(used, []string{"AUTH=PLAIN", "COMPRESS", "ID"}) {
+		t.Error("Wrong list of used features:", used)
+	}
+
+	// Order of commands does not matter.
+	tracker.loggedIn(otherInfo, "user@example.org", "AUTH=PLAIN")
+	tracker.use(otherInfo, "COMPRESS")
+	tracker.identified(otherInfo, map[string]string{"name": "Thunderbird"})
+	if otherFp, _ := tracker.session(otherInfo).fingerprint(); otherFp != fp {
+		t.Error("Different fingerprints for the same set of features:", fp, otherFp)
+	}
+
+	tracker.use(otherInfo, "NAMESPACE")
+	if otherFp, _ := tracker.session(otherInfo).fingerprint(); otherFp == fp {
+		t.Error("Same fingerprint for a different set of features")
+	}
+
+	tracker.closed(info.RemoteAddr.String())
+	if tracker.session(info) != nil {
+		t.Error("Session is not removed on close")
+	}
+}
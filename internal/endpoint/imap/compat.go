@@ -0,0 +1,238 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Workarounds for client bugs that can be enabled using compat_table.
+const (
+	// Strip extension data (Content-Disposition, Content-Language, etc.)
+	// from BODYSTRUCTURE responses. Some Outlook versions fail to parse
+	// nested extension data.
+	workaroundBodyStructure = "bodystructure_no_ext"
+	// Send "* OK Still here" periodically while the client is in IDLE.
+	// iOS drops IDLE connections that stay silent for too long.
+	workaroundIdleKeepalive = "idle_keepalive"
+)
+
+var knownWorkarounds = map[string]struct{}{
+	workaroundBodyStructure: {},
+	workaroundIdleKeepalive: {},
+}
+
+const idleKeepaliveInterval = 2 * time.Minute
+
+// compatKeys returns table keys to look up workarounds for the client,
+// from the most specific to the least specific one.
+func (s *clientSession) compatKeys() []string {
+	keys := make([]string, 0, 3)
+	if name := strings.ToLower(s.id["name"]); name != "" {
+		if version := strings.ToLower(s.id["version"]); version != "" {
+			keys = append(keys, name+"/"+version)
+		}
+		keys = append(keys, name)
+	}
+	fingerprint, _ := s.fingerprint()
+	return append(keys, "fingerprint:"+fingerprint)
+}
+
+// updateWorkarounds looks up workarounds to enable for the client.
+//
+// It is called once more information about the client is available (after
+// ID and authentication). s.lock should be held.
+func (t *clientTracker) updateWorkarounds(s *clientSession) {
+	if t.compat == nil {
+		return
+	}
+
+	for _, key := range s.compatKeys() {
+		vals, err := t.lookupCompat(key)
+		if err != nil {
+			t.log.Error("compat_table lookup failed", err, "key", key, "src_ip", s.srcAddr)
+			return
+		}
+		if len(vals) == 0 {
+			continue
+		}
+
+		workarounds := make(map[string]struct{})
+		for _, val := range vals {
+			for _, name := range strings.FieldsFunc(val, func(r rune) bool {
+				return r == ',' || r == ' '
+			}) {
+				if _, ok := knownWorkarounds[name]; !ok {
+					t.log.Msg("unknown workaround in compat_table", "key", key, "workaround", name)
+					continue
+				}
+				workarounds[name] = struct{}{}
+			}
+		}
+		s.workarounds = workarounds
+
+		t.log.DebugMsg("enabled client workarounds", "key", key, "workarounds", vals, "src_ip", s.srcAddr)
+		return
+	}
+}
+
+func (t *clientTracker) lookupCompat(key string) ([]string, error) {
+	if multi, ok := t.compat.(module.MultiTable); ok {
+		return multi.LookupMulti(context.TODO(), key)
+	}
+
+	val, ok, err := t.compat.Lookup(context.TODO(), key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return []string{val}, nil
+}
+
+func (s *clientSession) hasWorkaround(name string) bool {
+	if s == nil {
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.workarounds[name]
+	return ok
+}
+
+// Read is called by the IDLE command handler to wait for DONE. It is not
+// used for anything else.
+func (c *trackedConn) Read(b []byte) (int, error) {
+	if !c.t.sessionByAddr(c.addr).hasWorkaround(workaroundIdleKeepalive) {
+		return c.Conn.Read(b)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.idleKeepalive(stop)
+
+	return c.Conn.Read(b)
+}
+
+func (c *trackedConn) idleKeepalive(stop <-chan struct{}) {
+	ticker := time.NewTicker(c.t.keepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		select {
+		case c.Context().Responses <- &imap.StatusResp{
+			Type: imap.StatusRespOk,
+			Info: "Still here",
+		}:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// compatFetch is the FETCH command handler that applies FETCH-related
+// workarounds on top of the default one.
+type compatFetch struct {
+	imapserver.Fetch
+	t *clientTracker
+}
+
+func (h *compatFetch) Handle(conn imapserver.Conn) error {
+	return h.Fetch.Handle(h.t.fetchConn(conn))
+}
+
+func (h *compatFetch) UidHandle(conn imapserver.Conn) error {
+	return h.Fetch.UidHandle(h.t.fetchConn(conn))
+}
+
+func (t *clientTracker) fetchConn(conn imapserver.Conn) imapserver.Conn {
+	if conn.Context().Mailbox == nil || !t.session(conn.Info()).hasWorkaround(workaroundBodyStructure) {
+		return conn
+	}
+
+	ctx := *conn.Context()
+	ctx.Mailbox = bodyStructureMailbox{ctx.Mailbox}
+	return &compatConn{Conn: conn, ctx: &ctx}
+}
+
+// compatConn replaces the connection context for a single command handler.
+type compatConn struct {
+	imapserver.Conn
+	ctx *imapserver.Context
+}
+
+func (c *compatConn) Context() *imapserver.Context {
+	return c.ctx
+}
+
+type bodyStructureMailbox struct {
+	imapbackend.Mailbox
+}
+
+func (m bodyStructureMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	backendCh := make(chan *imap.Message)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(ch)
+		for msg := range backendCh {
+			if msg.BodyStructure != nil {
+				stripBodyStructureExt(msg.BodyStructure)
+			}
+			ch <- msg
+		}
+	}()
+
+	err := m.Mailbox.ListMessages(uid, seqset, items, backendCh)
+	<-done
+	return err
+}
+
+// stripBodyStructureExt removes extension data from the body structure, so
+// only fields returned for the BODY data item are left.
+func stripBodyStructureExt(bs *imap.BodyStructure) {
+	if strings.EqualFold(bs.MIMEType, "multipart") {
+		// Parameters are part of extension data for multipart bodies.
+		bs.Params = nil
+	}
+	bs.MD5 = ""
+	bs.Disposition = ""
+	bs.DispositionParams = nil
+	bs.Language = nil
+	bs.Location = nil
+
+	for _, part := range bs.Parts {
+		stripBodyStructureExt(part)
+	}
+	if bs.BodyStructure != nil {
+		stripBodyStructureExt(bs.BodyStructure)
+	}
+}
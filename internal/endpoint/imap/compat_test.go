@@ -0,0 +1,132 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testWorkarounds(t *testing.T, compat module.Table, id map[string]string, expected ...string) {
+	t.Helper()
+
+	tracker := newClientTracker(testutils.Logger(t, "imap"), compat)
+	info := &imap.ConnInfo{RemoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}}
+	tracker.sessions[info.RemoteAddr.String()] = &clientSession{
+		srcAddr: info.RemoteAddr.String(),
+		used:    make(map[string]struct{}),
+	}
+	if id != nil {
+		tracker.identified(info, id)
+	}
+	tracker.loggedIn(info, "user@example.org", "LOGIN")
+
+	s := tracker.session(info)
+	if len(s.workarounds) != len(expected) {
+		t.Fatalf("Wrong workarounds enabled: %v", s.workarounds)
+	}
+	for _, name := range expected {
+		if !s.hasWorkaround(name) {
+			t.Errorf("Workaround %s is not enabled: %v", name, s.workarounds)
+		}
+	}
+}
+
+func TestClientTracker_Workarounds(t *testing.T) {
+	compat := testutils.Table{M: map[string]string{
+		"outlook/16.0": "bodystructure_no_ext",
+		"outlook":      "idle_keepalive",
+		"ios mail":     "idle_keepalive, bodystructure_no_ext unknown",
+	}}
+
+	testWorkarounds(t, compat, map[string]string{"name": "Outlook", "version": "16.0"}, workaroundBodyStructure)
+	testWorkarounds(t, compat, map[string]string{"name": "Outlook", "version": "15.0"}, workaroundIdleKeepalive)
+	testWorkarounds(t, compat, map[string]string{"name": "iOS Mail"}, workaroundIdleKeepalive, workaroundBodyStructure)
+	testWorkarounds(t, compat, map[string]string{"name": "Thunderbird"})
+	testWorkarounds(t, compat, nil)
+
+	multi := struct {
+		testutils.Table
+		testutils.MultiTable
+	}{
+		MultiTable: testutils.MultiTable{M: map[string][]string{
+			"outlook": {"idle_keepalive", "bodystructure_no_ext"},
+		}},
+	}
+	testWorkarounds(t, multi, map[string]string{"name": "Outlook"}, workaroundIdleKeepalive, workaroundBodyStructure)
+}
+
+func TestClientTracker_WorkaroundsFingerprint(t *testing.T) {
+	s := clientSession{used: map[string]struct{}{"LOGIN": {}}}
+	fingerprint, _ := s.fingerprint()
+
+	testWorkarounds(t, testutils.Table{M: map[string]string{
+		"fingerprint:" + fingerprint: "idle_keepalive",
+	}}, nil, workaroundIdleKeepalive)
+}
+
+func TestStripBodyStructureExt(t *testing.T) {
+	bs := &imap.BodyStructure{
+		MIMEType:    "multipart",
+		MIMESubType: "mixed",
+		Params:      map[string]string{"boundary": "b"},
+		Extended:    true,
+		Parts: []*imap.BodyStructure{
+			{
+				MIMEType:    "text",
+				MIMESubType: "plain",
+				Params:      map[string]string{"charset": "utf-8"},
+				Encoding:    "7bit",
+				Size:        10,
+				Lines:       1,
+				Extended:    true,
+				MD5:         "abc",
+			},
+			{
+				MIMEType:          "application",
+				MIMESubType:       "pdf",
+				Params:            map[string]string{"name": "a.pdf"},
+				Encoding:          "base64",
+				Size:              20,
+				Extended:          true,
+				Disposition:       "attachment",
+				DispositionParams: map[string]string{"filename": "a.pdf"},
+				Language:          []string{"en"},
+				Location:          []string{"http://example.org"},
+			},
+		},
+	}
+	stripBodyStructureExt(bs)
+
+	var b bytes.Buffer
+	w := imap.NewWriter(&b)
+	if err := imap.NewUntaggedResp([]interface{}{bs.Format()}).WriteTo(w); err != nil {
+		t.Fatal(err)
+	}
+	expected := `* (("text" "plain" ("charset" "utf-8") NIL NIL "7bit" 10 1 NIL NIL NIL NIL) ` +
+		`("application" "pdf" ("name" "a.pdf") NIL NIL "base64" 20 NIL NIL NIL NIL) "mixed" NIL NIL NIL NIL)` + "\r\n"
+	if b.String() != expected {
+		t.Errorf("Wrong body structure:\n%q\nexpected:\n%q", b.String(), expected)
+	}
+}
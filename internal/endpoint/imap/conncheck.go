@@ -0,0 +1,186 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-sasl"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const (
+	// connCheckTimeout limits the time connection_check can take (including
+	// throttling).
+	connCheckTimeout = time.Minute
+
+	// rejectWriteTimeout limits the time spent sending the BYE response to
+	// rejected clients.
+	rejectWriteTimeout = 5 * time.Second
+)
+
+// connCheckDirective parses the connection_check directive. Any check
+// implementing module.EarlyCheck or a group of checks can be used.
+func connCheckDirective(m *config.Map, node config.Node) (interface{}, error) {
+	var check module.EarlyCheck
+	if err := modconfig.ModuleFromNode("check", node.Args, node, m.Globals, &check); err != nil {
+		return nil, err
+	}
+	return check, nil
+}
+
+// checkConn runs connection_check for the client and converts the error to
+// the IMAP response.
+func (endp *Endpoint) checkConn(remoteAddr net.Addr) error {
+	if endp.connCheck == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), connCheckTimeout)
+	defer cancel()
+	err := endp.connCheck.CheckConnection(ctx, &module.ConnState{
+		RemoteAddr: remoteAddr,
+		Proto:      "IMAP",
+	})
+	if err == nil {
+		return nil
+	}
+
+	endp.Log.DebugMsg("connection check failed", "reason", err, "src_ip", remoteAddr)
+
+	resp := &imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Info: "Connection rejected",
+	}
+	var smtpErr *exterrors.SMTPError
+	if errors.As(err, &smtpErr) {
+		resp.Info = smtpErr.Message
+	}
+	if exterrors.IsTemporary(err) {
+		resp.Code = "UNAVAILABLE"
+	}
+	return &imap.ErrStatusResp{Resp: resp}
+}
+
+// failedSASL is the SASL server that fails the authentication immediately.
+type failedSASL struct {
+	err error
+}
+
+func (s failedSASL) Next([]byte) ([]byte, bool, error) {
+	return nil, true, s.err
+}
+
+var _ sasl.Server = failedSASL{}
+
+// checkedListener runs connection_check for accepted connections.
+// Rejected clients get the BYE response and are disconnected before the
+// greeting.
+//
+// Checks are run in parallel so slow ones (e.g. throttling) do not delay
+// other connections.
+type checkedListener struct {
+	net.Listener
+	endp *Endpoint
+
+	accepted  chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newCheckedListener(l net.Listener, endp *Endpoint) *checkedListener {
+	cl := &checkedListener{
+		Listener: l,
+		endp:     endp,
+		accepted: make(chan acceptResult),
+		closed:   make(chan struct{}),
+	}
+	go cl.acceptLoop()
+	return cl
+}
+
+func (cl *checkedListener) acceptLoop() {
+	for {
+		conn, err := cl.Listener.Accept()
+		if err != nil {
+			select {
+			case cl.accepted <- acceptResult{err: err}:
+			case <-cl.closed:
+				return
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return
+		}
+
+		go cl.check(conn)
+	}
+}
+
+func (cl *checkedListener) check(conn net.Conn) {
+	if err := cl.endp.checkConn(conn.RemoteAddr()); err != nil {
+		resp := err.(*imap.ErrStatusResp).Resp
+		if err := conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout)); err == nil {
+			bye := &imap.StatusResp{Type: imap.StatusRespBye, Code: resp.Code, Info: resp.Info}
+			w := imap.NewWriter(conn)
+			if err := bye.WriteTo(w); err == nil {
+				_ = w.Flush()
+			}
+		}
+		conn.Close()
+		return
+	}
+
+	select {
+	case cl.accepted <- acceptResult{conn: conn}:
+	case <-cl.closed:
+		conn.Close()
+	}
+}
+
+func (cl *checkedListener) Accept() (net.Conn, error) {
+	select {
+	case res := <-cl.accepted:
+		return res.conn, res.err
+	case <-cl.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (cl *checkedListener) Close() error {
+	cl.closeOnce.Do(func() {
+		close(cl.closed)
+	})
+	return cl.Listener.Close()
+}
@@ -0,0 +1,45 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+// FuzzParseCommand runs arguments of commands parsed by maddy itself
+// through the same IMAP reader the server uses.
+func FuzzParseCommand(f *testing.F) {
+	f.Add([]byte("1 ID (\"name\" \"Thunderbird\" \"version\" \"115.0\")\r\n"))
+	f.Add([]byte("1 ID NIL\r\n"))
+	f.Add([]byte("1 ID (\"name\" NIL)\r\n"))
+	f.Add([]byte("1 APPEND INBOX {5}\r\nHello\r\n"))
+	f.Add([]byte("1 APPEND INBOX (\\Seen) \"01-Jan-2030 00:00:00 +0000\" {5}\r\nHello\r\n"))
+	f.Add([]byte("1 APPEND Drafts (\\Draft) {1}\r\na (\\Seen) {1}\r\nb\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := imap.NewServerReader(bufio.NewReader(bytes.NewReader(data)), nil)
+		r.MaxLiteralSize = 64 * 1024
+
+		fields, err := r.ReadLine()
+		if err != nil {
+			return
+		}
+		var cmd imap.Command
+		if err := cmd.Parse(fields); err != nil {
+			return
+		}
+
+		switch strings.ToUpper(cmd.Name) {
+		case "ID":
+			_, _ = parseClientID(cmd.Arguments)
+		case "APPEND":
+			mailbox, messages, err := parseMultiAppend(cmd.Arguments)
+			if err == nil && (len(messages) == 0 || mailbox != messages[0].Mailbox) {
+				t.Errorf("inconsistent APPEND parse result for %q", data)
+			}
+		}
+	})
+}
@@ -26,6 +26,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/emersion/go-imap"
 	compress "github.com/emersion/go-imap-compress"
@@ -42,6 +43,8 @@ import (
 	tls2 "github.com/foxcpp/maddy/framework/config/tls"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/acctstatus"
+	"github.com/foxcpp/maddy/internal/activity"
 	"github.com/foxcpp/maddy/internal/auth"
 	"github.com/foxcpp/maddy/internal/authz"
 	"github.com/foxcpp/maddy/internal/proxy_protocol"
@@ -53,6 +56,7 @@ type Endpoint struct {
 	serv          *imapserver.Server
 	listeners     []net.Listener
 	proxyProtocol *proxy_protocol.ProxyProtocol
+	connCheck     module.EarlyCheck
 	Store         module.Storage
 
 	tlsConfig   *tls.Config
@@ -63,6 +67,10 @@ type Endpoint struct {
 	storageNormalize authz.NormalizeFunc
 	storageMap       module.Table
 
+	compatTable   module.Table
+	clients       *clientTracker
+	keywordLimits keywordLimits
+
 	Log log.Logger
 }
 
@@ -83,6 +91,8 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		insecureAuth bool
 		ioDebug      bool
 		ioErrors     bool
+
+		keywordsOverflow string
 	)
 
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
@@ -92,6 +102,7 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	cfg.Custom("storage", false, true, nil, modconfig.StorageDirective, &endp.Store)
 	cfg.Custom("tls", true, true, nil, tls2.TLSDirective, &endp.tlsConfig)
 	cfg.Custom("proxy_protocol", false, false, nil, proxy_protocol.ProxyProtocolDirective, &endp.proxyProtocol)
+	cfg.Custom("connection_check", false, false, nil, connCheckDirective, &endp.connCheck)
 	cfg.Bool("insecure_auth", false, false, &insecureAuth)
 	cfg.Bool("io_debug", false, false, &ioDebug)
 	cfg.Bool("io_errors", false, false, &ioErrors)
@@ -102,9 +113,19 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	config.EnumMapped(cfg, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto,
 		&endp.saslAuth.AuthNormalize)
 	modconfig.Table(cfg, "auth_map", true, false, nil, &endp.saslAuth.AuthMap)
+	modconfig.Table(cfg, "account_status", true, false, nil, &endp.saslAuth.AccountStatus)
+	modconfig.Table(cfg, "auth_allowed_ips", true, false, nil, &endp.saslAuth.AllowedIPs)
+	modconfig.Table(cfg, "compat_table", false, false, nil, &endp.compatTable)
+	cfg.Int("max_keywords_per_message", false, false, 0, &endp.keywordLimits.perMessage)
+	cfg.Int("max_keywords_per_mailbox", false, false, 0, &endp.keywordLimits.perMailbox)
+	cfg.Enum("keywords_overflow", false, false, []string{"reject", "drop"}, "reject", &keywordsOverflow)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
+	if endp.keywordLimits.perMessage < 0 || endp.keywordLimits.perMailbox < 0 {
+		return errors.New("imap: keywords limits should not be negative")
+	}
+	endp.keywordLimits.drop = keywordsOverflow == "drop"
 
 	if updBe, ok := endp.Store.(updatepipe.Backend); ok {
 		if err := updBe.EnableUpdatePipe(updatepipe.ModeReplicate); err != nil {
@@ -121,6 +142,7 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		addresses = append(addresses, saddr)
 	}
 
+	endp.clients = newClientTracker(endp.Log, endp.compatTable)
 	endp.serv = imapserver.New(endp)
 	endp.serv.AllowInsecureAuth = insecureAuth
 	endp.serv.TLSConfig = endp.tlsConfig
@@ -138,10 +160,19 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		return err
 	}
 
+	endp.saslAuth.StatusAllowed = acctstatus.Status.AllowsLogin
+	endp.saslAuth.DisabledErr = errAccountDisabled
 	for _, mech := range endp.saslAuth.SASLMechanisms() {
 		endp.serv.EnableAuth(mech, func(c imapserver.Conn) sasl.Server {
-			return endp.saslAuth.CreateSASL(mech, c.Info().RemoteAddr, func(identity string, data auth.ContextData) error {
-				return endp.openAccount(c, identity)
+			if err := endp.checkConn(c.Info().RemoteAddr); err != nil {
+				return failedSASL{err: err}
+			}
+			return endp.saslAuth.CreateSASL(mech, c.Info().RemoteAddr, c.Info().TLS, func(identity string, data auth.ContextData) error {
+				if err := endp.openAccount(c, identity); err != nil {
+					return err
+				}
+				endp.clients.loggedIn(c.Info(), identity, "AUTH="+mech)
+				return nil
 			})
 		})
 	}
@@ -150,6 +181,15 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 }
 
 func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
+	// Server options should be set before listeners are started.
+	if endp.serv.AllowInsecureAuth {
+		endp.Log.Println("authentication over unencrypted connections is allowed, this is insecure configuration and should be used only for testing!")
+	}
+	if endp.serv.TLSConfig == nil {
+		endp.Log.Println("TLS is disabled, this is insecure configuration and should be used only for testing!")
+		endp.serv.AllowInsecureAuth = true
+	}
+
 	for _, addr := range addresses {
 		var l net.Listener
 		var err error
@@ -170,6 +210,10 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 			l = proxy_protocol.NewListener(l, endp.proxyProtocol, endp.Log)
 		}
 
+		if endp.connCheck != nil {
+			l = newCheckedListener(l, endp)
+		}
+
 		endp.listeners = append(endp.listeners, l)
 
 		endp.listenersWg.Add(1)
@@ -181,14 +225,6 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 		}()
 	}
 
-	if endp.serv.AllowInsecureAuth {
-		endp.Log.Println("authentication over unencrypted connections is allowed, this is insecure configuration and should be used only for testing!")
-	}
-	if endp.serv.TLSConfig == nil {
-		endp.Log.Println("TLS is disabled, this is insecure configuration and should be used only for testing!")
-		endp.serv.AllowInsecureAuth = true
-	}
-
 	return nil
 }
 
@@ -200,6 +236,38 @@ func (endp *Endpoint) InstanceName() string {
 	return "imap"
 }
 
+// StopListening implements module.DrainableEndpoint.
+func (endp *Endpoint) StopListening() error {
+	for _, l := range endp.listeners {
+		l.Close()
+	}
+	endp.listenersWg.Wait()
+	return nil
+}
+
+// Drain implements module.DrainableEndpoint.
+func (endp *Endpoint) Drain(ctx context.Context) error {
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+	for {
+		conns := 0
+		endp.serv.ForEachConn(func(imapserver.Conn) {
+			conns++
+		})
+		if conns == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+var drainPollInterval = time.Second
+
 func (endp *Endpoint) Close() error {
 	for _, l := range endp.listeners {
 		l.Close()
@@ -246,21 +314,37 @@ func (endp *Endpoint) openAccount(c imapserver.Conn, identity string) error {
 		return fmt.Errorf("internal server error")
 	}
 
-	u, err := endp.Store.GetOrCreateIMAPAcct(username)
+	u, err := endp.getAccount(username)
 	if err != nil {
 		return err
 	}
+	activity.RecordLogin(username, "imap", c.Info().RemoteAddr)
 	ctx := c.Context()
 	ctx.State = imap.AuthenticatedState
 	ctx.User = u
 	return nil
 }
 
+// errAccountDisabled is returned if the account status does not permit
+// logging in.
+var errAccountDisabled = &imap.ErrStatusResp{Resp: &imap.StatusResp{
+	Type: imap.StatusRespNo,
+	Code: "CONTACTADMIN",
+	Info: "Account is disabled",
+}}
+
 func (endp *Endpoint) Login(connInfo *imap.ConnInfo, username, password string) (imapbackend.User, error) {
+	if err := endp.checkConn(connInfo.RemoteAddr); err != nil {
+		return nil, err
+	}
+
 	// saslAuth handles AuthMap calling.
-	err := endp.saslAuth.AuthPlain(username, password)
+	err := endp.saslAuth.AuthPlain(username, password, connInfo.RemoteAddr)
 	if err != nil {
 		endp.Log.Error("authentication failed", err, "username", username, "src_ip", connInfo.RemoteAddr)
+		if errors.Is(err, auth.ErrAccountDisabled) {
+			return nil, errAccountDisabled
+		}
 		return nil, imapbackend.ErrInvalidCredentials
 	}
 
@@ -273,7 +357,13 @@ func (endp *Endpoint) Login(connInfo *imap.ConnInfo, username, password string)
 		return nil, fmt.Errorf("internal server error")
 	}
 
-	return endp.Store.GetOrCreateIMAPAcct(storageUsername)
+	u, err := endp.getAccount(storageUsername)
+	if err != nil {
+		return nil, err
+	}
+	activity.RecordLogin(storageUsername, "imap", connInfo.RemoteAddr)
+	endp.clients.loggedIn(connInfo, username, "LOGIN")
+	return u, nil
 }
 
 func (endp *Endpoint) I18NLevel() int {
@@ -285,21 +375,29 @@ func (endp *Endpoint) I18NLevel() int {
 }
 
 func (endp *Endpoint) enableExtensions() error {
+	// Should go first to override handlers of other extensions.
+	endp.serv.Enable(maintenanceExtension{})
+
 	exts := endp.Store.IMAPExtensions()
 	for _, ext := range exts {
 		switch ext {
 		case "I18NLEVEL=1", "I18NLEVEL=2":
-			endp.serv.Enable(i18nlevel.NewExtension())
+			endp.serv.Enable(endp.clients.track(i18nlevel.NewExtension()))
 		case "SORT":
-			endp.serv.Enable(sortthread.NewSortExtension())
+			endp.serv.Enable(endp.clients.track(sortthread.NewSortExtension()))
 		}
 		if strings.HasPrefix(ext, "THREAD") {
-			endp.serv.Enable(sortthread.NewThreadExtension())
+			endp.serv.Enable(endp.clients.track(sortthread.NewThreadExtension()))
 		}
 	}
 
-	endp.serv.Enable(compress.NewExtension())
-	endp.serv.Enable(namespace.NewExtension())
+	endp.serv.Enable(endp.clients.track(compress.NewExtension()))
+	endp.serv.Enable(endp.clients.track(namespace.NewExtension()))
+	endp.serv.Enable(&appendExtension{endp: endp})
+	if _, ok := endp.Store.(module.QuotaStorage); ok {
+		endp.serv.Enable(&quotaExtension{endp: endp})
+	}
+	endp.serv.Enable(endp.clients)
 
 	return nil
 }
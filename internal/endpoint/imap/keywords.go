@@ -0,0 +1,252 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// keywordLimits restricts the amount of custom keywords (flags not starting
+// with a backslash) clients can create.
+type keywordLimits struct {
+	perMessage int
+	perMailbox int
+	// Drop keywords that do not fit instead of rejecting the command.
+	drop bool
+}
+
+func (l keywordLimits) enabled() bool {
+	return l.perMessage > 0 || l.perMailbox > 0
+}
+
+func isKeyword(flag string) bool {
+	return !strings.HasPrefix(flag, "\\")
+}
+
+func hasKeywords(flags []string) bool {
+	for _, flag := range flags {
+		if isKeyword(flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// discardConn is used to open mailboxes outside of IMAP connections.
+type discardConn struct{}
+
+func (discardConn) SendUpdate(imapbackend.Update) error {
+	return nil
+}
+
+// mailboxKeywords returns the set of keywords used in the mailbox.
+// Keywords are case-insensitive, so the set keys are lowercase.
+func mailboxKeywords(u imapbackend.User, name string) (map[string]struct{}, error) {
+	// Mailbox status (and so the list of used flags) is returned only when
+	// mailbox is opened for a connection.
+	status, mbox, err := u.GetMailbox(name, true, discardConn{})
+	if err != nil {
+		return nil, err
+	}
+	defer mbox.Close()
+	if status == nil {
+		return map[string]struct{}{}, nil
+	}
+
+	keywords := make(map[string]struct{}, len(status.Flags))
+	for _, flag := range status.Flags {
+		if isKeyword(flag) {
+			keywords[strings.ToLower(flag)] = struct{}{}
+		}
+	}
+	return keywords, nil
+}
+
+// fit returns flags with keywords that fit into limits and keywords that do
+// not.
+//
+// mboxKeywords is updated with accepted keywords. msgKeywords is the amount of
+// other keywords already set on the message.
+func (l keywordLimits) fit(flags []string, mboxKeywords map[string]struct{}, msgKeywords int) (allowed, rejected []string) {
+	allowed = make([]string, 0, len(flags))
+	added := make(map[string]struct{}, len(flags))
+	for _, flag := range flags {
+		if !isKeyword(flag) {
+			allowed = append(allowed, flag)
+			continue
+		}
+
+		key := strings.ToLower(flag)
+		if _, ok := added[key]; ok {
+			allowed = append(allowed, flag)
+			continue
+		}
+		_, exists := mboxKeywords[key]
+		if l.perMailbox > 0 && !exists && len(mboxKeywords) >= l.perMailbox {
+			rejected = append(rejected, flag)
+			continue
+		}
+		if l.perMessage > 0 && msgKeywords >= l.perMessage {
+			rejected = append(rejected, flag)
+			continue
+		}
+
+		msgKeywords++
+		added[key] = struct{}{}
+		mboxKeywords[key] = struct{}{}
+		allowed = append(allowed, flag)
+	}
+	return allowed, rejected
+}
+
+// check applies limits to the flags that are going to be added to the
+// mailbox. It returns the error if keywords should be rejected.
+func (l keywordLimits) check(logger log.Logger, conn imapserver.Conn, mbox string, flags []string,
+	mboxKeywords map[string]struct{}, msgKeywords int) ([]string, error) {
+	allowed, rejected := l.fit(flags, mboxKeywords, msgKeywords)
+	if len(rejected) == 0 {
+		return allowed, nil
+	}
+
+	logger.Msg("keywords limit exceeded",
+		"username", conn.Context().User.Username(),
+		"src_ip", conn.Info().RemoteAddr,
+		"mailbox", mbox,
+		"keywords", rejected,
+		"dropped", l.drop,
+	)
+	if l.drop {
+		return allowed, nil
+	}
+	return nil, &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Code: "LIMIT",
+		Info: "Too many keywords",
+	}}
+}
+
+// limitedStore is the STORE command handler that enforces keywordLimits.
+type limitedStore struct {
+	imapserver.Store
+	endp *Endpoint
+}
+
+func (cmd *limitedStore) Handle(conn imapserver.Conn) error {
+	if err := cmd.limit(false, conn); err != nil {
+		return err
+	}
+	return cmd.Store.Handle(conn)
+}
+
+func (cmd *limitedStore) UidHandle(conn imapserver.Conn) error {
+	if err := cmd.limit(true, conn); err != nil {
+		return err
+	}
+	return cmd.Store.UidHandle(conn)
+}
+
+// limit checks keywords to be added and removes ones that do not fit if
+// configured to do so.
+//
+// Errors not related to limits are left for the default handler to report.
+func (cmd *limitedStore) limit(uid bool, conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil || ctx.MailboxReadOnly {
+		return nil
+	}
+	op, _, err := imap.ParseFlagsOp(cmd.Item)
+	if err != nil || op == imap.RemoveFlags {
+		return nil
+	}
+
+	var flags []string
+	if flagsList, ok := cmd.Value.([]interface{}); ok {
+		flags, err = imap.ParseStringList(flagsList)
+	} else {
+		var flag string
+		flag, err = imap.ParseString(cmd.Value)
+		flags = []string{flag}
+	}
+	if err != nil || !hasKeywords(flags) {
+		return nil
+	}
+
+	limits := cmd.endp.keywordLimits
+	mboxName := ctx.Mailbox.Name()
+	mboxKeywords, err := mailboxKeywords(ctx.User, mboxName)
+	if err != nil {
+		return err
+	}
+
+	msgKeywords := 0
+	if op == imap.AddFlags && limits.perMessage > 0 {
+		msgKeywords, err = maxOtherKeywords(ctx.Mailbox, uid, cmd.SeqSet, flags)
+		if err != nil {
+			return err
+		}
+	}
+
+	allowed, err := limits.check(cmd.endp.Log, conn, mboxName, flags, mboxKeywords, msgKeywords)
+	if err != nil {
+		return err
+	}
+	value := make([]interface{}, 0, len(allowed))
+	for _, flag := range allowed {
+		value = append(value, flag)
+	}
+	cmd.Value = value
+	return nil
+}
+
+// maxOtherKeywords returns the maximum amount of keywords set on messages,
+// not counting ones from flags.
+func maxOtherKeywords(mbox imapbackend.Mailbox, uid bool, seqset *imap.SeqSet, flags []string) (int, error) {
+	added := make(map[string]struct{}, len(flags))
+	for _, flag := range flags {
+		added[strings.ToLower(flag)] = struct{}{}
+	}
+
+	ch := make(chan *imap.Message)
+	done := make(chan int)
+	go func() {
+		maxCount := 0
+		for msg := range ch {
+			count := 0
+			for _, flag := range msg.Flags {
+				if _, ok := added[strings.ToLower(flag)]; ok || !isKeyword(flag) {
+					continue
+				}
+				count++
+			}
+			if count > maxCount {
+				maxCount = count
+			}
+		}
+		done <- maxCount
+	}()
+
+	err := mbox.ListMessages(uid, seqset, []imap.FetchItem{imap.FetchFlags}, ch)
+	maxCount := <-done
+	return maxCount, err
+}
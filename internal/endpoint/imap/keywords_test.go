@@ -0,0 +1,65 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeywordLimits_Fit(t *testing.T) {
+	test := func(l keywordLimits, flags []string, mbox []string, msgKeywords int, allowed, rejected []string) {
+		t.Helper()
+
+		mboxKeywords := make(map[string]struct{})
+		for _, k := range mbox {
+			mboxKeywords[k] = struct{}{}
+		}
+
+		actualAllowed, actualRejected := l.fit(flags, mboxKeywords, msgKeywords)
+		if !reflect.DeepEqual(actualAllowed, allowed) {
+			t.Errorf("Wrong allowed flags: %v, expected %v", actualAllowed, allowed)
+		}
+		if !reflect.DeepEqual(actualRejected, rejected) {
+			t.Errorf("Wrong rejected flags: %v, expected %v", actualRejected, rejected)
+		}
+	}
+
+	perMailbox := keywordLimits{perMailbox: 2}
+	test(perMailbox, []string{`\Seen`, "a", "b"}, nil, 0,
+		[]string{`\Seen`, "a", "b"}, nil)
+	test(perMailbox, []string{`\Seen`, "a", "b", "c"}, nil, 0,
+		[]string{`\Seen`, "a", "b"}, []string{"c"})
+	// Already used keywords are always allowed, case-insensitively.
+	test(perMailbox, []string{"A", "c"}, []string{"a", "b"}, 0,
+		[]string{"A"}, []string{"c"})
+	// Duplicates are not counted twice.
+	test(perMailbox, []string{"a", "A", "b"}, nil, 0,
+		[]string{"a", "A", "b"}, nil)
+
+	perMessage := keywordLimits{perMessage: 2}
+	test(perMessage, []string{"a", "b", `\Flagged`, "c"}, nil, 0,
+		[]string{"a", "b", `\Flagged`}, []string{"c"})
+	test(perMessage, []string{"a", "b"}, []string{"x", "y", "z"}, 1,
+		[]string{"a"}, []string{"b"})
+	test(perMessage, []string{"a", "A", "b"}, nil, 0,
+		[]string{"a", "A", "b"}, nil)
+	test(perMessage, []string{`\Seen`}, nil, 5,
+		[]string{`\Seen`}, nil)
+}
@@ -0,0 +1,165 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/foxcpp/maddy/internal/maintenance"
+)
+
+var errMaintenance = &imap.ErrStatusResp{Resp: &imap.StatusResp{
+	Type: imap.StatusRespNo,
+	Code: "UNAVAILABLE",
+	Info: "Server is in maintenance mode, try again later",
+}}
+
+// maintenanceExtension makes all mailboxes read-only while the server is in
+// maintenance mode.
+//
+// Mailboxes are opened read-only by SELECT and commands that change the
+// storage are rejected. Mailboxes selected before the maintenance mode was
+// enabled stay read-write in the backend so FETCH is changed to not set the
+// \Seen flag implicitly.
+type maintenanceExtension struct{}
+
+func (maintenanceExtension) Capabilities(c imapserver.Conn) []string {
+	return nil
+}
+
+func (maintenanceExtension) Command(name string) imapserver.HandlerFactory {
+	// Command is also called by Server.Enable to detect extensions
+	// implemented by go-imap itself (including MOVE). This is not a problem
+	// since the maintenance mode can't be enabled before the endpoint is
+	// initialized.
+	if !maintenance.Enabled() {
+		return nil
+	}
+
+	switch name {
+	case "SELECT":
+		return func() imapserver.Handler {
+			hdlr := &imapserver.Select{}
+			hdlr.ReadOnly = true
+			return hdlr
+		}
+	case "CLOSE":
+		return func() imapserver.Handler {
+			return &maintenanceClose{}
+		}
+	case "FETCH":
+		return func() imapserver.Handler {
+			return &maintenanceFetch{}
+		}
+	case "APPEND", "CREATE", "DELETE", "RENAME", "SUBSCRIBE", "UNSUBSCRIBE",
+		"STORE", "COPY", "MOVE", "EXPUNGE":
+		return func() imapserver.Handler {
+			return maintenanceReject{}
+		}
+	}
+	return nil
+}
+
+// maintenanceReject rejects the command regardless of its arguments.
+type maintenanceReject struct{}
+
+func (maintenanceReject) Parse([]interface{}) error {
+	return nil
+}
+
+func (maintenanceReject) Handle(imapserver.Conn) error {
+	return errMaintenance
+}
+
+func (maintenanceReject) UidHandle(imapserver.Conn) error {
+	return errMaintenance
+}
+
+// maintenanceClose is the CLOSE command handler that does not expunge
+// messages, as it is done for read-only mailboxes.
+type maintenanceClose struct {
+	imapserver.Close
+}
+
+func (cmd *maintenanceClose) Handle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+
+	mbox := ctx.Mailbox
+	ctx.Mailbox = nil
+	ctx.MailboxReadOnly = false
+	return mbox.Close()
+}
+
+// maintenanceFetch is the FETCH command handler that replaces body sections
+// with their .PEEK variants for mailboxes opened read-write.
+type maintenanceFetch struct {
+	imapserver.Fetch
+}
+
+func (cmd *maintenanceFetch) peek(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil || ctx.MailboxReadOnly {
+		return nil
+	}
+
+	for i, item := range cmd.Items {
+		switch name := strings.ToUpper(string(item)); {
+		case strings.HasPrefix(name, "BODY["):
+			cmd.Items[i] = imap.FetchItem("BODY.PEEK" + string(item)[len("BODY"):])
+		case name == string(imap.FetchRFC822) || name == string(imap.FetchRFC822Text):
+			// These can't be replaced without changing the response, ask
+			// the client to reopen the mailbox in read-only mode instead.
+			return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+				Type: imap.StatusRespNo,
+				Code: "UNAVAILABLE",
+				Info: "Server is in maintenance mode, select the mailbox again",
+			}}
+		}
+	}
+	return nil
+}
+
+func (cmd *maintenanceFetch) Handle(conn imapserver.Conn) error {
+	if err := cmd.peek(conn); err != nil {
+		return err
+	}
+	return cmd.Fetch.Handle(conn)
+}
+
+func (cmd *maintenanceFetch) UidHandle(conn imapserver.Conn) error {
+	if err := cmd.peek(conn); err != nil {
+		return err
+	}
+	return cmd.Fetch.UidHandle(conn)
+}
+
+// getAccount returns the storage account for the user. Accounts are not
+// created automatically while the server is in maintenance mode.
+func (endp *Endpoint) getAccount(username string) (imapbackend.User, error) {
+	if maintenance.Enabled() {
+		return endp.Store.GetIMAPAcct(username)
+	}
+	return endp.Store.GetOrCreateIMAPAcct(username)
+}
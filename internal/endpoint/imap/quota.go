@@ -0,0 +1,222 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const quotaCapability = "QUOTA"
+
+var errOverQuota = &imap.ErrStatusResp{Resp: &imap.StatusResp{
+	Type: imap.StatusRespNo,
+	Code: "OVERQUOTA",
+	Info: "Quota exceeded",
+}}
+
+// quotaExtension implements QUOTA (RFC 2087) for storage backends that
+// implement module.QuotaStorage.
+//
+// Each account has a single quota root named "" that includes all its
+// mailboxes. Quotas can't be changed using SETQUOTA, use 'maddy imap-acct
+// quota' instead.
+type quotaExtension struct {
+	endp *Endpoint
+}
+
+func (ext *quotaExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState == 0 {
+		return nil
+	}
+	return []string{quotaCapability}
+}
+
+func (ext *quotaExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "GETQUOTA":
+		return func() imapserver.Handler {
+			return &getQuota{endp: ext.endp}
+		}
+	case "GETQUOTAROOT":
+		return func() imapserver.Handler {
+			return &getQuotaRoot{endp: ext.endp}
+		}
+	case "SETQUOTA":
+		return func() imapserver.Handler {
+			return setQuota{}
+		}
+	}
+	return nil
+}
+
+// quota returns the quota usage for the account the connection is
+// authenticated as.
+func (endp *Endpoint) quota(conn imapserver.Conn) (module.QuotaUsage, error) {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return module.QuotaUsage{}, imapserver.ErrNotAuthenticated
+	}
+	qs, ok := endp.Store.(module.QuotaStorage)
+	if !ok {
+		return module.QuotaUsage{}, nil
+	}
+	return qs.GetQuota(ctx.User.Username())
+}
+
+// checkQuota returns errOverQuota if messages of the specified total size
+// can't be stored without exceeding the quota.
+func (endp *Endpoint) checkQuota(conn imapserver.Conn, count, size int64) error {
+	usage, err := endp.quota(conn)
+	if err != nil {
+		return err
+	}
+	if usage.StorageLimit != 0 && usage.StorageUsed+size > usage.StorageLimit {
+		return errOverQuota
+	}
+	if usage.MessagesLimit != 0 && usage.MessagesUsed+count > usage.MessagesLimit {
+		return errOverQuota
+	}
+	return nil
+}
+
+type getQuota struct {
+	endp *Endpoint
+	root string
+}
+
+func (cmd *getQuota) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("Quota root name is required")
+	}
+	var err error
+	cmd.root, err = imap.ParseString(fields[0])
+	return err
+}
+
+func (cmd *getQuota) Handle(conn imapserver.Conn) error {
+	usage, err := cmd.endp.quota(conn)
+	if err != nil {
+		return err
+	}
+	if cmd.root != "" {
+		return errors.New("No such quota root")
+	}
+	return conn.WriteResp(&quotaResp{usage: usage})
+}
+
+type getQuotaRoot struct {
+	endp    *Endpoint
+	mailbox string
+}
+
+func (cmd *getQuotaRoot) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("Mailbox name is required")
+	}
+	mailbox, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	mailbox, err = utf7.Encoding.NewDecoder().String(mailbox)
+	if err != nil {
+		return err
+	}
+	cmd.mailbox = imap.CanonicalMailboxName(mailbox)
+	return nil
+}
+
+func (cmd *getQuotaRoot) Handle(conn imapserver.Conn) error {
+	usage, err := cmd.endp.quota(conn)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the mailbox exists.
+	if _, err := conn.Context().User.Status(cmd.mailbox, []imap.StatusItem{imap.StatusMessages}); err != nil {
+		return err
+	}
+
+	if err := conn.WriteResp(&quotaRootResp{mailbox: cmd.mailbox}); err != nil {
+		return err
+	}
+	return conn.WriteResp(&quotaResp{usage: usage})
+}
+
+// setQuota rejects all SETQUOTA commands since users are not allowed to
+// change their quotas.
+type setQuota struct{}
+
+func (setQuota) Parse([]interface{}) error {
+	return nil
+}
+
+func (setQuota) Handle(conn imapserver.Conn) error {
+	if conn.Context().User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Code: "NOPERM",
+		Info: "Quota can't be changed",
+	}}
+}
+
+type quotaResp struct {
+	usage module.QuotaUsage
+}
+
+func (r *quotaResp) WriteTo(w *imap.Writer) error {
+	var resources []interface{}
+	if r.usage.StorageLimit != 0 {
+		// STORAGE is measured in units of 1024 octets.
+		resources = append(resources,
+			imap.RawString(module.QuotaResourceStorage),
+			imap.RawString(strconv.FormatInt(r.usage.StorageUsed/1024, 10)),
+			imap.RawString(strconv.FormatInt(r.usage.StorageLimit/1024, 10)))
+	}
+	if r.usage.MessagesLimit != 0 {
+		resources = append(resources,
+			imap.RawString(module.QuotaResourceMessages),
+			imap.RawString(strconv.FormatInt(r.usage.MessagesUsed, 10)),
+			imap.RawString(strconv.FormatInt(r.usage.MessagesLimit, 10)))
+	}
+	if resources == nil {
+		resources = []interface{}{}
+	}
+
+	return imap.NewUntaggedResp([]interface{}{imap.RawString("QUOTA"), "", resources}).WriteTo(w)
+}
+
+type quotaRootResp struct {
+	mailbox string
+}
+
+func (r *quotaRootResp) WriteTo(w *imap.Writer) error {
+	name, err := utf7.Encoding.NewEncoder().String(r.mailbox)
+	if err != nil {
+		return err
+	}
+	return imap.NewUntaggedResp([]interface{}{imap.RawString("QUOTAROOT"), imap.FormatMailboxName(name), ""}).WriteTo(w)
+}
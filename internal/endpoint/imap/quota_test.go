@@ -0,0 +1,70 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func TestQuotaResp(t *testing.T) {
+	for _, c := range []struct {
+		resp     imap.WriterTo
+		expected string
+	}{
+		{
+			resp:     &quotaResp{},
+			expected: "* QUOTA \"\" ()\r\n",
+		},
+		{
+			resp: &quotaResp{usage: module.QuotaUsage{
+				StorageUsed:   10 * 1024,
+				StorageLimit:  1024 * 1024,
+				MessagesUsed:  3,
+				MessagesLimit: 0,
+			}},
+			expected: "* QUOTA \"\" (STORAGE 10 1024)\r\n",
+		},
+		{
+			resp: &quotaResp{usage: module.QuotaUsage{
+				StorageUsed:   10 * 1024,
+				StorageLimit:  1024 * 1024,
+				MessagesUsed:  3,
+				MessagesLimit: 100,
+			}},
+			expected: "* QUOTA \"\" (STORAGE 10 1024 MESSAGE 3 100)\r\n",
+		},
+		{
+			resp:     &quotaRootResp{mailbox: "INBOX"},
+			expected: "* QUOTAROOT INBOX \"\"\r\n",
+		},
+	} {
+		var buf bytes.Buffer
+		w := imap.NewWriter(&buf)
+		if err := c.resp.WriteTo(w); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != c.expected {
+			t.Errorf("Expected %q, got %q", c.expected, buf.String())
+		}
+	}
+}
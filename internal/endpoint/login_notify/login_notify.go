@@ -0,0 +1,415 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package login_notify implements notifications about logins from
+// previously unseen IP addresses or countries.
+//
+// Locations seen for each account are kept in the state directory. If the
+// login location is new, the login_new_location server notification is sent
+// (see the global hook directive) and, optionally, the account owner gets an
+// email message.
+package login_notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/activity"
+	"github.com/foxcpp/maddy/internal/geoip"
+)
+
+const (
+	modName  = "login_notify"
+	fileName = "login_notify.json"
+
+	// queueSize is the amount of logins waiting to be processed, logins
+	// are dropped if the queue is full.
+	queueSize = 128
+)
+
+type login struct {
+	account  string
+	protocol string
+	activity.Login
+}
+
+// seenLocations contains the last time each location (IP address or country
+// code) was seen for each account.
+type seenLocations map[string]map[string]time.Time
+
+type Notifier struct {
+	log log.Logger
+
+	hostname     string
+	sender       string
+	target       module.DeliveryTarget
+	optOut       module.Table
+	track        string
+	maxLocations int
+	statePath    string
+
+	// Folder and flags to use for messages in the local storage.
+	folder string
+	flags  []string
+
+	geoip *geoip.DB
+	// country returns the ISO code of the country the IP address belongs
+	// to or an empty string if it is not known.
+	country func(ip net.IP) string
+
+	seen seenLocations
+
+	queueLck sync.RWMutex
+	queue    chan login
+	wg       sync.WaitGroup
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("%s: no arguments expected", modName)
+	}
+	return &Notifier{
+		log: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (n *Notifier) Init(cfg *config.Map) error {
+	var geoipPath string
+	cfg.Bool("debug", true, false, &n.log.Debug)
+	cfg.String("hostname", true, true, "", &n.hostname)
+	cfg.String("sender", false, false, "", &n.sender)
+	cfg.Custom("deliver_to", false, false, nil, modconfig.DeliveryDirective, &n.target)
+	cfg.Custom("opt_out", false, false, nil, modconfig.TableDirective, &n.optOut)
+	cfg.String("folder", false, false, "", &n.folder)
+	cfg.StringList("flags", false, false, nil, &n.flags)
+	cfg.String("geoip_db", false, false, "", &geoipPath)
+	cfg.Enum("track", false, false, []string{"ip", "country"}, "ip", &n.track)
+	cfg.Int("max_locations", false, false, 50, &n.maxLocations)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if n.track == "country" && geoipPath == "" {
+		return fmt.Errorf("%s: geoip_db is required to track countries", modName)
+	}
+	if n.maxLocations <= 0 {
+		return fmt.Errorf("%s: max_locations should be positive", modName)
+	}
+	if n.sender == "" {
+		n.sender = "postmaster@" + n.hostname
+	}
+	n.statePath = filepath.Join(config.StateDirectory, fileName)
+
+	if geoipPath != "" {
+		var err error
+		n.geoip, err = geoip.Open(geoipPath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+		n.country = n.lookupCountry
+	} else {
+		n.country = func(net.IP) string { return "" }
+	}
+
+	if module.NoRun {
+		return nil
+	}
+
+	if err := n.load(); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+
+	n.queue = make(chan login, queueSize)
+	n.wg.Add(1)
+	go n.loop(n.queue)
+	activity.AddLoginHandler(n.loggedIn)
+
+	return nil
+}
+
+func (n *Notifier) Name() string {
+	return modName
+}
+
+func (n *Notifier) InstanceName() string {
+	return ""
+}
+
+func (n *Notifier) Close() error {
+	n.queueLck.Lock()
+	running := n.queue != nil
+	if running {
+		close(n.queue)
+		n.queue = nil
+	}
+	n.queueLck.Unlock()
+	n.wg.Wait()
+
+	// Save the time locations were last seen.
+	if running {
+		if err := n.save(); err != nil {
+			n.log.Error("failed to save seen locations", err)
+		}
+	}
+	if n.geoip != nil {
+		return n.geoip.Close()
+	}
+	return nil
+}
+
+func (n *Notifier) lookupCountry(ip net.IP) string {
+	country, err := n.geoip.Country(ip)
+	if err != nil {
+		n.log.Error("GeoIP lookup failed", err, "ip", ip)
+	}
+	return country
+}
+
+// loggedIn queues the login for processing. It is called by the endpoint
+// that authenticated the client so it should not block.
+func (n *Notifier) loggedIn(account, protocol string, l activity.Login) {
+	n.queueLck.RLock()
+	defer n.queueLck.RUnlock()
+	if n.queue == nil {
+		return
+	}
+
+	select {
+	case n.queue <- login{account: account, protocol: protocol, Login: l}:
+	default:
+		n.log.Msg("too many logins, dropping", "username", account, "src_ip", l.IP)
+	}
+}
+
+func (n *Notifier) loop(queue <-chan login) {
+	defer n.wg.Done()
+	for l := range queue {
+		n.processSafe(l)
+	}
+}
+
+func (n *Notifier) processSafe(l login) {
+	defer func() {
+		if err := recover(); err != nil {
+			stack := debug.Stack()
+			log.Printf("panic during login notification: %v\n%s", err, stack)
+		}
+	}()
+	n.process(context.Background(), l)
+}
+
+func (n *Notifier) process(ctx context.Context, l login) {
+	var country string
+	if ip := net.ParseIP(l.IP); ip != nil {
+		country = n.country(ip)
+	}
+
+	location := l.IP
+	if n.track == "country" && country != "" {
+		location = country
+	}
+	if location == "" {
+		return
+	}
+
+	account := activity.Normalize(l.account)
+	// The very first login of the account is not reported since there is
+	// nothing to compare it with.
+	first := len(n.seen[account]) == 0
+	if !n.see(account, location, l.Time) {
+		return
+	}
+	if err := n.save(); err != nil {
+		n.log.Error("failed to save seen locations", err)
+	}
+	if first {
+		return
+	}
+
+	n.log.Msg("login from a new location", "username", account, "protocol", l.protocol, "src_ip", l.IP, "country", country)
+	hooks.Notify(hooks.NotifyNewLoginLocation, map[string]string{
+		"module":   modName,
+		"username": account,
+		"protocol": l.protocol,
+		"ip":       l.IP,
+		"country":  country,
+	})
+
+	if n.target == nil {
+		return
+	}
+	if !strings.Contains(account, "@") {
+		n.log.DebugMsg("account name is not an address, not sending the email", "username", account)
+		return
+	}
+	if n.optOut != nil {
+		_, optedOut, err := n.optOut.Lookup(ctx, account)
+		if err != nil {
+			n.log.Error("opt-out lookup failed", err, "username", account)
+			return
+		}
+		if optedOut {
+			n.log.DebugMsg("user opted out", "username", account)
+			return
+		}
+	}
+	if err := n.sendEmail(ctx, account, l, country); err != nil {
+		n.log.Error("failed to send the notification", err, "username", account)
+	}
+}
+
+// see records the login location and returns true if it was not seen before.
+func (n *Notifier) see(account, location string, t time.Time) bool {
+	locations := n.seen[account]
+	if locations == nil {
+		locations = map[string]time.Time{}
+		n.seen[account] = locations
+	}
+
+	_, known := locations[location]
+	locations[location] = t
+	if known {
+		return false
+	}
+
+	// Forget the least recently seen locations.
+	for len(locations) > n.maxLocations {
+		var (
+			oldest     string
+			oldestTime time.Time
+		)
+		for loc, seen := range locations {
+			if oldest == "" || seen.Before(oldestTime) {
+				oldest, oldestTime = loc, seen
+			}
+		}
+		delete(locations, oldest)
+	}
+	return true
+}
+
+func (n *Notifier) load() error {
+	n.seen = seenLocations{}
+	blob, err := os.ReadFile(n.statePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(blob, &n.seen)
+}
+
+func (n *Notifier) save() error {
+	blob, err := json.Marshal(n.seen)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(n.statePath), fileName+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(blob); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), n.statePath)
+}
+
+func (n *Notifier) sendEmail(ctx context.Context, rcpt string, l login, country string) (err error) {
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Date", time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	hdr.Add("Message-ID", "<"+msgID+"@"+n.hostname+">")
+	hdr.Add("From", "<"+n.sender+">")
+	hdr.Add("To", "<"+rcpt+">")
+	hdr.Add("Subject", "New login to your account")
+	hdr.Add("Auto-Submitted", "auto-generated")
+	hdr.Add("MIME-Version", "1.0")
+	hdr.Add("Content-Type", "text/plain; charset=utf-8")
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "There was a login to your account %s from a new location.\r\n\r\n", rcpt)
+	fmt.Fprintf(&body, "Time: %s\r\n", l.Time.UTC().Format("2006-01-02 15:04:05 MST"))
+	fmt.Fprintf(&body, "Protocol: %s\r\n", l.protocol)
+	fmt.Fprintf(&body, "IP address: %s\r\n", l.IP)
+	if country != "" {
+		fmt.Fprintf(&body, "Country: %s\r\n", country)
+	}
+	body.WriteString("\r\nIf it was you, no action is needed. Otherwise, change your password\r\n")
+	body.WriteString("immediately and contact the server administrator.\r\n")
+
+	msgMeta := &module.MsgMetadata{
+		ID:           msgID,
+		OriginalFrom: n.sender,
+		Folder:       n.folder,
+		Flags:        n.flags,
+	}
+
+	delivery, err := n.target.Start(ctx, msgMeta, n.sender)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if err := delivery.Abort(ctx); err != nil {
+				n.log.Error("failed to abort the notification delivery", err)
+			}
+		}
+	}()
+
+	if err = delivery.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+		return err
+	}
+	if err = delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: body.Bytes()}); err != nil {
+		return err
+	}
+	return delivery.Commit(ctx)
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
@@ -0,0 +1,146 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package login_notify
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/internal/activity"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testNotifier(t *testing.T, tgt *testutils.Target) *Notifier {
+	n := &Notifier{
+		log:          testutils.Logger(t, modName),
+		hostname:     "mx.example.org",
+		sender:       "postmaster@example.org",
+		target:       tgt,
+		track:        "ip",
+		maxLocations: 2,
+		statePath:    filepath.Join(t.TempDir(), fileName),
+		country: func(ip net.IP) string {
+			if ip.To4()[0] == 10 {
+				return "DE"
+			}
+			return "US"
+		},
+	}
+	if err := n.load(); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func doLogin(n *Notifier, account, ip string, t time.Time) {
+	n.process(context.Background(), login{
+		account:  account,
+		protocol: "imap",
+		Login:    activity.Login{Time: t, IP: ip},
+	})
+}
+
+func TestNotifier(t *testing.T) {
+	var notified []map[string]string
+	hooks.AddNotifyHandler(func(name string, params map[string]string) {
+		if name == hooks.NotifyNewLoginLocation {
+			notified = append(notified, params)
+		}
+	})
+
+	tgt := testutils.Target{}
+	n := testNotifier(t, &tgt)
+	now := time.Now()
+
+	// First login is not compared with anything.
+	doLogin(n, "Foxcpp@example.org", "10.0.0.1", now)
+	doLogin(n, "foxcpp@example.org", "10.0.0.1", now.Add(time.Minute))
+	if len(tgt.Messages) != 0 || len(notified) != 0 {
+		t.Fatalf("unexpected notification for known location: %v", notified)
+	}
+
+	doLogin(n, "foxcpp@example.org", "192.0.2.1", now.Add(2*time.Minute))
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	if len(msg.RcptTo) != 1 || msg.RcptTo[0] != "foxcpp@example.org" {
+		t.Errorf("wrong recipient: %v", msg.RcptTo)
+	}
+	if !strings.Contains(string(msg.Body), "IP address: 192.0.2.1\r\n") || !strings.Contains(string(msg.Body), "Country: US\r\n") {
+		t.Errorf("wrong body: %s", msg.Body)
+	}
+	if len(notified) != 1 || notified[0]["ip"] != "192.0.2.1" || notified[0]["username"] != "foxcpp@example.org" {
+		t.Errorf("wrong hook notification: %v", notified)
+	}
+
+	// The least recently seen location is forgotten.
+	doLogin(n, "foxcpp@example.org", "192.0.2.2", now.Add(3*time.Minute))
+	if _, ok := n.seen["foxcpp@example.org"]["10.0.0.1"]; ok {
+		t.Error("old location is not forgotten")
+	}
+
+	// State is saved.
+	n2 := testNotifier(t, &tgt)
+	n2.statePath = n.statePath
+	if err := n2.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(n2.seen["foxcpp@example.org"]) != 2 {
+		t.Errorf("state is not saved: %v", n2.seen)
+	}
+}
+
+func TestNotifier_Country(t *testing.T) {
+	tgt := testutils.Target{}
+	n := testNotifier(t, &tgt)
+	n.track = "country"
+	now := time.Now()
+
+	doLogin(n, "foxcpp@example.org", "10.0.0.1", now)
+	doLogin(n, "foxcpp@example.org", "10.0.0.2", now)
+	if len(tgt.Messages) != 0 {
+		t.Fatal("unexpected notification for the same country")
+	}
+	doLogin(n, "foxcpp@example.org", "192.0.2.1", now)
+	if len(tgt.Messages) != 1 {
+		t.Fatal("expected notification for the new country")
+	}
+}
+
+func TestNotifier_OptOut(t *testing.T) {
+	tgt := testutils.Target{}
+	n := testNotifier(t, &tgt)
+	n.optOut = testutils.Table{M: map[string]string{"foxcpp@example.org": ""}}
+	now := time.Now()
+
+	doLogin(n, "foxcpp@example.org", "10.0.0.1", now)
+	doLogin(n, "foxcpp@example.org", "192.0.2.1", now)
+	if len(tgt.Messages) != 0 {
+		t.Error("notification sent to the user that opted out")
+	}
+	if len(n.seen["foxcpp@example.org"]) != 2 {
+		t.Error("location is not recorded for the user that opted out")
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package managesieve implements the ManageSieve protocol (RFC 5804)
+// endpoint that allows users to manage their Sieve scripts.
+package managesieve
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/acctstatus"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/proxy_protocol"
+	"github.com/foxcpp/maddy/internal/sieve"
+)
+
+const modName = "managesieve"
+
+// idleTimeout is the maximum time the server waits for the next command.
+var idleTimeout = 10 * time.Minute
+
+type Endpoint struct {
+	addrs         []string
+	listeners     []net.Listener
+	listenersWg   sync.WaitGroup
+	proxyProtocol *proxy_protocol.ProxyProtocol
+	tlsConfig     *tls.Config
+	insecureAuth  bool
+	ioDebug       bool
+
+	store    sieve.Store
+	saslAuth auth.SASLAuth
+
+	storageNormalize authz.NormalizeFunc
+	storageMap       module.Table
+
+	connsLck sync.Mutex
+	conns    map[net.Conn]struct{}
+	connsWg  sync.WaitGroup
+
+	log log.Logger
+}
+
+func New(_ string, addrs []string) (module.Module, error) {
+	return &Endpoint{
+		addrs: addrs,
+		conns: map[net.Conn]struct{}{},
+		log:   log.Logger{Name: modName},
+		saslAuth: auth.SASLAuth{
+			Log: log.Logger{Name: modName + "/sasl"},
+		},
+	}, nil
+}
+
+func (endp *Endpoint) Name() string {
+	return modName
+}
+
+func (endp *Endpoint) InstanceName() string {
+	return modName
+}
+
+func sieveDirective(m *config.Map, node config.Node) (interface{}, error) {
+	var store sieve.Store
+	err := modconfig.ModuleFromNode("imap.filter", node.Args, node, m.Globals, &store)
+	return store, err
+}
+
+func (endp *Endpoint) Init(cfg *config.Map) error {
+	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
+		return endp.saslAuth.AddProvider(m, node)
+	})
+	cfg.Bool("sasl_login", false, false, &endp.saslAuth.EnableLogin)
+	cfg.Custom("sieve", false, true, nil, sieveDirective, &endp.store)
+	cfg.Custom("tls", true, true, nil, tls2.TLSDirective, &endp.tlsConfig)
+	cfg.Custom("proxy_protocol", false, false, nil, proxy_protocol.ProxyProtocolDirective, &endp.proxyProtocol)
+	cfg.Bool("insecure_auth", false, false, &endp.insecureAuth)
+	cfg.Bool("io_debug", false, false, &endp.ioDebug)
+	cfg.Bool("debug", true, false, &endp.log.Debug)
+	config.EnumMapped(cfg, "storage_map_normalize", false, false, authz.NormalizeFuncs, authz.NormalizeAuto,
+		&endp.storageNormalize)
+	modconfig.Table(cfg, "storage_map", false, false, nil, &endp.storageMap)
+	config.EnumMapped(cfg, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto,
+		&endp.saslAuth.AuthNormalize)
+	modconfig.Table(cfg, "auth_map", true, false, nil, &endp.saslAuth.AuthMap)
+	modconfig.Table(cfg, "account_status", true, false, nil, &endp.saslAuth.AccountStatus)
+	modconfig.Table(cfg, "auth_allowed_ips", true, false, nil, &endp.saslAuth.AllowedIPs)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	endp.saslAuth.StatusAllowed = acctstatus.Status.AllowsLogin
+
+	addresses := make([]config.Endpoint, 0, len(endp.addrs))
+	for _, addr := range endp.addrs {
+		saddr, err := config.ParseEndpoint(addr)
+		if err != nil {
+			return fmt.Errorf("%s: invalid address: %s", modName, addr)
+		}
+		addresses = append(addresses, saddr)
+	}
+
+	if endp.tlsConfig == nil {
+		endp.log.Println("TLS is disabled, this is insecure configuration and should be used only for testing!")
+		endp.insecureAuth = true
+	} else if endp.insecureAuth {
+		endp.log.Println("authentication over unencrypted connections is allowed, this is insecure configuration and should be used only for testing!")
+	}
+
+	return endp.setupListeners(addresses)
+}
+
+func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
+	for _, addr := range addresses {
+		l, err := net.Listen(addr.Network(), addr.Address())
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+		endp.log.Printf("listening on %v", addr)
+
+		if addr.IsTLS() {
+			if endp.tlsConfig == nil {
+				return fmt.Errorf("%s: can't bind on TLS endpoint without TLS configuration", modName)
+			}
+			l = tls.NewListener(l, endp.tlsConfig)
+		}
+		if endp.proxyProtocol != nil {
+			l = proxy_protocol.NewListener(l, endp.proxyProtocol, endp.log)
+		}
+
+		endp.listeners = append(endp.listeners, l)
+
+		endp.listenersWg.Add(1)
+		go func() {
+			defer endp.listenersWg.Done()
+			endp.serve(l, addr)
+		}()
+	}
+	return nil
+}
+
+func (endp *Endpoint) serve(l net.Listener, addr config.Endpoint) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && !strings.HasSuffix(err.Error(), "use of closed network connection") {
+				endp.log.Printf("failed to accept connection on %s: %v", addr, err)
+			}
+			return
+		}
+
+		endp.connsLck.Lock()
+		endp.conns[conn] = struct{}{}
+		endp.connsLck.Unlock()
+
+		endp.connsWg.Add(1)
+		go func() {
+			defer endp.connsWg.Done()
+			defer func() {
+				endp.connsLck.Lock()
+				delete(endp.conns, conn)
+				endp.connsLck.Unlock()
+			}()
+			endp.handleConn(conn)
+		}()
+	}
+}
+
+func (endp *Endpoint) usernameForStorage(ctx context.Context, saslUsername string) (string, error) {
+	saslUsername, err := endp.storageNormalize(saslUsername)
+	if err != nil {
+		return "", err
+	}
+
+	if endp.storageMap == nil {
+		return saslUsername, nil
+	}
+
+	mapped, ok, err := endp.storageMap.Lookup(ctx, saslUsername)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", auth.ErrInvalidAuthCred
+	}
+	return mapped, nil
+}
+
+func (endp *Endpoint) Close() error {
+	for _, l := range endp.listeners {
+		l.Close()
+	}
+	endp.listenersWg.Wait()
+
+	endp.connsLck.Lock()
+	for conn := range endp.conns {
+		conn.Close()
+	}
+	endp.connsLck.Unlock()
+	endp.connsWg.Wait()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
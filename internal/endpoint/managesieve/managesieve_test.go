@@ -0,0 +1,194 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package managesieve
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/sieve"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type testAuth struct{}
+
+func (testAuth) AuthPlain(username, password string) error {
+	if username == "user@example.org" && password == "secret" {
+		return nil
+	}
+	return errors.New("invalid credentials")
+}
+
+type testClient struct {
+	t  *testing.T
+	br *bufio.Reader
+	c  net.Conn
+}
+
+func (c testClient) send(line string) {
+	c.t.Helper()
+	if _, err := c.c.Write([]byte(line + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// readResponse reads lines until the OK/NO/BYE response and returns all
+// of them.
+func (c testClient) readResponse() []string {
+	c.t.Helper()
+	var lines []string
+	for {
+		line, err := c.br.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		lines = append(lines, line)
+		if strings.HasPrefix(line, "OK") || strings.HasPrefix(line, "NO") || strings.HasPrefix(line, "BYE") {
+			return lines
+		}
+	}
+}
+
+func (c testClient) expect(prefix string) []string {
+	c.t.Helper()
+	lines := c.readResponse()
+	if !strings.HasPrefix(lines[len(lines)-1], prefix) {
+		c.t.Fatalf("expected %s response, got %q", prefix, lines)
+	}
+	return lines
+}
+
+func testSession(t *testing.T) testClient {
+	endp := &Endpoint{
+		insecureAuth: true,
+		store:        &sieve.FSStore{Dir: t.TempDir(), MaxScripts: 2},
+		saslAuth: auth.SASLAuth{
+			Log:           testutils.Logger(t, modName+"/sasl"),
+			AuthNormalize: authz.NormalizeAuto,
+			Plain:         []module.PlainAuth{testAuth{}},
+		},
+		storageNormalize: authz.NormalizeAuto,
+		log:              testutils.Logger(t, modName),
+	}
+
+	srv, cl := net.Pipe()
+	go endp.handleConn(srv)
+	t.Cleanup(func() { cl.Close() })
+
+	c := testClient{t: t, br: bufio.NewReader(cl), c: cl}
+	greeting := c.expect("OK")
+	if !strings.Contains(strings.Join(greeting, "\n"), `"SASL" "PLAIN"`) {
+		t.Fatalf("unexpected greeting: %q", greeting)
+	}
+	return c
+}
+
+func TestSession(t *testing.T) {
+	c := testSession(t)
+
+	c.send(`LISTSCRIPTS`)
+	c.expect("NO")
+
+	c.send(`AUTHENTICATE "PLAIN" "` + base64.StdEncoding.EncodeToString([]byte("\x00user@example.org\x00wrong")) + `"`)
+	c.expect("NO")
+
+	// Without the initial response.
+	c.send(`AUTHENTICATE "PLAIN"`)
+	if line, _ := c.br.ReadString('\n'); line != "\"\"\r\n" {
+		t.Fatalf("expected empty challenge, got %q", line)
+	}
+	c.send(`"` + base64.StdEncoding.EncodeToString([]byte("\x00user@example.org\x00secret")) + `"`)
+	c.expect("OK")
+
+	c.send(`CHECKSCRIPT {8+}`)
+	c.send(`unknown;`)
+	c.expect("NO")
+
+	script := "require \"fileinto\";\r\nfileinto \"Junk\";\r\n"
+	c.send(`PUTSCRIPT "my script" {` + strconv.Itoa(len(script)) + `+}`)
+	c.send(script)
+	c.expect("OK")
+	c.send(`PUTSCRIPT "second" "keep;"`)
+	c.expect("OK")
+	c.send(`PUTSCRIPT "third" "keep;"`)
+	if lines := c.expect("NO"); !strings.HasPrefix(lines[0], "NO (QUOTA)") {
+		t.Errorf("expected QUOTA response code, got %q", lines)
+	}
+
+	c.send(`SETACTIVE "my script"`)
+	c.expect("OK")
+	c.send(`DELETESCRIPT "my script"`)
+	if lines := c.expect("NO"); !strings.HasPrefix(lines[0], "NO (ACTIVE)") {
+		t.Errorf("expected ACTIVE response code, got %q", lines)
+	}
+	c.send(`RENAMESCRIPT "second" "renamed"`)
+	c.expect("OK")
+
+	c.send(`LISTSCRIPTS`)
+	lines := c.expect("OK")
+	if want := []string{`"my script" ACTIVE`, `"renamed"`}; strings.Join(lines[:len(lines)-1], "\n") != strings.Join(want, "\n") {
+		t.Errorf("wrong scripts list: %q", lines)
+	}
+
+	c.send(`GETSCRIPT "my script"`)
+	lines = c.expect("OK")
+	if got := strings.Join(lines[:len(lines)-1], "\r\n"); got != "{"+strconv.Itoa(len(script))+"}\r\n"+script {
+		t.Errorf("wrong script: %q", got)
+	}
+
+	c.send(`GETSCRIPT "missing"`)
+	if lines := c.expect("NO"); !strings.HasPrefix(lines[0], "NO (NONEXISTENT)") {
+		t.Errorf("expected NONEXISTENT response code, got %q", lines)
+	}
+
+	c.send(`NOOP "tag1"`)
+	if lines := c.expect("OK"); !strings.HasPrefix(lines[0], `OK (TAG "tag1")`) {
+		t.Errorf("expected TAG response code, got %q", lines)
+	}
+
+	c.send(`LOGOUT`)
+	c.expect("OK")
+}
+
+func TestReadArgs(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("PUTSCRIPT \"a \\\"b\\\"\" {5+}\r\nkeep;\r\nNOOP\r\n"))
+	args, err := readArgs(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 3 || !args[0].atom || args[1].val != `a "b"` || args[2].val != "keep;" {
+		t.Fatalf("wrong args: %+v", args)
+	}
+	args, err = readArgs(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 1 || args[0].val != "NOOP" {
+		t.Fatalf("wrong args: %+v", args)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package managesieve
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxLineLength limits the length of the command line excluding
+	// literals.
+	maxLineLength = 8192
+	// maxLiteralSize limits the size of literals sent by the client.
+	maxLiteralSize = 1024 * 1024
+)
+
+var errLineTooLong = errors.New("managesieve: command line is too long")
+
+// arg is a command argument. Atoms are distinguished from strings since
+// command names and the cancellation of AUTHENTICATE are atoms.
+type arg struct {
+	val  string
+	atom bool
+}
+
+func readLine(br *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := br.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxLineLength {
+			return "", errLineTooLong
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// readArgs reads the command line (RFC 5804 Section 4) splitting it into
+// atoms and strings. Literals are read inline.
+func readArgs(br *bufio.Reader) ([]arg, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return nil, err
+	}
+
+	var args []arg
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			return args, nil
+		}
+
+		switch line[0] {
+		case '"':
+			var (
+				b      strings.Builder
+				closed bool
+				i      = 1
+			)
+			for ; i < len(line); i++ {
+				c := line[i]
+				if c == '\\' && i+1 < len(line) {
+					i++
+					c = line[i]
+				} else if c == '"' {
+					closed = true
+					break
+				}
+				b.WriteByte(c)
+			}
+			if !closed {
+				return nil, errors.New("unterminated quoted string")
+			}
+			args = append(args, arg{val: b.String()})
+			line = line[i+1:]
+		case '{':
+			end := strings.IndexByte(line, '}')
+			if end == -1 || end != len(line)-1 {
+				return nil, errors.New("malformed literal")
+			}
+			size, err := strconv.Atoi(strings.TrimSuffix(line[1:end], "+"))
+			if err != nil || size < 0 {
+				return nil, errors.New("malformed literal size")
+			}
+			if size > maxLiteralSize {
+				return nil, errors.New("literal is too big")
+			}
+			blob := make([]byte, size)
+			if _, err := io.ReadFull(br, blob); err != nil {
+				return nil, err
+			}
+			args = append(args, arg{val: string(blob)})
+
+			// Literal is followed by the rest of the command line.
+			line, err = readLine(br)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			end := strings.IndexByte(line, ' ')
+			if end == -1 {
+				end = len(line)
+			}
+			args = append(args, arg{val: line[:end], atom: true})
+			line = line[end:]
+		}
+	}
+}
+
+// quote formats the string as a quoted string or a literal if it can not
+// be quoted.
+func quote(s string) string {
+	if len(s) > 1024 || strings.ContainsAny(s, "\r\n\x00") {
+		return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
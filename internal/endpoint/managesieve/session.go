@@ -0,0 +1,420 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package managesieve
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/activity"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/sieve"
+)
+
+type session struct {
+	endp *Endpoint
+	conn net.Conn
+	br   *bufio.Reader
+	bw   *bufio.Writer
+	log  log.Logger
+
+	tlsState *tls.ConnectionState
+	username string
+}
+
+func (endp *Endpoint) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	s := &session{
+		endp: endp,
+		log:  endp.log,
+	}
+	s.setConn(conn)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			s.log.DebugMsg("TLS handshake failed", "src_ip", conn.RemoteAddr(), "reason", err)
+			return
+		}
+		state := tlsConn.ConnectionState()
+		s.tlsState = &state
+	}
+
+	s.capabilities()
+	if err := s.bw.Flush(); err != nil {
+		return
+	}
+
+	for {
+		if err := s.conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+			return
+		}
+		args, err := readArgs(s.br)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.log.DebugMsg("failed to read command", "src_ip", conn.RemoteAddr(), "reason", err)
+				s.response("BYE", "", err.Error())
+				s.bw.Flush()
+			}
+			return
+		}
+		if len(args) == 0 || !args[0].atom {
+			s.response("NO", "", "Command name expected")
+		} else if !s.command(strings.ToUpper(args[0].val), args[1:]) {
+			s.bw.Flush()
+			return
+		}
+		if err := s.bw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+type debugConn struct {
+	net.Conn
+	log log.Logger
+}
+
+func (c debugConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.log.Debugf("C: %q", b[:n])
+	}
+	return n, err
+}
+
+func (c debugConn) Write(b []byte) (int, error) {
+	c.log.Debugf("S: %q", b)
+	return c.Conn.Write(b)
+}
+
+func (s *session) setConn(conn net.Conn) {
+	s.conn = conn
+	rw := conn
+	if s.endp.ioDebug {
+		rw = debugConn{Conn: conn, log: log.Logger{Name: modName + "/io", Debug: true}}
+	}
+	s.br = bufio.NewReader(rw)
+	s.bw = bufio.NewWriter(rw)
+}
+
+func (s *session) response(status, code, msg string) {
+	s.bw.WriteString(status)
+	if code != "" {
+		s.bw.WriteString(" (" + code + ")")
+	}
+	if msg != "" {
+		s.bw.WriteString(" " + quote(msg))
+	}
+	s.bw.WriteString("\r\n")
+}
+
+func (s *session) authAllowed() bool {
+	return s.tlsState != nil || s.endp.insecureAuth
+}
+
+func (s *session) capabilities() {
+	s.bw.WriteString(`"IMPLEMENTATION" "maddy"` + "\r\n")
+	s.bw.WriteString(`"SIEVE" ` + quote(strings.Join(sieve.Extensions, " ")) + "\r\n")
+	if s.username == "" {
+		mechs := ""
+		if s.authAllowed() {
+			mechs = strings.Join(s.endp.saslAuth.SASLMechanisms(), " ")
+		}
+		s.bw.WriteString(`"SASL" ` + quote(mechs) + "\r\n")
+		if s.tlsState == nil && s.endp.tlsConfig != nil {
+			s.bw.WriteString(`"STARTTLS"` + "\r\n")
+		}
+	} else {
+		s.bw.WriteString(`"OWNER" ` + quote(s.username) + "\r\n")
+	}
+	s.bw.WriteString(`"MAXREDIRECTS" "` + strconv.Itoa(sieve.MaxRedirects) + `"` + "\r\n")
+	s.bw.WriteString(`"VERSION" "1.0"` + "\r\n")
+	s.response("OK", "", "")
+}
+
+// command executes the command. It returns false if the connection should
+// be closed.
+func (s *session) command(name string, args []arg) bool {
+	switch name {
+	case "CAPABILITY":
+		s.capabilities()
+		return true
+	case "LOGOUT":
+		s.response("OK", "", "Bye")
+		return false
+	case "NOOP":
+		if len(args) == 1 {
+			s.response("OK", "TAG "+quote(args[0].val), "Done")
+			return true
+		}
+		s.response("OK", "", "Done")
+		return true
+	case "STARTTLS":
+		return s.startTLS()
+	case "AUTHENTICATE":
+		return s.authenticate(args)
+	}
+
+	if s.username == "" {
+		s.response("NO", "", "Authenticate first")
+		return true
+	}
+
+	switch name {
+	case "LISTSCRIPTS":
+		s.listScripts()
+	case "GETSCRIPT":
+		if s.checkArgs(args, 1) {
+			s.getScript(args[0].val)
+		}
+	case "PUTSCRIPT":
+		if s.checkArgs(args, 2) {
+			s.putScript(args[0].val, args[1].val)
+		}
+	case "CHECKSCRIPT":
+		if s.checkArgs(args, 1) {
+			if _, err := sieve.Parse(args[0].val); err != nil {
+				s.response("NO", "", err.Error())
+			} else {
+				s.response("OK", "", "Script is valid")
+			}
+		}
+	case "SETACTIVE":
+		if s.checkArgs(args, 1) {
+			s.storeOp(s.endp.store.SetActive(s.username, args[0].val), "Script activated")
+		}
+	case "DELETESCRIPT":
+		if s.checkArgs(args, 1) {
+			s.storeOp(s.endp.store.DeleteScript(s.username, args[0].val), "Script deleted")
+		}
+	case "RENAMESCRIPT":
+		if s.checkArgs(args, 2) {
+			s.storeOp(s.endp.store.RenameScript(s.username, args[0].val, args[1].val), "Script renamed")
+		}
+	case "HAVESPACE":
+		if s.checkArgs(args, 2) {
+			size, err := strconv.ParseInt(args[1].val, 10, 64)
+			if err != nil {
+				s.response("NO", "", "Invalid size")
+				return true
+			}
+			s.storeOp(s.endp.store.CheckSpace(s.username, args[0].val, size), "Putscript would succeed")
+		}
+	default:
+		s.response("NO", "", "Unknown command")
+	}
+	return true
+}
+
+func (s *session) checkArgs(args []arg, count int) bool {
+	if len(args) != count {
+		s.response("NO", "", fmt.Sprintf("%d arguments expected", count))
+		return false
+	}
+	return true
+}
+
+// storeOp reports the result of a script storage operation to the client.
+func (s *session) storeOp(err error, okMsg string) {
+	switch {
+	case err == nil:
+		s.response("OK", "", okMsg)
+	case errors.Is(err, sieve.ErrNoSuchScript):
+		s.response("NO", "NONEXISTENT", "Script does not exist")
+	case errors.Is(err, sieve.ErrScriptExists):
+		s.response("NO", "ALREADYEXISTS", "Script already exists")
+	case errors.Is(err, sieve.ErrScriptActive):
+		s.response("NO", "ACTIVE", "Active script can not be deleted")
+	case errors.Is(err, sieve.ErrQuotaExceeded):
+		s.response("NO", "QUOTA", err.Error())
+	case errors.Is(err, sieve.ErrInvalidName):
+		s.response("NO", "", "Invalid script name")
+	default:
+		s.log.Error("script storage operation failed", err, "username", s.username)
+		s.response("NO", "TRYLATER", "Internal server error, try again later")
+	}
+}
+
+func (s *session) listScripts() {
+	scripts, err := s.endp.store.ListScripts(s.username)
+	if err != nil {
+		s.storeOp(err, "")
+		return
+	}
+	for _, script := range scripts {
+		s.bw.WriteString(quote(script.Name))
+		if script.Active {
+			s.bw.WriteString(" ACTIVE")
+		}
+		s.bw.WriteString("\r\n")
+	}
+	s.response("OK", "", "Listscripts completed")
+}
+
+func (s *session) getScript(name string) {
+	content, err := s.endp.store.GetScript(s.username, name)
+	if err != nil {
+		s.storeOp(err, "")
+		return
+	}
+	fmt.Fprintf(s.bw, "{%d}\r\n%s\r\n", len(content), content)
+	s.response("OK", "", "Getscript completed")
+}
+
+func (s *session) putScript(name, content string) {
+	if _, err := sieve.Parse(content); err != nil {
+		s.response("NO", "", err.Error())
+		return
+	}
+	s.storeOp(s.endp.store.PutScript(s.username, name, content), "Script stored")
+}
+
+func (s *session) startTLS() bool {
+	if s.tlsState != nil {
+		s.response("NO", "", "TLS is already active")
+		return true
+	}
+	if s.endp.tlsConfig == nil {
+		s.response("NO", "", "TLS is not supported")
+		return true
+	}
+	if s.username != "" {
+		s.response("NO", "", "STARTTLS is not allowed after authentication")
+		return true
+	}
+	if s.br.Buffered() != 0 {
+		// Prevent STARTTLS command injection.
+		s.response("BYE", "", "Unexpected data after STARTTLS")
+		return false
+	}
+
+	s.response("OK", "", "Begin TLS negotiation now")
+	if err := s.bw.Flush(); err != nil {
+		return false
+	}
+
+	tlsConn := tls.Server(s.conn, s.endp.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		s.log.DebugMsg("TLS handshake failed", "src_ip", s.conn.RemoteAddr(), "reason", err)
+		return false
+	}
+	state := tlsConn.ConnectionState()
+	s.tlsState = &state
+	s.setConn(tlsConn)
+
+	// RFC 5804 Section 2.2: capabilities are sent again after the TLS
+	// negotiation.
+	s.capabilities()
+	return true
+}
+
+func (s *session) authenticate(args []arg) bool {
+	if s.username != "" {
+		s.response("NO", "", "Already authenticated")
+		return true
+	}
+	if len(args) != 1 && len(args) != 2 {
+		s.response("NO", "", "Mechanism name expected")
+		return true
+	}
+	if !s.authAllowed() {
+		s.response("NO", "ENCRYPT-NEEDED", "Use STARTTLS first")
+		return true
+	}
+
+	mech := strings.ToUpper(args[0].val)
+	supported := false
+	for _, m := range s.endp.saslAuth.SASLMechanisms() {
+		if m == mech {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		s.response("NO", "", "Unsupported mechanism")
+		return true
+	}
+
+	var username string
+	srv := s.endp.saslAuth.CreateSASL(mech, s.conn.RemoteAddr(), s.tlsState, func(identity string, _ auth.ContextData) error {
+		var err error
+		username, err = s.endp.usernameForStorage(context.TODO(), identity)
+		return err
+	})
+
+	var response []byte
+	if len(args) == 2 {
+		var err error
+		response, err = base64.StdEncoding.DecodeString(args[1].val)
+		if err != nil {
+			s.response("NO", "", "Malformed initial response")
+			return true
+		}
+	}
+
+	for {
+		challenge, done, err := srv.Next(response)
+		if err != nil {
+			s.log.Msg("authentication failed", "reason", err, "src_ip", s.conn.RemoteAddr())
+			s.response("NO", "", "Authentication failed")
+			return true
+		}
+		if done {
+			break
+		}
+
+		s.bw.WriteString(quote(base64.StdEncoding.EncodeToString(challenge)) + "\r\n")
+		if err := s.bw.Flush(); err != nil {
+			return false
+		}
+		clientArgs, err := readArgs(s.br)
+		if err != nil {
+			return false
+		}
+		if len(clientArgs) != 1 {
+			s.response("NO", "", "Malformed response")
+			return true
+		}
+		if clientArgs[0].val == "*" {
+			s.response("NO", "", "Authentication cancelled")
+			return true
+		}
+		response, err = base64.StdEncoding.DecodeString(clientArgs[0].val)
+		if err != nil {
+			s.response("NO", "", "Malformed response")
+			return true
+		}
+	}
+
+	s.username = username
+	s.log.DebugMsg("authenticated", "username", username, "src_ip", s.conn.RemoteAddr())
+	activity.RecordLogin(username, modName, s.conn.RemoteAddr())
+	s.response("OK", "", "Logged in")
+	return true
+}
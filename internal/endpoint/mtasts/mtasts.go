@@ -0,0 +1,231 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package mtasts implements the HTTP endpoint serving MTA-STS policies
+// (RFC 8461) for local domains.
+//
+// The policy is served at https://mta-sts.<domain>/.well-known/mta-sts.txt.
+// The list of MX hosts defaults to the server hostname so the policy matches
+// the configuration without repeating it.
+package mtasts
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	stdlog "log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const (
+	modName    = "mta-sts"
+	policyPath = "/.well-known/mta-sts.txt"
+
+	// maxMaxAge is the upper limit for max_age defined by RFC 8461.
+	maxMaxAge = 31557600 * time.Second
+)
+
+type Endpoint struct {
+	addrs  []string
+	logger log.Logger
+
+	tlsConfig *tls.Config
+	domains   map[string]struct{}
+	policy    []byte
+	policyID  string
+
+	listenersWg sync.WaitGroup
+	serv        http.Server
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	return &Endpoint{
+		addrs:  args,
+		logger: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	var (
+		hostname string
+		domains  []string
+		mode     string
+		mxs      []string
+		maxAge   time.Duration
+	)
+	cfg.Bool("debug", true, false, &e.logger.Debug)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.StringList("domains", false, true, nil, &domains)
+	cfg.Enum("mode", false, false, []string{"enforce", "testing", "none"}, "testing", &mode)
+	cfg.StringList("mx", false, false, nil, &mxs)
+	cfg.Duration("max_age", false, false, 7*24*time.Hour, &maxAge)
+	cfg.Custom("tls", true, false, nil, tls2.TLSDirective, &e.tlsConfig)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(mxs) == 0 {
+		if hostname == "" {
+			return fmt.Errorf("%s: mx is not specified and hostname is not set", modName)
+		}
+		mxs = []string{hostname}
+	}
+	if maxAge < time.Second || maxAge > maxMaxAge {
+		return fmt.Errorf("%s: max_age should be between 1s and %v", modName, maxMaxAge)
+	}
+
+	e.domains = make(map[string]struct{}, len(domains))
+	for _, d := range domains {
+		d, err := dns.ForLookup(d)
+		if err != nil {
+			return fmt.Errorf("%s: invalid domain: %w", modName, err)
+		}
+		e.domains[d] = struct{}{}
+	}
+
+	e.policy = formatPolicy(mode, mxs, maxAge)
+	e.policyID = policyID(e.policy)
+	for d := range e.domains {
+		e.logger.DebugMsg("serving policy", "domain", d,
+			"txt_name", "_mta-sts."+d, "txt_value", "v=STSv1; id="+e.policyID)
+	}
+
+	e.serv.Handler = e.handler()
+	e.serv.ReadHeaderTimeout = 30 * time.Second
+	e.serv.ErrorLog = stdlog.New(e.logger.DebugWriter(), "", 0)
+
+	if module.NoRun {
+		return nil
+	}
+
+	for _, a := range e.addrs {
+		endp, err := config.ParseEndpoint(a)
+		if err != nil {
+			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
+		}
+		l, err := net.Listen(endp.Network(), endp.Address())
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+		if endp.IsTLS() {
+			if e.tlsConfig == nil {
+				l.Close()
+				return fmt.Errorf("%s: can't bind on TLS endpoint without TLS configuration", modName)
+			}
+			l = tls.NewListener(l, e.tlsConfig)
+		}
+
+		e.listenersWg.Add(1)
+		go func() {
+			e.logger.Println("listening on", endp.String())
+			err := e.serv.Serve(l)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				e.logger.Error("serve failed", err, "endpoint", a)
+			}
+			e.listenersWg.Done()
+		}()
+	}
+
+	return nil
+}
+
+// formatPolicy returns the policy file contents as defined in RFC 8461,
+// Section 3.2.
+func formatPolicy(mode string, mxs []string, maxAge time.Duration) []byte {
+	var b strings.Builder
+	b.WriteString("version: STSv1\r\n")
+	b.WriteString("mode: " + mode + "\r\n")
+	for _, mx := range mxs {
+		b.WriteString("mx: " + strings.TrimSuffix(mx, ".") + "\r\n")
+	}
+	b.WriteString("max_age: " + strconv.FormatInt(int64(maxAge/time.Second), 10) + "\r\n")
+	return []byte(b.String())
+}
+
+// policyID derives the policy identifier from its contents so it changes
+// each time the policy does.
+func policyID(policy []byte) string {
+	sum := sha256.Sum256(policy)
+	return hex.EncodeToString(sum[:10])
+}
+
+// PolicyID returns the value to use as id in the _mta-sts TXT record for the
+// served policy.
+func (e *Endpoint) PolicyID() string {
+	return e.policyID
+}
+
+func (e *Endpoint) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+policyPath, e.servePolicy)
+	return mux
+}
+
+func (e *Endpoint) servePolicy(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	domain, ok := strings.CutPrefix(strings.ToLower(host), "mta-sts.")
+	if ok {
+		domain, _ = dns.ForLookup(domain)
+		_, ok = e.domains[domain]
+	}
+	if !ok {
+		e.logger.DebugMsg("policy requested for unknown host", "host", r.Host, "src_ip", r.RemoteAddr)
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.policy)))
+	_, _ = w.Write(e.policy)
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return ""
+}
+
+func (e *Endpoint) Close() error {
+	if err := e.serv.Close(); err != nil {
+		return err
+	}
+	e.listenersWg.Wait()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
@@ -0,0 +1,110 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mtasts
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func testEndpoint(t *testing.T, children ...config.Node) *Endpoint {
+	t.Helper()
+
+	module.NoRun = true
+	t.Cleanup(func() { module.NoRun = false })
+
+	mod, err := New("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := mod.(*Endpoint)
+	globals := map[string]interface{}{"hostname": "mx.example.org"}
+	if err := e.Init(config.NewMap(globals, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestFormatPolicy(t *testing.T) {
+	policy := formatPolicy("enforce", []string{"mx1.example.org.", "*.example.org"}, 24*time.Hour)
+	expected := "version: STSv1\r\n" +
+		"mode: enforce\r\n" +
+		"mx: mx1.example.org\r\n" +
+		"mx: *.example.org\r\n" +
+		"max_age: 86400\r\n"
+	if string(policy) != expected {
+		t.Errorf("wrong policy:\n%q\nexpected:\n%q", policy, expected)
+	}
+}
+
+func TestServePolicy(t *testing.T) {
+	e := testEndpoint(t,
+		config.Node{Name: "domains", Args: []string{"example.org", "Example.COM"}},
+		config.Node{Name: "mode", Args: []string{"enforce"}},
+	)
+	h := e.handler()
+
+	get := func(host string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, policyPath, nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		body, _ := io.ReadAll(rec.Body)
+		return rec.Code, string(body)
+	}
+
+	expected := "version: STSv1\r\nmode: enforce\r\nmx: mx.example.org\r\nmax_age: 604800\r\n"
+	for _, host := range []string{"mta-sts.example.org", "MTA-STS.example.com:443"} {
+		code, body := get(host)
+		if code != http.StatusOK {
+			t.Errorf("%s: status %d", host, code)
+			continue
+		}
+		if body != expected {
+			t.Errorf("%s: wrong policy: %q", host, body)
+		}
+	}
+	for _, host := range []string{"example.org", "mta-sts.example.net", "www.example.org"} {
+		if code, _ := get(host); code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", host, code)
+		}
+	}
+}
+
+func TestPolicyID(t *testing.T) {
+	e1 := testEndpoint(t, config.Node{Name: "domains", Args: []string{"example.org"}})
+	e2 := testEndpoint(t, config.Node{Name: "domains", Args: []string{"example.org"}})
+	if e1.PolicyID() != e2.PolicyID() {
+		t.Error("policy id differs for the same policy")
+	}
+	e3 := testEndpoint(t,
+		config.Node{Name: "domains", Args: []string{"example.org"}},
+		config.Node{Name: "mx", Args: []string{"mx2.example.org"}},
+	)
+	if e1.PolicyID() == e3.PolicyID() {
+		t.Error("policy id is the same for different policies")
+	}
+}
@@ -0,0 +1,58 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package probe
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	probeFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "probe",
+			Name:      "failures",
+			Help:      "Failed delivery probes, stage is either 'send' or 'receive'",
+		},
+		[]string{"rcpt", "stage"},
+	)
+	probeLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "probe",
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Time of the last successfully completed delivery probe",
+		},
+		[]string{"rcpt"},
+	)
+	probeLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "maddy",
+			Subsystem: "probe",
+			Name:      "latency_seconds",
+			Help:      "Time between sending the delivery probe and its reception (or acceptance, if reception is not checked)",
+			Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800},
+		},
+		[]string{"rcpt"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(probeFailures)
+	prometheus.MustRegister(probeLastSuccess)
+	prometheus.MustRegister(probeLatency)
+}
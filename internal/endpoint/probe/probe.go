@@ -0,0 +1,287 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package probe implements the synthetic delivery probes scheduler.
+//
+// The prober periodically sends test messages to the configured addresses
+// and, optionally, waits for them (or replies containing the probe token in
+// the subject) to arrive to the local mailbox. Results are exported as
+// Prometheus metrics.
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const modName = "probe"
+
+type Prober struct {
+	log log.Logger
+
+	hostname     string
+	sender       string
+	rcpts        []string
+	interval     time.Duration
+	timeout      time.Duration
+	pollInterval time.Duration
+	target       module.DeliveryTarget
+	storage      module.Storage
+	account      string
+	folder       string
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("%s: no arguments expected", modName)
+	}
+	return &Prober{
+		log:  log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		stop: make(chan struct{}),
+	}, nil
+}
+
+func (p *Prober) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &p.log.Debug)
+	cfg.String("hostname", true, true, "", &p.hostname)
+	cfg.String("sender", false, true, "", &p.sender)
+	cfg.StringList("rcpt", false, true, nil, &p.rcpts)
+	cfg.Duration("interval", false, false, 5*time.Minute, &p.interval)
+	cfg.Duration("timeout", false, false, 10*time.Minute, &p.timeout)
+	cfg.Duration("poll_interval", false, false, 15*time.Second, &p.pollInterval)
+	cfg.Custom("deliver_to", false, true, nil, modconfig.DeliveryDirective, &p.target)
+	cfg.Custom("check_storage", false, false, nil, modconfig.StorageDirective, &p.storage)
+	cfg.String("check_account", false, false, "", &p.account)
+	cfg.String("check_folder", false, false, "INBOX", &p.folder)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if p.storage != nil && p.account == "" {
+		return fmt.Errorf("%s: check_account is required if check_storage is used", modName)
+	}
+	if p.interval <= 0 {
+		return fmt.Errorf("%s: interval should be positive", modName)
+	}
+
+	if module.NoRun {
+		return nil
+	}
+
+	p.wg.Add(1)
+	go p.loop()
+
+	return nil
+}
+
+func (p *Prober) Name() string {
+	return modName
+}
+
+func (p *Prober) InstanceName() string {
+	return ""
+}
+
+func (p *Prober) Close() error {
+	close(p.stop)
+	p.wg.Wait()
+	return nil
+}
+
+func (p *Prober) loop() {
+	defer p.wg.Done()
+
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			for _, rcpt := range p.rcpts {
+				p.wg.Add(1)
+				go p.run(rcpt)
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *Prober) run(rcpt string) {
+	defer p.wg.Done()
+	defer func() {
+		if err := recover(); err != nil {
+			stack := debug.Stack()
+			log.Printf("panic during delivery probe: %v\n%s", err, stack)
+		}
+	}()
+
+	start := time.Now()
+
+	token, err := p.send(context.Background(), rcpt)
+	if err != nil {
+		p.log.Error("failed to send the probe", err, "rcpt", rcpt)
+		probeFailures.WithLabelValues(rcpt, "send").Inc()
+		return
+	}
+	p.log.DebugMsg("probe sent", "rcpt", rcpt, "token", token)
+
+	if p.storage != nil {
+		if err := p.waitReception(token, start); err != nil {
+			p.log.Error("probe is not received", err, "rcpt", rcpt, "token", token)
+			probeFailures.WithLabelValues(rcpt, "receive").Inc()
+			return
+		}
+	}
+
+	latency := time.Since(start)
+	p.log.DebugMsg("probe completed", "rcpt", rcpt, "token", token, "latency", latency)
+	probeLatency.WithLabelValues(rcpt).Observe(latency.Seconds())
+	probeLastSuccess.WithLabelValues(rcpt).SetToCurrentTime()
+}
+
+func (p *Prober) send(ctx context.Context, rcpt string) (token string, err error) {
+	token, err = module.GenerateMsgID()
+	if err != nil {
+		return "", err
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Date", time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	hdr.Add("Message-ID", "<"+token+"@"+p.hostname+">")
+	hdr.Add("From", "<"+p.sender+">")
+	hdr.Add("To", "<"+rcpt+">")
+	hdr.Add("Subject", "Delivery probe "+token)
+	hdr.Add("X-Maddy-Probe", token)
+	hdr.Add("MIME-Version", "1.0")
+	hdr.Add("Content-Type", "text/plain; charset=us-ascii")
+	body := buffer.MemoryBuffer{Slice: []byte("This message was sent automatically to check the mail delivery.\r\n")}
+
+	msgMeta := &module.MsgMetadata{
+		ID:           token,
+		OriginalFrom: p.sender,
+	}
+
+	delivery, err := p.target.Start(ctx, msgMeta, p.sender)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			if err := delivery.Abort(ctx); err != nil {
+				p.log.Error("failed to abort the probe delivery", err)
+			}
+		}
+	}()
+
+	if err = delivery.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+		return "", err
+	}
+	if err = delivery.Body(ctx, hdr, body); err != nil {
+		return "", err
+	}
+	if err = delivery.Commit(ctx); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+var errTimeout = errors.New("probe: timed out")
+
+func (p *Prober) waitReception(token string, start time.Time) error {
+	t := time.NewTicker(p.pollInterval)
+	defer t.Stop()
+
+	deadline := time.NewTimer(time.Until(start.Add(p.timeout)))
+	defer deadline.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			found, err := p.checkReceived(token)
+			if err != nil {
+				// Temporary storage errors should not fail the probe
+				// immediately.
+				p.log.Error("mailbox check failed", err, "token", token)
+			}
+			if found {
+				return nil
+			}
+		case <-deadline.C:
+			return errTimeout
+		case <-p.stop:
+			return errors.New("probe: server is stopping")
+		}
+	}
+}
+
+// checkReceived looks for messages with token in the subject in the
+// configured folder and removes them if found.
+func (p *Prober) checkReceived(token string) (bool, error) {
+	u, err := p.storage.GetIMAPAcct(p.account)
+	if err != nil {
+		return false, err
+	}
+	defer u.Logout()
+
+	_, mbox, err := u.GetMailbox(p.folder, false, nil)
+	if err != nil {
+		return false, err
+	}
+	defer mbox.Close()
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Subject", token)
+	uids, err := mbox.SearchMessages(true, criteria)
+	if err != nil {
+		return false, err
+	}
+	if len(uids) == 0 {
+		return false, nil
+	}
+
+	seq := &imap.SeqSet{}
+	seq.AddNum(uids...)
+	if err := mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.DeletedFlag}); err != nil {
+		return true, fmt.Errorf("probe: cleanup failed: %w", err)
+	}
+	if err := mbox.Expunge(); err != nil {
+		return true, fmt.Errorf("probe: cleanup failed: %w", err)
+	}
+	return true, nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
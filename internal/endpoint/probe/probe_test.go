@@ -0,0 +1,135 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package probe
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// memUser passes the dummy connection to the memory backend, it crashes on
+// updates otherwise.
+type memUser struct {
+	imapbackend.User
+}
+
+type nopConn struct{}
+
+func (nopConn) SendUpdate(imapbackend.Update) error {
+	return nil
+}
+
+func (u memUser) GetMailbox(name string, readOnly bool, _ imapbackend.Conn) (*imap.MailboxStatus, imapbackend.Mailbox, error) {
+	return u.User.GetMailbox(name, readOnly, nopConn{})
+}
+
+type memStorage struct {
+	user imapbackend.User
+}
+
+func (s memStorage) GetOrCreateIMAPAcct(string) (imapbackend.User, error) {
+	return memUser{s.user}, nil
+}
+
+func (s memStorage) GetIMAPAcct(string) (imapbackend.User, error) {
+	return memUser{s.user}, nil
+}
+
+func (memStorage) IMAPExtensions() []string {
+	return nil
+}
+
+func TestProber(t *testing.T) {
+	user, err := memory.New().Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tgt := testutils.Target{}
+	p := &Prober{
+		log:          testutils.Logger(t, modName),
+		hostname:     "mx.example.org",
+		sender:       "probe@example.org",
+		rcpts:        []string{"reflector@example.com"},
+		timeout:      5 * time.Second,
+		pollInterval: 10 * time.Millisecond,
+		target:       &tgt,
+		storage:      memStorage{user: user},
+		account:      "username",
+		folder:       "INBOX",
+		stop:         make(chan struct{}),
+	}
+
+	start := time.Now()
+	token, err := p.send(context.Background(), "reflector@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected 1 message to be sent, got", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	if msg.MailFrom != "probe@example.org" || len(msg.RcptTo) != 1 || msg.RcptTo[0] != "reflector@example.com" {
+		t.Fatal("Wrong envelope:", msg.MailFrom, msg.RcptTo)
+	}
+	if msg.Header.Get("X-Maddy-Probe") != token {
+		t.Fatal("Wrong probe token:", msg.Header.Get("X-Maddy-Probe"))
+	}
+
+	if found, err := p.checkReceived(token); err != nil || found {
+		t.Fatal("Unexpected checkReceived result before reflection:", found, err)
+	}
+
+	// Reflect the message back to the mailbox.
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, msg.Header); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(msg.Body)
+	if err := user.CreateMessage("INBOX", nil, time.Now(), bytes.NewReader(buf.Bytes()), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.waitReception(token, start); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reflected message should be removed.
+	_, mbox, err := user.GetMailbox("INBOX", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Subject", token)
+	uids, err := mbox.SearchMessages(true, criteria)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uids) != 0 {
+		t.Fatal("Probe message is not removed")
+	}
+}
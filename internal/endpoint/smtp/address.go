@@ -0,0 +1,83 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+// cleanSender checks and normalizes the MAIL FROM argument. Both returned
+// values are empty for the null reverse-path.
+//
+// It is kept free of side effects so it can be fuzzed separately from the
+// session.
+func cleanSender(from string, smtpUTF8 bool) (cleanFrom, domain string, err error) {
+	if from == "" {
+		return "", "", nil
+	}
+
+	// INTERNATIONALIZATION: Do not permit non-ASCII addresses unless SMTPUTF8 is
+	// used.
+	if !smtpUTF8 && !address.IsASCII(from) {
+		return "", "", &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 6, 7},
+			Message:      "SMTPUTF8 is required for non-ASCII senders",
+		}
+	}
+
+	// Decode punycode, normalize to NFC and case-fold address.
+	cleanFrom, err = address.CleanDomain(from)
+	if err != nil {
+		return "", "", &exterrors.SMTPError{
+			Code:         553,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 7},
+			Message:      "Unable to normalize the sender address",
+		}
+	}
+
+	_, domain, err = address.Split(cleanFrom)
+	if err != nil {
+		return "", "", err
+	}
+	return cleanFrom, domain, nil
+}
+
+// cleanRecipient checks and normalizes the RCPT TO argument.
+func cleanRecipient(to string, smtpUTF8 bool) (string, error) {
+	// INTERNATIONALIZATION: Do not permit non-ASCII addresses unless SMTPUTF8 is
+	// used.
+	if !smtpUTF8 && !address.IsASCII(to) {
+		return "", &exterrors.SMTPError{
+			Code:         553,
+			EnhancedCode: exterrors.EnhancedCode{5, 6, 7},
+			Message:      "SMTPUTF8 is required for non-ASCII recipients",
+		}
+	}
+	cleanTo, err := address.CleanDomain(to)
+	if err != nil {
+		return "", &exterrors.SMTPError{
+			Code:         501,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 2},
+			Message:      "Unable to normalize the recipient address",
+		}
+	}
+	return cleanTo, nil
+}
@@ -0,0 +1,79 @@
+package smtp
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+// Seed inputs are in addition to the corpus in testdata/fuzz.
+
+func FuzzCleanSender(f *testing.F) {
+	for _, addr := range []string{
+		"",
+		"test@example.org",
+		"test@EXAMPLE.ORG",
+		"\"quoted local\"@example.org",
+		"тест@пример.рф",
+		"test@xn--e1afmkfd.xn--p1ai",
+		"postmaster",
+		"@example.org",
+	} {
+		f.Add(addr, false)
+		f.Add(addr, true)
+	}
+
+	f.Fuzz(func(t *testing.T, from string, smtpUTF8 bool) {
+		cleanFrom, domain, err := cleanSender(from, smtpUTF8)
+		if err != nil {
+			return
+		}
+		if from != "" && cleanFrom == "" {
+			t.Errorf("empty address returned for %q", from)
+		}
+		if utf8.ValidString(from) && !utf8.ValidString(domain) {
+			t.Errorf("invalid UTF-8 domain %q returned for %q", domain, from)
+		}
+	})
+}
+
+func FuzzCleanRecipient(f *testing.F) {
+	for _, addr := range []string{
+		"test@example.org",
+		"postmaster",
+		"Test@Example.Org",
+		"тест@пример.рф",
+		"test@xn--80ak6aa92e.com",
+		"\"a@b\"@example.org",
+	} {
+		f.Add(addr, false)
+		f.Add(addr, true)
+	}
+
+	f.Fuzz(func(t *testing.T, to string, smtpUTF8 bool) {
+		_, _ = cleanRecipient(to, smtpUTF8)
+	})
+}
+
+func FuzzParseReceivedFrom(f *testing.F) {
+	f.Add("from mx.example.org (mx.example.org [192.0.2.1]) by mx.example.com with ESMTP id 1234")
+	f.Add("from helo.example.org (unknown [IPv6:2001:db8::1])\r\n\tby mx.example.com (Postfix) with ESMTPS id ABCD")
+	f.Add("from [192.0.2.2] (helo=laptop) by mx.example.com with esmtp (Exim 4.96) id 1abc")
+	f.Add("by mx.example.com (Postfix, from userid 1000) id ABCD")
+
+	f.Fuzz(func(t *testing.T, value string) {
+		client := parseReceivedFrom(value)
+		if client != nil && client.IP == nil {
+			t.Errorf("client without IP returned for %q", value)
+		}
+	})
+}
+
+func FuzzParseMessageDateTime(f *testing.F) {
+	f.Add("Mon, 02 Jan 2006 15:04:05 -0700")
+	f.Add("2 Jan 2006 15:04 MST (Mountain Standard Time)")
+	f.Add("Mon, 2 Jan 06 15:04:05 -0700 (comment) (another)")
+
+	f.Fuzz(func(t *testing.T, value string) {
+		_, _ = parseMessageDateTime(value)
+	})
+}
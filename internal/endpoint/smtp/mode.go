@@ -0,0 +1,104 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"github.com/foxcpp/maddy/framework/config"
+
+	// Modules used by default checks.
+	_ "github.com/foxcpp/maddy/internal/check/authorize_sender"
+	_ "github.com/foxcpp/maddy/internal/check/dkim"
+	_ "github.com/foxcpp/maddy/internal/check/spf"
+)
+
+// endpointMode describes defaults and restrictions specific to the endpoint
+// module type (smtp, submission or lmtp).
+type endpointMode struct {
+	// Protocol is LMTP instead of SMTP.
+	lmtp bool
+
+	// Default value for the allow_auth directive. If it is false,
+	// configuring the auth directive is an error unless allow_auth is set
+	// explicitly.
+	authAllowed bool
+
+	// Authentication is required before starting a transaction, auth
+	// directive is mandatory.
+	authRequired bool
+
+	// Message header is fixed up as described in RFC 6409 before the
+	// message is processed.
+	submissionPrepare bool
+
+	// tls directive is mandatory.
+	tlsRequired bool
+
+	// Checks used if the endpoint configuration does not contain any
+	// check blocks.
+	defaultChecks []string
+}
+
+var modes = map[string]endpointMode{
+	// MX endpoint accepting messages from other servers. Authentication
+	// is not permitted by default since messages from authenticated
+	// clients bypass many checks and it is easy to end up with an open
+	// relay by mistake.
+	"smtp": {
+		tlsRequired:   true,
+		defaultChecks: []string{"dkim", "spf"},
+	},
+	// Message submission endpoint for mail clients (RFC 6409).
+	"submission": {
+		authAllowed:       true,
+		authRequired:      true,
+		submissionPrepare: true,
+		tlsRequired:       true,
+		defaultChecks:     []string{"authorize_sender"},
+	},
+	// LMTP endpoint for local delivery, usually used over Unix sockets.
+	"lmtp": {
+		lmtp:        true,
+		authAllowed: true,
+	},
+}
+
+// hasChecks reports whether there is a check block anywhere in the
+// pipeline configuration.
+func hasChecks(nodes []config.Node) bool {
+	for _, node := range nodes {
+		if node.Name == "check" || hasChecks(node.Children) {
+			return true
+		}
+	}
+	return false
+}
+
+// withDefaultChecks adds the check block with default checks of the mode
+// to the pipeline configuration if it does not contain any checks.
+func (m endpointMode) withDefaultChecks(nodes []config.Node) []config.Node {
+	if len(m.defaultChecks) == 0 || hasChecks(nodes) {
+		return nodes
+	}
+
+	checks := config.Node{Name: "check"}
+	for _, name := range m.defaultChecks {
+		checks.Children = append(checks.Children, config.Node{Name: name})
+	}
+	return append([]config.Node{checks}, nodes...)
+}
@@ -0,0 +1,163 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"net"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// trustedRelaysDirective parses the list of IP addresses and networks of
+// trusted relays.
+func trustedRelaysDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "at least one network is required")
+	}
+	nets := make([]net.IPNet, 0, len(node.Args))
+	for _, arg := range node.Args {
+		if !strings.Contains(arg, "/") {
+			ip := net.ParseIP(arg)
+			if ip == nil {
+				return nil, config.NodeErr(node, "malformed IP: %s", arg)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		nets = append(nets, *ipNet)
+	}
+	return nets, nil
+}
+
+func (endp *Endpoint) isTrustedRelay(ip net.IP) bool {
+	for _, n := range endp.trustedRelays {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// relayedClient walks the Received header fields added by trusted relays
+// and returns the first client that is not a trusted relay.
+//
+// nil is returned if the chain ends or a field can't be parsed before such
+// client is found.
+func (endp *Endpoint) relayedClient(header textproto.Header) *module.RelayedClient {
+	// Fields are prepended by each hop so the first one is added by the
+	// relay connected to us.
+	for f := header.FieldsByKey("Received"); f.Next(); {
+		client := parseReceivedFrom(f.Value())
+		if client == nil {
+			return nil
+		}
+		if !endp.isTrustedRelay(client.IP) {
+			return client
+		}
+	}
+	return nil
+}
+
+// parseReceivedFrom extracts the client IP and HELO hostname from the "from"
+// clause of the Received field value.
+//
+// Formats used by common MTAs are recognized:
+//
+//	from helo.example.org (rdns.example.org [192.0.2.1]) by ...
+//	from helo.example.org (rdns.example.org [IPv6:2001:db8::1]) by ...
+//	from [192.0.2.1] (helo=helo.example.org) by ...
+//	from rdns.example.org ([192.0.2.1]:1234 helo=helo.example.org) by ...
+func parseReceivedFrom(value string) *module.RelayedClient {
+	value = strings.Join(strings.Fields(value), " ")
+	if indexFoldASCII(value, "from ") != 0 {
+		return nil
+	}
+	value = value[len("from "):]
+	// Only the "from" clause is interesting, "by" and everything after it
+	// describes the relay itself.
+	if idx := indexFoldASCII(value, " by "); idx != -1 {
+		value = value[:idx]
+	}
+
+	client := &module.RelayedClient{}
+	if helo, _, _ := strings.Cut(value, " "); !strings.HasPrefix(helo, "[") {
+		client.Hostname = helo
+	}
+	if _, helo, ok := strings.Cut(value, "helo="); ok {
+		helo, _, _ = strings.Cut(helo, " ")
+		client.Hostname = strings.TrimRight(helo, ")")
+	}
+
+	// The first address literal is the client address.
+	start := strings.Index(value, "[")
+	if start == -1 {
+		return nil
+	}
+	end := strings.Index(value[start:], "]")
+	if end == -1 {
+		return nil
+	}
+	literal := value[start+1 : start+end]
+	if len(literal) > 5 && strings.EqualFold(literal[:5], "IPv6:") {
+		literal = literal[5:]
+	}
+	client.IP = net.ParseIP(literal)
+	if client.IP == nil {
+		return nil
+	}
+	if v4 := client.IP.To4(); v4 != nil {
+		client.IP = v4
+	}
+	return client
+}
+
+// indexFoldASCII is strings.Index that ignores the case of ASCII letters.
+// Unlike strings.ToLower, it keeps byte offsets valid for non-ASCII or
+// malformed input. substr should be lower-case.
+func indexFoldASCII(s, substr string) int {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		match := true
+		for j := 0; j < len(substr); j++ {
+			ch := s[i+j]
+			if 'A' <= ch && ch <= 'Z' {
+				ch += 'a' - 'A'
+			}
+			if ch != substr[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
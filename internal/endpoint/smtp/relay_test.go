@@ -0,0 +1,124 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func TestParseReceivedFrom(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		ip    string
+		helo  string
+	}{
+		{
+			value: "from mx.example.org (mx.example.org [192.0.2.1]) by mx.example.com (envelope-sender <a@example.org>) with ESMTP id 1234; Tue, 1 Jan 2030 00:00:00 +0000",
+			ip:    "192.0.2.1",
+			helo:  "mx.example.org",
+		},
+		{
+			value: "from helo.example.org (unknown [IPv6:2001:db8::1])\r\n\tby mx.example.com (Postfix) with ESMTPS id ABCD\r\n\tfor <b@example.com>; Tue, 1 Jan 2030 00:00:00 +0000",
+			ip:    "2001:db8::1",
+			helo:  "helo.example.org",
+		},
+		{
+			value: "from [192.0.2.2] (helo=laptop) by mx.example.com with esmtp (Exim 4.96) id 1abc",
+			ip:    "192.0.2.2",
+			helo:  "laptop",
+		},
+		{
+			value: "from rdns.example.org ([192.0.2.3]:51234 helo=helo.example.org) by mx.example.com with esmtps (Exim 4.96) id 1abc",
+			ip:    "192.0.2.3",
+			helo:  "helo.example.org",
+		},
+		{
+			value: "from mx.example.org (mx.example.org [192.0.2.1]) by mx.example.com",
+			ip:    "192.0.2.1",
+			helo:  "mx.example.org",
+		},
+		{value: "by mx.example.com (Postfix, from userid 1000) id ABCD"},
+		{value: "from mx.example.org by mx.example.com [192.0.2.1] with ESMTP"},
+		{value: "from mx.example.org (mx.example.org [not-an-ip]) by mx.example.com"},
+	} {
+		client := parseReceivedFrom(c.value)
+		if c.ip == "" {
+			if client != nil {
+				t.Errorf("%q: expected no client, got %+v", c.value, client)
+			}
+			continue
+		}
+		if client == nil {
+			t.Errorf("%q: failed to parse", c.value)
+			continue
+		}
+		if !client.IP.Equal(net.ParseIP(c.ip)) {
+			t.Errorf("%q: wrong IP: %v", c.value, client.IP)
+		}
+		if client.Hostname != c.helo {
+			t.Errorf("%q: wrong HELO: %v", c.value, client.Hostname)
+		}
+	}
+}
+
+func TestRelayedClient(t *testing.T) {
+	nets, err := trustedRelaysDirective(nil, config.Node{Args: []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endp := &Endpoint{trustedRelays: nets.([]net.IPNet)}
+
+	hdr := textproto.Header{}
+	// Fields are added in the reverse order.
+	hdr.Add("Received", "from mail.example.net (mail.example.net [203.0.113.1]) by gw1.example.org")
+	hdr.Add("Received", "from gw1.example.org (gw1.example.org [10.1.1.1]) by gw2.example.org")
+	hdr.Add("Received", "from gw2.example.org (gw2.example.org [IPv6:2001:db8::2]) by mx.example.org")
+	hdr.Add("Received", "from mx.example.org (mx.example.org [192.0.2.1]) by relay.example.org")
+
+	client := endp.relayedClient(hdr)
+	if client == nil {
+		t.Fatal("client not found")
+	}
+	if !client.IP.Equal(net.IPv4(203, 0, 113, 1)) || client.Hostname != "mail.example.net" {
+		t.Errorf("wrong client: %+v", client)
+	}
+
+	// Malformed field in the chain.
+	hdr.Add("Received", "from unknown by gw0.example.org")
+	if client := endp.relayedClient(hdr); client != nil {
+		t.Errorf("expected no client for a broken chain, got %+v", client)
+	}
+
+	// All hops are trusted.
+	hdr = textproto.Header{}
+	hdr.Add("Received", "from gw1.example.org (gw1.example.org [10.1.1.1]) by gw2.example.org")
+	if client := endp.relayedClient(hdr); client != nil {
+		t.Errorf("expected no client, got %+v", client)
+	}
+
+	for _, arg := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := trustedRelaysDirective(nil, config.Node{Args: []string{arg}}); err == nil {
+			t.Errorf("%s: expected an error", arg)
+		}
+	}
+}
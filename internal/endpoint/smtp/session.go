@@ -21,6 +21,7 @@ package smtp
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -39,7 +40,13 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/activity"
 	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/limits"
+	"github.com/foxcpp/maddy/internal/maintenance"
+	"github.com/foxcpp/maddy/internal/msgtrace"
+	"github.com/foxcpp/maddy/internal/sessions"
+	"github.com/foxcpp/maddy/internal/transcript"
 )
 
 func limitReader(r io.Reader, n int64, err error) *limitedReader {
@@ -80,6 +87,9 @@ type Session struct {
 	connState        module.ConnState
 	repeatedMailErrs int
 	loggedRcptErrors int
+	transcript       *transcript.Recorder
+	// tracked is nil for sessions created in tests.
+	tracked *sessions.Session
 
 	// Specific for the currently handled message.
 	// msgCtx is not used for cancellation or timeouts, only for tracing.
@@ -94,23 +104,49 @@ type Session struct {
 	msgMeta     *module.MsgMetadata
 	delivery    module.Delivery
 	deliveryErr error
+	// quotaSender and rcptCount are used for limits quota accounting.
+	quotaSender limits.Sender
+	rcptCount   int
 
 	log log.Logger
 }
 
 func (s *Session) AuthMechanisms() []string {
-	return s.endp.saslAuth.SASLMechanisms()
+	mechs := s.endp.saslAuth.SASLMechanisms()
+	if s.tlsState() != nil {
+		return mechs
+	}
+
+	// Mechanisms with channel binding require TLS.
+	filtered := make([]string, 0, len(mechs))
+	for _, mech := range mechs {
+		if !strings.HasSuffix(mech, "-PLUS") {
+			filtered = append(filtered, mech)
+		}
+	}
+	return filtered
+}
+
+func (s *Session) tlsState() *tls.ConnectionState {
+	if !s.connState.TLS.HandshakeComplete {
+		return nil
+	}
+	return &s.connState.TLS
 }
 
 func (s *Session) Auth(mech string) (sasl.Server, error) {
-	return s.endp.saslAuth.CreateSASL(mech, s.connState.RemoteAddr, func(identity string, data auth.ContextData) error {
+	s.tracked.Touch()
+	return s.endp.saslAuth.CreateSASL(mech, s.connState.RemoteAddr, s.tlsState(), func(identity string, data auth.ContextData) error {
 		s.connState.AuthUser = identity
 		s.connState.AuthPassword = data.Password
+		activity.RecordLogin(identity, s.endp.name, s.connState.RemoteAddr)
+		s.tracked.SetUsername(identity)
 		return nil
 	}), nil
 }
 
 func (s *Session) Reset() {
+	s.tracked.Touch()
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
 
@@ -154,23 +190,46 @@ func (s *Session) cleanSession() {
 	s.msgMeta = nil
 	s.delivery = nil
 	s.deliveryErr = nil
+	s.quotaSender = limits.Sender{}
+	s.rcptCount = 0
 	s.msgCtx = nil
 	s.msgTask.End()
 }
 
+// errAccountDisabled is returned if the account status does not permit
+// sending messages (RFC 4954).
+var errAccountDisabled = &smtp.SMTPError{
+	Code:         525,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 13},
+	Message:      "User account disabled",
+}
+
+// errMaintenance is returned for all messages while the server is in
+// maintenance mode.
+var errMaintenance = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "Server is in maintenance mode, try again later",
+}
+
 func (s *Session) AuthPlain(username, password string) error {
+	s.tracked.Touch()
+
 	// Executed before authentication and session initialization.
 	if err := s.endp.pipeline.RunEarlyChecks(context.TODO(), &s.connState); err != nil {
 		return s.endp.wrapErr("", true, "AUTH", err)
 	}
 
 	// saslAuth will handle AuthMap and AuthNormalize.
-	err := s.endp.saslAuth.AuthPlain(username, password)
+	err := s.endp.saslAuth.AuthPlain(username, password, s.connState.RemoteAddr)
 	if err != nil {
 		s.endp.Log.Error("authentication failed", err, "username", username, "src_ip", s.connState.RemoteAddr)
 
 		failedLogins.WithLabelValues(s.endp.name).Inc()
 
+		if errors.Is(err, auth.ErrAccountDisabled) {
+			return errAccountDisabled
+		}
 		if exterrors.IsTemporary(err) {
 			return &smtp.SMTPError{
 				Code:         454,
@@ -188,6 +247,8 @@ func (s *Session) AuthPlain(username, password string) error {
 
 	s.connState.AuthUser = username
 	s.connState.AuthPassword = password
+	activity.RecordLogin(username, s.endp.name, s.connState.RemoteAddr)
+	s.tracked.SetUsername(username)
 
 	return nil
 }
@@ -220,46 +281,21 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 		)
 	}
 
-	// INTERNATIONALIZATION: Do not permit non-ASCII addresses unless SMTPUTF8 is
-	// used.
-	if !opts.UTF8 {
-		for _, ch := range from {
-			if ch > 128 {
-				return "", &exterrors.SMTPError{
-					Code:         550,
-					EnhancedCode: exterrors.EnhancedCode{5, 6, 7},
-					Message:      "SMTPUTF8 is required for non-ASCII senders",
-				}
-			}
-		}
-	}
-
-	// Decode punycode, normalize to NFC and case-fold address.
-	cleanFrom := from
-	if from != "" {
-		cleanFrom, err = address.CleanDomain(from)
-		if err != nil {
-			return "", &exterrors.SMTPError{
-				Code:         553,
-				EnhancedCode: exterrors.EnhancedCode{5, 1, 7},
-				Message:      "Unable to normalize the sender address",
-			}
-		}
+	cleanFrom, domain, err := cleanSender(from, opts.UTF8)
+	if err != nil {
+		return "", err
 	}
 
 	msgMeta.OriginalFrom = from
 
-	domain := ""
-	if cleanFrom != "" {
-		_, domain, err = address.Split(cleanFrom)
-		if err != nil {
-			return "", err
-		}
-	}
 	remoteIP, ok := msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
 	if !ok {
 		remoteIP = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
 	}
+	quotaSender := limits.Sender{IP: remoteIP.IP, Domain: domain, User: s.connState.AuthUser}
+	if err := s.endp.limits.CheckQuota(ctx, quotaSender, 1); err != nil {
+		return "", err
+	}
 	if err := s.endp.limits.TakeMsg(context.Background(), remoteIP.IP, domain); err != nil {
 		return "", err
 	}
@@ -282,24 +318,34 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	s.msgMeta = msgMeta
 	s.mailFrom = cleanFrom
 	s.delivery = delivery
+	s.quotaSender = quotaSender
 
 	return msgMeta.ID, nil
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
-	if s.endp.authAlwaysRequired && s.connState.AuthUser == "" {
+	s.tracked.Touch()
+
+	if s.endp.mode.authRequired && s.connState.AuthUser == "" {
 		return smtp.ErrAuthRequired
 	}
 
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
 
+	s.transcript.Sender(from)
+
+	if maintenance.Enabled() {
+		s.log.Msg("MAIL FROM deferred, maintenance mode is enabled", "sender", from)
+		return errMaintenance
+	}
+
 	if !s.endp.deferServerReject {
 		// Will initialize s.msgCtx.
 		msgID, err := s.startDelivery(s.sessionCtx, from, *opts)
 		if err != nil {
 			if !errors.Is(err, context.DeadlineExceeded) {
-				s.log.Error("MAIL FROM error", err, "msg_id", msgID)
+				s.log.Error("MAIL FROM error", withErrorID(err), "msg_id", msgID)
 			}
 			return s.endp.wrapErr(msgID, !opts.UTF8, "MAIL", err)
 		}
@@ -346,9 +392,12 @@ func (s *Session) fetchRDNSName(ctx context.Context) {
 }
 
 func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.tracked.Touch()
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
 
+	s.transcript.Rcpt(to)
+
 	// deferServerReject = true and this is the first RCPT TO command.
 	if s.delivery == nil {
 		// If we already attempted to initialize the delivery -
@@ -363,7 +412,7 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 		msgID, err := s.startDelivery(s.sessionCtx, s.mailFrom, s.opts)
 		if err != nil {
 			if !errors.Is(err, context.DeadlineExceeded) {
-				s.log.Error("MAIL FROM error (deferred)", err, "rcpt", to, "msg_id", msgID)
+				s.log.Error("MAIL FROM error (deferred)", withErrorID(err), "rcpt", to, "msg_id", msgID)
 			}
 			s.deliveryErr = s.endp.wrapErr(msgID, !s.opts.UTF8, "RCPT", err)
 			return s.deliveryErr
@@ -375,7 +424,7 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 
 	if err := s.rcpt(rcptCtx, to, opts); err != nil {
 		if s.loggedRcptErrors < s.endp.maxLoggedRcptErrors {
-			s.log.Error("RCPT error", err, "rcpt", to, "msg_id", s.msgMeta.ID)
+			s.log.Error("RCPT error", withErrorID(err), "rcpt", to, "msg_id", s.msgMeta.ID)
 			s.loggedRcptErrors++
 			if s.loggedRcptErrors == s.endp.maxLoggedRcptErrors {
 				s.log.Msg("too many RCPT errors, possible dictonary attack", "src_ip", s.connState.RemoteAddr, "msg_id", s.msgMeta.ID)
@@ -388,25 +437,20 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 }
 
 func (s *Session) rcpt(ctx context.Context, to string, opts *smtp.RcptOptions) error {
-	// INTERNATIONALIZATION: Do not permit non-ASCII addresses unless SMTPUTF8 is
-	// used.
-	if !address.IsASCII(to) && !s.opts.UTF8 {
-		return &exterrors.SMTPError{
-			Code:         553,
-			EnhancedCode: exterrors.EnhancedCode{5, 6, 7},
-			Message:      "SMTPUTF8 is required for non-ASCII recipients",
-		}
-	}
-	cleanTo, err := address.CleanDomain(to)
+	cleanTo, err := cleanRecipient(to, s.opts.UTF8)
 	if err != nil {
-		return &exterrors.SMTPError{
-			Code:         501,
-			EnhancedCode: exterrors.EnhancedCode{5, 1, 2},
-			Message:      "Unable to normalize the recipient address",
-		}
+		return err
+	}
+
+	if err := s.endp.limits.CheckQuota(ctx, s.quotaSender, s.rcptCount+1); err != nil {
+		return err
 	}
 
-	return s.delivery.AddRcpt(ctx, cleanTo, *opts)
+	if err := s.delivery.AddRcpt(ctx, cleanTo, *opts); err != nil {
+		return err
+	}
+	s.rcptCount++
+	return nil
 }
 
 func (s *Session) Logout() error {
@@ -423,26 +467,56 @@ func (s *Session) Logout() error {
 	if s.cancelRDNS != nil {
 		s.cancelRDNS()
 	}
+	s.tracked.Close()
 
 	s.endp.sessionCnt.Add(-1)
 
 	return nil
 }
 
-func (s *Session) prepareBody(r io.Reader) (textproto.Header, buffer.Buffer, error) {
+// preDataPeekSize is the amount of body bytes available to pre-DATA checks.
+const preDataPeekSize = 16 * 1024
+
+func (s *Session) prepareBody(ctx context.Context, r io.Reader) (textproto.Header, buffer.Buffer, error) {
 	limitr := limitReader(r, s.endp.maxHeaderBytes, &exterrors.SMTPError{
 		Code:         552,
 		EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
 		Message:      "Message header size exceeds limit",
 	})
 
-	bufr := bufio.NewReader(limitr)
+	bufr := bufio.NewReaderSize(limitr, preDataPeekSize)
 	header, err := textproto.ReadHeader(bufr)
 	if err != nil {
 		return textproto.Header{}, nil, fmt.Errorf("I/O error while parsing header: %w", err)
 	}
 
-	if s.endp.submission {
+	// Only authenticated clients can enable tracing, it makes all modules
+	// log a lot.
+	if s.connState.AuthUser != "" && header.Has(msgtrace.Header) {
+		header.Del(msgtrace.Header)
+		s.msgMeta.Trace = true
+		s.log.Msg("message tracing enabled", "msg_id", s.msgMeta.ID, "username", s.connState.AuthUser)
+	}
+
+	if s.connState.TrustedRelay {
+		// Should be set before any checks see the header.
+		s.msgMeta.RelayedClient = s.endp.relayedClient(header)
+		if s.msgMeta.RelayedClient != nil {
+			s.log.Msg("message from trusted relay",
+				"relay_ip", s.connState.RemoteAddr,
+				"src_host", s.msgMeta.RelayedClient.Hostname,
+				"src_ip", s.msgMeta.RelayedClient.IP.String(),
+				"msg_id", s.msgMeta.ID,
+			)
+		} else {
+			s.log.Msg("message from trusted relay, unable to determine the original client",
+				"relay_ip", s.connState.RemoteAddr,
+				"msg_id", s.msgMeta.ID,
+			)
+		}
+	}
+
+	if s.endp.mode.submissionPrepare {
 		// The MsgMetadata is passed by pointer all the way down.
 		if err := s.submissionPrepare(s.msgMeta, &header); err != nil {
 			return textproto.Header{}, nil, err
@@ -452,6 +526,18 @@ func (s *Session) prepareBody(r io.Reader) (textproto.Header, buffer.Buffer, err
 	// the header size check is done. The message size will be checked by go-smtp
 	limitr.Enabled = false
 
+	// Give header-only and pre-DATA checks a chance to reject the message
+	// before we spend resources on buffering the body.
+	if hd, ok := s.delivery.(module.HeaderDelivery); ok {
+		prefix, err := bufr.Peek(preDataPeekSize)
+		if err != nil && err != io.EOF {
+			return textproto.Header{}, nil, fmt.Errorf("I/O error while reading body: %w", err)
+		}
+		if err := hd.Header(ctx, header, prefix); err != nil {
+			return textproto.Header{}, nil, err
+		}
+	}
+
 	buf, err := s.endp.buffer(bufr)
 	if err != nil {
 		return textproto.Header{}, nil, fmt.Errorf("I/O error while writing buffer: %w", err)
@@ -461,6 +547,7 @@ func (s *Session) prepareBody(r io.Reader) (textproto.Header, buffer.Buffer, err
 }
 
 func (s *Session) Data(r io.Reader) error {
+	s.tracked.Touch()
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
 
@@ -468,11 +555,11 @@ func (s *Session) Data(r io.Reader) error {
 	defer bodyTask.End()
 
 	wrapErr := func(err error) error {
-		s.log.Error("DATA error", err, "msg_id", s.msgMeta.ID)
+		s.log.Error("DATA error", withErrorID(err), "msg_id", s.msgMeta.ID)
 		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
 	}
 
-	header, buf, err := s.prepareBody(r)
+	header, buf, err := s.prepareBody(bodyCtx, r)
 	if err != nil {
 		return wrapErr(err)
 	}
@@ -485,6 +572,11 @@ func (s *Session) Data(r io.Reader) error {
 		s.cleanSession()
 	}()
 
+	// The maintenance mode might have been enabled after MAIL FROM.
+	if maintenance.Enabled() {
+		return wrapErr(errMaintenance)
+	}
+
 	if err := s.checkRoutingLoops(header); err != nil {
 		return wrapErr(err)
 	}
@@ -500,6 +592,7 @@ func (s *Session) Data(r io.Reader) error {
 	if err := s.delivery.Commit(bodyCtx); err != nil {
 		return wrapErr(err)
 	}
+	s.endp.limits.ConsumeQuota(s.msgMeta.ID, s.quotaSender, s.rcptCount)
 
 	s.log.Msg("accepted", "msg_id", s.msgMeta.ID)
 
@@ -516,6 +609,7 @@ func (sw statusWrapper) SetStatus(rcpt string, err error) {
 }
 
 func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
+	s.tracked.Touch()
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
 
@@ -523,11 +617,11 @@ func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
 	defer bodyTask.End()
 
 	wrapErr := func(err error) error {
-		s.log.Error("DATA error", err, "msg_id", s.msgMeta.ID)
+		s.log.Error("DATA error", withErrorID(err), "msg_id", s.msgMeta.ID)
 		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
 	}
 
-	header, buf, err := s.prepareBody(r)
+	header, buf, err := s.prepareBody(bodyCtx, r)
 	if err != nil {
 		return wrapErr(err)
 	}
@@ -544,6 +638,10 @@ func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
 		s.msgMeta.TLSRequireOverride = true
 	}
 
+	if maintenance.Enabled() {
+		return wrapErr(errMaintenance)
+	}
+
 	if err := s.checkRoutingLoops(header); err != nil {
 		return wrapErr(err)
 	}
@@ -555,6 +653,7 @@ func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
 	if err := s.delivery.Commit(bodyCtx); err != nil {
 		return wrapErr(err)
 	}
+	s.endp.limits.ConsumeQuota(s.msgMeta.ID, s.quotaSender, s.rcptCount)
 
 	s.log.Msg("accepted", "msg_id", s.msgMeta.ID)
 
@@ -581,16 +680,63 @@ func (s *Session) checkRoutingLoops(header textproto.Header) error {
 	return nil
 }
 
+// expandReplyPlaceholders replaces placeholders that can be used in
+// configured rejection messages. Message ID is not appended to the message
+// if it is referenced explicitly.
+func (endp *Endpoint) expandReplyPlaceholders(msgId, msg string) string {
+	hasMsgId := strings.Contains(msg, "{msg_id}")
+
+	idStr := msgId
+	if idStr == "" {
+		idStr = "unknown"
+	}
+	msg = strings.NewReplacer(
+		"{msg_id}", idStr,
+		"{contact_url}", endp.contactURL,
+	).Replace(msg)
+
+	if !hasMsgId && msgId != "" {
+		msg += " (msg ID = " + msgId + ")"
+	}
+	return msg
+}
+
+// withErrorID attaches the error ID to errors that will be reported to the
+// client using the generic text so the reply can be matched with the log
+// message. Errors of known classes are translated to the specific status
+// (see exterrors.Translate).
+func withErrorID(err error) error {
+	if exterrors.IDOf(err) != "" {
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return exterrors.WithID(err, exterrors.IDSMTPDeadline)
+	}
+	if _, ok := exterrors.Fields(err)["smtp_msg"]; ok {
+		return err
+	}
+	if _, ok := err.(*smtp.SMTPError); ok {
+		return err
+	}
+	if tErr := exterrors.Translate(err); tErr != nil {
+		return tErr
+	}
+	return exterrors.WithID(err, exterrors.IDSMTPInternal)
+}
+
 func (endp *Endpoint) wrapErr(msgId string, mangleUTF8 bool, command string, err error) error {
 	if err == nil {
 		return nil
 	}
 
+	err = withErrorID(err)
+	errID := exterrors.IDOf(err)
+
 	if errors.Is(err, context.DeadlineExceeded) {
 		return &smtp.SMTPError{
 			Code:         451,
 			EnhancedCode: smtp.EnhancedCode{4, 4, 5},
-			Message:      "High load, try again later",
+			Message:      "High load, try again later " + exterrors.ReplySuffix(errID),
 		}
 	}
 
@@ -628,9 +774,14 @@ func (endp *Endpoint) wrapErr(msgId string, mangleUTF8 bool, command string, err
 		res.Message = smtpErr.Message
 	}
 
-	if msgId != "" {
+	if strings.Contains(res.Message, "{") {
+		res.Message = endp.expandReplyPlaceholders(msgId, res.Message)
+	} else if msgId != "" {
 		res.Message += " (msg ID = " + msgId + ")"
 	}
+	if errID != "" {
+		res.Message += " " + exterrors.ReplySuffix(errID)
+	}
 
 	failedCmds.WithLabelValues(endp.name, command, strconv.Itoa(res.Code),
 		fmt.Sprintf("%d.%d.%d",
@@ -22,6 +22,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -41,11 +42,14 @@ import (
 	"github.com/foxcpp/maddy/framework/future"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/acctstatus"
 	"github.com/foxcpp/maddy/internal/auth"
 	"github.com/foxcpp/maddy/internal/authz"
 	"github.com/foxcpp/maddy/internal/limits"
 	"github.com/foxcpp/maddy/internal/msgpipeline"
 	"github.com/foxcpp/maddy/internal/proxy_protocol"
+	"github.com/foxcpp/maddy/internal/sessions"
+	"github.com/foxcpp/maddy/internal/transcript"
 	"golang.org/x/net/idna"
 )
 
@@ -62,13 +66,14 @@ type Endpoint struct {
 
 	buffer func(r io.Reader) (buffer.Buffer, error)
 
-	authAlwaysRequired  bool
-	submission          bool
-	lmtp                bool
+	trustedRelays []net.IPNet
+
+	mode                endpointMode
 	deferServerReject   bool
 	maxLoggedRcptErrors int
 	maxReceived         int
 	maxHeaderBytes      int64
+	contactURL          string
 
 	sessionCnt atomic.Int32
 
@@ -89,14 +94,18 @@ func (endp *Endpoint) InstanceName() string {
 }
 
 func New(modName string, addrs []string) (module.Module, error) {
+	mode, ok := modes[modName]
+	if !ok {
+		return nil, fmt.Errorf("smtp: unknown endpoint type: %s", modName)
+	}
+
 	endp := &Endpoint{
-		name:       modName,
-		addrs:      addrs,
-		submission: modName == "submission",
-		lmtp:       modName == "lmtp",
-		resolver:   dns.DefaultResolver(),
-		buffer:     buffer.BufferInMemory,
-		Log:        log.Logger{Name: modName},
+		name:     modName,
+		addrs:    addrs,
+		mode:     mode,
+		resolver: dns.DefaultResolver(),
+		buffer:   buffer.BufferInMemory,
+		Log:      log.Logger{Name: modName},
 		saslAuth: auth.SASLAuth{
 			Log: log.Logger{Name: modName + "/sasl"},
 		},
@@ -107,9 +116,10 @@ func New(modName string, addrs []string) (module.Module, error) {
 func (endp *Endpoint) Init(cfg *config.Map) error {
 	endp.serv = smtp.NewServer(endp)
 	endp.serv.ErrorLog = endp.Log
-	endp.serv.LMTP = endp.lmtp
+	endp.serv.LMTP = endp.mode.lmtp
 	endp.serv.EnableSMTPUTF8 = true
 	endp.serv.EnableREQUIRETLS = true
+	endp.serv.EnableDSN = true
 	if err := endp.setConfig(cfg); err != nil {
 		return err
 	}
@@ -154,32 +164,24 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 
 func autoBufferMode(maxSize int, dir string) func(io.Reader) (buffer.Buffer, error) {
 	return func(r io.Reader) (buffer.Buffer, error) {
-		// First try to read up to N bytes.
-		initial := make([]byte, maxSize)
-		actualSize, err := io.ReadFull(r, initial)
+		// First try to read up to N bytes. The buffer grows as needed
+		// instead of being preallocated so small messages do not cost
+		// maxSize bytes each.
+		var initial bytes.Buffer
+		actualSize, err := io.CopyN(&initial, r, int64(maxSize))
 		if err != nil {
-			if err == io.ErrUnexpectedEOF {
-				log.Debugln("autobuffer: keeping the message in RAM (read", actualSize, "bytes, got EOF)")
-				return buffer.MemoryBuffer{Slice: initial[:actualSize]}, nil
-			}
 			if err == io.EOF {
-				// Special case: message with empty body.
-				return buffer.MemoryBuffer{}, nil
+				log.Debugln("autobuffer: keeping the message in RAM (read", actualSize, "bytes, got EOF)")
+				return buffer.MemoryBuffer{Slice: initial.Bytes()}, nil
 			}
 			// Some I/O error happened, bail out.
 			return nil, err
 		}
-		if actualSize < maxSize {
-			// Ok, the message is smaller than N. Make a MemoryBuffer and
-			// handle it in RAM.
-			log.Debugln("autobuffer: keeping the message in RAM (read", actualSize, "bytes, got short read)")
-			return buffer.MemoryBuffer{Slice: initial[:actualSize]}, nil
-		}
 
 		log.Debugln("autobuffer: spilling the message to the FS")
 		// The message is big. Dump what we got to the disk and continue writing it there.
 		return buffer.BufferInFile(
-			io.MultiReader(bytes.NewReader(initial[:actualSize]), r),
+			io.MultiReader(&initial, r),
 			dir)
 	}
 }
@@ -240,19 +242,26 @@ func bufferModeDirective(_ *config.Map, node config.Node) (interface{}, error) {
 
 func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	var (
-		hostname string
-		err      error
-		ioDebug  bool
+		hostname  string
+		err       error
+		ioDebug   bool
+		allowAuth bool
 	)
 
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
 		return endp.saslAuth.AddProvider(m, node)
 	})
 	cfg.Bool("sasl_login", false, false, &endp.saslAuth.EnableLogin)
+	if !endp.mode.authRequired {
+		cfg.Bool("allow_auth", false, endp.mode.authAllowed, &allowAuth)
+	}
 	cfg.String("hostname", true, true, "", &hostname)
+	cfg.String("contact_url", true, false, "", &endp.contactURL)
 	config.EnumMapped(cfg, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto,
 		&endp.saslAuth.AuthNormalize)
 	modconfig.Table(cfg, "auth_map", true, false, nil, &endp.saslAuth.AuthMap)
+	modconfig.Table(cfg, "account_status", true, false, nil, &endp.saslAuth.AccountStatus)
+	modconfig.Table(cfg, "auth_allowed_ips", true, false, nil, &endp.saslAuth.AllowedIPs)
 	cfg.Duration("write_timeout", false, false, 1*time.Minute, &endp.serv.WriteTimeout)
 	cfg.Duration("read_timeout", false, false, 10*time.Minute, &endp.serv.ReadTimeout)
 	cfg.DataSize("max_message_size", false, false, 32*1024*1024, &endp.serv.MaxMessageBytes)
@@ -266,9 +275,10 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 		}
 		return autoBufferMode(1*1024*1024 /* 1 MiB */, path), nil
 	}, bufferModeDirective, &endp.buffer)
-	cfg.Custom("tls", true, endp.name != "lmtp", nil, tls2.TLSDirective, &endp.serv.TLSConfig)
+	cfg.Custom("tls", true, endp.mode.tlsRequired, nil, tls2.TLSDirective, &endp.serv.TLSConfig)
 	cfg.Custom("proxy_protocol", false, false, nil, proxy_protocol.ProxyProtocolDirective, &endp.proxyProtocol)
-	cfg.Bool("insecure_auth", endp.name == "lmtp", false, &endp.serv.AllowInsecureAuth)
+	cfg.Custom("trusted_relays", false, false, nil, trustedRelaysDirective, &endp.trustedRelays)
+	cfg.Bool("insecure_auth", endp.mode.lmtp, false, &endp.serv.AllowInsecureAuth)
 	cfg.Int("smtp_max_line_length", false, false, 4000, &endp.serv.MaxLineLength)
 	cfg.Bool("io_debug", false, false, &ioDebug)
 	cfg.Bool("debug", true, false, &endp.Log.Debug)
@@ -295,7 +305,7 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 		return fmt.Errorf("%s: cannot represent the hostname as an A-label name: %w", endp.name, err)
 	}
 
-	endp.pipeline, err = msgpipeline.New(cfg.Globals, unknown)
+	endp.pipeline, err = msgpipeline.New(cfg.Globals, endp.mode.withDefaultChecks(unknown))
 	if err != nil {
 		return err
 	}
@@ -304,14 +314,19 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	endp.pipeline.Log = log.Logger{Name: "smtp/pipeline", Debug: endp.Log.Debug}
 	endp.pipeline.FirstPipeline = true
 
-	if endp.submission {
-		endp.authAlwaysRequired = true
+	if endp.mode.authRequired {
 		if len(endp.saslAuth.SASLMechanisms()) == 0 {
 			return fmt.Errorf("%s: auth. provider must be set for submission endpoint", endp.name)
 		}
+	} else if !allowAuth && len(endp.saslAuth.SASLMechanisms()) != 0 {
+		return fmt.Errorf("%s: authentication is not allowed on the MX endpoint, use the submission endpoint for clients or set allow_auth if it is intended", endp.name)
 	}
 	endp.saslAuth.AuthNormalize = endp.authNormalize
 	endp.saslAuth.AuthMap = endp.authMap
+	endp.saslAuth.StatusAllowed = acctstatus.Status.AllowsSending
+	endp.saslAuth.DisabledErr = errAccountDisabled
+
+	endp.serv.TLSConfig = transcript.TLSConfig(endp.serv.TLSConfig)
 
 	if ioDebug {
 		endp.serv.Debug = endp.Log.DebugWriter()
@@ -342,11 +357,13 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 			l = proxy_protocol.NewListener(l, endp.proxyProtocol, endp.Log)
 		}
 
+		l = transcript.Listener{Listener: l}
+
 		endp.listeners = append(endp.listeners, l)
 
 		endp.listenersWg.Add(1)
 		go func() {
-			if err := endp.serv.Serve(l); err != nil {
+			if err := endp.serv.Serve(l); err != nil && !errors.Is(err, net.ErrClosed) {
 				endp.Log.Printf("failed to serve %s: %s", addr, err)
 			}
 			endp.listenersWg.Done()
@@ -389,6 +406,13 @@ func (endp *Endpoint) newSession(conn *smtp.Conn) *Session {
 		LocalAddr:  conn.Conn().LocalAddr(),
 		RemoteAddr: conn.Conn().RemoteAddr(),
 	}
+	if tcpAddr, ok := s.connState.RemoteAddr.(*net.TCPAddr); ok {
+		s.connState.TrustedRelay = endp.isTrustedRelay(tcpAddr.IP)
+	}
+	s.transcript = transcript.FromConn(conn.Conn())
+	// Closing the network connection directly makes the server terminate the
+	// session even if a command is in progress.
+	s.tracked = sessions.Register(endp.name, s.connState.RemoteAddr, conn.Conn().Close)
 	if tlsState, ok := conn.TLSConnectionState(); ok {
 		s.connState.TLS = tlsState
 	}
@@ -419,8 +443,38 @@ func (endp *Endpoint) ConnectionCount() int {
 	return int(endp.sessionCnt.Load())
 }
 
+// StopListening implements module.DrainableEndpoint.
+func (endp *Endpoint) StopListening() error {
+	for _, l := range endp.listeners {
+		l.Close()
+	}
+	endp.listenersWg.Wait()
+	return nil
+}
+
+// Drain implements module.DrainableEndpoint.
+func (endp *Endpoint) Drain(ctx context.Context) error {
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+	for endp.ConnectionCount() != 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
+
+var drainPollInterval = time.Second
+
 func (endp *Endpoint) Close() error {
 	endp.serv.Close()
+	// Serve might not have registered the listener in serv yet if Close is
+	// called right after Init.
+	for _, l := range endp.listeners {
+		l.Close()
+	}
 	endp.listenersWg.Wait()
 	return nil
 }
@@ -19,12 +19,16 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package smtp
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"math/rand"
 	"net"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -35,6 +39,7 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/maintenance"
 	"github.com/foxcpp/maddy/internal/msgpipeline"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
@@ -177,6 +182,43 @@ func TestSMTPDelivery(t *testing.T) {
 	}
 }
 
+func TestSMTPDelivery_TrustedRelay(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{Name: "trusted_relays", Args: []string{"127.0.0.1", "10.0.0.0/8"}},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	err = submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.com"},
+		"Received: from gw.example.org (gw.example.org [10.0.0.2]) by mx.example.org\r\n"+
+			"Received: from mail.example.net (mail.example.net [203.0.113.1]) by gw.example.org\r\n"+
+			testMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	msgMeta := tgt.Messages[0].MsgMeta
+	if !msgMeta.Conn.TrustedRelay {
+		t.Error("Connection is not marked as coming from the trusted relay")
+	}
+	client := msgMeta.RelayedClient
+	if client == nil {
+		t.Fatal("Original client is not set")
+	}
+	if !client.IP.Equal(net.IPv4(203, 0, 113, 1)) || client.Hostname != "mail.example.net" {
+		t.Errorf("Wrong original client: %+v", client)
+	}
+}
+
 func TestSMTPDelivery_rDNSError(t *testing.T) {
 	tgt := testutils.Target{}
 	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
@@ -289,6 +331,128 @@ func TestSMTPDeliver_CheckError(t *testing.T) {
 	}
 }
 
+func TestSMTPDeliver_ErrorID(t *testing.T) {
+	tgt := testutils.Target{
+		RcptErr: map[string]error{
+			"internal@example.org": errors.New("something broke"),
+			"storage@example.org": &exterrors.SMTPError{
+				Code:    451,
+				Message: "Internal server error, try again later",
+				ErrorID: exterrors.IDStorageInternal,
+			},
+			"annotated@example.org": &exterrors.SMTPError{
+				Code:    550,
+				Message: "No such user",
+			},
+		},
+	}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Mail("sender@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for rcpt, id := range map[string]exterrors.ID{
+		"internal@example.org":  exterrors.IDSMTPInternal,
+		"storage@example.org":   exterrors.IDStorageInternal,
+		"annotated@example.org": "",
+	} {
+		err := cl.Rcpt(rcpt, &smtp.RcptOptions{})
+		smtpErr, ok := err.(*smtp.SMTPError)
+		if !ok {
+			t.Fatal("Non-SMTPError returned:", err)
+		}
+		hasSuffix := strings.HasSuffix(smtpErr.Message, " "+exterrors.ReplySuffix(id))
+		if id == "" {
+			hasSuffix = strings.Contains(smtpErr.Message, "MDY-")
+		}
+		if hasSuffix != (id != "") {
+			t.Errorf("Wrong SMTP message for %s: %s", rcpt, smtpErr.Message)
+		}
+	}
+}
+
+func TestSMTPDeliver_TranslatedError(t *testing.T) {
+	tgt := testutils.Target{
+		RcptErr: map[string]error{
+			"full@example.org": fmt.Errorf("write spool: %w", syscall.ENOSPC),
+		},
+	}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Mail("sender@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	err = cl.Rcpt("full@example.org", &smtp.RcptOptions{})
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatal("Non-SMTPError returned:", err)
+	}
+	if smtpErr.Code != 452 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 3, 1}) {
+		t.Errorf("Wrong SMTP status: %d %v", smtpErr.Code, smtpErr.EnhancedCode)
+	}
+	if !strings.HasPrefix(smtpErr.Message, "Insufficient system storage") ||
+		!strings.HasSuffix(smtpErr.Message, exterrors.ReplySuffix(exterrors.IDLocalDiskFull)) {
+		t.Errorf("Wrong SMTP message: %s", smtpErr.Message)
+	}
+}
+
+func TestSMTPDeliver_CheckError_Placeholders(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, []module.Check{
+		&testutils.Check{
+			ConnRes: module.CheckResult{
+				Reason: &exterrors.SMTPError{
+					Code:    550,
+					Message: "Rejected, see {contact_url} and mention {msg_id}",
+				},
+				Reject: true,
+			},
+		},
+	}, nil)
+	endp.deferServerReject = false
+	endp.contactURL = "https://example.org/support"
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	err = cl.Mail("sender@example.org", nil)
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatal("Non-SMTPError returned")
+	}
+
+	prefix := "Rejected, see https://example.org/support and mention "
+	if !strings.HasPrefix(smtpErr.Message, prefix) {
+		t.Fatal("Wrong SMTP message:", smtpErr.Message)
+	}
+	if msgId := strings.TrimPrefix(smtpErr.Message, prefix); msgId == "" || strings.ContainsAny(msgId, "{} ") {
+		t.Fatal("Wrong SMTP message:", smtpErr.Message)
+	}
+}
+
 func TestSMTPDeliver_CheckError_Deferred(t *testing.T) {
 	tgt := testutils.Target{}
 	endp := testEndpoint(t, "smtp", nil, &tgt, []module.Check{
@@ -520,6 +684,39 @@ func TestSMTPDelivery_Reset(t *testing.T) {
 	testutils.CheckMsgID(t, &msg, "sender@example.org", []string{"rcpt1@example.com", "rcpt2@example.com"}, "")
 }
 
+func TestSMTPDelivery_Maintenance(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	maintenance.Enable("test")
+	defer maintenance.Disable()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	err = cl.Mail("sender@example.org", nil)
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatal("Expected SMTPError, got", err)
+	}
+	if smtpErr.Code != 451 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 3, 2}) {
+		t.Fatal("Wrong SMTP code:", smtpErr.Code, smtpErr.EnhancedCode)
+	}
+
+	maintenance.Disable()
+
+	if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.org"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message to be delivered after maintenance mode is disabled")
+	}
+}
+
 func TestSMTPDelivery_SubmissionAuthRequire(t *testing.T) {
 	tgt := testutils.Target{}
 	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, nil)
@@ -578,6 +775,71 @@ func TestSMTPDelivery_SubmissionAuthOK(t *testing.T) {
 	}
 }
 
+func TestSMTPDelivery_SubmissionTrace(t *testing.T) {
+	config.RuntimeDirectory = t.TempDir()
+	defer func() { config.RuntimeDirectory = "" }()
+
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, nil)
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Auth(sasl.NewPlainClient("", "user", "password")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.org"}, "X-Maddy-Trace: yes\r\n"+testMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	if !msg.MsgMeta.Trace {
+		t.Error("Tracing is not enabled")
+	}
+	if msg.Header.Has("X-Maddy-Trace") {
+		t.Error("X-Maddy-Trace field is not removed")
+	}
+}
+
+func TestSMTPEndpoint_MXAuth(t *testing.T) {
+	initEndp := func(extra ...config.Node) error {
+		mod, err := New("smtp", []string{"tcp://127.0.0.1:" + testPort})
+		if err != nil {
+			t.Fatal(err)
+		}
+		endp := mod.(*Endpoint)
+		endp.Log = testutils.Logger(t, "smtp")
+
+		err = endp.Init(config.NewMap(nil, config.Node{
+			Children: append([]config.Node{
+				{Name: "hostname", Args: []string{"mx.example.com"}},
+				{Name: "tls", Args: []string{"off"}},
+				{Name: "deliver_to", Args: []string{"dummy"}},
+				{Name: "auth", Args: []string{"dummy"}},
+			}, extra...),
+		}))
+		if err == nil {
+			endp.Close()
+		}
+		return err
+	}
+
+	if err := initEndp(); err == nil {
+		t.Error("Expected an error for auth on the MX endpoint")
+	}
+	if err := initEndp(config.Node{Name: "allow_auth", Args: []string{"yes"}}); err != nil {
+		t.Error("Unexpected error with allow_auth:", err)
+	}
+}
+
 func TestMain(m *testing.M) {
 	remoteSmtpPort := flag.String("test.smtpport", "random", "(maddy) SMTP port to use for connections in tests")
 	flag.Parse()
@@ -589,3 +851,45 @@ func TestMain(m *testing.M) {
 	testPort = *remoteSmtpPort
 	os.Exit(m.Run())
 }
+
+func TestEndpointMode_DefaultChecks(t *testing.T) {
+	names := func(nodes []config.Node) []string {
+		var res []string
+		for _, node := range nodes {
+			if node.Name != "check" {
+				continue
+			}
+			for _, child := range node.Children {
+				res = append(res, child.Name)
+			}
+		}
+		return res
+	}
+
+	deliver := config.Node{Name: "deliver_to", Args: []string{"dummy"}}
+	for _, tc := range []struct {
+		mode     string
+		nodes    []config.Node
+		expected []string
+	}{
+		{"smtp", []config.Node{deliver}, []string{"dkim", "spf"}},
+		{"submission", []config.Node{deliver}, []string{"authorize_sender"}},
+		{"lmtp", []config.Node{deliver}, nil},
+		// Explicit empty block disables default checks.
+		{"smtp", []config.Node{{Name: "check"}, deliver}, nil},
+		// Checks in source blocks replace defaults too.
+		{"submission", []config.Node{{
+			Name: "source",
+			Args: []string{"example.org"},
+			Children: []config.Node{
+				{Name: "check", Children: []config.Node{{Name: "require_mx_record"}}},
+				deliver,
+			},
+		}}, nil},
+	} {
+		res := names(modes[tc.mode].withDefaultChecks(tc.nodes))
+		if !reflect.DeepEqual(res, tc.expected) {
+			t.Errorf("%s %v: expected checks %v, got %v", tc.mode, tc.nodes, tc.expected, res)
+		}
+	}
+}
@@ -0,0 +1,481 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package system_mail implements sending of templated messages generated by
+// the server itself, such as welcome messages for new accounts.
+//
+// Messages are sent automatically when the corresponding server notification
+// is reported (see framework/hooks) or on request via the control socket.
+package system_mail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/control"
+)
+
+const (
+	modName = "system_mail"
+
+	// queueSize is the amount of notifications waiting to be processed,
+	// notifications are dropped if the queue is full.
+	queueSize = 128
+)
+
+// Names of the control socket commands.
+const (
+	// CommandSend sends the message for the event unconditionally.
+	CommandSend = "system_mail.send"
+	// CommandNotify passes the server notification reported in another
+	// process (e.g. by the maddy command) to the running server.
+	CommandNotify = "system_mail.notify"
+	// CommandInject delivers the message passed by the client as is.
+	CommandInject = "system_mail.inject"
+)
+
+// Event names that are not server notifications.
+const (
+	// EventQuotaWarning is sent on request when the account is close to
+	// its storage quota.
+	//
+	// Parameters: usage, limit, percent.
+	EventQuotaWarning = "quota_warning"
+)
+
+var eventNameRe = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+type notification struct {
+	event  string
+	params map[string]string
+}
+
+type Mailer struct {
+	log log.Logger
+
+	hostname     string
+	sender       string
+	target       module.DeliveryTarget
+	templatesDir string
+	events       map[string]bool
+	// Folder and flags to use for messages in the local storage.
+	folder string
+	flags  []string
+
+	queueLck sync.RWMutex
+	queue    chan notification
+	wg       sync.WaitGroup
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("%s: no arguments expected", modName)
+	}
+	return &Mailer{
+		log: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (m *Mailer) Init(cfg *config.Map) error {
+	var events []string
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.String("hostname", true, true, "", &m.hostname)
+	cfg.String("sender", false, false, "", &m.sender)
+	cfg.Custom("deliver_to", false, true, nil, modconfig.DeliveryDirective, &m.target)
+	cfg.String("templates", false, false, "", &m.templatesDir)
+	cfg.String("folder", false, false, "", &m.folder)
+	cfg.StringList("flags", false, false, nil, &m.flags)
+	cfg.StringList("events", false, false, []string{hooks.NotifyAccountCreated, hooks.NotifyPasswordChanged}, &events)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if m.sender == "" {
+		m.sender = "postmaster@" + m.hostname
+	}
+	m.events = make(map[string]bool, len(events))
+	for _, event := range events {
+		if event == "" {
+			continue
+		}
+		if event != hooks.NotifyAccountCreated && event != hooks.NotifyPasswordChanged {
+			return fmt.Errorf("%s: messages can not be sent automatically for %s", modName, event)
+		}
+		m.events[event] = true
+	}
+	if m.templatesDir != "" {
+		if _, err := os.Stat(m.templatesDir); err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+	}
+
+	if module.NoRun {
+		return nil
+	}
+
+	m.queue = make(chan notification, queueSize)
+	m.wg.Add(1)
+	go m.loop(m.queue)
+	hooks.AddNotifyHandler(m.notified)
+	control.Handle(CommandSend, m.handleSend)
+	control.Handle(CommandNotify, m.handleNotify)
+	control.Handle(CommandInject, m.handleInject)
+
+	return nil
+}
+
+func (m *Mailer) Name() string {
+	return modName
+}
+
+func (m *Mailer) InstanceName() string {
+	return ""
+}
+
+func (m *Mailer) Close() error {
+	m.queueLck.Lock()
+	if m.queue != nil {
+		close(m.queue)
+		m.queue = nil
+	}
+	m.queueLck.Unlock()
+	m.wg.Wait()
+	return nil
+}
+
+// notified queues the message for the notification if it is enabled. It is
+// called synchronously by the module reporting it so it should not block.
+func (m *Mailer) notified(event string, params map[string]string) {
+	if !m.events[event] {
+		return
+	}
+	// Welcome message can be disabled by the storage account template.
+	if event == hooks.NotifyAccountCreated && params["welcome"] == "no" {
+		return
+	}
+
+	m.queueLck.RLock()
+	defer m.queueLck.RUnlock()
+	if m.queue == nil {
+		return
+	}
+
+	select {
+	case m.queue <- notification{event: event, params: params}:
+	default:
+		m.log.Msg("too many notifications, dropping", "event", event, "username", params["username"])
+	}
+}
+
+func (m *Mailer) loop(queue <-chan notification) {
+	defer m.wg.Done()
+	for n := range queue {
+		m.processSafe(n)
+	}
+}
+
+func (m *Mailer) processSafe(n notification) {
+	defer func() {
+		if err := recover(); err != nil {
+			stack := debug.Stack()
+			log.Printf("panic during system message sending: %v\n%s", err, stack)
+		}
+	}()
+
+	username := n.params["username"]
+	if !strings.Contains(username, "@") {
+		m.log.DebugMsg("account name is not an address, not sending the message", "event", n.event, "username", username)
+		return
+	}
+	if err := m.Send(context.Background(), n.event, username, n.params); err != nil {
+		m.log.Error("failed to send the message", err, "event", n.event, "username", username)
+	}
+}
+
+// handleSend implements the control socket command to send the message for
+// the specified event. The username argument specifies the recipient, other
+// arguments are passed to the template.
+func (m *Mailer) handleSend(args map[string]string) (interface{}, error) {
+	event, username := args["event"], args["username"]
+	if event == "" || username == "" {
+		return nil, errors.New("event and username are required")
+	}
+	if err := m.Send(context.Background(), event, username, args); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// handleNotify implements the control socket command used to forward server
+// notifications reported by other processes.
+func (m *Mailer) handleNotify(args map[string]string) (interface{}, error) {
+	event := args["event"]
+	params := make(map[string]string, len(args))
+	for k, v := range args {
+		if k != "event" {
+			params[k] = v
+		}
+	}
+	m.notified(event, params)
+	return nil, nil
+}
+
+// handleInject implements the control socket command to deliver the message
+// provided by the client. Arguments are: from (envelope sender), rcpts
+// (newline-separated recipients), message (base64-encoded message) and trace
+// ("true" to enable tracing, see module.MsgMetadata.Trace).
+func (m *Mailer) handleInject(args map[string]string) (interface{}, error) {
+	rcpts := strings.Fields(args["rcpts"])
+	if len(rcpts) == 0 {
+		return nil, errors.New("rcpts is required")
+	}
+	msg, err := base64.StdEncoding.DecodeString(args["message"])
+	if err != nil {
+		return nil, fmt.Errorf("malformed message: %w", err)
+	}
+
+	msgID, err := m.Inject(context.Background(), args["from"], rcpts, msg, args["trace"] == "true")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"msg_id": msgID}, nil
+}
+
+// templateData is the value templates are executed with.
+type templateData struct {
+	Event    string
+	Account  string
+	Domain   string
+	Hostname string
+	Sender   string
+	Time     time.Time
+	Params   map[string]string
+}
+
+// loadTemplate returns the template for the event to use for the domain.
+//
+// The template is searched in templates/DOMAIN/EVENT.txt and
+// templates/EVENT.txt, the built-in template is used if there is no such
+// file.
+func (m *Mailer) loadTemplate(event, domain string) (*template.Template, error) {
+	if !eventNameRe.MatchString(event) {
+		return nil, fmt.Errorf("%s: malformed event name: %s", modName, event)
+	}
+
+	if m.templatesDir != "" {
+		candidates := []string{filepath.Join(m.templatesDir, event+".txt")}
+		if domain != "" && !strings.ContainsAny(domain, `/\`) && domain[0] != '.' {
+			candidates = append([]string{filepath.Join(m.templatesDir, domain, event+".txt")}, candidates...)
+		}
+		for _, path := range candidates {
+			text, err := os.ReadFile(path)
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				return nil, fmt.Errorf("%s: %w", modName, err)
+			}
+			tmpl, err := template.New(filepath.Base(path)).Parse(string(text))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", modName, err)
+			}
+			return tmpl, nil
+		}
+	}
+
+	text, ok := defaultTemplates[event]
+	if !ok {
+		return nil, fmt.Errorf("%s: no template for %s", modName, event)
+	}
+	return template.Must(template.New(event).Parse(text)), nil
+}
+
+// render executes the template and parses the result into the message header
+// and body. Date, Message-ID, From, To and other standard header fields are
+// added unless set by the template.
+func (m *Mailer) render(tmpl *template.Template, data templateData) (textproto.Header, []byte, error) {
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return textproto.Header{}, nil, fmt.Errorf("%s: %w", modName, err)
+	}
+
+	// Templates are usually written with LF line endings.
+	text := strings.ReplaceAll(out.String(), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\n", "\r\n")
+
+	br := bufio.NewReader(strings.NewReader(text))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		return textproto.Header{}, nil, fmt.Errorf("%s: malformed message header in template: %w", modName, err)
+	}
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(br); err != nil {
+		return textproto.Header{}, nil, err
+	}
+
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	defaults := []struct{ key, value string }{
+		{"Date", data.Time.Format("Mon, 2 Jan 2006 15:04:05 -0700")},
+		{"Message-ID", "<" + msgID + "@" + m.hostname + ">"},
+		{"From", "<" + m.sender + ">"},
+		{"To", "<" + data.Account + ">"},
+		{"Auto-Submitted", "auto-generated"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+	}
+	for _, field := range defaults {
+		if !hdr.Has(field.key) {
+			hdr.Add(field.key, field.value)
+		}
+	}
+
+	return hdr, body.Bytes(), nil
+}
+
+// Send sends the message for the event to the account.
+func (m *Mailer) Send(ctx context.Context, event, account string, params map[string]string) error {
+	_, domain, err := address.Split(account)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	if domain != "" {
+		domain, err = dns.ForLookup(domain)
+		if err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+	}
+
+	tmpl, err := m.loadTemplate(event, domain)
+	if err != nil {
+		return err
+	}
+	hdr, body, err := m.render(tmpl, templateData{
+		Event:    event,
+		Account:  account,
+		Domain:   domain,
+		Hostname: m.hostname,
+		Sender:   m.sender,
+		Time:     time.Now(),
+		Params:   params,
+	})
+	if err != nil {
+		return err
+	}
+
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+	msgMeta := &module.MsgMetadata{
+		ID:           msgID,
+		OriginalFrom: m.sender,
+		Folder:       m.folder,
+		Flags:        m.flags,
+	}
+	if err := m.deliver(ctx, msgMeta, m.sender, []string{account}, hdr, body); err != nil {
+		return err
+	}
+
+	m.log.Msg("message sent", "event", event, "rcpt", account, "msg_id", msgID)
+	return nil
+}
+
+// Inject delivers the message to the recipients without changes. The
+// generated message ID is returned so the message can be found in logs or
+// its trace can be inspected.
+func (m *Mailer) Inject(ctx context.Context, from string, rcpts []string, msg []byte, trace bool) (string, error) {
+	bufr := bufio.NewReader(bytes.NewReader(msg))
+	hdr, err := textproto.ReadHeader(bufr)
+	if err != nil {
+		return "", fmt.Errorf("%s: malformed message: %w", modName, err)
+	}
+	body, err := io.ReadAll(bufr)
+	if err != nil {
+		return "", err
+	}
+
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return "", err
+	}
+	msgMeta := &module.MsgMetadata{
+		ID:           msgID,
+		OriginalFrom: from,
+		Trace:        trace,
+	}
+	if err := m.deliver(ctx, msgMeta, from, rcpts, hdr, body); err != nil {
+		return msgID, err
+	}
+
+	m.log.Msg("message injected", "sender", from, "rcpts", rcpts, "msg_id", msgID, "trace", trace)
+	return msgID, nil
+}
+
+func (m *Mailer) deliver(ctx context.Context, msgMeta *module.MsgMetadata, from string, rcpts []string, hdr textproto.Header, body []byte) (err error) {
+	delivery, err := m.target.Start(ctx, msgMeta, from)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if err := delivery.Abort(ctx); err != nil {
+				m.log.Error("failed to abort the delivery", err)
+			}
+		}
+	}()
+
+	for _, rcpt := range rcpts {
+		if err = delivery.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+			return err
+		}
+	}
+	if err = delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: body}); err != nil {
+		return err
+	}
+	return delivery.Commit(ctx)
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
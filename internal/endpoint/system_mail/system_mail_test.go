@@ -0,0 +1,210 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package system_mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testMailer(t *testing.T, tgt *testutils.Target) *Mailer {
+	return &Mailer{
+		log:      testutils.Logger(t, modName),
+		hostname: "mx.example.org",
+		sender:   "postmaster@example.org",
+		target:   tgt,
+		events:   map[string]bool{hooks.NotifyAccountCreated: true},
+	}
+}
+
+func TestMailer_Default(t *testing.T) {
+	tgt := testutils.Target{}
+	m := testMailer(t, &tgt)
+
+	if err := m.Send(context.Background(), EventQuotaWarning, "foxcpp@example.org", map[string]string{
+		"percent": "90",
+		"usage":   "900M",
+		"limit":   "1G",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	if msg.MailFrom != "postmaster@example.org" {
+		t.Errorf("wrong sender: %v", msg.MailFrom)
+	}
+	if len(msg.RcptTo) != 1 || msg.RcptTo[0] != "foxcpp@example.org" {
+		t.Errorf("wrong recipient: %v", msg.RcptTo)
+	}
+	if subj := msg.Header.Get("Subject"); subj != "Your mailbox is almost full" {
+		t.Errorf("wrong subject: %v", subj)
+	}
+	for _, field := range []string{"Date", "Message-ID", "From", "To", "Auto-Submitted", "Content-Type"} {
+		if !msg.Header.Has(field) {
+			t.Errorf("missing %s field", field)
+		}
+	}
+	if !strings.Contains(string(msg.Body), "is 90% full (900M of 1G).\r\n") {
+		t.Errorf("wrong body: %q", msg.Body)
+	}
+
+	if err := m.Send(context.Background(), "unknown_event", "foxcpp@example.org", nil); err == nil {
+		t.Error("expected an error for the event without template")
+	}
+	if err := m.Send(context.Background(), "../../etc/passwd", "foxcpp@example.org", nil); err == nil {
+		t.Error("expected an error for the malformed event name")
+	}
+}
+
+func TestMailer_Templates(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "example.com"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "account_created.txt"),
+		[]byte("Subject: Welcome\n\nHello, {{.Account}}!\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "example.com", "account_created.txt"),
+		[]byte("Subject: Willkommen\nFrom: Support <support@example.com>\n\nHallo, {{.Account}}!\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tgt := testutils.Target{}
+	m := testMailer(t, &tgt)
+	m.templatesDir = dir
+
+	for _, rcpt := range []string{"foxcpp@example.org", "foxcpp@EXAMPLE.com"} {
+		if err := m.Send(context.Background(), hooks.NotifyAccountCreated, rcpt, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(tgt.Messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(tgt.Messages))
+	}
+
+	msg := tgt.Messages[0]
+	if subj := msg.Header.Get("Subject"); subj != "Welcome" {
+		t.Errorf("wrong subject: %v", subj)
+	}
+	if string(msg.Body) != "Hello, foxcpp@example.org!\r\n" {
+		t.Errorf("wrong body: %q", msg.Body)
+	}
+
+	msg = tgt.Messages[1]
+	if subj := msg.Header.Get("Subject"); subj != "Willkommen" {
+		t.Errorf("per-domain template is not used, subject: %v", subj)
+	}
+	if from := msg.Header.Get("From"); from != "Support <support@example.com>" {
+		t.Errorf("From field set by the template is replaced: %v", from)
+	}
+
+	// Built-in template is used if there is no file.
+	if err := m.Send(context.Background(), hooks.NotifyPasswordChanged, "foxcpp@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if subj := tgt.Messages[2].Header.Get("Subject"); subj != "Your password has been changed" {
+		t.Errorf("wrong subject: %v", subj)
+	}
+}
+
+func TestMailer_Notifications(t *testing.T) {
+	tgt := testutils.Target{}
+	m := testMailer(t, &tgt)
+	m.queue = make(chan notification, queueSize)
+	m.wg.Add(1)
+	go m.loop(m.queue)
+
+	m.notified(hooks.NotifyAccountCreated, map[string]string{"username": "foxcpp@example.org"})
+	// Not enabled.
+	m.notified(hooks.NotifyPasswordChanged, map[string]string{"username": "foxcpp@example.org"})
+	// Not an address.
+	m.notified(hooks.NotifyAccountCreated, map[string]string{"username": "foxcpp"})
+	// Disabled by the account template.
+	m.notified(hooks.NotifyAccountCreated, map[string]string{"username": "bob@example.org", "welcome": "no"})
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(tgt.Messages))
+	}
+	if subj := tgt.Messages[0].Header.Get("Subject"); subj != "Welcome to mx.example.org" {
+		t.Errorf("wrong subject: %v", subj)
+	}
+}
+
+func TestMailer_Folder(t *testing.T) {
+	tgt := testutils.Target{}
+	m := testMailer(t, &tgt)
+	m.folder = "Server Notices"
+	m.flags = []string{"\\Flagged"}
+
+	if err := m.Send(context.Background(), hooks.NotifyPasswordChanged, "foxcpp@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(tgt.Messages))
+	}
+	msgMeta := tgt.Messages[0].MsgMeta
+	if msgMeta.Folder != "Server Notices" {
+		t.Errorf("wrong folder: %v", msgMeta.Folder)
+	}
+	if len(msgMeta.Flags) != 1 || msgMeta.Flags[0] != "\\Flagged" {
+		t.Errorf("wrong flags: %v", msgMeta.Flags)
+	}
+}
+
+func TestMailer_Inject(t *testing.T) {
+	tgt := testutils.Target{}
+	m := testMailer(t, &tgt)
+
+	msg := "From: <foxcpp@example.org>\r\nSubject: test\r\n\r\nHello!\r\n"
+	msgID, err := m.Inject(context.Background(), "foxcpp@example.org",
+		[]string{"rcpt1@example.org", "rcpt2@example.org"}, []byte(msg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(tgt.Messages))
+	}
+	delivered := tgt.Messages[0]
+	if delivered.MsgMeta.ID != msgID || !delivered.MsgMeta.Trace {
+		t.Errorf("wrong metadata: %+v", delivered.MsgMeta)
+	}
+	if delivered.MailFrom != "foxcpp@example.org" || len(delivered.RcptTo) != 2 {
+		t.Errorf("wrong envelope: %v -> %v", delivered.MailFrom, delivered.RcptTo)
+	}
+	if subj := delivered.Header.Get("Subject"); subj != "test" {
+		t.Errorf("wrong subject: %v", subj)
+	}
+	if string(delivered.Body) != "Hello!\r\n" {
+		t.Errorf("wrong body: %q", delivered.Body)
+	}
+}
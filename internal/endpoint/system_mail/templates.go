@@ -0,0 +1,61 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package system_mail
+
+import "github.com/foxcpp/maddy/framework/hooks"
+
+// defaultTemplates are used if there is no template file for the event.
+var defaultTemplates = map[string]string{
+	hooks.NotifyAccountCreated: `Subject: Welcome to {{.Hostname}}
+
+Hello,
+
+Your mailbox {{.Account}} has been created and is ready to use.
+
+Use the following settings to configure your mail client:
+
+  IMAP server: {{.Hostname}}
+  SMTP (submission) server: {{.Hostname}}
+  Username: {{.Account}}
+
+If you have any questions, contact the server administrator at
+{{.Sender}}.
+`,
+	hooks.NotifyPasswordChanged: `Subject: Your password has been changed
+
+Hello,
+
+The password for your account {{.Account}} was changed on
+{{.Time.UTC.Format "2006-01-02 15:04:05 MST"}}.
+
+If it was you, no action is needed. Otherwise, contact the server
+administrator at {{.Sender}} immediately.
+`,
+	EventQuotaWarning: `Subject: Your mailbox is almost full
+
+Hello,
+
+Your mailbox {{.Account}} is {{with .Params.percent}}{{.}}%{{else}}almost{{end}} full
+{{- with .Params.usage}} ({{.}}{{with $.Params.limit}} of {{.}}{{end}}){{end}}.
+
+Once the mailbox is full, new messages will be rejected. Please delete
+messages you no longer need or contact the server administrator at
+{{.Sender}} to increase the limit.
+`,
+}
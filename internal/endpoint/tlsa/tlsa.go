@@ -0,0 +1,380 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package tlsa implements the module that keeps TLSA records for
+// certificates used by the server up to date.
+//
+// Records are computed periodically using the server TLS configuration,
+// written to the zone file and, optionally, published using a libdns
+// provider.
+package tlsa
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/tlsa"
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+)
+
+const (
+	modName = "tlsa"
+
+	// recordTTL is the TTL of records created using dns_provider.
+	recordTTL = time.Hour
+
+	// dnsTimeout is the maximum time allowed for DNS provider requests.
+	dnsTimeout = time.Minute
+)
+
+type dnsProvider interface {
+	libdns.RecordAppender
+	libdns.RecordDeleter
+}
+
+type Publisher struct {
+	log log.Logger
+
+	hostnames []string
+	ports     []int
+	usages    []uint8
+	tlsConfig *tls.Config
+	interval  time.Duration
+	zoneFile  string
+	provider  dnsProvider
+	dnsZone   string
+
+	// Records written to the zone file last time.
+	current []tlsa.Record
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("%s: no arguments expected", modName)
+	}
+	return &Publisher{
+		log:  log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		stop: make(chan struct{}),
+	}, nil
+}
+
+func (p *Publisher) Init(cfg *config.Map) error {
+	var (
+		hostname   string
+		usageNames []string
+	)
+	cfg.Bool("debug", true, false, &p.log.Debug)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.StringList("hostnames", false, false, nil, &p.hostnames)
+	cfg.Custom("ports", false, false, func() (interface{}, error) {
+		return []int{25}, nil
+	}, portsDirective, &p.ports)
+	cfg.StringList("usages", false, false, []string{"dane-ee", "dane-ta"}, &usageNames)
+	cfg.Custom("tls", true, true, nil, tls2.TLSDirective, &p.tlsConfig)
+	cfg.Duration("interval", false, false, time.Hour, &p.interval)
+	cfg.String("zone_file", false, false, filepath.Join(config.StateDirectory, "tlsa.zone"), &p.zoneFile)
+	cfg.Custom("dns_provider", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		var p dnsProvider
+		err := modconfig.ModuleFromNode("libdns", node.Args, node, m.Globals, &p)
+		return p, err
+	}, &p.provider)
+	cfg.String("dns_zone", false, false, "", &p.dnsZone)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(p.hostnames) == 0 {
+		if hostname == "" {
+			return fmt.Errorf("%s: hostnames are not specified", modName)
+		}
+		p.hostnames = []string{hostname}
+	}
+	if p.tlsConfig == nil {
+		return fmt.Errorf("%s: TLS is disabled, there are no certificates to use", modName)
+	}
+	for _, name := range usageNames {
+		usage, err := tlsa.ParseUsage(name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+		p.usages = append(p.usages, usage)
+	}
+	if p.interval <= 0 {
+		return fmt.Errorf("%s: interval should be positive", modName)
+	}
+	if p.provider != nil && p.dnsZone == "" {
+		return fmt.Errorf("%s: dns_zone is required if dns_provider is used", modName)
+	}
+
+	current, err := readZone(p.zoneFile)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	p.current = current
+
+	if module.NoRun {
+		return nil
+	}
+
+	p.wg.Add(1)
+	go p.loop()
+
+	return nil
+}
+
+func portsDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "at least one port is required")
+	}
+	ports := make([]int, 0, len(node.Args))
+	for _, arg := range node.Args {
+		var port int
+		if _, err := fmt.Sscanf(arg, "%d", &port); err != nil || port <= 0 || port > 65535 {
+			return nil, config.NodeErr(node, "invalid port: %s", arg)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+func (p *Publisher) Name() string {
+	return modName
+}
+
+func (p *Publisher) InstanceName() string {
+	return ""
+}
+
+func (p *Publisher) Close() error {
+	close(p.stop)
+	p.wg.Wait()
+	return nil
+}
+
+func (p *Publisher) loop() {
+	defer p.wg.Done()
+	defer func() {
+		if err := recover(); err != nil {
+			stack := debug.Stack()
+			log.Printf("panic during TLSA records update: %v\n%s", err, stack)
+		}
+	}()
+
+	// Certificates may be not loaded yet (e.g. obtained by ACME), so the
+	// first update is not done synchronously in Init.
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+
+	p.runUpdate()
+	for {
+		select {
+		case <-t.C:
+			p.runUpdate()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *Publisher) runUpdate() {
+	if err := p.update(); err != nil {
+		p.log.Error("TLSA records update failed", err)
+	}
+}
+
+// records computes TLSA records for all configured hostnames and ports.
+func (p *Publisher) records() ([]tlsa.Record, error) {
+	var recs []tlsa.Record
+	for _, hostname := range p.hostnames {
+		cert, err := tlsa.ServedCertificate(p.tlsConfig, hostname)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", hostname, err)
+		}
+		chain, err := tlsa.ParseChain(cert)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", hostname, err)
+		}
+		for _, port := range p.ports {
+			hostRecs, err := tlsa.ForChain(hostname, port, chain, p.usages)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", hostname, err)
+			}
+			recs = append(recs, hostRecs...)
+		}
+	}
+	return recs, nil
+}
+
+func (p *Publisher) update() error {
+	recs, err := p.records()
+	if err != nil {
+		return err
+	}
+
+	added, removed := diffRecords(p.current, recs)
+	if len(added) == 0 && len(removed) == 0 {
+		p.log.DebugMsg("TLSA records are up to date")
+		return nil
+	}
+
+	// Records are added before removing old ones so there is no moment
+	// when there are no matching records.
+	if p.provider != nil {
+		if err := p.publish(added, removed); err != nil {
+			return err
+		}
+	}
+
+	zone := tlsa.Zone(recs)
+	if err := writeFileAtomic(p.zoneFile, []byte(zone)); err != nil {
+		return err
+	}
+	p.current = recs
+
+	p.log.Msg("TLSA records changed", "added", len(added), "removed", len(removed), "zone_file", p.zoneFile)
+	hooks.Notify(hooks.NotifyTLSAChanged, map[string]string{
+		"module":  modName,
+		"records": zone,
+	})
+	return nil
+}
+
+func (p *Publisher) libdnsRecords(recs []tlsa.Record) []libdns.Record {
+	res := make([]libdns.Record, 0, len(recs))
+	for _, rec := range recs {
+		res = append(res, libdns.Record{
+			Type:  "TLSA",
+			Name:  libdns.RelativeName(rec.Name, dns.Fqdn(p.dnsZone)),
+			Value: rec.Value(),
+			TTL:   recordTTL,
+		})
+	}
+	return res
+}
+
+func (p *Publisher) publish(added, removed []tlsa.Record) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+
+	zone := dns.Fqdn(p.dnsZone)
+	if len(added) != 0 {
+		if _, err := p.provider.AppendRecords(ctx, zone, p.libdnsRecords(added)); err != nil {
+			return fmt.Errorf("add records: %w", err)
+		}
+	}
+	if len(removed) != 0 {
+		if _, err := p.provider.DeleteRecords(ctx, zone, p.libdnsRecords(removed)); err != nil {
+			// New records are already published, there is no point in failing
+			// the update.
+			p.log.Error("failed to remove outdated records", err)
+		}
+	}
+	return nil
+}
+
+// diffRecords returns records present only in b (added) and only in a
+// (removed).
+func diffRecords(a, b []tlsa.Record) (added, removed []tlsa.Record) {
+	inA := make(map[tlsa.Record]bool, len(a))
+	for _, rec := range a {
+		inA[rec] = true
+	}
+	inB := make(map[tlsa.Record]bool, len(b))
+	for _, rec := range b {
+		inB[rec] = true
+		if !inA[rec] {
+			added = append(added, rec)
+		}
+	}
+	for _, rec := range a {
+		if !inB[rec] {
+			removed = append(removed, rec)
+		}
+	}
+	return added, removed
+}
+
+// readZone reads records from the zone file written by the previous run.
+func readZone(path string) ([]tlsa.Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var recs []tlsa.Record
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		rec, ok := rr.(*dns.TLSA)
+		if !ok {
+			continue
+		}
+		recs = append(recs, tlsa.Record{
+			Name:         rec.Hdr.Name,
+			Usage:        rec.Usage,
+			Selector:     rec.Selector,
+			MatchingType: rec.MatchingType,
+			Data:         strings.ToLower(rec.Certificate),
+		})
+	}
+	return recs, scnr.Err()
+}
+
+func writeFileAtomic(path string, blob []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, blob, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
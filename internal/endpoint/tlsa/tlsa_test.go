@@ -0,0 +1,71 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tlsa
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/tlsa"
+)
+
+func TestReadZone(t *testing.T) {
+	recs := []tlsa.Record{
+		{Name: "_25._tcp.mx.example.org.", Usage: 2, Selector: 1, MatchingType: 1, Data: "0a0b"},
+		{Name: "_25._tcp.mx.example.org.", Usage: 3, Selector: 1, MatchingType: 1, Data: "0c0d"},
+	}
+	path := filepath.Join(t.TempDir(), "tlsa.zone")
+	if err := os.WriteFile(path, []byte(tlsa.Zone(recs)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := readZone(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, recs) {
+		t.Errorf("Wrong records read:\n%v\n%v", read, recs)
+	}
+
+	read, err = readZone(filepath.Join(t.TempDir(), "missing.zone"))
+	if err != nil || read != nil {
+		t.Error("Unexpected result for missing file:", read, err)
+	}
+}
+
+func TestDiffRecords(t *testing.T) {
+	a := tlsa.Record{Name: "_25._tcp.mx.example.org.", Usage: 3, Selector: 1, MatchingType: 1, Data: "AA"}
+	b := tlsa.Record{Name: "_25._tcp.mx.example.org.", Usage: 3, Selector: 1, MatchingType: 1, Data: "BB"}
+	ta := tlsa.Record{Name: "_25._tcp.mx.example.org.", Usage: 2, Selector: 1, MatchingType: 1, Data: "CC"}
+
+	added, removed := diffRecords([]tlsa.Record{a, ta}, []tlsa.Record{b, ta})
+	if !reflect.DeepEqual(added, []tlsa.Record{b}) {
+		t.Error("Wrong added records:", added)
+	}
+	if !reflect.DeepEqual(removed, []tlsa.Record{a}) {
+		t.Error("Wrong removed records:", removed)
+	}
+
+	added, removed = diffRecords([]tlsa.Record{a}, []tlsa.Record{a})
+	if len(added) != 0 || len(removed) != 0 {
+		t.Error("Unexpected changes:", added, removed)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package exthook implements execution of external programs and webhooks
+// for server notifications (see framework/hooks.Notify).
+package exthook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// anyEvent is the event name that matches all notifications.
+const anyEvent = "*"
+
+// hookTimeout is the maximum time a hook is allowed to run.
+var hookTimeout = 30 * time.Second
+
+// Hook is an external program or webhook called on notification.
+type Hook struct {
+	// Notification name or "*" to match all of them.
+	Event string
+
+	// Command to execute, nil if URL is set.
+	Exec []string
+	// Webhook URL, empty if Exec is set.
+	URL string
+}
+
+func (h Hook) String() string {
+	if h.URL != "" {
+		return "webhook " + h.URL
+	}
+	return "exec " + strings.Join(h.Exec, " ")
+}
+
+// ParseHook parses the hook directive in the following format:
+//
+//	hook <event> exec <path> [args...]
+//	hook <event> webhook <url>
+func ParseHook(node config.Node) (Hook, error) {
+	if len(node.Args) < 3 {
+		return Hook{}, config.NodeErr(node, "expected at least 3 arguments")
+	}
+
+	h := Hook{Event: node.Args[0]}
+	if !knownEvent(h.Event) {
+		return Hook{}, config.NodeErr(node, "unknown event: %s", h.Event)
+	}
+
+	switch node.Args[1] {
+	case "exec":
+		h.Exec = node.Args[2:]
+	case "webhook":
+		if len(node.Args) != 3 {
+			return Hook{}, config.NodeErr(node, "exactly one URL is expected for webhook")
+		}
+		u, err := url.Parse(node.Args[2])
+		if err != nil {
+			return Hook{}, config.NodeErr(node, "%v", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return Hook{}, config.NodeErr(node, "only http and https webhook URLs are supported")
+		}
+		h.URL = u.String()
+	default:
+		return Hook{}, config.NodeErr(node, "unknown hook type: %s", node.Args[1])
+	}
+	return h, nil
+}
+
+func knownEvent(name string) bool {
+	if name == anyEvent {
+		return true
+	}
+	for _, n := range hooks.Notifications {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// pending tracks hooks that are still running.
+var pending sync.WaitGroup
+
+// Wait blocks until all running hooks complete.
+//
+// It should be called before the process exits so notifications are not
+// lost.
+func Wait() {
+	pending.Wait()
+}
+
+// Runner runs hooks matching notifications. Its Handle method can be passed
+// to hooks.AddNotifyHandler.
+type Runner struct {
+	Hooks []Hook
+	Log   log.Logger
+
+	client http.Client
+}
+
+func NewRunner(hooksList []Hook) *Runner {
+	return &Runner{
+		Hooks: hooksList,
+		Log:   log.Logger{Name: "hook", Debug: log.DefaultLogger.Debug},
+	}
+}
+
+// Handle starts all hooks matching the notification in background.
+func (r *Runner) Handle(name string, params map[string]string) {
+	for _, h := range r.Hooks {
+		if h.Event != anyEvent && h.Event != name {
+			continue
+		}
+
+		pending.Add(1)
+		go func(h Hook) {
+			defer pending.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+			defer cancel()
+
+			if err := r.run(ctx, h, name, params); err != nil {
+				r.Log.Error("hook failed", err, "event", name, "hook", h.String())
+				return
+			}
+			r.Log.Debugf("%s: %s completed", name, h)
+		}(h)
+	}
+}
+
+func (r *Runner) run(ctx context.Context, h Hook, name string, params map[string]string) error {
+	if h.URL != "" {
+		return r.postWebhook(ctx, h.URL, name, params)
+	}
+	return r.exec(ctx, h.Exec, name, params)
+}
+
+// hookEnv returns environment variables describing the notification.
+//
+// MADDY_EVENT is set to the notification name and each parameter is passed as
+// MADDY_<PARAMETER> (uppercase).
+func hookEnv(name string, params map[string]string) []string {
+	env := make([]string, 0, len(params)+1)
+	env = append(env, "MADDY_EVENT="+name)
+	for k, v := range params {
+		env = append(env, "MADDY_"+strings.ToUpper(k)+"="+v)
+	}
+	return env
+}
+
+func (r *Runner) exec(ctx context.Context, cmdLine []string, name string, params map[string]string) error {
+	cmd := exec.CommandContext(ctx, cmdLine[0], cmdLine[1:]...)
+	cmd.Env = append(os.Environ(), hookEnv(name, params)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if len(out) != 0 {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+		}
+		return err
+	}
+	return nil
+}
+
+type webhookBody struct {
+	Event  string            `json:"event"`
+	Time   time.Time         `json:"time"`
+	Params map[string]string `json:"params"`
+}
+
+func (r *Runner) postWebhook(ctx context.Context, target, name string, params map[string]string) error {
+	body, err := json.Marshal(webhookBody{
+		Event:  name,
+		Time:   time.Now().UTC(),
+		Params: params,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
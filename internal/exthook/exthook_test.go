@@ -0,0 +1,126 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package exthook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/hooks"
+)
+
+func TestParseHook(t *testing.T) {
+	for _, args := range [][]string{
+		{"cert_reload", "exec", "/bin/true"},
+		{"*", "exec", "/bin/echo", "a", "b"},
+		{"account_created", "webhook", "https://example.org/hook"},
+	} {
+		if _, err := ParseHook(config.Node{Name: "hook", Args: args}); err != nil {
+			t.Errorf("%v: unexpected error: %v", args, err)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"cert_reload", "exec"},
+		{"unknown_event", "exec", "/bin/true"},
+		{"cert_reload", "email", "postmaster@example.org"},
+		{"cert_reload", "webhook", "https://example.org/a", "https://example.org/b"},
+		{"cert_reload", "webhook", "ftp://example.org/hook"},
+	} {
+		if _, err := ParseHook(config.Node{Name: "hook", Args: args}); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestHookEnv(t *testing.T) {
+	env := hookEnv(hooks.NotifyAccountCreated, map[string]string{
+		"module":   "local_mailboxes",
+		"username": "foxcpp@example.org",
+	})
+	sort.Strings(env)
+	expected := []string{
+		"MADDY_EVENT=account_created",
+		"MADDY_MODULE=local_mailboxes",
+		"MADDY_USERNAME=foxcpp@example.org",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Wrong env: %v", env)
+	}
+}
+
+func TestRunner_Exec(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("No /bin/sh")
+	}
+	out := filepath.Join(t.TempDir(), "out")
+
+	r := NewRunner([]Hook{
+		{Event: hooks.NotifyCertReload, Exec: []string{"/bin/sh", "-c", `echo "$MADDY_EVENT $MADDY_MODULE" > "$0"`, out}},
+		{Event: hooks.NotifyAccountCreated, Exec: []string{"/bin/sh", "-c", "exit 1"}},
+	})
+	r.Handle(hooks.NotifyCertReload, map[string]string{"module": "tls.loader.file"})
+	Wait()
+
+	text, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(text)) != "cert_reload tls.loader.file" {
+		t.Errorf("Wrong output: %q", text)
+	}
+}
+
+func TestRunner_Webhook(t *testing.T) {
+	received := make(chan webhookBody, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Wrong request: %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		var body webhookBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		received <- body
+	}))
+	defer srv.Close()
+
+	r := NewRunner([]Hook{
+		{Event: "*", URL: srv.URL},
+		{Event: hooks.NotifyBacklogLeave, URL: srv.URL},
+	})
+	r.Handle(hooks.NotifyBacklogEnter, map[string]string{"module": "remote_queue", "length": "100"})
+	Wait()
+
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(received))
+	}
+	body := <-received
+	if body.Event != hooks.NotifyBacklogEnter || body.Params["module"] != "remote_queue" || body.Params["length"] != "100" {
+		t.Errorf("Wrong body: %+v", body)
+	}
+}
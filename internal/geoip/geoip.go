@@ -0,0 +1,75 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package geoip implements lookups in MaxMind DB files (GeoLite2, GeoIP2 and
+// compatible databases).
+package geoip
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// DB is the opened database file.
+type DB struct {
+	r *maxminddb.Reader
+}
+
+func Open(path string) (*DB, error) {
+	r, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("geoip: %w", err)
+	}
+	return &DB{r: r}, nil
+}
+
+// Country returns the ISO 3166-1 code of the country the IP address belongs
+// to. Empty string is returned if it is not known.
+//
+// Country and City databases are supported.
+func (db *DB) Country(ip net.IP) (string, error) {
+	var rec struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := db.r.Lookup(ip, &rec); err != nil {
+		return "", fmt.Errorf("geoip: %w", err)
+	}
+	return rec.Country.ISOCode, nil
+}
+
+// ASN returns the number of the autonomous system the IP address belongs to.
+// Zero is returned if it is not known.
+//
+// ASN databases are supported.
+func (db *DB) ASN(ip net.IP) (uint, error) {
+	var rec struct {
+		Number uint `maxminddb:"autonomous_system_number"`
+	}
+	if err := db.r.Lookup(ip, &rec); err != nil {
+		return 0, fmt.Errorf("geoip: %w", err)
+	}
+	return rec.Number, nil
+}
+
+func (db *DB) Close() error {
+	return db.r.Close()
+}
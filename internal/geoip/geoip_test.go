@@ -0,0 +1,68 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package geoip
+
+import (
+	"net"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDB(t *testing.T) {
+	db, err := Open(testutils.WriteMMDB(t, map[string]map[string]interface{}{
+		"192.0.2.0/24": {
+			"country":                  map[string]interface{}{"iso_code": "DE"},
+			"autonomous_system_number": uint(64500),
+		},
+		"198.51.100.0/25": {
+			"country": map[string]interface{}{"iso_code": "US"},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, c := range []struct {
+		ip      string
+		country string
+		asn     uint
+	}{
+		{"192.0.2.1", "DE", 64500},
+		{"198.51.100.1", "US", 0},
+		{"198.51.100.200", "", 0},
+		{"203.0.113.1", "", 0},
+	} {
+		country, err := db.Country(net.ParseIP(c.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if country != c.country {
+			t.Errorf("%s: expected country %q, got %q", c.ip, c.country, country)
+		}
+		asn, err := db.ASN(net.ParseIP(c.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if asn != c.asn {
+			t.Errorf("%s: expected ASN %d, got %d", c.ip, c.asn, asn)
+		}
+	}
+}
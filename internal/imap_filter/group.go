@@ -19,6 +19,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package imap_filter
 
 import (
+	"errors"
+
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
@@ -54,6 +56,9 @@ func (g *Group) IMAPFilter(accountName string, rcptTo string, meta *module.MsgMe
 	)
 	for _, f := range g.Filters {
 		folder, flags, err := f.IMAPFilter(accountName, rcptTo, meta, hdr, body)
+		if errors.Is(err, module.ErrIMAPFilterDiscard) {
+			return "", nil, err
+		}
 		if err != nil {
 			g.log.Error("IMAP filter failed", err)
 			continue
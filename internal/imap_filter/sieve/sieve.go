@@ -0,0 +1,372 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sieve implements the imap.filter.sieve module that runs
+// per-user Sieve scripts on delivery.
+package sieve
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	sievelang "github.com/foxcpp/maddy/internal/sieve"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "imap.filter.sieve"
+
+// vacationDir is the subdirectory of the scripts directory used to track
+// sent vacation responses. Per-user directories never start with a dot.
+const vacationDir = ".vacation"
+
+// Filter runs the active Sieve script of the recipient and provides
+// access to stored scripts for the managesieve endpoint.
+type Filter struct {
+	*sievelang.FSStore
+
+	instName string
+	log      log.Logger
+	hostname string
+
+	// Target used for redirect and vacation actions. If nil, these
+	// actions are ignored.
+	target module.DeliveryTarget
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Filter{
+		FSStore:  &sievelang.FSStore{},
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (f *Filter) Name() string {
+	return modName
+}
+
+func (f *Filter) InstanceName() string {
+	return f.instName
+}
+
+func (f *Filter) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &f.log.Debug)
+	cfg.String("hostname", true, true, "", &f.hostname)
+	cfg.String("dir", false, false, filepath.Join(config.StateDirectory, "sieve"), &f.Dir)
+	cfg.Int("max_scripts", false, false, 16, &f.MaxScripts)
+	cfg.DataSize("max_script_size", false, false, 64*1024, &f.MaxSize)
+	cfg.Custom("deliver_to", false, false, nil, modconfig.DeliveryDirective, &f.target)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	return os.MkdirAll(f.Dir, 0o700)
+}
+
+func (f *Filter) IMAPFilter(accountName string, rcptTo string, meta *module.MsgMetadata, hdr textproto.Header, body buffer.Buffer) (folder string, flags []string, err error) {
+	src, err := f.ActiveScript(accountName)
+	if err != nil {
+		return "", nil, err
+	}
+	if src == "" {
+		return "", nil, nil
+	}
+	script, err := sievelang.Parse(src)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: invalid script: %w", modName, err)
+	}
+
+	var hdrBuf bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBuf, hdr); err != nil {
+		return "", nil, err
+	}
+	res, err := script.Execute(&sievelang.Message{
+		Header:       hdr,
+		Size:         int64(hdrBuf.Len() + body.Len()),
+		EnvelopeFrom: meta.OriginalFrom,
+		EnvelopeTo:   rcptTo,
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %w", modName, err)
+	}
+
+	ctx := context.TODO()
+	for _, addr := range res.Redirect {
+		if err := f.redirect(ctx, accountName, meta, hdr, body, addr); err != nil {
+			f.log.Error("redirect failed, keeping the message", err, "rcpt", accountName, "redirect_to", addr, "msg_id", meta.ID)
+			res.Keep = true
+		}
+	}
+	if res.Vacation != nil {
+		if err := f.vacation(ctx, accountName, rcptTo, meta, hdr, res.Vacation); err != nil {
+			f.log.Error("vacation response failed", err, "rcpt", accountName, "msg_id", meta.ID)
+		}
+	}
+
+	if res.Discard() {
+		return "", nil, module.ErrIMAPFilterDiscard
+	}
+	if len(res.Fileinto) == 0 {
+		return "", nil, nil
+	}
+	if len(res.Fileinto) > 1 || res.Keep {
+		f.log.DebugMsg("multiple mailboxes requested, only one copy is stored", "rcpt", accountName, "mailbox", res.Fileinto[0])
+	}
+	return res.Fileinto[0], nil, nil
+}
+
+func (f *Filter) deliver(ctx context.Context, from, rcpt string, hdr textproto.Header, body buffer.Buffer) (err error) {
+	if f.target == nil {
+		return errors.New("deliver_to is not configured")
+	}
+
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+	msgMeta := &module.MsgMetadata{
+		ID:           msgID,
+		OriginalFrom: from,
+	}
+
+	delivery, err := f.target.Start(ctx, msgMeta, from)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if err := delivery.Abort(ctx); err != nil {
+				f.log.Error("failed to abort the delivery", err)
+			}
+		}
+	}()
+
+	if err = delivery.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+		return err
+	}
+	if err = delivery.Body(ctx, hdr, body); err != nil {
+		return err
+	}
+	return delivery.Commit(ctx)
+}
+
+func (f *Filter) redirect(ctx context.Context, accountName string, meta *module.MsgMetadata, hdr textproto.Header, body buffer.Buffer, addr string) error {
+	// Delivered-To is used for loop detection, like other MTAs do.
+	for _, value := range hdr.Values("Delivered-To") {
+		if strings.EqualFold(strings.TrimSpace(value), accountName) {
+			return errors.New("mail loop detected")
+		}
+	}
+
+	hdr = hdr.Copy()
+	hdr.Add("Delivered-To", accountName)
+	if err := f.deliver(ctx, meta.OriginalFrom, addr, hdr, body); err != nil {
+		return err
+	}
+	f.log.Msg("message redirected", "rcpt", accountName, "redirect_to", addr, "msg_id", meta.ID)
+	return nil
+}
+
+func hasAddress(hdr textproto.Header, addrs []string) bool {
+	for _, field := range []string{"To", "Cc", "Bcc", "Resent-To", "Resent-Cc"} {
+		for _, value := range hdr.Values(field) {
+			list, err := mail.ParseAddressList(value)
+			if err != nil {
+				continue
+			}
+			for _, a := range list {
+				for _, addr := range addrs {
+					if strings.EqualFold(a.Address, addr) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// shouldReply implements the checks from RFC 5230 Sections 4.5 and 5 that
+// prevent responses to automated messages and mailing lists.
+func shouldReply(sender string, userAddrs []string, hdr textproto.Header) bool {
+	if sender == "" {
+		return false
+	}
+	if autoSubmitted := strings.TrimSpace(hdr.Get("Auto-Submitted")); autoSubmitted != "" && !strings.EqualFold(autoSubmitted, "no") {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(hdr.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return false
+	}
+	for _, field := range []string{"List-Id", "List-Post", "List-Unsubscribe"} {
+		if hdr.Has(field) {
+			return false
+		}
+	}
+
+	localPart := strings.ToLower(sender)
+	if i := strings.LastIndexByte(localPart, '@'); i != -1 {
+		localPart = localPart[:i]
+	}
+	if localPart == "mailer-daemon" || localPart == "listserv" || localPart == "majordomo" ||
+		strings.HasPrefix(localPart, "owner-") || strings.HasSuffix(localPart, "-request") {
+		return false
+	}
+
+	for _, addr := range userAddrs {
+		if strings.EqualFold(sender, addr) {
+			return false
+		}
+	}
+
+	// Do not reply to messages the user received as Bcc or via a
+	// mailing list that was not detected above.
+	return hasAddress(hdr, userAddrs)
+}
+
+func (f *Filter) vacation(ctx context.Context, accountName, rcptTo string, meta *module.MsgMetadata, hdr textproto.Header, v *sievelang.Vacation) error {
+	userAddrs := append([]string{accountName, rcptTo}, v.Addresses...)
+	sender := meta.OriginalFrom
+	if !shouldReply(sender, userAddrs, hdr) {
+		f.log.DebugMsg("vacation response suppressed", "rcpt", accountName, "sender", sender, "msg_id", meta.ID)
+		return nil
+	}
+
+	handle := v.Handle
+	if handle == "" {
+		handle = fmt.Sprintf("%s\x00%s\x00%v\x00%s", v.Subject, v.From, v.MIME, v.Reason)
+	}
+	sum := sha256.Sum256([]byte(accountName + "\x00" + handle + "\x00" + strings.ToLower(sender)))
+	trackPath := filepath.Join(f.Dir, vacationDir, hex.EncodeToString(sum[:]))
+	if info, err := os.Stat(trackPath); err == nil && time.Since(info.ModTime()) < time.Duration(v.Days)*24*time.Hour {
+		f.log.DebugMsg("vacation response already sent", "rcpt", accountName, "sender", sender, "msg_id", meta.ID)
+		return nil
+	}
+
+	from := rcptTo
+	if strings.Contains(accountName, "@") {
+		from = accountName
+	}
+	replyHdr, replyBody, err := f.vacationReply(from, userAddrs, sender, hdr, v)
+	if err != nil {
+		return err
+	}
+	// Null return path per RFC 5230 Section 5.
+	if err := f.deliver(ctx, "", sender, replyHdr, buffer.MemoryBuffer{Slice: replyBody}); err != nil {
+		return err
+	}
+	f.log.Msg("vacation response sent", "rcpt", accountName, "sender", sender, "msg_id", meta.ID)
+
+	if err := os.MkdirAll(filepath.Dir(trackPath), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(trackPath, nil, 0o600)
+}
+
+func (f *Filter) vacationReply(from string, userAddrs []string, sender string, hdr textproto.Header, v *sievelang.Vacation) (textproto.Header, []byte, error) {
+	fromHdr := from
+	if v.From != "" {
+		// Only addresses of the user are allowed to prevent abuse.
+		addr, err := mail.ParseAddress(v.From)
+		if err == nil {
+			for _, userAddr := range userAddrs {
+				if strings.EqualFold(addr.Address, userAddr) {
+					fromHdr = addr.String()
+					break
+				}
+			}
+		}
+	}
+
+	subject := v.Subject
+	if subject == "" {
+		subject = hdr.Get("Subject")
+		if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+			subject = decoded
+		}
+		subject = "Auto: " + subject
+	}
+
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+
+	var replyHdr textproto.Header
+	replyHdr.Add("From", fromHdr)
+	replyHdr.Add("To", sender)
+	replyHdr.Add("Subject", mime.QEncoding.Encode("utf-8", subject))
+	replyHdr.Add("Date", time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	replyHdr.Add("Message-ID", "<"+msgID+"@"+f.hostname+">")
+	if origID := strings.TrimSpace(hdr.Get("Message-Id")); origID != "" {
+		replyHdr.Add("In-Reply-To", origID)
+		references := strings.TrimSpace(hdr.Get("References"))
+		if references != "" {
+			references += " "
+		}
+		replyHdr.Add("References", references+origID)
+	}
+	replyHdr.Add("Auto-Submitted", "auto-replied (vacation)")
+	replyHdr.Add("MIME-Version", "1.0")
+
+	reason := strings.ReplaceAll(v.Reason, "\n", "\r\n")
+	if !v.MIME {
+		replyHdr.Add("Content-Type", "text/plain; charset=utf-8")
+		replyHdr.Add("Content-Transfer-Encoding", "8bit")
+		return replyHdr, []byte(reason), nil
+	}
+
+	br := bufio.NewReader(strings.NewReader(reason))
+	entityHdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		return textproto.Header{}, nil, fmt.Errorf("malformed MIME vacation reason: %w", err)
+	}
+	for fields := entityHdr.Fields(); fields.Next(); {
+		if strings.HasPrefix(strings.ToLower(fields.Key()), "content-") {
+			replyHdr.Add(fields.Key(), target.SanitizeForHeader(fields.Value()))
+		}
+	}
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(br); err != nil {
+		return textproto.Header{}, nil, err
+	}
+	return replyHdr, body.Bytes(), nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
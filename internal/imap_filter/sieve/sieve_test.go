@@ -0,0 +1,170 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	sievelang "github.com/foxcpp/maddy/internal/sieve"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testFilter(t *testing.T, script string) (*Filter, *testutils.Target) {
+	t.Helper()
+	tgt := &testutils.Target{}
+	f := &Filter{
+		FSStore:  &sievelang.FSStore{Dir: t.TempDir()},
+		log:      testutils.Logger(t, modName),
+		hostname: "mx.example.com",
+		target:   tgt,
+	}
+	if err := f.PutScript("user@example.com", "main", script); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetActive("user@example.com", "main"); err != nil {
+		t.Fatal(err)
+	}
+	return f, tgt
+}
+
+func runFilter(t *testing.T, f *Filter, sender, hdr string) (string, error) {
+	t.Helper()
+	h, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(hdr + "\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder, _, err := f.IMAPFilter("user@example.com", "user@example.com",
+		&module.MsgMetadata{ID: "test", OriginalFrom: sender}, h,
+		buffer.MemoryBuffer{Slice: []byte("Hello!\r\n")})
+	return folder, err
+}
+
+const sampleHeader = "From: sender@example.org\r\n" +
+	"To: user@example.com\r\n" +
+	"Subject: Meeting\r\n" +
+	"Message-Id: <orig@example.org>\r\n"
+
+func TestFilter_Fileinto(t *testing.T) {
+	f, _ := testFilter(t, `require "fileinto";
+		if header :contains "subject" "meeting" { fileinto "Work"; }`)
+
+	folder, err := runFilter(t, f, "sender@example.org", sampleHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder != "Work" {
+		t.Fatalf("wrong folder: %q", folder)
+	}
+}
+
+func TestFilter_Discard(t *testing.T) {
+	f, _ := testFilter(t, `discard;`)
+
+	if _, err := runFilter(t, f, "sender@example.org", sampleHeader); !errors.Is(err, module.ErrIMAPFilterDiscard) {
+		t.Fatal("expected ErrIMAPFilterDiscard, got", err)
+	}
+}
+
+func TestFilter_Redirect(t *testing.T) {
+	f, tgt := testFilter(t, `redirect "other@example.net";`)
+
+	if _, err := runFilter(t, f, "sender@example.org", sampleHeader); !errors.Is(err, module.ErrIMAPFilterDiscard) {
+		t.Fatal("expected ErrIMAPFilterDiscard, got", err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("expected 1 message sent, got %d", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	if msg.MailFrom != "sender@example.org" || len(msg.RcptTo) != 1 || msg.RcptTo[0] != "other@example.net" {
+		t.Errorf("wrong envelope: %v %v", msg.MailFrom, msg.RcptTo)
+	}
+
+	// Message that was already delivered to the user is kept to
+	// prevent loops.
+	folder, err := runFilter(t, f, "sender@example.org", sampleHeader+"Delivered-To: user@example.com\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder != "" || len(tgt.Messages) != 1 {
+		t.Errorf("message in a loop should be kept")
+	}
+}
+
+func TestFilter_Vacation(t *testing.T) {
+	f, tgt := testFilter(t, `require "vacation";
+		vacation :days 3 "I am away.";`)
+
+	if _, err := runFilter(t, f, "sender@example.org", sampleHeader); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("expected 1 response, got %d", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	if msg.MailFrom != "" || msg.RcptTo[0] != "sender@example.org" {
+		t.Errorf("wrong envelope: %v %v", msg.MailFrom, msg.RcptTo)
+	}
+	if got := msg.Header.Get("Subject"); got != "Auto: Meeting" {
+		t.Errorf("wrong subject: %q", got)
+	}
+	if got := msg.Header.Get("In-Reply-To"); got != "<orig@example.org>" {
+		t.Errorf("wrong In-Reply-To: %q", got)
+	}
+	if got := msg.Header.Get("Auto-Submitted"); !strings.HasPrefix(got, "auto-replied") {
+		t.Errorf("wrong Auto-Submitted: %q", got)
+	}
+	if string(msg.Body) != "I am away." {
+		t.Errorf("wrong body: %q", msg.Body)
+	}
+
+	// Second message from the same sender - no response.
+	if _, err := runFilter(t, f, "sender@example.org", sampleHeader); err != nil {
+		t.Fatal(err)
+	}
+	// Automated messages and mailing lists - no response.
+	for _, case_ := range []struct{ sender, hdr string }{
+		{"other@example.org", sampleHeader + "Auto-Submitted: auto-generated\r\n"},
+		{"other@example.org", sampleHeader + "List-Id: <list.example.org>\r\n"},
+		{"other@example.org", sampleHeader + "Precedence: bulk\r\n"},
+		{"owner-list@example.org", sampleHeader},
+		{"", sampleHeader},
+		{"other@example.org", strings.Replace(sampleHeader, "To: user@example.com", "To: list@example.org", 1)},
+	} {
+		if _, err := runFilter(t, f, case_.sender, case_.hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("expected 1 response, got %d", len(tgt.Messages))
+	}
+
+	// New sender - new response.
+	if _, err := runFilter(t, f, "another@example.org", sampleHeader); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 2 {
+		t.Fatalf("expected 2 responses, got %d", len(tgt.Messages))
+	}
+}
@@ -1,5 +1,5 @@
-//go:build libdns_acmedns || libdns_all
-// +build libdns_acmedns libdns_all
+//go:build libdns_acmedns || !libdns_separate
+// +build libdns_acmedns !libdns_separate
 
 package libdns
 
@@ -0,0 +1,26 @@
+//go:build libdns_desec || !libdns_separate
+// +build libdns_desec !libdns_separate
+
+package libdns
+
+import (
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/libdns/desec"
+)
+
+func init() {
+	module.Register("libdns.desec", func(modName, instName string, _, _ []string) (module.Module, error) {
+		p := desec.Provider{}
+		return &ProviderModule{
+			RecordDeleter:  &p,
+			RecordAppender: &p,
+			setConfig: func(c *config.Map) {
+				c.String("token", false, true, "", &p.Token)
+				c.String("api_url", false, false, desec.DefaultAPIURL, &p.APIURL)
+			},
+			instName: instName,
+			modName:  modName,
+		}, nil
+	})
+}
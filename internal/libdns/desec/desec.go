@@ -0,0 +1,205 @@
+// Package desec implements the libdns provider for deSEC (https://desec.io).
+//
+// There is no upstream libdns package for deSEC, the API is small enough to
+// use it directly.
+package desec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+const (
+	DefaultAPIURL = "https://desec.io/api/v1"
+
+	// minTTL is the smallest TTL accepted by deSEC by default.
+	minTTL = 3600
+)
+
+type Provider struct {
+	Token  string
+	APIURL string
+
+	// rrsets are replaced as a whole, serialize updates to avoid losing
+	// records added concurrently.
+	lck sync.Mutex
+}
+
+type rrset struct {
+	Subname string   `json:"subname"`
+	Type    string   `json:"type"`
+	TTL     int      `json:"ttl,omitempty"`
+	Records []string `json:"records"`
+}
+
+type rrsetKey struct {
+	subname, typ string
+}
+
+func (p *Provider) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return p.update(ctx, zone, recs, func(existing []string, value string) []string {
+		if slices.Contains(existing, value) {
+			return existing
+		}
+		return append(existing, value)
+	})
+}
+
+func (p *Provider) DeleteRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return p.update(ctx, zone, recs, func(existing []string, value string) []string {
+		return slices.DeleteFunc(existing, func(v string) bool { return v == value })
+	})
+}
+
+func (p *Provider) update(ctx context.Context, zone string, recs []libdns.Record, apply func([]string, string) []string) ([]libdns.Record, error) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+
+	zone = strings.TrimSuffix(zone, ".")
+
+	var (
+		order []rrsetKey
+		sets  = make(map[rrsetKey]*rrset)
+	)
+	for _, rec := range recs {
+		key := rrsetKey{subname: subname(rec.Name), typ: rec.Type}
+		set, ok := sets[key]
+		if !ok {
+			var err error
+			set, err = p.getRRSet(ctx, zone, key)
+			if err != nil {
+				return nil, err
+			}
+			sets[key] = set
+			order = append(order, key)
+		}
+		if ttl := int(rec.TTL / time.Second); ttl > set.TTL {
+			set.TTL = ttl
+		}
+		set.Records = apply(set.Records, recordValue(rec))
+	}
+
+	patch := make([]rrset, 0, len(order))
+	for _, key := range order {
+		set := sets[key]
+		if set.TTL < minTTL {
+			set.TTL = minTTL
+		}
+		if set.Records == nil {
+			set.Records = []string{}
+		}
+		patch = append(patch, *set)
+	}
+	if err := p.do(ctx, http.MethodPatch, "/domains/"+url.PathEscape(zone)+"/rrsets/", patch, nil); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+func (p *Provider) getRRSet(ctx context.Context, zone string, key rrsetKey) (*rrset, error) {
+	pathSubname := key.subname
+	if pathSubname == "" {
+		pathSubname = "@"
+	}
+	set := rrset{Subname: key.subname, Type: key.typ}
+	err := p.do(ctx, http.MethodGet,
+		"/domains/"+url.PathEscape(zone)+"/rrsets/"+url.PathEscape(pathSubname)+"/"+url.PathEscape(key.typ)+"/",
+		nil, &set)
+	if err != nil {
+		var apiErr apiError
+		if errors.As(err, &apiErr) && apiErr.status == http.StatusNotFound {
+			return &rrset{Subname: key.subname, Type: key.typ}, nil
+		}
+		return nil, err
+	}
+	return &set, nil
+}
+
+type apiError struct {
+	status int
+	body   string
+}
+
+func (err apiError) Error() string {
+	return fmt.Sprintf("desec: API error: %d %s: %s", err.status, http.StatusText(err.status), err.body)
+}
+
+func (p *Provider) do(ctx context.Context, method, path string, body, out interface{}) error {
+	apiURL := p.APIURL
+	if apiURL == "" {
+		apiURL = DefaultAPIURL
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		blob, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(blob)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(apiURL, "/")+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+p.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("desec: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		blob, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return apiError{status: resp.StatusCode, body: strings.TrimSpace(string(blob))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// subname converts the libdns relative name into the deSEC subname, which is
+// empty for the zone apex.
+func subname(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "@" {
+		return ""
+	}
+	return name
+}
+
+// recordValue returns the record value in the presentation format expected
+// by deSEC. TXT values need to be quoted and split into strings of at most 255
+// characters.
+func recordValue(rec libdns.Record) string {
+	if rec.Type != "TXT" || strings.HasPrefix(rec.Value, `"`) {
+		return rec.Value
+	}
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	value := rec.Value
+	var parts []string
+	for len(value) > 255 {
+		parts = append(parts, `"`+escaper.Replace(value[:255])+`"`)
+		value = value[255:]
+	}
+	parts = append(parts, `"`+escaper.Replace(value)+`"`)
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,138 @@
+package desec
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+// fakeAPI implements the subset of the deSEC API used by Provider.
+type fakeAPI struct {
+	lck  sync.Mutex
+	sets map[string]rrset // "subname/type" -> rrset
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lck.Lock()
+	defer f.lck.Unlock()
+
+	if r.Header.Get("Authorization") != "Token secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/domains/example.org/rrsets/")
+	switch {
+	case r.Method == http.MethodGet:
+		parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+		if parts[0] == "@" {
+			parts[0] = ""
+		}
+		set, ok := f.sets[parts[0]+"/"+parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(set)
+	case r.Method == http.MethodPatch && path == "":
+		var sets []rrset
+		if err := json.NewDecoder(r.Body).Decode(&sets); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, set := range sets {
+			if len(set.Records) == 0 {
+				delete(f.sets, set.Subname+"/"+set.Type)
+				continue
+			}
+			f.sets[set.Subname+"/"+set.Type] = set
+		}
+		_ = json.NewEncoder(w).Encode(sets)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestProvider(t *testing.T) {
+	api := &fakeAPI{sets: map[string]rrset{
+		"_acme-challenge/TXT": {Subname: "_acme-challenge", Type: "TXT", TTL: 3600, Records: []string{`"existing"`}},
+	}}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	p := Provider{Token: "secret", APIURL: srv.URL}
+	ctx := context.Background()
+
+	_, err := p.AppendRecords(ctx, "example.org.", []libdns.Record{
+		{Type: "TXT", Name: "_acme-challenge", Value: "token1", TTL: 60 * time.Second},
+		{Type: "TXT", Name: "_acme-challenge", Value: `with "quotes"`},
+		{Type: "TLSA", Name: "@", Value: "3 1 1 0a0b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]rrset{
+		"_acme-challenge/TXT": {Subname: "_acme-challenge", Type: "TXT", TTL: 3600,
+			Records: []string{`"existing"`, `"token1"`, `"with \"quotes\""`}},
+		"/TLSA": {Subname: "", Type: "TLSA", TTL: 3600, Records: []string{"3 1 1 0a0b"}},
+	}
+	if !reflect.DeepEqual(api.sets, expected) {
+		t.Fatalf("wrong rrsets after append:\n%+v\nexpected:\n%+v", api.sets, expected)
+	}
+
+	_, err = p.DeleteRecords(ctx, "example.org.", []libdns.Record{
+		{Type: "TXT", Name: "_acme-challenge", Value: "token1"},
+		{Type: "TLSA", Name: "@", Value: "3 1 1 0a0b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = map[string]rrset{
+		"_acme-challenge/TXT": {Subname: "_acme-challenge", Type: "TXT", TTL: 3600,
+			Records: []string{`"existing"`, `"with \"quotes\""`}},
+	}
+	if !reflect.DeepEqual(api.sets, expected) {
+		t.Fatalf("wrong rrsets after delete:\n%+v\nexpected:\n%+v", api.sets, expected)
+	}
+}
+
+func TestProvider_APIError(t *testing.T) {
+	srv := httptest.NewServer(&fakeAPI{sets: map[string]rrset{}})
+	defer srv.Close()
+
+	p := Provider{Token: "wrong", APIURL: srv.URL}
+	_, err := p.AppendRecords(context.Background(), "example.org.", []libdns.Record{
+		{Type: "TXT", Name: "_acme-challenge", Value: "token1"},
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRecordValue(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	for _, c := range []struct {
+		rec      libdns.Record
+		expected string
+	}{
+		{libdns.Record{Type: "TXT", Value: "abc"}, `"abc"`},
+		{libdns.Record{Type: "TXT", Value: `"already quoted"`}, `"already quoted"`},
+		{libdns.Record{Type: "TXT", Value: `a\b`}, `"a\\b"`},
+		{libdns.Record{Type: "TXT", Value: long}, `"` + long[:255] + `" "` + long[255:] + `"`},
+		{libdns.Record{Type: "A", Value: "192.0.2.1"}, "192.0.2.1"},
+	} {
+		if got := recordValue(c.rec); got != c.expected {
+			t.Errorf("recordValue(%+v) = %q, expected %q", c.rec, got, c.expected)
+		}
+	}
+}
@@ -1,5 +1,5 @@
-//go:build libdns_rfc2136 || libdns_all
-// +build libdns_rfc2136 libdns_all
+//go:build libdns_rfc2136 || !libdns_separate
+// +build libdns_rfc2136 !libdns_separate
 
 package libdns
 
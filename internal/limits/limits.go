@@ -18,7 +18,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 // Package limit provides a module object that can be used to restrict the
 // concurrency and rate of the messages flow globally or on per-source,
-// per-destination basis.
+// per-destination basis. Additionally, it can enforce quotas on the amount of
+// messages and recipients per sender in a fixed time window.
 //
 // Note, all domain inputs are interpreted with the assumption they are already
 // normalized.
@@ -28,11 +29,17 @@ package limits
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
 	"net"
+	"path/filepath"
 	"strconv"
 	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/limits/limiters"
 )
@@ -44,8 +51,21 @@ type Group struct {
 	ip     *limiters.BucketSet // BucketSet of MultiLimit
 	source *limiters.BucketSet // BucketSet of MultiLimit
 	dest   *limiters.BucketSet // BucketSet of MultiLimit
+
+	// quota is nil if no quotas are configured.
+	quota *quotaState
+
+	// maxWait is the maximum time to wait for the limit to allow the
+	// message before rejecting it.
+	maxWait time.Duration
+	// retryHints contains the longest rate limit period for each scope. It
+	// is reported to clients as the time after which they should retry.
+	retryHints map[string]time.Duration
 }
 
+// defaultMaxWait is used if max_wait is not specified.
+const defaultMaxWait = 5 * time.Second
+
 func New(_, instName string, _, _ []string) (module.Module, error) {
 	return &Group{
 		instName: instName,
@@ -58,9 +78,39 @@ func (g *Group) Init(cfg *config.Map) error {
 		ipL     []func() limiters.L
 		sourceL []func() limiters.L
 		destL   []func() limiters.L
+		quotas  []quota
+
+		stateFile string
 	)
+	if g.instName != "" {
+		stateFile = filepath.Join(config.StateDirectory, "limits_"+g.instName+".json")
+	}
+	g.maxWait = defaultMaxWait
+	g.retryHints = map[string]time.Duration{}
 
 	for _, child := range cfg.Block.Children {
+		switch child.Name {
+		case "state_file":
+			if len(child.Args) != 1 {
+				return config.NodeErr(child, "exactly one argument is required")
+			}
+			stateFile = child.Args[0]
+			continue
+		case "max_wait":
+			if len(child.Args) != 1 {
+				return config.NodeErr(child, "exactly one argument is required")
+			}
+			var err error
+			g.maxWait, err = time.ParseDuration(child.Args[0])
+			if err != nil {
+				return config.NodeErr(child, "%v", err)
+			}
+			if g.maxWait < 0 {
+				return config.NodeErr(child, "max_wait cannot be negative")
+			}
+			continue
+		}
+
 		if len(child.Args) < 1 {
 			return config.NodeErr(child, "at least two arguments are required")
 		}
@@ -71,9 +121,27 @@ func (g *Group) Init(cfg *config.Map) error {
 		)
 		switch kind := child.Args[0]; kind {
 		case "rate":
-			ctor, err = rateCtor(child, child.Args[1:])
+			var period time.Duration
+			ctor, period, err = rateCtor(child, child.Args[1:])
+			if period > g.retryHints[child.Name] {
+				g.retryHints[child.Name] = period
+			}
 		case "concurrency":
 			ctor, err = concurrencyCtor(child, child.Args[1:])
+		case string(quotaMessages), string(quotaRecipients):
+			switch child.Name {
+			case "all", "ip", "source", "user":
+			case "destination":
+				return config.NodeErr(child, "%v limit is not supported for destination scope", kind)
+			default:
+				return config.NodeErr(child, "unknown limit scope: %v", child.Name)
+			}
+			q, err := quotaCtor(child, child.Name, quotaKind(kind), child.Args[1:])
+			if err != nil {
+				return err
+			}
+			quotas = append(quotas, q)
+			continue
 		default:
 			return config.NodeErr(child, "unknown limit kind: %v", kind)
 		}
@@ -82,6 +150,8 @@ func (g *Group) Init(cfg *config.Map) error {
 		}
 
 		switch scope := child.Name; scope {
+		case "user":
+			return config.NodeErr(child, "only messages and recipients limits are supported for user scope")
 		case "all":
 			globalL = append(globalL, ctor())
 		case "ip":
@@ -118,18 +188,30 @@ func (g *Group) Init(cfg *config.Map) error {
 	}
 	if len(destL) != 0 {
 		g.dest = limiters.NewBucketSet(func() limiters.L {
-			l := make([]limiters.L, 0, len(sourceL))
-			for _, ctor := range sourceL {
+			l := make([]limiters.L, 0, len(destL))
+			for _, ctor := range destL {
 				l = append(l, ctor())
 			}
 			return &limiters.MultiLimit{Wrapped: l}
 		}, 1*time.Minute, 20010)
 	}
 
+	if len(quotas) != 0 {
+		l := log.Logger{Name: "limits"}
+		if stateFile == "" {
+			l.Msg("state_file is not set for the inline block, quota counters will be reset on restart")
+		}
+		var err error
+		g.quota, err = newQuotaState(quotas, stateFile, l)
+		if err != nil {
+			return fmt.Errorf("limits: %w", err)
+		}
+	}
+
 	return nil
 }
 
-func rateCtor(node config.Node, args []string) (func() limiters.L, error) {
+func rateCtor(node config.Node, args []string) (func() limiters.L, time.Duration, error) {
 	period := 1 * time.Second
 	burst := 0
 
@@ -138,24 +220,24 @@ func rateCtor(node config.Node, args []string) (func() limiters.L, error) {
 		var err error
 		period, err = time.ParseDuration(args[1])
 		if err != nil {
-			return nil, config.NodeErr(node, "%v", err)
+			return nil, 0, config.NodeErr(node, "%v", err)
 		}
 		fallthrough
 	case 1:
 		var err error
 		burst, err = strconv.Atoi(args[0])
 		if err != nil {
-			return nil, config.NodeErr(node, "%v", err)
+			return nil, 0, config.NodeErr(node, "%v", err)
 		}
 	case 0:
-		return nil, config.NodeErr(node, "at least burst size is needed")
+		return nil, 0, config.NodeErr(node, "at least burst size is needed")
 	default:
-		return nil, config.NodeErr(node, "too many arguments")
+		return nil, 0, config.NodeErr(node, "too many arguments")
 	}
 
 	return func() limiters.L {
 		return limiters.NewRate(burst, period)
-	}, nil
+	}, period, nil
 }
 
 func concurrencyCtor(node config.Node, args []string) (func() limiters.L, error) {
@@ -171,25 +253,87 @@ func concurrencyCtor(node config.Node, args []string) (func() limiters.L, error)
 	}, nil
 }
 
+func (g *Group) waitTimeout() time.Duration {
+	// Zero value is used as a no-op Group by modules.
+	if g.retryHints == nil {
+		return defaultMaxWait
+	}
+	return g.maxWait
+}
+
+// limitErr converts the error returned by the limiter for the scope into
+// the error with the SMTP reply and the retry time hint.
+func (g *Group) limitErr(scope string, err error) error {
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return throttleErr(scope, "rate", g.retryHints[scope])
+}
+
+// throttleErr returns the error for the message rejected due to the limit.
+//
+// Limits for all messages and per-IP limits are reported using the 451
+// code since they are not specific to the sender or recipient, 450 is used
+// for other limits. 421 is not used since the connection is not closed
+// after the reply. If retryAfter is known, it is included in the reply text as
+// "retry after N seconds" so clients can schedule the next attempt.
+func throttleErr(scope, kind string, retryAfter time.Duration) error {
+	code, enchCode := 450, exterrors.EnhancedCode{4, 7, 1}
+	if scope == "all" || scope == "ip" {
+		code, enchCode = 451, exterrors.EnhancedCode{4, 7, 0}
+	}
+
+	msg := "Too many messages"
+	if kind == string(quotaMessages) || kind == string(quotaRecipients) {
+		msg = "Sending quota exceeded"
+	}
+	misc := map[string]interface{}{
+		"limit_scope": scope,
+		"limit_kind":  kind,
+	}
+	if retryAfter > 0 {
+		secs := int64(math.Ceil(retryAfter.Seconds()))
+		msg += fmt.Sprintf(", retry after %d seconds", secs)
+		misc["retry_after"] = secs
+	} else {
+		msg += ", try again later"
+	}
+
+	return &exterrors.SMTPError{
+		Code:         code,
+		EnhancedCode: enchCode,
+		Message:      msg,
+		Reason:       scope + " " + kind + " limit exceeded",
+		Misc:         misc,
+	}
+}
+
+// TakeMsg blocks until the message from the specified source is allowed by
+// the limits, waiting for at most max_wait.
+//
+// If the message is not allowed in time, the returned error contains the
+// SMTP reply with the retry time hint, see throttleErr.
 func (g *Group) TakeMsg(ctx context.Context, addr net.IP, sourceDomain string) error {
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, g.waitTimeout())
 	defer cancel()
 
 	if err := g.global.TakeContext(ctx); err != nil {
-		return err
+		return g.limitErr("all", err)
 	}
 
 	if g.ip != nil {
 		if err := g.ip.TakeContext(ctx, addr.String()); err != nil {
 			g.global.Release()
-			return err
+			return g.limitErr("ip", err)
 		}
 	}
 	if g.source != nil {
 		if err := g.source.TakeContext(ctx, sourceDomain); err != nil {
 			g.global.Release()
-			g.ip.Release(addr.String())
-			return err
+			if g.ip != nil {
+				g.ip.Release(addr.String())
+			}
+			return g.limitErr("source", err)
 		}
 	}
 	return nil
@@ -199,9 +343,12 @@ func (g *Group) TakeDest(ctx context.Context, domain string) error {
 	if g.dest == nil {
 		return nil
 	}
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, g.waitTimeout())
 	defer cancel()
-	return g.dest.TakeContext(ctx, domain)
+	if err := g.dest.TakeContext(ctx, domain); err != nil {
+		return g.limitErr("destination", err)
+	}
+	return nil
 }
 
 func (g *Group) ReleaseMsg(addr net.IP, sourceDomain string) {
@@ -221,6 +368,54 @@ func (g *Group) ReleaseDest(domain string) {
 	g.dest.Release(domain)
 }
 
+// CheckQuota checks whether the sender is allowed to send a message with
+// the specified amount of recipients without exceeding configured quotas.
+//
+// If the quota window ends in less than max_wait, CheckQuota waits for it
+// instead of rejecting the message.
+//
+// Quotas are not consumed by CheckQuota, ConsumeQuota should be called once
+// the message is accepted.
+func (g *Group) CheckQuota(ctx context.Context, s Sender, rcpts int) error {
+	if g.quota == nil {
+		return nil
+	}
+
+	deadline := time.Now().Add(g.maxWait)
+	for {
+		retryAfter, err := g.quota.check(s, rcpts)
+		if err == nil || retryAfter <= 0 || time.Now().Add(retryAfter).After(deadline) {
+			return err
+		}
+
+		t := time.NewTimer(retryAfter)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+	}
+}
+
+// ConsumeQuota accounts the accepted message in quota counters.
+//
+// If the message with the same msgID was already accounted recently, the
+// call is ignored.
+func (g *Group) ConsumeQuota(msgID string, s Sender, rcpts int) {
+	if g.quota == nil {
+		return
+	}
+	g.quota.consume(msgID, s, rcpts)
+}
+
+func (g *Group) Close() error {
+	if g.quota == nil {
+		return nil
+	}
+	return g.quota.close()
+}
+
 func (g *Group) Name() string {
 	return "limits"
 }
@@ -0,0 +1,62 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package limits
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+func TestTakeMsg_Throttle(t *testing.T) {
+	g := initGroup(t,
+		config.Node{Name: "max_wait", Args: []string{"10ms"}},
+		config.Node{Name: "ip", Args: []string{"rate", "1", "1m"}},
+	)
+	ip := net.IPv4(127, 0, 0, 1)
+
+	if err := g.TakeMsg(context.Background(), ip, "example.org"); err != nil {
+		t.Fatal(err)
+	}
+	g.ReleaseMsg(ip, "example.org")
+
+	err := g.TakeMsg(context.Background(), ip, "example.org")
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) {
+		t.Fatal("expected SMTPError, got", err)
+	}
+	if smtpErr.Code != 451 {
+		t.Error("unexpected error code:", smtpErr.Code)
+	}
+	if smtpErr.Message != "Too many messages, retry after 60 seconds" {
+		t.Error("unexpected message:", smtpErr.Message)
+	}
+	if !exterrors.IsTemporary(err) {
+		t.Error("error is not temporary")
+	}
+
+	// Other IPs are not affected.
+	if err := g.TakeMsg(context.Background(), net.IPv4(127, 0, 0, 2), "example.org"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,358 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package limits
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+const (
+	// quotaFlushDelay is the maximum amount of time counter changes are kept
+	// only in memory.
+	quotaFlushDelay = 30 * time.Second
+
+	// quotaConsumedTTL is the amount of time the message ID is remembered to
+	// not count the message twice if it passes through several places
+	// using the same limits group (e.g. endpoint and target.queue).
+	quotaConsumedTTL = 10 * time.Minute
+
+	// quotaPruneInterval is how often counters for windows that are over
+	// are removed.
+	quotaPruneInterval = 1 * time.Minute
+)
+
+var (
+	sharedCountersLck sync.Mutex
+	sharedCounters    = map[string]*quotaCounters{}
+)
+
+// Sender identifies the originator of the message for quota accounting.
+type Sender struct {
+	IP net.IP
+	// Domain is the domain part of the MAIL FROM address.
+	Domain string
+	// User is the authenticated username, empty for unauthenticated
+	// clients.
+	User string
+}
+
+type quotaKind string
+
+const (
+	quotaMessages   quotaKind = "messages"
+	quotaRecipients quotaKind = "recipients"
+)
+
+// quota is the limit on the amount of messages or recipients in a fixed
+// time window.
+type quota struct {
+	scope  string
+	kind   quotaKind
+	max    int
+	period time.Duration
+}
+
+func (q quota) key(s Sender) (string, bool) {
+	var key string
+	switch q.scope {
+	case "all":
+	case "ip":
+		if s.IP == nil {
+			return "", false
+		}
+		key = s.IP.String()
+	case "source":
+		key = s.Domain
+	case "user":
+		if s.User == "" {
+			return "", false
+		}
+		key = s.User
+	}
+	return q.scope + "/" + string(q.kind) + "/" + q.period.String() + "/" + key, true
+}
+
+type quotaWindow struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+// quotaCounters contains counters for quota windows. Counters saved to
+// the state file are shared by all limits blocks using the file, this way
+// old and new instances of the block do not overwrite each other's changes
+// during the configuration reload.
+type quotaCounters struct {
+	stateFile string
+	log       log.Logger
+	// refs is the amount of quotaStates using the counters, protected by
+	// sharedCountersLck.
+	refs int
+
+	lck        sync.Mutex
+	windows    map[string]*quotaWindow
+	consumed   map[string]time.Time
+	lastPrune  time.Time
+	flushTimer *time.Timer
+}
+
+type quotaState struct {
+	quotas []quota
+	c      *quotaCounters
+}
+
+func quotaCtor(node config.Node, scope string, kind quotaKind, args []string) (quota, error) {
+	if len(args) != 2 {
+		return quota{}, config.NodeErr(node, "limit value and period are needed")
+	}
+	max, err := strconv.Atoi(args[0])
+	if err != nil {
+		return quota{}, config.NodeErr(node, "%v", err)
+	}
+	if max <= 0 {
+		return quota{}, config.NodeErr(node, "limit value should be positive")
+	}
+	period, err := time.ParseDuration(args[1])
+	if err != nil {
+		return quota{}, config.NodeErr(node, "%v", err)
+	}
+	if period <= 0 {
+		return quota{}, config.NodeErr(node, "period should be positive")
+	}
+	return quota{
+		scope:  scope,
+		kind:   kind,
+		max:    max,
+		period: period,
+	}, nil
+}
+
+// newQuotaState creates the quota state using counters from stateFile. If
+// the file is already used by another limits block, counters are shared
+// with it. Counters are kept only in memory if stateFile is empty.
+//
+// The state should be closed using close once it is no longer used.
+func newQuotaState(quotas []quota, stateFile string, l log.Logger) (*quotaState, error) {
+	if stateFile == "" {
+		return &quotaState{quotas: quotas, c: newQuotaCounters("", l)}, nil
+	}
+	stateFile = filepath.Clean(stateFile)
+
+	sharedCountersLck.Lock()
+	defer sharedCountersLck.Unlock()
+
+	if c := sharedCounters[stateFile]; c != nil {
+		c.refs++
+		return &quotaState{quotas: quotas, c: c}, nil
+	}
+
+	c := newQuotaCounters(stateFile, l)
+	blob, err := os.ReadFile(stateFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(blob, &c.windows); err != nil {
+			return nil, fmt.Errorf("%s: %w", stateFile, err)
+		}
+	}
+	c.refs = 1
+	sharedCounters[stateFile] = c
+	return &quotaState{quotas: quotas, c: c}, nil
+}
+
+func newQuotaCounters(stateFile string, l log.Logger) *quotaCounters {
+	return &quotaCounters{
+		stateFile: stateFile,
+		log:       l,
+		windows:   map[string]*quotaWindow{},
+		consumed:  map[string]time.Time{},
+	}
+}
+
+// close saves the counters and releases the state file.
+func (qs *quotaState) close() error {
+	if qs.c.stateFile == "" {
+		return nil
+	}
+
+	sharedCountersLck.Lock()
+	qs.c.refs--
+	if qs.c.refs == 0 {
+		delete(sharedCounters, qs.c.stateFile)
+	}
+	sharedCountersLck.Unlock()
+
+	return qs.c.flush()
+}
+
+// current returns the counter value for the window containing the current
+// moment.
+func (c *quotaCounters) current(key string, period time.Duration, now time.Time) int {
+	w := c.windows[key]
+	if w == nil || now.Sub(w.Start) >= period {
+		return 0
+	}
+	return w.Count
+}
+
+// check returns the error if the quota is exceeded along with the time
+// after which the current window ends. Zero time is returned if the
+// request exceeds the quota on its own.
+func (qs *quotaState) check(s Sender, rcpts int) (time.Duration, error) {
+	c := qs.c
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	now := time.Now()
+	for _, q := range qs.quotas {
+		key, ok := q.key(s)
+		if !ok {
+			continue
+		}
+
+		add := 1
+		if q.kind == quotaRecipients {
+			add = rcpts
+		}
+		if c.current(key, q.period, now)+add <= q.max {
+			continue
+		}
+
+		// The request does not fit even into the empty window, waiting
+		// will not help.
+		var retryAfter time.Duration
+		if w := c.windows[key]; w != nil && now.Sub(w.Start) < q.period {
+			retryAfter = w.Start.Add(q.period).Sub(now)
+		}
+		return retryAfter, throttleErr(q.scope, string(q.kind), retryAfter)
+	}
+	return 0, nil
+}
+
+func (qs *quotaState) consume(msgID string, s Sender, rcpts int) {
+	c := qs.c
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	now := time.Now()
+	for id, t := range c.consumed {
+		if now.Sub(t) >= quotaConsumedTTL {
+			delete(c.consumed, id)
+		}
+	}
+	if now.Sub(c.lastPrune) >= quotaPruneInterval {
+		c.prune(now)
+	}
+	if msgID != "" {
+		if _, ok := c.consumed[msgID]; ok {
+			return
+		}
+		c.consumed[msgID] = now
+	}
+
+	for _, q := range qs.quotas {
+		key, ok := q.key(s)
+		if !ok {
+			continue
+		}
+
+		add := 1
+		if q.kind == quotaRecipients {
+			add = rcpts
+		}
+
+		w := c.windows[key]
+		if w == nil || now.Sub(w.Start) >= q.period {
+			w = &quotaWindow{Start: now}
+			c.windows[key] = w
+		}
+		w.Count += add
+	}
+
+	if c.stateFile != "" && c.flushTimer == nil {
+		c.flushTimer = time.AfterFunc(quotaFlushDelay, func() {
+			if err := c.flush(); err != nil {
+				c.log.Error("failed to save quota counters", err)
+			}
+		})
+	}
+}
+
+// prune removes counters for windows that are already over. The window
+// period is taken from the key since counters can be shared by blocks with
+// different quotas.
+func (c *quotaCounters) prune(now time.Time) {
+	c.lastPrune = now
+
+	for key, w := range c.windows {
+		parts := strings.SplitN(key, "/", 4)
+		if len(parts) == 4 {
+			period, err := time.ParseDuration(parts[2])
+			if err == nil && now.Sub(w.Start) < period {
+				continue
+			}
+		}
+		delete(c.windows, key)
+	}
+}
+
+func (c *quotaCounters) flush() error {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	if c.flushTimer == nil {
+		return nil
+	}
+	c.flushTimer.Stop()
+	c.flushTimer = nil
+
+	c.prune(time.Now())
+
+	blob, err := json.Marshal(c.windows)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.stateFile), filepath.Base(c.stateFile)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(blob); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.stateFile)
+}
@@ -0,0 +1,238 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package limits
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+func initGroup(t *testing.T, children ...config.Node) *Group {
+	t.Helper()
+	config.StateDirectory = t.TempDir()
+	mod, err := New("limits", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := mod.(*Group)
+	if err := g.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestQuota(t *testing.T) {
+	g := initGroup(t,
+		config.Node{Name: "user", Args: []string{"messages", "2", "1h"}},
+		config.Node{Name: "source", Args: []string{"recipients", "5", "24h"}},
+	)
+
+	ctx := context.Background()
+	alice := Sender{IP: net.IPv4(127, 0, 0, 1), Domain: "example.org", User: "alice"}
+	bob := Sender{IP: net.IPv4(127, 0, 0, 1), Domain: "example.org", User: "bob"}
+
+	if err := g.CheckQuota(ctx, alice, 6); err == nil {
+		t.Fatal("expected recipients quota to be exceeded")
+	}
+
+	for i, id := range []string{"msg1", "msg2"} {
+		if err := g.CheckQuota(ctx, alice, 1); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		g.ConsumeQuota(id, alice, 1)
+	}
+	// Same message accepted at another point should not be counted again.
+	g.ConsumeQuota("msg2", alice, 1)
+
+	var smtpErr *exterrors.SMTPError
+	if err := g.CheckQuota(ctx, alice, 1); !errors.As(err, &smtpErr) {
+		t.Fatal("expected SMTPError, got", err)
+	} else if smtpErr.Code != 450 {
+		t.Fatal("unexpected error code:", smtpErr.Code)
+	} else if !strings.Contains(smtpErr.Message, "retry after") {
+		t.Fatal("no retry time hint in the message:", smtpErr.Message)
+	}
+	if err := g.CheckQuota(ctx, bob, 3); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := g.CheckQuota(ctx, bob, 4); err == nil {
+		t.Fatal("expected recipients quota to be exceeded for the domain")
+	}
+}
+
+func TestQuota_Persistence(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "limits.json")
+	cfg := []config.Node{
+		{Name: "state_file", Args: []string{stateFile}},
+		{Name: "user", Args: []string{"messages", "1", "1h"}},
+	}
+	ctx := context.Background()
+	alice := Sender{User: "alice"}
+
+	g := initGroup(t, cfg...)
+	g.ConsumeQuota("msg1", alice, 1)
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	g = initGroup(t, cfg...)
+	if err := g.CheckQuota(ctx, alice, 1); err == nil {
+		t.Fatal("counters are not restored")
+	}
+}
+
+func TestQuota_InlineNoStateFile(t *testing.T) {
+	cfg := []config.Node{
+		{Name: "user", Args: []string{"messages", "1", "1h"}},
+	}
+	ctx := context.Background()
+	alice := Sender{User: "alice"}
+
+	g := initGroup(t, cfg...)
+	stateDir := config.StateDirectory
+	// Identical block defined elsewhere keeps separate counters.
+	other := initGroup(t, cfg...)
+	defer other.Close()
+
+	g.ConsumeQuota("msg1", alice, 1)
+	if err := other.CheckQuota(ctx, alice, 1); err != nil {
+		t.Fatal("counters are shared by inline blocks:", err)
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatal("state file is created for the inline block without state_file")
+	}
+}
+
+func TestQuota_Reload(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "limits.json")
+	cfg := []config.Node{
+		{Name: "state_file", Args: []string{stateFile}},
+		{Name: "user", Args: []string{"messages", "3", "1h"}},
+	}
+	ctx := context.Background()
+	alice := Sender{User: "alice"}
+
+	old := initGroup(t, cfg...)
+	old.ConsumeQuota("msg1", alice, 1)
+
+	// On reload, the new instance is initialized before the old one is
+	// closed and both are used for some time.
+	reloaded := initGroup(t, append(cfg,
+		config.Node{Name: "source", Args: []string{"messages", "100", "24h"}})...)
+	old.ConsumeQuota("msg2", alice, 1)
+	reloaded.ConsumeQuota("msg3", alice, 1)
+	for _, g := range []*Group{old, reloaded} {
+		if err := g.CheckQuota(ctx, alice, 1); err == nil {
+			t.Fatal("counters are not shared between old and new instances")
+		}
+	}
+	if err := old.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.CheckQuota(ctx, alice, 1); err == nil {
+		t.Fatal("counters are lost after the old instance is closed")
+	}
+	if err := reloaded.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	g := initGroup(t, cfg...)
+	defer g.Close()
+	if err := g.CheckQuota(ctx, alice, 1); err == nil {
+		t.Fatal("counters are not restored")
+	}
+}
+
+func TestQuota_Prune(t *testing.T) {
+	g := initGroup(t,
+		config.Node{Name: "ip", Args: []string{"messages", "10", "1h"}},
+	)
+	defer g.Close()
+
+	g.ConsumeQuota("msg1", Sender{IP: net.IPv4(192, 0, 2, 1)}, 1)
+	g.quota.c.lck.Lock()
+	for _, w := range g.quota.c.windows {
+		w.Start = w.Start.Add(-2 * time.Hour)
+	}
+	g.quota.c.lastPrune = time.Time{}
+	g.quota.c.lck.Unlock()
+
+	g.ConsumeQuota("msg2", Sender{IP: net.IPv4(192, 0, 2, 2)}, 1)
+	g.quota.c.lck.Lock()
+	defer g.quota.c.lck.Unlock()
+	if len(g.quota.c.windows) != 1 {
+		t.Fatalf("expired counters are not removed: %v", g.quota.c.windows)
+	}
+}
+
+func TestQuota_Wait(t *testing.T) {
+	g := initGroup(t,
+		config.Node{Name: "max_wait", Args: []string{"5s"}},
+		config.Node{Name: "user", Args: []string{"messages", "1", "200ms"}},
+	)
+	ctx := context.Background()
+	alice := Sender{User: "alice"}
+
+	g.ConsumeQuota("msg1", alice, 1)
+
+	start := time.Now()
+	if err := g.CheckQuota(ctx, alice, 1); err != nil {
+		t.Fatal("message is not accepted after waiting:", err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("CheckQuota did not wait for the quota window to end")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	g.ConsumeQuota("msg2", alice, 1)
+	if err := g.CheckQuota(ctx, alice, 1); err == nil {
+		t.Error("expected an error for cancelled context")
+	}
+}
+
+func TestQuota_InvalidScope(t *testing.T) {
+	for _, n := range []config.Node{
+		{Name: "destination", Args: []string{"messages", "1", "1h"}},
+		{Name: "user", Args: []string{"rate", "10"}},
+		{Name: "user", Args: []string{"messages", "0", "1h"}},
+	} {
+		mod, _ := New("limits", "", nil, nil)
+		if err := mod.(*Group).Init(config.NewMap(nil, config.Node{Children: []config.Node{n}})); err == nil {
+			t.Errorf("%v %v: expected error", n.Name, n.Args)
+		}
+	}
+}
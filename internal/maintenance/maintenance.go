@@ -0,0 +1,84 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package maintenance implements the server-wide maintenance mode.
+//
+// While the mode is enabled, endpoints should not modify the storage: IMAP
+// serves mailboxes read-only and SMTP defers all incoming messages. It is
+// meant to be used during storage migrations and upgrades that can't be
+// done while the server is running normally.
+package maintenance
+
+import (
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+type Status struct {
+	Enabled bool      `json:"enabled"`
+	Reason  string    `json:"reason,omitempty"`
+	Since   time.Time `json:"since"`
+}
+
+var (
+	lck     sync.RWMutex
+	current Status
+)
+
+// Enabled reports whether the maintenance mode is enabled.
+func Enabled() bool {
+	lck.RLock()
+	defer lck.RUnlock()
+	return current.Enabled
+}
+
+// Current returns the maintenance mode status.
+func Current() Status {
+	lck.RLock()
+	defer lck.RUnlock()
+	return current
+}
+
+// Enable enables the maintenance mode. The reason is used only for logging
+// and it is not shown to clients.
+//
+// If the mode is already enabled, only the reason is updated.
+func Enable(reason string) Status {
+	lck.Lock()
+	defer lck.Unlock()
+	if !current.Enabled {
+		current.Since = time.Now()
+	}
+	current.Enabled = true
+	current.Reason = reason
+	log.DefaultLogger.Msg("maintenance mode enabled", "reason", reason)
+	return current
+}
+
+// Disable disables the maintenance mode.
+func Disable() Status {
+	lck.Lock()
+	defer lck.Unlock()
+	if current.Enabled {
+		log.DefaultLogger.Msg("maintenance mode disabled", "duration", time.Since(current.Since).Truncate(time.Second))
+	}
+	current = Status{}
+	return current
+}
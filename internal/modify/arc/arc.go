@@ -0,0 +1,367 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package arc implements the modify.arc module that adds ARC (RFC 8617)
+// header fields to forwarded messages. ARC chain validation is also
+// exported for use by check.arc.
+package arc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/modify/dkim"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+var signDefault = []string{
+	"From",
+	"Sender",
+	"Reply-To",
+	"Subject",
+	"Date",
+	"Message-Id",
+	"To",
+	"Cc",
+	"MIME-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+	"In-Reply-To",
+	"References",
+	"List-Id",
+	"List-Unsubscribe",
+	"List-Post",
+	"DKIM-Signature",
+}
+
+type Modifier struct {
+	instName string
+
+	domain     string
+	selector   string
+	signer     crypto.Signer
+	signHeader []string
+	authServID string
+	verifier
+
+	log log.Logger
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	m := &Modifier{
+		instName: instName,
+		verifier: verifier{resolver: dns.DefaultResolver()},
+		log:      log.Logger{Name: "modify.arc"},
+	}
+
+	switch len(inlineArgs) {
+	case 0:
+	case 2:
+		m.domain = inlineArgs[0]
+		m.selector = inlineArgs[1]
+	default:
+		return nil, errors.New("modify.arc: domain and selector are expected as arguments")
+	}
+
+	return m, nil
+}
+
+func (m *Modifier) Name() string {
+	return "modify.arc"
+}
+
+func (m *Modifier) InstanceName() string {
+	return m.instName
+}
+
+func (m *Modifier) Init(cfg *config.Map) error {
+	var (
+		keyPathTemplate string
+		newKeyAlgo      string
+		hostname        string
+	)
+
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.String("domain", false, false, m.domain, &m.domain)
+	cfg.String("selector", false, false, m.selector, &m.selector)
+	cfg.String("key_path", false, false, "dkim_keys/{domain}_{selector}.key", &keyPathTemplate)
+	cfg.StringList("sign_fields", false, false, signDefault, &m.signHeader)
+	cfg.String("authserv_id", false, false, "", &m.authServID)
+	cfg.Enum("newkey_algo", false, false,
+		[]string{"rsa4096", "rsa2048", "ed25519"}, "rsa2048", &newKeyAlgo)
+
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if m.domain == "" {
+		return errors.New("modify.arc: domain is not specified")
+	}
+	if m.selector == "" {
+		return errors.New("modify.arc: selector is not specified")
+	}
+	if m.authServID == "" {
+		m.authServID = hostname
+	}
+	if m.authServID == "" {
+		return errors.New("modify.arc: authserv_id or hostname should be specified")
+	}
+	for _, key := range m.signHeader {
+		if strings.HasPrefix(strings.ToLower(key), "arc-") {
+			return errors.New("modify.arc: ARC header fields cannot be signed using sign_fields")
+		}
+	}
+
+	keyValues := strings.NewReplacer("{domain}", m.domain, "{selector}", m.selector)
+	keyPath := keyValues.Replace(keyPathTemplate)
+
+	var (
+		newKey bool
+		err    error
+	)
+	m.signer, newKey, err = dkim.LoadOrGenerateKey(m.log, keyPath, newKeyAlgo)
+	if err != nil {
+		return err
+	}
+	if newKey {
+		dnsPath := keyPath + ".dns"
+		if filepath.Ext(keyPath) == ".key" {
+			dnsPath = keyPath[:len(keyPath)-4] + ".dns"
+		}
+		m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
+			"put its contents into TXT record for %s._domainkey.%s to make sealing work",
+			newKeyAlgo, keyPath, dnsPath, m.selector, m.domain)
+	}
+
+	return nil
+}
+
+// ourAuthRes returns the value of the Authentication-Results field added by
+// this server.
+func (m *Modifier) ourAuthRes(h *textproto.Header) (string, bool) {
+	for field := h.FieldsByKey("Authentication-Results"); field.Next(); {
+		id, _, _ := strings.Cut(field.Value(), ";")
+		if fields := strings.Fields(id); len(fields) != 0 && strings.EqualFold(fields[0], m.authServID) {
+			return field.Value(), true
+		}
+	}
+	return "", false
+}
+
+// signAlgo returns the value of the a= tag for the key.
+func (m *Modifier) signAlgo() string {
+	if _, ok := m.signer.Public().(ed25519.PublicKey); ok {
+		return "ed25519-sha256"
+	}
+	return "rsa-sha256"
+}
+
+func (m *Modifier) sign(hashed []byte) (string, error) {
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := m.signer.Public().(ed25519.PublicKey); ok {
+		opts = crypto.Hash(0)
+	}
+	sig, err := m.signer.Sign(rand.Reader, hashed, opts)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+type state struct {
+	m   *Modifier
+	log log.Logger
+}
+
+func (m *Modifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return state{
+		m:   m,
+		log: target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s state) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s state) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (s state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "modify.arc/RewriteBody").End()
+
+	// Messages that were not received from other servers (e.g. submitted
+	// by local users) do not have our Authentication-Results and there is
+	// nothing to attest.
+	authRes, ok := s.m.ourAuthRes(h)
+	if !ok {
+		s.log.DebugMsg("no Authentication-Results from this server, not sealing")
+		return nil
+	}
+
+	fields, err := headerFields(h)
+	if err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.arc"})
+	}
+	c := parseChain(fields)
+
+	// RFC 8617 Section 5.1.2: No new sets are added once the chain failed.
+	if c.lastCV() == cvFail {
+		s.log.DebugMsg("ARC chain already failed, not sealing")
+		return nil
+	}
+	if c.instances() >= maxInstance {
+		s.log.Msg("too many ARC sets, not sealing", "instances", c.instances())
+		return nil
+	}
+
+	cv, reason, err := s.m.validateChain(ctx, c, fields, body)
+	if err != nil {
+		// Do not add a set with cv=fail because of a lookup error, since
+		// nobody will be able to fix that later.
+		s.log.Error("unable to validate ARC chain, not sealing", err)
+		return nil
+	}
+	if reason != nil {
+		s.log.Msg("ARC chain validation failed", "reason", reason.Error())
+	}
+
+	if err := s.seal(h, c, fields, body, authRes, cv); err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.arc"})
+	}
+
+	s.log.DebugMsg("sealed", "cv", cv, "instance", c.instances()+1)
+	return nil
+}
+
+func (s state) seal(h *textproto.Header, c chain, fields []headerField, body buffer.Buffer, authRes, cv string) error {
+	instance := strconv.Itoa(c.instances() + 1)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// ARC-Authentication-Results is a copy of our Authentication-Results
+	// with the chain validation result added.
+	if cv != cvNone {
+		id, results, err := authres.Parse(authRes)
+		if err == nil {
+			results = append(results, &authres.GenericResult{
+				Method: "arc",
+				Value:  authres.ResultValue(cv),
+			})
+			authRes = authres.Format(id, results)
+		}
+	}
+	aar := headerField{
+		key: fieldAAR,
+		raw: "ARC-Authentication-Results: i=" + instance + "; " + strings.TrimSpace(authRes) + "\r\n",
+	}
+
+	// ARC-Message-Signature is computed like DKIM-Signature.
+	r, err := body.Open()
+	if err != nil {
+		return err
+	}
+	bh, err := bodyHash(canonRelaxed, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	var signedKeys []string
+	for _, key := range s.m.signHeader {
+		for range h.Values(key) {
+			signedKeys = append(signedKeys, key)
+		}
+	}
+	amsHash := sha256.New()
+	for _, f := range pickFields(fields, signedKeys) {
+		amsHash.Write([]byte(canonHeader(canonRelaxed, f.raw)))
+	}
+	amsUnsigned := formatField("ARC-Message-Signature", []tag{
+		{"i", instance},
+		{"a", s.m.signAlgo()},
+		{"c", "relaxed/relaxed"},
+		{"d", s.m.domain},
+		{"s", s.m.selector},
+		{"t", now},
+		{"h", strings.Join(signedKeys, ":")},
+		{"bh", base64.StdEncoding.EncodeToString(bh)},
+	})
+	writeSigned(amsHash, canonRelaxed, amsUnsigned)
+	amsSig, err := s.m.sign(amsHash.Sum(nil))
+	if err != nil {
+		return err
+	}
+	ams := headerField{key: fieldAMS, raw: addSignature(amsUnsigned, amsSig)}
+
+	// ARC-Seal covers all sets, or only the new one if the chain failed
+	// validation.
+	sealUnsigned := formatField("ARC-Seal", []tag{
+		{"i", instance},
+		{"a", s.m.signAlgo()},
+		{"t", now},
+		{"cv", cv},
+		{"d", s.m.domain},
+		{"s", s.m.selector},
+	})
+	newSet := arcSet{
+		instance: c.instances() + 1,
+		aar:      &aar,
+		ams:      &ams,
+		seal:     &headerField{key: fieldSeal, raw: sealUnsigned},
+	}
+	sets := append(c.sets, newSet)
+	if cv == cvFail {
+		sets = []arcSet{newSet}
+	}
+	sealSig, err := s.m.sign(sealHash(sets))
+	if err != nil {
+		return err
+	}
+
+	h.AddRaw([]byte(aar.raw))
+	h.AddRaw([]byte(ams.raw))
+	h.AddRaw([]byte(addSignature(sealUnsigned, sealSig)))
+	return nil
+}
+
+func (s state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.arc", New)
+}
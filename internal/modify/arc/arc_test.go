@@ -0,0 +1,266 @@
+package arc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestCanonicalization(t *testing.T) {
+	// Examples from RFC 6376 Section 3.4.5.
+	hdr := []string{"A: X\r\n", "B : Y\t\r\n\tZ  \r\n"}
+	relaxedHdr := ""
+	for _, f := range hdr {
+		relaxedHdr += canonHeader(canonRelaxed, f)
+	}
+	if relaxedHdr != "a:X\r\nb:Y Z\r\n" {
+		t.Errorf("Wrong relaxed header canonicalization: %q", relaxedHdr)
+	}
+
+	body := " C \r\nD \t E\r\n\r\n\r\n"
+	test := func(canon, expected string) {
+		t.Helper()
+		hash, err := bodyHash(canon, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedHash := sha256.Sum256([]byte(expected))
+		if !bytes.Equal(hash, expectedHash[:]) {
+			t.Errorf("Wrong %s body hash", canon)
+		}
+	}
+	test(canonRelaxed, " C\r\nD E\r\n")
+	test(canonSimple, " C \r\nD \t E\r\n")
+
+	emptySimple, _ := bodyHash(canonSimple, strings.NewReader(""))
+	expected := sha256.Sum256([]byte("\r\n"))
+	if !bytes.Equal(emptySimple, expected[:]) {
+		t.Errorf("Wrong simple hash for the empty body")
+	}
+}
+
+func newTestModifier(t *testing.T, dir, domain, keyAlgo string, zones map[string]mockdns.Zone) *Modifier {
+	t.Helper()
+
+	mod, err := New("", "test", nil, []string{domain, "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, m.Name())
+	m.resolver = &mockdns.Resolver{Zones: zones}
+
+	err = m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "authserv_id",
+				Args: []string{"mx." + domain},
+			},
+			{
+				Name: "key_path",
+				Args: []string{filepath.Join(dir, "{domain}.key")},
+			},
+			{
+				Name: "newkey_algo",
+				Args: []string{keyAlgo},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dnsRecord, err := os.ReadFile(filepath.Join(dir, domain+".dns"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zones["default._domainkey."+domain+"."] = mockdns.Zone{TXT: []string{string(dnsRecord)}}
+
+	return m
+}
+
+// reparse serializes and parses the header to make sure the raw
+// representation is used as it would be seen by the next hop.
+func reparse(t *testing.T, h textproto.Header) textproto.Header {
+	t.Helper()
+	var b bytes.Buffer
+	if err := textproto.WriteHeader(&b, h); err != nil {
+		t.Fatal(err)
+	}
+	h, err := textproto.ReadHeader(bufio.NewReader(&b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func sealTestMsg(t *testing.T, m *Modifier, h textproto.Header, body []byte) textproto.Header {
+	t.Helper()
+
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = reparse(t, h)
+	h.Add("Authentication-Results", m.authServID+"; spf=pass smtp.mailfrom=sender@example.org")
+	if err := state.RewriteBody(context.Background(), &h, buffer.MemoryBuffer{Slice: body}); err != nil {
+		t.Fatal(err)
+	}
+	return reparse(t, h)
+}
+
+func checkChain(t *testing.T, m *Modifier, h textproto.Header, body []byte, expectCV string, expectInstances int) {
+	t.Helper()
+
+	fields, err := headerFields(&h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := parseChain(fields)
+	if c.instances() != expectInstances {
+		t.Fatalf("Expected %d ARC sets, got %d", expectInstances, c.instances())
+	}
+	cv, reason, err := m.validateChain(context.Background(), c, fields, buffer.MemoryBuffer{Slice: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cv != expectCV {
+		t.Fatalf("Expected cv=%s, got %s (reason: %v)", expectCV, cv, reason)
+	}
+}
+
+func testMsg() textproto.Header {
+	h := textproto.Header{}
+	h.Add("From", "<sender@example.org>")
+	h.Add("Subject", "heya")
+	h.Add("To", "<alias@a.test>")
+	return h
+}
+
+func TestSealVerify(t *testing.T) {
+	for _, algo := range []string{"rsa2048", "ed25519"} {
+		t.Run(algo, func(t *testing.T) {
+			zones := map[string]mockdns.Zone{}
+			m1 := newTestModifier(t, t.TempDir(), "a.test", algo, zones)
+			m2 := newTestModifier(t, t.TempDir(), "b.test", algo, zones)
+			body := []byte("hello there  \r\n\r\n")
+
+			h := sealTestMsg(t, m1, testMsg(), body)
+			checkChain(t, m1, h, body, cvPass, 1)
+			if !strings.Contains(h.Get("Arc-Seal"), "cv=none") {
+				t.Errorf("Wrong ARC-Seal: %s", h.Get("Arc-Seal"))
+			}
+			if !strings.HasPrefix(h.Get("Arc-Authentication-Results"), "i=1; mx.a.test; spf=pass") {
+				t.Errorf("Wrong ARC-Authentication-Results: %s", h.Get("Arc-Authentication-Results"))
+			}
+
+			h = sealTestMsg(t, m2, h, body)
+			checkChain(t, m2, h, body, cvPass, 2)
+			if !strings.Contains(h.Get("Arc-Seal"), "cv=pass") {
+				t.Errorf("Wrong ARC-Seal: %s", h.Get("Arc-Seal"))
+			}
+			if !strings.Contains(h.Get("Arc-Authentication-Results"), "arc=pass") {
+				t.Errorf("Wrong ARC-Authentication-Results: %s", h.Get("Arc-Authentication-Results"))
+			}
+		})
+	}
+}
+
+func TestSealBrokenChain(t *testing.T) {
+	zones := map[string]mockdns.Zone{}
+	m1 := newTestModifier(t, t.TempDir(), "a.test", "ed25519", zones)
+	m2 := newTestModifier(t, t.TempDir(), "b.test", "ed25519", zones)
+
+	h := sealTestMsg(t, m1, testMsg(), []byte("hello there\r\n"))
+
+	// Body modified after the first hop.
+	body := []byte("hello there, modified\r\n")
+	h = sealTestMsg(t, m2, h, body)
+	if !strings.Contains(h.Get("Arc-Seal"), "cv=fail") {
+		t.Errorf("Wrong ARC-Seal: %s", h.Get("Arc-Seal"))
+	}
+
+	// The new seal covers only its own set and is still valid.
+	fields, err := headerFields(&h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := parseChain(fields)
+	if err := m2.verifySig(context.Background(), mustParseTags(t, fieldValue(*c.sets[1].seal)), sealHash(c.sets[1:])); err != nil {
+		t.Errorf("Seal verification failed: %v", err)
+	}
+
+	// No sets are added after a failure.
+	h = sealTestMsg(t, m1, h, body)
+	if len(h.Values("Arc-Seal")) != 2 {
+		t.Errorf("Expected 2 ARC-Seal fields, got %d", len(h.Values("Arc-Seal")))
+	}
+}
+
+func mustParseTags(t *testing.T, v string) map[string]string {
+	t.Helper()
+	tags, err := parseTags(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tags
+}
+
+func TestSealNoAuthRes(t *testing.T) {
+	zones := map[string]mockdns.Zone{}
+	m := newTestModifier(t, t.TempDir(), "a.test", "ed25519", zones)
+
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := testMsg()
+	h.Add("Authentication-Results", "mx.other.test; spf=pass smtp.mailfrom=sender@example.org")
+	if err := state.RewriteBody(context.Background(), &h, buffer.MemoryBuffer{Slice: []byte("hello\r\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if h.Has("Arc-Seal") || h.Has("Arc-Message-Signature") || h.Has("Arc-Authentication-Results") {
+		t.Error("Message without our Authentication-Results was sealed")
+	}
+}
+
+func TestSealMissingKey(t *testing.T) {
+	zones := map[string]mockdns.Zone{}
+	m1 := newTestModifier(t, t.TempDir(), "a.test", "ed25519", zones)
+	m2 := newTestModifier(t, t.TempDir(), "b.test", "ed25519", zones)
+	body := []byte("hello there\r\n")
+
+	h := sealTestMsg(t, m1, testMsg(), body)
+	delete(zones, "default._domainkey.a.test.")
+	h = sealTestMsg(t, m2, h, body)
+	if !strings.Contains(h.Get("Arc-Seal"), "cv=fail") {
+		t.Errorf("Wrong ARC-Seal: %s", h.Get("Arc-Seal"))
+	}
+}
+
+func TestAddSignature(t *testing.T) {
+	field := formatField("ARC-Seal", []tag{{"i", "1"}, {"a", "rsa-sha256"}})
+	sig := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xFF}, 256))
+	signed := addSignature(field, sig)
+	if removeSignature(signed) != strings.TrimSuffix(field, "\r\n") {
+		t.Errorf("removeSignature(addSignature(...)) mismatch:\n%q\n%q", removeSignature(signed), field)
+	}
+	for _, line := range strings.Split(signed, "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("Line is too long: %q", line)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package arc
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+const (
+	canonSimple  = "simple"
+	canonRelaxed = "relaxed"
+)
+
+var crlf = []byte("\r\n")
+
+// headerField is a raw header field including the trailing CRLF.
+type headerField struct {
+	key string
+	raw string
+}
+
+// headerFields returns all header fields in the order they appear in the
+// message, top to bottom.
+func headerFields(h *textproto.Header) ([]headerField, error) {
+	res := make([]headerField, 0, h.Len())
+	for field := h.Fields(); field.Next(); {
+		raw, err := field.Raw()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, headerField{key: field.Key(), raw: string(raw)})
+	}
+	return res, nil
+}
+
+// collapseWSP replaces all sequences of whitespace with a single space.
+func collapseWSP(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	wsp := false
+	for _, ch := range s {
+		if ch == ' ' || ch == '\t' {
+			wsp = true
+			continue
+		}
+		if wsp {
+			b.WriteByte(' ')
+			wsp = false
+		}
+		b.WriteRune(ch)
+	}
+	if wsp {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// canonHeader canonicalizes the raw header field as specified in RFC 6376
+// Section 3.4.
+func canonHeader(canon, raw string) string {
+	if canon == canonSimple {
+		return raw
+	}
+
+	k, v, _ := strings.Cut(raw, ":")
+	k = strings.ToLower(strings.TrimRight(k, " \t"))
+	v = strings.ReplaceAll(v, "\r", "")
+	v = strings.ReplaceAll(v, "\n", "")
+	v = strings.Trim(collapseWSP(v), " ")
+	return k + ":" + v + "\r\n"
+}
+
+// bodyHash computes the SHA-256 hash of the message body canonicalized as
+// specified in RFC 6376 Section 3.4.
+func bodyHash(canon string, r io.Reader) ([]byte, error) {
+	var (
+		h          = sha256.New()
+		br         = bufio.NewReader(r)
+		emptyLines = 0
+		nonEmpty   = false
+	)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			line = strings.TrimSuffix(line, "\n")
+			line = strings.TrimSuffix(line, "\r")
+			if canon == canonRelaxed {
+				line = strings.TrimRight(collapseWSP(line), " ")
+			}
+
+			// Trailing empty lines are ignored, so write them only once
+			// a non-empty line follows.
+			if line == "" {
+				emptyLines++
+			} else {
+				for ; emptyLines > 0; emptyLines-- {
+					h.Write(crlf)
+				}
+				io.WriteString(h, line)
+				h.Write(crlf)
+				nonEmpty = true
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+	}
+	if !nonEmpty && canon == canonSimple {
+		h.Write(crlf)
+	}
+	return h.Sum(nil), nil
+}
+
+// parseTags parses the tag list used in signature fields, see RFC 6376
+// Section 3.2.
+func parseTags(value string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(value, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed tag: %s", spec)
+		}
+		k = strings.TrimSpace(k)
+		if _, ok := tags[k]; ok {
+			return nil, fmt.Errorf("duplicate tag: %s", k)
+		}
+		tags[k] = strings.TrimSpace(strings.NewReplacer("\r", "", "\n", "").Replace(v))
+	}
+	return tags, nil
+}
+
+func stripWhitespace(s string) string {
+	return strings.Map(func(ch rune) rune {
+		switch ch {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return ch
+	}, s)
+}
+
+var signatureTag = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+
+// removeSignature removes the b= tag value from the raw header field.
+func removeSignature(raw string) string {
+	k, v, _ := strings.Cut(raw, ":")
+	return k + ":" + signatureTag.ReplaceAllString(v, "$1$2")
+}
+
+// writeSigned writes the canonicalized signature field with the b= tag value
+// removed to h. Per RFC 6376 Section 3.7, it is written without the trailing
+// CRLF.
+func writeSigned(h hash.Hash, canon, raw string) {
+	io.WriteString(h, strings.TrimSuffix(canonHeader(canon, removeSignature(raw)), "\r\n"))
+}
+
+// tag is a single tag in the signature field.
+type tag struct {
+	key, value string
+}
+
+// formatField formats the signature field with the empty b= tag value,
+// folding it as necessary.
+func formatField(key string, tags []tag) string {
+	var b strings.Builder
+	b.WriteString(key)
+	b.WriteString(":")
+	lineLen := b.Len()
+	for _, t := range tags {
+		spec := " " + t.key + "=" + t.value + ";"
+		if lineLen+len(spec) > 76 && lineLen > len(key)+1 {
+			b.WriteString("\r\n")
+			lineLen = 0
+		}
+		b.WriteString(spec)
+		lineLen += len(spec)
+	}
+	// Signature is always on its own line, see addSignature.
+	b.WriteString("\r\n b=\r\n")
+	return b.String()
+}
+
+// addSignature inserts the base64-encoded signature into the field formatted
+// by formatField.
+func addSignature(field, sig string) string {
+	var b strings.Builder
+	b.WriteString(strings.TrimSuffix(field, "\r\n"))
+	for len(sig) > 72 {
+		b.WriteString(sig[:72])
+		b.WriteString("\r\n ")
+		sig = sig[72:]
+	}
+	b.WriteString(sig)
+	b.WriteString("\r\n")
+	return b.String()
+}
@@ -0,0 +1,423 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package arc
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+const (
+	fieldAAR  = "Arc-Authentication-Results"
+	fieldAMS  = "Arc-Message-Signature"
+	fieldSeal = "Arc-Seal"
+
+	// maxInstance is the maximum number of ARC sets in the message, see RFC
+	// 8617 Section 4.2.1.
+	maxInstance = 50
+)
+
+// Chain validation status values, see RFC 8617 Section 4.4.
+const (
+	cvNone = "none"
+	cvPass = "pass"
+	cvFail = "fail"
+)
+
+// arcSet is a single ARC set, that is, three header fields with the same
+// instance number.
+type arcSet struct {
+	instance int
+	aar      *headerField
+	ams      *headerField
+	seal     *headerField
+}
+
+// chain is the set of existing ARC header fields in the message.
+type chain struct {
+	sets []arcSet
+
+	// Set if there are malformed, missing or duplicate fields.
+	malformedErr error
+}
+
+func (c chain) instances() int {
+	return len(c.sets)
+}
+
+// lastCV returns the cv tag value of the most recent ARC-Seal.
+func (c chain) lastCV() string {
+	if len(c.sets) == 0 || c.sets[len(c.sets)-1].seal == nil {
+		return ""
+	}
+	tags, err := parseTags(fieldValue(*c.sets[len(c.sets)-1].seal))
+	if err != nil {
+		return ""
+	}
+	return tags["cv"]
+}
+
+func fieldValue(f headerField) string {
+	_, v, _ := strings.Cut(f.raw, ":")
+	return v
+}
+
+// fieldInstance extracts the value of the i= tag from the ARC header field.
+func fieldInstance(f headerField) (int, error) {
+	v := fieldValue(f)
+	if strings.EqualFold(f.key, fieldAAR) {
+		// ARC-Authentication-Results starts with the i= tag followed by the
+		// Authentication-Results value.
+		v, _, _ = strings.Cut(v, ";")
+	}
+	tags, err := parseTags(v)
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.Atoi(tags["i"])
+	if err != nil || i < 1 {
+		return 0, fmt.Errorf("%s: invalid instance: %q", f.key, tags["i"])
+	}
+	return i, nil
+}
+
+// parseChain collects ARC sets from the message header.
+func parseChain(fields []headerField) chain {
+	byInstance := make(map[int]*arcSet)
+	var c chain
+
+	for i := range fields {
+		f := &fields[i]
+		var slot **headerField
+
+		inst := 0
+		switch {
+		case strings.EqualFold(f.key, fieldAAR), strings.EqualFold(f.key, fieldAMS), strings.EqualFold(f.key, fieldSeal):
+			var err error
+			inst, err = fieldInstance(*f)
+			if err != nil {
+				c.malformedErr = err
+				continue
+			}
+		default:
+			continue
+		}
+
+		set := byInstance[inst]
+		if set == nil {
+			set = &arcSet{instance: inst}
+			byInstance[inst] = set
+		}
+		switch {
+		case strings.EqualFold(f.key, fieldAAR):
+			slot = &set.aar
+		case strings.EqualFold(f.key, fieldAMS):
+			slot = &set.ams
+		default:
+			slot = &set.seal
+		}
+		if *slot != nil {
+			c.malformedErr = fmt.Errorf("duplicate %s for instance %d", f.key, inst)
+			continue
+		}
+		*slot = f
+	}
+
+	for i := 1; i <= len(byInstance); i++ {
+		set := byInstance[i]
+		if set == nil {
+			c.malformedErr = fmt.Errorf("missing ARC set for instance %d", i)
+			break
+		}
+		if set.aar == nil || set.ams == nil || set.seal == nil {
+			c.malformedErr = fmt.Errorf("incomplete ARC set for instance %d", i)
+		}
+		c.sets = append(c.sets, *set)
+	}
+
+	return c
+}
+
+// verifier validates existing ARC chains.
+type verifier struct {
+	resolver dns.Resolver
+}
+
+// tempError is returned by validation functions for errors that may go away
+// if the operation is retried later, e.g. DNS lookup failures.
+type tempError struct {
+	err error
+}
+
+func (err tempError) Error() string {
+	return err.err.Error()
+}
+
+func (err tempError) Unwrap() error {
+	return err.err
+}
+
+func (v verifier) lookupKey(ctx context.Context, domain, selector string) (crypto.PublicKey, error) {
+	txts, err := v.resolver.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, fmt.Errorf("no key for %s._domainkey.%s", selector, domain)
+		}
+		return nil, tempError{err: err}
+	}
+	if len(txts) == 0 {
+		return nil, fmt.Errorf("no key for %s._domainkey.%s", selector, domain)
+	}
+
+	tags, err := parseTags(strings.Join(txts, ""))
+	if err != nil {
+		return nil, fmt.Errorf("malformed key record: %w", err)
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("unsupported key record version: %s", v)
+	}
+	keyBlob, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["p"]))
+	if err != nil {
+		return nil, fmt.Errorf("malformed public key: %w", err)
+	}
+	if len(keyBlob) == 0 {
+		return nil, errors.New("key is revoked")
+	}
+
+	switch tags["k"] {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(keyBlob)
+		if err != nil {
+			pub, err = x509.ParsePKCS1PublicKey(keyBlob)
+			if err != nil {
+				return nil, fmt.Errorf("malformed public key: %w", err)
+			}
+		}
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("not an RSA public key")
+		}
+		return rsaPub, nil
+	case "ed25519":
+		if len(keyBlob) != ed25519.PublicKeySize {
+			return nil, errors.New("malformed public key: invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(keyBlob), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", tags["k"])
+	}
+}
+
+func (v verifier) verifySig(ctx context.Context, tags map[string]string, hashed []byte) error {
+	pub, err := v.lookupKey(ctx, tags["d"], tags["s"])
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["b"]))
+	if err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+
+	switch tags["a"] {
+	case "rsa-sha256":
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key type does not match the signature algorithm")
+		}
+		return rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, hashed, sig)
+	case "ed25519-sha256":
+		edPub, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("key type does not match the signature algorithm")
+		}
+		if !ed25519.Verify(edPub, hashed, sig) {
+			return errors.New("signature verification failed")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported signature algorithm: %s", tags["a"])
+	}
+}
+
+// verifyAMS verifies the ARC-Message-Signature of the set against the
+// message, see RFC 8617 Section 5.2 step 5.
+func (v verifier) verifyAMS(ctx context.Context, set arcSet, fields []headerField, body buffer.Buffer) error {
+	tags, err := parseTags(fieldValue(*set.ams))
+	if err != nil {
+		return err
+	}
+	for _, k := range []string{"a", "b", "bh", "d", "s", "h"} {
+		if tags[k] == "" {
+			return fmt.Errorf("missing %s= tag", k)
+		}
+	}
+	if _, ok := tags["l"]; ok {
+		return errors.New("body length limits are not supported")
+	}
+
+	headerCanon, bodyCanon := canonSimple, canonSimple
+	if c := tags["c"]; c != "" {
+		headerCanon, bodyCanon, _ = strings.Cut(c, "/")
+		if bodyCanon == "" {
+			bodyCanon = canonSimple
+		}
+	}
+	for _, c := range []string{headerCanon, bodyCanon} {
+		if c != canonSimple && c != canonRelaxed {
+			return fmt.Errorf("unsupported canonicalization: %s", c)
+		}
+	}
+
+	r, err := body.Open()
+	if err != nil {
+		return err
+	}
+	bh, err := bodyHash(bodyCanon, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	expectedBH, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["bh"]))
+	if err != nil {
+		return fmt.Errorf("malformed body hash: %w", err)
+	}
+	if !bytes.Equal(bh, expectedBH) {
+		return errors.New("body hash mismatch")
+	}
+
+	h := sha256.New()
+	for _, f := range pickFields(fields, strings.Split(tags["h"], ":")) {
+		h.Write([]byte(canonHeader(headerCanon, f.raw)))
+	}
+	writeSigned(h, headerCanon, set.ams.raw)
+
+	return v.verifySig(ctx, tags, h.Sum(nil))
+}
+
+// verifySeal verifies the ARC-Seal of the set, see RFC 8617 Section 5.2
+// step 6.
+func (v verifier) verifySeal(ctx context.Context, c chain, idx int) error {
+	tags, err := parseTags(fieldValue(*c.sets[idx].seal))
+	if err != nil {
+		return err
+	}
+	for _, k := range []string{"a", "b", "d", "s", "cv"} {
+		if tags[k] == "" {
+			return fmt.Errorf("missing %s= tag", k)
+		}
+	}
+
+	expectedCV := cvPass
+	if idx == 0 {
+		expectedCV = cvNone
+	}
+	if tags["cv"] != expectedCV {
+		return fmt.Errorf("unexpected cv=%s for instance %d", tags["cv"], idx+1)
+	}
+
+	return v.verifySig(ctx, tags, sealHash(c.sets[:idx+1]))
+}
+
+// sealHash computes the hash signed by the ARC-Seal of the last set in
+// sets.
+func sealHash(sets []arcSet) []byte {
+	h := sha256.New()
+	for i, set := range sets {
+		h.Write([]byte(canonHeader(canonRelaxed, set.aar.raw)))
+		h.Write([]byte(canonHeader(canonRelaxed, set.ams.raw)))
+		if i == len(sets)-1 {
+			writeSigned(h, canonRelaxed, set.seal.raw)
+		} else {
+			h.Write([]byte(canonHeader(canonRelaxed, set.seal.raw)))
+		}
+	}
+	return h.Sum(nil)
+}
+
+// pickFields selects header fields listed in the h= tag. Per RFC 6376
+// Section 5.4.2, multiple instances of the same field are picked from the
+// bottom of the header.
+func pickFields(fields []headerField, keys []string) []headerField {
+	used := make(map[int]bool)
+	res := make([]headerField, 0, len(keys))
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fields[i].key, key) {
+				continue
+			}
+			used[i] = true
+			res = append(res, fields[i])
+			break
+		}
+	}
+	return res
+}
+
+// validateChain determines the chain validation status of the existing ARC
+// chain, see RFC 8617 Section 5.2.
+//
+// The returned error is set only for temporary errors that prevent
+// validation. Reason is set if the chain fails validation.
+func (v verifier) validateChain(ctx context.Context, c chain, fields []headerField, body buffer.Buffer) (cv string, reason error, err error) {
+	if c.instances() == 0 && c.malformedErr == nil {
+		return cvNone, nil, nil
+	}
+	if c.malformedErr != nil {
+		return cvFail, c.malformedErr, nil
+	}
+	if c.instances() > maxInstance {
+		return cvFail, errors.New("too many ARC sets"), nil
+	}
+	if c.lastCV() == cvFail {
+		return cvFail, errors.New("chain already failed validation"), nil
+	}
+
+	check := func(err error) (string, error, error) {
+		var tempErr tempError
+		if errors.As(err, &tempErr) {
+			return "", nil, err
+		}
+		return cvFail, err, nil
+	}
+
+	last := c.sets[len(c.sets)-1]
+	if err := v.verifyAMS(ctx, last, fields, body); err != nil {
+		return check(fmt.Errorf("ARC-Message-Signature (i=%d): %w", last.instance, err))
+	}
+	for i := len(c.sets) - 1; i >= 0; i-- {
+		if err := v.verifySeal(ctx, c, i); err != nil {
+			return check(fmt.Errorf("ARC-Seal (i=%d): %w", i+1, err))
+		}
+	}
+	return cvPass, nil, nil
+}
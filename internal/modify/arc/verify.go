@@ -0,0 +1,74 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package arc
+
+import (
+	"context"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+// Result is the result of the ARC chain validation.
+type Result struct {
+	// Chain validation status: "none", "pass" or "fail".
+	Value string
+
+	// Number of ARC sets in the message.
+	Instances int
+
+	// Signing domain of the most recent ARC-Seal. Set only if the chain
+	// passed validation.
+	Sealer string
+
+	// Reason is set if the chain failed validation.
+	Reason error
+}
+
+// Verify validates the ARC chain of the message as described in RFC 8617
+// Section 5.2.
+//
+// The returned error is set only for errors that prevent validation and may
+// go away if it is retried later, e.g. DNS lookup failures.
+func Verify(ctx context.Context, resolver dns.Resolver, h *textproto.Header, body buffer.Buffer) (Result, error) {
+	fields, err := headerFields(h)
+	if err != nil {
+		return Result{}, err
+	}
+	c := parseChain(fields)
+
+	cv, reason, err := verifier{resolver: resolver}.validateChain(ctx, c, fields, body)
+	if err != nil {
+		return Result{}, err
+	}
+
+	res := Result{
+		Value:     cv,
+		Instances: c.instances(),
+		Reason:    reason,
+	}
+	if cv == cvPass {
+		tags, err := parseTags(fieldValue(*c.sets[len(c.sets)-1].seal))
+		if err == nil {
+			res.Sealer = tags["d"]
+		}
+	}
+	return res, nil
+}
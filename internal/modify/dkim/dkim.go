@@ -24,9 +24,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"path/filepath"
 	"runtime/trace"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-message/textproto"
@@ -34,6 +34,7 @@ import (
 	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
@@ -93,12 +94,19 @@ var (
 	}
 )
 
+// domainKey is the key used to sign messages for a domain.
+type domainKey struct {
+	selector string
+	signer   crypto.Signer
+}
+
 type Modifier struct {
 	instName string
 
 	domains        []string
 	selector       string
-	signers        map[string]crypto.Signer
+	signers        map[string]domainKey
+	signersLck     sync.RWMutex
 	oversignHeader []string
 	signHeader     []string
 	headerCanon    dkim.Canonicalization
@@ -107,6 +115,14 @@ type Modifier struct {
 	hash           crypto.Hash
 	multipleFromOk bool
 	signSubdomains bool
+	newKeyAlgo     string
+
+	rotateInterval     time.Duration
+	rotatePublishDelay time.Duration
+	rotateGrace        time.Duration
+	dnsProvider        dnsProvider
+	rings              []*keyRing
+	rotationStop       chan struct{}
 
 	log log.Logger
 }
@@ -114,7 +130,7 @@ type Modifier struct {
 func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 	m := &Modifier{
 		instName: instName,
-		signers:  map[string]crypto.Signer{},
+		signers:  map[string]domainKey{},
 		log:      log.Logger{Name: "modify.dkim"},
 	}
 
@@ -143,7 +159,6 @@ func (m *Modifier) Init(cfg *config.Map) error {
 	var (
 		hashName        string
 		keyPathTemplate string
-		newKeyAlgo      string
 	)
 
 	cfg.Bool("debug", true, false, &m.log.Debug)
@@ -162,9 +177,19 @@ func (m *Modifier) Init(cfg *config.Map) error {
 	cfg.Enum("hash", false, false,
 		[]string{"sha256"}, "sha256", &hashName)
 	cfg.Enum("newkey_algo", false, false,
-		[]string{"rsa4096", "rsa2048", "ed25519"}, "rsa2048", &newKeyAlgo)
+		[]string{"rsa4096", "rsa2048", "ed25519"}, "rsa2048", &m.newKeyAlgo)
 	cfg.Bool("allow_multiple_from", false, false, &m.multipleFromOk)
 	cfg.Bool("sign_subdomains", false, false, &m.signSubdomains)
+	cfg.Duration("rotate_interval", false, false, 0, &m.rotateInterval)
+	cfg.Duration("rotate_publish_delay", false, false, 2*Day, &m.rotatePublishDelay)
+	cfg.Duration("rotate_grace", false, false, 7*Day, &m.rotateGrace)
+	cfg.Custom("dns_provider", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		var p dnsProvider
+		err := modconfig.ModuleFromNode("libdns", node.Args, node, m.Globals, &p)
+		return p, err
+	}, &m.dnsProvider)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -185,39 +210,70 @@ func (m *Modifier) Init(cfg *config.Map) error {
 		panic("modify.dkim.Init: Hash function allowed by config matcher but not present in hashFuncs")
 	}
 
+	if m.rotateInterval != 0 {
+		if err := validateRotation(m.rotateInterval, m.rotatePublishDelay, m.rotateGrace, keyPathTemplate); err != nil {
+			return err
+		}
+	} else if m.dnsProvider != nil {
+		return errors.New("modify.dkim: dns_provider can be used only with rotate_interval")
+	}
+
 	for _, domain := range m.domains {
 		if _, err := idna.ToASCII(domain); err != nil {
 			m.log.Printf("warning: unable to convert domain %s to A-labels form, non-EAI messages will not be signed: %v", domain, err)
 		}
 
+		normDomain, err := dns.ForLookup(domain)
+		if err != nil {
+			return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
+		}
+
+		if m.rotateInterval != 0 {
+			r := newKeyRing(domain, normDomain, m.selector, keyPathTemplate)
+			if err := m.loadRing(r); err != nil {
+				return fmt.Errorf("modify.dkim: %s: %w", domain, err)
+			}
+			if err := m.rotate(r, time.Now()); err != nil {
+				return fmt.Errorf("modify.dkim: %s: %w", domain, err)
+			}
+			m.rings = append(m.rings, r)
+			continue
+		}
+
 		keyValues := strings.NewReplacer("{domain}", domain, "{selector}", m.selector)
 		keyPath := keyValues.Replace(keyPathTemplate)
 
-		signer, newKey, err := m.loadOrGenerateKey(keyPath, newKeyAlgo)
+		signer, newKey, err := m.loadOrGenerateKey(keyPath, m.newKeyAlgo)
 		if err != nil {
 			return err
 		}
 
 		if newKey {
-			dnsPath := keyPath + ".dns"
-			if filepath.Ext(keyPath) == ".key" {
-				dnsPath = keyPath[:len(keyPath)-4] + ".dns"
-			}
+			dnsPath := dnsRecordPath(keyPath)
 			m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
 				"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
-				newKeyAlgo, keyPath, dnsPath, m.selector, domain)
+				m.newKeyAlgo, keyPath, dnsPath, m.selector, domain)
 		}
 
-		normDomain, err := dns.ForLookup(domain)
-		if err != nil {
-			return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
-		}
-		m.signers[normDomain] = signer
+		m.signers[normDomain] = domainKey{selector: m.selector, signer: signer}
+	}
+
+	if len(m.rings) != 0 && !module.NoRun {
+		m.rotationStop = make(chan struct{})
+		go m.rotationLoop()
 	}
 
 	return nil
 }
 
+func (m *Modifier) Close() error {
+	if m.rotationStop != nil {
+		m.rotationStop <- struct{}{}
+		<-m.rotationStop
+	}
+	return nil
+}
+
 func (m *Modifier) fieldsToSign(h *textproto.Header) []string {
 	// Filter out duplicated fields from configs so they
 	// will not cause panic() in go-msgauth internals.
@@ -290,8 +346,6 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 	if domain == "" {
 		domain = s.m.domains[0]
 	}
-	selector := s.m.selector
-
 	if s.m.signSubdomains {
 		topDomain := s.m.domains[0]
 		if strings.HasSuffix(domain, "."+topDomain) {
@@ -303,11 +357,14 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 		s.log.Error("unable to normalize domain from envelope sender", err, "domain", domain)
 		return nil
 	}
-	keySigner := s.m.signers[normDomain]
-	if keySigner == nil {
+	s.m.signersLck.RLock()
+	key, ok := s.m.signers[normDomain]
+	s.m.signersLck.RUnlock()
+	if !ok {
 		s.log.Msg("no key for domain", "domain", normDomain)
 		return nil
 	}
+	selector := key.selector
 
 	// If the message is non-EAI, we are not allowed to use domains in U-labels,
 	// attempt to convert.
@@ -328,7 +385,7 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 		Domain:                 domain,
 		Selector:               selector,
 		Identifier:             "@" + domain,
-		Signer:                 keySigner,
+		Signer:                 key.signer,
 		Hash:                   s.m.hash,
 		HeaderCanonicalization: s.m.headerCanon,
 		BodyCanonicalization:   s.m.bodyCanon,
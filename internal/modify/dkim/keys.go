@@ -31,8 +31,18 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+
+	"github.com/foxcpp/maddy/framework/log"
 )
 
+// LoadOrGenerateKey loads the private key from keyPath, generating a new key
+// using newKeyAlgo if the file does not exist. It is used by other modules
+// that sign messages with DKIM keys, such as modify.arc.
+func LoadOrGenerateKey(l log.Logger, keyPath, newKeyAlgo string) (pkey crypto.Signer, newKey bool, err error) {
+	m := &Modifier{log: l}
+	return m.loadOrGenerateKey(keyPath, newKeyAlgo)
+}
+
 func (m *Modifier) loadOrGenerateKey(keyPath, newKeyAlgo string) (pkey crypto.Signer, newKey bool, err error) {
 	f, err := os.Open(keyPath)
 	if err != nil {
@@ -99,16 +109,13 @@ func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer,
 	m.log.Printf("generating a new %s keypair...", newKeyAlgo)
 
 	var (
-		pkey     crypto.Signer
-		dkimName = newKeyAlgo
-		err      error
+		pkey crypto.Signer
+		err  error
 	)
 	switch newKeyAlgo {
 	case "rsa4096":
-		dkimName = "rsa"
 		pkey, err = rsa.GenerateKey(rand.Reader, 4096)
 	case "rsa2048":
-		dkimName = "rsa"
 		pkey, err = rsa.GenerateKey(rand.Reader, 2048)
 	case "ed25519":
 		_, pkey, err = ed25519.GenerateKey(rand.Reader)
@@ -130,7 +137,7 @@ func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer,
 		return nil, wrapErr(err)
 	}
 
-	_, err = writeDNSRecord(keyPath, dkimName, pkey)
+	_, err = writeDNSRecord(keyPath, pkey)
 	if err != nil {
 		return nil, wrapErr(err)
 	}
@@ -150,33 +157,52 @@ func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer,
 	return pkey, nil
 }
 
-func writeDNSRecord(keyPath, dkimAlgoName string, pkey crypto.Signer) (string, error) {
+// dnsRecordPath returns the path of the file containing the DNS record
+// for the key stored in keyPath.
+func dnsRecordPath(keyPath string) string {
+	if filepath.Ext(keyPath) == ".key" {
+		return keyPath[:len(keyPath)-4] + ".dns"
+	}
+	return keyPath + ".dns"
+}
+
+// dkimRecord returns the DKIM key record (RFC 6376, Section 3.6.1) for
+// the public key of pkey.
+func dkimRecord(pkey crypto.Signer) (string, error) {
 	var (
-		keyBlob []byte
-		pubkey  = pkey.Public()
+		keyBlob  []byte
+		algoName string
 	)
-	switch pubkey := pubkey.(type) {
+	switch pubkey := pkey.Public().(type) {
 	case *rsa.PublicKey:
 		var err error
 		keyBlob, err = x509.MarshalPKIXPublicKey(pubkey)
 		if err != nil {
 			return "", err
 		}
+		algoName = "rsa"
 	case ed25519.PublicKey:
 		keyBlob = pubkey
+		algoName = "ed25519"
 	default:
-		panic("modify.dkim.writeDNSRecord: unknown key algorithm")
+		return "", fmt.Errorf("unsupported key algorithm: %T", pubkey)
 	}
 
-	dnsPath := keyPath + ".dns"
-	if filepath.Ext(keyPath) == ".key" {
-		dnsPath = keyPath[:len(keyPath)-4] + ".dns"
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", algoName, base64.StdEncoding.EncodeToString(keyBlob)), nil
+}
+
+func writeDNSRecord(keyPath string, pkey crypto.Signer) (string, error) {
+	keyRecord, err := dkimRecord(pkey)
+	if err != nil {
+		return "", err
 	}
+
+	dnsPath := dnsRecordPath(keyPath)
 	dnsF, err := os.Create(dnsPath)
 	if err != nil {
 		return "", err
 	}
-	keyRecord := fmt.Sprintf("v=DKIM1; k=%s; p=%s", dkimAlgoName, base64.StdEncoding.EncodeToString(keyBlob))
+	defer dnsF.Close()
 	if _, err := io.WriteString(dnsF, keyRecord); err != nil {
 		return "", err
 	}
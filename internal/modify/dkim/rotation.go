@@ -0,0 +1,461 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/libdns/libdns"
+)
+
+const (
+	// rotationCheckInterval is how often key ages are checked when key
+	// rotation is enabled.
+	rotationCheckInterval = time.Hour
+
+	// rotationRecordTTL is the TTL of TXT records created using dns_provider.
+	rotationRecordTTL = time.Hour
+
+	// rotationDNSTimeout is the maximum time allowed for a single DNS
+	// provider request.
+	rotationDNSTimeout = time.Minute
+)
+
+// dnsProvider is the subset of libdns interfaces used to publish DKIM
+// records. It is implemented by libdns.* modules.
+type dnsProvider interface {
+	libdns.RecordAppender
+	libdns.RecordDeleter
+}
+
+// rotatedKey is the key ring entry persisted in the state file.
+//
+// The key is pending (published but not used for signing yet) if Activated
+// is zero and retired (not used for signing but kept in DNS for verification
+// of messages in transit) if Retired is not zero.
+type rotatedKey struct {
+	Selector  string    `json:"selector"`
+	Created   time.Time `json:"created"`
+	Published bool      `json:"published"`
+	Activated time.Time `json:"activated"`
+	Retired   time.Time `json:"retired"`
+}
+
+// keyRing is the set of keys used by modify.dkim for a single domain when
+// key rotation is enabled.
+type keyRing struct {
+	domain       string
+	normDomain   string
+	baseSelector string
+	// keyPath with the {domain} placeholder already replaced.
+	keyPathTmpl string
+	statePath   string
+	zonePath    string
+
+	keys    []rotatedKey
+	signers map[string]crypto.Signer
+}
+
+func newKeyRing(domain, normDomain, baseSelector, keyPathTemplate string) *keyRing {
+	keyPathTmpl := strings.ReplaceAll(keyPathTemplate, "{domain}", domain)
+	basePath := strings.ReplaceAll(keyPathTmpl, "{selector}", baseSelector)
+	basePath = strings.TrimSuffix(basePath, filepath.Ext(basePath))
+
+	return &keyRing{
+		domain:       domain,
+		normDomain:   normDomain,
+		baseSelector: baseSelector,
+		keyPathTmpl:  keyPathTmpl,
+		statePath:    basePath + ".keys.json",
+		zonePath:     basePath + ".zone",
+		signers:      map[string]crypto.Signer{},
+	}
+}
+
+func (r *keyRing) keyPath(selector string) string {
+	return strings.ReplaceAll(r.keyPathTmpl, "{selector}", selector)
+}
+
+// find returns the index of the first key matching the predicate or -1.
+func (r *keyRing) find(pred func(k rotatedKey) bool) int {
+	for i, k := range r.keys {
+		if pred(k) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *keyRing) activeKey() int {
+	return r.find(func(k rotatedKey) bool { return !k.Activated.IsZero() && k.Retired.IsZero() })
+}
+
+func (r *keyRing) pendingKey() int {
+	return r.find(func(k rotatedKey) bool { return k.Activated.IsZero() })
+}
+
+// nextSelector returns the selector for the key generated at the specified
+// time. It is unique within the ring.
+func (r *keyRing) nextSelector(now time.Time) string {
+	selector := r.baseSelector + "-" + now.UTC().Format("20060102")
+	candidate := selector
+	for i := 2; r.find(func(k rotatedKey) bool { return k.Selector == candidate }) != -1; i++ {
+		candidate = selector + "-" + strconv.Itoa(i)
+	}
+	return candidate
+}
+
+// loadRing reads the ring state and all referenced keys.
+//
+// If there is no state file yet, but the key for the base selector exists
+// (e.g. it was created before rotation was enabled), it is adopted as the
+// active key. Its file modification time is used as the activation time
+// so old keys are replaced soon.
+func (m *Modifier) loadRing(r *keyRing) error {
+	blob, err := os.ReadFile(r.statePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		legacyPath := r.keyPath(r.baseSelector)
+		info, err := os.Stat(legacyPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		r.keys = []rotatedKey{{
+			Selector:  r.baseSelector,
+			Created:   info.ModTime(),
+			Published: true,
+			Activated: info.ModTime(),
+		}}
+	} else if err := json.Unmarshal(blob, &r.keys); err != nil {
+		return fmt.Errorf("%s: %w", r.statePath, err)
+	}
+
+	for _, k := range r.keys {
+		keyPath := r.keyPath(k.Selector)
+		if _, err := os.Stat(keyPath); err != nil {
+			return fmt.Errorf("key for selector %s is missing: %w", k.Selector, err)
+		}
+		signer, _, err := m.loadOrGenerateKey(keyPath, m.newKeyAlgo)
+		if err != nil {
+			return err
+		}
+		r.signers[k.Selector] = signer
+	}
+	return nil
+}
+
+// save writes the ring state and the zone file snippet with records for all
+// published keys.
+func (r *keyRing) save() error {
+	blob, err := json.MarshalIndent(r.keys, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(r.statePath, blob, 0o600); err != nil {
+		return err
+	}
+
+	var zone strings.Builder
+	zone.WriteString("; DKIM records for " + r.domain + " generated by maddy.\n")
+	zone.WriteString("; This file is overwritten on each key rotation.\n")
+	for _, k := range r.keys {
+		record, err := dkimRecord(r.signers[k.Selector])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&zone, "%s._domainkey.%s. %d IN TXT %s\n",
+			k.Selector, r.domain, int(rotationRecordTTL.Seconds()), zoneTXTValue(record))
+	}
+	return writeFileAtomic(r.zonePath, []byte(zone.String()), 0o644)
+}
+
+// zoneTXTValue formats the TXT record value for use in zone files, splitting
+// it into 255-character strings as required by RFC 1035.
+func zoneTXTValue(value string) string {
+	var parts []string
+	for len(value) > 255 {
+		parts = append(parts, `"`+value[:255]+`"`)
+		value = value[255:]
+	}
+	parts = append(parts, `"`+value+`"`)
+	return strings.Join(parts, " ")
+}
+
+func writeFileAtomic(path string, blob []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, blob, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// rotate performs all key ring state transitions due at the specified time.
+func (m *Modifier) rotate(r *keyRing, now time.Time) error {
+	changed := false
+	defer func() {
+		if changed {
+			if err := r.save(); err != nil {
+				m.log.Error("failed to save DKIM key ring state", err, "domain", r.domain)
+			}
+		}
+		m.updateSigner(r)
+	}()
+
+	// Retry publishing if the DNS provider failed last time.
+	for i := range r.keys {
+		if !r.keys[i].Published && m.publishKey(r, r.keys[i].Selector) {
+			r.keys[i].Published = true
+			changed = true
+		}
+	}
+
+	active, pending := r.activeKey(), r.pendingKey()
+
+	// No keys at all. Generate one and use it right away, the operator is
+	// expected to publish it in DNS, as with rotation disabled.
+	if active == -1 && pending == -1 {
+		if err := m.generateRingKey(r, now); err != nil {
+			return err
+		}
+		changed = true
+		active = len(r.keys) - 1
+		r.keys[active].Activated = now
+		m.log.Printf("generated a new %s keypair for %s (selector %s), put the record from %s into DNS to make signing and verification work",
+			m.newKeyAlgo, r.domain, r.keys[active].Selector, r.zonePath)
+	}
+
+	// Time to prepare the successor so it is published in DNS when it
+	// should be used.
+	if active != -1 && pending == -1 && now.Sub(r.keys[active].Activated) >= m.rotateInterval-m.rotatePublishDelay {
+		if err := m.generateRingKey(r, now); err != nil {
+			return err
+		}
+		changed = true
+		pending = len(r.keys) - 1
+		m.log.Msg("generated a new key for rotation", "domain", r.domain, "selector", r.keys[pending].Selector,
+			"zone_file", r.zonePath)
+	}
+
+	// Switch to the successor once it is published long enough.
+	if pending != -1 && r.keys[pending].Published && now.Sub(r.keys[pending].Created) >= m.rotatePublishDelay &&
+		(active == -1 || now.Sub(r.keys[active].Activated) >= m.rotateInterval) {
+		if active != -1 {
+			r.keys[active].Retired = now
+		}
+		r.keys[pending].Activated = now
+		changed = true
+		m.log.Msg("switched to the new key", "domain", r.domain, "selector", r.keys[pending].Selector)
+	}
+
+	// Remove retired keys once the grace period is over.
+	kept := r.keys[:0]
+	for _, k := range r.keys {
+		if k.Retired.IsZero() || now.Sub(k.Retired) < m.rotateGrace {
+			kept = append(kept, k)
+			continue
+		}
+		if !m.unpublishKey(r, k.Selector) {
+			kept = append(kept, k)
+			continue
+		}
+		m.removeRingKey(r, k.Selector)
+		changed = true
+	}
+	r.keys = kept
+
+	return nil
+}
+
+func (m *Modifier) generateRingKey(r *keyRing, now time.Time) error {
+	selector := r.nextSelector(now)
+	keyPath := r.keyPath(selector)
+	signer, err := m.generateAndWrite(keyPath, m.newKeyAlgo)
+	if err != nil {
+		return err
+	}
+	r.signers[selector] = signer
+	r.keys = append(r.keys, rotatedKey{
+		Selector: selector,
+		Created:  now,
+	})
+
+	record, err := dkimRecord(signer)
+	if err != nil {
+		return err
+	}
+	hooks.Notify(hooks.NotifyDKIMKeyPublished, map[string]string{
+		"module":   m.instName,
+		"domain":   r.domain,
+		"selector": selector,
+		"record":   record,
+	})
+
+	r.keys[len(r.keys)-1].Published = m.publishKey(r, selector)
+	return nil
+}
+
+func (m *Modifier) removeRingKey(r *keyRing, selector string) {
+	keyPath := r.keyPath(selector)
+	for _, path := range []string{keyPath, dnsRecordPath(keyPath)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			m.log.Error("failed to remove retired key", err, "domain", r.domain, "selector", selector)
+		}
+	}
+	delete(r.signers, selector)
+
+	hooks.Notify(hooks.NotifyDKIMKeyRemoved, map[string]string{
+		"module":   m.instName,
+		"domain":   r.domain,
+		"selector": selector,
+	})
+	m.log.Msg("removed retired key", "domain", r.domain, "selector", selector)
+}
+
+func (m *Modifier) ringRecord(r *keyRing, selector string) (libdns.Record, error) {
+	record, err := dkimRecord(r.signers[selector])
+	if err != nil {
+		return libdns.Record{}, err
+	}
+	return libdns.Record{
+		Type:  "TXT",
+		Name:  selector + "._domainkey",
+		Value: record,
+		TTL:   rotationRecordTTL,
+	}, nil
+}
+
+// publishKey adds the record for the key using dns_provider. It reports
+// whether the key is considered published: without dns_provider it is up
+// to the operator to update DNS.
+func (m *Modifier) publishKey(r *keyRing, selector string) bool {
+	if m.dnsProvider == nil {
+		return true
+	}
+
+	rec, err := m.ringRecord(r, selector)
+	if err != nil {
+		m.log.Error("failed to publish DKIM record", err, "domain", r.domain, "selector", selector)
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rotationDNSTimeout)
+	defer cancel()
+	if _, err := m.dnsProvider.AppendRecords(ctx, r.domain+".", []libdns.Record{rec}); err != nil {
+		m.log.Error("failed to publish DKIM record", err, "domain", r.domain, "selector", selector)
+		return false
+	}
+	m.log.Msg("published DKIM record", "domain", r.domain, "selector", selector)
+	return true
+}
+
+// unpublishKey removes the record for the key using dns_provider.
+func (m *Modifier) unpublishKey(r *keyRing, selector string) bool {
+	if m.dnsProvider == nil {
+		return true
+	}
+
+	rec, err := m.ringRecord(r, selector)
+	if err != nil {
+		m.log.Error("failed to remove DKIM record", err, "domain", r.domain, "selector", selector)
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rotationDNSTimeout)
+	defer cancel()
+	if _, err := m.dnsProvider.DeleteRecords(ctx, r.domain+".", []libdns.Record{rec}); err != nil {
+		m.log.Error("failed to remove DKIM record", err, "domain", r.domain, "selector", selector)
+		return false
+	}
+	return true
+}
+
+// updateSigner makes the active key of the ring used for signing.
+func (m *Modifier) updateSigner(r *keyRing) {
+	active := r.activeKey()
+	if active == -1 {
+		return
+	}
+	selector := r.keys[active].Selector
+
+	m.signersLck.Lock()
+	defer m.signersLck.Unlock()
+	m.signers[r.normDomain] = domainKey{
+		selector: selector,
+		signer:   r.signers[selector],
+	}
+}
+
+func (m *Modifier) rotationLoop() {
+	defer func() {
+		if err := recover(); err != nil {
+			stack := debug.Stack()
+			m.log.Printf("panic during DKIM key rotation: %v\n%s", err, stack)
+		}
+	}()
+
+	t := time.NewTicker(rotationCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			for _, r := range m.rings {
+				if err := m.rotate(r, time.Now()); err != nil {
+					m.log.Error("DKIM key rotation failed", err, "domain", r.domain)
+				}
+			}
+		case <-m.rotationStop:
+			m.rotationStop <- struct{}{}
+			return
+		}
+	}
+}
+
+func validateRotation(interval, publishDelay, grace time.Duration, keyPathTemplate string) error {
+	if interval < Day {
+		return errors.New("modify.dkim: rotate_interval should be at least 24h")
+	}
+	if publishDelay >= interval {
+		return errors.New("modify.dkim: rotate_publish_delay should be less than rotate_interval")
+	}
+	if grace <= 0 {
+		return errors.New("modify.dkim: rotate_grace should be positive")
+	}
+	if !strings.Contains(keyPathTemplate, "{selector}") {
+		return errors.New("modify.dkim: key_path should contain {selector} placeholder to use key rotation")
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/libdns/libdns"
+)
+
+type mockDNSProvider struct {
+	lck     sync.Mutex
+	fail    bool
+	records map[string]string
+}
+
+func (p *mockDNSProvider) AppendRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	if p.fail {
+		return nil, os.ErrDeadlineExceeded
+	}
+	for _, rec := range recs {
+		p.records[rec.Name+"."+zone] = rec.Value
+	}
+	return recs, nil
+}
+
+func (p *mockDNSProvider) DeleteRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	if p.fail {
+		return nil, os.ErrDeadlineExceeded
+	}
+	for _, rec := range recs {
+		delete(p.records, rec.Name+"."+zone)
+	}
+	return recs, nil
+}
+
+func newRotationModifier(t *testing.T) (*Modifier, *mockDNSProvider) {
+	t.Helper()
+	p := &mockDNSProvider{records: map[string]string{}}
+	return &Modifier{
+		instName:           "test",
+		signers:            map[string]domainKey{},
+		newKeyAlgo:         "ed25519",
+		rotateInterval:     30 * Day,
+		rotatePublishDelay: 2 * Day,
+		rotateGrace:        7 * Day,
+		dnsProvider:        p,
+		log:                testutils.Logger(t, "modify.dkim"),
+	}, p
+}
+
+func currentSelector(m *Modifier, domain string) string {
+	m.signersLck.RLock()
+	defer m.signersLck.RUnlock()
+	return m.signers[domain].selector
+}
+
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+	m, p := newRotationModifier(t)
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := newKeyRing("example.org", "example.org", "default", filepath.Join(dir, "{domain}_{selector}.key"))
+	if err := m.loadRing(r); err != nil {
+		t.Fatal(err)
+	}
+
+	step := func(now time.Time, expectActive string, expectRecords ...string) {
+		t.Helper()
+		if err := m.rotate(r, now); err != nil {
+			t.Fatal(err)
+		}
+		if sel := currentSelector(m, "example.org"); sel != expectActive {
+			t.Errorf("%v: wrong active selector: %s", now, sel)
+		}
+		if len(p.records) != len(expectRecords) {
+			t.Errorf("%v: wrong records: %v", now, p.records)
+		}
+		for _, sel := range expectRecords {
+			if _, ok := p.records[sel+"._domainkey.example.org."]; !ok {
+				t.Errorf("%v: missing record for %s", now, sel)
+			}
+		}
+	}
+
+	step(start, "default-20260101", "default-20260101")
+	step(start.Add(27*Day), "default-20260101", "default-20260101")
+	// Successor is published in advance.
+	step(start.Add(28*Day), "default-20260101", "default-20260101", "default-20260129")
+	step(start.Add(30*Day), "default-20260129", "default-20260101", "default-20260129")
+	// Old key is kept during the grace period.
+	step(start.Add(36*Day), "default-20260129", "default-20260101", "default-20260129")
+	step(start.Add(37*Day), "default-20260129", "default-20260129")
+
+	if _, err := os.Stat(filepath.Join(dir, "example.org_default-20260101.key")); !os.IsNotExist(err) {
+		t.Error("Retired key file is not removed:", err)
+	}
+
+	zone, err := os.ReadFile(filepath.Join(dir, "example.org_default.zone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(zone), "default-20260129._domainkey.example.org. 3600 IN TXT \"v=DKIM1; k=ed25519; p=") {
+		t.Error("Wrong zone file contents:", string(zone))
+	}
+	if strings.Contains(string(zone), "default-20260101") {
+		t.Error("Zone file contains the removed key:", string(zone))
+	}
+
+	// State should be restored on restart.
+	m2, _ := newRotationModifier(t)
+	r2 := newKeyRing("example.org", "example.org", "default", filepath.Join(dir, "{domain}_{selector}.key"))
+	if err := m2.loadRing(r2); err != nil {
+		t.Fatal(err)
+	}
+	if err := m2.rotate(r2, start.Add(38*Day)); err != nil {
+		t.Fatal(err)
+	}
+	if sel := currentSelector(m2, "example.org"); sel != "default-20260129" {
+		t.Error("Wrong active selector after restart:", sel)
+	}
+}
+
+func TestRotate_PublishFailure(t *testing.T) {
+	dir := t.TempDir()
+	m, p := newRotationModifier(t)
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := newKeyRing("example.org", "example.org", "default", filepath.Join(dir, "{domain}_{selector}.key"))
+	if err := m.rotate(r, start); err != nil {
+		t.Fatal(err)
+	}
+
+	// Successor is generated, but not published.
+	p.fail = true
+	if err := m.rotate(r, start.Add(28*Day)); err != nil {
+		t.Fatal(err)
+	}
+	// ... and so it should not be used.
+	if err := m.rotate(r, start.Add(30*Day)); err != nil {
+		t.Fatal(err)
+	}
+	if sel := currentSelector(m, "example.org"); sel != "default-20260101" {
+		t.Error("Switched to unpublished key:", sel)
+	}
+
+	p.fail = false
+	if err := m.rotate(r, start.Add(30*Day+time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.records["default-20260129._domainkey.example.org."]; !ok {
+		t.Error("Publishing is not retried")
+	}
+	if sel := currentSelector(m, "example.org"); sel != "default-20260129" {
+		t.Error("Wrong active selector:", sel)
+	}
+}
+
+func TestRotate_AdoptExisting(t *testing.T) {
+	dir := t.TempDir()
+	m, _ := newRotationModifier(t)
+
+	keyPath := filepath.Join(dir, "example.org_default.key")
+	if _, _, err := m.loadOrGenerateKey(keyPath, "ed25519"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newKeyRing("example.org", "example.org", "default", filepath.Join(dir, "{domain}_{selector}.key"))
+	if err := m.loadRing(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.rotate(r, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if sel := currentSelector(m, "example.org"); sel != "default" {
+		t.Error("Existing key is not used:", sel)
+	}
+}
+
+func TestZoneTXTValue(t *testing.T) {
+	if v := zoneTXTValue("short"); v != `"short"` {
+		t.Error("Wrong value:", v)
+	}
+	v := zoneTXTValue(strings.Repeat("a", 300))
+	if v != `"`+strings.Repeat("a", 255)+`" "`+strings.Repeat("a", 45)+`"` {
+		t.Error("Wrong value:", v)
+	}
+}
@@ -0,0 +1,427 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// appendFooter is the module that appends a configured text to the message
+// body, e.g. a legal disclaimer required for all outgoing messages.
+type appendFooter struct {
+	instName string
+	log      log.Logger
+
+	text    string
+	html    string
+	senders module.Table
+}
+
+func NewAppendFooter(_, instName string, _, _ []string) (module.Module, error) {
+	return &appendFooter{
+		instName: instName,
+		log:      log.Logger{Name: "modify.append_footer"},
+	}, nil
+}
+
+func (f *appendFooter) Init(cfg *config.Map) error {
+	var text, textFile, htmlText, htmlFile string
+	cfg.String("text", false, false, "", &text)
+	cfg.String("text_file", false, false, "", &textFile)
+	cfg.String("html", false, false, "", &htmlText)
+	cfg.String("html_file", false, false, "", &htmlFile)
+	modconfig.Table(cfg, "senders", false, false, nil, &f.senders)
+	cfg.Bool("debug", true, false, &f.log.Debug)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var err error
+	f.text, err = footerText(text, textFile)
+	if err != nil {
+		return fmt.Errorf("modify.append_footer: %w", err)
+	}
+	f.html, err = footerText(htmlText, htmlFile)
+	if err != nil {
+		return fmt.Errorf("modify.append_footer: %w", err)
+	}
+
+	if f.text == "" && f.html == "" {
+		return fmt.Errorf("modify.append_footer: text or html should be specified")
+	}
+	if f.html == "" {
+		f.html = "<p>" + strings.ReplaceAll(html.EscapeString(strings.TrimSpace(f.text)), "\n", "<br>\n") + "</p>"
+	}
+
+	return nil
+}
+
+// footerText returns the inline text or contents of the file with line
+// endings converted to CRLF.
+func footerText(text, path string) (string, error) {
+	if text != "" && path != "" {
+		return "", fmt.Errorf("inline text and file cannot be used together")
+	}
+	if path != "" {
+		blob, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		text = string(blob)
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.TrimRight(text, "\n")
+	if text == "" {
+		return "", nil
+	}
+	return strings.ReplaceAll(text, "\n", "\r\n") + "\r\n", nil
+}
+
+func (f *appendFooter) Name() string {
+	return "modify.append_footer"
+}
+
+func (f *appendFooter) InstanceName() string {
+	return f.instName
+}
+
+func (f *appendFooter) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	enabled, err := f.senderSelected(ctx, msgMeta.OriginalFrom)
+	if err != nil {
+		return nil, err
+	}
+	return &appendFooterState{f: f, msgMeta: msgMeta, enabled: enabled}, nil
+}
+
+// senderSelected reports whether the footer should be added to messages of
+// the sender.
+func (f *appendFooter) senderSelected(ctx context.Context, sender string) (bool, error) {
+	if sender == "" {
+		return false, nil
+	}
+	if f.senders == nil {
+		return true, nil
+	}
+	return lookupAddrOrDomain(ctx, f.senders, sender)
+}
+
+// lookupAddrOrDomain reports whether the address is listed in the table.
+// The address is looked up first, then its domain.
+func lookupAddrOrDomain(ctx context.Context, tbl module.Table, addr string) (bool, error) {
+	normAddr, err := address.ForLookup(addr)
+	if err != nil {
+		return false, nil
+	}
+	_, ok, err := tbl.Lookup(ctx, normAddr)
+	if err != nil || ok {
+		return ok, err
+	}
+
+	_, domain, err := address.Split(normAddr)
+	if err != nil || domain == "" {
+		return false, nil
+	}
+	_, ok, err = tbl.Lookup(ctx, domain)
+	return ok, err
+}
+
+type appendFooterState struct {
+	f       *appendFooter
+	msgMeta *module.MsgMetadata
+	enabled bool
+}
+
+func (s *appendFooterState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s *appendFooterState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (s *appendFooterState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (s *appendFooterState) ModifyBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	if !s.enabled {
+		return body, nil
+	}
+	if h.Has("DKIM-Signature") {
+		s.f.log.Msg("message is already signed, not adding the footer", "msg_id", s.msgMeta.ID)
+		return body, nil
+	}
+
+	r, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	blob, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var addText func(string) string
+	if s.f.text != "" {
+		addText = func(text string) string { return appendText(text, s.f.text) }
+	}
+	addHTML := func(text string) string { return insertHTML(text, s.f.html) }
+
+	newBlob, changed, err := editEntity(h, blob, addText, addHTML)
+	if err != nil {
+		s.f.log.Error("failed to add the footer", err, "msg_id", s.msgMeta.ID)
+		return body, nil
+	}
+	if !changed {
+		s.f.log.DebugMsg("no suitable body part for the footer", "msg_id", s.msgMeta.ID)
+		return body, nil
+	}
+
+	return buffer.MemoryBuffer{Slice: newBlob}, nil
+}
+
+func (s *appendFooterState) Close() error {
+	return nil
+}
+
+// editEntity modifies the text of the MIME entity body using editText and
+// editHTML for text/plain and text/html parts respectively. nil function
+// means the corresponding parts are not modified. The header is updated if
+// the body encoding is changed.
+//
+// Text parts are modified directly. For multipart/alternative, all
+// alternatives are modified, for other multipart types only the first
+// part (message text) is modified. Signed and encrypted messages and
+// attachments are not modified.
+func editEntity(h *textproto.Header, body []byte, editText, editHTML func(string) string) ([]byte, bool, error) {
+	if disp, _, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil && disp == "attachment" {
+		return body, false, nil
+	}
+
+	mediaType, params := "text/plain", map[string]string{}
+	if ct := h.Get("Content-Type"); ct != "" {
+		var err error
+		mediaType, params, err = mime.ParseMediaType(ct)
+		if err != nil {
+			return body, false, nil
+		}
+	}
+
+	switch {
+	case mediaType == "text/plain" && editText != nil:
+		return editTextPart(h, mediaType, params, body, editText)
+	case mediaType == "text/html" && editHTML != nil:
+		return editTextPart(h, mediaType, params, body, editHTML)
+	case mediaType == "multipart/signed" || mediaType == "multipart/encrypted":
+		return body, false, nil
+	case strings.HasPrefix(mediaType, "multipart/"):
+		return editMultipart(params["boundary"], body, mediaType == "multipart/alternative", editText, editHTML)
+	default:
+		return body, false, nil
+	}
+}
+
+func editMultipart(boundary string, body []byte, allParts bool, editText, editHTML func(string) string) ([]byte, bool, error) {
+	if boundary == "" {
+		return body, false, nil
+	}
+
+	type part struct {
+		header textproto.Header
+		body   []byte
+	}
+	var (
+		parts   []part
+		changed bool
+	)
+
+	mr := textproto.NewMultipartReader(bytes.NewReader(body), boundary)
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return body, false, err
+		}
+		partBody, err := io.ReadAll(p)
+		if err != nil {
+			return body, false, err
+		}
+
+		if allParts || len(parts) == 0 {
+			var partChanged bool
+			partBody, partChanged, err = editEntity(&p.Header, partBody, editText, editHTML)
+			if err != nil {
+				return body, false, err
+			}
+			changed = changed || partChanged
+		}
+
+		parts = append(parts, part{header: p.Header, body: partBody})
+	}
+	if !changed {
+		return body, false, nil
+	}
+
+	var out bytes.Buffer
+	mw := textproto.NewMultipartWriter(&out)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return body, false, err
+	}
+	for _, p := range parts {
+		w, err := mw.CreatePart(p.header)
+		if err != nil {
+			return body, false, err
+		}
+		if _, err := w.Write(p.body); err != nil {
+			return body, false, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return body, false, err
+	}
+	return out.Bytes(), true, nil
+}
+
+// editTextPart decodes the text part, modifies it using edit and encodes
+// it again using the same Content-Transfer-Encoding. The text is converted
+// to UTF-8 if necessary.
+func editTextPart(h *textproto.Header, mediaType string, params map[string]string, body []byte, edit func(string) string) ([]byte, bool, error) {
+	cte := strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding")))
+
+	var decoded []byte
+	var err error
+	switch cte {
+	case "quoted-printable":
+		decoded, err = io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	case "base64":
+		decoded, err = io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(body)))
+	case "", "7bit", "8bit", "binary":
+		decoded = body
+	default:
+		return body, false, nil
+	}
+	if err != nil {
+		return body, false, err
+	}
+
+	switch cs := strings.ToLower(params["charset"]); cs {
+	case "", "us-ascii", "utf-8":
+	default:
+		r, err := charset.Reader(cs, bytes.NewReader(decoded))
+		if err != nil {
+			return body, false, err
+		}
+		decoded, err = io.ReadAll(r)
+		if err != nil {
+			return body, false, err
+		}
+	}
+	params["charset"] = "utf-8"
+
+	text := edit(string(decoded))
+
+	if (cte == "" || cte == "7bit") && !isASCII(text) {
+		cte = "quoted-printable"
+		h.Set("Content-Transfer-Encoding", cte)
+	}
+
+	var out bytes.Buffer
+	switch cte {
+	case "quoted-printable":
+		w := quotedprintable.NewWriter(&out)
+		if _, err := w.Write([]byte(text)); err != nil {
+			return body, false, err
+		}
+		if err := w.Close(); err != nil {
+			return body, false, err
+		}
+	case "base64":
+		enc := base64.StdEncoding.EncodeToString([]byte(text))
+		for len(enc) > 76 {
+			out.WriteString(enc[:76])
+			out.WriteString("\r\n")
+			enc = enc[76:]
+		}
+		out.WriteString(enc)
+		out.WriteString("\r\n")
+	default:
+		out.WriteString(text)
+	}
+
+	h.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	return out.Bytes(), true, nil
+}
+
+func appendText(text, footer string) string {
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		text += "\r\n"
+	}
+	return text + "\r\n" + footer
+}
+
+// insertHTML inserts the footer before the closing body tag or at the end
+// of the document if there is none.
+func insertHTML(text, footer string) string {
+	lower := strings.ToLower(text)
+	idx := strings.LastIndex(lower, "</body>")
+	if idx == -1 {
+		idx = strings.LastIndex(lower, "</html>")
+	}
+	if idx == -1 {
+		if text != "" && !strings.HasSuffix(text, "\n") {
+			text += "\r\n"
+		}
+		return text + footer
+	}
+	return text[:idx] + footer + text[idx:]
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+func init() {
+	module.Register("modify.append_footer", NewAppendFooter)
+}
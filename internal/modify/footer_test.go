@@ -0,0 +1,231 @@
+package modify
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testFooter(t *testing.T, text, html string) *appendFooter {
+	t.Helper()
+
+	mod, err := NewAppendFooter("modify.append_footer", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := mod.(*appendFooter)
+	cfg := config.Node{}
+	if text != "" {
+		cfg.Children = append(cfg.Children, config.Node{Name: "text", Args: []string{text}})
+	}
+	if html != "" {
+		cfg.Children = append(cfg.Children, config.Node{Name: "html", Args: []string{html}})
+	}
+	if err := f.Init(config.NewMap(nil, cfg)); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func applyFooter(t *testing.T, f *appendFooter, sender, msg string) (textproto.Header, string) {
+	t.Helper()
+
+	br := bufio.NewReader(strings.NewReader(strings.ReplaceAll(msg, "\n", "\r\n")))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := f.ModStateForMsg(context.Background(), &module.MsgMetadata{
+		ID:           "testing",
+		OriginalFrom: sender,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	newBody, err := module.ModifyBody(context.Background(), state, &hdr, buffer.MemoryBuffer{Slice: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newBody.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	newBlob, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hdr, strings.ReplaceAll(string(newBlob), "\r\n", "\n")
+}
+
+func TestAppendFooter_Plain(t *testing.T) {
+	f := testFooter(t, "Confidential.", "")
+
+	hdr, body := applyFooter(t, f, "test@example.org", `Subject: Hello
+
+Hi!`)
+	if body != "Hi!\n\nConfidential.\n" {
+		t.Errorf("wrong body: %q", body)
+	}
+	if ct := hdr.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("wrong Content-Type: %q", ct)
+	}
+	if hdr.Has("Content-Transfer-Encoding") {
+		t.Error("Content-Transfer-Encoding is set for ASCII text")
+	}
+
+	// Null sender (bounces).
+	_, body = applyFooter(t, f, "", `Subject: Hello
+
+Hi!`)
+	if body != "Hi!" {
+		t.Errorf("footer is added for null sender: %q", body)
+	}
+}
+
+func TestAppendFooter_Encodings(t *testing.T) {
+	f := testFooter(t, "Vertraulich – nur für den Empfänger.", "")
+
+	// Non-ASCII footer in 7bit part.
+	hdr, body := applyFooter(t, f, "test@example.org", `Content-Type: text/plain; charset=us-ascii
+
+Hi!
+`)
+	if cte := hdr.Get("Content-Transfer-Encoding"); cte != "quoted-printable" {
+		t.Errorf("wrong Content-Transfer-Encoding: %q", cte)
+	}
+	if body != "Hi!\n\nVertraulich =E2=80=93 nur f=C3=BCr den Empf=C3=A4nger.\n" {
+		t.Errorf("wrong body: %q", body)
+	}
+
+	hdr, body = applyFooter(t, f, "test@example.org", `Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: base64
+
+SGkh
+`)
+	if cte := hdr.Get("Content-Transfer-Encoding"); cte != "base64" {
+		t.Errorf("wrong Content-Transfer-Encoding: %q", cte)
+	}
+	if body != "SGkhDQoNClZlcnRyYXVsaWNoIOKAkyBudXIgZsO8ciBkZW4gRW1wZsOkbmdlci4NCg==\n" {
+		t.Errorf("wrong body: %q", body)
+	}
+
+	// Text in other charsets is converted to UTF-8.
+	hdr, body = applyFooter(t, f, "test@example.org", `Content-Type: text/plain; charset=iso-8859-1
+Content-Transfer-Encoding: quoted-printable
+
+Gr=FC=DFe
+`)
+	if ct := hdr.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("wrong Content-Type: %q", ct)
+	}
+	if !strings.HasPrefix(body, "Gr=C3=BC=C3=9Fe\n\nVertraulich") {
+		t.Errorf("wrong body: %q", body)
+	}
+}
+
+func TestAppendFooter_Multipart(t *testing.T) {
+	f := testFooter(t, "Confidential.", "<p>Confidential.</p>")
+
+	_, body := applyFooter(t, f, "test@example.org", `Content-Type: multipart/mixed; boundary=outer
+
+--outer
+Content-Type: multipart/alternative; boundary=inner
+
+--inner
+Content-Type: text/plain
+
+Hi!
+--inner
+Content-Type: text/html
+
+<html><body>Hi!</body></html>
+--inner--
+--outer
+Content-Type: text/plain
+Content-Disposition: attachment; filename=notes.txt
+
+Notes.
+--outer--
+`)
+	want := `--outer
+Content-Type: multipart/alternative; boundary=inner
+
+--inner
+Content-Type: text/plain; charset=utf-8
+
+Hi!
+
+Confidential.
+
+--inner
+Content-Type: text/html; charset=utf-8
+
+<html><body>Hi!<p>Confidential.</p>
+</body></html>
+--inner--
+
+--outer
+Content-Type: text/plain
+Content-Disposition: attachment; filename=notes.txt
+
+Notes.
+--outer--
+`
+	if body != want {
+		t.Errorf("wrong body:\n%s\nwant:\n%s", body, want)
+	}
+
+	signed := `Content-Type: multipart/signed; boundary=b; protocol="application/pgp-signature"
+
+--b
+Content-Type: text/plain
+
+Hi!
+--b
+Content-Type: application/pgp-signature
+
+SIGNATURE
+--b--
+`
+	_, body = applyFooter(t, f, "test@example.org", signed)
+	if want := signed[strings.Index(signed, "\n\n")+2:]; body != want {
+		t.Errorf("signed message is modified: %q", body)
+	}
+}
+
+func TestAppendFooter_Senders(t *testing.T) {
+	f := testFooter(t, "Confidential.", "")
+	f.senders = testutils.Table{M: map[string]string{
+		"example.org":     "",
+		"ceo@example.com": "",
+	}}
+
+	for sender, added := range map[string]bool{
+		"test@example.org": true,
+		"TEST@EXAMPLE.ORG": true,
+		"ceo@example.com":  true,
+		"test@example.com": false,
+		"test@example.net": false,
+	} {
+		_, body := applyFooter(t, f, sender, "Subject: Hello\n\nHi!")
+		if strings.Contains(body, "Confidential.") != added {
+			t.Errorf("sender %s: unexpected body: %q", sender, body)
+		}
+	}
+}
@@ -20,6 +20,7 @@ package modify
 
 import (
 	"context"
+	"errors"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
@@ -47,6 +48,10 @@ func (g *Group) Init(cfg *config.Map) error {
 	for _, node := range cfg.Block.Children {
 		mod, err := modconfig.MsgModifier(cfg.Globals, append([]string{node.Name}, node.Args...), node)
 		if err != nil {
+			// Optional module that failed to initialize, already logged.
+			if errors.Is(err, module.ErrDisabled) {
+				continue
+			}
 			return err
 		}
 
@@ -110,12 +115,19 @@ func (gs groupState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string,
 }
 
 func (gs groupState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	_, err := gs.ModifyBody(ctx, h, body)
+	return err
+}
+
+func (gs groupState) ModifyBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	var err error
 	for _, state := range gs.states {
-		if err := state.RewriteBody(ctx, h, body); err != nil {
-			return err
+		body, err = module.ModifyBody(ctx, state, h, body)
+		if err != nil {
+			return nil, err
 		}
 	}
-	return nil
+	return body, nil
 }
 
 func (gs groupState) Close() error {
@@ -28,6 +28,7 @@ import (
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
 )
 
@@ -44,6 +45,9 @@ type replaceAddr struct {
 	replaceSender bool
 	replaceRcpt   bool
 	table         module.MultiTable
+	// Max. amount of lookups done for a recipient, replacements are looked up
+	// again if it is bigger than 1.
+	maxDepth int
 }
 
 func NewReplaceAddr(modName, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -59,7 +63,28 @@ func NewReplaceAddr(modName, instName string, _, inlineArgs []string) (module.Mo
 }
 
 func (r *replaceAddr) Init(cfg *config.Map) error {
-	return modconfig.ModuleFromNode("table", r.inlineArgs, cfg.Block, cfg.Globals, &r.table)
+	r.maxDepth = 1
+	if len(r.inlineArgs) != 0 {
+		return modconfig.ModuleFromNode("table", r.inlineArgs, cfg.Block, cfg.Globals, &r.table)
+	}
+
+	cfg.Custom("table", false, true, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var tbl module.MultiTable
+		if err := modconfig.ModuleFromNode("table", node.Args, node, m.Globals, &tbl); err != nil {
+			return nil, err
+		}
+		return tbl, nil
+	}, &r.table)
+	if r.replaceRcpt {
+		cfg.Int("max_depth", false, false, 1, &r.maxDepth)
+	}
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if r.maxDepth < 1 {
+		return fmt.Errorf("%s: max_depth should be at least 1", r.modName)
+	}
+	return nil
 }
 
 func (r replaceAddr) Name() string {
@@ -87,11 +112,78 @@ func (r replaceAddr) RewriteSender(ctx context.Context, mailFrom string) (string
 
 func (r replaceAddr) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
 	if r.replaceRcpt {
-		return r.rewrite(ctx, rcptTo)
+		if r.maxDepth == 1 {
+			return r.rewrite(ctx, rcptTo)
+		}
+		return r.expand(ctx, rcptTo, nil)
 	}
 	return []string{rcptTo}, nil
 }
 
+// expand replaces the recipient address and then repeats the lookup for the
+// replacements. path contains addresses expanded to get to rcptTo.
+//
+// An address that is replaced by itself (e.g. to keep a copy of messages for
+// a forwarded mailbox) is not expanded again. Other loops and expansion
+// deeper than maxDepth are rejected.
+func (r replaceAddr) expand(ctx context.Context, rcptTo string, path []string) ([]string, error) {
+	replacements, err := r.rewrite(ctx, rcptTo)
+	if err != nil {
+		return nil, err
+	}
+	if len(replacements) == 1 && replacements[0] == rcptTo {
+		return replacements, nil
+	}
+	if len(path) >= r.maxDepth {
+		return nil, &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 4, 6},
+			Message:      "Alias expansion is too deep",
+			Misc: map[string]interface{}{
+				"rcpt":      rcptTo,
+				"max_depth": r.maxDepth,
+			},
+		}
+	}
+
+	normRcpt, err := address.ForLookup(rcptTo)
+	if err != nil {
+		return nil, err
+	}
+	path = append(path, normRcpt)
+
+	results := make([]string, 0, len(replacements))
+	for _, replacement := range replacements {
+		normRepl, err := address.ForLookup(replacement)
+		if err != nil {
+			return nil, err
+		}
+		if normRepl == normRcpt {
+			results = append(results, replacement)
+			continue
+		}
+		for _, prev := range path {
+			if prev == normRepl {
+				return nil, &exterrors.SMTPError{
+					Code:         554,
+					EnhancedCode: exterrors.EnhancedCode{5, 4, 6},
+					Message:      "Alias expansion loop detected",
+					Misc: map[string]interface{}{
+						"rcpt": replacement,
+					},
+				}
+			}
+		}
+
+		expanded, err := r.expand(ctx, replacement, path[:len(path):len(path)])
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, expanded...)
+	}
+	return results, nil
+}
+
 func (r replaceAddr) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
 	return nil
 }
@@ -112,3 +112,56 @@ func TestReplaceAddr_RewriteSender(t *testing.T) {
 func TestReplaceAddr_RewriteRcpt(t *testing.T) {
 	testReplaceAddr(t, "modify.replace_rcpt")
 }
+
+func TestReplaceAddr_MaxDepth(t *testing.T) {
+	aliases := map[string][]string{
+		"list@example.org":  {"team@example.org", "boss@example.org"},
+		"team@example.org":  {"a@example.org", "b@example.org"},
+		"a@example.org":     {"a@example.org", "a@example.net"},
+		"deep1@example.org": {"deep2@example.org"},
+		"deep2@example.org": {"deep3@example.org"},
+		"deep3@example.org": {"deep4@example.org"},
+		"loop1@example.org": {"loop2@example.org"},
+		"loop2@example.org": {"loop1@example.org"},
+	}
+
+	test := func(rcpt string, maxDepth string, expected []string, fail bool) {
+		t.Helper()
+
+		mod, err := NewReplaceAddr("modify.replace_rcpt", "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := mod.(*replaceAddr)
+		if err := m.Init(config.NewMap(nil, config.Node{Children: []config.Node{
+			{Name: "table", Args: []string{"dummy"}},
+			{Name: "max_depth", Args: []string{maxDepth}},
+		}})); err != nil {
+			t.Fatal(err)
+		}
+		m.table = testutils.MultiTable{M: aliases}
+
+		actual, err := m.RewriteRcpt(context.Background(), rcpt)
+		if fail {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", rcpt, actual)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", rcpt, err)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: want %s, got %s", rcpt, expected, actual)
+		}
+	}
+
+	// Not expanded recursively by default.
+	test("list@example.org", "1", []string{"team@example.org", "boss@example.org"}, false)
+	test("list@example.org", "3", []string{"a@example.org", "a@example.net", "b@example.org", "boss@example.org"}, false)
+	test("list@example.org", "2", nil, true)
+	test("deep1@example.org", "3", []string{"deep4@example.org"}, false)
+	test("deep1@example.org", "2", nil, true)
+	test("loop1@example.org", "10", nil, true)
+	test("other@example.org", "2", []string{"other@example.org"}, false)
+}
@@ -0,0 +1,297 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// tagExternal is the module that marks messages coming from outside of the
+// configured domains by prepending a tag to the Subject, adding a header
+// field and a warning banner to the message text.
+type tagExternal struct {
+	instName string
+	log      log.Logger
+
+	domains     map[string]struct{}
+	subjectTag  string
+	headerName  string
+	headerValue string
+	banner      string
+	bannerHTML  string
+	exempt      module.Table
+}
+
+func NewTagExternal(_, instName string, _, _ []string) (module.Module, error) {
+	return &tagExternal{
+		instName: instName,
+		log:      log.Logger{Name: "modify.tag_external"},
+	}, nil
+}
+
+func (t *tagExternal) Init(cfg *config.Map) error {
+	var (
+		domains, header                          []string
+		banner, bannerFile, bannerHTML, htmlFile string
+	)
+	cfg.StringList("domains", false, true, nil, &domains)
+	cfg.String("subject_tag", false, false, "[EXTERNAL]", &t.subjectTag)
+	cfg.StringList("header", false, false, nil, &header)
+	cfg.String("banner", false, false, "", &banner)
+	cfg.String("banner_file", false, false, "", &bannerFile)
+	cfg.String("banner_html", false, false, "", &bannerHTML)
+	cfg.String("banner_html_file", false, false, "", &htmlFile)
+	modconfig.Table(cfg, "exempt", false, false, nil, &t.exempt)
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	t.domains = make(map[string]struct{}, len(domains))
+	for _, d := range domains {
+		d, err := dns.ForLookup(d)
+		if err != nil {
+			return fmt.Errorf("modify.tag_external: invalid domain: %w", err)
+		}
+		t.domains[d] = struct{}{}
+	}
+
+	switch len(header) {
+	case 0:
+	case 2:
+		t.headerName = header[0]
+		t.headerValue = header[1]
+	default:
+		return fmt.Errorf("modify.tag_external: header: field name and value expected")
+	}
+
+	var err error
+	t.banner, err = footerText(banner, bannerFile)
+	if err != nil {
+		return fmt.Errorf("modify.tag_external: %w", err)
+	}
+	t.bannerHTML, err = footerText(bannerHTML, htmlFile)
+	if err != nil {
+		return fmt.Errorf("modify.tag_external: %w", err)
+	}
+	if t.bannerHTML == "" && t.banner != "" {
+		t.bannerHTML = "<p>" + strings.ReplaceAll(html.EscapeString(strings.TrimSpace(t.banner)), "\n", "<br>\n") + "</p>"
+	}
+
+	return nil
+}
+
+func (t *tagExternal) Name() string {
+	return "modify.tag_external"
+}
+
+func (t *tagExternal) InstanceName() string {
+	return t.instName
+}
+
+func (t *tagExternal) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &tagExternalState{t: t, msgMeta: msgMeta}, nil
+}
+
+// isLocal reports whether the domain of the address is one of the
+// configured domains.
+func (t *tagExternal) isLocal(addr string) bool {
+	normAddr, err := address.ForLookup(addr)
+	if err != nil {
+		return false
+	}
+	_, domain, err := address.Split(normAddr)
+	if err != nil {
+		return false
+	}
+	_, ok := t.domains[domain]
+	return ok
+}
+
+// isExternal reports whether the message should be tagged.
+//
+// Messages generated locally and messages submitted by authenticated users
+// are never tagged. Otherwise, the message is considered external if the
+// envelope sender or the From header field address is not in one of the
+// configured domains.
+func (t *tagExternal) isExternal(ctx context.Context, msgMeta *module.MsgMetadata, h *textproto.Header) (bool, error) {
+	if msgMeta.Conn == nil || msgMeta.Conn.AuthUser != "" {
+		return false, nil
+	}
+
+	sender := msgMeta.OriginalFrom
+	if t.exempt != nil && sender != "" {
+		exempt, err := lookupAddrOrDomain(ctx, t.exempt, sender)
+		if err != nil {
+			return false, err
+		}
+		if exempt {
+			return false, nil
+		}
+	}
+
+	if sender != "" && !t.isLocal(sender) {
+		return true, nil
+	}
+
+	fromList, err := mail.ParseAddressList(h.Get("From"))
+	if err != nil || len(fromList) == 0 {
+		// Null sender and no valid From - can't be sure the message is
+		// ours.
+		return true, nil
+	}
+	for _, from := range fromList {
+		if !t.isLocal(from.Address) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type tagExternalState struct {
+	t       *tagExternal
+	msgMeta *module.MsgMetadata
+}
+
+func (s *tagExternalState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s *tagExternalState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (s *tagExternalState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	external, err := s.t.isExternal(ctx, s.msgMeta, h)
+	if err != nil || !external {
+		return err
+	}
+	s.tagHeader(h)
+	return nil
+}
+
+func (s *tagExternalState) ModifyBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	external, err := s.t.isExternal(ctx, s.msgMeta, h)
+	if err != nil {
+		return nil, err
+	}
+	if !external {
+		return body, nil
+	}
+	s.t.log.DebugMsg("tagging external message", "msg_id", s.msgMeta.ID)
+
+	s.tagHeader(h)
+
+	if s.t.banner == "" && s.t.bannerHTML == "" {
+		return body, nil
+	}
+
+	r, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	blob, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var addText func(string) string
+	if s.t.banner != "" {
+		addText = func(text string) string { return s.t.banner + "\r\n" + text }
+	}
+	addHTML := func(text string) string { return prependHTML(text, s.t.bannerHTML) }
+
+	newBlob, changed, err := editEntity(h, blob, addText, addHTML)
+	if err != nil {
+		s.t.log.Error("failed to add the banner", err, "msg_id", s.msgMeta.ID)
+		return body, nil
+	}
+	if !changed {
+		s.t.log.DebugMsg("no suitable body part for the banner", "msg_id", s.msgMeta.ID)
+		return body, nil
+	}
+
+	return buffer.MemoryBuffer{Slice: newBlob}, nil
+}
+
+func (s *tagExternalState) tagHeader(h *textproto.Header) {
+	if s.t.headerName != "" {
+		h.Add(s.t.headerName, s.t.headerValue)
+	}
+	if s.t.subjectTag != "" {
+		h.Set("Subject", tagSubject(h.Get("Subject"), s.t.subjectTag))
+	}
+}
+
+func (s *tagExternalState) Close() error {
+	return nil
+}
+
+// tagSubject prepends the tag to the Subject header field value unless it
+// is already present (e.g. in a reply to the tagged message).
+func tagSubject(subject, tag string) string {
+	dec := mime.WordDecoder{CharsetReader: charset.Reader}
+	decoded, err := dec.DecodeHeader(subject)
+	if err != nil {
+		decoded = subject
+	}
+	if strings.Contains(strings.ToLower(decoded), strings.ToLower(tag)) {
+		return subject
+	}
+
+	tagged := strings.TrimSpace(tag + " " + strings.TrimSpace(decoded))
+	return mime.QEncoding.Encode("utf-8", tagged)
+}
+
+// prependHTML inserts the banner after the opening body tag or at the
+// start of the document if there is none.
+func prependHTML(text, banner string) string {
+	lower := strings.ToLower(text)
+	idx := strings.Index(lower, "<body")
+	if idx == -1 {
+		return banner + text
+	}
+	end := strings.IndexByte(lower[idx:], '>')
+	if end == -1 {
+		return banner + text
+	}
+	idx += end + 1
+	return text[:idx] + banner + text[idx:]
+}
+
+func init() {
+	module.Register("modify.tag_external", NewTagExternal)
+}
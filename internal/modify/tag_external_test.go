@@ -0,0 +1,184 @@
+package modify
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testTagExternal(t *testing.T, directives ...config.Node) *tagExternal {
+	t.Helper()
+
+	mod, err := NewTagExternal("modify.tag_external", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	te := mod.(*tagExternal)
+	cfg := config.Node{
+		Children: append([]config.Node{
+			{Name: "domains", Args: []string{"example.org", "example.com"}},
+		}, directives...),
+	}
+	if err := te.Init(config.NewMap(nil, cfg)); err != nil {
+		t.Fatal(err)
+	}
+	return te
+}
+
+func applyTagExternal(t *testing.T, te *tagExternal, conn *module.ConnState, sender, msg string) (textproto.Header, string) {
+	t.Helper()
+
+	br := bufio.NewReader(strings.NewReader(strings.ReplaceAll(msg, "\n", "\r\n")))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := te.ModStateForMsg(context.Background(), &module.MsgMetadata{
+		ID:           "testing",
+		OriginalFrom: sender,
+		Conn:         conn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	newBody, err := module.ModifyBody(context.Background(), state, &hdr, buffer.MemoryBuffer{Slice: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newBody.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	newBlob, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hdr, strings.ReplaceAll(string(newBlob), "\r\n", "\n")
+}
+
+const tagExternalMsg = `From: <sender@%s>
+Subject: Hello
+
+Text
+`
+
+func TestTagExternal(t *testing.T) {
+	te := testTagExternal(t,
+		config.Node{Name: "header", Args: []string{"X-External", "yes"}},
+		config.Node{Name: "banner", Args: []string{"Caution: external sender."}},
+	)
+	smtpConn := &module.ConnState{Proto: "ESMTP"}
+
+	test := func(conn *module.ConnState, sender, fromDomain string, external bool) {
+		t.Helper()
+
+		msg := strings.ReplaceAll(tagExternalMsg, "%s", fromDomain)
+		hdr, body := applyTagExternal(t, te, conn, sender, msg)
+
+		if external {
+			if subj := hdr.Get("Subject"); subj != "[EXTERNAL] Hello" {
+				t.Errorf("wrong Subject: %q", subj)
+			}
+			if hdr.Get("X-External") != "yes" {
+				t.Errorf("missing X-External")
+			}
+			if body != "Caution: external sender.\n\nText\n" {
+				t.Errorf("wrong body: %q", body)
+			}
+		} else {
+			if subj := hdr.Get("Subject"); subj != "Hello" {
+				t.Errorf("wrong Subject: %q", subj)
+			}
+			if hdr.Has("X-External") {
+				t.Errorf("unexpected X-External")
+			}
+			if body != "Text\n" {
+				t.Errorf("wrong body: %q", body)
+			}
+		}
+	}
+
+	test(smtpConn, "sender@example.net", "example.net", true)
+	test(smtpConn, "sender@EXAMPLE.org", "example.com", false)
+	// Forged From.
+	test(smtpConn, "sender@example.net", "example.org", true)
+	test(smtpConn, "sender@example.org", "example.net", true)
+	// Bounce from a remote server.
+	test(smtpConn, "", "example.net", true)
+	test(smtpConn, "", "example.org", false)
+	// Locally generated and submitted messages.
+	test(nil, "sender@example.net", "example.net", false)
+	test(&module.ConnState{Proto: "ESMTPSA", AuthUser: "user"}, "sender@example.net", "example.net", false)
+
+	te.exempt = testutils.Table{M: map[string]string{
+		"partner.example":  "",
+		"user@example.net": "",
+	}}
+	test(smtpConn, "sender@partner.example", "partner.example", false)
+	test(smtpConn, "user@example.net", "example.net", false)
+	test(smtpConn, "sender@example.net", "example.net", true)
+}
+
+func TestTagExternal_Subject(t *testing.T) {
+	for _, c := range []struct {
+		subject, tagged string
+	}{
+		{"Hello", "[EXTERNAL] Hello"},
+		{"", "[EXTERNAL]"},
+		{"Re: [EXTERNAL] Hello", "Re: [EXTERNAL] Hello"},
+		{"Re: [external] Hello", "Re: [external] Hello"},
+		{"=?utf-8?q?Pr=C3=BCfung?=", "=?utf-8?q?[EXTERNAL]_Pr=C3=BCfung?="},
+		{"=?iso-8859-1?q?Pr=FCfung?=", "=?utf-8?q?[EXTERNAL]_Pr=C3=BCfung?="},
+	} {
+		if tagged := tagSubject(c.subject, "[EXTERNAL]"); tagged != c.tagged {
+			t.Errorf("tagSubject(%q): want %q, got %q", c.subject, c.tagged, tagged)
+		}
+	}
+}
+
+func TestTagExternal_HTMLBanner(t *testing.T) {
+	te := testTagExternal(t,
+		config.Node{Name: "subject_tag", Args: []string{""}},
+		config.Node{Name: "banner", Args: []string{"External <sender>"}},
+	)
+
+	hdr, body := applyTagExternal(t, te, &module.ConnState{Proto: "ESMTP"}, "sender@example.net", `From: <sender@example.net>
+Subject: Hello
+Content-Type: multipart/alternative; boundary=BOUNDARY
+
+--BOUNDARY
+Content-Type: text/plain
+
+Text
+--BOUNDARY
+Content-Type: text/html
+
+<html><body class="x"><p>Text</p></body></html>
+--BOUNDARY--
+`)
+	if subj := hdr.Get("Subject"); subj != "Hello" {
+		t.Errorf("wrong Subject: %q", subj)
+	}
+	if !strings.Contains(body, "External <sender>\n\nText") {
+		t.Errorf("missing text banner: %q", body)
+	}
+	if !strings.Contains(body, `<body class="x"><p>External &lt;sender&gt;</p><p>Text</p>`) {
+		t.Errorf("missing HTML banner: %q", body)
+	}
+}
@@ -19,6 +19,9 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package msgpipeline
 
 import (
+	"context"
+	"errors"
+
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/module"
@@ -41,6 +44,10 @@ func (cg *CheckGroup) Init(cfg *config.Map) error {
 	for _, node := range cfg.Block.Children {
 		chk, err := modconfig.MessageCheck(cfg.Globals, append([]string{node.Name}, node.Args...), node)
 		if err != nil {
+			// Optional module that failed to initialize, already logged.
+			if errors.Is(err, module.ErrDisabled) {
+				continue
+			}
 			return err
 		}
 
@@ -50,6 +57,22 @@ func (cg *CheckGroup) Init(cfg *config.Map) error {
 	return nil
 }
 
+// CheckConnection runs all checks in the group that implement
+// module.EarlyCheck, so the group can be used where a single early check is
+// expected (e.g. IMAP connection_check).
+func (cg *CheckGroup) CheckConnection(ctx context.Context, state *module.ConnState) error {
+	for _, chk := range cg.L {
+		early, ok := chk.(module.EarlyCheck)
+		if !ok {
+			continue
+		}
+		if err := early.CheckConnection(ctx, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (CheckGroup) Name() string {
 	return "checks"
 }
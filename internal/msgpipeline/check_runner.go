@@ -20,11 +20,14 @@ package msgpipeline
 
 import (
 	"context"
+	"errors"
 	"runtime/debug"
+	"strings"
 	"sync"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
@@ -53,6 +56,27 @@ type checkRunner struct {
 
 	states map[module.Check]module.CheckState
 
+	// States of header-only checks that had CheckBody called already
+	// by checkHeader.
+	headerChecked map[module.CheckState]struct{}
+	// States that had CheckPreData called already.
+	preDataChecked map[module.CheckState]struct{}
+
+	// The first check implementing module.AuthResPolicy, if any.
+	authResPolicy module.AuthResPolicy
+
+	// If set, check rejections are saved in deferredErr instead of being
+	// returned. Used to postpone the decision until recipients are known.
+	deferReject bool
+	deferredErr error
+
+	// Explanation for the first quarantine verdict, copied into
+	// MsgMetadata.QuarantineReason.
+	quarantineReason string
+
+	// If set, checks for which it returns true are not run at all.
+	skipCheck func(module.Check) bool
+
 	mergedRes module.CheckResult
 }
 
@@ -64,7 +88,23 @@ func newCheckRunner(msgMeta *module.MsgMetadata, log log.Logger, r dns.Resolver)
 		resolver:             r,
 		dmarcVerify:          dmarc.NewVerifier(r),
 		states:               make(map[module.Check]module.CheckState),
+		headerChecked:        make(map[module.CheckState]struct{}),
+		preDataChecked:       make(map[module.CheckState]struct{}),
+	}
+}
+
+// filter removes checks that should be skipped for the message.
+func (cr *checkRunner) filter(checks []module.Check) []module.Check {
+	if cr.skipCheck == nil {
+		return checks
+	}
+	filtered := make([]module.Check, 0, len(checks))
+	for _, check := range checks {
+		if !cr.skipCheck(check) {
+			filtered = append(filtered, check)
+		}
 	}
+	return filtered
 }
 
 func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) ([]module.CheckState, error) {
@@ -93,6 +133,10 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 		states = append(states, state)
 		newStates = append(newStates, state)
 		newStatesMap[check] = state
+
+		if policy, ok := check.(module.AuthResPolicy); ok && cr.authResPolicy == nil {
+			cr.authResPolicy = policy
+		}
 	}
 
 	if len(newStates) == 0 {
@@ -171,10 +215,15 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 		rejectCheck  string
 		setRejectErr sync.Once
 
+		// Indexed by state so the result does not depend on the order
+		// checks complete in.
+		folders []string
+
 		wg sync.WaitGroup
 	}{}
+	data.folders = make([]string, len(states))
 
-	for _, state := range states {
+	for i, state := range states {
 		data.wg.Add(1)
 		go func() {
 			defer func() {
@@ -206,6 +255,8 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 				data.headerLock.Unlock()
 			}
 
+			data.folders[i] = subCheckRes.Folder
+
 			if subCheckRes.Quarantine {
 				data.setQuarantineErr.Do(func() {
 					data.quarantineErr = subCheckRes.Reason
@@ -225,28 +276,61 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 
 	data.wg.Wait()
 	if data.rejectErr != nil {
-		return data.rejectErr
+		if !cr.deferReject {
+			return data.rejectErr
+		}
+		if cr.deferredErr == nil {
+			cr.deferredErr = data.rejectErr
+		}
 	}
 
 	if data.quarantineErr != nil {
 		cr.log.Error("quarantined", data.quarantineErr)
 		cr.mergedRes.Quarantine = true
+		if cr.quarantineReason == "" {
+			cr.quarantineReason = quarantineReason(data.quarantineErr)
+		}
+	}
+
+	if cr.mergedRes.Folder == "" {
+		for _, folder := range data.folders {
+			if folder != "" {
+				cr.mergedRes.Folder = folder
+				break
+			}
+		}
 	}
 
 	return nil
 }
 
+// quarantineReason returns the explanation of the quarantine verdict that
+// is safe to show to the recipient.
+//
+// Only the message meant for the SMTP client is used, it does not include
+// details about the server configuration.
+func quarantineReason(err error) string {
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) {
+		return "Message quarantined by a policy check"
+	}
+	if smtpErr.CheckName == "" {
+		return smtpErr.Message
+	}
+	return smtpErr.CheckName + ": " + smtpErr.Message
+}
+
 func (cr *checkRunner) checkConnSender(ctx context.Context, checks []module.Check, mailFrom string) error {
 	cr.mailFrom = mailFrom
 	cr.mailFromReceived = true
 
 	// checkStates will run CheckConnection and CheckSender.
-	_, err := cr.checkStates(ctx, checks)
+	_, err := cr.checkStates(ctx, cr.filter(checks))
 	return err
 }
 
 func (cr *checkRunner) checkRcpt(ctx context.Context, checks []module.Check, rcptTo string) error {
-	states, err := cr.checkStates(ctx, checks)
+	states, err := cr.checkStates(ctx, cr.filter(checks))
 	if err != nil {
 		return err
 	}
@@ -271,7 +355,138 @@ func (cr *checkRunner) checkRcpt(ctx context.Context, checks []module.Check, rcp
 	return err
 }
 
+func isHeaderOnly(check module.Check) bool {
+	hc, ok := check.(module.HeaderOnlyCheck)
+	return ok && hc.HeaderOnly()
+}
+
+// checkHeader runs CheckBody for header-only checks before the message body
+// is available.
+func (cr *checkRunner) checkHeader(ctx context.Context, checks []module.Check, header textproto.Header) error {
+	headerChecks := make([]module.Check, 0, len(checks))
+	for _, check := range cr.filter(checks) {
+		if isHeaderOnly(check) {
+			headerChecks = append(headerChecks, check)
+		}
+	}
+	if len(headerChecks) == 0 {
+		return nil
+	}
+
+	states, err := cr.checkStates(ctx, headerChecks)
+	if err != nil {
+		return err
+	}
+
+	if cr.doDMARC && !cr.didDMARCFetch {
+		cr.dmarcVerify.FetchRecord(ctx, header)
+		cr.didDMARCFetch = true
+	}
+
+	pending := make([]module.CheckState, 0, len(states))
+	for _, state := range states {
+		if _, ok := cr.headerChecked[state]; ok {
+			continue
+		}
+		cr.headerChecked[state] = struct{}{}
+		pending = append(pending, state)
+	}
+
+	return cr.runAndMergeResults(pending, func(s module.CheckState) module.CheckResult {
+		res := s.CheckBody(ctx, header, buffer.MemoryBuffer{})
+		return res
+	})
+}
+
+// checkPreData runs CheckPreData for check states that implement
+// module.PreDataCheckState.
+func (cr *checkRunner) checkPreData(ctx context.Context, checks []module.Check, header textproto.Header, prefix []byte) error {
+	states, err := cr.checkStates(ctx, cr.filter(checks))
+	if err != nil {
+		return err
+	}
+
+	pending := make([]module.CheckState, 0, len(states))
+	for _, state := range states {
+		if _, ok := state.(module.PreDataCheckState); !ok {
+			continue
+		}
+		if _, ok := cr.preDataChecked[state]; ok {
+			continue
+		}
+		cr.preDataChecked[state] = struct{}{}
+		pending = append(pending, state)
+	}
+
+	return cr.runAndMergeResults(pending, func(s module.CheckState) module.CheckResult {
+		res := s.(module.PreDataCheckState).CheckPreData(ctx, header, prefix)
+		return res
+	})
+}
+
+// earlyDMARC rejects the message before the body is received if its DMARC
+// policy evaluation result is already known.
+//
+// This is the case if the message has no DKIM signatures and both SPF and
+// DKIM results are already available (check.spf is header-only and
+// check.dkim reports unsigned messages early). Without signatures, body
+// cannot change the outcome.
+func (cr *checkRunner) earlyDMARC(ctx context.Context, header textproto.Header) error {
+	if !cr.doDMARC || header.Has("DKIM-Signature") {
+		return nil
+	}
+
+	haveSPF, haveDKIM := false, false
+	for _, res := range cr.mergedRes.AuthResult {
+		switch res.(type) {
+		case *authres.SPFResult:
+			haveSPF = true
+		case *authres.DKIMResult:
+			haveDKIM = true
+		}
+	}
+	if !haveSPF || !haveDKIM {
+		return nil
+	}
+
+	if !cr.didDMARCFetch {
+		cr.dmarcVerify.FetchRecord(ctx, header)
+		cr.didDMARCFetch = true
+	}
+
+	dmarcRes, policy := cr.dmarcVerify.Apply(cr.mergedRes.AuthResult)
+	if policy != dmarc.PolicyReject {
+		// Quarantine and others are handled normally by applyResults.
+		return nil
+	}
+	cr.log.Msg("early reject", "reason", dmarcRes.Authres.Reason, "check", "dmarc")
+	return dmarcRejectErr(dmarcRes)
+}
+
+func dmarcRejectErr(dmarcRes dmarc.EvalResult) error {
+	code := 550
+	enchCode := exterrors.EnhancedCode{5, 7, 1}
+	if dmarcRes.Authres.Value == authres.ResultTempError {
+		code = 450
+		enchCode[0] = 4
+	}
+	return &exterrors.SMTPError{
+		Code:         code,
+		EnhancedCode: enchCode,
+		Message:      "DMARC check failed",
+		CheckName:    "dmarc",
+		Misc: map[string]interface{}{
+			"reason":      dmarcRes.Authres.Reason,
+			"dkim_res":    dmarcRes.DKIMResult.Value,
+			"dkim_domain": dmarcRes.DKIMResult.Domain,
+			"spf_res":     dmarcRes.SPFResult.Value,
+			"spf_from":    dmarcRes.SPFResult.From,
+		},
+	}
+}
+
 func (cr *checkRunner) checkBody(ctx context.Context, checks []module.Check, header textproto.Header, body buffer.Buffer) error {
+	checks = cr.filter(checks)
 	states, err := cr.checkStates(ctx, checks)
 	if err != nil {
 		return err
@@ -282,7 +497,22 @@ func (cr *checkRunner) checkBody(ctx context.Context, checks []module.Check, hea
 		cr.didDMARCFetch = true
 	}
 
-	return cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
+	// checkStates returns states in the same order as checks.
+	pending := make([]module.CheckState, 0, len(states))
+	headerOnly := make(map[module.CheckState]bool, len(states))
+	for i, state := range states {
+		if _, ok := cr.headerChecked[state]; ok {
+			continue
+		}
+		pending = append(pending, state)
+		headerOnly[state] = isHeaderOnly(checks[i])
+	}
+
+	return cr.runAndMergeResults(pending, func(s module.CheckState) module.CheckResult {
+		if headerOnly[s] {
+			// Do not let the check hold the body buffer.
+			return s.CheckBody(ctx, header, buffer.MemoryBuffer{})
+		}
 		res := s.CheckBody(ctx, header, body)
 		return res
 	})
@@ -291,44 +521,46 @@ func (cr *checkRunner) checkBody(ctx context.Context, checks []module.Check, hea
 func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) error {
 	if cr.mergedRes.Quarantine {
 		cr.msgMeta.Quarantine = true
+		cr.msgMeta.QuarantineReason = cr.quarantineReason
+	}
+	if cr.mergedRes.Folder != "" && cr.msgMeta.Folder == "" {
+		cr.log.DebugMsg("folder set by checks", "folder", cr.mergedRes.Folder)
+		cr.msgMeta.Folder = cr.mergedRes.Folder
+	}
+	if senderAuth := cr.senderAuth(); senderAuth != module.SenderAuthUnknown {
+		cr.msgMeta.SenderAuth = senderAuth
 	}
 
+	// The rejection is returned after the header is updated so the results
+	// are still recorded if the caller decides to accept the message anyway.
+	var rejectErr error
 	if cr.doDMARC {
 		dmarcRes, policy := cr.dmarcVerify.Apply(cr.mergedRes.AuthResult)
 		cr.mergedRes.AuthResult = append(cr.mergedRes.AuthResult, &dmarcRes.Authres)
 		switch policy {
 		case dmarc.PolicyReject:
-			code := 550
-			enchCode := exterrors.EnhancedCode{5, 7, 1}
-			if dmarcRes.Authres.Value == authres.ResultTempError {
-				code = 450
-				enchCode[0] = 4
-			}
-			return &exterrors.SMTPError{
-				Code:         code,
-				EnhancedCode: enchCode,
-				Message:      "DMARC check failed",
-				CheckName:    "dmarc",
-				Misc: map[string]interface{}{
-					"reason":      dmarcRes.Authres.Reason,
-					"dkim_res":    dmarcRes.DKIMResult.Value,
-					"dkim_domain": dmarcRes.DKIMResult.Domain,
-					"spf_res":     dmarcRes.SPFResult.Value,
-					"spf_from":    dmarcRes.SPFResult.From,
-				},
-			}
+			rejectErr = dmarcRejectErr(dmarcRes)
 		case dmarc.PolicyQuarantine:
 			cr.msgMeta.Quarantine = true
+			if cr.msgMeta.QuarantineReason == "" {
+				cr.msgMeta.QuarantineReason = "dmarc: DMARC check failed"
+			}
 
 			// Mimick the message structure for regular checks.
 			cr.log.Msg("quarantined", "reason", dmarcRes.Authres.Reason, "check", "dmarc")
 		}
 	}
 
+	authServID := hostname
+	if cr.authResPolicy != nil {
+		authServID = cr.authResPolicy.AuthServID()
+		removeAuthRes(header, authServID, cr.authResPolicy)
+	}
+
 	// After results for all checks are checked, authRes will be populated with values
 	// we should put into Authentication-Results header.
-	if len(cr.mergedRes.AuthResult) != 0 {
-		header.Add("Authentication-Results", authres.Format(hostname, cr.mergedRes.AuthResult))
+	if len(cr.mergedRes.AuthResult) != 0 || cr.authResPolicy != nil {
+		header.Add("Authentication-Results", authres.Format(authServID, cr.mergedRes.AuthResult))
 	}
 
 	for field := cr.mergedRes.Header.Fields(); field.Next(); {
@@ -338,7 +570,44 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 		}
 		header.AddRaw(formatted)
 	}
-	return nil
+	return rejectErr
+}
+
+// senderAuth evaluates whether the envelope sender is authentic based on
+// the client authentication and SPF and DKIM check results.
+func (cr *checkRunner) senderAuth() module.SenderAuth {
+	if cr.msgMeta.Conn != nil && cr.msgMeta.Conn.AuthUser != "" {
+		return module.SenderAuthPass
+	}
+	_, domain, err := address.Split(cr.mailFrom)
+	if err != nil || domain == "" {
+		return module.SenderAuthUnknown
+	}
+	switch dmarc.EvaluateSender(domain, cr.mergedRes.AuthResult) {
+	case authres.ResultPass:
+		return module.SenderAuthPass
+	case authres.ResultFail:
+		return module.SenderAuthFail
+	default:
+		return module.SenderAuthUnknown
+	}
+}
+
+// removeAuthRes removes Authentication-Results fields that use our
+// authserv-id or are not allowed by the policy.
+func removeAuthRes(header *textproto.Header, authServID string, policy module.AuthResPolicy) {
+	for field := header.FieldsByKey("Authentication-Results"); field.Next(); {
+		// The authserv-id may be followed by the version, see RFC 8601
+		// Section 2.2.
+		id := strings.SplitN(field.Value(), ";", 2)[0]
+		if fields := strings.Fields(id); len(fields) != 0 {
+			id = fields[0]
+		}
+
+		if strings.EqualFold(id, authServID) || !policy.KeepAuthRes(id) {
+			field.Del()
+		}
+	}
 }
 
 func (cr *checkRunner) close() {
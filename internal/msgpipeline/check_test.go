@@ -19,11 +19,15 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package msgpipeline
 
 import (
+	"context"
 	"errors"
 	"testing"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
@@ -59,6 +63,174 @@ func TestMsgPipeline_Checks(t *testing.T) {
 	}
 }
 
+func TestMsgPipeline_CheckFolder(t *testing.T) {
+	target := testutils.Target{}
+	check1 := testutils.Check{BodyRes: module.CheckResult{Folder: "Newsletters"}}
+	check2 := testutils.Check{BodyRes: module.CheckResult{Folder: "Other"}}
+	check3 := testutils.Check{}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check3, &check1, &check2},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "whatever@whatever", []string{"whatever@whatever"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	if target.Messages[0].MsgMeta.Folder != "Newsletters" {
+		t.Fatalf("wrong folder: %q", target.Messages[0].MsgMeta.Folder)
+	}
+}
+
+func TestMsgPipeline_QuarantineReason(t *testing.T) {
+	target := testutils.Target{}
+	check := testutils.Check{BodyRes: module.CheckResult{
+		Quarantine: true,
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
+			Message:      "Message is spam",
+			CheckName:    "test_check",
+			Err:          errors.New("score 100 is above threshold 5"),
+		},
+	}}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "whatever@whatever", []string{"whatever@whatever"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	meta := target.Messages[0].MsgMeta
+	if !meta.Quarantine {
+		t.Fatal("message is not quarantined")
+	}
+	if meta.QuarantineReason != "test_check: Message is spam" {
+		t.Fatalf("wrong quarantine reason: %q", meta.QuarantineReason)
+	}
+}
+
+func TestMsgPipeline_HeaderOnlyChecks(t *testing.T) {
+	target := testutils.Target{}
+	headerCheck := testutils.Check{HeaderOnlyCheck: true}
+	bodyCheck := testutils.Check{}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&headerCheck, &bodyCheck},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	ctx := context.Background()
+	delivery, err := d.Start(ctx, &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(ctx, "rcpt@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("From", "<sender@example.org>")
+	if err := delivery.(module.HeaderDelivery).Header(ctx, hdr, nil); err != nil {
+		t.Fatal(err)
+	}
+	if headerCheck.BodyCalls != 1 {
+		t.Fatal("Header-only check was not called by Header, calls:", headerCheck.BodyCalls)
+	}
+	if bodyCheck.BodyCalls != 0 {
+		t.Fatal("Regular check was called by Header")
+	}
+
+	body := buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}
+	if err := delivery.Body(ctx, hdr, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if headerCheck.BodyCalls != 1 {
+		t.Error("Header-only check was called twice")
+	}
+	if headerCheck.LastBodyLen != 0 {
+		t.Error("Header-only check got the body")
+	}
+	if bodyCheck.BodyCalls != 1 || bodyCheck.LastBodyLen != body.Len() {
+		t.Error("Regular check did not get the body")
+	}
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+}
+
+func TestMsgPipeline_HeaderOnlyChecks_Reject(t *testing.T) {
+	target := testutils.Target{}
+	headerCheck := testutils.Check{
+		HeaderOnlyCheck: true,
+		BodyRes:         module.CheckResult{Reject: true, Reason: errors.New("nope")},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&headerCheck},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	ctx := context.Background()
+	delivery, err := d.Start(ctx, &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(ctx, "rcpt@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.(module.HeaderDelivery).Header(ctx, textproto.Header{}, nil); err == nil {
+		t.Fatal("Expected an error from Header")
+	}
+	if err := delivery.Abort(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if headerCheck.UnclosedStates != 0 {
+		t.Fatal("Check state objects leak or double-closed:", headerCheck.UnclosedStates)
+	}
+}
+
 func TestMsgPipeline_AuthResults(t *testing.T) {
 	target := testutils.Target{}
 	check1, check2 := testutils.Check{
@@ -142,6 +314,54 @@ func TestMsgPipeline_AuthResults(t *testing.T) {
 	}
 }
 
+func TestMsgPipeline_SenderAuth(t *testing.T) {
+	test := func(res authres.ResultValue, authUser string, expected module.SenderAuth) {
+		t.Helper()
+
+		target := testutils.Target{}
+		check := testutils.Check{
+			BodyRes: module.CheckResult{
+				AuthResult: []authres.Result{
+					&authres.SPFResult{
+						Value: res,
+						From:  "example.org",
+					},
+				},
+			},
+		}
+		d := MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				globalChecks: []module.Check{&check},
+				perSource:    map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&target},
+					},
+				},
+			},
+			Hostname: "TEST-HOST",
+			Log:      testutils.Logger(t, "msgpipeline"),
+		}
+
+		testutils.DoTestDeliveryMeta(t, &d, "sender@example.org", []string{"rcpt@example.com"}, &module.MsgMetadata{
+			OriginalFrom: "sender@example.org",
+			Conn:         &module.ConnState{AuthUser: authUser},
+		})
+		if len(target.Messages) != 1 {
+			t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+		}
+		if senderAuth := target.Messages[0].MsgMeta.SenderAuth; senderAuth != expected {
+			t.Errorf("wrong SenderAuth for %v, %q: want %q, got %q", res, authUser, expected, senderAuth)
+		}
+	}
+
+	test(authres.ResultPass, "", module.SenderAuthPass)
+	test(authres.ResultFail, "", module.SenderAuthFail)
+	test(authres.ResultNone, "", module.SenderAuthUnknown)
+	test(authres.ResultFail, "sender@example.org", module.SenderAuthPass)
+}
+
 func TestMsgPipeline_Headers(t *testing.T) {
 	hdr1 := textproto.Header{}
 	hdr1.Add("HDR1", "1")
@@ -446,3 +666,93 @@ func TestMsgPipeline_RcptCheck_Errors(t *testing.T) {
 			check_.UnclosedStates, sourceCheck.UnclosedStates, globalCheck.UnclosedStates)
 	}
 }
+
+type authResPolicyCheck struct {
+	testutils.Check
+	id      string
+	trusted string
+}
+
+func (c *authResPolicyCheck) AuthServID() string {
+	return c.id
+}
+
+func (c *authResPolicyCheck) KeepAuthRes(id string) bool {
+	return id == c.trusted
+}
+
+func TestMsgPipeline_AuthResPolicy(t *testing.T) {
+	target := testutils.Target{}
+	check := authResPolicyCheck{
+		Check: testutils.Check{
+			BodyRes: module.CheckResult{
+				AuthResult: []authres.Result{
+					&authres.SPFResult{Value: authres.ResultPass, From: "example.org"},
+				},
+			},
+		},
+		id:      "mx.example.org",
+		trusted: "relay.example.net",
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Hostname: "TEST-HOST",
+		Log:      testutils.Logger(t, "msgpipeline"),
+	}
+
+	_, err := doTestDelivery(t, &d, "test@example.org", []string{"test@example.com"},
+		"Authentication-Results: MX.example.org; spf=pass smtp.mailfrom=spoofed.example\r\n"+
+			"Authentication-Results: relay.example.net 1; dkim=pass header.d=example.org\r\n"+
+			"Authentication-Results: other.example; dkim=pass header.d=example.org\r\n"+
+			"From: <test@example.org>\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+
+	var ids []string
+	for field := target.Messages[0].Header.FieldsByKey("Authentication-Results"); field.Next(); {
+		id, res, err := authres.Parse(field.Value())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		if id == "mx.example.org" {
+			if len(res) != 1 || res[0].(*authres.SPFResult).From != "example.org" {
+				t.Error("Wrong generated results:", field.Value())
+			}
+		}
+	}
+	if len(ids) != 2 || ids[0] != "mx.example.org" || ids[1] != "relay.example.net" {
+		t.Fatal("Wrong Authentication-Results fields:", ids)
+	}
+}
+
+func TestCheckGroup_CheckConnection(t *testing.T) {
+	errReject := errors.New("rejected")
+	cg := &CheckGroup{L: []module.Check{
+		&testutils.Check{},
+		&testutils.Check{EarlyErr: errReject},
+	}}
+
+	err := cg.CheckConnection(context.Background(), &module.ConnState{})
+	if !errors.Is(err, errReject) {
+		t.Fatalf("expected the check error, got %v", err)
+	}
+
+	cg.L = cg.L[:1]
+	if err := cg.CheckConnection(context.Background(), &module.ConnState{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
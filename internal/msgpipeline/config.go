@@ -44,6 +44,10 @@ type msgpipelineCfg struct {
 	perSource       map[string]sourceBlock
 	defaultSource   sourceBlock
 	doDMARC         bool
+	roleAddrs       *roleAddrs
+	nullSender      *nullSender
+	// Max. amount of recipients after address rewriting, 0 means no limit.
+	maxExpandedRcpts int
 }
 
 func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node) (msgpipelineCfg, error) {
@@ -129,6 +133,33 @@ func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node
 			case 0:
 				cfg.doDMARC = true
 			}
+		case "postmaster":
+			if cfg.roleAddrs != nil {
+				return msgpipelineCfg{}, config.NodeErr(node, "duplicate 'postmaster' directive")
+			}
+			var err error
+			cfg.roleAddrs, err = parseRoleAddrs(globals, node)
+			if err != nil {
+				return msgpipelineCfg{}, err
+			}
+		case "null_sender":
+			if cfg.nullSender != nil {
+				return msgpipelineCfg{}, config.NodeErr(node, "duplicate 'null_sender' directive")
+			}
+			var err error
+			cfg.nullSender, err = parseNullSender(globals, node)
+			if err != nil {
+				return msgpipelineCfg{}, err
+			}
+		case "max_expanded_rcpts":
+			if len(node.Args) != 1 {
+				return msgpipelineCfg{}, config.NodeErr(node, "exactly one argument is required")
+			}
+			limit, err := strconv.Atoi(node.Args[0])
+			if err != nil || limit < 0 {
+				return msgpipelineCfg{}, config.NodeErr(node, "invalid recipients limit: %v", node.Args[0])
+			}
+			cfg.maxExpandedRcpts = limit
 		case "deliver_to", "reroute", "destination_in", "destination", "default_destination", "reject":
 			othersRaw = append(othersRaw, node)
 		default:
@@ -373,6 +404,12 @@ func parseEnhancedCode(s string) (exterrors.EnhancedCode, error) {
 	return code, nil
 }
 
+// ChecksDirective parses the check block (or reference to the 'checks'
+// configuration block) and returns []module.Check.
+func ChecksDirective(m *config.Map, node config.Node) (interface{}, error) {
+	return parseChecksGroup(m.Globals, node)
+}
+
 func parseChecksGroup(globals map[string]interface{}, node config.Node) ([]module.Check, error) {
 	var cg *CheckGroup
 	err := modconfig.GroupFromNode("checks", node.Args, node, globals, &cg)
@@ -221,6 +221,33 @@ func TestMsgPipelineCfg(t *testing.T) {
 				}`,
 			fail: true,
 		},
+		{
+			name: "max_expanded_rcpts",
+			str: `
+				max_expanded_rcpts 100
+				default_destination {
+					reject 420
+				}`,
+			value: msgpipelineCfg{
+				perSource: map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						rejectErr: policyError(420),
+					},
+				},
+				maxExpandedRcpts: 100,
+			},
+		},
+		{
+			name: "negative max_expanded_rcpts",
+			str: `
+				max_expanded_rcpts -1
+				default_destination {
+					reject 420
+				}`,
+			fail: true,
+		},
 	}
 
 	for _, case_ := range cases {
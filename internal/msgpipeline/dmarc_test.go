@@ -222,3 +222,74 @@ func TestDMARC(t *testing.T) {
 		&authres.SPFResult{Value: authres.ResultNone, From: "example.org", Helo: "mx.example.org"},
 	}, false, true, authres.ResultFail)
 }
+
+func TestDMARC_Early(t *testing.T) {
+	test := func(hdr string, reject bool) {
+		t.Helper()
+
+		tgt := testutils.Target{}
+		p := MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				globalChecks: []module.Check{
+					&testutils.Check{
+						HeaderOnlyCheck: true,
+						BodyRes: module.CheckResult{
+							AuthResult: []authres.Result{
+								&authres.SPFResult{
+									Value: authres.ResultFail,
+									From:  "example.org",
+									Helo:  "mx.example.org",
+								},
+								&authres.DKIMResult{
+									Value: authres.ResultNone,
+								},
+							},
+						},
+					},
+				},
+				perSource: map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&tgt},
+					},
+				},
+				doDMARC: true,
+			},
+			Log: testutils.Logger(t, "pipeline"),
+			Resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+				"_dmarc.example.org.": {
+					TXT: []string{"v=DMARC1; p=reject"},
+				},
+			}},
+		}
+
+		hdrParsed, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(hdr)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		delivery, err := p.Start(ctx, &module.MsgMetadata{ID: "test"}, "test@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer delivery.Abort(ctx)
+		if err := delivery.AddRcpt(ctx, "test@example.com", smtp.RcptOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		err = delivery.(module.HeaderDelivery).Header(ctx, hdrParsed, nil)
+		if reject && err == nil {
+			t.Error("Expected message to be rejected early")
+		}
+		if !reject && err != nil {
+			t.Error("Unexpected early rejection:", err)
+		}
+	}
+
+	test("From: <test@example.org>\r\n\r\n", true)
+	// DKIM signature may still make the message pass.
+	test("From: <test@example.org>\r\n"+
+		"DKIM-Signature: v=1; d=example.org; s=default\r\n\r\n", false)
+}
@@ -22,6 +22,9 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/modify"
 	"github.com/foxcpp/maddy/internal/testutils"
@@ -268,6 +271,53 @@ func TestMsgPipeline_RcptModifier(t *testing.T) {
 	}
 }
 
+func TestMsgPipeline_RcptModifier_ExpandedLimit(t *testing.T) {
+	target := testutils.Target{}
+	mod := testutils.Modifier{
+		InstName: "test_modifier",
+		RcptTo: map[string][]string{
+			"list1@example.com": []string{"a@example.com", "b@example.com", "c@example.com"},
+			"list2@example.com": []string{"d@example.com", "e@example.com"},
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalModifiers: modify.Group{
+				Modifiers: []module.Modifier{mod},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+			maxExpandedRcpts: 4,
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"list1@example.com", "f@example.com"})
+	testutils.CheckTestMessage(t, &target, 0, "sender@example.com",
+		[]string{"a@example.com", "b@example.com", "c@example.com", "f@example.com"})
+
+	_, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"list1@example.com", "list2@example.com"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 452 {
+		t.Errorf("expected 452 code, got %v", err)
+	}
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+
+	if mod.UnclosedStates != 0 {
+		t.Fatalf("modifier state objects leak or double-closed, counter: %d", mod.UnclosedStates)
+	}
+}
+
 func TestMsgPipeline_RcptModifier_OriginalRcpt(t *testing.T) {
 	target := testutils.Target{}
 	mod := testutils.Modifier{
@@ -707,3 +757,52 @@ func TestMsgPipeline_RcptModifier_Errors(t *testing.T) {
 			mod.UnclosedStates, globalMod.UnclosedStates, sourceMod.UnclosedStates)
 	}
 }
+
+func TestMsgPipeline_BodyModifier(t *testing.T) {
+	target := testutils.Target{}
+	footer, err := modify.NewAppendFooter("modify.append_footer", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := footer.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{{Name: "text", Args: []string{"Confidential."}}},
+	})); err != nil {
+		t.Fatal(err)
+	}
+	modifier := testutils.Modifier{
+		InstName: "test_modifier",
+		AddHdr:   textproto.Header{},
+	}
+	modifier.AddHdr.Add("X-Signed", "1")
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalModifiers: modify.Group{
+				Modifiers: []module.Modifier{footer.(module.Modifier)},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				modifiers: modify.Group{
+					Modifiers: []module.Modifier{modifier},
+				},
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.com"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	msg := target.Messages[0]
+	if string(msg.Body) != "foobar\r\n\r\nConfidential.\r\n" {
+		t.Errorf("wrong body: %q", msg.Body)
+	}
+	if msg.Header.Get("X-Signed") != "1" || msg.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("header modifications are lost: %v", msg.Header)
+	}
+}
@@ -93,6 +93,27 @@ func New(globals map[string]interface{}, cfg []config.Node) (*MsgPipeline, error
 	}, err
 }
 
+// NewChecked returns the pipeline that runs the checks and passes accepted
+// messages to the target.
+//
+// It is used to run checks outside of message sources, e.g. when
+// target.queue dispatches the message.
+func NewChecked(checks []module.Check, tgt module.DeliveryTarget) *MsgPipeline {
+	return &MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: checks,
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{tgt},
+				},
+			},
+		},
+		Resolver: dns.DefaultResolver(),
+	}
+}
+
 func (d *MsgPipeline) RunEarlyChecks(ctx context.Context, state *module.ConnState) error {
 	eg, checkCtx := errgroup.WithContext(ctx)
 
@@ -132,10 +153,30 @@ func (d *MsgPipeline) Start(ctx context.Context, msgMeta *module.MsgMetadata, ma
 		msgMeta.OriginalRcpts = map[string]string{}
 	}
 
+	// Rejections by sender checks are postponed until we see whether the
+	// message is addressed to role addresses that should bypass checks.
+	if mailFrom == "" && d.nullSender != nil {
+		if err := d.nullSender.checkSize(msgMeta.SMTPOpts.Size); err != nil {
+			dd.close()
+			return nil, err
+		}
+		if err := d.nullSender.takeLimits(ctx, msgMeta); err != nil {
+			dd.close()
+			return nil, err
+		}
+		dd.nullSender = d.nullSender
+		dd.checkRunner.skipCheck = d.nullSender.skip
+	}
+
+	dd.checkRunner.deferReject = d.roleAddrs != nil && d.roleAddrs.bypassChecks
 	if err := dd.start(ctx, msgMeta, mailFrom); err != nil {
 		dd.close()
 		return nil, err
 	}
+	dd.checkRunner.deferReject = false
+	if err := dd.checkRunner.deferredErr; err != nil {
+		dd.log.Error("sender rejected, allowing only role addresses", err)
+	}
 
 	return &dd, nil
 }
@@ -275,17 +316,81 @@ type msgpipelineDelivery struct {
 	deliveries  map[module.DeliveryTarget]*delivery
 	msgMeta     *module.MsgMetadata
 	checkRunner *checkRunner
+
+	// Amount of accepted role and other recipients, see roleAddrs.
+	roleRcpts  int
+	otherRcpts int
+	// Amount of recipients after address rewriting.
+	expandedRcpts int
+	// The first check rejection bypassed for a role address.
+	bypassedErr error
+
+	// Set if the message has the null sender and the pipeline has
+	// restrictions configured for such messages.
+	nullSender *nullSender
+}
+
+// rcptCheckErr returns the error from recipient checks unless rejections are
+// bypassed for the recipient.
+func (dd *msgpipelineDelivery) rcptCheckErr(bypass bool, err error) error {
+	if err == nil || !bypass {
+		return err
+	}
+	dd.log.Error("check rejection bypassed for role address", err)
+	if dd.bypassedErr == nil {
+		dd.bypassedErr = err
+	}
+	return nil
+}
+
+// onlyRoleRcpts reports whether check rejections should be bypassed for the
+// message as a whole, that is, all recipients are role addresses.
+func (dd *msgpipelineDelivery) onlyRoleRcpts() bool {
+	return dd.d.roleAddrs != nil && dd.d.roleAddrs.bypassChecks &&
+		dd.roleRcpts != 0 && dd.otherRcpts == 0
+}
+
+// msgCheckErr quarantines the message instead of rejecting it if it is
+// addressed only to role addresses that bypass checks.
+func (dd *msgpipelineDelivery) msgCheckErr(err error) error {
+	if err == nil || !dd.onlyRoleRcpts() {
+		return err
+	}
+	dd.log.Error("check rejection bypassed for role address, quarantined", err)
+	dd.msgMeta.Quarantine = true
+	return nil
 }
 
 func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp.RcptOptions) error {
-	if err := dd.checkRunner.checkRcpt(ctx, dd.d.globalChecks, to); err != nil {
+	if dd.nullSender != nil {
+		if err := dd.nullSender.checkRcptCount(dd.roleRcpts + dd.otherRcpts); err != nil {
+			return err
+		}
+	}
+
+	isRole := dd.d.roleAddrs.match(to)
+	bypass := isRole && dd.d.roleAddrs.bypassChecks
+	if dd.checkRunner.deferredErr != nil {
+		if !bypass {
+			return dd.checkRunner.deferredErr
+		}
+		if dd.bypassedErr == nil {
+			dd.bypassedErr = dd.checkRunner.deferredErr
+		}
+	}
+
+	if err := dd.rcptCheckErr(bypass, dd.checkRunner.checkRcpt(ctx, dd.d.globalChecks, to)); err != nil {
 		return err
 	}
-	if err := dd.checkRunner.checkRcpt(ctx, dd.sourceBlock.checks, to); err != nil {
+	if err := dd.rcptCheckErr(bypass, dd.checkRunner.checkRcpt(ctx, dd.sourceBlock.checks, to)); err != nil {
 		return err
 	}
 
 	originalTo := to
+	if isRole {
+		dd.log.Debugln("role address:", to, "=>", dd.d.roleAddrs.mailbox)
+		to = dd.d.roleAddrs.mailbox
+	}
 
 	newTo, err := dd.globalModifiersState.RewriteRcpt(ctx, to)
 	if err != nil {
@@ -322,7 +427,7 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp
 			return wrapErr(rcptBlock.rejectErr)
 		}
 
-		if err := dd.checkRunner.checkRcpt(ctx, rcptBlock.checks, to); err != nil {
+		if err := dd.rcptCheckErr(bypass, dd.checkRunner.checkRcpt(ctx, rcptBlock.checks, to)); err != nil {
 			return wrapErr(err)
 		}
 
@@ -338,6 +443,10 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp
 		}
 		dd.log.Debugln("per-rcpt modifiers:", to, "=>", newTo)
 
+		if err := dd.checkExpandedRcpts(len(newTo)); err != nil {
+			return wrapErr(err)
+		}
+
 		for _, to = range newTo {
 			wrapErr = func(err error) error {
 				return exterrors.WithFields(err, map[string]interface{}{
@@ -372,18 +481,75 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp
 		}
 	}
 
+	if isRole {
+		dd.roleRcpts++
+	} else {
+		dd.otherRcpts++
+	}
+	return nil
+}
+
+// checkExpandedRcpts counts recipients the address is expanded into against
+// the max_expanded_rcpts limit.
+func (dd *msgpipelineDelivery) checkExpandedRcpts(count int) error {
+	if dd.d.maxExpandedRcpts != 0 && dd.expandedRcpts+count > dd.d.maxExpandedRcpts {
+		return &exterrors.SMTPError{
+			Code:         452,
+			EnhancedCode: exterrors.EnhancedCode{4, 5, 3},
+			Message:      "Too many recipients after alias expansion",
+			Misc: map[string]interface{}{
+				"expanded_rcpts": dd.expandedRcpts + count,
+				"limit":          dd.d.maxExpandedRcpts,
+			},
+		}
+	}
+	dd.expandedRcpts += count
 	return nil
 }
 
+// Header runs header-only checks and pre-DATA checks before the message body
+// is received.
+//
+// Delivery targets are not notified since they should see the header only
+// after all checks and modifiers are applied.
+func (dd *msgpipelineDelivery) Header(ctx context.Context, header textproto.Header, bodyPrefix []byte) error {
+	checkGroups := make([][]module.Check, 0, 2+len(dd.rcptModifiersState))
+	checkGroups = append(checkGroups, dd.d.globalChecks, dd.sourceBlock.checks)
+	for blk := range dd.rcptModifiersState {
+		checkGroups = append(checkGroups, blk.checks)
+	}
+
+	for _, checks := range checkGroups {
+		if err := dd.msgCheckErr(dd.checkRunner.checkHeader(ctx, checks, header)); err != nil {
+			return err
+		}
+	}
+	for _, checks := range checkGroups {
+		if err := dd.msgCheckErr(dd.checkRunner.checkPreData(ctx, checks, header, bodyPrefix)); err != nil {
+			return err
+		}
+	}
+
+	return dd.msgCheckErr(dd.checkRunner.earlyDMARC(ctx, header))
+}
+
 func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
-	if err := dd.checkRunner.checkBody(ctx, dd.d.globalChecks, header, body); err != nil {
+	if dd.nullSender != nil {
+		if err := dd.nullSender.checkSize(int64(body.Len())); err != nil {
+			return err
+		}
+	}
+	if err := dd.msgCheckErr(dd.bypassedErr); err != nil {
+		return err
+	}
+	if err := dd.msgCheckErr(dd.checkRunner.checkBody(ctx, dd.d.globalChecks, header, body)); err != nil {
 		return err
 	}
-	if err := dd.checkRunner.checkBody(ctx, dd.sourceBlock.checks, header, body); err != nil {
+	if err := dd.msgCheckErr(dd.checkRunner.checkBody(ctx, dd.sourceBlock.checks, header, body)); err != nil {
 		return err
 	}
 	for blk := range dd.rcptModifiersState {
-		if err := dd.checkRunner.checkBody(ctx, blk.checks, header, body); err != nil {
+		if err := dd.msgCheckErr(dd.checkRunner.checkBody(ctx, blk.checks, header, body)); err != nil {
 			return err
 		}
 	}
@@ -400,23 +566,16 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 		header.Add("Received", received)
 	}
 
-	if err := dd.checkRunner.applyResults(dd.d.Hostname, &header); err != nil {
+	if err := dd.msgCheckErr(dd.checkRunner.applyResults(dd.d.Hostname, &header)); err != nil {
 		return err
 	}
 
 	// Run modifiers after Authentication-Results addition to make
 	// sure signatures, etc will cover it.
-	if err := dd.globalModifiersState.RewriteBody(ctx, &header, body); err != nil {
-		return err
-	}
-	if err := dd.sourceModifiersState.RewriteBody(ctx, &header, body); err != nil {
+	body, err := dd.modifyBody(ctx, &header, body)
+	if err != nil {
 		return err
 	}
-	for _, modifiers := range dd.rcptModifiersState {
-		if err := modifiers.RewriteBody(ctx, &header, body); err != nil {
-			return err
-		}
-	}
 
 	for _, delivery := range dd.deliveries {
 		if err := delivery.Body(ctx, header, body); err != nil {
@@ -427,6 +586,26 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 	return nil
 }
 
+// modifyBody runs modifiers for the message header and body and returns the
+// body to deliver.
+func (dd *msgpipelineDelivery) modifyBody(ctx context.Context, header *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	body, err := module.ModifyBody(ctx, dd.globalModifiersState, header, body)
+	if err != nil {
+		return nil, err
+	}
+	body, err = module.ModifyBody(ctx, dd.sourceModifiersState, header, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, modifiers := range dd.rcptModifiersState {
+		body, err = module.ModifyBody(ctx, modifiers, header, body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
 // statusCollector wraps StatusCollector and adds reverse translation
 // of recipients for all statuses.]
 //
@@ -448,6 +627,18 @@ func (sc statusCollector) SetStatus(rcptTo string, err error) {
 	sc.wrapped.SetStatus(rcptTo, err)
 }
 
+func (sc statusCollector) SetDeliveryInfo(rcptTo string, info module.DeliveryInfo) {
+	ic, ok := sc.wrapped.(module.DeliveryInfoCollector)
+	if !ok {
+		return
+	}
+	original, ok := sc.originalRcpts[rcptTo]
+	if ok {
+		rcptTo = original
+	}
+	ic.SetDeliveryInfo(rcptTo, info)
+}
+
 func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.StatusCollector, header textproto.Header, body buffer.Buffer) {
 	setStatusAll := func(err error) {
 		for _, delivery := range dd.deliveries {
@@ -457,31 +648,32 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 		}
 	}
 
-	if err := dd.checkRunner.checkBody(ctx, dd.d.globalChecks, header, body); err != nil {
+	if dd.nullSender != nil {
+		if err := dd.nullSender.checkSize(int64(body.Len())); err != nil {
+			setStatusAll(err)
+			return
+		}
+	}
+	if err := dd.msgCheckErr(dd.bypassedErr); err != nil {
 		setStatusAll(err)
 		return
 	}
-	if err := dd.checkRunner.checkBody(ctx, dd.sourceBlock.checks, header, body); err != nil {
+	if err := dd.msgCheckErr(dd.checkRunner.checkBody(ctx, dd.d.globalChecks, header, body)); err != nil {
 		setStatusAll(err)
 		return
 	}
-
-	// Run modifiers after Authentication-Results addition to make
-	// sure signatures, etc will cover it.
-	if err := dd.globalModifiersState.RewriteBody(ctx, &header, body); err != nil {
+	if err := dd.msgCheckErr(dd.checkRunner.checkBody(ctx, dd.sourceBlock.checks, header, body)); err != nil {
 		setStatusAll(err)
 		return
 	}
-	if err := dd.sourceModifiersState.RewriteBody(ctx, &header, body); err != nil {
+
+	// Run modifiers after Authentication-Results addition to make
+	// sure signatures, etc will cover it.
+	body, err := dd.modifyBody(ctx, &header, body)
+	if err != nil {
 		setStatusAll(err)
 		return
 	}
-	for _, modifiers := range dd.rcptModifiersState {
-		if err := modifiers.RewriteBody(ctx, &header, body); err != nil {
-			setStatusAll(err)
-			return
-		}
-	}
 
 	for _, delivery := range dd.deliveries {
 		partDelivery, ok := delivery.Delivery.(module.PartialDelivery)
@@ -516,6 +708,10 @@ func (dd msgpipelineDelivery) Commit(ctx context.Context) error {
 func (dd *msgpipelineDelivery) close() {
 	dd.checkRunner.close()
 
+	if dd.nullSender != nil {
+		dd.nullSender.releaseLimits(dd.msgMeta)
+	}
+
 	if dd.globalModifiersState != nil {
 		dd.globalModifiersState.Close()
 	}
@@ -0,0 +1,148 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/limits"
+)
+
+// nullSender is the configuration of the 'null_sender' directive that
+// restricts messages with the null return-path (<>), that is, bounces and
+// other automatically generated notifications.
+type nullSender struct {
+	maxSize    int64
+	maxRcpts   int
+	limits     *limits.Group
+	skipChecks map[string]struct{}
+}
+
+func parseNullSender(globals map[string]interface{}, node config.Node) (*nullSender, error) {
+	var (
+		ns         nullSender
+		skipChecks []string
+	)
+	cfg := config.NewMap(globals, node)
+	cfg.DataSize("max_size", false, false, 0, &ns.maxSize)
+	cfg.Int("max_rcpts", false, false, 1, &ns.maxRcpts)
+	cfg.Custom("limits", false, false, func() (interface{}, error) {
+		return &limits.Group{}, nil
+	}, func(cfg *config.Map, n config.Node) (interface{}, error) {
+		var g *limits.Group
+		if err := modconfig.GroupFromNode("limits", n.Args, n, cfg.Globals, &g); err != nil {
+			return nil, err
+		}
+		return g, nil
+	}, &ns.limits)
+	cfg.StringList("skip_checks", false, false, nil, &skipChecks)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+	if ns.maxSize < 0 || ns.maxRcpts < 0 {
+		return nil, config.NodeErr(node, "limits should not be negative")
+	}
+
+	ns.skipChecks = make(map[string]struct{}, len(skipChecks))
+	for _, name := range skipChecks {
+		ns.skipChecks[name] = struct{}{}
+	}
+
+	return &ns, nil
+}
+
+// skip reports whether the check should not be run for null-sender messages.
+//
+// Checks are referenced either by the module name (with or without the
+// "check." prefix) or by the configuration block name.
+func (ns *nullSender) skip(check module.Check) bool {
+	mod, ok := check.(module.Module)
+	if !ok {
+		return false
+	}
+	for _, name := range []string{mod.Name(), strings.TrimPrefix(mod.Name(), "check."), mod.InstanceName()} {
+		if name == "" {
+			continue
+		}
+		if _, ok := ns.skipChecks[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// nullSenderLimitsKey returns the IP address and the "source" used for rate
+// limiting. Since there is no sender domain, the HELO hostname is used as the
+// source.
+func nullSenderLimitsKey(msgMeta *module.MsgMetadata) (net.IP, string) {
+	ip := net.IPv4(127, 0, 0, 1)
+	if msgMeta.Conn == nil {
+		return ip, ""
+	}
+	if addr, ok := msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	return ip, strings.ToLower(msgMeta.Conn.Hostname)
+}
+
+func (ns *nullSender) takeLimits(ctx context.Context, msgMeta *module.MsgMetadata) error {
+	ip, source := nullSenderLimitsKey(msgMeta)
+	if err := ns.limits.TakeMsg(ctx, ip, source); err != nil {
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Too many messages with null sender, try again later",
+			Err:          err,
+		}
+	}
+	return nil
+}
+
+func (ns *nullSender) releaseLimits(msgMeta *module.MsgMetadata) {
+	ip, source := nullSenderLimitsKey(msgMeta)
+	ns.limits.ReleaseMsg(ip, source)
+}
+
+func (ns *nullSender) checkSize(size int64) error {
+	if ns.maxSize == 0 || size <= ns.maxSize {
+		return nil
+	}
+	return &exterrors.SMTPError{
+		Code:         552,
+		EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
+		Message:      "Message with null sender is too big",
+	}
+}
+
+func (ns *nullSender) checkRcptCount(count int) error {
+	if ns.maxRcpts == 0 || count < ns.maxRcpts {
+		return nil
+	}
+	return &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 5, 3},
+		Message:      "Too many recipients for message with null sender",
+	}
+}
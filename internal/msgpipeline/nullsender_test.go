@@ -0,0 +1,108 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testNullSenderPipeline(t *testing.T, cfg string, checks ...module.Check) (*MsgPipeline, *testutils.Target) {
+	t.Helper()
+
+	nodes, err := parser.Read(strings.NewReader(cfg), "literal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err := parseNullSender(nil, nodes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := &testutils.Target{}
+	return &MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: checks,
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{target},
+				},
+			},
+			nullSender: ns,
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}, target
+}
+
+func TestMsgPipeline_NullSender_Rcpts(t *testing.T) {
+	d, target := testNullSenderPipeline(t, `null_sender`)
+
+	if _, err := testutils.DoTestDeliveryErr(t, d, "", []string{"a@example.org", "b@example.org"}); err == nil {
+		t.Fatal("Expected an error for multi-recipient bounce")
+	}
+	testutils.DoTestDelivery(t, d, "", []string{"a@example.org"})
+	testutils.DoTestDelivery(t, d, "sender@example.org", []string{"a@example.org", "b@example.org"})
+	if len(target.Messages) != 2 {
+		t.Fatal("Wrong amount of messages delivered:", len(target.Messages))
+	}
+}
+
+func TestMsgPipeline_NullSender_Size(t *testing.T) {
+	d, target := testNullSenderPipeline(t, `null_sender {
+		max_size 4b
+		max_rcpts 0
+	}`)
+
+	// Test message body is 8 bytes long.
+	if _, err := testutils.DoTestDeliveryErr(t, d, "", []string{"a@example.org", "b@example.org"}); err == nil {
+		t.Fatal("Expected an error for too big bounce")
+	}
+	testutils.DoTestDelivery(t, d, "sender@example.org", []string{"a@example.org"})
+	if len(target.Messages) != 1 {
+		t.Fatal("Wrong amount of messages delivered:", len(target.Messages))
+	}
+}
+
+func TestMsgPipeline_NullSender_SkipChecks(t *testing.T) {
+	check := testutils.Check{
+		InstName: "strict",
+		BodyRes:  module.CheckResult{Reject: true, Reason: errors.New("rejected")},
+	}
+	d, _ := testNullSenderPipeline(t, `null_sender {
+		skip_checks strict
+	}`, &check)
+
+	testutils.DoTestDelivery(t, d, "", []string{"a@example.org"})
+	if check.BodyCalls != 0 {
+		t.Fatal("Skipped check is called")
+	}
+	if _, err := testutils.DoTestDeliveryErr(t, d, "sender@example.org", []string{"a@example.org"}); err == nil {
+		t.Fatal("Expected an error for non-null sender")
+	}
+	if check.UnclosedStates != 0 {
+		t.Fatalf("check state objects leak or double-closed, counter: %d", check.UnclosedStates)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+// roleAddrs is the configuration of the 'postmaster' directive that routes
+// role addresses (postmaster@ as required by RFC 5321 and abuse@ as
+// recommended by RFC 2142) of hosted domains to a single mailbox.
+type roleAddrs struct {
+	mailbox      string
+	localParts   map[string]struct{}
+	domains      map[string]struct{}
+	bypassChecks bool
+}
+
+func parseRoleAddrs(globals map[string]interface{}, node config.Node) (*roleAddrs, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "expected exactly one argument: mailbox address")
+	}
+	mailbox, err := address.ForLookup(node.Args[0])
+	if err != nil || !address.Valid(mailbox) {
+		return nil, config.NodeErr(node, "invalid mailbox address: %v", node.Args[0])
+	}
+
+	var (
+		domains, localParts []string
+		r                   = roleAddrs{mailbox: mailbox}
+	)
+	cfg := config.NewMap(globals, node)
+	cfg.StringList("domains", false, true, nil, &domains)
+	cfg.StringList("local_parts", false, false, []string{"postmaster", "abuse"}, &localParts)
+	cfg.Bool("bypass_checks", false, false, &r.bypassChecks)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	r.domains = make(map[string]struct{}, len(domains))
+	for _, d := range domains {
+		d, err := dns.ForLookup(d)
+		if err != nil {
+			return nil, config.NodeErr(node, "invalid domain: %v", err)
+		}
+		r.domains[d] = struct{}{}
+	}
+	r.localParts = make(map[string]struct{}, len(localParts))
+	for _, lp := range localParts {
+		r.localParts[strings.ToLower(lp)] = struct{}{}
+	}
+
+	return &r, nil
+}
+
+// match reports whether the recipient address is one of the role addresses.
+func (r *roleAddrs) match(rcpt string) bool {
+	if r == nil {
+		return false
+	}
+
+	clean, err := address.ForLookup(rcpt)
+	if err != nil {
+		return false
+	}
+	mbox, domain, err := address.Split(clean)
+	if err != nil {
+		return false
+	}
+	if _, ok := r.localParts[mbox]; !ok {
+		return false
+	}
+	if domain == "" {
+		// <postmaster> without a domain, see RFC 5321 Section 4.1.1.3.
+		return mbox == "postmaster"
+	}
+	_, ok := r.domains[domain]
+	return ok
+}
@@ -0,0 +1,202 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testRoleAddrs(bypass bool) *roleAddrs {
+	return &roleAddrs{
+		mailbox: "admin@example.org",
+		localParts: map[string]struct{}{
+			"postmaster": {},
+			"abuse":      {},
+		},
+		domains: map[string]struct{}{
+			"example.org": {},
+			"example.net": {},
+		},
+		bypassChecks: bypass,
+	}
+}
+
+func TestMsgPipeline_RoleAddrs(t *testing.T) {
+	target, otherTarget := testutils.Target{}, testutils.Target{}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{
+					"example.org": {
+						targets: []module.DeliveryTarget{&target},
+					},
+				},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&otherTarget},
+				},
+			},
+			roleAddrs: testRoleAddrs(false),
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{
+		"Abuse@example.net", "postmaster", "abuse@example.com", "user@example.org",
+	})
+
+	testutils.CheckTestMessage(t, &target, 0, "sender@example.com", []string{
+		"admin@example.org", "admin@example.org", "user@example.org",
+	})
+	testutils.CheckTestMessage(t, &otherTarget, 0, "sender@example.com", []string{"abuse@example.com"})
+
+	if orig := target.Messages[0].MsgMeta.OriginalRcpts["admin@example.org"]; orig != "postmaster" {
+		t.Errorf("Wrong original recipient: %v", orig)
+	}
+}
+
+func TestMsgPipeline_RoleAddrs_BypassChecks(t *testing.T) {
+	target := testutils.Target{}
+	check := testutils.Check{
+		SenderRes: module.CheckResult{Reject: true, Reason: errors.New("sender rejected")},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+			roleAddrs: testRoleAddrs(true),
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	if _, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"user@example.org"}); err == nil {
+		t.Fatal("Expected an error for non-role recipient")
+	}
+	if _, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"postmaster@example.org", "user@example.org"}); err == nil {
+		t.Fatal("Expected an error for non-role recipient")
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"postmaster@example.org"})
+	testutils.CheckTestMessage(t, &target, 0, "sender@example.com", []string{"admin@example.org"})
+	if !target.Messages[0].MsgMeta.Quarantine {
+		t.Error("Message with bypassed rejection is not quarantined")
+	}
+
+	check.SenderRes = module.CheckResult{}
+	check.BodyRes = module.CheckResult{Reject: true, Reason: errors.New("body rejected")}
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"abuse@example.net"})
+	if !target.Messages[1].MsgMeta.Quarantine {
+		t.Error("Message with bypassed rejection is not quarantined")
+	}
+	if _, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"abuse@example.net", "user@example.org"}); err == nil {
+		t.Fatal("Expected an error for message with non-role recipients")
+	}
+
+	if check.UnclosedStates != 0 {
+		t.Fatalf("check state objects leak or double-closed, counter: %d", check.UnclosedStates)
+	}
+}
+
+func TestMsgPipeline_RoleAddrs_NoBypass(t *testing.T) {
+	target := testutils.Target{}
+	check := testutils.Check{
+		BodyRes: module.CheckResult{Reject: true, Reason: errors.New("body rejected")},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+			roleAddrs: testRoleAddrs(false),
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	if _, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"postmaster@example.org"}); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
+func TestMsgPipelineCfg_RoleAddrs(t *testing.T) {
+	parse := func(str string) (msgpipelineCfg, error) {
+		cfg, _ := parser.Read(strings.NewReader(str), "literal")
+		return parseMsgPipelineRootCfg(nil, cfg)
+	}
+
+	cfg, err := parse(`
+		postmaster Admin@Example.org {
+			domains example.org EXAMPLE.net
+			bypass_checks yes
+		}
+		deliver_to dummy`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := cfg.roleAddrs
+	if r == nil || r.mailbox != "admin@example.org" || !r.bypassChecks {
+		t.Fatalf("Wrong configuration: %+v", r)
+	}
+	for _, rcpt := range []string{"postmaster@example.net", "ABUSE@example.org", "postmaster"} {
+		if !r.match(rcpt) {
+			t.Errorf("%s is not matched", rcpt)
+		}
+	}
+	for _, rcpt := range []string{"postmaster@example.com", "hostmaster@example.org", "abuse"} {
+		if r.match(rcpt) {
+			t.Errorf("%s is matched", rcpt)
+		}
+	}
+
+	for _, str := range []string{
+		`postmaster admin@example.org
+		deliver_to dummy`,
+		`postmaster {
+			domains example.org
+		}
+		deliver_to dummy`,
+		`postmaster admin@example.org {
+			domains example.org
+		}
+		postmaster admin@example.org {
+			domains example.org
+		}
+		deliver_to dummy`,
+	} {
+		if _, err := parse(str); err == nil {
+			t.Errorf("Expected an error for %s", str)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package msgtrace implements tracing of individual messages.
+//
+// If module.MsgMetadata.Trace is set, loggers created using
+// target.DeliveryLogger write debug messages for the message regardless
+// of the module configuration and all log lines for it are also saved to
+// the file in Dir named after the message ID.
+package msgtrace
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Header is the message header field authenticated clients can add to
+// enable tracing for the message. It is removed from the message.
+const Header = "X-Maddy-Trace"
+
+// MaxSize is the maximum size of a single trace. Lines past that are
+// dropped.
+const MaxSize = 1024 * 1024
+
+// ErrInvalidID is returned by Path for strings that can't be message IDs.
+var ErrInvalidID = errors.New("msgtrace: invalid message ID")
+
+// Dir returns the path to the directory traces are written to.
+func Dir() string {
+	return filepath.Join(config.RuntimeDirectory, "msgtraces")
+}
+
+// Path returns the path to the trace for the message with the specified ID.
+func Path(msgID string) (string, error) {
+	if msgID == "" || strings.ContainsAny(msgID, `/\`) || strings.HasPrefix(msgID, ".") {
+		return "", ErrInvalidID
+	}
+	return filepath.Join(Dir(), msgID+".log"), nil
+}
+
+type output struct {
+	out     log.Output
+	msgMeta *module.MsgMetadata
+}
+
+// Output returns the log.Output that passes lines to out (or
+// log.DefaultLogger.Out if out is nil) and also appends them to the trace if
+// msgMeta.Trace is set.
+func Output(out log.Output, msgMeta *module.MsgMetadata) log.Output {
+	return output{out: out, msgMeta: msgMeta}
+}
+
+func (o output) Write(stamp time.Time, debug bool, msg string) {
+	out := o.out
+	if out == nil {
+		out = log.DefaultLogger.Out
+	}
+	if out != nil {
+		out.Write(stamp, debug, msg)
+	}
+
+	if o.msgMeta.Trace {
+		if err := appendLine(o.msgMeta.ID, stamp, debug, msg); err != nil && out != nil {
+			out.Write(time.Now(), false, "msgtrace: "+err.Error())
+		}
+	}
+}
+
+// Close does nothing, the underlying output is shared with other loggers.
+func (o output) Close() error {
+	return nil
+}
+
+func appendLine(msgID string, stamp time.Time, debug bool, msg string) error {
+	path, err := Path(msgID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(Dir(), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() >= MaxSize {
+		return nil
+	}
+
+	var b strings.Builder
+	b.WriteString(stamp.Format("2006-01-02T15:04:05.000Z07:00"))
+	b.WriteByte(' ')
+	if debug {
+		b.WriteString("[debug] ")
+	}
+	b.WriteString(strings.TrimRight(msg, "\t"))
+	b.WriteByte('\n')
+	_, err = f.WriteString(b.String())
+	return err
+}
@@ -0,0 +1,79 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgtrace
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func TestOutput(t *testing.T) {
+	config.RuntimeDirectory = t.TempDir()
+	t.Cleanup(func() { config.RuntimeDirectory = "" })
+
+	var mainLog []string
+	msgMeta := &module.MsgMetadata{ID: "0123abcd"}
+	l := log.Logger{
+		Name: "test",
+		Out: Output(log.FuncOutput(func(_ time.Time, _ bool, msg string) {
+			mainLog = append(mainLog, strings.TrimSpace(msg))
+		}, func() error { return nil }), msgMeta),
+		DebugFunc: func() bool { return msgMeta.Trace },
+	}
+
+	l.Debugln("not traced")
+	l.Println("before")
+	msgMeta.Trace = true
+	l.Debugln("traced")
+	l.Println("after")
+
+	if want := []string{"test: before", "test: traced", "test: after"}; strings.Join(mainLog, "|") != strings.Join(want, "|") {
+		t.Errorf("wrong main log: %q", mainLog)
+	}
+
+	path, err := Path(msgMeta.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(trace), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines in the trace, got %q", lines)
+	}
+	if !strings.HasSuffix(lines[0], " [debug] test: traced") || !strings.HasSuffix(lines[1], " test: after") {
+		t.Errorf("wrong trace: %q", lines)
+	}
+}
+
+func TestPath(t *testing.T) {
+	for _, id := range []string{"", "../passwd", ".hidden", `a\b`} {
+		if _, err := Path(id); err != ErrInvalidID {
+			t.Errorf("Path(%q): expected ErrInvalidID, got %v", id, err)
+		}
+	}
+}
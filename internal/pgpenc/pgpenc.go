@@ -0,0 +1,220 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package pgpenc implements encryption of stored messages using the
+// recipient's public OpenPGP key.
+//
+// Keys are stored in a table (usually defined using the pgp_keys directive
+// of the storage module) keyed by the account name. Accounts without an
+// entry receive messages unencrypted.
+//
+// Messages are converted to PGP/MIME (RFC 3156) format. Only the message
+// body and content-related header fields are encrypted, other header fields
+// (From, To, Subject, etc.) are left as is so the messages can still be
+// searched and listed by IMAP clients.
+package pgpenc
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// contentFields are the header fields that describe the message body and
+// are moved into the encrypted part.
+var contentFields = []string{
+	"Content-Type",
+	"Content-Transfer-Encoding",
+	"Content-Disposition",
+	"Content-Id",
+	"Content-Description",
+	"Content-Language",
+}
+
+// ParseKey parses the public key in the ASCII-armored form or base64-encoded
+// binary form (suitable for tables that store single-line values).
+//
+// An error is returned if the key cannot be used for encryption.
+func ParseKey(val string) (openpgp.EntityList, error) {
+	val = strings.TrimSpace(val)
+
+	var (
+		keys openpgp.EntityList
+		err  error
+	)
+	if strings.HasPrefix(val, "-----BEGIN") {
+		keys, err = openpgp.ReadArmoredKeyRing(strings.NewReader(val))
+	} else {
+		var blob []byte
+		blob, err = base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return nil, fmt.Errorf("pgpenc: malformed key: %w", err)
+		}
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(blob))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("pgpenc: malformed key: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("pgpenc: no keys found")
+	}
+
+	now := time.Now()
+	for _, e := range keys {
+		if _, ok := e.EncryptionKey(now); !ok {
+			return nil, fmt.Errorf("pgpenc: key %X cannot be used for encryption", e.PrimaryKey.Fingerprint)
+		}
+	}
+	return keys, nil
+}
+
+// FormatKey serializes public keys into the form accepted by ParseKey that
+// fits into a single line.
+func FormatKey(keys openpgp.EntityList) (string, error) {
+	var b bytes.Buffer
+	for _, e := range keys {
+		if err := e.Serialize(&b); err != nil {
+			return "", err
+		}
+	}
+	return base64.StdEncoding.EncodeToString(b.Bytes()), nil
+}
+
+// Lookup returns the keys of the account stored in the table.
+//
+// nil is returned if tbl is nil or has no entry for the account.
+func Lookup(ctx context.Context, tbl module.Table, account string) (openpgp.EntityList, error) {
+	if tbl == nil {
+		return nil, nil
+	}
+	val, ok, err := tbl.Lookup(ctx, account)
+	if err != nil {
+		return nil, fmt.Errorf("pgpenc: %w", err)
+	}
+	if !ok {
+		return nil, nil
+	}
+	return ParseKey(val)
+}
+
+// IsEncrypted reports whether the message is already encrypted (using
+// PGP/MIME or S/MIME) and should not be encrypted again.
+func IsEncrypted(h textproto.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "multipart/encrypted", "application/pkcs7-mime", "application/x-pkcs7-mime":
+		return true
+	}
+	return false
+}
+
+// Encrypt converts the message into the PGP/MIME encrypted message. The
+// header is modified in place and the new body is returned.
+func Encrypt(h *textproto.Header, body io.Reader, keys openpgp.EntityList) ([]byte, error) {
+	inner := textproto.Header{}
+	for _, key := range contentFields {
+		for fields := h.FieldsByKey(key); fields.Next(); {
+			raw, err := fields.Raw()
+			if err != nil {
+				return nil, err
+			}
+			inner.AddRaw(raw)
+		}
+	}
+	if !inner.Has("Content-Type") {
+		inner.Set("Content-Type", "text/plain; charset=us-ascii")
+	}
+
+	var armored bytes.Buffer
+	aw, err := armor.Encode(&armored, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := openpgp.Encrypt(aw, keys, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := textproto.WriteHeader(pw, inner); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(pw, body); err != nil {
+		return nil, err
+	}
+	if err := pw.Close(); err != nil {
+		return nil, err
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+	armored.WriteString("\n")
+
+	var out bytes.Buffer
+	mw := textproto.NewMultipartWriter(&out)
+
+	ctlHdr := textproto.Header{}
+	ctlHdr.Set("Content-Type", "application/pgp-encrypted")
+	ctlHdr.Set("Content-Description", "PGP/MIME version identification")
+	w, err := mw.CreatePart(ctlHdr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, "Version: 1\r\n"); err != nil {
+		return nil, err
+	}
+
+	dataHdr := textproto.Header{}
+	dataHdr.Set("Content-Type", `application/octet-stream; name="encrypted.asc"`)
+	dataHdr.Set("Content-Disposition", `inline; filename="encrypted.asc"`)
+	dataHdr.Set("Content-Description", "OpenPGP encrypted message")
+	w, err = mw.CreatePart(dataHdr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(bytes.ReplaceAll(armored.Bytes(), []byte("\n"), []byte("\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	for _, key := range contentFields {
+		h.Del(key)
+	}
+	if !h.Has("MIME-Version") {
+		h.Set("MIME-Version", "1.0")
+	}
+	h.Set("Content-Type", mime.FormatMediaType("multipart/encrypted", map[string]string{
+		"protocol": "application/pgp-encrypted",
+		"boundary": mw.Boundary(),
+	}))
+	return out.Bytes(), nil
+}
@@ -0,0 +1,138 @@
+package pgpenc
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/emersion/go-message/textproto"
+)
+
+func testKey(t *testing.T) *openpgp.Entity {
+	t.Helper()
+	e, err := openpgp.NewEntity("Test", "", "test@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestParseKey(t *testing.T) {
+	e := testKey(t)
+
+	formatted, err := FormatKey(openpgp.EntityList{e})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.ContainsAny(formatted, "\r\n") {
+		t.Error("FormatKey result is not a single line")
+	}
+	keys, err := ParseKey(formatted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].PrimaryKey.KeyId != e.PrimaryKey.KeyId {
+		t.Error("Wrong key parsed")
+	}
+
+	var b bytes.Buffer
+	w, err := armor.Encode(&b, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	keys, err = ParseKey(b.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].PrimaryKey.KeyId != e.PrimaryKey.KeyId {
+		t.Error("Wrong key parsed")
+	}
+
+	if _, err := ParseKey("not a key"); err == nil {
+		t.Error("Expected an error for malformed key")
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	e := testKey(t)
+
+	h := textproto.Header{}
+	h.Add("Content-Type", "text/plain; charset=utf-8")
+	h.Add("Content-Transfer-Encoding", "8bit")
+	h.Add("Subject", "Secret")
+	h.Add("From", "<sender@example.org>")
+	if IsEncrypted(h) {
+		t.Error("Plain text message is considered encrypted")
+	}
+
+	body, err := Encrypt(&h, strings.NewReader("Hello!\r\n"), openpgp.EntityList{e})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Get("Subject") != "Secret" || h.Get("From") != "<sender@example.org>" {
+		t.Error("Header fields are not preserved")
+	}
+	if h.Has("Content-Transfer-Encoding") {
+		t.Error("Content-Transfer-Encoding is not removed")
+	}
+	if !IsEncrypted(h) {
+		t.Error("Encrypted message is not considered encrypted")
+	}
+	if bytes.Contains(body, []byte("Hello!")) {
+		t.Error("Body is not encrypted")
+	}
+
+	_, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := textproto.NewMultipartReader(bytes.NewReader(body), params["boundary"])
+	ctl, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctl.Header.Get("Content-Type") != "application/pgp-encrypted" {
+		t.Errorf("Wrong control part type: %s", ctl.Header.Get("Content-Type"))
+	}
+	data, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := armor.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{e}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := bufio.NewReader(md.UnverifiedBody)
+	inner, err := textproto.ReadHeader(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inner.Get("Content-Type") != "text/plain; charset=utf-8" || inner.Get("Content-Transfer-Encoding") != "8bit" {
+		t.Errorf("Wrong inner header: %v", inner)
+	}
+	if inner.Has("Subject") {
+		t.Error("Non-content fields are copied to the inner header")
+	}
+	innerBody, err := io.ReadAll(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(innerBody) != "Hello!\r\n" {
+		t.Errorf("Wrong decrypted body: %q", innerBody)
+	}
+}
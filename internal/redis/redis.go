@@ -0,0 +1,297 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package redis implements a minimal Redis client sufficient for the
+// commands used by maddy (key-value storage and pub/sub).
+package redis
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout = 10 * time.Second
+	ioTimeout   = 30 * time.Second
+)
+
+// Error is the error reply returned by the Redis server.
+type Error string
+
+func (err Error) Error() string {
+	return "redis: " + string(err)
+}
+
+// Options specify the server to connect to.
+type Options struct {
+	Network  string
+	Addr     string
+	Username string
+	Password string
+	DB       int
+	TLS      *tls.Config
+}
+
+// ParseURL parses the server URL. The following URL schemes are supported:
+//
+//	redis://[[username]:password@]host[:port][/db]
+//	rediss://[[username]:password@]host[:port][/db] (TLS)
+//	unix://[[username]:password@]/path/to/socket[?db=db]
+func ParseURL(redisURL string) (Options, error) {
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return Options{}, fmt.Errorf("redis: malformed URL: %w", err)
+	}
+
+	var opts Options
+	dbStr := u.Query().Get("db")
+	switch u.Scheme {
+	case "redis", "rediss":
+		opts.Network = "tcp"
+		opts.Addr = u.Host
+		if u.Port() == "" {
+			opts.Addr = net.JoinHostPort(u.Hostname(), "6379")
+		}
+		if u.Scheme == "rediss" {
+			opts.TLS = &tls.Config{ServerName: u.Hostname()}
+		}
+		if path := strings.TrimPrefix(u.Path, "/"); path != "" {
+			dbStr = path
+		}
+	case "unix":
+		opts.Network = "unix"
+		opts.Addr = u.Path
+	default:
+		return Options{}, fmt.Errorf("redis: unsupported URL scheme: %s", u.Scheme)
+	}
+	if dbStr != "" {
+		opts.DB, err = strconv.Atoi(dbStr)
+		if err != nil || opts.DB < 0 {
+			return Options{}, fmt.Errorf("redis: invalid database number: %s", dbStr)
+		}
+	}
+	if u.User != nil {
+		opts.Username = u.User.Username()
+		opts.Password, _ = u.User.Password()
+		// redis://password@host form used by some clients.
+		if opts.Password == "" {
+			opts.Password, opts.Username = opts.Username, ""
+		}
+	}
+	return opts, nil
+}
+
+// Conn is a single connection to the server.
+type Conn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+// Dial connects to the server, authenticates and selects the database if
+// necessary.
+func Dial(opts Options) (*Conn, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	var (
+		netConn net.Conn
+		err     error
+	)
+	if opts.TLS != nil {
+		netConn, err = tls.DialWithDialer(&dialer, opts.Network, opts.Addr, opts.TLS.Clone())
+	} else {
+		netConn, err = dialer.Dial(opts.Network, opts.Addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	conn := &Conn{Conn: netConn, br: bufio.NewReader(netConn)}
+
+	if opts.Password != "" {
+		args := []string{"AUTH", opts.Password}
+		if opts.Username != "" {
+			args = []string{"AUTH", opts.Username, opts.Password}
+		}
+		if _, err := conn.Do(args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis: authentication failed: %w", err)
+		}
+	}
+	if opts.DB != 0 {
+		if _, err := conn.Do("SELECT", strconv.Itoa(opts.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// Do sends the command and reads the reply.
+func (c *Conn) Do(args ...string) (interface{}, error) {
+	if err := c.SetDeadline(time.Now().Add(ioTimeout)); err != nil {
+		return nil, err
+	}
+	if err := c.Send(args...); err != nil {
+		return nil, err
+	}
+	return c.Receive()
+}
+
+// Send sends the command without waiting for the reply.
+func (c *Conn) Send(args ...string) error {
+	var sb strings.Builder
+	sb.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		sb.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+		sb.WriteString(arg)
+		sb.WriteString("\r\n")
+	}
+	_, err := io.WriteString(c.Conn, sb.String())
+	return err
+}
+
+// Receive reads a single reply, see ReadReply.
+func (c *Conn) Receive() (interface{}, error) {
+	return ReadReply(c.br)
+}
+
+// ReadReply reads a single RESP value. Simple and bulk strings are returned
+// as string, integers as int64, arrays as []interface{} and null values as
+// nil. Error replies are returned as Error.
+func ReadReply(br *bufio.Reader) (interface{}, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("redis: malformed reply: empty line")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		l, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed bulk string length: %w", err)
+		}
+		if l < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, l+2)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:l]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed array length: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		arr := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			val, err := ReadReply(br)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, val)
+		}
+		return arr, nil
+	default:
+		return nil, fmt.Errorf("redis: malformed reply: unknown type %q", line[0])
+	}
+}
+
+// Client is a goroutine-safe client that sends commands over a single
+// connection. The connection is reestablished if it is lost.
+type Client struct {
+	opts Options
+
+	lck  sync.Mutex
+	conn *Conn
+}
+
+// NewClient creates the Client and checks the server is reachable.
+func NewClient(opts Options) (*Client, error) {
+	conn, err := Dial(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{opts: opts, conn: conn}, nil
+}
+
+func (c *Client) do(args []string) (interface{}, error) {
+	if c.conn == nil {
+		conn, err := Dial(c.opts)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	}
+	return c.conn.Do(args...)
+}
+
+// Do sends the command and returns the reply. If the command fails due to
+// a network error, it is retried once using a new connection.
+func (c *Client) Do(args ...string) (interface{}, error) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	reply, err := c.do(args)
+	var redisErr Error
+	if err != nil && !errors.As(err, &redisErr) {
+		// Connection might have been closed by the server.
+		if c.conn != nil {
+			c.conn.Close()
+			c.conn = nil
+		}
+		reply, err = c.do(args)
+		if err != nil && !errors.As(err, &redisErr) && c.conn != nil {
+			c.conn.Close()
+			c.conn = nil
+		}
+	}
+	return reply, err
+}
+
+func (c *Client) Close() error {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
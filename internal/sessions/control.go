@@ -0,0 +1,44 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sessions
+
+import (
+	"errors"
+
+	"github.com/foxcpp/maddy/internal/control"
+)
+
+func init() {
+	control.Handle("sessions.list", func(map[string]string) (interface{}, error) {
+		return List(), nil
+	})
+	control.Handle("sessions.kill", func(args map[string]string) (interface{}, error) {
+		if username := args["username"]; username != "" {
+			return KillUser(username)
+		}
+		if id := args["id"]; id != "" {
+			info, err := Kill(id)
+			if err != nil {
+				return nil, err
+			}
+			return []Info{info}, nil
+		}
+		return nil, errors.New("sessions: id or username is required")
+	})
+}
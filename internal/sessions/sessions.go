@@ -0,0 +1,201 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sessions keeps track of active client sessions of all endpoints
+// so they can be listed and terminated at runtime.
+package sessions
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/authz"
+)
+
+var ErrNoSession = errors.New("sessions: no such session")
+
+// Info is the information about the active session.
+type Info struct {
+	ID         string    `json:"id"`
+	Protocol   string    `json:"protocol"`
+	Username   string    `json:"username,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Started    time.Time `json:"started"`
+	LastActive time.Time `json:"last_active"`
+}
+
+// Session is the tracked client session.
+type Session struct {
+	seq      uint64
+	id       string
+	protocol string
+	remote   string
+	started  time.Time
+	kill     func() error
+
+	lck        sync.Mutex
+	username   string
+	lastActive time.Time
+}
+
+var (
+	lastID   atomic.Uint64
+	lck      sync.Mutex
+	sessions = map[string]*Session{}
+)
+
+// Register adds the session to the list of active sessions. kill should
+// forcibly close the session connection.
+//
+// Close should be called once the session is closed.
+func Register(protocol string, remoteAddr net.Addr, kill func() error) *Session {
+	now := time.Now()
+	s := &Session{
+		seq:        lastID.Add(1),
+		protocol:   protocol,
+		started:    now,
+		lastActive: now,
+		kill:       kill,
+	}
+	s.id = strconv.FormatUint(s.seq, 10)
+	if remoteAddr != nil {
+		s.remote = remoteAddr.String()
+	}
+
+	lck.Lock()
+	sessions[s.id] = s
+	lck.Unlock()
+	return s
+}
+
+// SetUsername sets the name of the user authenticated in the session.
+func (s *Session) SetUsername(username string) {
+	if s == nil {
+		return
+	}
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	s.username = username
+}
+
+// Touch updates the time of the last client activity in the session.
+func (s *Session) Touch() {
+	if s == nil {
+		return
+	}
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	s.lastActive = time.Now()
+}
+
+// Close removes the session from the list of active sessions.
+func (s *Session) Close() {
+	if s == nil {
+		return
+	}
+	lck.Lock()
+	defer lck.Unlock()
+	delete(sessions, s.id)
+}
+
+func (s *Session) info() Info {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return Info{
+		ID:         s.id,
+		Protocol:   s.protocol,
+		Username:   s.username,
+		RemoteAddr: s.remote,
+		Started:    s.started,
+		LastActive: s.lastActive,
+	}
+}
+
+func active() []*Session {
+	lck.Lock()
+	defer lck.Unlock()
+	list := make([]*Session, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, s)
+	}
+	return list
+}
+
+// List returns the information about active sessions ordered by start
+// time.
+func List() []Info {
+	list := active()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].seq < list[j].seq
+	})
+	infos := make([]Info, 0, len(list))
+	for _, s := range list {
+		infos = append(infos, s.info())
+	}
+	return infos
+}
+
+// Kill terminates the session with the specified ID.
+func Kill(id string) (Info, error) {
+	lck.Lock()
+	s := sessions[id]
+	lck.Unlock()
+	if s == nil {
+		return Info{}, ErrNoSession
+	}
+
+	info := s.info()
+	s.Close()
+	return info, s.kill()
+}
+
+// KillUser terminates all sessions of the user and returns the terminated
+// ones.
+func KillUser(username string) ([]Info, error) {
+	key := normalize(username)
+
+	var (
+		killed  []Info
+		lastErr error
+	)
+	for _, s := range active() {
+		info := s.info()
+		if info.Username == "" || normalize(info.Username) != key {
+			continue
+		}
+		s.Close()
+		if err := s.kill(); err != nil {
+			lastErr = err
+		}
+		killed = append(killed, info)
+	}
+	return killed, lastErr
+}
+
+func normalize(username string) string {
+	norm, err := authz.NormalizeAuto(username)
+	if err != nil {
+		return username
+	}
+	return norm
+}
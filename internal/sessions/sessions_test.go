@@ -0,0 +1,86 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sessions
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestSessions(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	var killed []string
+	register := func(proto string) *Session {
+		var s *Session
+		s = Register(proto, addr, func() error {
+			killed = append(killed, s.id)
+			return nil
+		})
+		t.Cleanup(s.Close)
+		return s
+	}
+
+	s1 := register("imap")
+	s1.SetUsername("Foxcpp@Example.org")
+	s2 := register("submission")
+	s2.SetUsername("foxcpp@example.org")
+	s3 := register("smtp")
+
+	list := List()
+	if len(list) != 3 {
+		t.Fatalf("expected 3 sessions, got %v", list)
+	}
+	for i, s := range []*Session{s1, s2, s3} {
+		if list[i].ID != s.id {
+			t.Errorf("wrong order: %v", list)
+		}
+	}
+	if list[0].RemoteAddr != "127.0.0.1:1234" || list[0].Protocol != "imap" {
+		t.Errorf("wrong info: %+v", list[0])
+	}
+
+	infos, err := KillUser("foxcpp@EXAMPLE.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || len(killed) != 2 {
+		t.Fatalf("expected 2 sessions to be killed, got %v", infos)
+	}
+	if list := List(); len(list) != 1 || list[0].ID != s3.id {
+		t.Errorf("killed sessions are not removed: %v", list)
+	}
+
+	if _, err := Kill(s3.id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Kill(s3.id); !errors.Is(err, ErrNoSession) {
+		t.Errorf("expected ErrNoSession, got %v", err)
+	}
+	if len(List()) != 0 {
+		t.Errorf("session is not removed: %v", List())
+	}
+}
+
+func TestSessions_Nil(t *testing.T) {
+	var s *Session
+	s.SetUsername("foxcpp")
+	s.Touch()
+	s.Close()
+}
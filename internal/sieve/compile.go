@@ -0,0 +1,422 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Extensions lists the extensions that can be used in the require command.
+var Extensions = []string{
+	"comparator-i;ascii-casemap",
+	"comparator-i;octet",
+	"envelope",
+	"fileinto",
+	"vacation",
+}
+
+// Script is a compiled Sieve script.
+type Script struct {
+	cmds []command
+}
+
+// Parse parses and validates the script.
+func Parse(src string) (*Script, error) {
+	nodes, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	c := compiler{requires: map[string]bool{}}
+	cmds, err := c.commands(nodes, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{cmds: cmds}, nil
+}
+
+type compiler struct {
+	requires map[string]bool
+}
+
+func errorf(line int, format string, args ...interface{}) error {
+	return &Error{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (c *compiler) require(line int, ext string) error {
+	if !c.requires[ext] {
+		return errorf(line, "missing require %q", ext)
+	}
+	return nil
+}
+
+func (c *compiler) commands(nodes []commandNode, topLevel bool) ([]command, error) {
+	cmds := make([]command, 0, len(nodes))
+	requireAllowed := topLevel
+	for i := 0; i < len(nodes); i++ {
+		node := nodes[i]
+		if node.name == "require" {
+			if !requireAllowed {
+				return nil, errorf(node.line, "require is allowed only at the beginning of the script")
+			}
+			if err := c.requireCmd(node); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		requireAllowed = false
+
+		if node.name == "elsif" || node.name == "else" {
+			return nil, errorf(node.line, "%s without if", node.name)
+		}
+
+		if node.name == "if" {
+			cmd, next, err := c.ifCmd(nodes, i)
+			if err != nil {
+				return nil, err
+			}
+			cmds = append(cmds, cmd)
+			i = next - 1
+			continue
+		}
+
+		if node.hasBlock {
+			return nil, errorf(node.line, "%s does not take a block", node.name)
+		}
+		if len(node.tests) != 0 {
+			return nil, errorf(node.line, "%s does not take tests", node.name)
+		}
+		cmd, err := c.action(node)
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+func (c *compiler) requireCmd(node commandNode) error {
+	if len(node.args) != 1 || node.args[0].kind != argStrings || len(node.tests) != 0 || node.hasBlock {
+		return errorf(node.line, "require expects a string list")
+	}
+	for _, ext := range node.args[0].strs {
+		supported := false
+		for _, known := range Extensions {
+			if ext == known {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return errorf(node.line, "unsupported extension: %s", ext)
+		}
+		c.requires[ext] = true
+	}
+	return nil
+}
+
+// ifCmd compiles the if command starting at nodes[i] together with
+// following elsif and else commands. It returns the index of the first
+// command after the chain.
+func (c *compiler) ifCmd(nodes []commandNode, i int) (command, int, error) {
+	var cmd cmdIf
+	for ; i < len(nodes); i++ {
+		node := nodes[i]
+		if len(cmd.branches) != 0 && node.name != "elsif" && node.name != "else" {
+			break
+		}
+		if !node.hasBlock {
+			return nil, 0, errorf(node.line, "%s requires a block", node.name)
+		}
+		if len(node.args) != 0 {
+			return nil, 0, errorf(node.line, "unexpected %v for %s", node.args[0], node.name)
+		}
+		block, err := c.commands(node.block, false)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if node.name == "else" {
+			if len(node.tests) != 0 {
+				return nil, 0, errorf(node.line, "else does not take tests")
+			}
+			cmd.elseBlock = block
+			cmd.hasElse = true
+			i++
+			break
+		}
+
+		if len(node.tests) != 1 {
+			return nil, 0, errorf(node.line, "%s requires exactly one test", node.name)
+		}
+		t, err := c.test(node.tests[0])
+		if err != nil {
+			return nil, 0, err
+		}
+		cmd.branches = append(cmd.branches, ifBranch{test: t, block: block})
+	}
+	return cmd, i, nil
+}
+
+func (c *compiler) action(node commandNode) (command, error) {
+	switch node.name {
+	case "stop":
+		if len(node.args) != 0 {
+			return nil, errorf(node.line, "stop does not take arguments")
+		}
+		return cmdStop{}, nil
+	case "keep":
+		if len(node.args) != 0 {
+			return nil, errorf(node.line, "keep does not take arguments")
+		}
+		return cmdKeep{}, nil
+	case "discard":
+		if len(node.args) != 0 {
+			return nil, errorf(node.line, "discard does not take arguments")
+		}
+		return cmdDiscard{}, nil
+	case "redirect":
+		addr, err := singleString(node.name, node.line, node.args)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.Contains(addr, "@") {
+			return nil, errorf(node.line, "redirect: invalid address: %s", addr)
+		}
+		return cmdRedirect{addr: addr}, nil
+	case "fileinto":
+		if err := c.require(node.line, "fileinto"); err != nil {
+			return nil, err
+		}
+		mbox, err := singleString(node.name, node.line, node.args)
+		if err != nil {
+			return nil, err
+		}
+		return cmdFileinto{mailbox: mbox}, nil
+	case "vacation":
+		if err := c.require(node.line, "vacation"); err != nil {
+			return nil, err
+		}
+		return c.vacation(node)
+	}
+	return nil, errorf(node.line, "unknown command: %s", node.name)
+}
+
+func singleString(name string, line int, args []argument) (string, error) {
+	if len(args) != 1 || args[0].kind != argStrings || len(args[0].strs) != 1 {
+		return "", errorf(line, "%s expects a single string", name)
+	}
+	return args[0].strs[0], nil
+}
+
+func (c *compiler) vacation(node commandNode) (command, error) {
+	v := cmdVacation{days: 7}
+	args := node.args
+	for len(args) > 1 {
+		if args[0].kind != argTag {
+			return nil, errorf(args[0].line, "vacation: unexpected %v", args[0])
+		}
+		tag := args[0].tag
+		if tag == "mime" {
+			v.mime = true
+			args = args[1:]
+			continue
+		}
+		val := args[1]
+		switch tag {
+		case "days":
+			if val.kind != argNumber {
+				return nil, errorf(val.line, "vacation: number expected after :days")
+			}
+			v.days = int(val.num)
+			if v.days < 1 {
+				v.days = 1
+			}
+		case "subject", "from", "handle":
+			if val.kind != argStrings || len(val.strs) != 1 {
+				return nil, errorf(val.line, "vacation: string expected after :%s", tag)
+			}
+			switch tag {
+			case "subject":
+				v.subject = val.strs[0]
+			case "from":
+				v.from = val.strs[0]
+			case "handle":
+				v.handle = val.strs[0]
+			}
+		case "addresses":
+			if val.kind != argStrings {
+				return nil, errorf(val.line, "vacation: string list expected after :addresses")
+			}
+			v.addresses = val.strs
+		default:
+			return nil, errorf(args[0].line, "vacation: unknown tag :%s", tag)
+		}
+		args = args[2:]
+	}
+	if len(args) != 1 || args[0].kind != argStrings || len(args[0].strs) != 1 {
+		return nil, errorf(node.line, "vacation: reason string is required")
+	}
+	v.reason = args[0].strs[0]
+	return v, nil
+}
+
+// matchArgs parses comparator, match type and (if allowed) address part
+// tagged arguments and returns the remaining positional arguments.
+func (c *compiler) matchArgs(node testNode, addrPart bool) (matcher, string, []argument, error) {
+	m := matcher{comparator: "i;ascii-casemap", matchType: "is"}
+	part := "all"
+	var seenComparator, seenMatch, seenPart bool
+
+	args := node.args
+	for len(args) != 0 && args[0].kind == argTag {
+		tag := args[0].tag
+		switch tag {
+		case "comparator":
+			if seenComparator {
+				return m, "", nil, errorf(args[0].line, "%s: duplicate :comparator", node.name)
+			}
+			seenComparator = true
+			if len(args) < 2 || args[1].kind != argStrings || len(args[1].strs) != 1 {
+				return m, "", nil, errorf(args[0].line, "%s: comparator name expected", node.name)
+			}
+			m.comparator = args[1].strs[0]
+			// Both supported comparators can be used without require
+			// (RFC 5228 Section 2.7.3).
+			if m.comparator != "i;ascii-casemap" && m.comparator != "i;octet" {
+				return m, "", nil, errorf(args[0].line, "%s: unsupported comparator: %s", node.name, m.comparator)
+			}
+			args = args[2:]
+			continue
+		case "is", "contains", "matches":
+			if seenMatch {
+				return m, "", nil, errorf(args[0].line, "%s: duplicate match type", node.name)
+			}
+			seenMatch = true
+			m.matchType = tag
+		case "all", "localpart", "domain":
+			if !addrPart {
+				return m, "", nil, errorf(args[0].line, "%s: unexpected tag :%s", node.name, tag)
+			}
+			if seenPart {
+				return m, "", nil, errorf(args[0].line, "%s: duplicate address part", node.name)
+			}
+			seenPart = true
+			part = tag
+		default:
+			return m, "", nil, errorf(args[0].line, "%s: unknown tag :%s", node.name, tag)
+		}
+		args = args[1:]
+	}
+	return m, part, args, nil
+}
+
+func twoStringLists(name string, line int, args []argument) ([]string, []string, error) {
+	if len(args) != 2 || args[0].kind != argStrings || args[1].kind != argStrings {
+		return nil, nil, errorf(line, "%s expects two string lists", name)
+	}
+	return args[0].strs, args[1].strs, nil
+}
+
+func (c *compiler) test(node testNode) (test, error) {
+	switch node.name {
+	case "allof", "anyof":
+		if len(node.args) != 0 || len(node.tests) == 0 {
+			return nil, errorf(node.line, "%s expects a test list", node.name)
+		}
+		tests := make([]test, 0, len(node.tests))
+		for _, sub := range node.tests {
+			t, err := c.test(sub)
+			if err != nil {
+				return nil, err
+			}
+			tests = append(tests, t)
+		}
+		if node.name == "allof" {
+			return testAllOf{tests: tests}, nil
+		}
+		return testAnyOf{tests: tests}, nil
+	case "not":
+		if len(node.args) != 0 || len(node.tests) != 1 {
+			return nil, errorf(node.line, "not expects a single test")
+		}
+		t, err := c.test(node.tests[0])
+		if err != nil {
+			return nil, err
+		}
+		return testNot{test: t}, nil
+	}
+
+	if len(node.tests) != 0 {
+		return nil, errorf(node.line, "%s does not take tests", node.name)
+	}
+
+	switch node.name {
+	case "true", "false":
+		if len(node.args) != 0 {
+			return nil, errorf(node.line, "%s does not take arguments", node.name)
+		}
+		return testConst(node.name == "true"), nil
+	case "exists":
+		if len(node.args) != 1 || node.args[0].kind != argStrings {
+			return nil, errorf(node.line, "exists expects a string list")
+		}
+		return testExists{headers: node.args[0].strs}, nil
+	case "size":
+		if len(node.args) != 2 || node.args[0].kind != argTag || node.args[1].kind != argNumber ||
+			(node.args[0].tag != "over" && node.args[0].tag != "under") {
+			return nil, errorf(node.line, "size expects :over or :under and a number")
+		}
+		return testSize{over: node.args[0].tag == "over", limit: node.args[1].num}, nil
+	case "header":
+		m, _, args, err := c.matchArgs(node, false)
+		if err != nil {
+			return nil, err
+		}
+		headers, keys, err := twoStringLists(node.name, node.line, args)
+		if err != nil {
+			return nil, err
+		}
+		return testHeader{matcher: m, headers: headers, keys: keys}, nil
+	case "address", "envelope":
+		if node.name == "envelope" {
+			if err := c.require(node.line, "envelope"); err != nil {
+				return nil, err
+			}
+		}
+		m, part, args, err := c.matchArgs(node, true)
+		if err != nil {
+			return nil, err
+		}
+		headers, keys, err := twoStringLists(node.name, node.line, args)
+		if err != nil {
+			return nil, err
+		}
+		if node.name == "envelope" {
+			for _, h := range headers {
+				if !strings.EqualFold(h, "from") && !strings.EqualFold(h, "to") {
+					return nil, errorf(node.line, "envelope: unsupported envelope part: %s", h)
+				}
+			}
+		}
+		return testAddress{matcher: m, part: part, headers: headers, keys: keys, envelope: node.name == "envelope"}, nil
+	}
+	return nil, errorf(node.line, "unknown test: %s", node.name)
+}
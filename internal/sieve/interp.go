@@ -0,0 +1,371 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"errors"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/textproto"
+)
+
+// MaxRedirects is the maximum amount of redirect actions executed for a
+// single message.
+const MaxRedirects = 4
+
+// Message contains the message information available to the script.
+type Message struct {
+	Header textproto.Header
+	// Size is the size of the message including the header.
+	Size int64
+
+	EnvelopeFrom string
+	EnvelopeTo   string
+}
+
+// Vacation is the auto-reply requested by the vacation action.
+type Vacation struct {
+	Days      int
+	Subject   string
+	From      string
+	Addresses []string
+	// If MIME is set, Reason contains a MIME entity (header and body)
+	// instead of plain text.
+	MIME   bool
+	Handle string
+	Reason string
+}
+
+// Result lists the actions to take for the message.
+type Result struct {
+	// Keep is set if the message should be stored in the default mailbox.
+	// It is set either by keep or if the implicit keep is not cancelled.
+	Keep     bool
+	Fileinto []string
+	Redirect []string
+	Vacation *Vacation
+}
+
+// Discard reports whether the message should not be stored at all.
+func (r *Result) Discard() bool {
+	return !r.Keep && len(r.Fileinto) == 0
+}
+
+type execState struct {
+	msg *Message
+	res Result
+
+	implicitKeep bool
+	stopped      bool
+}
+
+// Execute runs the script for the message.
+//
+// If an error is returned, the message should be stored as if no script
+// was executed (RFC 5228 Section 2.10.6).
+func (s *Script) Execute(msg *Message) (*Result, error) {
+	state := execState{msg: msg, implicitKeep: true}
+	if err := execBlock(&state, s.cmds); err != nil {
+		return nil, err
+	}
+	if state.implicitKeep {
+		state.res.Keep = true
+	}
+	return &state.res, nil
+}
+
+func execBlock(state *execState, cmds []command) error {
+	for _, cmd := range cmds {
+		if err := cmd.exec(state); err != nil {
+			return err
+		}
+		if state.stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+type command interface {
+	exec(state *execState) error
+}
+
+type ifBranch struct {
+	test  test
+	block []command
+}
+
+type cmdIf struct {
+	branches  []ifBranch
+	elseBlock []command
+	hasElse   bool
+}
+
+func (c cmdIf) exec(state *execState) error {
+	for _, b := range c.branches {
+		if b.test.eval(state.msg) {
+			return execBlock(state, b.block)
+		}
+	}
+	if c.hasElse {
+		return execBlock(state, c.elseBlock)
+	}
+	return nil
+}
+
+type cmdStop struct{}
+
+func (cmdStop) exec(state *execState) error {
+	state.stopped = true
+	return nil
+}
+
+type cmdKeep struct{}
+
+func (cmdKeep) exec(state *execState) error {
+	state.res.Keep = true
+	state.implicitKeep = false
+	return nil
+}
+
+type cmdDiscard struct{}
+
+func (cmdDiscard) exec(state *execState) error {
+	state.implicitKeep = false
+	return nil
+}
+
+type cmdRedirect struct {
+	addr string
+}
+
+func (c cmdRedirect) exec(state *execState) error {
+	state.implicitKeep = false
+	for _, addr := range state.res.Redirect {
+		if strings.EqualFold(addr, c.addr) {
+			return nil
+		}
+	}
+	if len(state.res.Redirect) >= MaxRedirects {
+		return errors.New("sieve: too many redirects")
+	}
+	state.res.Redirect = append(state.res.Redirect, c.addr)
+	return nil
+}
+
+type cmdFileinto struct {
+	mailbox string
+}
+
+func (c cmdFileinto) exec(state *execState) error {
+	state.implicitKeep = false
+	for _, mbox := range state.res.Fileinto {
+		if mbox == c.mailbox {
+			return nil
+		}
+	}
+	state.res.Fileinto = append(state.res.Fileinto, c.mailbox)
+	return nil
+}
+
+type cmdVacation struct {
+	days      int
+	subject   string
+	from      string
+	addresses []string
+	mime      bool
+	handle    string
+	reason    string
+}
+
+func (c cmdVacation) exec(state *execState) error {
+	if state.res.Vacation != nil {
+		return errors.New("sieve: vacation can be executed only once")
+	}
+	state.res.Vacation = &Vacation{
+		Days:      c.days,
+		Subject:   c.subject,
+		From:      c.from,
+		Addresses: c.addresses,
+		MIME:      c.mime,
+		Handle:    c.handle,
+		Reason:    c.reason,
+	}
+	return nil
+}
+
+type test interface {
+	eval(msg *Message) bool
+}
+
+type testConst bool
+
+func (t testConst) eval(*Message) bool {
+	return bool(t)
+}
+
+type testNot struct {
+	test test
+}
+
+func (t testNot) eval(msg *Message) bool {
+	return !t.test.eval(msg)
+}
+
+type testAllOf struct {
+	tests []test
+}
+
+func (t testAllOf) eval(msg *Message) bool {
+	for _, sub := range t.tests {
+		if !sub.eval(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+type testAnyOf struct {
+	tests []test
+}
+
+func (t testAnyOf) eval(msg *Message) bool {
+	for _, sub := range t.tests {
+		if sub.eval(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+type testExists struct {
+	headers []string
+}
+
+func (t testExists) eval(msg *Message) bool {
+	for _, h := range t.headers {
+		if !msg.Header.Has(h) {
+			return false
+		}
+	}
+	return true
+}
+
+type testSize struct {
+	over  bool
+	limit int64
+}
+
+func (t testSize) eval(msg *Message) bool {
+	if t.over {
+		return msg.Size > t.limit
+	}
+	return msg.Size < t.limit
+}
+
+var wordDecoder = mime.WordDecoder{CharsetReader: charset.Reader}
+
+// decodeHeader decodes MIME encoded-words in the header field value.
+func decodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+type testHeader struct {
+	matcher matcher
+	headers []string
+	keys    []string
+}
+
+func (t testHeader) eval(msg *Message) bool {
+	for _, h := range t.headers {
+		for _, value := range msg.Header.Values(h) {
+			if t.matcher.match(decodeHeader(strings.TrimSpace(value)), t.keys) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type testAddress struct {
+	matcher  matcher
+	part     string
+	headers  []string
+	keys     []string
+	envelope bool
+}
+
+func (t testAddress) addresses(msg *Message, name string) []string {
+	if t.envelope {
+		if strings.EqualFold(name, "from") {
+			return []string{msg.EnvelopeFrom}
+		}
+		return []string{msg.EnvelopeTo}
+	}
+
+	var addrs []string
+	for _, value := range msg.Header.Values(name) {
+		list, err := mail.ParseAddressList(value)
+		if err != nil {
+			// Use the raw value, it is better than ignoring the field
+			// completely.
+			addrs = append(addrs, strings.TrimSpace(value))
+			continue
+		}
+		for _, addr := range list {
+			addrs = append(addrs, addr.Address)
+		}
+	}
+	return addrs
+}
+
+func addressPart(addr, part string) string {
+	switch part {
+	case "localpart":
+		if i := strings.LastIndexByte(addr, '@'); i != -1 {
+			return addr[:i]
+		}
+		return addr
+	case "domain":
+		if i := strings.LastIndexByte(addr, '@'); i != -1 {
+			return addr[i+1:]
+		}
+		return ""
+	default:
+		return addr
+	}
+}
+
+func (t testAddress) eval(msg *Message) bool {
+	for _, h := range t.headers {
+		for _, addr := range t.addresses(msg, h) {
+			if t.matcher.match(addressPart(addr, t.part), t.keys) {
+				return true
+			}
+		}
+	}
+	return false
+}
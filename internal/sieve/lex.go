@@ -0,0 +1,288 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sieve implements the Sieve mail filtering language (RFC 5228)
+// with fileinto, envelope and vacation (RFC 5230) extensions.
+package sieve
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokTag
+	tokNumber
+	tokString
+	tokLBracket
+	tokRBracket
+	tokLParen
+	tokRParen
+	tokLBrace
+	tokRBrace
+	tokComma
+	tokSemicolon
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokEOF:
+		return "end of script"
+	case tokIdent:
+		return "identifier"
+	case tokTag:
+		return "tag"
+	case tokNumber:
+		return "number"
+	case tokString:
+		return "string"
+	case tokLBracket:
+		return "'['"
+	case tokRBracket:
+		return "']'"
+	case tokLParen:
+		return "'('"
+	case tokRParen:
+		return "')'"
+	case tokLBrace:
+		return "'{'"
+	case tokRBrace:
+		return "'}'"
+	case tokComma:
+		return "','"
+	case tokSemicolon:
+		return "';'"
+	}
+	return "unknown token"
+}
+
+type token struct {
+	kind tokenKind
+	val  string
+	num  int64
+	line int
+}
+
+// Error is a syntax or semantic error in the script.
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+var punctuation = map[byte]tokenKind{
+	'[': tokLBracket, ']': tokRBracket,
+	'(': tokLParen, ')': tokRParen,
+	'{': tokLBrace, '}': tokRBrace,
+	',': tokComma, ';': tokSemicolon,
+}
+
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return &Error{Line: l.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func isIdentStart(b byte) bool {
+	return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+func isIdentChar(b byte) bool {
+	return isIdentStart(b) || (b >= '0' && b <= '9')
+}
+
+func (l *lexer) skipSpace() error {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end == -1 {
+				return l.errorf("unterminated comment")
+			}
+			comment := l.src[l.pos : l.pos+2+end+2]
+			l.line += strings.Count(comment, "\n")
+			l.pos += len(comment)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skipSpace(); err != nil {
+		return token{}, err
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, line: l.line}, nil
+	}
+
+	line := l.line
+	c := l.src[l.pos]
+	if kind, ok := punctuation[c]; ok {
+		l.pos++
+		return token{kind: kind, line: line}, nil
+	}
+
+	switch {
+	case c == '"':
+		s, err := l.quotedString()
+		return token{kind: tokString, val: s, line: line}, err
+	case c == ':':
+		l.pos++
+		start := l.pos
+		if l.pos >= len(l.src) || !isIdentStart(l.src[l.pos]) {
+			return token{}, l.errorf("tag name expected after ':'")
+		}
+		for l.pos < len(l.src) && isIdentChar(l.src[l.pos]) {
+			l.pos++
+		}
+		return token{kind: tokTag, val: strings.ToLower(l.src[start:l.pos]), line: line}, nil
+	case c >= '0' && c <= '9':
+		return l.number()
+	case isIdentStart(c):
+		start := l.pos
+		for l.pos < len(l.src) && isIdentChar(l.src[l.pos]) {
+			l.pos++
+		}
+		ident := l.src[start:l.pos]
+		if strings.EqualFold(ident, "text") && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			s, err := l.multilineString()
+			return token{kind: tokString, val: s, line: line}, err
+		}
+		return token{kind: tokIdent, val: strings.ToLower(ident), line: line}, nil
+	}
+
+	return token{}, l.errorf("unexpected character: %q", c)
+}
+
+func (l *lexer) number() (token, error) {
+	line := l.line
+	var num int64
+	for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+		num = num*10 + int64(l.src[l.pos]-'0')
+		if num > 1<<40 {
+			return token{}, l.errorf("number is too big")
+		}
+		l.pos++
+	}
+	if l.pos < len(l.src) {
+		switch l.src[l.pos] {
+		case 'K', 'k':
+			num <<= 10
+			l.pos++
+		case 'M', 'm':
+			num <<= 20
+			l.pos++
+		case 'G', 'g':
+			num <<= 30
+			l.pos++
+		}
+	}
+	return token{kind: tokNumber, num: num, line: line}, nil
+}
+
+func (l *lexer) quotedString() (string, error) {
+	l.pos++ // opening quote
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return b.String(), nil
+		case '\\':
+			// RFC 5228 Section 2.4.2: only \\ and \" are defined, other
+			// escapes are replaced with the escaped character.
+			l.pos++
+			if l.pos >= len(l.src) {
+				return "", l.errorf("unterminated string")
+			}
+			c = l.src[l.pos]
+		case '\r':
+			l.pos++
+			continue
+		case '\n':
+			l.line++
+		}
+		b.WriteByte(c)
+		l.pos++
+	}
+	return "", l.errorf("unterminated string")
+}
+
+func (l *lexer) multilineString() (string, error) {
+	// Whitespace and a hash comment are allowed after "text:".
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t') {
+		l.pos++
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '#' {
+		for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+			l.pos++
+		}
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '\r' {
+		l.pos++
+	}
+	if l.pos >= len(l.src) || l.src[l.pos] != '\n' {
+		return "", l.errorf("line break expected after 'text:'")
+	}
+	l.pos++
+	l.line++
+
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		if end == -1 {
+			break
+		}
+		line := strings.TrimSuffix(l.src[l.pos:l.pos+end], "\r")
+		l.pos += end + 1
+		l.line++
+
+		if line == "." {
+			return b.String(), nil
+		}
+		// Lines starting with a dot are dot-stuffed.
+		line = strings.TrimPrefix(line, ".")
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return "", l.errorf("unterminated multi-line string")
+}
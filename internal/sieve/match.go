@@ -0,0 +1,130 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+type matcher struct {
+	comparator string
+	matchType  string
+}
+
+func asciiLower(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 'A' && s[i] <= 'Z' {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				if b[j] >= 'A' && b[j] <= 'Z' {
+					b[j] += 'a' - 'A'
+				}
+			}
+			return string(b)
+		}
+	}
+	return s
+}
+
+func (m matcher) match(value string, keys []string) bool {
+	fold := m.comparator == "i;ascii-casemap"
+	if fold {
+		value = asciiLower(value)
+	}
+	for _, key := range keys {
+		if fold {
+			key = asciiLower(key)
+		}
+		switch m.matchType {
+		case "is":
+			if value == key {
+				return true
+			}
+		case "contains":
+			if strings.Contains(value, key) {
+				return true
+			}
+		case "matches":
+			if matchGlob(key, value, m.comparator == "i;octet") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchGlob implements the :matches match type. '*' matches zero or more
+// characters, '?' matches exactly one character and '\' escapes the
+// following character.
+//
+// For i;octet comparator, '?' matches a single octet instead of a
+// character.
+func matchGlob(pattern, value string, octet bool) bool {
+	// Positions to backtrack to after the last '*'.
+	starPattern, starValue := -1, -1
+
+	p, v := 0, 0
+	for v < len(value) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starPattern = p
+				starValue = v
+				p++
+				continue
+			case '?':
+				p++
+				v += charLen(value[v:], octet)
+				continue
+			default:
+				pc := pattern[p]
+				pl := 1
+				if pc == '\\' && p+1 < len(pattern) {
+					pc = pattern[p+1]
+					pl = 2
+				}
+				if value[v] == pc {
+					p += pl
+					v++
+					continue
+				}
+			}
+		}
+		if starPattern == -1 {
+			return false
+		}
+		// Let the last '*' consume one more character and retry.
+		starValue += charLen(value[starValue:], octet)
+		p = starPattern + 1
+		v = starValue
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+func charLen(s string, octet bool) int {
+	if octet {
+		return 1
+	}
+	_, size := utf8.DecodeRuneInString(s)
+	return size
+}
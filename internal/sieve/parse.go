@@ -0,0 +1,263 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"fmt"
+)
+
+type argKind int
+
+const (
+	argTag argKind = iota
+	argNumber
+	argStrings
+)
+
+// argument is a positional or tagged argument of a command or a test.
+type argument struct {
+	kind argKind
+	tag  string
+	num  int64
+	strs []string
+	line int
+}
+
+func (a argument) String() string {
+	switch a.kind {
+	case argTag:
+		return "tag :" + a.tag
+	case argNumber:
+		return "number"
+	default:
+		return "string list"
+	}
+}
+
+type testNode struct {
+	name  string
+	args  []argument
+	tests []testNode
+	line  int
+}
+
+type commandNode struct {
+	name     string
+	args     []argument
+	tests    []testNode
+	block    []commandNode
+	hasBlock bool
+	line     int
+}
+
+// maxNesting limits the depth of nested blocks and tests to protect
+// against stack exhaustion on malicious scripts.
+const maxNesting = 32
+
+type parser struct {
+	lex   lexer
+	tok   token
+	depth int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &Error{Line: p.tok.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) expect(kind tokenKind) error {
+	if p.tok.kind != kind {
+		return p.errorf("%v expected, got %v", kind, p.tok.kind)
+	}
+	return p.advance()
+}
+
+func parse(src string) ([]commandNode, error) {
+	p := parser{lex: lexer{src: src, line: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	cmds, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %v", p.tok.kind)
+	}
+	return cmds, nil
+}
+
+func (p *parser) commands() ([]commandNode, error) {
+	var cmds []commandNode
+	for p.tok.kind == tokIdent {
+		cmd, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+func (p *parser) command() (commandNode, error) {
+	cmd := commandNode{name: p.tok.val, line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return cmd, err
+	}
+
+	var err error
+	cmd.args, cmd.tests, err = p.arguments()
+	if err != nil {
+		return cmd, err
+	}
+
+	switch p.tok.kind {
+	case tokSemicolon:
+		return cmd, p.advance()
+	case tokLBrace:
+		p.depth++
+		if p.depth > maxNesting {
+			return cmd, p.errorf("too many nested blocks")
+		}
+		if err := p.advance(); err != nil {
+			return cmd, err
+		}
+		cmd.hasBlock = true
+		cmd.block, err = p.commands()
+		if err != nil {
+			return cmd, err
+		}
+		p.depth--
+		return cmd, p.expect(tokRBrace)
+	default:
+		return cmd, p.errorf("';' or '{' expected after %s, got %v", cmd.name, p.tok.kind)
+	}
+}
+
+func (p *parser) arguments() ([]argument, []testNode, error) {
+	var args []argument
+	for {
+		arg := argument{line: p.tok.line}
+		switch p.tok.kind {
+		case tokTag:
+			arg.kind = argTag
+			arg.tag = p.tok.val
+		case tokNumber:
+			arg.kind = argNumber
+			arg.num = p.tok.num
+		case tokString:
+			arg.kind = argStrings
+			arg.strs = []string{p.tok.val}
+		case tokLBracket:
+			arg.kind = argStrings
+			strs, err := p.stringList()
+			if err != nil {
+				return nil, nil, err
+			}
+			arg.strs = strs
+			args = append(args, arg)
+			continue
+		case tokIdent:
+			test, err := p.test()
+			if err != nil {
+				return nil, nil, err
+			}
+			return args, []testNode{test}, nil
+		case tokLParen:
+			tests, err := p.testList()
+			return args, tests, err
+		default:
+			return args, nil, nil
+		}
+		args = append(args, arg)
+		if err := p.advance(); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func (p *parser) stringList() ([]string, error) {
+	if err := p.expect(tokLBracket); err != nil {
+		return nil, err
+	}
+	var strs []string
+	for {
+		if p.tok.kind != tokString {
+			return nil, p.errorf("string expected in the list, got %v", p.tok.kind)
+		}
+		strs = append(strs, p.tok.val)
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind == tokRBracket {
+			return strs, p.advance()
+		}
+		if err := p.expect(tokComma); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) test() (testNode, error) {
+	if p.tok.kind != tokIdent {
+		return testNode{}, p.errorf("test expected, got %v", p.tok.kind)
+	}
+	test := testNode{name: p.tok.val, line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return test, err
+	}
+
+	p.depth++
+	if p.depth > maxNesting {
+		return test, p.errorf("too many nested tests")
+	}
+	defer func() { p.depth-- }()
+
+	var err error
+	test.args, test.tests, err = p.arguments()
+	return test, err
+}
+
+func (p *parser) testList() ([]testNode, error) {
+	if err := p.expect(tokLParen); err != nil {
+		return nil, err
+	}
+	var tests []testNode
+	for {
+		test, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, test)
+		if p.tok.kind == tokRParen {
+			return tests, p.advance()
+		}
+		if err := p.expect(tokComma); err != nil {
+			return nil, err
+		}
+	}
+}
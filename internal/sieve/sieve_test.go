@@ -0,0 +1,282 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"bufio"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+func testMessage(t *testing.T, hdr string) *Message {
+	t.Helper()
+	h, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(hdr + "\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Message{
+		Header:       h,
+		Size:         2048,
+		EnvelopeFrom: "sender@example.org",
+		EnvelopeTo:   "rcpt+tag@example.com",
+	}
+}
+
+const sampleHeader = "From: Sender <Sender@Example.org>\r\n" +
+	"To: rcpt@example.com, other@example.net\r\n" +
+	"Subject: =?utf-8?q?Caf=C3=A9?= [list] meeting\r\n" +
+	"List-Id: <dev.lists.example.org>\r\n"
+
+func TestExecute(t *testing.T) {
+	cases := []struct {
+		name   string
+		script string
+		res    Result
+	}{
+		{
+			name:   "empty",
+			script: ``,
+			res:    Result{Keep: true},
+		},
+		{
+			name: "fileinto header contains",
+			script: `require "fileinto";
+				if header :contains "subject" "[LIST]" {
+					fileinto "Lists";
+				}`,
+			res: Result{Fileinto: []string{"Lists"}},
+		},
+		{
+			name: "decoded header matches",
+			script: `require ["fileinto"];
+				if header :matches "Subject" "café*meet?ng" { fileinto "A"; } else { fileinto "B"; }`,
+			res: Result{Fileinto: []string{"A"}},
+		},
+		{
+			name: "octet comparator is case-sensitive",
+			script: `require "fileinto";
+				if header :comparator "i;octet" :contains "subject" "LIST" { fileinto "A"; }`,
+			res: Result{Keep: true},
+		},
+		{
+			name: "address domain",
+			script: `if address :domain :is "from" "example.org" { discard; stop; }
+				keep;`,
+			res: Result{},
+		},
+		{
+			name: "address localpart of any recipient",
+			script: `require "fileinto";
+				if address :localpart "to" ["nobody", "other"] { fileinto "Other"; keep; }`,
+			res: Result{Keep: true, Fileinto: []string{"Other"}},
+		},
+		{
+			name: "envelope",
+			script: `require ["envelope", "fileinto"];
+				if envelope :localpart :matches "to" "*+tag" { fileinto "Tagged"; }`,
+			res: Result{Fileinto: []string{"Tagged"}},
+		},
+		{
+			name: "elsif chain",
+			script: `require "fileinto";
+				if false { fileinto "1"; }
+				elsif exists ["X-Missing"] { fileinto "2"; }
+				elsif allof (exists "list-id", not size :over 1K) { fileinto "3"; }
+				elsif anyof (false, size :over 1K) { fileinto "4"; }
+				else { fileinto "5"; }`,
+			res: Result{Fileinto: []string{"4"}},
+		},
+		{
+			name:   "redirect",
+			script: `redirect "a@example.org"; redirect "A@example.org";`,
+			res:    Result{Redirect: []string{"a@example.org"}},
+		},
+		{
+			name: "vacation",
+			script: `require "vacation";
+				vacation :days 0 :subject "Away" :addresses ["alias@example.com"] text:
+I am away.
+..
+.
+;`,
+			res: Result{Keep: true, Vacation: &Vacation{
+				Days:      1,
+				Subject:   "Away",
+				Addresses: []string{"alias@example.com"},
+				Reason:    "I am away.\n.\n",
+			}},
+		},
+		{
+			name: "stop",
+			script: `# comment
+				/* multi-line
+				   comment */
+				stop; discard;`,
+			res: Result{Keep: true},
+		},
+	}
+
+	for _, case_ := range cases {
+		t.Run(case_.name, func(t *testing.T) {
+			script, err := Parse(case_.script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := script.Execute(testMessage(t, sampleHeader))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*res, case_.res) {
+				t.Errorf("wrong result:\n%+v\nwant:\n%+v", *res, case_.res)
+			}
+		})
+	}
+}
+
+func TestExecute_TooManyRedirects(t *testing.T) {
+	script, err := Parse(`redirect "1@example.org"; redirect "2@example.org"; redirect "3@example.org";
+		redirect "4@example.org"; redirect "5@example.org";`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := script.Execute(testMessage(t, sampleHeader)); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	for _, script := range []string{
+		`fileinto "A";`,
+		`require "fileinto"; keep; require "envelope";`,
+		`require "imap4flags";`,
+		`unknown;`,
+		`keep`,
+		`if true keep;`,
+		`if true { keep; } else true { keep; }`,
+		`else { keep; }`,
+		`if header :is :contains "a" "b" { keep; }`,
+		`if header :comparator "i;ascii-numeric" "a" "b" { keep; }`,
+		`if address :domain "from" { keep; }`,
+		`if envelope "from" "a" { keep; }`,
+		`if size 100 { keep; }`,
+		`redirect "not-an-address";`,
+		`require "vacation"; vacation :days 1;`,
+		`keep; "unterminated`,
+		`if true { keep;`,
+		strings.Repeat(`if true {`, maxNesting+1) + strings.Repeat(`}`, maxNesting+1),
+	} {
+		if _, err := Parse(script); err == nil {
+			t.Errorf("expected an error for %q", script)
+		} else if !errors.As(err, new(*Error)) {
+			t.Errorf("unexpected error type for %q: %v", script, err)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern, value string
+		octet          bool
+		match          bool
+	}{
+		{"*", "", false, true},
+		{"a*c", "abbbc", false, true},
+		{"a*c", "abbbd", false, false},
+		{"a?c", "abc", false, true},
+		{"a?c", "aéc", false, true},
+		{"a?c", "aéc", true, false},
+		{"a??c", "aéc", true, true},
+		{`a\*c`, "a*c", false, true},
+		{`a\*c`, "abc", false, false},
+		{"*@example.org", "user@sub.example.org", false, false},
+		{"*.example.org", "user@sub.example.org", false, true},
+		{"a*b*c", "aXbYbZc", false, true},
+	}
+	for _, case_ := range cases {
+		if got := matchGlob(case_.pattern, case_.value, case_.octet); got != case_.match {
+			t.Errorf("matchGlob(%q, %q, %v) = %v, want %v", case_.pattern, case_.value, case_.octet, got, case_.match)
+		}
+	}
+}
+
+func TestFSStore(t *testing.T) {
+	s := &FSStore{Dir: t.TempDir(), MaxScripts: 2, MaxSize: 100}
+	const user = "user@example.org"
+
+	if err := s.PutScript(user, "first", "keep;"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutScript(user, "second", "discard;"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutScript(user, "third", "keep;"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatal("expected ErrQuotaExceeded, got", err)
+	}
+	if err := s.PutScript(user, "first", strings.Repeat("#", 101)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatal("expected ErrQuotaExceeded, got", err)
+	}
+
+	if content, err := s.ActiveScript(user); err != nil || content != "" {
+		t.Fatal("unexpected active script:", content, err)
+	}
+	if err := s.SetActive(user, "missing"); !errors.Is(err, ErrNoSuchScript) {
+		t.Fatal("expected ErrNoSuchScript, got", err)
+	}
+	if err := s.SetActive(user, "second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteScript(user, "second"); !errors.Is(err, ErrScriptActive) {
+		t.Fatal("expected ErrScriptActive, got", err)
+	}
+	if err := s.RenameScript(user, "second", "first"); !errors.Is(err, ErrScriptExists) {
+		t.Fatal("expected ErrScriptExists, got", err)
+	}
+	if err := s.RenameScript(user, "second", "renamed/script"); err != nil {
+		t.Fatal(err)
+	}
+
+	scripts, err := s.ListScripts(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ScriptInfo{{Name: "first"}, {Name: "renamed/script", Active: true}}
+	if !reflect.DeepEqual(scripts, want) {
+		t.Fatalf("wrong scripts list: %+v", scripts)
+	}
+	if content, err := s.ActiveScript(user); err != nil || content != "discard;" {
+		t.Fatal("unexpected active script:", content, err)
+	}
+
+	if err := s.SetActive(user, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteScript(user, "renamed/script"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetScript(user, "renamed/script"); !errors.Is(err, ErrNoSuchScript) {
+		t.Fatal("expected ErrNoSuchScript, got", err)
+	}
+	if scripts, err := s.ListScripts("other@example.org"); err != nil || len(scripts) != 0 {
+		t.Fatal("unexpected scripts for other user:", scripts, err)
+	}
+}
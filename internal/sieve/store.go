@@ -0,0 +1,327 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	ErrNoSuchScript    = errors.New("sieve: no such script")
+	ErrScriptExists    = errors.New("sieve: script already exists")
+	ErrScriptActive    = errors.New("sieve: active script can not be deleted")
+	ErrQuotaExceeded   = errors.New("sieve: quota exceeded")
+	ErrInvalidName     = errors.New("sieve: invalid script name")
+	ErrInvalidUsername = errors.New("sieve: invalid username")
+)
+
+// ScriptInfo describes a stored script.
+type ScriptInfo struct {
+	Name   string
+	Active bool
+}
+
+// Store is the per-user storage of Sieve scripts. At most one script
+// is active at a time, it is executed for delivered messages.
+type Store interface {
+	ListScripts(username string) ([]ScriptInfo, error)
+	GetScript(username, name string) (string, error)
+	// PutScript creates or replaces the script. Script should be
+	// validated using Parse by the caller.
+	PutScript(username, name, content string) error
+	DeleteScript(username, name string) error
+	RenameScript(username, oldName, newName string) error
+	// SetActive makes the script active. Empty name deactivates the
+	// active script.
+	SetActive(username, name string) error
+	// ActiveScript returns the content of the active script or empty
+	// string if there is none.
+	ActiveScript(username string) (string, error)
+	// CheckSpace returns ErrQuotaExceeded if the script with the
+	// specified size can not be stored.
+	CheckSpace(username, name string, size int64) error
+}
+
+const (
+	scriptExt  = ".sieve"
+	activeFile = ".active"
+)
+
+// FSStore stores scripts in the file system directory, each user has
+// a subdirectory with script files and a file with the name of the
+// active script.
+type FSStore struct {
+	Dir        string
+	MaxScripts int
+	MaxSize    int64
+}
+
+// ValidName reports whether the name can be used as a script name
+// (RFC 5804 Section 1.6).
+func ValidName(name string) bool {
+	if name == "" || len(name) > 512 || !utf8.ValidString(name) {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || r == 0x2028 || r == 0x2029 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *FSStore) userDir(username string) (string, error) {
+	if username == "" {
+		return "", ErrInvalidUsername
+	}
+	escaped := url.PathEscape(username)
+	if strings.HasPrefix(escaped, ".") {
+		escaped = "%2E" + escaped[1:]
+	}
+	return filepath.Join(s.Dir, escaped), nil
+}
+
+func (s *FSStore) scriptPath(username, name string) (string, error) {
+	if !ValidName(name) {
+		return "", ErrInvalidName
+	}
+	dir, err := s.userDir(username)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, url.PathEscape(name)+scriptExt), nil
+}
+
+func (s *FSStore) activeName(username string) (string, error) {
+	dir, err := s.userDir(username)
+	if err != nil {
+		return "", err
+	}
+	name, err := os.ReadFile(filepath.Join(dir, activeFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(name), nil
+}
+
+func (s *FSStore) ListScripts(username string) ([]ScriptInfo, error) {
+	dir, err := s.userDir(username)
+	if err != nil {
+		return nil, err
+	}
+	active, err := s.activeName(username)
+	if err != nil {
+		return nil, err
+	}
+
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	scripts := make([]ScriptInfo, 0, len(ents))
+	for _, ent := range ents {
+		if !strings.HasSuffix(ent.Name(), scriptExt) {
+			continue
+		}
+		name, err := url.PathUnescape(strings.TrimSuffix(ent.Name(), scriptExt))
+		if err != nil {
+			continue
+		}
+		scripts = append(scripts, ScriptInfo{Name: name, Active: name == active})
+	}
+	sort.Slice(scripts, func(i, j int) bool {
+		return scripts[i].Name < scripts[j].Name
+	})
+	return scripts, nil
+}
+
+func (s *FSStore) GetScript(username, name string) (string, error) {
+	path, err := s.scriptPath(username, name)
+	if err != nil {
+		return "", err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrNoSuchScript
+		}
+		return "", err
+	}
+	return string(content), nil
+}
+
+func (s *FSStore) CheckSpace(username, name string, size int64) error {
+	if s.MaxSize != 0 && size > s.MaxSize {
+		return fmt.Errorf("%w: script is too big", ErrQuotaExceeded)
+	}
+	if s.MaxScripts == 0 {
+		return nil
+	}
+	path, err := s.scriptPath(username, name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		// Replacing an existing script.
+		return nil
+	}
+	scripts, err := s.ListScripts(username)
+	if err != nil {
+		return err
+	}
+	if len(scripts) >= s.MaxScripts {
+		return fmt.Errorf("%w: too many scripts", ErrQuotaExceeded)
+	}
+	return nil
+}
+
+// writeFile replaces the file contents atomically.
+func writeFile(path string, content []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s *FSStore) PutScript(username, name, content string) error {
+	if err := s.CheckSpace(username, name, int64(len(content))); err != nil {
+		return err
+	}
+	path, err := s.scriptPath(username, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return writeFile(path, []byte(content))
+}
+
+func (s *FSStore) DeleteScript(username, name string) error {
+	path, err := s.scriptPath(username, name)
+	if err != nil {
+		return err
+	}
+	active, err := s.activeName(username)
+	if err != nil {
+		return err
+	}
+	if active == name {
+		return ErrScriptActive
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNoSuchScript
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *FSStore) RenameScript(username, oldName, newName string) error {
+	oldPath, err := s.scriptPath(username, oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := s.scriptPath(username, newName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(oldPath); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNoSuchScript
+		}
+		return err
+	}
+	if _, err := os.Stat(newPath); err == nil {
+		return ErrScriptExists
+	}
+	active, err := s.activeName(username)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	if active == oldName {
+		return s.SetActive(username, newName)
+	}
+	return nil
+}
+
+func (s *FSStore) SetActive(username, name string) error {
+	dir, err := s.userDir(username)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		if err := os.Remove(filepath.Join(dir, activeFile)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	path, err := s.scriptPath(username, name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNoSuchScript
+		}
+		return err
+	}
+	return writeFile(filepath.Join(dir, activeFile), []byte(name))
+}
+
+func (s *FSStore) ActiveScript(username string) (string, error) {
+	name, err := s.activeName(username)
+	if err != nil || name == "" {
+		return "", err
+	}
+	content, err := s.GetScript(username, name)
+	if errors.Is(err, ErrNoSuchScript) {
+		return "", nil
+	}
+	return content, err
+}
@@ -0,0 +1,94 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtpconn
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDSNParams(t *testing.T) {
+	mailOpts := smtp.MailOptions{
+		Return:     smtp.DSNReturnHeaders,
+		EnvelopeID: "QQ314159",
+	}
+	rcptOpts := smtp.RcptOptions{
+		Notify:                []smtp.DSNNotify{smtp.DSNNotifySuccess, smtp.DSNNotifyFailure},
+		OriginalRecipientType: smtp.DSNAddressTypeRFC822,
+		OriginalRecipient:     "orig@example.invalid",
+	}
+
+	check := func(serverDSN bool, expectMail smtp.MailOptions, expectRcpt smtp.RcptOptions) {
+		t.Helper()
+
+		be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+		srv.EnableDSN = serverDSN
+		defer srv.Close()
+		defer testutils.CheckSMTPConnLeak(t, srv)
+
+		c := New()
+		c.Log = testutils.Logger(t, "target.smtp")
+		if _, err := c.Connect(context.Background(), config.Endpoint{
+			Scheme: "tcp",
+			Host:   "127.0.0.1",
+			Port:   testPort,
+		}, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		if c.SupportsDSN() != serverDSN {
+			t.Errorf("SupportsDSN = %v, want %v", c.SupportsDSN(), serverDSN)
+		}
+
+		if err := c.Mail(context.Background(), "test@example.org", mailOpts); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Rcpt(context.Background(), "test@example.invalid", rcptOpts); err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		hdr.Add("B", "2")
+		hdr.Add("A", "1")
+		if err := c.Data(context.Background(), hdr, strings.NewReader("foobar\n")); err != nil {
+			t.Fatal(err)
+		}
+
+		be.CheckMsg(t, 0, "test@example.org", []string{"test@example.invalid"})
+		msg := be.Messages[0]
+		if msg.Opts.Return != expectMail.Return || msg.Opts.EnvelopeID != expectMail.EnvelopeID {
+			t.Errorf("RET = %q, ENVID = %q; want %q, %q", msg.Opts.Return, msg.Opts.EnvelopeID,
+				expectMail.Return, expectMail.EnvelopeID)
+		}
+		if !reflect.DeepEqual(msg.RcptOpts[0], expectRcpt) {
+			t.Errorf("RCPT options = %+v, want %+v", msg.RcptOpts[0], expectRcpt)
+		}
+	}
+
+	check(true, mailOpts, rcptOpts)
+	// Parameters are dropped if the server does not support the extension.
+	check(false, smtp.MailOptions{}, smtp.RcptOptions{})
+}
@@ -43,6 +43,7 @@ import (
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/transcript"
 )
 
 // The C object represents the SMTP connection and is a wrapper around
@@ -84,6 +85,7 @@ type C struct {
 	cl         *smtp.Client
 	rcpts      []string
 	lmtp       bool
+	transcript *transcript.Recorder
 }
 
 // New creates the new instance of the C object, populating the required fields
@@ -155,6 +157,19 @@ func (c *C) wrapClientErr(err error, serverName string) error {
 			},
 		}
 	default:
+		// The server closed the connection unexpectedly, e.g. LMTP server
+		// crashed while processing DATA.
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+			return &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 4, 2},
+				Message:      "Connection closed by the next hop",
+				Err:          err,
+				Misc: map[string]interface{}{
+					"remote_server": serverName,
+				},
+			}
+		}
 		return exterrors.WithFields(err, map[string]interface{}{
 			"remote_server": serverName,
 		})
@@ -236,6 +251,13 @@ func (c *C) attemptConnect(ctx context.Context, lmtp bool, endp config.Endpoint,
 		return false, nil, nil, err
 	}
 
+	// Data is recorded via smtp.Client.DebugWriter to see it after STARTTLS.
+	rec := transcript.Start("out", conn.RemoteAddr())
+	if rec != nil {
+		rec.Note("connected to %s", endp)
+		conn = &transcript.Conn{Conn: conn, Recorder: rec, Passive: true}
+	}
+
 	if endp.IsTLS() {
 		cfg := tlsConfig.Clone()
 		cfg.ServerName = endp.Host
@@ -252,6 +274,8 @@ func (c *C) attemptConnect(ctx context.Context, lmtp bool, endp config.Endpoint,
 
 	cl.CommandTimeout = c.CommandTimeout
 	cl.SubmissionTimeout = c.SubmissionTimeout
+	cl.DebugWriter = rec.Writer()
+	c.transcript = rec
 
 	// i18n: hostname is already expected to be in A-labels form.
 	if err := cl.Hello(c.Hostname); err != nil {
@@ -272,7 +296,10 @@ func (c *C) attemptConnect(ctx context.Context, lmtp bool, endp config.Endpoint,
 
 	cfg := tlsConfig.Clone()
 	cfg.ServerName = endp.Host
+	rec.Note("starting TLS, server_name=%q", cfg.ServerName)
 	if err := cl.StartTLS(cfg); err != nil {
+		rec.TLSCompleted(err)
+
 		// After the handshake failure, the connection may be in a bad state.
 		// We attempt to send the proper QUIT command though, in case the error happened
 		// *after* the handshake (e.g. PKI verification fail), we don't log the error in
@@ -283,6 +310,10 @@ func (c *C) attemptConnect(ctx context.Context, lmtp bool, endp config.Endpoint,
 
 		return false, nil, nil, TLSError{err}
 	}
+	if cs, ok := cl.TLSConnectionState(); ok {
+		rec.Note("TLS established: version=%s cipher=%s", tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite))
+	}
+	rec.TLSCompleted(nil)
 
 	// Re-do HELO using our hostname instead of localhost.
 	if err := cl.Hello(c.Hostname); err != nil {
@@ -308,6 +339,8 @@ func (c *C) attemptConnect(ctx context.Context, lmtp bool, endp config.Endpoint,
 func (c *C) Mail(ctx context.Context, from string, opts smtp.MailOptions) error {
 	defer trace.StartRegion(ctx, "smtpconn/MAIL FROM").End()
 
+	c.transcript.Sender(from)
+
 	outOpts := smtp.MailOptions{
 		// Future extensions may add additional fields that should not be
 		// copied blindly. So we copy only fields we know should be handled
@@ -317,6 +350,15 @@ func (c *C) Mail(ctx context.Context, from string, opts smtp.MailOptions) error
 		RequireTLS: opts.RequireTLS,
 	}
 
+	// Pass DSN parameters so the server is responsible for reporting the
+	// delivery status, see SupportsDSN.
+	if c.SupportsDSN() {
+		outOpts.Return = opts.Return
+		if address.IsASCII(opts.EnvelopeID) {
+			outOpts.EnvelopeID = opts.EnvelopeID
+		}
+	}
+
 	// INTERNATIONALIZATION: Use SMTPUTF8 is possible, attempt to convert addresses otherwise.
 
 	// There is no way we can accept a message with non-ASCII addresses without SMTPUTF8
@@ -365,6 +407,14 @@ func (c *C) IsLMTP() bool {
 	return c.lmtp
 }
 
+// SupportsDSN reports whether the server supports the DSN extension
+// (RFC 3461). If it does, DSN parameters are passed to it and it is
+// responsible for sending DSNs after the message is accepted.
+func (c *C) SupportsDSN() bool {
+	ok, _ := c.cl.Extension("DSN")
+	return ok
+}
+
 // Rcpt sends the RCPT TO command to the remote server.
 //
 // If the address is non-ASCII and cannot be converted to ASCII and the remote
@@ -372,8 +422,16 @@ func (c *C) IsLMTP() bool {
 func (c *C) Rcpt(ctx context.Context, to string, opts smtp.RcptOptions) error {
 	defer trace.StartRegion(ctx, "smtpconn/RCPT TO").End()
 
-	outOpts := &smtp.RcptOptions{
-		// TODO: DSN support
+	c.transcript.Rcpt(to)
+
+	outOpts := &smtp.RcptOptions{}
+	if c.SupportsDSN() {
+		outOpts.Notify = opts.Notify
+		switch opts.OriginalRecipientType {
+		case smtp.DSNAddressTypeRFC822, smtp.DSNAddressTypeUTF8:
+			outOpts.OriginalRecipientType = opts.OriginalRecipientType
+			outOpts.OriginalRecipient = opts.OriginalRecipient
+		}
 	}
 
 	// If necessary, the extension flag is enabled in Start.
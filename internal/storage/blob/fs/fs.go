@@ -9,12 +9,14 @@ import (
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/storagepath"
 )
 
 // FSStore struct represents directory on FS used to store blobs.
 type FSStore struct {
 	instName string
 	root     string
+	quota    *storagepath.Quota
 }
 
 func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -42,6 +44,17 @@ func (s *FSStore) Init(cfg *config.Map) error {
 		return err
 	}
 
+	if s.root == "" {
+		s.root = storagepath.Dir(storagepath.Messages, "")
+	}
+	if loc := storagepath.Get(storagepath.Messages); loc != nil {
+		// Size limit applies only if the store actually uses the configured
+		// directory.
+		if root, err := filepath.Abs(s.root); err == nil && root == filepath.Clean(loc.Dir) {
+			s.quota = loc.Quota
+		}
+	}
+
 	if s.root == "" {
 		return config.NodeErr(cfg.Block, "storage.blob.fs: directory not set")
 	}
@@ -65,8 +78,16 @@ func (s *FSStore) Open(_ context.Context, key string) (io.ReadCloser, error) {
 }
 
 func (s *FSStore) Create(_ context.Context, key string, blobSize int64) (module.Blob, error) {
+	if blobSize > 0 {
+		if err := s.quota.Reserve(blobSize); err != nil {
+			return nil, err
+		}
+	}
 	f, err := os.Create(filepath.Join(s.root, key))
 	if err != nil {
+		if blobSize > 0 {
+			s.quota.Release(blobSize)
+		}
 		return nil, err
 	}
 	if blobSize >= 0 {
@@ -79,7 +100,13 @@ func (s *FSStore) Create(_ context.Context, key string, blobSize int64) (module.
 
 func (s *FSStore) Delete(_ context.Context, keys []string) error {
 	for _, key := range keys {
-		if err := os.Remove(filepath.Join(s.root, key)); err != nil {
+		path := filepath.Join(s.root, key)
+		if s.quota != nil {
+			if info, err := os.Stat(path); err == nil {
+				s.quota.Release(info.Size())
+			}
+		}
+		if err := os.Remove(path); err != nil {
 			if os.IsNotExist(err) {
 				continue
 			}
@@ -89,7 +116,37 @@ func (s *FSStore) Delete(_ context.Context, keys []string) error {
 	return nil
 }
 
+func (s *FSStore) ListBlobs(ctx context.Context) ([]module.BlobInfo, error) {
+	dir, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := make([]module.BlobInfo, 0, len(dir))
+	for _, ent := range dir {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !ent.Type().IsRegular() {
+			continue
+		}
+		info, err := ent.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		blobs = append(blobs, module.BlobInfo{
+			Key:     ent.Name(),
+			ModTime: info.ModTime(),
+		})
+	}
+	return blobs, nil
+}
+
 func init() {
 	var _ module.BlobStore = &FSStore{}
+	var _ module.BlobLister = &FSStore{}
 	module.Register(FSStore{}.Name(), New)
 }
@@ -0,0 +1,93 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"errors"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+// specialFolders returns special-use folders created for accounts that are
+// created automatically if auto_create_special_folders is enabled and
+// account_template does not define folders. Names match the defaults of
+// 'maddy imap-acct create'.
+func (store *Storage) specialFolders() []struct{ name, attr string } {
+	return []struct{ name, attr string }{
+		{"Sent", imap.SentAttr},
+		{"Trash", imap.TrashAttr},
+		{store.junkMbox, imap.JunkAttr},
+		{"Drafts", imap.DraftsAttr},
+		{"Archive", imap.ArchiveAttr},
+	}
+}
+
+// autoCreateAccount creates the storage account on first login or delivery.
+//
+// If the account was created concurrently by another connection, it is
+// returned as is.
+func (store *Storage) autoCreateAccount(accountName string) (backend.User, error) {
+	if err := store.Back.CreateUser(accountName); err != nil {
+		if errors.Is(err, imapsql.ErrUserAlreadyExists) {
+			return store.Back.GetUser(accountName)
+		}
+		return nil, err
+	}
+	store.Log.Msg("storage account created automatically", "username", accountName)
+
+	u, err := store.Back.GetUser(accountName)
+	if err != nil {
+		return nil, err
+	}
+	store.provisionAccount(u, accountName, store.autoCreateFolders)
+	return u, nil
+}
+
+// autoCreateForDelivery creates the account for the recipient if it is
+// listed in the delivery_auto_create table. It reports whether the account
+// was created.
+func (store *Storage) autoCreateForDelivery(ctx context.Context, accountName string) (bool, error) {
+	if store.deliveryAutoCreate == nil {
+		return false, nil
+	}
+
+	_, ok, err := store.deliveryAutoCreate.Lookup(ctx, accountName)
+	if err != nil {
+		return false, lookupFailed(err)
+	}
+	if !ok {
+		return false, nil
+	}
+
+	if _, err := store.autoCreateAccount(accountName); err != nil {
+		return false, &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Internal server error, try again later",
+			ErrorID:      exterrors.IDStorageInternal,
+			TargetName:   "imapsql",
+			Err:          err,
+		}
+	}
+	return true, nil
+}
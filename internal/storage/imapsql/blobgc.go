@@ -0,0 +1,170 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// BlobReport is the result of the consistency check between the database and
+// the blob store used for message bodies.
+type BlobReport struct {
+	// Orphaned contains keys of objects present in the blob store but not
+	// referenced by the database.
+	Orphaned []string
+
+	// Missing contains keys referenced by the database that have no
+	// corresponding object in the blob store.
+	Missing []string
+
+	// Removed is true if orphaned objects were deleted from the blob store.
+	Removed bool
+}
+
+var ErrBlobListUnsupported = errors.New("imapsql: blob store does not support listing")
+
+// CheckBlobs compares the set of keys referenced by the database with the
+// contents of the blob store.
+//
+// Objects modified within the grace period are never reported as orphaned
+// since they may belong to a delivery that is still in progress.
+//
+// If cleanup is true, orphaned objects are removed. Missing objects are only
+// reported as the database rows still contain message metadata that may be
+// used to recover them from backups.
+func (store *Storage) CheckBlobs(ctx context.Context, grace time.Duration, cleanup bool) (BlobReport, error) {
+	lister, ok := store.blobStore.(module.BlobLister)
+	if !ok {
+		return BlobReport{}, ErrBlobListUnsupported
+	}
+
+	// Read the DB first so objects created after the listing below but
+	// before the query are not considered orphaned. The grace period
+	// covers the opposite case.
+	referenced, err := store.referencedBlobs(ctx)
+	if err != nil {
+		return BlobReport{}, err
+	}
+
+	blobs, err := lister.ListBlobs(ctx)
+	if err != nil {
+		return BlobReport{}, fmt.Errorf("imapsql: list blobs: %w", err)
+	}
+
+	report := BlobReport{}
+	present := make(map[string]struct{}, len(blobs))
+	cutoff := time.Now().Add(-grace)
+	for _, b := range blobs {
+		present[b.Key] = struct{}{}
+		if _, ok := referenced[b.Key]; ok {
+			continue
+		}
+		if b.ModTime.After(cutoff) {
+			continue
+		}
+		report.Orphaned = append(report.Orphaned, b.Key)
+	}
+	for key := range referenced {
+		if _, ok := present[key]; !ok {
+			report.Missing = append(report.Missing, key)
+		}
+	}
+	sort.Strings(report.Orphaned)
+	sort.Strings(report.Missing)
+
+	if cleanup && len(report.Orphaned) != 0 {
+		if err := store.blobStore.Delete(ctx, report.Orphaned); err != nil {
+			return report, fmt.Errorf("imapsql: delete orphaned blobs: %w", err)
+		}
+		report.Removed = true
+	}
+
+	return report, nil
+}
+
+func (store *Storage) referencedBlobs(ctx context.Context) (map[string]struct{}, error) {
+	rows, err := store.Back.DB.QueryContext(ctx, `SELECT id FROM extKeys`)
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: query blob keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := make(map[string]struct{})
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("imapsql: query blob keys: %w", err)
+		}
+		keys[key] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("imapsql: query blob keys: %w", err)
+	}
+	return keys, nil
+}
+
+// blobGCLoop periodically runs CheckBlobs until ctx is cancelled. The
+// running scan is interrupted too. blobGCDone is closed once the loop exits.
+func (store *Storage) blobGCLoop(ctx context.Context, interval, grace time.Duration, cleanup bool) {
+	defer close(store.blobGCDone)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			store.blobGCScan(ctx, grace, cleanup)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (store *Storage) blobGCScan(ctx context.Context, grace time.Duration, cleanup bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			stack := debug.Stack()
+			log.Printf("panic during imapsql blob scan: %v\n%s", err, stack)
+		}
+	}()
+
+	report, err := store.CheckBlobs(ctx, grace, cleanup)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		store.Log.Error("blob store scan failed", err)
+		return
+	}
+	if len(report.Orphaned) != 0 {
+		store.Log.Msg("orphaned blobs found", "count", len(report.Orphaned), "removed", report.Removed)
+	}
+	for _, key := range report.Missing {
+		store.Log.Msg("message blob is missing", "key", key)
+	}
+}
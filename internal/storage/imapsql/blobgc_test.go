@@ -0,0 +1,156 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/storage/blob/fs"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestCheckBlobs(t *testing.T) {
+	dir := testutils.Dir(t)
+
+	mod, err := fs.New("storage.blob.fs", "test", nil, []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	blobStore := mod.(module.BlobStore)
+
+	back, err := imapsql.New("sqlite3", ":memory:", ExtBlobStore{Base: blobStore}, imapsql.Opts{
+		Log: testutils.Logger(t, "imapsql"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &Storage{Back: back, blobStore: blobStore, Log: testutils.Logger(t, "imapsql")}
+	defer store.Close()
+
+	if err := back.CreateUser("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := back.GetUser("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		body := bytes.NewReader([]byte("Subject: test\r\n\r\nHello!\r\n"))
+		if err := u.CreateMessage("INBOX", nil, time.Now(), body, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	referenced, err := store.referencedBlobs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(referenced) != 2 {
+		t.Fatal("Expected 2 referenced blobs, got", len(referenced))
+	}
+	var missingKey string
+	for key := range referenced {
+		missingKey = key
+		break
+	}
+	if err := os.Remove(filepath.Join(dir, missingKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.WriteFile(filepath.Join(dir, "orphan-old"), []byte("a"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, "orphan-old"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "orphan-new"), []byte("a"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := store.CheckBlobs(context.Background(), 1*time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Orphaned, []string{"orphan-old"}) {
+		t.Error("Wrong orphaned list:", report.Orphaned)
+	}
+	if !reflect.DeepEqual(report.Missing, []string{missingKey}) {
+		t.Error("Wrong missing list:", report.Missing)
+	}
+	if report.Removed {
+		t.Error("Removed should not be set without cleanup")
+	}
+
+	report, err = store.CheckBlobs(context.Background(), 1*time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Removed {
+		t.Error("Removed is not set")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "orphan-old")); !os.IsNotExist(err) {
+		t.Error("Orphaned blob was not removed:", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "orphan-new")); err != nil {
+		t.Error("Recently created blob was removed:", err)
+	}
+}
+
+type blockingLister struct {
+	module.BlobStore
+	started chan struct{}
+}
+
+func (bl blockingLister) ListBlobs(ctx context.Context) ([]module.BlobInfo, error) {
+	close(bl.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestBlobGCLoop_Close(t *testing.T) {
+	back, err := imapsql.New("sqlite3", ":memory:", ExtBlobStore{Base: nil}, imapsql.Opts{
+		Log: testutils.Logger(t, "imapsql"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := blockingLister{started: make(chan struct{})}
+	store := &Storage{Back: back, blobStore: bl, Log: testutils.Logger(t, "imapsql")}
+
+	var ctx context.Context
+	ctx, store.blobGCStop = context.WithCancel(context.Background())
+	store.blobGCDone = make(chan struct{})
+	go store.blobGCLoop(ctx, time.Millisecond, time.Hour, false)
+
+	select {
+	case <-bl.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan is not started")
+	}
+
+	// Close should interrupt the running scan.
+	closed := make(chan struct{})
+	go func() {
+		store.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close is blocked by the running scan")
+	}
+}
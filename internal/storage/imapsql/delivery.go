@@ -20,8 +20,10 @@ package imapsql
 
 import (
 	"context"
+	"errors"
 	"runtime/trace"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
 	"github.com/emersion/go-message/textproto"
@@ -30,11 +32,23 @@ import (
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/acctstatus"
+	"github.com/foxcpp/maddy/internal/pgpenc"
 	"github.com/foxcpp/maddy/internal/target"
 )
 
+// quarantineHeader is added to quarantined messages to explain why they were
+// put into the Junk folder.
+const quarantineHeader = "X-Maddy-Quarantine"
+
 type addedRcpt struct {
 	rcptTo string
+
+	// Set if the message should be stored encrypted for the recipient.
+	// Such recipients are added to a separate delivery since the
+	// message body is different for them.
+	pgpKeys   openpgp.EntityList
+	encrypted *imapsql.Delivery
 }
 type delivery struct {
 	store    *Storage
@@ -59,11 +73,29 @@ func userDoesNotExist(actual error) error {
 	}
 }
 
+// lookupFailed is returned if the delivery_map lookup failed. The recipient
+// may exist, so the delivery should be retried instead of reporting
+// userDoesNotExist.
+func lookupFailed(actual error) error {
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+		Message:      "Recipient lookup failed, try again later",
+		ErrorID:      exterrors.IDLookupFailed,
+		TargetName:   "imapsql",
+		Err:          actual,
+	}
+}
+
 func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOptions) error {
 	defer trace.StartRegion(ctx, "sql/AddRcpt").End()
 
 	accountName, err := d.store.deliveryNormalize(ctx, rcptTo)
 	if err != nil {
+		var smtpErr *exterrors.SMTPError
+		if errors.As(err, &smtpErr) {
+			return err
+		}
 		return userDoesNotExist(err)
 	}
 
@@ -71,13 +103,62 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOption
 		return nil
 	}
 
-	// This header is added to the message only for that recipient.
-	// go-imap-sql does certain optimizations to store the message
-	// with small amount of per-recipient data in a efficient way.
-	userHeader := textproto.Header{}
-	userHeader.Add("Delivered-To", accountName)
+	status, err := acctstatus.Lookup(ctx, d.store.accountStatus, accountName)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Internal server error, try again later",
+			ErrorID:      exterrors.IDStorageInternal,
+			TargetName:   "imapsql",
+			Err:          err,
+		}
+	}
+	if !status.AllowsReceiving() {
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 2, 1},
+			Message:      "Mailbox disabled, not accepting messages",
+			TargetName:   "imapsql",
+			Reason:       "account status: " + string(status),
+		}
+	}
+
+	if err := d.store.checkQuota(ctx, accountName, d.msgMeta.SMTPOpts.Size); err != nil {
+		return err
+	}
+
+	keys, err := pgpenc.Lookup(ctx, d.store.pgpKeys, accountName)
+	if err != nil {
+		// Do not store the message unencrypted if the user asked for
+		// encryption and the key is broken.
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Internal server error, try again later",
+			ErrorID:      exterrors.IDStorageInternal,
+			TargetName:   "imapsql",
+			Err:          err,
+		}
+	}
+
+	rcptDelivery := &d.d
+	if keys != nil {
+		encDelivery := d.store.Back.NewDelivery()
+		rcptDelivery = &encDelivery
+	}
 
-	if err := d.d.AddRcpt(accountName, userHeader); err != nil {
+	err = rcptDelivery.AddRcpt(accountName, rcptHeader(accountName))
+	if err == imapsql.ErrUserDoesntExists {
+		created, createErr := d.store.autoCreateForDelivery(ctx, accountName)
+		if createErr != nil {
+			return createErr
+		}
+		if created {
+			err = rcptDelivery.AddRcpt(accountName, rcptHeader(accountName))
+		}
+	}
+	if err != nil {
 		if err == imapsql.ErrUserDoesntExists || err == backend.ErrNoSuchMailbox {
 			return userDoesNotExist(err)
 		}
@@ -86,6 +167,7 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOption
 				Code:         453,
 				EnhancedCode: exterrors.EnhancedCode{4, 3, 2},
 				Message:      "Internal server error, try again later",
+				ErrorID:      exterrors.IDStorageInternal,
 				TargetName:   "imapsql",
 				Err:          err,
 			}
@@ -93,44 +175,122 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOption
 		return err
 	}
 
-	d.addedRcpts[accountName] = addedRcpt{
-		rcptTo: rcptTo,
+	rcptData := addedRcpt{
+		rcptTo:  rcptTo,
+		pgpKeys: keys,
 	}
+	if keys != nil {
+		rcptData.encrypted = rcptDelivery
+	}
+	d.addedRcpts[accountName] = rcptData
 	return nil
 }
 
+// rcptHeader returns the header that is added to the message only for the
+// recipient.
+//
+// go-imap-sql does certain optimizations to store the message with small
+// amount of per-recipient data in a efficient way.
+func rcptHeader(accountName string) textproto.Header {
+	userHeader := textproto.Header{}
+	userHeader.Add("Delivered-To", accountName)
+	return userHeader
+}
+
 func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
 	defer trace.StartRegion(ctx, "sql/Body").End()
 
-	if !d.msgMeta.Quarantine && d.store.filters != nil {
+	if !d.msgMeta.Quarantine && (d.store.filters != nil || d.msgMeta.Folder != "" || len(d.msgMeta.Flags) != 0 || d.store.subaddrMode != subaddressOff) {
+		type rcptMailbox struct {
+			folder string
+			flags  []string
+		}
+		mailboxes := make(map[string]rcptMailbox, len(d.addedRcpts))
+		discarded := false
 		for rcpt, rcptData := range d.addedRcpts {
-			folder, flags, err := d.store.filters.IMAPFilter(rcpt, rcptData.rcptTo, d.msgMeta, header, body)
-			if err != nil {
-				d.store.Log.Error("IMAPFilter failed", err, "rcpt", rcpt)
-				continue
+			var (
+				folder string
+				flags  []string
+			)
+			if d.store.filters != nil {
+				var err error
+				folder, flags, err = d.store.filters.IMAPFilter(rcpt, rcptData.rcptTo, d.msgMeta, header, body)
+				if errors.Is(err, module.ErrIMAPFilterDiscard) {
+					d.store.Log.DebugMsg("message discarded by filter", "rcpt", rcpt)
+					if rcptData.encrypted != nil {
+						rcptData.encrypted.Abort()
+					}
+					delete(d.addedRcpts, rcpt)
+					discarded = true
+					continue
+				}
+				if err != nil {
+					d.store.Log.Error("IMAPFilter failed", err, "rcpt", rcpt)
+					continue
+				}
+			}
+			if folder == "" {
+				folder = d.metadataFolder(rcpt)
+			}
+			if folder == "" {
+				folder = d.subaddressFolder(rcpt, rcptData.rcptTo)
+			}
+			flags = append(flags, d.msgMeta.Flags...)
+			mailboxes[rcpt] = rcptMailbox{folder: folder, flags: flags}
+		}
+
+		if discarded {
+			if err := d.removeDiscarded(); err != nil {
+				return err
 			}
-			d.d.UserMailbox(rcpt, folder, flags)
+		}
+		for rcpt, mbox := range mailboxes {
+			d.rcptDelivery(d.addedRcpts[rcpt]).UserMailbox(rcpt, mbox.folder, mbox.flags)
 		}
 	}
 
 	if d.msgMeta.Quarantine {
 		if err := d.d.SpecialMailbox(imap.JunkAttr, d.store.junkMbox); err != nil {
-			if _, ok := err.(imapsql.SerializationError); ok {
-				return &exterrors.SMTPError{
-					Code:         453,
-					EnhancedCode: exterrors.EnhancedCode{4, 3, 2},
-					Message:      "Storage access serialiation problem, try again later",
-					TargetName:   "imapsql",
-					Err:          err,
-				}
+			return serializationErr(err)
+		}
+		for _, rcptData := range d.addedRcpts {
+			if rcptData.encrypted == nil {
+				continue
+			}
+			if err := rcptData.encrypted.SpecialMailbox(imap.JunkAttr, d.store.junkMbox); err != nil {
+				return serializationErr(err)
 			}
-			return err
 		}
 	}
 
 	header = header.Copy()
 	header.Add("Return-Path", "<"+target.SanitizeForHeader(d.mailFrom)+">")
-	err := d.d.BodyParsed(header, body.Len(), body)
+	// Do not let senders pretend the message was quarantined.
+	header.Del(quarantineHeader)
+	if d.msgMeta.Quarantine {
+		reason := d.msgMeta.QuarantineReason
+		if reason == "" {
+			reason = "Message quarantined by a policy check"
+		}
+		header.Add(quarantineHeader, target.SanitizeForHeader(reason))
+	}
+
+	if err := d.deliverEncrypted(header, body); err != nil {
+		return err
+	}
+
+	// The body is copied into the blob store even if it is spooled to a
+	// file already. go-imap-sql writes the blob itself: the header above
+	// followed by the body, compressed if compression is enabled, under
+	// the key it generates. So the spool file cannot be linked into the
+	// store as is.
+	//
+	// TODO: Pass the body by reference once go-imap-sql allows to store
+	// the header separately from the body.
+	return serializationErr(d.d.BodyParsed(header, body.Len(), body))
+}
+
+func serializationErr(err error) error {
 	if _, ok := err.(imapsql.SerializationError); ok {
 		return &exterrors.SMTPError{
 			Code:         453,
@@ -143,9 +303,140 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 	return err
 }
 
+// removeDiscarded recreates the shared delivery with recipients that are
+// left in addedRcpts since imapsql.Delivery does not allow to remove
+// added recipients.
+func (d *delivery) removeDiscarded() error {
+	if err := d.d.Abort(); err != nil {
+		return err
+	}
+	d.d = d.store.Back.NewDelivery()
+	for rcpt, rcptData := range d.addedRcpts {
+		if rcptData.encrypted != nil {
+			continue
+		}
+		if err := d.d.AddRcpt(rcpt, rcptHeader(rcpt)); err != nil {
+			if err == imapsql.ErrUserDoesntExists {
+				return userDoesNotExist(err)
+			}
+			return serializationErr(err)
+		}
+	}
+	return nil
+}
+
+// rcptDelivery returns the imapsql.Delivery the recipient was added to.
+func (d *delivery) rcptDelivery(rcptData addedRcpt) *imapsql.Delivery {
+	if rcptData.encrypted != nil {
+		return rcptData.encrypted
+	}
+	return &d.d
+}
+
+// deliverEncrypted stores the message for recipients that have a PGP key
+// set.
+//
+// Each such recipient has its own delivery that is committed immediately.
+// Transactions of different deliveries must not overlap since SQLite
+// allows only one writer at a time and the main delivery transaction is
+// kept open until Commit. If the main delivery fails later, the message
+// may be stored twice for these recipients when the delivery is retried.
+func (d *delivery) deliverEncrypted(header textproto.Header, body buffer.Buffer) error {
+	for rcpt, rcptData := range d.addedRcpts {
+		if rcptData.encrypted == nil {
+			continue
+		}
+
+		encHeader := header.Copy()
+		encBody := body
+		if !pgpenc.IsEncrypted(encHeader) {
+			r, err := body.Open()
+			if err != nil {
+				return err
+			}
+			blob, err := pgpenc.Encrypt(&encHeader, r, rcptData.pgpKeys)
+			r.Close()
+			if err != nil {
+				return &exterrors.SMTPError{
+					Code:         451,
+					EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+					Message:      "Internal server error, try again later",
+					ErrorID:      exterrors.IDStorageInternal,
+					TargetName:   "imapsql",
+					Err:          err,
+					Misc: map[string]interface{}{
+						"rcpt": rcpt,
+					},
+				}
+			}
+			encBody = buffer.MemoryBuffer{Slice: blob}
+		}
+
+		if err := rcptData.encrypted.BodyParsed(encHeader, encBody.Len(), encBody); err != nil {
+			rcptData.encrypted.Abort()
+			return serializationErr(err)
+		}
+		if err := rcptData.encrypted.Commit(); err != nil {
+			return serializationErr(err)
+		}
+		// Already stored, do not abort or deliver it again.
+		delete(d.addedRcpts, rcpt)
+	}
+	return nil
+}
+
+// metadataFolder returns the folder set in the message metadata (e.g. by
+// checks) creating it if it does not exist.
+func (d *delivery) metadataFolder(rcpt string) string {
+	if d.msgMeta.Folder == "" {
+		return ""
+	}
+
+	u, err := d.store.Back.GetUser(rcpt)
+	if err != nil {
+		d.store.Log.Error("metadata folder lookup failed", err, "rcpt", rcpt)
+		return ""
+	}
+	if err := u.CreateMailbox(d.msgMeta.Folder); err != nil && err != backend.ErrMailboxAlreadyExists {
+		d.store.Log.Error("failed to create folder", err, "rcpt", rcpt, "folder", d.msgMeta.Folder)
+		return ""
+	}
+	return d.msgMeta.Folder
+}
+
+// subaddressFolder returns the folder to deliver the message to based on the
+// subaddress of the original recipient address. Empty string is returned if
+// the message should be delivered to INBOX.
+func (d *delivery) subaddressFolder(rcpt, rcptTo string) string {
+	if d.store.subaddrMode == subaddressOff {
+		return ""
+	}
+	tag := subaddressTag(rcptTo, d.store.subaddrSeparator)
+	if tag == "" {
+		return ""
+	}
+
+	u, err := d.store.Back.GetUser(rcpt)
+	if err != nil {
+		d.store.Log.Error("subaddress folder lookup failed", err, "rcpt", rcpt)
+		return ""
+	}
+	folder, err := subaddressFolder(u, tag, d.store.subaddrMode == subaddressCreate)
+	if err != nil {
+		d.store.Log.Error("subaddress folder lookup failed", err, "rcpt", rcpt, "folder", tag)
+		return ""
+	}
+	return folder
+}
+
 func (d *delivery) Abort(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "sql/Abort").End()
 
+	for _, rcptData := range d.addedRcpts {
+		if rcptData.encrypted != nil {
+			rcptData.encrypted.Abort()
+		}
+	}
 	return d.d.Abort()
 }
 
@@ -0,0 +1,314 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/pgpenc"
+	"github.com/foxcpp/maddy/internal/storage/blob/fs"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func fetchInbox(t *testing.T, store *Storage, username string) []string {
+	t.Helper()
+
+	u, err := store.GetIMAPAcct(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, mbox, err := u.GetMailbox("INBOX", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seq, _ := imap.ParseSeqSet("1:*")
+	section := &imap.BodySectionName{Peek: true}
+	ch := make(chan *imap.Message, 10)
+	if err := mbox.ListMessages(false, seq, []imap.FetchItem{section.FetchItem()}, ch); err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []string
+	for msg := range ch {
+		for _, literal := range msg.Body {
+			blob, err := io.ReadAll(literal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, string(blob))
+		}
+	}
+	return msgs
+}
+
+func newTestBackend(t *testing.T) *imapsql.Backend {
+	t.Helper()
+
+	mod, err := fs.New("storage.blob.fs", "test", nil, []string{testutils.Dir(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	back, err := imapsql.New("sqlite3", ":memory:", ExtBlobStore{Base: mod.(module.BlobStore)}, imapsql.Opts{
+		Log: testutils.Logger(t, "imapsql"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return back
+}
+
+func TestDeliveryPGPEncryption(t *testing.T) {
+	back := newTestBackend(t)
+
+	e, err := openpgp.NewEntity("Test", "", "enc@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := pgpenc.FormatKey(openpgp.EntityList{e})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &Storage{
+		Back:   back,
+		driver: "sqlite3",
+		Log:    testutils.Logger(t, "imapsql"),
+		deliveryNormalize: func(_ context.Context, s string) (string, error) {
+			return s, nil
+		},
+		pgpKeys: testutils.Table{M: map[string]string{
+			"enc@example.org": key,
+		}},
+	}
+	defer store.Close()
+
+	for _, name := range []string{"plain@example.org", "enc@example.org"} {
+		if err := store.CreateIMAPAcct(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	d, err := store.Start(ctx, &module.MsgMetadata{ID: "testing"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"plain@example.org", "enc@example.org"} {
+		if err := d.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Secret")
+	hdr.Add("Content-Type", "text/plain")
+	if err := d.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte("Hello!\r\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	plain := fetchInbox(t, store, "plain@example.org")
+	if len(plain) != 1 || !strings.Contains(plain[0], "Hello!") {
+		t.Errorf("Wrong unencrypted message: %q", plain)
+	}
+
+	enc := fetchInbox(t, store, "enc@example.org")
+	if len(enc) != 1 {
+		t.Fatalf("Expected 1 encrypted message, got %d", len(enc))
+	}
+	if strings.Contains(enc[0], "Hello!") {
+		t.Error("Message is stored unencrypted")
+	}
+	for _, s := range []string{"Subject: Secret", "Delivered-To: enc@example.org", "multipart/encrypted", "-----BEGIN PGP MESSAGE-----"} {
+		if !bytes.Contains([]byte(enc[0]), []byte(s)) {
+			t.Errorf("Encrypted message does not contain %q", s)
+		}
+	}
+}
+
+type discardFilter map[string]bool
+
+func (f discardFilter) IMAPFilter(accountName, _ string, _ *module.MsgMetadata, _ textproto.Header, _ buffer.Buffer) (string, []string, error) {
+	if f[accountName] {
+		return "", nil, module.ErrIMAPFilterDiscard
+	}
+	return "", nil, nil
+}
+
+func TestDeliveryFilterDiscard(t *testing.T) {
+	store := &Storage{
+		Back:   newTestBackend(t),
+		driver: "sqlite3",
+		Log:    testutils.Logger(t, "imapsql"),
+		deliveryNormalize: func(_ context.Context, s string) (string, error) {
+			return s, nil
+		},
+		filters: discardFilter{"discard@example.org": true},
+	}
+	defer store.Close()
+
+	rcpts := []string{"keep@example.org", "discard@example.org"}
+	for _, name := range rcpts {
+		if err := store.CreateIMAPAcct(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	d, err := store.Start(ctx, &module.MsgMetadata{ID: "testing"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range rcpts {
+		if err := d.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Test")
+	if err := d.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte("Hello!\r\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if msgs := fetchInbox(t, store, "keep@example.org"); len(msgs) != 1 {
+		t.Errorf("expected 1 message for keep@, got %d", len(msgs))
+	}
+	u, err := store.GetIMAPAcct("discard@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := u.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 0 {
+		t.Errorf("expected no messages for discard@, got %d", status.Messages)
+	}
+}
+
+func TestDeliveryLookupFailed(t *testing.T) {
+	lookupErr := errors.New("connection refused")
+	store := &Storage{
+		Back:   newTestBackend(t),
+		driver: "sqlite3",
+		Log:    testutils.Logger(t, "imapsql"),
+		deliveryNormalize: func(_ context.Context, s string) (string, error) {
+			if s == "broken@example.org" {
+				return "", lookupFailed(lookupErr)
+			}
+			return "", errors.New("malformed address")
+		},
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	d, err := store.Start(ctx, &module.MsgMetadata{ID: "testing"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Abort(ctx)
+
+	// Lookup failure should not be reported as non-existent user.
+	err = d.AddRcpt(ctx, "broken@example.org", smtp.RcptOptions{})
+	if !exterrors.IsTemporary(err) || exterrors.IDOf(err) != exterrors.IDLookupFailed {
+		t.Errorf("Wrong error for lookup failure: %v %v", err, exterrors.Fields(err))
+	}
+	if !errors.Is(err, lookupErr) {
+		t.Errorf("Lookup error is not wrapped: %v", err)
+	}
+
+	err = d.AddRcpt(ctx, "invalid@example.org", smtp.RcptOptions{})
+	if exterrors.IsTemporary(err) {
+		t.Errorf("Wrong error for invalid address: %v %v", err, exterrors.Fields(err))
+	}
+}
+
+func TestDeliveryAutoCreate(t *testing.T) {
+	store := &Storage{
+		Back:   newTestBackend(t),
+		driver: "sqlite3",
+		Log:    testutils.Logger(t, "imapsql"),
+		deliveryNormalize: func(_ context.Context, s string) (string, error) {
+			return s, nil
+		},
+		deliveryAutoCreate: testutils.Table{M: map[string]string{"new@example.org": ""}},
+		autoCreateFolders:  true,
+		junkMbox:           "Junk",
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	d, err := store.Start(ctx, &module.MsgMetadata{ID: "testing"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddRcpt(ctx, "new@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	err = d.AddRcpt(ctx, "unknown@example.org", smtp.RcptOptions{})
+	if err == nil || exterrors.IsTemporary(err) {
+		t.Errorf("Expected permanent error for unknown recipient, got %v", err)
+	}
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Test")
+	if err := d.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte("Hello!\r\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if msgs := fetchInbox(t, store, "new@example.org"); len(msgs) != 1 {
+		t.Errorf("expected 1 message for new@, got %d", len(msgs))
+	}
+	u, err := store.GetIMAPAcct("new@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Sent", "Trash", "Junk", "Drafts", "Archive"} {
+		if _, _, err := u.GetMailbox(name, true, nil); err != nil {
+			t.Errorf("special folder %s is not created: %v", name, err)
+		}
+	}
+	if _, err := store.GetIMAPAcct("unknown@example.org"); err == nil {
+		t.Errorf("account is created for unknown recipient")
+	}
+}
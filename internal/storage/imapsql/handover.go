@@ -0,0 +1,135 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"sync"
+
+	mess "github.com/foxcpp/go-imap-mess"
+	"github.com/foxcpp/maddy/internal/updatepipe"
+)
+
+// When the configuration is reloaded, the new storage instance can be
+// initialized while the old one is still used by IMAP sessions that were
+// started before the reload. Both instances use the same update pipe socket
+// but only one of them can listen on it.
+//
+// Instances using the same socket form a group. The newest instance
+// listens on the socket, older instances stop listening and deliver updates
+// to other group members directly. Updates from other processes are
+// received by the newest instance and are passed to other members too.
+
+type updGroup struct {
+	// members are ordered by the time they joined the group, the last one
+	// listens on the socket.
+	members []*Storage
+}
+
+var (
+	updGroups    = map[string]*updGroup{}
+	updGroupsLck sync.Mutex
+)
+
+// joinUpdGroup makes the storage the listening member of the group for its
+// socket. The previous listening member stops listening.
+func (store *Storage) joinUpdGroup(sockPath string, inbound chan<- mess.Update) error {
+	updGroupsLck.Lock()
+	defer updGroupsLck.Unlock()
+
+	g := updGroups[sockPath]
+	if g == nil {
+		g = &updGroup{}
+		updGroups[sockPath] = g
+	}
+	var prev *Storage
+	if len(g.members) != 0 {
+		prev = g.members[len(g.members)-1]
+		store.Log.DebugMsg("taking over the update pipe from the previous instance")
+		prev.updPipe.(*updatepipe.UnixSockPipe).StopListening()
+	}
+
+	if err := store.updPipe.Listen(inbound); err != nil {
+		if prev != nil {
+			if err := prev.updPipe.Listen(prev.inboundUpds); err != nil {
+				prev.Log.Error("failed to resume listening for updates", err)
+			}
+		}
+		if len(g.members) == 0 {
+			delete(updGroups, sockPath)
+		}
+		return err
+	}
+
+	store.updGroupKey = sockPath
+	store.inboundUpds = inbound
+	g.members = append(g.members, store)
+	return nil
+}
+
+// leaveUpdGroup removes the storage from its group. If it was listening on
+// the socket, the previous member starts listening again.
+func (store *Storage) leaveUpdGroup() {
+	updGroupsLck.Lock()
+	defer updGroupsLck.Unlock()
+
+	g := updGroups[store.updGroupKey]
+	if g == nil {
+		return
+	}
+	for i, m := range g.members {
+		if m != store {
+			continue
+		}
+		g.members = append(g.members[:i], g.members[i+1:]...)
+		if i == len(g.members) && i != 0 {
+			// The storage was listening, pass it back.
+			prev := g.members[i-1]
+			store.updPipe.(*updatepipe.UnixSockPipe).StopListening()
+			if err := prev.updPipe.Listen(prev.inboundUpds); err != nil {
+				prev.Log.Error("failed to resume listening for updates", err)
+			}
+		}
+		break
+	}
+	if len(g.members) == 0 {
+		delete(updGroups, store.updGroupKey)
+	}
+}
+
+// shareUpdate delivers the update to other members of the group. It
+// returns the pipe that should be used to send the update to other
+// processes: updates from the old instances are sent using the pipe of the
+// listening instance so it does not receive them again.
+func (store *Storage) shareUpdate(upd mess.Update) updatepipe.P {
+	updGroupsLck.Lock()
+	g := updGroups[store.updGroupKey]
+	if g == nil {
+		updGroupsLck.Unlock()
+		return store.updPipe
+	}
+	members := append([]*Storage(nil), g.members...)
+	updGroupsLck.Unlock()
+
+	for _, m := range members {
+		if m != store {
+			m.Back.UpdateManager().ExternalUpdate(upd)
+		}
+	}
+	return members[len(members)-1].updPipe
+}
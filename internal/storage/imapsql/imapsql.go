@@ -31,10 +31,13 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"path/filepath"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/emersion/go-imap"
 	sortthread "github.com/emersion/go-imap-sortthread"
@@ -47,6 +50,8 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/sieve"
+	"github.com/foxcpp/maddy/internal/storagepath"
 	"github.com/foxcpp/maddy/internal/updatepipe"
 	"github.com/foxcpp/maddy/internal/updatepipe/pubsub"
 
@@ -61,21 +66,63 @@ type Storage struct {
 
 	junkMbox string
 
+	subaddrMode      string
+	subaddrSeparator string
+
 	driver string
 	dsn    []string
 
 	resolver dns.Resolver
 
 	updPipe      updatepipe.P
+	updRedis     string
+	updPrefix    string
 	updPushStop  chan struct{}
 	outboundUpds chan mess.Update
+	inboundUpds  chan<- mess.Update
+	// updGroupKey is the socket path if the storage is a member of the
+	// update pipe group, see handover.go.
+	updGroupKey string
 
 	filters module.IMAPFilter
 
+	blobStore module.BlobStore
+	// blobGCStop cancels the context used by the blob GC job, blobGCDone is
+	// closed once it exits.
+	blobGCStop context.CancelFunc
+	blobGCDone chan struct{}
+
 	deliveryMap       module.Table
 	deliveryNormalize func(context.Context, string) (string, error)
 	authMap           module.Table
 	authNormalize     func(context.Context, string) (string, error)
+
+	accountStatus module.Table
+
+	// Accounts listed in deliveryAutoCreate are created on first delivery,
+	// special-use folders are added to automatically created accounts if
+	// autoCreateFolders is set. See autocreate.go.
+	deliveryAutoCreate module.Table
+	autoCreateFolders  bool
+
+	// Initial folders, quota, filters and aliases for new accounts, see
+	// template.go.
+	templates []*accountTemplate
+
+	// Table with public keys of users that want messages to be stored
+	// encrypted, see pgpenc package.
+	pgpKeys module.Table
+
+	// Whether to upgrade the database schema on start-up and the command
+	// to run before it, see checkSchema.
+	autoMigrate bool
+	schemaHook  []string
+
+	// Default quota limits, zero means no limit. See quota.go.
+	quotaStorage   int64
+	quotaMessages  int64
+	quotaTableOnce sync.Once
+	quotaTableErr  error
 }
 
 func (store *Storage) Name() string {
@@ -113,6 +160,10 @@ func (store *Storage) Init(cfg *config.Map) error {
 		deliveryNormalize string
 
 		blobStore module.BlobStore
+
+		blobGCInterval time.Duration
+		blobGCGrace    time.Duration
+		blobGCCleanup  bool
 	)
 
 	opts := imapsql.Opts{}
@@ -125,7 +176,7 @@ func (store *Storage) Init(cfg *config.Map) error {
 	})
 	cfg.Custom("msg_store", false, false, func() (interface{}, error) {
 		var store module.BlobStore
-		err := modconfig.ModuleFromNode("storage.blob", []string{"fs", "messages"},
+		err := modconfig.ModuleFromNode("storage.blob", []string{"fs", storagepath.Dir(storagepath.Messages, "messages")},
 			config.Node{}, nil, &store)
 		return store, err
 	}, func(m *config.Map, node config.Node) (interface{}, error) {
@@ -141,6 +192,9 @@ func (store *Storage) Init(cfg *config.Map) error {
 	cfg.Int("sqlite3_busy_timeout", false, false, 5000, &opts.BusyTimeout)
 	cfg.Bool("disable_recent", false, true, &opts.DisableRecent)
 	cfg.String("junk_mailbox", false, false, "Junk", &store.junkMbox)
+	cfg.Enum("delivery_subaddress_folder", false, false,
+		[]string{subaddressOff, subaddressExisting, subaddressCreate}, subaddressOff, &store.subaddrMode)
+	cfg.String("delivery_subaddress_separator", false, false, "+", &store.subaddrSeparator)
 	cfg.Custom("imap_filter", false, false, func() (interface{}, error) {
 		return nil, nil
 	}, func(m *config.Map, node config.Node) (interface{}, error) {
@@ -156,11 +210,47 @@ func (store *Storage) Init(cfg *config.Map) error {
 		return nil, nil
 	}, modconfig.TableDirective, &store.deliveryMap)
 	cfg.String("delivery_normalize", false, false, "precis_casefold_email", &deliveryNormalize)
+	modconfig.Table(cfg, "account_status", true, false, nil, &store.accountStatus)
+	modconfig.Table(cfg, "delivery_auto_create", false, false, nil, &store.deliveryAutoCreate)
+	cfg.Bool("auto_create_special_folders", false, false, &store.autoCreateFolders)
+	cfg.Callback("account_template", func(m *config.Map, node config.Node) error {
+		t, err := parseAccountTemplate(m.Globals, node)
+		if err != nil {
+			return err
+		}
+		store.templates = append(store.templates, t)
+		return nil
+	})
+	modconfig.Table(cfg, "pgp_keys", false, false, nil, &store.pgpKeys)
+	cfg.Duration("blob_gc_interval", false, false, 0, &blobGCInterval)
+	cfg.Duration("blob_gc_grace", false, false, 1*time.Hour, &blobGCGrace)
+	cfg.Bool("blob_gc_cleanup", false, false, &blobGCCleanup)
+	cfg.Bool("auto_migrate", false, true, &store.autoMigrate)
+	cfg.StringList("schema_upgrade_hook", false, false, nil, &store.schemaHook)
+	cfg.String("update_pipe_redis", false, false, "", &store.updRedis)
+	cfg.String("update_pipe_prefix", false, false, "maddy.", &store.updPrefix)
+	cfg.DataSize("quota_storage", false, false, 0, &store.quotaStorage)
+	cfg.Int64("quota_messages", false, false, 0, &store.quotaMessages)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
+	for _, t := range store.templates {
+		if t.sieveScript == "" || t.sieveStore != nil {
+			continue
+		}
+		sieveStore, ok := store.filters.(sieve.Store)
+		if !ok {
+			return errors.New("imapsql: account_template: sieve_store is required to use sieve_script")
+		}
+		t.sieveStore = sieveStore
+	}
+
+	if store.subaddrSeparator == "" {
+		return errors.New("imapsql: delivery_subaddress_separator should not be empty")
+	}
+
 	if dsn == nil {
 		return errors.New("imapsql: dsn is required")
 	}
@@ -193,8 +283,11 @@ func (store *Storage) Init(cfg *config.Map) error {
 				return "", err
 			}
 			mapped, ok, err := store.deliveryMap.Lookup(ctx, email)
-			if err != nil || !ok {
-				return "", userDoesNotExist(err)
+			if err != nil {
+				return "", lookupFailed(err)
+			}
+			if !ok {
+				return "", userDoesNotExist(nil)
 			}
 			return mapped, nil
 		}
@@ -264,6 +357,10 @@ func (store *Storage) Init(cfg *config.Map) error {
 		}
 	}
 
+	store.driver = driver
+	if err := store.checkSchema(driver, dsnStr); err != nil {
+		return err
+	}
 	store.Back, err = imapsql.New(driver, dsnStr, ExtBlobStore{Base: blobStore}, opts)
 	if err != nil {
 		return fmt.Errorf("imapsql: %s", err)
@@ -271,42 +368,95 @@ func (store *Storage) Init(cfg *config.Map) error {
 
 	store.Log.Debugln("go-imap-sql version", imapsql.VersionStr)
 
+	if store.quotaStorage < 0 || store.quotaMessages < 0 {
+		return errors.New("imapsql: quota limits cannot be negative")
+	}
+	if err := store.initQuotaTable(); err != nil {
+		return err
+	}
+
 	store.driver = driver
 	store.dsn = dsn
+	store.blobStore = blobStore
+
+	if blobGCInterval != 0 && !module.NoRun {
+		if _, ok := blobStore.(module.BlobLister); !ok {
+			return errors.New("imapsql: blob_gc_interval is set but msg_store does not support listing")
+		}
+		var ctx context.Context
+		ctx, store.blobGCStop = context.WithCancel(context.Background())
+		store.blobGCDone = make(chan struct{})
+		go store.blobGCLoop(ctx, blobGCInterval, blobGCGrace, blobGCCleanup)
+	}
 
 	return nil
 }
 
+// updSockPath returns the path of the unix socket used as the update pipe
+// for SQLite databases.
+func (store *Storage) updSockPath() string {
+	dbId := sha1.Sum([]byte(strings.Join(store.dsn, " ")))
+	return filepath.Join(
+		config.RuntimeDirectory,
+		fmt.Sprintf("sql-%s.sock", hex.EncodeToString(dbId[:])))
+}
+
+// SubscribeUpdates implements updatepipe.Subscriber.
+func (store *Storage) SubscribeUpdates(upds chan<- mess.Update) (io.Closer, error) {
+	if store.driver != "sqlite3" {
+		return nil, errors.New("imapsql: updates subscription is supported only for sqlite3 driver")
+	}
+	pipe := &updatepipe.UnixSockPipe{
+		SockPath: store.updSockPath(),
+		Log:      log.Logger{Name: "storage.imapsql/updpipe", Debug: store.Log.Debug},
+	}
+	if err := pipe.Subscribe(upds); err != nil {
+		return nil, err
+	}
+	return pipe, nil
+}
+
+// pubSubPipe creates the update pipe on top of the message broker and
+// makes the update manager subscribe only to the mailboxes in use.
+func (store *Storage) pubSubPipe(ps pubsub.PubSub) updatepipe.P {
+	pipe := &updatepipe.PubSubPipe{
+		PubSub: ps,
+		Log:    log.Logger{Name: "storage.imapsql/updpipe", Debug: store.Log.Debug},
+	}
+	store.Back.UpdateManager().ExternalUnsubscribe = pipe.Unsubscribe
+	store.Back.UpdateManager().ExternalSubscribe = pipe.Subscribe
+	return pipe
+}
+
 func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 	if store.updPipe != nil {
 		return nil
 	}
 
-	switch store.driver {
-	case "sqlite3":
-		dbId := sha1.Sum([]byte(strings.Join(store.dsn, " ")))
-		sockPath := filepath.Join(
-			config.RuntimeDirectory,
-			fmt.Sprintf("sql-%s.sock", hex.EncodeToString(dbId[:])))
+	switch {
+	case store.updRedis != "":
+		store.Log.DebugMsg("using Redis broker for external updates")
+		ps, err := pubsub.NewRedis(store.updRedis, store.updPrefix)
+		if err != nil {
+			return fmt.Errorf("enable_update_pipe: %w", err)
+		}
+		ps.Log = log.Logger{Name: "storage.imapsql/updpipe/pubsub", Debug: store.Log.Debug}
+		store.updPipe = store.pubSubPipe(ps)
+	case store.driver == "sqlite3":
+		sockPath := store.updSockPath()
 		store.Log.DebugMsg("using unix socket for external updates", "path", sockPath)
 		store.updPipe = &updatepipe.UnixSockPipe{
 			SockPath: sockPath,
 			Log:      log.Logger{Name: "storage.imapsql/updpipe", Debug: store.Log.Debug},
 		}
-	case "postgres":
+	case store.driver == "postgres":
 		store.Log.DebugMsg("using PostgreSQL broker for external updates")
 		ps, err := pubsub.NewPQ(strings.Join(store.dsn, " "))
 		if err != nil {
 			return fmt.Errorf("enable_update_pipe: %w", err)
 		}
 		ps.Log = log.Logger{Name: "storage.imapsql/updpipe/pubsub", Debug: store.Log.Debug}
-		pipe := &updatepipe.PubSubPipe{
-			PubSub: ps,
-			Log:    log.Logger{Name: "storage.imapsql/updpipe", Debug: store.Log.Debug},
-		}
-		store.Back.UpdateManager().ExternalUnsubscribe = pipe.Unsubscribe
-		store.Back.UpdateManager().ExternalSubscribe = pipe.Subscribe
-		store.updPipe = pipe
+		store.updPipe = store.pubSubPipe(ps)
 	default:
 		return errors.New("imapsql: driver does not have an update pipe implementation")
 	}
@@ -316,7 +466,13 @@ func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 	store.outboundUpds = outbound
 
 	if mode == updatepipe.ModeReplicate {
-		if err := store.updPipe.Listen(inbound); err != nil {
+		var err error
+		if usp, ok := store.updPipe.(*updatepipe.UnixSockPipe); ok {
+			err = store.joinUpdGroup(usp.SockPath, inbound)
+		} else {
+			err = store.updPipe.Listen(inbound)
+		}
+		if err != nil {
 			store.updPipe = nil
 			return err
 		}
@@ -334,7 +490,7 @@ func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 		defer func() {
 			// Ensure we sent all outbound updates.
 			for upd := range outbound {
-				if err := store.updPipe.Push(upd); err != nil {
+				if err := store.shareUpdate(upd).Push(upd); err != nil {
 					store.Log.Error("IMAP update pipe push failed", err)
 				}
 			}
@@ -351,12 +507,13 @@ func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 			case u := <-inbound:
 				store.Log.DebugMsg("external update received", "type", u.Type, "key", u.Key)
 				store.Back.UpdateManager().ExternalUpdate(u)
+				store.shareUpdate(u)
 			case u, ok := <-outbound:
 				if !ok {
 					return
 				}
 				store.Log.DebugMsg("sending external update", "type", u.Type, "key", u.Key)
-				if err := store.updPipe.Push(u); err != nil {
+				if err := store.shareUpdate(u).Push(u); err != nil {
 					store.Log.Error("IMAP update pipe push failed", err)
 				}
 			}
@@ -384,7 +541,12 @@ func (store *Storage) GetOrCreateIMAPAcct(username string) (backend.User, error)
 		return nil, backend.ErrInvalidCredentials
 	}
 
-	return store.Back.GetOrCreateUser(accountName)
+	u, err := store.Back.GetUser(accountName)
+	if err == nil || !errors.Is(err, imapsql.ErrUserDoesntExists) {
+		return u, err
+	}
+
+	return store.autoCreateAccount(accountName)
 }
 
 func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, error) {
@@ -408,6 +570,18 @@ func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, err
 }
 
 func (store *Storage) Close() error {
+	if store.blobGCStop != nil {
+		store.blobGCStop()
+		<-store.blobGCDone
+	}
+
+	// Hand over listening for updates to the previous instance, if any.
+	// Updates generated while closing are still delivered to other
+	// instances.
+	if store.updGroupKey != "" {
+		store.leaveUpdGroup()
+	}
+
 	// Stop backend from generating new updates.
 	store.Back.Close()
 
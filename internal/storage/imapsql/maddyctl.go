@@ -19,7 +19,13 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package imapsql
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
 	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
 )
 
 // These methods wrap corresponding go-imap-sql methods, but also apply
@@ -30,11 +36,99 @@ func (store *Storage) ListIMAPAccts() ([]string, error) {
 }
 
 func (store *Storage) CreateIMAPAcct(accountName string) error {
-	return store.Back.CreateUser(accountName)
+	if err := store.Back.CreateUser(accountName); err != nil {
+		return err
+	}
+	u, err := store.Back.GetUser(accountName)
+	if err != nil {
+		return err
+	}
+	store.provisionAccount(u, accountName, false)
+	return nil
 }
 
 func (store *Storage) DeleteIMAPAcct(accountName string) error {
-	return store.Back.DeleteUser(accountName)
+	if err := store.Back.DeleteUser(accountName); err != nil {
+		return err
+	}
+
+	if err := store.initQuotaTable(); err != nil {
+		return err
+	}
+	_, err := store.Back.DB.Exec(store.rebind(`DELETE FROM maddy_quotas WHERE username = ?`), strings.ToLower(accountName))
+	if err != nil {
+		return fmt.Errorf("imapsql: delete %s: %w", accountName, err)
+	}
+	return nil
+}
+
+func (store *Storage) RenameIMAPAcct(oldName, newName string) error {
+	// go-imap-sql stores account names in lower case.
+	oldName = strings.ToLower(oldName)
+	newName = strings.ToLower(newName)
+	if oldName == newName {
+		return fmt.Errorf("imapsql: rename %s: old and new names are the same", oldName)
+	}
+
+	if err := store.initQuotaTable(); err != nil {
+		return err
+	}
+
+	tx, err := store.Back.DB.BeginTx(context.TODO(), nil)
+	if err != nil {
+		return fmt.Errorf("imapsql: rename %s: %w", oldName, err)
+	}
+	defer tx.Rollback()
+
+	var id uint64
+	err = tx.QueryRow(store.rebind(`SELECT id FROM users WHERE username = ?`), newName).Scan(&id)
+	if err == nil {
+		return fmt.Errorf("imapsql: rename %s: account %s already exists", oldName, newName)
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("imapsql: rename %s: %w", oldName, err)
+	}
+
+	res, err := tx.Exec(store.rebind(`UPDATE users SET username = ? WHERE username = ?`), newName, oldName)
+	if err != nil {
+		return fmt.Errorf("imapsql: rename %s: %w", oldName, err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("imapsql: rename %s: %w", oldName, err)
+	}
+	if affected == 0 {
+		return imapsql.ErrUserDoesntExists
+	}
+
+	_, err = tx.Exec(store.rebind(`UPDATE maddy_quotas SET username = ? WHERE username = ?`), newName, oldName)
+	if err != nil {
+		return fmt.Errorf("imapsql: rename %s: %w", oldName, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("imapsql: rename %s: %w", oldName, err)
+	}
+	return nil
+}
+
+// rebind converts '?' placeholders in the query to the driver-specific
+// form.
+func (store *Storage) rebind(query string) string {
+	if store.driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, ch := range query {
+		if ch != '?' {
+			b.WriteRune(ch)
+			continue
+		}
+		n++
+		fmt.Fprintf(&b, "$%d", n)
+	}
+	return b.String()
 }
 
 func (store *Storage) GetIMAPAcct(accountName string) (backend.User, error) {
@@ -0,0 +1,101 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/storage/blob/fs"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestRenameIMAPAcct(t *testing.T) {
+	mod, err := fs.New("storage.blob.fs", "test", nil, []string{testutils.Dir(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+
+	back, err := imapsql.New("sqlite3", ":memory:", ExtBlobStore{Base: mod.(module.BlobStore)}, imapsql.Opts{
+		Log: testutils.Logger(t, "imapsql"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &Storage{Back: back, driver: "sqlite3", Log: testutils.Logger(t, "imapsql")}
+	defer store.Close()
+
+	for _, name := range []string{"old@example.org", "taken@example.org"} {
+		if err := store.CreateIMAPAcct(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u, err := store.GetIMAPAcct("old@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := bytes.NewReader([]byte("Subject: test\r\n\r\nHello!\r\n"))
+	if err := u.CreateMessage("INBOX", nil, time.Now(), body, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.RenameIMAPAcct("old@example.org", "taken@example.org"); err == nil {
+		t.Error("Expected an error for existing account")
+	}
+	if err := store.RenameIMAPAcct("missing@example.org", "new2@example.org"); err != imapsql.ErrUserDoesntExists {
+		t.Error("Expected ErrUserDoesntExists, got", err)
+	}
+
+	if err := store.RenameIMAPAcct("Old@example.org", "New@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetIMAPAcct("old@example.org"); err != imapsql.ErrUserDoesntExists {
+		t.Error("Old account still exists:", err)
+	}
+	u, err = store.GetIMAPAcct("new@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := u.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 1 {
+		t.Error("Expected 1 message in renamed account, got", status.Messages)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	store := &Storage{driver: "postgres"}
+	if q := store.rebind("UPDATE t SET a = ? WHERE b = ?"); q != "UPDATE t SET a = $1 WHERE b = $2" {
+		t.Error("Unexpected query:", q)
+	}
+	store.driver = "sqlite3"
+	if q := store.rebind("SELECT ?"); q != "SELECT ?" {
+		t.Error("Unexpected query:", q)
+	}
+}
@@ -0,0 +1,214 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// quotaColumns maps quota resources to columns of the maddy_quotas table.
+var quotaColumns = map[string]string{
+	module.QuotaResourceStorage:  "storage_limit",
+	module.QuotaResourceMessages: "messages_limit",
+}
+
+// initQuotaTable creates the table with per-account quota limits.
+//
+// NULL values in it mean that the default limit set in the configuration is
+// used.
+func (store *Storage) initQuotaTable() error {
+	store.quotaTableOnce.Do(func() {
+		_, store.quotaTableErr = store.Back.DB.Exec(`CREATE TABLE IF NOT EXISTS maddy_quotas (
+			username VARCHAR(255) NOT NULL PRIMARY KEY,
+			storage_limit BIGINT DEFAULT NULL,
+			messages_limit BIGINT DEFAULT NULL
+		)`)
+	})
+	if store.quotaTableErr != nil {
+		return fmt.Errorf("imapsql: create quota table: %w", store.quotaTableErr)
+	}
+	return nil
+}
+
+// quotaLimits returns the effective quota limits for the account.
+func (store *Storage) quotaLimits(ctx context.Context, username string) (storage, messages int64, err error) {
+	if err := store.initQuotaTable(); err != nil {
+		return 0, 0, err
+	}
+
+	var storageLimit, messagesLimit sql.NullInt64
+	err = store.Back.DB.QueryRowContext(ctx, store.rebind(`SELECT storage_limit, messages_limit FROM maddy_quotas WHERE username = ?`),
+		strings.ToLower(username)).Scan(&storageLimit, &messagesLimit)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, fmt.Errorf("imapsql: quota limits %s: %w", username, err)
+	}
+
+	storage, messages = store.quotaStorage, store.quotaMessages
+	if storageLimit.Valid {
+		storage = storageLimit.Int64
+	}
+	if messagesLimit.Valid {
+		messages = messagesLimit.Int64
+	}
+	return storage, messages, nil
+}
+
+// quotaUsage returns the total size and the amount of messages stored in all
+// mailboxes of the account.
+func (store *Storage) quotaUsage(ctx context.Context, username string) (storage, messages int64, err error) {
+	err = store.Back.DB.QueryRowContext(ctx, store.rebind(`
+		SELECT COUNT(*), COALESCE(SUM(msgs.bodyLen), 0)
+		FROM msgs
+		INNER JOIN mboxes ON msgs.mboxId = mboxes.id
+		INNER JOIN users ON mboxes.uid = users.id
+		WHERE users.username = ?`), strings.ToLower(username)).Scan(&messages, &storage)
+	if err != nil {
+		return 0, 0, fmt.Errorf("imapsql: quota usage %s: %w", username, err)
+	}
+	return storage, messages, nil
+}
+
+func (store *Storage) GetQuota(username string) (module.QuotaUsage, error) {
+	ctx := context.TODO()
+
+	var (
+		usage module.QuotaUsage
+		err   error
+	)
+	usage.StorageLimit, usage.MessagesLimit, err = store.quotaLimits(ctx, username)
+	if err != nil {
+		return module.QuotaUsage{}, err
+	}
+	usage.StorageUsed, usage.MessagesUsed, err = store.quotaUsage(ctx, username)
+	if err != nil {
+		return module.QuotaUsage{}, err
+	}
+	return usage, nil
+}
+
+func (store *Storage) SetQuotaLimit(username, resource string, limit int64) error {
+	column, ok := quotaColumns[resource]
+	if !ok {
+		return fmt.Errorf("imapsql: unknown quota resource: %s", resource)
+	}
+	if limit < -1 {
+		return fmt.Errorf("imapsql: invalid quota limit: %d", limit)
+	}
+	if err := store.initQuotaTable(); err != nil {
+		return err
+	}
+
+	username = strings.ToLower(username)
+	var value interface{} = limit
+	if limit == -1 {
+		value = nil
+	}
+
+	tx, err := store.Back.DB.BeginTx(context.TODO(), nil)
+	if err != nil {
+		return fmt.Errorf("imapsql: set quota %s: %w", username, err)
+	}
+	defer tx.Rollback()
+
+	var id uint64
+	err = tx.QueryRow(store.rebind(`SELECT id FROM users WHERE username = ?`), username).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return imapsql.ErrUserDoesntExists
+		}
+		return fmt.Errorf("imapsql: set quota %s: %w", username, err)
+	}
+
+	var rows int
+	err = tx.QueryRow(store.rebind(`SELECT COUNT(*) FROM maddy_quotas WHERE username = ?`), username).Scan(&rows)
+	if err != nil {
+		return fmt.Errorf("imapsql: set quota %s: %w", username, err)
+	}
+	if rows == 0 {
+		_, err = tx.Exec(store.rebind(`INSERT INTO maddy_quotas (username, `+column+`) VALUES (?, ?)`), username, value)
+	} else {
+		_, err = tx.Exec(store.rebind(`UPDATE maddy_quotas SET `+column+` = ? WHERE username = ?`), value, username)
+	}
+	if err != nil {
+		return fmt.Errorf("imapsql: set quota %s: %w", username, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("imapsql: set quota %s: %w", username, err)
+	}
+	return nil
+}
+
+// checkQuota checks whether the message of the specified size can be
+// delivered to the account without exceeding its quota.
+//
+// size is the size declared by the client and may be zero if it is not
+// known. In this case, only accounts that are already over quota are
+// rejected.
+func (store *Storage) checkQuota(ctx context.Context, username string, size int64) error {
+	internalErr := func(err error) error {
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Internal server error, try again later",
+			ErrorID:      exterrors.IDStorageInternal,
+			TargetName:   "imapsql",
+			Err:          err,
+		}
+	}
+
+	storageLimit, messagesLimit, err := store.quotaLimits(ctx, username)
+	if err != nil {
+		return internalErr(err)
+	}
+	if storageLimit == 0 && messagesLimit == 0 {
+		return nil
+	}
+
+	storage, messages, err := store.quotaUsage(ctx, username)
+	if err != nil {
+		return internalErr(err)
+	}
+
+	if (storageLimit != 0 && storage+size > storageLimit) ||
+		(messagesLimit != 0 && messages+1 > messagesLimit) {
+		return &exterrors.SMTPError{
+			Code:         552,
+			EnhancedCode: exterrors.EnhancedCode{5, 2, 2},
+			Message:      "Mailbox is full",
+			TargetName:   "imapsql",
+			Reason:       "quota exceeded",
+			Misc: map[string]interface{}{
+				"storage_used":   storage,
+				"storage_limit":  storageLimit,
+				"messages_used":  messages,
+				"messages_limit": messagesLimit,
+			},
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func deliverTestMsg(t *testing.T, store *Storage, rcpt string) error {
+	t.Helper()
+
+	ctx := context.Background()
+	d, err := store.Start(ctx, &module.MsgMetadata{ID: "testing"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+		d.Abort(ctx)
+		return err
+	}
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Test")
+	if err := d.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte("Hello!\r\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return nil
+}
+
+func TestQuota(t *testing.T) {
+	store := &Storage{
+		Back:   newTestBackend(t),
+		driver: "sqlite3",
+		Log:    testutils.Logger(t, "imapsql"),
+		deliveryNormalize: func(_ context.Context, s string) (string, error) {
+			return s, nil
+		},
+		quotaMessages: 1,
+	}
+	defer store.Close()
+
+	if err := store.CreateIMAPAcct("user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deliverTestMsg(t, store, "user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	err := deliverTestMsg(t, store, "user@example.org")
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 552 {
+		t.Fatal("Expected 552 error, got", err)
+	}
+
+	usage, err := store.GetQuota("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.MessagesUsed != 1 || usage.MessagesLimit != 1 || usage.StorageUsed == 0 || usage.StorageLimit != 0 {
+		t.Errorf("Unexpected quota usage: %+v", usage)
+	}
+
+	if err := store.SetQuotaLimit("user@example.org", module.QuotaResourceMessages, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := deliverTestMsg(t, store, "user@example.org"); err != nil {
+		t.Fatal("Delivery failed after the limit is removed:", err)
+	}
+
+	if err := store.SetQuotaLimit("user@example.org", module.QuotaResourceStorage, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RenameIMAPAcct("user@example.org", "new@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	usage, err = store.GetQuota("new@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.StorageLimit != 10 || usage.MessagesLimit != 0 || usage.MessagesUsed != 2 {
+		t.Errorf("Quota is not preserved on rename: %+v", usage)
+	}
+
+	if err := store.SetQuotaLimit("new@example.org", module.QuotaResourceMessages, -1); err != nil {
+		t.Fatal(err)
+	}
+	usage, err = store.GetQuota("new@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.MessagesLimit != 1 {
+		t.Errorf("Default limit is not restored: %+v", usage)
+	}
+
+	if err := store.SetQuotaLimit("missing@example.org", module.QuotaResourceStorage, 10); err == nil {
+		t.Error("Expected an error for missing account")
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+)
+
+// LatestSchemaVersion is the database schema version used by this maddy
+// version. Older schemas are upgraded to it, go-imap-sql does not support
+// upgrading to other versions.
+const LatestSchemaVersion = imapsql.SchemaVersion
+
+// SchemaUpgradeFunc, if set, is called by Init if the database schema is
+// outdated. The schema is upgraded if it returns nil, otherwise Init fails
+// with the returned error. auto_migrate directive is ignored in this case.
+//
+// It is set by 'maddy imap-db migrate' command to perform the upgrade
+// explicitly.
+var SchemaUpgradeFunc func(current, latest int) error
+
+// SchemaError is returned by Init if the database schema is outdated and it
+// is not upgraded.
+type SchemaError struct {
+	Current int
+	Latest  int
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("imapsql: database schema is outdated (version %d, latest %d), run 'maddy imap-db migrate' to upgrade it",
+		e.Current, e.Latest)
+}
+
+// readSchemaVersion returns the schema version recorded in the database
+// without changing it. 0 is returned for the empty database.
+func (store *Storage) readSchemaVersion(driver, dsn string) (int, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	query := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`
+	if driver == "postgres" {
+		query = `SELECT COUNT(*) FROM information_schema.tables WHERE table_name = ?`
+	}
+	var tables int
+	if err := db.QueryRow(store.rebind(query), "schema_version").Scan(&tables); err != nil {
+		return 0, err
+	}
+	if tables == 0 {
+		return 0, nil
+	}
+
+	var version int
+	err = db.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+// checkSchema is called before go-imap-sql is initialized (and so upgrades
+// the schema) to make sure the upgrade is allowed and to run the pre-upgrade
+// hook.
+func (store *Storage) checkSchema(driver, dsn string) error {
+	version, err := store.readSchemaVersion(driver, dsn)
+	if err != nil {
+		return fmt.Errorf("imapsql: failed to read schema version: %w", err)
+	}
+	// go-imap-sql reports too new schema itself.
+	if version == 0 || version >= LatestSchemaVersion {
+		return nil
+	}
+
+	if SchemaUpgradeFunc != nil {
+		if err := SchemaUpgradeFunc(version, LatestSchemaVersion); err != nil {
+			return err
+		}
+	} else if !store.autoMigrate {
+		return &SchemaError{Current: version, Latest: LatestSchemaVersion}
+	}
+
+	if len(store.schemaHook) != 0 {
+		store.Log.Msg("running pre-upgrade hook", "hook", strings.Join(store.schemaHook, " "))
+		if err := store.runSchemaHook(driver, dsn, version); err != nil {
+			return fmt.Errorf("imapsql: pre-upgrade hook failed, schema is not upgraded: %w", err)
+		}
+	}
+	store.Log.Msg("upgrading database schema", "from", version, "to", LatestSchemaVersion)
+	return nil
+}
+
+func (store *Storage) runSchemaHook(driver, dsn string, version int) error {
+	cmd := exec.Command(store.schemaHook[0], store.schemaHook[1:]...)
+	cmd.Env = append(os.Environ(),
+		"MADDY_SCHEMA_FROM="+strconv.Itoa(version),
+		"MADDY_SCHEMA_TO="+strconv.Itoa(LatestSchemaVersion),
+		"MADDY_DRIVER="+driver,
+		"MADDY_DSN="+dsn,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if out = bytes.TrimSpace(out); len(out) != 0 {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+		return err
+	}
+	return nil
+}
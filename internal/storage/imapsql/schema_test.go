@@ -0,0 +1,96 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+package imapsql
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/storage/blob/fs"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestCheckSchema(t *testing.T) {
+	dir := testutils.Dir(t)
+	dsn := filepath.Join(dir, "imapsql.db")
+
+	store := &Storage{driver: "sqlite3", Log: testutils.Logger(t, "imapsql")}
+
+	// New database is initialized as usual.
+	if err := store.checkSchema("sqlite3", dsn); err != nil {
+		t.Fatal("unexpected error for new database:", err)
+	}
+
+	mod, err := fs.New("storage.blob.fs", "test", nil, []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	back, err := imapsql.New("sqlite3", dsn, ExtBlobStore{Base: mod.(module.BlobStore)}, imapsql.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer back.Close()
+
+	if err := store.checkSchema("sqlite3", dsn); err != nil {
+		t.Fatal("unexpected error for the current schema:", err)
+	}
+
+	// Pretend the schema is outdated.
+	if _, err := back.DB.Exec(`UPDATE schema_version SET version = ?`, LatestSchemaVersion-1); err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.checkSchema("sqlite3", dsn)
+	var schemaErr *SchemaError
+	if !errors.As(err, &schemaErr) {
+		t.Fatal("expected SchemaError, got", err)
+	}
+	if schemaErr.Current != LatestSchemaVersion-1 || schemaErr.Latest != LatestSchemaVersion {
+		t.Errorf("wrong versions: %+v", schemaErr)
+	}
+
+	store.autoMigrate = true
+	if err := store.checkSchema("sqlite3", dsn); err != nil {
+		t.Fatal("unexpected error with auto_migrate:", err)
+	}
+
+	var current, latest int
+	errStop := errors.New("stop")
+	SchemaUpgradeFunc = func(c, l int) error {
+		current, latest = c, l
+		return errStop
+	}
+	err = store.checkSchema("sqlite3", dsn)
+	SchemaUpgradeFunc = nil
+	if err != errStop {
+		t.Fatal("expected the SchemaUpgradeFunc error, got", err)
+	}
+	if current != LatestSchemaVersion-1 || latest != LatestSchemaVersion {
+		t.Errorf("wrong versions passed to SchemaUpgradeFunc: %d, %d", current, latest)
+	}
+
+	// The upgrade is not allowed if the hook fails.
+	hookOut := filepath.Join(dir, "hook.out")
+	store.schemaHook = []string{"sh", "-c", `echo "$MADDY_SCHEMA_FROM $MADDY_SCHEMA_TO" > ` + hookOut + `; exit 1`}
+	if err := store.checkSchema("sqlite3", dsn); err == nil {
+		t.Fatal("expected an error for the failed hook")
+	}
+	out, err := os.ReadFile(hookOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("%d %d", LatestSchemaVersion-1, LatestSchemaVersion); strings.TrimSpace(string(out)) != expected {
+		t.Errorf("wrong hook environment: %q", out)
+	}
+}
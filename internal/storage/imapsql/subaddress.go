@@ -0,0 +1,127 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/framework/address"
+)
+
+// Values for delivery_subaddress_folder.
+const (
+	subaddressOff      = "off"
+	subaddressExisting = "existing"
+	subaddressCreate   = "create"
+)
+
+// maxSubaddressFolderLen is the maximum length of the folder name (in
+// bytes) that can be specified using the subaddress.
+const maxSubaddressFolderLen = 64
+
+// specialUseAttrs are SPECIAL-USE (RFC 6154) attributes of folders that
+// should not be written to by senders.
+var specialUseAttrs = map[string]struct{}{
+	imap.AllAttr:     {},
+	imap.ArchiveAttr: {},
+	imap.DraftsAttr:  {},
+	imap.FlaggedAttr: {},
+	imap.JunkAttr:    {},
+	imap.SentAttr:    {},
+	imap.TrashAttr:   {},
+}
+
+// subaddressTag extracts the subaddress ("detail") part from the local-part
+// of the address, e.g. "lists" for "user+lists@example.org".
+//
+// Empty string is returned if there is no subaddress or it is not a valid
+// folder name.
+func subaddressTag(addr, separator string) string {
+	mbox, _, err := address.Split(addr)
+	if err != nil {
+		return ""
+	}
+	indx := strings.Index(mbox, separator)
+	if indx == -1 {
+		return ""
+	}
+	tag := mbox[indx+len(separator):]
+	if !validSubaddressFolder(tag) {
+		return ""
+	}
+	return tag
+}
+
+// validSubaddressFolder checks whether the subaddress can be safely used as
+// a folder name.
+//
+// Only letters, digits, '-' and '_' are allowed, so subaddress cannot refer to
+// nested folders or contain anything interpreted specially by IMAP clients.
+func validSubaddressFolder(name string) bool {
+	if name == "" || len(name) > maxSubaddressFolderLen || !utf8.ValidString(name) {
+		return false
+	}
+	if strings.EqualFold(name, "INBOX") {
+		return false
+	}
+	for _, ch := range name {
+		if unicode.IsLetter(ch) || unicode.IsDigit(ch) || ch == '-' || ch == '_' {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// subaddressFolder returns the name of the folder to deliver the message with
+// the subaddress tag to.
+//
+// Existing folders are matched case-insensitively. Folders with SPECIAL-USE
+// attributes are never used. If the folder does not exist, it is created if
+// create is true. Empty string is returned if the message should be delivered
+// to INBOX.
+func subaddressFolder(u backend.User, tag string, create bool) (string, error) {
+	mboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		return "", err
+	}
+	for _, mbox := range mboxes {
+		if !strings.EqualFold(mbox.Name, tag) {
+			continue
+		}
+		for _, attr := range mbox.Attributes {
+			if _, ok := specialUseAttrs[attr]; ok {
+				return "", nil
+			}
+		}
+		return mbox.Name, nil
+	}
+
+	if !create {
+		return "", nil
+	}
+	if err := u.CreateMailbox(tag); err != nil && err != backend.ErrMailboxAlreadyExists {
+		return "", err
+	}
+	return tag, nil
+}
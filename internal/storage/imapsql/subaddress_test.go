@@ -0,0 +1,26 @@
+package imapsql
+
+import "testing"
+
+func TestSubaddressTag(t *testing.T) {
+	test := func(addr, sep, expected string) {
+		t.Helper()
+		if tag := subaddressTag(addr, sep); tag != expected {
+			t.Errorf("subaddressTag(%q, %q) = %q, expected %q", addr, sep, tag, expected)
+		}
+	}
+
+	test("user@example.org", "+", "")
+	test("user+lists@example.org", "+", "lists")
+	test("user+Lists_2-x@example.org", "+", "Lists_2-x")
+	test("user+списки@example.org", "+", "списки")
+	test("user-lists@example.org", "-", "lists")
+	test("user+@example.org", "+", "")
+	test("user+a+b@example.org", "+", "")
+	test("user+a.b@example.org", "+", "")
+	test("user+../a@example.org", "+", "")
+	test("user+a/b@example.org", "+", "")
+	test("user+inbox@example.org", "+", "")
+	test("user+lists", "+", "")
+	test("user+0123456789012345678901234567890123456789012345678901234567890123456789@example.org", "+", "")
+}
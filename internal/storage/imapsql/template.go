@@ -0,0 +1,289 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/sieve"
+)
+
+// templateFolderAttrs maps names used in the 'folder' directive of
+// account_template to IMAP special-use attributes.
+var templateFolderAttrs = map[string]string{
+	"sent":    imap.SentAttr,
+	"trash":   imap.TrashAttr,
+	"junk":    imap.JunkAttr,
+	"drafts":  imap.DraftsAttr,
+	"archive": imap.ArchiveAttr,
+}
+
+type templateFolder struct {
+	name, attr string
+}
+
+// accountTemplate describes the initial state of new accounts in a set of
+// domains. It is applied both by 'maddy imap-acct create' and when accounts
+// are created automatically.
+type accountTemplate struct {
+	domains []string
+
+	folders []templateFolder
+
+	// -1 means the default limit is used.
+	quotaStorage  int64
+	quotaMessages int64
+
+	sieveStore  sieve.Store
+	sieveScript string
+
+	welcome bool
+
+	aliasTable module.MutableTable
+	aliases    []string
+}
+
+func parseAccountTemplate(globals map[string]interface{}, node config.Node) (*accountTemplate, error) {
+	t := accountTemplate{}
+	for _, d := range node.Args {
+		d, err := dns.ForLookup(d)
+		if err != nil {
+			return nil, config.NodeErr(node, "invalid domain: %v", err)
+		}
+		t.domains = append(t.domains, d)
+	}
+
+	var sieveScriptPath string
+	cfg := config.NewMap(globals, node)
+	cfg.Callback("folder", func(m *config.Map, node config.Node) error {
+		switch len(node.Args) {
+		case 1:
+			t.folders = append(t.folders, templateFolder{name: node.Args[0]})
+		case 2:
+			attr, ok := templateFolderAttrs[strings.ToLower(node.Args[1])]
+			if !ok {
+				return config.NodeErr(node, "unknown special-use attribute: %s", node.Args[1])
+			}
+			t.folders = append(t.folders, templateFolder{name: node.Args[0], attr: attr})
+		default:
+			return config.NodeErr(node, "expected 1 or 2 arguments: folder name and special-use attribute")
+		}
+		return nil
+	})
+	cfg.DataSize("quota_storage", false, false, -1, &t.quotaStorage)
+	cfg.Int64("quota_messages", false, false, -1, &t.quotaMessages)
+	cfg.Custom("sieve_store", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		var store sieve.Store
+		err := modconfig.ModuleFromNode("imap.filter", node.Args, node, m.Globals, &store)
+		return store, err
+	}, &t.sieveStore)
+	cfg.String("sieve_script", false, false, "", &sieveScriptPath)
+	cfg.Bool("welcome_message", false, true, &t.welcome)
+	cfg.Custom("alias_table", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		var tbl module.MutableTable
+		err := modconfig.ModuleFromNode("table", node.Args, node, m.Globals, &tbl)
+		return tbl, err
+	}, &t.aliasTable)
+	cfg.StringList("aliases", false, false, nil, &t.aliases)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	if t.quotaStorage < -1 || t.quotaMessages < -1 {
+		return nil, config.NodeErr(node, "quota limits cannot be negative")
+	}
+	if sieveScriptPath != "" {
+		src, err := os.ReadFile(sieveScriptPath)
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		if _, err := sieve.Parse(string(src)); err != nil {
+			return nil, config.NodeErr(node, "%s: %v", sieveScriptPath, err)
+		}
+		t.sieveScript = string(src)
+	}
+	if len(t.aliases) != 0 && t.aliasTable == nil {
+		return nil, config.NodeErr(node, "alias_table is required to use aliases")
+	}
+
+	return &t, nil
+}
+
+// accountTemplate returns the template for the account or nil if there is
+// none. Templates listing the account domain take precedence over the
+// template without domains.
+func (store *Storage) accountTemplate(accountName string) *accountTemplate {
+	var domain string
+	if _, d, err := address.Split(accountName); err == nil && d != "" {
+		domain, _ = dns.ForLookup(d)
+	}
+
+	var def *accountTemplate
+	for _, t := range store.templates {
+		if len(t.domains) == 0 {
+			if def == nil {
+				def = t
+			}
+			continue
+		}
+		for _, d := range t.domains {
+			if d == domain {
+				return t
+			}
+		}
+	}
+	return def
+}
+
+// TemplateCreatesFolders implements module.AccountProvisioner.
+func (store *Storage) TemplateCreatesFolders(accountName string) bool {
+	t := store.accountTemplate(accountName)
+	return t != nil && len(t.folders) != 0
+}
+
+// provisionAccount prepares the newly created account using the matching
+// template. If the template does not define folders, default special-use
+// folders are created if defaultFolders is set.
+//
+// The account is usable without any of these, so failures are only logged.
+func (store *Storage) provisionAccount(u backend.User, accountName string, defaultFolders bool) {
+	t := store.accountTemplate(accountName)
+
+	var folders []templateFolder
+	switch {
+	case t != nil && len(t.folders) != 0:
+		folders = t.folders
+	case defaultFolders:
+		for _, f := range store.specialFolders() {
+			folders = append(folders, templateFolder{name: f.name, attr: f.attr})
+		}
+	}
+	for _, f := range folders {
+		var err error
+		if f.attr != "" {
+			err = u.(*imapsql.User).CreateMailboxSpecial(f.name, f.attr)
+		} else {
+			err = u.CreateMailbox(f.name)
+		}
+		if err != nil {
+			store.Log.Error("failed to create folder", err, "username", accountName, "folder", f.name)
+		}
+	}
+
+	if t == nil {
+		store.notifyAccountCreated(accountName, true)
+		return
+	}
+
+	if t.quotaStorage != -1 {
+		if err := store.SetQuotaLimit(accountName, module.QuotaResourceStorage, t.quotaStorage); err != nil {
+			store.Log.Error("failed to set quota", err, "username", accountName)
+		}
+	}
+	if t.quotaMessages != -1 {
+		if err := store.SetQuotaLimit(accountName, module.QuotaResourceMessages, t.quotaMessages); err != nil {
+			store.Log.Error("failed to set quota", err, "username", accountName)
+		}
+	}
+
+	if t.sieveScript != "" {
+		if err := store.installSieveScript(t.sieveStore, accountName, t.sieveScript); err != nil {
+			store.Log.Error("failed to install sieve script", err, "username", accountName)
+		}
+	}
+
+	for _, pattern := range t.aliases {
+		if err := store.addTemplateAlias(t.aliasTable, accountName, pattern); err != nil {
+			store.Log.Error("failed to add alias", err, "username", accountName, "alias", pattern)
+		}
+	}
+
+	store.notifyAccountCreated(accountName, t.welcome)
+}
+
+func (store *Storage) installSieveScript(sieveStore sieve.Store, accountName, script string) error {
+	if err := sieveStore.PutScript(accountName, "default", script); err != nil {
+		return err
+	}
+	return sieveStore.SetActive(accountName, "default")
+}
+
+// addTemplateAlias expands {local} and {domain} in the pattern and adds the
+// account to targets of the resulting alias.
+func (store *Storage) addTemplateAlias(tbl module.MutableTable, accountName, pattern string) error {
+	local, domain, err := address.Split(accountName)
+	if err != nil {
+		return err
+	}
+	alias := strings.NewReplacer("{local}", local, "{domain}", domain).Replace(pattern)
+	key, err := address.ForLookup(alias)
+	if err != nil || key == "" {
+		return fmt.Errorf("invalid alias: %s", alias)
+	}
+
+	if multi, ok := tbl.(module.MutableMultiTable); ok {
+		targets, err := multi.LookupMulti(context.TODO(), key)
+		if err != nil {
+			return err
+		}
+		for _, target := range targets {
+			if target == accountName {
+				return nil
+			}
+		}
+		return multi.SetKeyMulti(key, append(targets, accountName))
+	}
+
+	_, exists, err := tbl.Lookup(context.TODO(), key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("alias already exists: %s", key)
+	}
+	return tbl.SetKey(key, accountName)
+}
+
+func (store *Storage) notifyAccountCreated(accountName string, welcome bool) {
+	welcomeParam := "yes"
+	if !welcome {
+		welcomeParam = "no"
+	}
+	hooks.Notify(hooks.NotifyAccountCreated, map[string]string{
+		"module":   store.InstanceName(),
+		"username": accountName,
+		"welcome":  welcomeParam,
+	})
+}
@@ -0,0 +1,210 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/sieve"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// multiTable is the minimal module.MutableMultiTable implementation.
+type multiTable struct {
+	m map[string][]string
+}
+
+func (t *multiTable) Lookup(_ context.Context, k string) (string, bool, error) {
+	v := t.m[k]
+	if len(v) == 0 {
+		return "", false, nil
+	}
+	return v[0], true, nil
+}
+
+func (t *multiTable) LookupMulti(_ context.Context, k string) ([]string, error) {
+	return t.m[k], nil
+}
+
+func (t *multiTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(t.m))
+	for k := range t.m {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (t *multiTable) RemoveKey(k string) error {
+	delete(t.m, k)
+	return nil
+}
+
+func (t *multiTable) SetKey(k, v string) error {
+	t.m[k] = []string{v}
+	return nil
+}
+
+func (t *multiTable) SetKeyMulti(k string, v []string) error {
+	t.m[k] = v
+	return nil
+}
+
+func TestParseAccountTemplate(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "junk.sieve")
+	if err := os.WriteFile(script, []byte(`require "fileinto";
+		if header :contains "X-Spam" "yes" { fileinto "Spam"; }`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err := parseAccountTemplate(nil, config.Node{
+		Name: "account_template",
+		Args: []string{"Example.ORG"},
+		Children: []config.Node{
+			{Name: "folder", Args: []string{"Spam", "junk"}},
+			{Name: "folder", Args: []string{"Projects"}},
+			{Name: "quota_storage", Args: []string{"1G"}},
+			{Name: "sieve_script", Args: []string{script}},
+			{Name: "welcome_message", Args: []string{"no"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tmpl.domains, []string{"example.org"}) {
+		t.Errorf("wrong domains: %v", tmpl.domains)
+	}
+	if !reflect.DeepEqual(tmpl.folders, []templateFolder{{"Spam", imap.JunkAttr}, {"Projects", ""}}) {
+		t.Errorf("wrong folders: %v", tmpl.folders)
+	}
+	if tmpl.quotaStorage != 1024*1024*1024 || tmpl.quotaMessages != -1 {
+		t.Errorf("wrong quota: %v %v", tmpl.quotaStorage, tmpl.quotaMessages)
+	}
+	if tmpl.sieveScript == "" || tmpl.welcome {
+		t.Errorf("wrong sieve script or welcome: %q %v", tmpl.sieveScript, tmpl.welcome)
+	}
+
+	for _, children := range [][]config.Node{
+		{{Name: "folder", Args: []string{"Spam", "spam"}}},
+		{{Name: "aliases", Args: []string{"{local}@example.com"}}},
+		{{Name: "sieve_script", Args: []string{filepath.Join(t.TempDir(), "missing")}}},
+	} {
+		_, err := parseAccountTemplate(nil, config.Node{Name: "account_template", Children: children})
+		if err == nil {
+			t.Errorf("expected an error for %v", children)
+		}
+	}
+}
+
+func TestAccountTemplate(t *testing.T) {
+	aliases := &multiTable{m: map[string][]string{
+		"team@example.com": {"alice@example.org"},
+	}}
+	sieveStore := &sieve.FSStore{Dir: t.TempDir()}
+	store := &Storage{
+		Back:   newTestBackend(t),
+		driver: "sqlite3",
+		Log:    testutils.Logger(t, "imapsql"),
+		templates: []*accountTemplate{
+			{
+				folders:       []templateFolder{{name: "Sent", attr: imap.SentAttr}},
+				quotaStorage:  -1,
+				quotaMessages: -1,
+				welcome:       true,
+			},
+			{
+				domains: []string{"example.com"},
+				folders: []templateFolder{
+					{name: "Spam", attr: imap.JunkAttr},
+					{name: "Projects"},
+				},
+				quotaStorage:  -1,
+				quotaMessages: 100,
+				sieveStore:    sieveStore,
+				sieveScript:   `keep;`,
+				aliasTable:    aliases,
+				aliases:       []string{"team@{domain}", "{local}@example.net"},
+			},
+		},
+	}
+	defer store.Close()
+
+	if !store.TemplateCreatesFolders("bob@example.com") || !store.TemplateCreatesFolders("bob") {
+		t.Error("TemplateCreatesFolders should be true")
+	}
+
+	if err := store.CreateIMAPAcct("bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.GetIMAPAcct("bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Spam", "Projects"} {
+		if _, _, err := u.GetMailbox(name, true, nil); err != nil {
+			t.Errorf("folder %s is not created: %v", name, err)
+		}
+	}
+	if _, _, err := u.GetMailbox("Sent", true, nil); err == nil {
+		t.Error("folder from the default template is created")
+	}
+
+	usage, err := store.GetQuota("bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.MessagesLimit != 100 || usage.StorageLimit != 0 {
+		t.Errorf("wrong quota limits: %+v", usage)
+	}
+
+	active, err := sieveStore.ActiveScript("bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active != `keep;` {
+		t.Errorf("wrong active script: %q", active)
+	}
+
+	if targets := aliases.m["team@example.com"]; !reflect.DeepEqual(targets, []string{"alice@example.org", "bob@example.com"}) {
+		t.Errorf("wrong targets for team@: %v", targets)
+	}
+	if targets := aliases.m["bob@example.net"]; !reflect.DeepEqual(targets, []string{"bob@example.com"}) {
+		t.Errorf("wrong targets for bob@example.net: %v", targets)
+	}
+
+	// Other domains use the template without domains.
+	if err := store.CreateIMAPAcct("carol@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	u, err = store.GetIMAPAcct("carol@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := u.GetMailbox("Sent", true, nil); err != nil {
+		t.Errorf("folder from the default template is not created: %v", err)
+	}
+	if _, ok := aliases.m["carol@example.net"]; ok {
+		t.Error("alias is added by the wrong template")
+	}
+}
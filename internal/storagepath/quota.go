@@ -0,0 +1,131 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package storagepath
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+// rescanInterval is the interval after which the directory size is
+// recalculated to account for changes not reported via Reserve and Release
+// (e.g. files removed by the administrator).
+const rescanInterval = time.Minute
+
+var ErrQuotaExceeded = errors.New("storage_paths: quota exceeded")
+
+// Quota tracks the disk space used by files in the directory.
+//
+// Users call Reserve before writing new files and Release after removing
+// them. The actual directory size is recalculated periodically.
+type Quota struct {
+	Dir     string
+	MaxSize int64
+
+	lck     sync.Mutex
+	used    int64
+	scanned time.Time
+}
+
+func NewQuota(dir string, maxSize int64) *Quota {
+	return &Quota{Dir: dir, MaxSize: maxSize}
+}
+
+func (q *Quota) rescan() {
+	var total int64
+	_ = filepath.WalkDir(q.Dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files may be removed concurrently.
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		total += info.Size()
+		return nil
+	})
+	q.used = total
+	q.scanned = time.Now()
+}
+
+// Reserve accounts for size bytes that are going to be written to the
+// directory. An error is returned if that would exceed the limit.
+//
+// It is safe to call Reserve and Release on nil Quota, the call does
+// nothing in this case.
+func (q *Quota) Reserve(size int64) error {
+	if q == nil {
+		return nil
+	}
+	q.lck.Lock()
+	defer q.lck.Unlock()
+
+	if time.Since(q.scanned) > rescanInterval {
+		q.rescan()
+	}
+	if q.used+size > q.MaxSize {
+		return &exterrors.SMTPError{
+			Code:         452,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 1},
+			Message:      "Insufficient system storage",
+			ErrorID:      exterrors.IDStorageQuota,
+			Err:          ErrQuotaExceeded,
+			Misc: map[string]interface{}{
+				"dir":      q.Dir,
+				"used":     q.used,
+				"max_size": q.MaxSize,
+			},
+		}
+	}
+	q.used += size
+	return nil
+}
+
+// Release accounts for size bytes removed from the directory.
+func (q *Quota) Release(size int64) {
+	if q == nil {
+		return
+	}
+	q.lck.Lock()
+	defer q.lck.Unlock()
+
+	q.used -= size
+	if q.used < 0 {
+		q.used = 0
+	}
+}
+
+// Used returns the current estimate of the directory size.
+func (q *Quota) Used() int64 {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+	if time.Since(q.scanned) > rescanInterval {
+		q.rescan()
+	}
+	return q.used
+}
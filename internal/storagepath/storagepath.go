@@ -0,0 +1,167 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package storagepath implements the storage_paths global directive that
+// allows to place data of different kinds (queue, message blobs, etc.)
+// outside of the state directory, e.g. on separate file systems, and to
+// limit the disk space used by them.
+package storagepath
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// Kinds of data that can be placed using storage_paths.
+const (
+	// Queue is the parent directory of target.queue instances
+	// directories.
+	Queue = "queue"
+	// Messages is the default root of storage.blob.fs.
+	Messages = "messages"
+	// MTASTSCache is the MTA-STS policy cache of mx_auth.mtasts.
+	MTASTSCache = "mtasts_cache"
+	// Logs is the directory used for log files specified using relative
+	// paths.
+	Logs = "logs"
+)
+
+// Location is the configured location of the data of a certain kind.
+type Location struct {
+	Dir string
+
+	// Quota is set if the size of the directory is limited.
+	Quota *Quota
+}
+
+var (
+	locationsLck sync.RWMutex
+	locations    map[string]*Location
+)
+
+// Set replaces the configured locations. nil resets them to the defaults.
+func Set(locs map[string]*Location) {
+	locationsLck.Lock()
+	defer locationsLck.Unlock()
+	locations = locs
+}
+
+// Get returns the location configured for the data kind or nil if it is
+// not configured.
+func Get(kind string) *Location {
+	locationsLck.RLock()
+	defer locationsLck.RUnlock()
+	return locations[kind]
+}
+
+// Dir returns the directory configured for the data kind or fallback if it
+// is not configured.
+func Dir(kind, fallback string) string {
+	if loc := Get(kind); loc != nil {
+		return loc.Dir
+	}
+	return fallback
+}
+
+// QuotaFor returns the quota of the data kind or nil if it is not limited.
+func QuotaFor(kind string) *Quota {
+	if loc := Get(kind); loc != nil {
+		return loc.Quota
+	}
+	return nil
+}
+
+// Directive parses the storage_paths global directive. The returned value
+// is map[string]*Location.
+//
+//	storage_paths {
+//	    queue /mnt/spool/maddy {
+//	        max_size 20G
+//	    }
+//	    messages /mnt/storage/messages
+//	    mtasts_cache /var/cache/maddy/mtasts
+//	    logs /var/log/maddy
+//	}
+func Directive(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "unexpected arguments")
+	}
+
+	locs := make(map[string]*Location, len(node.Children))
+	for _, child := range node.Children {
+		switch child.Name {
+		case Queue, Messages, MTASTSCache, Logs:
+		default:
+			return nil, config.NodeErr(child, "unknown data kind: %s", child.Name)
+		}
+		if _, ok := locs[child.Name]; ok {
+			return nil, config.NodeErr(child, "duplicate directive: %s", child.Name)
+		}
+		if len(child.Args) != 1 {
+			return nil, config.NodeErr(child, "exactly one argument is required")
+		}
+		dir := filepath.Clean(child.Args[0])
+		if !filepath.IsAbs(dir) {
+			return nil, config.NodeErr(child, "path should be absolute")
+		}
+
+		var maxSize int64
+		childM := config.NewMap(nil, child)
+		childM.DataSize("max_size", false, false, 0, &maxSize)
+		if _, err := childM.Process(); err != nil {
+			return nil, err
+		}
+
+		loc := &Location{Dir: dir}
+		if maxSize != 0 {
+			if child.Name != Queue && child.Name != Messages {
+				return nil, config.NodeErr(child, "max_size is not supported for %s", child.Name)
+			}
+			loc.Quota = NewQuota(dir, maxSize)
+		}
+		locs[child.Name] = loc
+	}
+	return locs, nil
+}
+
+// Validate creates the configured directories and checks that they are
+// writable.
+func Validate(locs map[string]*Location) error {
+	for kind, loc := range locs {
+		if err := ensureWritable(loc.Dir); err != nil {
+			return fmt.Errorf("storage_paths: %s: %w", kind, err)
+		}
+	}
+	return nil
+}
+
+func ensureWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "writeable-test")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
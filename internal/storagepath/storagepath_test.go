@@ -0,0 +1,137 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package storagepath
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+)
+
+func parseDirective(t *testing.T, cfg string) (map[string]*Location, error) {
+	t.Helper()
+	nodes, err := parser.Read(strings.NewReader(cfg), "literal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := Directive(nil, nodes[0])
+	if err != nil {
+		return nil, err
+	}
+	return val.(map[string]*Location), nil
+}
+
+func TestDirective(t *testing.T) {
+	locs, err := parseDirective(t, `storage_paths {
+		queue /srv/queue {
+			max_size 1M
+		}
+		messages /srv/messages/
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 2 {
+		t.Fatalf("expected 2 locations, got %d", len(locs))
+	}
+	if locs[Queue].Dir != "/srv/queue" || locs[Queue].Quota == nil || locs[Queue].Quota.MaxSize != 1024*1024 {
+		t.Errorf("wrong queue location: %+v", locs[Queue])
+	}
+	if locs[Messages].Dir != "/srv/messages" || locs[Messages].Quota != nil {
+		t.Errorf("wrong messages location: %+v", locs[Messages])
+	}
+
+	for _, cfg := range []string{
+		`storage_paths { unknown /srv }`,
+		`storage_paths { queue relative/path }`,
+		`storage_paths { queue }`,
+		`storage_paths { queue /a
+			queue /b }`,
+		`storage_paths {
+			logs /var/log/maddy {
+				max_size 1M
+			}
+		}`,
+	} {
+		if _, err := parseDirective(t, cfg); err == nil {
+			t.Errorf("expected an error for %q", cfg)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "existing"), make([]byte, 100), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	q := NewQuota(dir, 150)
+	if used := q.Used(); used != 100 {
+		t.Fatalf("expected 100 bytes used, got %d", used)
+	}
+	if err := q.Reserve(40); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Reserve(20); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	q.Release(40)
+	if err := q.Reserve(50); err != nil {
+		t.Fatal(err)
+	}
+
+	var nilQuota *Quota
+	if err := nilQuota.Reserve(1 << 40); err != nil {
+		t.Fatal("nil quota should not limit anything:", err)
+	}
+	nilQuota.Release(1)
+}
+
+func TestMoveDir(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(name), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dst, "b"), []byte("existing"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := MoveDir(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 1 {
+		t.Fatalf("expected 1 file moved, got %d", moved)
+	}
+	if blob, err := os.ReadFile(filepath.Join(dst, "a")); err != nil || string(blob) != "a" {
+		t.Errorf("a is not moved: %v %q", err, blob)
+	}
+	if blob, err := os.ReadFile(filepath.Join(dst, "b")); err != nil || string(blob) != "existing" {
+		t.Errorf("existing file is overwritten: %v %q", err, blob)
+	}
+	if _, err := os.Stat(filepath.Join(src, "b")); err != nil {
+		t.Errorf("conflicting file should be left in place: %v", err)
+	}
+}
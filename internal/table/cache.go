@@ -0,0 +1,162 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/ttlcache"
+	"github.com/foxcpp/maddy/internal/cacheflush"
+)
+
+type cacheKey struct {
+	key   string
+	multi bool
+}
+
+// Cache is a table that caches lookup results of another table for the
+// configured time.
+//
+// Lookup errors are not cached.
+type Cache struct {
+	modName  string
+	instName string
+
+	tbl         module.Table
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	norm        keyNormalizer
+
+	entries *ttlcache.Cache[cacheKey, []string]
+}
+
+func NewCache(modName, instName string, _, _ []string) (module.Module, error) {
+	return &Cache{
+		modName:  modName,
+		instName: instName,
+	}, nil
+}
+
+func (c *Cache) Init(cfg *config.Map) error {
+	cfg.Custom("table", false, true, nil, modconfig.TableDirective, &c.tbl)
+	cfg.Duration("ttl", false, false, 5*time.Minute, &c.ttl)
+	cfg.Duration("negative_ttl", false, false, time.Minute, &c.negativeTTL)
+	cfg.Int("max_entries", false, false, 10000, &c.maxEntries)
+	addNormalizeDirective(cfg, &c.norm)
+
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if c.maxEntries <= 0 {
+		return errors.New("table.cache: max_entries should be positive")
+	}
+	c.entries = ttlcache.New[cacheKey, []string](c.maxEntries)
+	cacheflush.Register("table", c.instName, c)
+	return nil
+}
+
+func (c *Cache) Name() string {
+	return c.modName
+}
+
+func (c *Cache) InstanceName() string {
+	return c.instName
+}
+
+func (c *Cache) put(key cacheKey, vals []string) {
+	ttl := c.ttl
+	if len(vals) == 0 {
+		ttl = c.negativeTTL
+	}
+	c.entries.Put(key, vals, ttl)
+}
+
+// FlushCache implements cacheflush.Flusher. The key is the lookup key.
+func (c *Cache) FlushCache(key string) int {
+	if key == "" {
+		return c.entries.Clear()
+	}
+
+	key, ok := c.norm.normalize(key)
+	if !ok {
+		return 0
+	}
+	removed := 0
+	for _, ck := range []cacheKey{{key: key}, {key: key, multi: true}} {
+		if c.entries.Remove(ck) {
+			removed++
+		}
+	}
+	return removed
+}
+
+func (c *Cache) Lookup(ctx context.Context, key string) (string, bool, error) {
+	key, ok := c.norm.normalize(key)
+	if !ok {
+		return "", false, nil
+	}
+
+	ck := cacheKey{key: key}
+	if vals, ok := c.entries.Get(ck); ok {
+		if len(vals) == 0 {
+			return "", false, nil
+		}
+		return vals[0], true, nil
+	}
+
+	val, ok, err := c.tbl.Lookup(ctx, key)
+	if err != nil {
+		return "", false, err
+	}
+	if ok {
+		c.put(ck, []string{val})
+	} else {
+		c.put(ck, nil)
+	}
+	return val, ok, nil
+}
+
+func (c *Cache) LookupMulti(ctx context.Context, key string) ([]string, error) {
+	key, ok := c.norm.normalize(key)
+	if !ok {
+		return nil, nil
+	}
+
+	ck := cacheKey{key: key, multi: true}
+	if vals, ok := c.entries.Get(ck); ok {
+		return vals, nil
+	}
+
+	vals, err := lookupMulti(ctx, c.tbl, key)
+	if err != nil {
+		return nil, err
+	}
+	c.put(ck, vals)
+	return vals, nil
+}
+
+func init() {
+	module.Register("table.cache", NewCache)
+}
@@ -0,0 +1,124 @@
+package table
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/ttlcache"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type countingTable struct {
+	testutils.Table
+	calls int
+}
+
+func (c *countingTable) Lookup(ctx context.Context, key string) (string, bool, error) {
+	c.calls++
+	return c.Table.Lookup(ctx, key)
+}
+
+func TestCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	tbl := &countingTable{Table: testutils.Table{M: map[string]string{"a": "1"}}}
+	mod, err := NewCache("table.cache", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Cache)
+	c.tbl = tbl
+	c.ttl = time.Minute
+	c.negativeTTL = 10 * time.Second
+	c.maxEntries = 2
+	c.entries = ttlcache.New[cacheKey, []string](c.maxEntries)
+	c.entries.SetClock(func() time.Time { return now })
+
+	lookup := func(key, expected string, expectedOk bool, expectedCalls int) {
+		t.Helper()
+		val, ok, err := c.Lookup(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != expected || ok != expectedOk {
+			t.Errorf("%q: expected (%q, %v), got (%q, %v)", key, expected, expectedOk, val, ok)
+		}
+		if tbl.calls != expectedCalls {
+			t.Errorf("%q: expected %d calls, got %d", key, expectedCalls, tbl.calls)
+		}
+	}
+
+	lookup("a", "1", true, 1)
+	lookup("a", "1", true, 1)
+	lookup("b", "", false, 2)
+	lookup("b", "", false, 2)
+
+	// Negative entry expired.
+	now = now.Add(15 * time.Second)
+	lookup("b", "", false, 3)
+	lookup("a", "1", true, 3)
+
+	// Positive entry expired.
+	now = now.Add(time.Minute)
+	tbl.M["a"] = "2"
+	lookup("a", "2", true, 4)
+
+	// Errors are not cached.
+	tbl.Err = errors.New("oops")
+	if _, _, err := c.Lookup(context.Background(), "c"); err == nil {
+		t.Error("Expected error")
+	}
+	tbl.Err = nil
+	lookup("c", "", false, 6)
+
+	if c.entries.Len() > c.maxEntries {
+		t.Errorf("Cache size limit exceeded: %d entries", c.entries.Len())
+	}
+
+	vals, err := c.LookupMulti(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 1 || vals[0] != "2" {
+		t.Errorf("Wrong LookupMulti result: %v", vals)
+	}
+}
+
+func TestCache_FlushCache(t *testing.T) {
+	tbl := &countingTable{Table: testutils.Table{M: map[string]string{"a": "1", "b": "2"}}}
+	mod, err := NewCache("table.cache", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Cache)
+	c.tbl = tbl
+	c.ttl = time.Minute
+	c.maxEntries = 10
+	c.entries = ttlcache.New[cacheKey, []string](c.maxEntries)
+
+	for _, key := range []string{"a", "b"} {
+		if _, _, err := c.Lookup(context.Background(), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tbl.M["a"] = "3"
+	if removed := c.FlushCache("a"); removed != 1 {
+		t.Errorf("expected 1 entry removed, got %d", removed)
+	}
+	val, _, err := c.Lookup(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "3" {
+		t.Errorf("expected new value after flush, got %q", val)
+	}
+
+	if removed := c.FlushCache(""); removed != 2 {
+		t.Errorf("expected 2 entries removed, got %d", removed)
+	}
+	if tbl.calls != 3 {
+		t.Errorf("expected 3 calls, got %d", tbl.calls)
+	}
+}
@@ -32,6 +32,7 @@ type Chain struct {
 
 	chain    []module.Table
 	optional []bool
+	norm     keyNormalizer
 }
 
 func NewChain(modName, instName string, _, _ []string) (module.Module, error) {
@@ -64,6 +65,7 @@ func (s *Chain) Init(cfg *config.Map) error {
 		s.optional = append(s.optional, true)
 		return nil
 	})
+	addNormalizeDirective(cfg, &s.norm)
 
 	_, err := cfg.Process()
 	return err
@@ -90,6 +92,11 @@ func (s *Chain) Lookup(ctx context.Context, key string) (string, bool, error) {
 }
 
 func (s *Chain) LookupMulti(ctx context.Context, key string) ([]string, error) {
+	key, ok := s.norm.normalize(key)
+	if !ok {
+		return []string{}, nil
+	}
+
 	result := []string{key}
 STEP:
 	for i, step := range s.chain {
@@ -0,0 +1,235 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/module"
+	"golang.org/x/net/idna"
+)
+
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNS is a table that looks up values in DNS records.
+type DNS struct {
+	modName    string
+	instName   string
+	inlineArgs []string
+
+	nameTemplate string
+	recordType   string
+	txtPrefix    string
+	norm         keyNormalizer
+
+	resolver dns.Resolver
+}
+
+func NewDNS(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &DNS{
+		modName:    modName,
+		instName:   instName,
+		inlineArgs: inlineArgs,
+		resolver:   dns.DefaultResolver(),
+	}, nil
+}
+
+func (d *DNS) Init(cfg *config.Map) error {
+	var defaultName string
+	switch len(d.inlineArgs) {
+	case 0:
+	case 1:
+		defaultName = d.inlineArgs[0]
+	default:
+		return fmt.Errorf("%s: at most one argument is expected", d.modName)
+	}
+
+	cfg.String("name", false, defaultName == "", defaultName, &d.nameTemplate)
+	cfg.Enum("type", false, false, []string{"txt", "srv"}, "txt", &d.recordType)
+	cfg.String("txt_prefix", false, false, "", &d.txtPrefix)
+	addNormalizeDirective(cfg, &d.norm)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if !strings.Contains(d.nameTemplate, "{key}") &&
+		!strings.Contains(d.nameTemplate, "{local}") &&
+		!strings.Contains(d.nameTemplate, "{domain}") {
+		return fmt.Errorf("%s: name should contain at least one of {key}, {local} or {domain} placeholders", d.modName)
+	}
+	if d.recordType == "srv" {
+		if _, ok := d.resolver.(srvResolver); !ok {
+			return fmt.Errorf("%s: resolver does not support SRV lookups", d.modName)
+		}
+	}
+
+	return nil
+}
+
+func (d *DNS) Name() string {
+	return d.modName
+}
+
+func (d *DNS) InstanceName() string {
+	return d.instName
+}
+
+// validName checks whether name is a valid host name that can be looked up.
+func validName(name string) bool {
+	if len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, ch := range label {
+			switch {
+			case ch >= 'a' && ch <= 'z', ch >= '0' && ch <= '9', ch == '-', ch == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// queryName returns the DNS name to look up for the key. It returns an empty
+// string if the key cannot be represented in a DNS name.
+func (d *DNS) queryName(key string) string {
+	var local, domain string
+	if strings.Contains(d.nameTemplate, "{local}") || strings.Contains(d.nameTemplate, "{domain}") {
+		var err error
+		local, domain, err = address.Split(key)
+		if err != nil || local == "" || domain == "" {
+			return ""
+		}
+	}
+
+	name := strings.NewReplacer(
+		"{key}", key,
+		"{local}", local,
+		"{domain}", domain,
+	).Replace(d.nameTemplate)
+
+	name, err := idna.ToASCII(strings.ToLower(name))
+	if err != nil || !validName(name) {
+		return ""
+	}
+	return name
+}
+
+func (d *DNS) Lookup(ctx context.Context, key string) (string, bool, error) {
+	vals, err := d.LookupMulti(ctx, key)
+	if err != nil {
+		return "", false, err
+	}
+	if len(vals) == 0 {
+		return "", false, nil
+	}
+	return vals[0], true, nil
+}
+
+func (d *DNS) LookupMulti(ctx context.Context, key string) ([]string, error) {
+	key, ok := d.norm.normalize(key)
+	if !ok {
+		return nil, nil
+	}
+
+	name := d.queryName(key)
+	if name == "" {
+		return nil, nil
+	}
+
+	var (
+		vals []string
+		err  error
+	)
+	switch d.recordType {
+	case "txt":
+		vals, err = d.lookupTXT(ctx, name)
+	case "srv":
+		vals, err = d.lookupSRV(ctx, name)
+	default:
+		panic("table.dns: unexpected record type")
+	}
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s: %w", d.modName, err)
+	}
+	return vals, nil
+}
+
+func (d *DNS) lookupTXT(ctx context.Context, name string) ([]string, error) {
+	recs, err := d.resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	vals := make([]string, 0, len(recs))
+	for _, rec := range recs {
+		if !strings.HasPrefix(rec, d.txtPrefix) {
+			continue
+		}
+		vals = append(vals, strings.TrimSpace(strings.TrimPrefix(rec, d.txtPrefix)))
+	}
+	// Records order is not defined in DNS.
+	sort.Strings(vals)
+	return vals, nil
+}
+
+func (d *DNS) lookupSRV(ctx context.Context, name string) ([]string, error) {
+	_, srvs, err := d.resolver.(srvResolver).LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+		return srvs[i].Weight > srvs[j].Weight
+	})
+
+	vals := make([]string, 0, len(srvs))
+	for _, srv := range srvs {
+		// "." target means the service is not available, see RFC 2782.
+		if srv.Target == "." {
+			continue
+		}
+		vals = append(vals, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+	}
+	return vals, nil
+}
+
+func init() {
+	module.Register("table.dns", NewDNS)
+}
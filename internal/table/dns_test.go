@@ -0,0 +1,100 @@
+package table
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+type srvMockResolver struct {
+	*mockdns.Resolver
+	srv map[string][]*net.SRV
+}
+
+func (r srvMockResolver) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	srvs, ok := r.srv[name]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return "", srvs, nil
+}
+
+func TestDNS(t *testing.T) {
+	resolver := srvMockResolver{
+		Resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+			"example.org._route.example.com.": {
+				TXT: []string{"v=spf1 -all", "route=relay2.example.com", "route=relay1.example.com"},
+			},
+			"user.example.org._alias.example.com.": {
+				TXT: []string{"user@example.net"},
+			},
+			"xn--80a1acny.xn--p1ai._route.example.com.": {
+				TXT: []string{"route=relay.example.com"},
+			},
+		}},
+		srv: map[string][]*net.SRV{
+			"example.org._srv.example.com": {
+				{Target: "b.example.com.", Port: 2525, Priority: 10, Weight: 5},
+				{Target: "a.example.com.", Port: 25, Priority: 10, Weight: 10},
+				{Target: "c.example.com.", Port: 25, Priority: 0},
+			},
+			"example.net._srv.example.com": {
+				{Target: ".", Port: 0},
+			},
+		},
+	}
+
+	test := func(args []string, directives []config.Node, key string, expected []string) {
+		t.Helper()
+
+		mod, err := NewDNS("table.dns", "", nil, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := mod.(*DNS)
+		d.resolver = resolver
+		if err := d.Init(config.NewMap(nil, config.Node{Children: directives})); err != nil {
+			t.Fatal(err)
+		}
+
+		vals, err := d.LookupMulti(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vals, expected) {
+			t.Errorf("%v %q: expected %q, got %q", args, key, expected, vals)
+		}
+
+		val, ok, err := d.Lookup(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(expected) == 0 {
+			if ok {
+				t.Errorf("%v %q: unexpected value %q", args, key, val)
+			}
+		} else if !ok || val != expected[0] {
+			t.Errorf("%v %q: expected %q, got %q", args, key, expected[0], val)
+		}
+	}
+
+	prefix := []config.Node{{Name: "txt_prefix", Args: []string{"route="}}}
+	test([]string{"{domain}._route.example.com"}, prefix, "user@example.org", []string{"relay1.example.com", "relay2.example.com"})
+	test([]string{"{domain}._route.example.com"}, prefix, "user@EXAMPLE.org", []string{"relay1.example.com", "relay2.example.com"})
+	test([]string{"{domain}._route.example.com"}, prefix, "user@example.net", nil)
+	test([]string{"{domain}._route.example.com"}, prefix, "user@рф.рф", nil)
+	test([]string{"{domain}._route.example.com"}, prefix, "user@почта.рф", []string{"relay.example.com"})
+	test([]string{"{domain}._route.example.com"}, prefix, "postmaster", nil)
+	test([]string{"{local}.{domain}._alias.example.com"}, nil, "user@example.org", []string{"user@example.net"})
+	test([]string{"{local}.{domain}._alias.example.com"}, nil, "user name@example.org", nil)
+	test([]string{"{key}._alias.example.com"}, nil, "user.example.org", []string{"user@example.net"})
+
+	srv := []config.Node{{Name: "type", Args: []string{"srv"}}}
+	test([]string{"{domain}._srv.example.com"}, srv, "user@example.org", []string{"c.example.com:25", "a.example.com:25", "b.example.com:2525"})
+	test([]string{"{domain}._srv.example.com"}, srv, "user@example.net", []string{})
+	test([]string{"{domain}._srv.example.com"}, srv, "user@example.invalid", nil)
+}
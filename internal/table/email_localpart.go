@@ -30,6 +30,7 @@ type EmailLocalpart struct {
 	modName       string
 	instName      string
 	allowNonEmail bool
+	norm          keyNormalizer
 }
 
 func NewEmailLocalpart(modName, instName string, _, _ []string) (module.Module, error) {
@@ -41,7 +42,9 @@ func NewEmailLocalpart(modName, instName string, _, _ []string) (module.Module,
 }
 
 func (s *EmailLocalpart) Init(cfg *config.Map) error {
-	return nil
+	addNormalizeDirective(cfg, &s.norm)
+	_, err := cfg.Process()
+	return err
 }
 
 func (s *EmailLocalpart) Name() string {
@@ -53,6 +56,10 @@ func (s *EmailLocalpart) InstanceName() string {
 }
 
 func (s *EmailLocalpart) Lookup(ctx context.Context, key string) (string, bool, error) {
+	key, ok := s.norm.normalize(key)
+	if !ok {
+		return "", false, nil
+	}
 	mbox, _, err := address.Split(key)
 	if err != nil {
 		if s.allowNonEmail {
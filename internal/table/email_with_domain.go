@@ -32,6 +32,7 @@ type EmailWithDomain struct {
 	modName  string
 	instName string
 	domains  []string
+	norm     keyNormalizer
 	log      log.Logger
 }
 
@@ -45,6 +46,11 @@ func NewEmailWithDomain(modName, instName string, _, inlineArgs []string) (modul
 }
 
 func (s *EmailWithDomain) Init(cfg *config.Map) error {
+	addNormalizeDirective(cfg, &s.norm)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
 	for _, d := range s.domains {
 		if !address.ValidDomain(d) {
 			return fmt.Errorf("%s: invalid domain: %s", s.modName, d)
@@ -66,6 +72,10 @@ func (s *EmailWithDomain) InstanceName() string {
 }
 
 func (s *EmailWithDomain) Lookup(ctx context.Context, key string) (string, bool, error) {
+	key, ok := s.norm.normalize(key)
+	if !ok {
+		return "", false, nil
+	}
 	quotedMbox := address.QuoteMbox(key)
 
 	if len(s.domains) == 0 {
@@ -76,6 +86,10 @@ func (s *EmailWithDomain) Lookup(ctx context.Context, key string) (string, bool,
 }
 
 func (s *EmailWithDomain) LookupMulti(ctx context.Context, key string) ([]string, error) {
+	key, ok := s.norm.normalize(key)
+	if !ok {
+		return nil, nil
+	}
 	quotedMbox := address.QuoteMbox(key)
 	emails := make([]string, len(s.domains))
 	for i, domain := range s.domains {
@@ -0,0 +1,99 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"context"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+type Fallback struct {
+	modName  string
+	instName string
+
+	tables []module.Table
+	norm   keyNormalizer
+}
+
+func NewFallback(modName, instName string, _, _ []string) (module.Module, error) {
+	return &Fallback{
+		modName:  modName,
+		instName: instName,
+	}, nil
+}
+
+func (f *Fallback) Init(cfg *config.Map) error {
+	cfg.Callback("table", tablesDirective(&f.tables))
+	addNormalizeDirective(cfg, &f.norm)
+
+	_, err := cfg.Process()
+	return err
+}
+
+func (f *Fallback) Name() string {
+	return f.modName
+}
+
+func (f *Fallback) InstanceName() string {
+	return f.instName
+}
+
+// Lookup returns the first non-empty value found in the tables.
+func (f *Fallback) Lookup(ctx context.Context, key string) (string, bool, error) {
+	key, ok := f.norm.normalize(key)
+	if !ok {
+		return "", false, nil
+	}
+
+	for _, tbl := range f.tables {
+		val, ok, err := tbl.Lookup(ctx, key)
+		if err != nil {
+			return "", false, err
+		}
+		if ok && val != "" {
+			return val, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// LookupMulti returns values from the first table that has any for the key.
+func (f *Fallback) LookupMulti(ctx context.Context, key string) ([]string, error) {
+	key, ok := f.norm.normalize(key)
+	if !ok {
+		return nil, nil
+	}
+
+	for _, tbl := range f.tables {
+		vals, err := lookupMulti(ctx, tbl, key)
+		if err != nil {
+			return nil, err
+		}
+		if len(vals) != 0 {
+			return vals, nil
+		}
+	}
+	return nil, nil
+}
+
+func init() {
+	module.Register("table.fallback", NewFallback)
+}
@@ -21,8 +21,10 @@ package table
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime/debug"
 	"strings"
 	"sync"
@@ -32,6 +34,7 @@ import (
 	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/fsnotify/fsnotify"
 )
 
 const FileModName = "table.file"
@@ -39,11 +42,20 @@ const FileModName = "table.file"
 type File struct {
 	instName string
 	file     string
+	watch    bool
+	norm     keyNormalizer
 
 	m      map[string][]string
 	mLck   sync.RWMutex
 	mStamp time.Time
 
+	// Serializes modifications of the file.
+	writeLck sync.Mutex
+
+	// nil if watch is disabled or the watcher cannot be created, the file
+	// is still polled in this case.
+	watcher *fsnotify.Watcher
+
 	stopReloader chan struct{}
 	forceReload  chan struct{}
 
@@ -82,6 +94,8 @@ func (f *File) Init(cfg *config.Map) error {
 	var file string
 	cfg.Bool("debug", true, false, &f.log.Debug)
 	cfg.String("file", false, false, "", &file)
+	cfg.Bool("watch", false, true, &f.watch)
+	addNormalizeDirective(cfg, &f.norm)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -92,12 +106,25 @@ func (f *File) Init(cfg *config.Map) error {
 		}
 		f.file = file
 	}
+	f.file = filepath.Clean(f.file)
 
-	if err := readFile(f.file, f.m); err != nil {
+	m, err := f.readTable()
+	if err != nil {
 		if !os.IsNotExist(err) {
 			return err
 		}
 		f.log.Printf("ignoring non-existent file: %s", f.file)
+	} else {
+		f.m = m
+	}
+	if stamp, err := pathStamp(f.file); err == nil {
+		f.mStamp = stamp
+	}
+
+	if f.watch && !module.NoRun {
+		if err := f.startWatcher(); err != nil {
+			f.log.Error("cannot watch file, falling back to polling", err, "file", f.file)
+		}
 	}
 
 	go f.reloader()
@@ -108,7 +135,50 @@ func (f *File) Init(cfg *config.Map) error {
 	return nil
 }
 
-var reloadInterval = 15 * time.Second
+var (
+	reloadInterval = 15 * time.Second
+
+	// Delay between the last file system event and the reload, allows
+	// writers to complete their changes.
+	watchDelay = 250 * time.Millisecond
+)
+
+// startWatcher sets up the inotify (or equivalent) watch for the file.
+//
+// The parent directory is watched instead of the file itself since text
+// editors and 'maddy alias' replace the file by renaming a new one over it.
+func (f *File) startWatcher() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(f.file)
+	if info, err := os.Stat(f.file); err == nil && info.IsDir() {
+		dir = f.file
+	}
+	if err := w.Add(dir); err != nil {
+		w.Close()
+		return err
+	}
+
+	f.watcher = w
+	return nil
+}
+
+// relevantEvent reports whether the file system event may change the table
+// contents.
+func (f *File) relevantEvent(ev fsnotify.Event) bool {
+	if ev.Op == fsnotify.Chmod {
+		return false
+	}
+	name := filepath.Clean(ev.Name)
+	if name == f.file {
+		return true
+	}
+	// Files in the watched directory.
+	return filepath.Dir(name) == f.file && !skipDirEntry(filepath.Base(name))
+}
 
 func (f *File) reloader() {
 	defer func() {
@@ -121,13 +191,46 @@ func (f *File) reloader() {
 	t := time.NewTicker(reloadInterval)
 	defer t.Stop()
 
+	var (
+		events <-chan fsnotify.Event
+		errs   <-chan error
+	)
+	if f.watcher != nil {
+		events = f.watcher.Events
+		errs = f.watcher.Errors
+	}
+
+	delay := time.NewTimer(watchDelay)
+	delay.Stop()
+	defer delay.Stop()
+
 	for {
 		select {
 		case <-t.C:
-			f.reload()
+			f.reload(false)
+
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if f.relevantEvent(ev) {
+				f.log.DebugMsg("file changed", "file", ev.Name, "op", ev.Op.String())
+				delay.Reset(watchDelay)
+			}
+
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			f.log.Error("watcher error", err)
+
+		case <-delay.C:
+			f.reload(true)
 
 		case <-f.forceReload:
-			f.reload()
+			f.reload(true)
 
 		case <-f.stopReloader:
 			f.stopReloader <- struct{}{}
@@ -136,54 +239,174 @@ func (f *File) reloader() {
 	}
 }
 
-func (f *File) reload() {
-	info, err := os.Stat(f.file)
+// reload reads the file if it was changed since the last reload.
+//
+// Files modified very recently are not read unless force is set since they
+// might be in the middle of being written by a text editor.
+//
+// If the new contents cannot be parsed, the previously loaded table is kept.
+func (f *File) reload(force bool) {
+	stamp, err := pathStamp(f.file)
 	if err != nil {
 		if os.IsNotExist(err) {
 			f.mLck.Lock()
 			f.m = map[string][]string{}
+			f.mStamp = time.Time{}
 			f.mLck.Unlock()
 			return
 		}
 		f.log.Error("os stat", err)
+		return
 	}
-	if info.ModTime().Before(f.mStamp) || time.Since(info.ModTime()) < (reloadInterval/2) {
+	if !force && (!stamp.After(f.mStamp) || time.Since(stamp) < (reloadInterval/2)) {
 		return // reload not necessary
 	}
 
 	f.log.Debugf("reloading")
 
-	newm := make(map[string][]string, len(f.m)+5)
-	if err := readFile(f.file, newm); err != nil {
+	newm, err := f.readTable()
+	if err != nil {
 		if os.IsNotExist(err) {
 			f.log.Printf("ignoring non-existent file: %s", f.file)
 			return
 		}
 
 		f.log.Println(err)
+		hooks.Notify(hooks.NotifyReloadFailed, map[string]string{
+			"module": f.InstanceName(),
+			"file":   f.file,
+			"error":  err.Error(),
+		})
 		return
 	}
 	// after reading we need to check whether file has changed in between
-	info2, err := os.Stat(f.file)
+	stamp2, err := pathStamp(f.file)
 	if err != nil {
 		f.log.Println(err)
 		return
 	}
 
-	if !info2.ModTime().Equal(info.ModTime()) {
+	if !stamp2.Equal(stamp) {
 		// file has changed in the meantime
 		return
 	}
 
 	f.mLck.Lock()
 	f.m = newm
-	f.mStamp = info.ModTime()
+	f.mStamp = stamp
 	f.mLck.Unlock()
 }
 
 func (f *File) Close() error {
 	f.stopReloader <- struct{}{}
 	<-f.stopReloader
+	if f.watcher != nil {
+		return f.watcher.Close()
+	}
+	return nil
+}
+
+// skipDirEntry reports whether the file in the table directory should be
+// ignored. These are hidden files (including temporary files created by
+// 'maddy alias' and swap files of text editors) and backup files.
+func skipDirEntry(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~")
+}
+
+// dirFiles returns paths of the files in the table directory, sorted by name.
+func dirFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || skipDirEntry(entry.Name()) {
+			continue
+		}
+		files = append(files, filepath.Join(dir, entry.Name()))
+	}
+	return files, nil
+}
+
+// pathStamp returns the latest modification time of the file or, if path is
+// a directory, of the directory itself and files in it.
+func pathStamp(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	stamp := info.ModTime()
+	if !info.IsDir() {
+		return stamp, nil
+	}
+
+	files, err := dirFiles(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return time.Time{}, err
+		}
+		if info.ModTime().After(stamp) {
+			stamp = info.ModTime()
+		}
+	}
+	return stamp, nil
+}
+
+// readTable reads the table from disk and applies the key normalization.
+func (f *File) readTable() (map[string][]string, error) {
+	m := make(map[string][]string)
+	if err := readPath(f.file, m); err != nil {
+		return nil, err
+	}
+	if !f.norm.enabled() {
+		return m, nil
+	}
+
+	normm := make(map[string][]string, len(m))
+	for k, v := range m {
+		normKey, ok := f.norm.normalize(k)
+		if !ok {
+			f.log.Msg("cannot normalize key, ignoring", "key", k)
+			continue
+		}
+		normm[normKey] = append(normm[normKey], v...)
+	}
+	return normm, nil
+}
+
+// readPath reads the table from the file or from all files in the directory.
+// Values from multiple files are merged in the order of file names.
+func readPath(path string, out map[string][]string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return readFile(path, out)
+	}
+
+	files, err := dirFiles(path)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := readFile(file, out); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// Removed after listing.
+				continue
+			}
+			return err
+		}
+	}
 	return nil
 }
 
@@ -192,6 +415,7 @@ func readFile(path string, out map[string][]string) error {
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
 	scnr := bufio.NewScanner(f)
 	lineCounter := 0
@@ -230,6 +454,11 @@ func readFile(path string, out map[string][]string) error {
 }
 
 func (f *File) Lookup(_ context.Context, val string) (string, bool, error) {
+	val, ok := f.norm.normalize(val)
+	if !ok {
+		return "", false, nil
+	}
+
 	// The existing map is never modified, instead it is replaced with a new
 	// one if reload is performed.
 	f.mLck.RLock()
@@ -246,6 +475,11 @@ func (f *File) Lookup(_ context.Context, val string) (string, bool, error) {
 }
 
 func (f *File) LookupMulti(_ context.Context, val string) ([]string, error) {
+	val, ok := f.norm.normalize(val)
+	if !ok {
+		return nil, nil
+	}
+
 	f.mLck.RLock()
 	usedFile := f.m
 	f.mLck.RUnlock()
@@ -254,5 +488,6 @@ func (f *File) LookupMulti(_ context.Context, val string) ([]string, error) {
 }
 
 func init() {
+	var _ module.MutableMultiTable = &File{}
 	module.Register(FileModName, NewFile)
 }
@@ -19,13 +19,16 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package table
 
 import (
+	"context"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/fsnotify/fsnotify"
 )
 
 func TestReadFile(t *testing.T) {
@@ -217,6 +220,212 @@ func TestFileReload_Removed(t *testing.T) {
 	}
 }
 
+func TestFileModify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aliases")
+	if err := os.WriteFile(path, []byte("# comment\na: b\nc: d\na: e\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	mod, err := NewFile("", "", nil, []string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*File)
+	m.log = testutils.Logger(t, FileModName)
+	if err := mod.Init(&config.Map{Block: config.Node{}}); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	check := func(expected string) {
+		t.Helper()
+		text, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(text) != expected {
+			t.Errorf("wrong file contents\n want %q\n got %q", expected, text)
+		}
+	}
+
+	if err := m.SetKeyMulti("a", []string{"x", "y"}); err != nil {
+		t.Fatal(err)
+	}
+	check("# comment\na: x, y\nc: d\n")
+	vals, _ := m.LookupMulti(context.Background(), "a")
+	if !reflect.DeepEqual(vals, []string{"x", "y"}) {
+		t.Errorf("wrong values after SetKeyMulti: %v", vals)
+	}
+
+	if err := m.SetKey("new", "z"); err != nil {
+		t.Fatal(err)
+	}
+	check("# comment\na: x, y\nc: d\nnew: z\n")
+
+	if err := m.RemoveKey("c"); err != nil {
+		t.Fatal(err)
+	}
+	check("# comment\na: x, y\nnew: z\n")
+
+	keys, err := m.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"a", "new"}) {
+		t.Errorf("wrong keys: %v", keys)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o640 {
+		t.Errorf("file mode is not preserved: %v", info.Mode())
+	}
+
+	for _, kv := range [][2]string{{"a:b", "c"}, {"#a", "c"}, {"", "c"}, {"a", "b, c"}, {"a", "b\nc: d"}} {
+		if err := m.SetKey(kv[0], kv[1]); err == nil {
+			t.Errorf("expected an error for %q: %q", kv[0], kv[1])
+		}
+	}
+	check("# comment\na: x, y\nnew: z\n")
+}
+
+func TestFileDirectory(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"10-team":        "team: a, b\nshared: x\n",
+		"20-lists":       "list: c\nshared: y\n",
+		".hidden":        "hidden: z\n",
+		"20-lists~":      "backup: z\n",
+		".20-lists.swp":  "swap: z\n",
+		"nested/ignored": "nested: z\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mod, err := NewFile("", "", nil, []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*File)
+	m.log = testutils.Logger(t, FileModName)
+	if err := mod.Init(&config.Map{Block: config.Node{}}); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	keys, err := m.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"list", "shared", "team"}) {
+		t.Errorf("wrong keys: %v", keys)
+	}
+	vals, _ := m.LookupMulti(context.Background(), "shared")
+	if !reflect.DeepEqual(vals, []string{"x", "y"}) {
+		t.Errorf("values are not merged in file name order: %v", vals)
+	}
+
+	if err := m.SetKey("new", "value"); err == nil {
+		t.Error("expected an error when modifying directory table")
+	}
+
+	// New files are picked up.
+	if err := os.WriteFile(filepath.Join(dir, "30-new"), []byte("new: value\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok, _ := m.Lookup(context.Background(), "new"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("new file was not loaded")
+		}
+		time.Sleep(reloadInterval)
+	}
+
+	// Broken file makes the whole table keep the old contents.
+	if err := os.WriteFile(filepath.Join(dir, "40-broken"), []byte(": value\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * reloadInterval)
+	m.reload(true)
+	if _, ok, _ := m.Lookup(context.Background(), "new"); !ok {
+		t.Error("table was replaced with broken contents")
+	}
+}
+
+func TestFileWatch(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "aliases")
+	if err := os.WriteFile(path, []byte("a: b\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	mod, err := NewFile("", "", nil, []string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*File)
+	m.log = testutils.Logger(t, FileModName)
+	if err := mod.Init(&config.Map{Block: config.Node{}}); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if m.watcher == nil {
+		t.Skip("file system notifications are not available")
+	}
+
+	for _, ev := range []struct {
+		ev       fsnotify.Event
+		relevant bool
+	}{
+		{fsnotify.Event{Name: path, Op: fsnotify.Write}, true},
+		{fsnotify.Event{Name: path, Op: fsnotify.Create}, true},
+		{fsnotify.Event{Name: path, Op: fsnotify.Remove}, true},
+		{fsnotify.Event{Name: path, Op: fsnotify.Chmod}, false},
+		{fsnotify.Event{Name: filepath.Join(dir, "other"), Op: fsnotify.Write}, false},
+		{fsnotify.Event{Name: filepath.Join(dir, ".aliases.tmp-1"), Op: fsnotify.Create}, false},
+	} {
+		if got := m.relevantEvent(ev.ev); got != ev.relevant {
+			t.Errorf("relevantEvent(%v) = %v, want %v", ev.ev, got, ev.relevant)
+		}
+	}
+
+	// Replace the file like text editors do.
+	tmp := filepath.Join(dir, ".aliases.new")
+	if err := os.WriteFile(tmp, []byte("a: c\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if val, _, _ := m.Lookup(context.Background(), "a"); val == "c" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("replaced file was not loaded")
+		}
+		time.Sleep(reloadInterval)
+	}
+}
+
 func init() {
 	reloadInterval = 10 * time.Millisecond
+	watchDelay = 10 * time.Millisecond
 }
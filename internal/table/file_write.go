@@ -0,0 +1,223 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Keys returns the list of keys present in the file.
+func (f *File) Keys() ([]string, error) {
+	f.mLck.RLock()
+	defer f.mLck.RUnlock()
+
+	keys := make([]string, 0, len(f.m))
+	for k := range f.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (f *File) SetKey(k, v string) error {
+	return f.SetKeyMulti(k, []string{v})
+}
+
+// SetKeyMulti replaces values of the key in the file. Other lines of the file
+// (including comments) are preserved.
+//
+// If key normalization is configured, the key is written in the normalized
+// form.
+func (f *File) SetKeyMulti(k string, values []string) error {
+	normKey, ok := f.norm.normalize(k)
+	if !ok {
+		return fmt.Errorf("%s: set %s: cannot normalize key", FileModName, k)
+	}
+	k = normKey
+	if err := validFileKey(k); err != nil {
+		return fmt.Errorf("%s: set %s: %w", FileModName, k, err)
+	}
+	if len(values) == 0 {
+		return fmt.Errorf("%s: set %s: no values", FileModName, k)
+	}
+	for _, v := range values {
+		if strings.ContainsAny(v, ",\r\n") || strings.TrimSpace(v) != v {
+			return fmt.Errorf("%s: set %s: invalid value: %q", FileModName, k, v)
+		}
+	}
+
+	line := k + ": " + strings.Join(values, ", ")
+	if err := f.rewrite(k, &line); err != nil {
+		return fmt.Errorf("%s: set %s: %w", FileModName, k, err)
+	}
+	return nil
+}
+
+func (f *File) RemoveKey(k string) error {
+	normKey, ok := f.norm.normalize(k)
+	if !ok {
+		return fmt.Errorf("%s: del %s: cannot normalize key", FileModName, k)
+	}
+	k = normKey
+	if err := f.rewrite(k, nil); err != nil {
+		return fmt.Errorf("%s: del %s: %w", FileModName, k, err)
+	}
+	return nil
+}
+
+func validFileKey(k string) error {
+	if k == "" || strings.TrimSpace(k) != k {
+		return errors.New("empty key or surrounding whitespace")
+	}
+	if strings.HasPrefix(k, "#") || strings.ContainsAny(k, ":\r\n") {
+		return errors.New("key cannot start with '#' or contain ':' or line breaks")
+	}
+	return nil
+}
+
+// fileLineKey returns the key defined on the line or empty string if there is
+// none (comment or empty line).
+func fileLineKey(line string) string {
+	if strings.HasPrefix(line, "#") {
+		return ""
+	}
+	key, _, _ := strings.Cut(strings.TrimSpace(line), ":")
+	return strings.TrimSpace(key)
+}
+
+// lineHasKey reports whether the line defines the normalized key k.
+func (f *File) lineHasKey(line, k string) bool {
+	lineKey := fileLineKey(line)
+	if lineKey == "" {
+		return false
+	}
+	lineKey, ok := f.norm.normalize(lineKey)
+	return ok && lineKey == k
+}
+
+// rewrite replaces the definition of key k in the file with newLine. If newLine
+// is nil, the key is removed.
+//
+// The file is replaced atomically so the server never sees a partially
+// written file.
+func (f *File) rewrite(k string, newLine *string) error {
+	f.writeLck.Lock()
+	defer f.writeLck.Unlock()
+
+	if f.file == "" {
+		return errors.New("no file path")
+	}
+	if info, err := os.Stat(f.file); err == nil && info.IsDir() {
+		return errors.New("tables read from a directory cannot be modified")
+	}
+
+	// The file is always re-read since it might have been changed by
+	// another process (e.g. the server or text editor).
+	mode := os.FileMode(0o644)
+	var lines []string
+	src, err := os.Open(f.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		info, err := src.Stat()
+		if err != nil {
+			src.Close()
+			return err
+		}
+		mode = info.Mode().Perm()
+
+		scnr := bufio.NewScanner(src)
+		for scnr.Scan() {
+			lines = append(lines, scnr.Text())
+		}
+		src.Close()
+		if err := scnr.Err(); err != nil {
+			return err
+		}
+	}
+
+	// Key can be defined multiple times, replace the first definition and
+	// remove all others.
+	replaced := false
+	newLines := make([]string, 0, len(lines)+1)
+	for _, line := range lines {
+		if !f.lineHasKey(line, k) {
+			newLines = append(newLines, line)
+			continue
+		}
+		if newLine != nil && !replaced {
+			newLines = append(newLines, *newLine)
+			replaced = true
+		}
+	}
+	if newLine != nil && !replaced {
+		newLines = append(newLines, *newLine)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.file), "."+filepath.Base(f.file)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, line := range newLines {
+		w.WriteString(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.file); err != nil {
+		return err
+	}
+
+	newm, err := f.readTable()
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(f.file)
+	if err != nil {
+		return err
+	}
+	f.mLck.Lock()
+	f.m = newm
+	f.mStamp = info.ModTime()
+	f.mLck.Unlock()
+	return nil
+}
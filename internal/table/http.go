@@ -0,0 +1,358 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// maxHTTPResponse is the maximum size of the response body read by table.http.
+const maxHTTPResponse = 1024 * 1024
+
+var ErrCircuitOpen = errors.New("table.http: too many failed requests, endpoint is not queried temporarily")
+
+type httpEntry struct {
+	vals    []string
+	etag    string
+	expires time.Time
+}
+
+// HTTP is a table that performs lookups using the HTTP API.
+type HTTP struct {
+	modName    string
+	instName   string
+	inlineArgs []string
+
+	endpoint    string
+	headers     http.Header
+	client      *http.Client
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	norm        keyNormalizer
+
+	breakerThreshold int
+	breakerTimeout   time.Duration
+
+	now func() time.Time
+	log log.Logger
+
+	lock      sync.Mutex
+	entries   map[string]httpEntry
+	failures  int
+	openUntil time.Time
+}
+
+func NewHTTP(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &HTTP{
+		modName:    modName,
+		instName:   instName,
+		inlineArgs: inlineArgs,
+		headers:    http.Header{},
+		now:        time.Now,
+		log:        log.Logger{Name: modName},
+		entries:    make(map[string]httpEntry),
+	}, nil
+}
+
+func (h *HTTP) Init(cfg *config.Map) error {
+	var (
+		defaultEndpoint string
+		tlsConfig       tls.Config
+		timeout         time.Duration
+	)
+	switch len(h.inlineArgs) {
+	case 0:
+	case 1:
+		defaultEndpoint = h.inlineArgs[0]
+	default:
+		return fmt.Errorf("%s: at most one argument is expected", h.modName)
+	}
+
+	cfg.Bool("debug", true, false, &h.log.Debug)
+	cfg.String("url", false, defaultEndpoint == "", defaultEndpoint, &h.endpoint)
+	cfg.Callback("header", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 2 {
+			return config.NodeErr(node, "expected two arguments")
+		}
+		h.headers.Add(node.Args[0], node.Args[1])
+		return nil
+	})
+	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
+		return tls.Config{}, nil
+	}, tls2.TLSClientBlock, &tlsConfig)
+	cfg.Duration("timeout", false, false, 5*time.Second, &timeout)
+	cfg.Duration("ttl", false, false, time.Minute, &h.ttl)
+	cfg.Duration("negative_ttl", false, false, 30*time.Second, &h.negativeTTL)
+	cfg.Int("max_entries", false, false, 10000, &h.maxEntries)
+	cfg.Int("breaker_threshold", false, false, 5, &h.breakerThreshold)
+	cfg.Duration("breaker_timeout", false, false, 30*time.Second, &h.breakerTimeout)
+	addNormalizeDirective(cfg, &h.norm)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(h.endpoint)
+	if err != nil {
+		return fmt.Errorf("%s: malformed url: %w", h.modName, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s: unsupported URL scheme: %s", h.modName, u.Scheme)
+	}
+	if h.maxEntries <= 0 {
+		return fmt.Errorf("%s: max_entries should be positive", h.modName)
+	}
+
+	h.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tlsConfig,
+		},
+		Timeout: timeout,
+	}
+
+	return nil
+}
+
+func (h *HTTP) Name() string {
+	return h.modName
+}
+
+func (h *HTTP) InstanceName() string {
+	return h.instName
+}
+
+// requestURL returns the URL to query for the key. The key either replaces
+// the {key} placeholder or is added as the "key" query parameter.
+func (h *HTTP) requestURL(key string) string {
+	if strings.Contains(h.endpoint, "{key}") {
+		return strings.ReplaceAll(h.endpoint, "{key}", url.QueryEscape(key))
+	}
+
+	u, _ := url.Parse(h.endpoint)
+	q := u.Query()
+	q.Set("key", key)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// parseHTTPValues parses the lookup response. JSON responses should contain
+// a string or an array of strings, other responses are parsed as a list of
+// values, one per line.
+func parseHTTPValues(contentType string, body []byte) ([]string, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "application/json" {
+		var single string
+		if err := json.Unmarshal(body, &single); err == nil {
+			if single == "" {
+				return nil, nil
+			}
+			return []string{single}, nil
+		}
+		var multi []string
+		if err := json.Unmarshal(body, &multi); err != nil {
+			return nil, fmt.Errorf("malformed response: %w", err)
+		}
+		return multi, nil
+	}
+
+	var vals []string
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			vals = append(vals, line)
+		}
+	}
+	return vals, nil
+}
+
+// cached returns the cache entry for the key and whether it is still fresh.
+func (h *HTTP) cached(key string) (httpEntry, bool, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	entry, ok := h.entries[key]
+	if !ok {
+		return httpEntry{}, false, false
+	}
+	return entry, true, h.now().Before(entry.expires)
+}
+
+func (h *HTTP) store(key string, entry httpEntry) {
+	ttl := h.ttl
+	if len(entry.vals) == 0 {
+		ttl = h.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := h.now()
+	entry.expires = now.Add(ttl)
+	if _, ok := h.entries[key]; !ok && len(h.entries) >= h.maxEntries {
+		for k, e := range h.entries {
+			if !now.Before(e.expires) {
+				delete(h.entries, k)
+			}
+		}
+		for k := range h.entries {
+			if len(h.entries) < h.maxEntries {
+				break
+			}
+			delete(h.entries, k)
+		}
+	}
+	h.entries[key] = entry
+}
+
+// allowRequest checks whether the circuit breaker allows querying the
+// endpoint.
+func (h *HTTP) allowRequest() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return !h.now().Before(h.openUntil)
+}
+
+func (h *HTTP) recordResult(err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if err == nil {
+		h.failures = 0
+		return
+	}
+	h.failures++
+	if h.breakerThreshold > 0 && h.failures >= h.breakerThreshold {
+		h.openUntil = h.now().Add(h.breakerTimeout)
+		// Let a single request through once the timeout expires.
+		h.failures = h.breakerThreshold - 1
+		h.log.Msg("endpoint is failing, not querying it temporarily", "failures", h.breakerThreshold, "timeout", h.breakerTimeout)
+	}
+}
+
+func (h *HTTP) fetch(ctx context.Context, key string, cached httpEntry, haveCached bool) (httpEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.requestURL(key), nil)
+	if err != nil {
+		return httpEntry{}, err
+	}
+	for k, v := range h.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "application/json, text/plain")
+	if haveCached && cached.etag != "" {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return httpEntry{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPResponse))
+		if err != nil {
+			return httpEntry{}, err
+		}
+		vals, err := parseHTTPValues(resp.Header.Get("Content-Type"), body)
+		if err != nil {
+			return httpEntry{}, err
+		}
+		return httpEntry{vals: vals, etag: resp.Header.Get("ETag")}, nil
+	case http.StatusNotModified:
+		if !haveCached {
+			return httpEntry{}, errors.New("unexpected 304 response")
+		}
+		return cached, nil
+	case http.StatusNotFound, http.StatusNoContent:
+		return httpEntry{}, nil
+	default:
+		return httpEntry{}, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+}
+
+func (h *HTTP) Lookup(ctx context.Context, key string) (string, bool, error) {
+	vals, err := h.LookupMulti(ctx, key)
+	if err != nil {
+		return "", false, err
+	}
+	if len(vals) == 0 {
+		return "", false, nil
+	}
+	return vals[0], true, nil
+}
+
+func (h *HTTP) LookupMulti(ctx context.Context, key string) ([]string, error) {
+	key, ok := h.norm.normalize(key)
+	if !ok {
+		return nil, nil
+	}
+
+	cached, haveCached, fresh := h.cached(key)
+	if fresh {
+		return cached.vals, nil
+	}
+
+	if !h.allowRequest() {
+		if haveCached {
+			h.log.DebugMsg("using stale entry, endpoint is not queried", "key", key)
+			return cached.vals, nil
+		}
+		return nil, ErrCircuitOpen
+	}
+
+	entry, err := h.fetch(ctx, key, cached, haveCached)
+	// Do not count cancellations by the caller as endpoint failures.
+	if ctx.Err() == nil {
+		h.recordResult(err)
+	}
+	if err != nil {
+		if haveCached {
+			h.log.Error("lookup failed, using stale entry", err, "key", key)
+			return cached.vals, nil
+		}
+		return nil, fmt.Errorf("%s: %w", h.modName, err)
+	}
+
+	h.store(key, entry)
+	return entry.vals, nil
+}
+
+func init() {
+	module.Register("table.http", NewHTTP)
+}
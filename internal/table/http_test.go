@@ -0,0 +1,185 @@
+package table
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func newTestHTTP(t *testing.T, endpoint string) *HTTP {
+	t.Helper()
+	mod, err := NewHTTP("table.http", "", nil, []string{endpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mod.(*HTTP)
+	h.log = testutils.Logger(t, "table.http")
+	err = h.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "header", Args: []string{"Authorization", "Bearer secret"}},
+			{Name: "breaker_threshold", Args: []string{"2"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestHTTP(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Query().Get("key") {
+		case "single":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`"a@example.org"`))
+		case "multi":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write([]byte(`["a@example.org", "b@example.org"]`))
+		case "text":
+			w.Write([]byte("a@example.org\r\n\r\nb@example.org\n"))
+		case "broken":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	h := newTestHTTP(t, srv.URL+"/lookup")
+
+	test := func(key string, expected []string) {
+		t.Helper()
+		vals, err := h.LookupMulti(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vals, expected) {
+			t.Errorf("%q: expected %q, got %q", key, expected, vals)
+		}
+	}
+
+	test("single", []string{"a@example.org"})
+	test("multi", []string{"a@example.org", "b@example.org"})
+	test("text", []string{"a@example.org", "b@example.org"})
+	test("missing", nil)
+	if _, err := h.LookupMulti(context.Background(), "broken"); err == nil {
+		t.Error("Expected error for a malformed response")
+	}
+
+	// Cached.
+	before := atomic.LoadInt32(&requests)
+	test("single", []string{"a@example.org"})
+	test("missing", nil)
+	if atomic.LoadInt32(&requests) != before {
+		t.Error("Cached entries were not used")
+	}
+}
+
+func TestHTTP_ETag(t *testing.T) {
+	var (
+		requests    int32
+		notModified int32
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path != "/users/a@example.org" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`"value"`))
+	}))
+	defer srv.Close()
+
+	now := time.Unix(0, 0)
+	h := newTestHTTP(t, srv.URL+"/users/{key}")
+	h.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		val, ok, err := h.Lookup(context.Background(), "a@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || val != "value" {
+			t.Fatalf("Wrong result: %q %v", val, ok)
+		}
+		now = now.Add(2 * time.Minute)
+	}
+
+	if requests != 3 || notModified != 2 {
+		t.Errorf("Expected 3 requests with 2 revalidations, got %d and %d", requests, notModified)
+	}
+}
+
+func TestHTTP_CircuitBreaker(t *testing.T) {
+	var requests, failing int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("value"))
+	}))
+	defer srv.Close()
+
+	now := time.Unix(0, 0)
+	h := newTestHTTP(t, srv.URL)
+	h.now = func() time.Time { return now }
+
+	// Populate the cache.
+	if _, err := h.LookupMulti(context.Background(), "cached"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Minute)
+	atomic.StoreInt32(&failing, 1)
+
+	// Stale entry is used on error.
+	vals, err := h.LookupMulti(context.Background(), "cached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 1 || vals[0] != "value" {
+		t.Errorf("Stale entry is not used: %v", vals)
+	}
+
+	// Second failure opens the circuit.
+	if _, err := h.LookupMulti(context.Background(), "key1"); err == nil {
+		t.Fatal("Expected error")
+	}
+	before := atomic.LoadInt32(&requests)
+	if _, err := h.LookupMulti(context.Background(), "key2"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatal("Expected ErrCircuitOpen, got", err)
+	}
+	if atomic.LoadInt32(&requests) != before {
+		t.Error("Endpoint was queried while the circuit is open")
+	}
+
+	// Endpoint is queried again after the timeout.
+	now = now.Add(time.Minute)
+	atomic.StoreInt32(&failing, 0)
+	if _, err := h.LookupMulti(context.Background(), "key2"); err != nil {
+		t.Fatal(err)
+	}
+}
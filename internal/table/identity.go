@@ -28,6 +28,7 @@ import (
 type Identity struct {
 	modName  string
 	instName string
+	norm     keyNormalizer
 }
 
 func NewIdentity(modName, instName string, _, _ []string) (module.Module, error) {
@@ -38,7 +39,9 @@ func NewIdentity(modName, instName string, _, _ []string) (module.Module, error)
 }
 
 func (s *Identity) Init(cfg *config.Map) error {
-	return nil
+	addNormalizeDirective(cfg, &s.norm)
+	_, err := cfg.Process()
+	return err
 }
 
 func (s *Identity) Name() string {
@@ -50,7 +53,8 @@ func (s *Identity) InstanceName() string {
 }
 
 func (s *Identity) Lookup(_ context.Context, key string) (string, bool, error) {
-	return key, true, nil
+	key, ok := s.norm.normalize(key)
+	return key, ok, nil
 }
 
 func init() {
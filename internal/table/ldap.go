@@ -0,0 +1,146 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	maddyldap "github.com/foxcpp/maddy/internal/auth/ldap"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAP implements table.ldap module that looks up values of an attribute
+// of directory entries matching the filter. It can be used for existence
+// checks (e.g. for destination_in) and alias expansion.
+//
+// Connection configuration and pooling is shared with auth.ldap.
+type LDAP struct {
+	modName  string
+	instName string
+
+	cl *maddyldap.Client
+
+	baseDN         string
+	filterTemplate string
+	attribute      string
+	scope          int
+	sizeLimit      int
+
+	log log.Logger
+}
+
+func NewLDAP(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	t := &LDAP{
+		modName:  modName,
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}
+	t.cl = maddyldap.NewClient(modName, inlineArgs, &t.log)
+	return t, nil
+}
+
+func (t *LDAP) Init(cfg *config.Map) error {
+	var scope string
+
+	t.cl.Configure(cfg)
+	cfg.String("base_dn", false, true, "", &t.baseDN)
+	cfg.String("filter", false, true, "", &t.filterTemplate)
+	cfg.String("attribute", false, false, "", &t.attribute)
+	cfg.Enum("scope", false, false, []string{"base", "one", "sub"}, "sub", &scope)
+	cfg.Int("size_limit", false, false, 100, &t.sizeLimit)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	switch scope {
+	case "base":
+		t.scope = ldap.ScopeBaseObject
+	case "one":
+		t.scope = ldap.ScopeSingleLevel
+	case "sub":
+		t.scope = ldap.ScopeWholeSubtree
+	}
+	if t.sizeLimit < 0 {
+		return fmt.Errorf("%s: size_limit cannot be negative", t.modName)
+	}
+
+	return t.cl.Init()
+}
+
+func (t *LDAP) Name() string {
+	return t.modName
+}
+
+func (t *LDAP) InstanceName() string {
+	return t.instName
+}
+
+func (t *LDAP) Close() error {
+	return t.cl.Close()
+}
+
+func (t *LDAP) LookupMulti(_ context.Context, key string) ([]string, error) {
+	escaped := ldap.EscapeFilter(key)
+	filter := strings.NewReplacer("{key}", escaped, "{username}", escaped).Replace(t.filterTemplate)
+
+	attrs := []string{"dn"}
+	if t.attribute != "" {
+		attrs = []string{t.attribute}
+	}
+	req := ldap.NewSearchRequest(
+		t.baseDN, t.scope, ldap.NeverDerefAliases,
+		t.sizeLimit, 0, false,
+		filter, attrs, nil)
+	res, err := t.cl.Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var vals []string
+	for _, entry := range res.Entries {
+		if t.attribute == "" {
+			vals = append(vals, entry.DN)
+			continue
+		}
+		vals = append(vals, entry.GetAttributeValues(t.attribute)...)
+	}
+	return vals, nil
+}
+
+func (t *LDAP) Lookup(ctx context.Context, key string) (string, bool, error) {
+	vals, err := t.LookupMulti(ctx, key)
+	if err != nil {
+		return "", false, err
+	}
+	if len(vals) == 0 {
+		return "", false, nil
+	}
+	return vals[0], true, nil
+}
+
+func init() {
+	var _ module.Table = &LDAP{}
+	var _ module.MultiTable = &LDAP{}
+	module.Register("table.ldap", NewLDAP)
+}
@@ -0,0 +1,116 @@
+package table
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func newTestLDAP(t *testing.T, srv *testutils.LDAPServer, directives ...config.Node) *LDAP {
+	t.Helper()
+	mod, err := NewLDAP("table.ldap", "", nil, []string{srv.URL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl := mod.(*LDAP)
+	tbl.log = testutils.Logger(t, "table.ldap")
+	if err := tbl.Init(config.NewMap(nil, config.Node{Children: append([]config.Node{
+		{Name: "bind", Args: []string{"plain", "cn=maddy,dc=example,dc=org", "service"}},
+		{Name: "base_dn", Args: []string{"ou=people,dc=example,dc=org"}},
+	}, directives...)})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tbl.Close() })
+	return tbl
+}
+
+func TestLDAP(t *testing.T) {
+	srv := testutils.NewLDAPServer(t,
+		testutils.LDAPEntry{DN: "cn=maddy,dc=example,dc=org", Password: "service"},
+		testutils.LDAPEntry{
+			DN: "uid=alice,ou=people,dc=example,dc=org",
+			Attrs: map[string][]string{
+				"uid":        {"alice"},
+				"mail":       {"alice@example.org"},
+				"mailAlias":  {"a@example.org", "al@example.org"},
+				"department": {"sales"},
+			},
+		},
+		testutils.LDAPEntry{
+			DN: "uid=bob,ou=people,dc=example,dc=org",
+			Attrs: map[string][]string{
+				"uid":        {"bob"},
+				"mail":       {"bob@example.org"},
+				"department": {"sales"},
+			},
+		},
+	)
+
+	test := func(tbl *LDAP, key string, expected []string) {
+		t.Helper()
+		vals, err := tbl.LookupMulti(context.Background(), key)
+		if err != nil {
+			t.Fatalf("%q: %v", key, err)
+		}
+		if !reflect.DeepEqual(vals, expected) {
+			t.Errorf("%q: expected %v, got %v", key, expected, vals)
+		}
+
+		val, ok, err := tbl.Lookup(context.Background(), key)
+		if err != nil {
+			t.Fatalf("%q: %v", key, err)
+		}
+		if len(expected) == 0 {
+			if ok {
+				t.Errorf("%q: unexpected value %q", key, val)
+			}
+			return
+		}
+		if !ok || val != expected[0] {
+			t.Errorf("%q: expected %q, got %q (%v)", key, expected[0], val, ok)
+		}
+	}
+
+	t.Run("attribute", func(t *testing.T) {
+		tbl := newTestLDAP(t, srv,
+			config.Node{Name: "filter", Args: []string{"(mail={key})"}},
+			config.Node{Name: "attribute", Args: []string{"mailAlias"}})
+		test(tbl, "alice@example.org", []string{"a@example.org", "al@example.org"})
+		test(tbl, "bob@example.org", nil)
+		test(tbl, "eve@example.org", nil)
+		test(tbl, "*", nil)
+	})
+	t.Run("dn", func(t *testing.T) {
+		tbl := newTestLDAP(t, srv,
+			config.Node{Name: "filter", Args: []string{"(&(uid={key})(department=sales))"}})
+		test(tbl, "bob", []string{"uid=bob,ou=people,dc=example,dc=org"})
+		test(tbl, "bob)(uid=*", nil)
+	})
+	t.Run("size_limit", func(t *testing.T) {
+		tbl := newTestLDAP(t, srv,
+			config.Node{Name: "filter", Args: []string{"(department={key})"}},
+			config.Node{Name: "size_limit", Args: []string{"1"}})
+		test(tbl, "sales", []string{"uid=alice,ou=people,dc=example,dc=org"})
+	})
+
+	for _, s := range srv.Searches() {
+		if s.BaseDN != "ou=people,dc=example,dc=org" {
+			t.Errorf("unexpected base DN: %s", s.BaseDN)
+		}
+		if s.BindDN != "cn=maddy,dc=example,dc=org" {
+			t.Errorf("search done as %q", s.BindDN)
+		}
+	}
+	filters := map[string]bool{}
+	for _, s := range srv.Searches() {
+		filters[s.Filter] = true
+	}
+	for _, f := range []string{`(mail=\2a)`, `(&(uid=bob\29\28uid=\2a)(department=sales))`} {
+		if !filters[f] {
+			t.Errorf("missing escaped filter %s in requests", f)
+		}
+	}
+}
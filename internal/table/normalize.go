@@ -0,0 +1,156 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/authz"
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizeFuncs are key normalization functions usable with the
+// 'normalize' directive. In addition to functions supported by
+// auth_map_normalize, NFC normalization and conversion of domains are
+// available.
+var normalizeFuncs = map[string]authz.NormalizeFunc{
+	"nfc": func(s string) (string, error) {
+		return norm.NFC.String(s), nil
+	},
+	"email":          emailForLookup,
+	"domain_ascii":   domainASCII,
+	"domain_unicode": domainUnicode,
+}
+
+func init() {
+	for name, f := range authz.NormalizeFuncs {
+		normalizeFuncs[name] = f
+	}
+}
+
+// mapDomain applies f to the domain part of the address or to the whole
+// key if it does not contain '@'.
+func mapDomain(key string, f func(string) (string, error)) (string, error) {
+	if !strings.Contains(key, "@") {
+		return f(key)
+	}
+	mbox, domain, err := address.Split(key)
+	if err != nil {
+		return key, err
+	}
+	domain, err = f(domain)
+	if err != nil {
+		return key, err
+	}
+	return mbox + "@" + domain, nil
+}
+
+// asciiLower converts ASCII letters to lower case, other characters are
+// left intact. Unlike strings.ToLower, it can be used before NFC
+// normalization.
+func asciiLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + ('a' - 'A')
+		}
+		return r
+	}, s)
+}
+
+// emailForLookup is address.ForLookup that also accepts A-labels with
+// upper-case ACE prefix ("XN--").
+func emailForLookup(key string) (string, error) {
+	mbox, domain, err := address.Split(key)
+	if err != nil || domain == "" {
+		return address.ForLookup(key)
+	}
+	return address.ForLookup(mbox + "@" + asciiLower(domain))
+}
+
+// domainASCII converts the domain to lower-case A-labels (punycode).
+func domainASCII(key string) (string, error) {
+	return mapDomain(key, func(domain string) (string, error) {
+		return idna.ToASCII(strings.ToLower(norm.NFC.String(domain)))
+	})
+}
+
+// domainUnicode converts the domain to lower-case U-labels normalized to NFC.
+func domainUnicode(key string) (string, error) {
+	return mapDomain(key, func(domain string) (string, error) {
+		// Unlike dns.ForLookup, do not ignore errors.
+		uDomain, err := idna.ToUnicode(asciiLower(domain))
+		if err != nil {
+			return domain, err
+		}
+		return strings.ToLower(norm.NFC.String(uDomain)), nil
+	})
+}
+
+// keyNormalizer applies the key normalization configured for the table
+// using the 'normalize' directive. The zero value performs no normalization.
+type keyNormalizer struct {
+	funcs []authz.NormalizeFunc
+}
+
+// normalizeDirective parses the 'normalize' directive arguments, functions
+// are applied in the specified order.
+func normalizeDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "at least one normalization function is required")
+	}
+
+	var n keyNormalizer
+	for _, name := range node.Args {
+		f, ok := normalizeFuncs[name]
+		if !ok {
+			return nil, config.NodeErr(node, "unknown normalization function: %s", name)
+		}
+		n.funcs = append(n.funcs, f)
+	}
+	return n, nil
+}
+
+// addNormalizeDirective adds the 'normalize' directive to the table
+// configuration.
+func addNormalizeDirective(cfg *config.Map, n *keyNormalizer) {
+	cfg.Custom("normalize", false, false, func() (interface{}, error) {
+		return keyNormalizer{}, nil
+	}, normalizeDirective, n)
+}
+
+// normalize returns the normalized key. If normalization fails, the key
+// cannot match anything and false is returned.
+func (n keyNormalizer) normalize(key string) (string, bool) {
+	for _, f := range n.funcs {
+		var err error
+		key, err = f(key)
+		if err != nil {
+			return "", false
+		}
+	}
+	return key, true
+}
+
+// enabled reports whether any normalization is configured.
+func (n keyNormalizer) enabled() bool {
+	return len(n.funcs) != 0
+}
@@ -0,0 +1,116 @@
+package table
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestNormalizeFuncs(t *testing.T) {
+	test := func(funcs []string, key, expected string, expectedOk bool) {
+		t.Helper()
+		v, err := normalizeDirective(nil, config.Node{Name: "normalize", Args: funcs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, ok := v.(keyNormalizer).normalize(key)
+		if res != expected || ok != expectedOk {
+			t.Errorf("%v(%q): expected (%q, %v), got (%q, %v)", funcs, key, expected, expectedOk, res, ok)
+		}
+	}
+
+	test([]string{"casefold"}, "Foo@Example.ORG", "foo@example.org", true)
+	test([]string{"email"}, "Test@XN--80A1ACNY.XN--P1AI", "test@почта.рф", true)
+	test([]string{"domain_ascii"}, "Test@Почта.рф", "Test@xn--80a1acny.xn--p1ai", true)
+	test([]string{"domain_ascii"}, "ПОЧТА.рф", "xn--80a1acny.xn--p1ai", true)
+	test([]string{"domain_unicode"}, "Test@XN--80A1ACNY.XN--P1AI", "Test@почта.рф", true)
+	test([]string{"domain_unicode", "casefold"}, "Test@XN--80A1ACNY.XN--P1AI", "test@почта.рф", true)
+	// U+0065 U+0301 (e + combining acute accent) -> U+00E9
+	test([]string{"nfc"}, "cafe\u0301@example.org", "caf\u00e9@example.org", true)
+	test([]string{"precis_casefold_email"}, "CAFÉ@Example.org", "café@example.org", true)
+	test([]string{"precis_casefold"}, "bad\u0000key", "", false)
+	test([]string{"domain_ascii"}, "test@", "", false)
+
+	if _, err := normalizeDirective(nil, config.Node{Name: "normalize", Args: []string{"nope"}}); err == nil {
+		t.Error("expected an error for unknown function")
+	}
+	if _, err := normalizeDirective(nil, config.Node{Name: "normalize"}); err == nil {
+		t.Error("expected an error for missing arguments")
+	}
+}
+
+func TestStaticNormalize(t *testing.T) {
+	mod, err := NewStatic("table.static", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "entry", Args: []string{"Info@Example.org", "a@example.org"}},
+			{Name: "entry", Args: []string{"INFO@example.org", "b@example.org"}},
+			{Name: "normalize", Args: []string{"casefold"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := mod.(*Static)
+
+	val, ok, err := s.Lookup(context.Background(), "info@EXAMPLE.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || val != "b@example.org" {
+		t.Errorf("expected the last entry to take effect, got (%q, %v)", val, ok)
+	}
+}
+
+func TestFileNormalize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aliases")
+	if err := os.WriteFile(path, []byte("Postmaster@XN--80A1ACNY.XN--P1AI: a@example.org\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	mod, err := NewFile("", "", nil, []string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*File)
+	m.log = testutils.Logger(t, FileModName)
+	err = mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "normalize", Args: []string{"email"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	for _, key := range []string{"postmaster@почта.рф", "POSTMASTER@ПОЧТА.РФ", "postmaster@xn--80a1acny.xn--p1ai"} {
+		if val, ok, _ := m.Lookup(context.Background(), key); !ok || val != "a@example.org" {
+			t.Errorf("Lookup %q: got (%q, %v)", key, val, ok)
+		}
+	}
+
+	// Modifications use the normalized key.
+	if err := m.SetKey("POSTMASTER@почта.рф", "b@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	text, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(text) != "postmaster@почта.рф: b@example.org\n" {
+		t.Errorf("wrong file contents: %q", text)
+	}
+	keys, _ := m.Keys()
+	if !reflect.DeepEqual(keys, []string{"postmaster@почта.рф"}) {
+		t.Errorf("wrong keys: %v", keys)
+	}
+}
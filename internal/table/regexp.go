@@ -37,6 +37,7 @@ type Regexp struct {
 	replacements []string
 
 	expandPlaceholders bool
+	norm               keyNormalizer
 }
 
 func NewRegexp(modName, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -55,6 +56,7 @@ func (r *Regexp) Init(cfg *config.Map) error {
 	cfg.Bool("full_match", false, true, &fullMatch)
 	cfg.Bool("case_insensitive", false, true, &caseInsensitive)
 	cfg.Bool("expand_replaceholders", false, true, &r.expandPlaceholders)
+	addNormalizeDirective(cfg, &r.norm)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -94,10 +96,19 @@ func (r *Regexp) InstanceName() string {
 }
 
 func (r *Regexp) LookupMulti(_ context.Context, key string) ([]string, error) {
+	key, ok := r.norm.normalize(key)
+	if !ok {
+		return []string{}, nil
+	}
+
 	matches := r.re.FindStringSubmatchIndex(key)
 	if matches == nil {
 		return []string{}, nil
 	}
+	if len(r.replacements) == 0 {
+		// Act as a match check.
+		return []string{key}, nil
+	}
 
 	result := []string{}
 	for _, replacement := range r.replacements {
@@ -0,0 +1,38 @@
+package table
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func TestRegexp(t *testing.T) {
+	test := func(args []string, key, expected string, expectedOk bool) {
+		t.Helper()
+
+		mod, err := NewRegexp("table.regexp", "", nil, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mod.Init(config.NewMap(nil, config.Node{})); err != nil {
+			t.Fatal(err)
+		}
+
+		val, ok, err := mod.(*Regexp).Lookup(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != expectedOk || val != expected {
+			t.Errorf("%v %q: expected (%q, %v), got (%q, %v)", args, key, expected, expectedOk, val, ok)
+		}
+	}
+
+	test([]string{"(.*)@example.org", "$1@example.com"}, "user@example.org", "user@example.com", true)
+	test([]string{"(.*)@example.org", "$1@example.com"}, "user@example.net", "", false)
+	test([]string{"(.*)@example.org", "static"}, "user@EXAMPLE.org", "static", true)
+
+	// Without replacement, the table acts as a match check.
+	test([]string{"(.*)@example.org"}, "user@example.org", "user@example.org", true)
+	test([]string{"(.*)@example.org"}, "user@example.net", "", false)
+}
@@ -34,6 +34,7 @@ type SQL struct {
 	instName string
 
 	namedArgs bool
+	norm      keyNormalizer
 
 	db     *sql.DB
 	lookup *sql.Stmt
@@ -81,6 +82,7 @@ func (s *SQL) Init(cfg *config.Map) error {
 	cfg.String("list", false, false, "", &listQuery)
 	cfg.String("del", false, false, "", &removeQuery)
 	cfg.String("set", false, false, "", &setQuery)
+	addNormalizeDirective(cfg, &s.norm)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -139,6 +141,11 @@ func (s *SQL) Close() error {
 }
 
 func (s *SQL) Lookup(ctx context.Context, val string) (string, bool, error) {
+	val, ok := s.norm.normalize(val)
+	if !ok {
+		return "", false, nil
+	}
+
 	var (
 		repl string
 		row  *sql.Row
@@ -158,6 +165,11 @@ func (s *SQL) Lookup(ctx context.Context, val string) (string, bool, error) {
 }
 
 func (s *SQL) LookupMulti(ctx context.Context, val string) ([]string, error) {
+	val, ok := s.norm.normalize(val)
+	if !ok {
+		return nil, nil
+	}
+
 	var (
 		repl []string
 		rows *sql.Rows
@@ -209,6 +221,11 @@ func (s *SQL) RemoveKey(k string) error {
 	if s.del == nil {
 		return fmt.Errorf("%s: table is not mutable (no 'del' query)", s.modName)
 	}
+	normKey, ok := s.norm.normalize(k)
+	if !ok {
+		return fmt.Errorf("%s: del %s: cannot normalize key", s.modName, k)
+	}
+	k = normKey
 
 	var err error
 	if s.namedArgs {
@@ -229,6 +246,11 @@ func (s *SQL) SetKey(k, v string) error {
 	if s.add == nil {
 		return fmt.Errorf("%s: table is not mutable (no 'add' query)", s.modName)
 	}
+	normKey, ok := s.norm.normalize(k)
+	if !ok {
+		return fmt.Errorf("%s: add %s: cannot normalize key", s.modName, k)
+	}
+	k = normKey
 
 	var args []interface{}
 	if s.namedArgs {
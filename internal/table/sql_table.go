@@ -61,12 +61,14 @@ func (s *SQLTable) Init(cfg *config.Map) error {
 		tableName   string
 		keyColumn   string
 		valueColumn string
+		norm        keyNormalizer
 	)
 	cfg.String("driver", false, true, "", &driver)
 	cfg.StringList("dsn", false, true, nil, &dsnParts)
 	cfg.String("table_name", false, true, "", &tableName)
 	cfg.String("key_column", false, false, "key", &keyColumn)
 	cfg.String("value_column", false, false, "value", &valueColumn)
+	addNormalizeDirective(cfg, &norm)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -99,7 +101,7 @@ func (s *SQLTable) Init(cfg *config.Map) error {
 		delQuery = fmt.Sprintf("DELETE FROM %s WHERE %s = $1", tableName, keyColumn)
 	}
 
-	return s.wrapped.Init(config.NewMap(cfg.Globals, config.Node{
+	err := s.wrapped.Init(config.NewMap(cfg.Globals, config.Node{
 		Children: []config.Node{
 			{
 				Name: "driver",
@@ -142,6 +144,8 @@ func (s *SQLTable) Init(cfg *config.Map) error {
 			},
 		},
 	}))
+	s.wrapped.norm = norm
+	return err
 }
 
 func (s *SQLTable) Close() error {
@@ -20,6 +20,7 @@ package table
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/module"
@@ -29,7 +30,8 @@ type Static struct {
 	modName  string
 	instName string
 
-	m map[string][]string
+	m    map[string][]string
+	norm keyNormalizer
 }
 
 func NewStatic(modName, instName string, _, _ []string) (module.Module, error) {
@@ -41,15 +43,27 @@ func NewStatic(modName, instName string, _, _ []string) (module.Module, error) {
 }
 
 func (s *Static) Init(cfg *config.Map) error {
+	var entries [][]string
 	cfg.Callback("entry", func(_ *config.Map, node config.Node) error {
 		if len(node.Args) < 2 {
 			return config.NodeErr(node, "expected at least one value")
 		}
-		s.m[node.Args[0]] = node.Args[1:]
+		entries = append(entries, node.Args)
 		return nil
 	})
-	_, err := cfg.Process()
-	return err
+	addNormalizeDirective(cfg, &s.norm)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		key, ok := s.norm.normalize(entry[0])
+		if !ok {
+			return fmt.Errorf("%s: cannot normalize key: %s", s.modName, entry[0])
+		}
+		s.m[key] = entry[1:]
+	}
+	return nil
 }
 
 func (s *Static) Name() string {
@@ -61,7 +75,7 @@ func (s *Static) InstanceName() string {
 }
 
 func (s *Static) Lookup(ctx context.Context, key string) (string, bool, error) {
-	val := s.m[key]
+	val, _ := s.LookupMulti(ctx, key)
 	if len(val) == 0 {
 		return "", false, nil
 	}
@@ -69,6 +83,10 @@ func (s *Static) Lookup(ctx context.Context, key string) (string, bool, error) {
 }
 
 func (s *Static) LookupMulti(ctx context.Context, key string) ([]string, error) {
+	key, ok := s.norm.normalize(key)
+	if !ok {
+		return nil, nil
+	}
 	return s.m[key], nil
 }
 
@@ -0,0 +1,129 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"context"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// lookupMulti returns all values for the key, using LookupMulti if the table
+// supports it.
+func lookupMulti(ctx context.Context, tbl module.Table, key string) ([]string, error) {
+	if multi, ok := tbl.(module.MultiTable); ok {
+		return multi.LookupMulti(ctx, key)
+	}
+	val, ok, err := tbl.Lookup(ctx, key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return []string{val}, nil
+}
+
+// tablesDirective returns the config callback that adds the table specified
+// by the directive to tbls.
+func tablesDirective(tbls *[]module.Table) func(*config.Map, config.Node) error {
+	return func(m *config.Map, node config.Node) error {
+		var tbl module.Table
+		err := modconfig.ModuleFromNode("table", node.Args, node, m.Globals, &tbl)
+		if err != nil {
+			return err
+		}
+
+		*tbls = append(*tbls, tbl)
+		return nil
+	}
+}
+
+type Union struct {
+	modName  string
+	instName string
+
+	tables []module.Table
+	norm   keyNormalizer
+}
+
+func NewUnion(modName, instName string, _, _ []string) (module.Module, error) {
+	return &Union{
+		modName:  modName,
+		instName: instName,
+	}, nil
+}
+
+func (u *Union) Init(cfg *config.Map) error {
+	cfg.Callback("table", tablesDirective(&u.tables))
+	addNormalizeDirective(cfg, &u.norm)
+
+	_, err := cfg.Process()
+	return err
+}
+
+func (u *Union) Name() string {
+	return u.modName
+}
+
+func (u *Union) InstanceName() string {
+	return u.instName
+}
+
+func (u *Union) Lookup(ctx context.Context, key string) (string, bool, error) {
+	vals, err := u.LookupMulti(ctx, key)
+	if err != nil {
+		return "", false, err
+	}
+	if len(vals) == 0 {
+		return "", false, nil
+	}
+	return vals[0], true, nil
+}
+
+// LookupMulti returns values from all tables, in the order tables are
+// specified. Duplicate values are returned only once.
+func (u *Union) LookupMulti(ctx context.Context, key string) ([]string, error) {
+	key, ok := u.norm.normalize(key)
+	if !ok {
+		return nil, nil
+	}
+
+	var (
+		result []string
+		seen   = make(map[string]struct{})
+	)
+	for _, tbl := range u.tables {
+		vals, err := lookupMulti(ctx, tbl, key)
+		if err != nil {
+			return nil, err
+		}
+		for _, val := range vals {
+			if _, ok := seen[val]; ok {
+				continue
+			}
+			seen[val] = struct{}{}
+			result = append(result, val)
+		}
+	}
+	return result, nil
+}
+
+func init() {
+	module.Register("table.union", NewUnion)
+}
@@ -0,0 +1,90 @@
+package table
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// multiTable is a table that also implements module.MultiTable.
+type multiTable struct {
+	testutils.MultiTable
+}
+
+func (m multiTable) Lookup(ctx context.Context, key string) (string, bool, error) {
+	vals, err := m.LookupMulti(ctx, key)
+	if err != nil || len(vals) == 0 {
+		return "", false, err
+	}
+	return vals[0], true, nil
+}
+
+func TestUnion(t *testing.T) {
+	u := Union{tables: []module.Table{
+		testutils.Table{M: map[string]string{"a": "1", "b": "2"}},
+		multiTable{testutils.MultiTable{M: map[string][]string{"a": {"3", "1", "4"}}}},
+	}}
+
+	vals, err := u.LookupMulti(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, []string{"1", "3", "4"}) {
+		t.Errorf("Wrong result: %v", vals)
+	}
+
+	val, ok, err := u.Lookup(context.Background(), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || val != "2" {
+		t.Errorf("Wrong result: %v %v", val, ok)
+	}
+
+	_, ok, err = u.Lookup(context.Background(), "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("Unexpected value for missing key")
+	}
+
+	u.tables = append(u.tables, testutils.Table{Err: errors.New("oops")})
+	if _, err := u.LookupMulti(context.Background(), "a"); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+func TestFallback(t *testing.T) {
+	f := Fallback{tables: []module.Table{
+		testutils.Table{M: map[string]string{"a": "1", "empty": ""}},
+		multiTable{testutils.MultiTable{M: map[string][]string{"a": {"2"}, "b": {"3", "4"}, "empty": {"5"}}}},
+	}}
+
+	test := func(key, expected string, expectedOk bool, expectedMulti []string) {
+		t.Helper()
+		val, ok, err := f.Lookup(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != expected || ok != expectedOk {
+			t.Errorf("Lookup %q: expected (%q, %v), got (%q, %v)", key, expected, expectedOk, val, ok)
+		}
+		vals, err := f.LookupMulti(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vals, expectedMulti) {
+			t.Errorf("LookupMulti %q: expected %v, got %v", key, expectedMulti, vals)
+		}
+	}
+
+	test("a", "1", true, []string{"1"})
+	test("b", "3", true, []string{"3", "4"})
+	test("empty", "5", true, []string{""})
+	test("c", "", false, nil)
+}
@@ -21,8 +21,14 @@ package target
 import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/msgtrace"
 )
 
+// DeliveryLogger returns the logger to use for messages related to the
+// specific message.
+//
+// Debug messages are written and saved to the message trace if
+// msgMeta.Trace is set, even if it is set after the logger is created.
 func DeliveryLogger(l log.Logger, msgMeta *module.MsgMetadata) log.Logger {
 	fields := make(map[string]interface{}, len(l.Fields)+1)
 	for k, v := range l.Fields {
@@ -30,5 +36,9 @@ func DeliveryLogger(l log.Logger, msgMeta *module.MsgMetadata) log.Logger {
 	}
 	fields["msg_id"] = msgMeta.ID
 	l.Fields = fields
+	l.Out = msgtrace.Output(l.Out, msgMeta)
+	if !l.Debug {
+		l.DebugFunc = func() bool { return msgMeta.Trace }
+	}
 	return l
 }
@@ -0,0 +1,82 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"strconv"
+
+	"github.com/foxcpp/maddy/framework/hooks"
+)
+
+// msgAdded should be called when the message is added to the queue (including
+// messages loaded from disk on start-up).
+func (q *Queue) msgAdded() {
+	q.lengthLck.Lock()
+	defer q.lengthLck.Unlock()
+
+	q.length++
+	q.lengthChanged()
+}
+
+// msgRemoved should be called when the message leaves the queue.
+func (q *Queue) msgRemoved() {
+	q.lengthLck.Lock()
+	defer q.lengthLck.Unlock()
+
+	if q.length > 0 {
+		q.length--
+	}
+	q.lengthChanged()
+}
+
+// lengthChanged updates metrics and sends backlog notifications.
+//
+// The queue enters the backlog state when the amount of messages reaches
+// backlogThreshold and leaves it when it drops to the half of the threshold so
+// notifications are not sent for every message if the length fluctuates
+// around the threshold.
+//
+// lengthLck should be held.
+func (q *Queue) lengthChanged() {
+	queuedMsgs.WithLabelValues(q.name, q.location).Set(float64(q.length))
+
+	if q.backlogThreshold <= 0 {
+		return
+	}
+
+	var event string
+	switch {
+	case !q.inBacklog && q.length >= q.backlogThreshold:
+		q.inBacklog = true
+		event = hooks.NotifyBacklogEnter
+		q.Log.Msg("queue is backlogged", "length", q.length, "threshold", q.backlogThreshold)
+	case q.inBacklog && q.length <= q.backlogThreshold/2:
+		q.inBacklog = false
+		event = hooks.NotifyBacklogLeave
+		q.Log.Msg("queue is no longer backlogged", "length", q.length, "threshold", q.backlogThreshold)
+	default:
+		return
+	}
+
+	hooks.Notify(event, map[string]string{
+		"module":    q.name,
+		"length":    strconv.Itoa(q.length),
+		"threshold": strconv.Itoa(q.backlogThreshold),
+	})
+}
@@ -0,0 +1,70 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestQueueBacklog(t *testing.T) {
+	var (
+		events    []string
+		eventsLck sync.Mutex
+	)
+	hooks.AddNotifyHandler(func(name string, params map[string]string) {
+		if params["module"] != "backlog_test" {
+			return
+		}
+		eventsLck.Lock()
+		defer eventsLck.Unlock()
+		events = append(events, name+" "+params["length"])
+	})
+
+	q := &Queue{
+		name:             "backlog_test",
+		backlogThreshold: 4,
+		Log:              testutils.Logger(t, "queue"),
+	}
+
+	for i := 0; i < 5; i++ {
+		q.msgAdded()
+	}
+	// Should not leave the backlog state until the length drops to 2.
+	q.msgRemoved()
+	q.msgRemoved()
+	q.msgAdded()
+	q.msgRemoved()
+	q.msgRemoved()
+	q.msgRemoved()
+
+	eventsLck.Lock()
+	defer eventsLck.Unlock()
+	expected := []string{
+		hooks.NotifyBacklogEnter + " 4",
+		hooks.NotifyBacklogLeave + " 2",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Wrong events: %v", events)
+	}
+}
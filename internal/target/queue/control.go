@@ -0,0 +1,64 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/foxcpp/maddy/internal/control"
+)
+
+// activeList returns active queue instances sorted by location. If name is
+// not empty, only instances with that name are returned.
+func activeList(name string) []*Queue {
+	activeQueuesLck.Lock()
+	defer activeQueuesLck.Unlock()
+
+	res := make([]*Queue, 0, len(activeQueues))
+	for _, q := range activeQueues {
+		if name != "" && q.name != name {
+			continue
+		}
+		res = append(res, q)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].location < res[j].location
+	})
+	return res
+}
+
+// cancelActive cancels the delivery of the message using the active queue
+// instance that contains it.
+func cancelActive(name, id string) (CancelResult, error) {
+	for _, q := range activeList(name) {
+		res, err := q.Cancel(id)
+		if errors.Is(err, ErrNoSuchMessage) {
+			continue
+		}
+		return res, err
+	}
+	return CancelResult{}, ErrNoSuchMessage
+}
+
+func init() {
+	control.Handle("queue.cancel", func(args map[string]string) (interface{}, error) {
+		return cancelActive(args["name"], args["id"])
+	})
+}
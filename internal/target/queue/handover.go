@@ -0,0 +1,93 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import "sync"
+
+// When the configuration is reloaded, the new queue instance can be
+// initialized while the old one is still used by endpoints that complete
+// active sessions. Both instances use the same directory so messages should
+// be handed over to the new instance without duplicate deliveries.
+//
+// The new instance waits for deliveries started by the old instance to
+// complete and loads all messages from disk. Messages stored by the old
+// instance after that are scheduled using the new instance.
+
+var (
+	activeQueues    = map[string]*Queue{}
+	activeQueuesLck sync.Mutex
+)
+
+// takeOver makes q responsible for messages of the currently active
+// instance using the same location (if any) and loads messages from disk.
+func (q *Queue) takeOver() error {
+	activeQueuesLck.Lock()
+	defer activeQueuesLck.Unlock()
+
+	prev := activeQueues[q.location]
+	if prev == nil {
+		if err := q.readDiskQueue(); err != nil {
+			return err
+		}
+		activeQueues[q.location] = q
+		return nil
+	}
+
+	prev.handoverLck.Lock()
+	defer prev.handoverLck.Unlock()
+
+	q.Log.Msg("waiting for deliveries started by the previous instance to complete")
+	prev.wheel.Close()
+	prev.deliveryWg.Wait()
+
+	if err := q.readDiskQueue(); err != nil {
+		// The previous instance cannot be restarted since its wheel is
+		// stopped. Messages stay on disk and will be loaded on the next
+		// start.
+		return err
+	}
+
+	prev.successor = q
+	activeQueues[q.location] = q
+	return nil
+}
+
+// release removes q from the list of active instances.
+func (q *Queue) release() {
+	activeQueuesLck.Lock()
+	defer activeQueuesLck.Unlock()
+
+	if activeQueues[q.location] == q {
+		delete(activeQueues, q.location)
+	}
+}
+
+// lockActive returns the instance responsible for new messages with its
+// handoverLck locked for reading.
+func (q *Queue) lockActive() *Queue {
+	for {
+		q.handoverLck.RLock()
+		if q.successor == nil {
+			return q
+		}
+		next := q.successor
+		q.handoverLck.RUnlock()
+		q = next
+	}
+}
@@ -0,0 +1,76 @@
+package queue
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func startTestDelivery(t *testing.T, q *Queue, id string) module.Delivery {
+	t.Helper()
+
+	ctx := context.Background()
+	delivery, err := q.Start(ctx, &module.MsgMetadata{ID: id, DontTraceSender: true}, "tester@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(ctx, "tester1@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	hdr := textproto.Header{}
+	hdr.Add("A", "1")
+	if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}); err != nil {
+		t.Fatal(err)
+	}
+	return delivery
+}
+
+func TestQueueTakeOver(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q1 := newTestQueue(t, &dt)
+	defer cleanQueue(t, q1)
+
+	// Stored before the new instance is started but committed after that.
+	beforeTakeOver := startTestDelivery(t, q1, "before")
+
+	q2 := newTestQueueDir(t, &dt, q1.location)
+	defer cleanQueue(t, q2)
+
+	if err := beforeTakeOver.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delivery started using the old instance after the new one is started.
+	afterTakeOver := startTestDelivery(t, q1, "after")
+	if err := afterTakeOver.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	delivered := map[string]int{}
+	for i := 0; i < 2; i++ {
+		msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+		// The queue appends a suffix to the message ID.
+		delivered[strings.SplitN(msg.MsgMeta.ID, "-", 2)[0]]++
+	}
+	select {
+	case msg := <-dt.committed:
+		t.Fatal("Unexpected duplicate delivery:", msg.MsgMeta.ID)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if delivered["before"] != 1 || delivered["after"] != 1 {
+		t.Fatal("Wrong deliveries:", delivered)
+	}
+
+	q1.Close()
+	q2.Close()
+	checkQueueDir(t, q2, []string{})
+}
@@ -0,0 +1,227 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNoSuchMessage is returned by Message if there is no message with the
+// specified ID in the queue.
+var ErrNoSuchMessage = errors.New("queue: no such message")
+
+// ErrDeliveryInProgress is returned by Cancel if the delivery attempt for
+// the message is in progress. The outcome is not known yet, the caller may
+// retry once the attempt completes.
+var ErrDeliveryInProgress = errors.New("queue: delivery attempt in progress")
+
+// MessageInfo is the summary of a message waiting in the queue.
+type MessageInfo struct {
+	ID    string
+	From  string
+	Class string
+
+	// Recipients the delivery will be retried for.
+	To []string
+
+	// Size of the stored header and body in bytes.
+	Size int64
+
+	FirstAttempt time.Time
+	LastAttempt  time.Time
+
+	// Amount of attempts made for each recipient.
+	Tries map[string]int
+
+	// Last error reported for each failed recipient.
+	Errors map[string]string
+}
+
+// Messages returns the list of messages currently stored in the queue,
+// sorted by the time of the first delivery attempt.
+//
+// Messages that are concurrently removed or have corrupted meta-data are
+// skipped.
+func (q *Queue) Messages() ([]MessageInfo, error) {
+	metas, err := q.store.Messages()
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]MessageInfo, 0, len(metas))
+	for _, meta := range metas {
+		info, err := q.messageInfo(meta)
+		if err != nil {
+			if !errors.Is(err, ErrNoSuchMessage) {
+				q.Log.Error("failed to read message", err, "msg_id", meta.MsgMeta.ID)
+			}
+			continue
+		}
+		msgs = append(msgs, info)
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].FirstAttempt.Before(msgs[j].FirstAttempt)
+	})
+
+	return msgs, nil
+}
+
+func validID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\`) && !strings.HasPrefix(id, ".")
+}
+
+// Message returns the summary for the queued message with the specified ID.
+func (q *Queue) Message(id string) (MessageInfo, error) {
+	if !validID(id) {
+		return MessageInfo{}, ErrNoSuchMessage
+	}
+
+	meta, err := q.store.ReadMeta(id)
+	if err != nil {
+		return MessageInfo{}, err
+	}
+	return q.messageInfo(meta)
+}
+
+func (q *Queue) messageInfo(meta *QueueMetadata) (MessageInfo, error) {
+	id := meta.MsgMeta.ID
+	info := MessageInfo{
+		ID:           id,
+		From:         meta.From,
+		Class:        meta.Class,
+		To:           meta.To,
+		FirstAttempt: meta.FirstAttempt,
+		LastAttempt:  meta.LastAttempt,
+		Tries:        meta.TriesCount,
+		Errors:       make(map[string]string, len(meta.RcptErrs)),
+	}
+	for rcpt, rcptErr := range meta.RcptErrs {
+		info.Errors[rcpt] = rcptErr.Error()
+	}
+	size, err := q.store.Size(id)
+	if err != nil {
+		return MessageInfo{}, err
+	}
+	info.Size = size
+
+	return info, nil
+}
+
+// CancelResult describes the state of the message at the moment it was
+// removed from the queue by Cancel.
+type CancelResult struct {
+	ID string `json:"id"`
+
+	// Recipients that already received the message. Cancellation does not
+	// affect them.
+	Delivered []string `json:"delivered"`
+
+	// Recipients the delivery failed for permanently, DSN was already sent
+	// for them.
+	Failed []string `json:"failed"`
+
+	// Recipients that will not receive the message.
+	Cancelled []string `json:"cancelled"`
+}
+
+// Cancel removes the message with the specified ID from the queue so no
+// further delivery attempts are made.
+//
+// ErrDeliveryInProgress is returned if the delivery attempt is running at
+// the moment, no changes are made in this case.
+func (q *Queue) Cancel(id string) (CancelResult, error) {
+	if !validID(id) {
+		return CancelResult{}, ErrNoSuchMessage
+	}
+
+	q = q.lockActive()
+	defer q.handoverLck.RUnlock()
+
+	q.dispatchLck.Lock()
+	defer q.dispatchLck.Unlock()
+
+	if _, ok := q.dispatching[id]; ok {
+		return CancelResult{}, ErrDeliveryInProgress
+	}
+
+	meta, err := q.store.ReadMeta(id)
+	if err != nil {
+		return CancelResult{}, err
+	}
+
+	res := CancelResult{
+		ID:        id,
+		Cancelled: meta.To,
+	}
+	pending := make(map[string]bool, len(meta.To))
+	for _, rcpt := range meta.To {
+		pending[rcpt] = true
+	}
+	for rcpt := range meta.Delivered {
+		res.Delivered = append(res.Delivered, rcpt)
+	}
+	for rcpt := range meta.RcptErrs {
+		if _, delivered := meta.Delivered[rcpt]; !delivered && !pending[rcpt] {
+			res.Failed = append(res.Failed, rcpt)
+		}
+	}
+	sort.Strings(res.Delivered)
+	sort.Strings(res.Failed)
+
+	q.removeFromDisk(meta.MsgMeta)
+	q.msgRemoved()
+	removed := q.wheel.Remove(func(value interface{}) bool {
+		slot, ok := value.(queueSlot)
+		return ok && slot.ID == id
+	})
+	if removed == 0 {
+		// The slot was already taken from the time wheel but the
+		// delivery is not started yet, see startDispatch.
+		q.cancelled[id] = struct{}{}
+	}
+
+	q.Log.Msg("delivery cancelled", "msg_id", id, "rcpts", res.Cancelled, "delivered_rcpts", res.Delivered)
+
+	return res, nil
+}
+
+// startDispatch marks the message as being delivered. false is returned if
+// the message was cancelled and should be skipped.
+func (q *Queue) startDispatch(id string) bool {
+	q.dispatchLck.Lock()
+	defer q.dispatchLck.Unlock()
+
+	if _, ok := q.cancelled[id]; ok {
+		delete(q.cancelled, id)
+		return false
+	}
+	q.dispatching[id] = struct{}{}
+	return true
+}
+
+func (q *Queue) endDispatch(id string) {
+	q.dispatchLck.Lock()
+	defer q.dispatchLck.Unlock()
+
+	delete(q.dispatching, id)
+}
@@ -0,0 +1,171 @@
+package queue
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestQueueMessages(t *testing.T) {
+	q := newTestQueue(t, &unreliableTarget{})
+	defer cleanQueue(t, q)
+
+	first := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i, id := range []string{"second", "first"} {
+		hdr := textproto.Header{}
+		hdr.Add("Subject", "test")
+		meta := &QueueMetadata{
+			MsgMeta:      &module.MsgMetadata{ID: id},
+			From:         "sender@example.org",
+			To:           []string{"rcpt@example.org"},
+			FirstAttempt: first.Add(time.Duration(1-i) * time.Minute),
+			LastAttempt:  first.Add(time.Duration(1-i) * time.Minute),
+			TriesCount:   map[string]int{"rcpt@example.org": 2},
+			RcptErrs: map[string]*smtp.SMTPError{
+				"rcpt@example.org": {
+					Code:         451,
+					EnhancedCode: smtp.EnhancedCode{4, 0, 0},
+					Message:      "try again later",
+				},
+			},
+		}
+		if _, err := q.store.Create(meta, hdr, buffer.MemoryBuffer{Slice: []byte("body")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs, err := q.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	if msgs[0].ID != "first" || msgs[1].ID != "second" {
+		t.Errorf("wrong order: %s, %s", msgs[0].ID, msgs[1].ID)
+	}
+	msg := msgs[0]
+	if msg.From != "sender@example.org" || len(msg.To) != 1 || msg.To[0] != "rcpt@example.org" {
+		t.Errorf("wrong envelope: %v -> %v", msg.From, msg.To)
+	}
+	if msg.Tries["rcpt@example.org"] != 2 {
+		t.Errorf("wrong tries count: %v", msg.Tries)
+	}
+	if msg.Errors["rcpt@example.org"] == "" {
+		t.Errorf("missing recipient error")
+	}
+	if msg.Size == 0 {
+		t.Errorf("zero size")
+	}
+
+	for _, id := range []string{"missing", "../first", ""} {
+		if _, err := q.Message(id); !errors.Is(err, ErrNoSuchMessage) {
+			t.Errorf("Message(%q): expected ErrNoSuchMessage, got %v", id, err)
+		}
+	}
+}
+
+func TestQueueCancel(t *testing.T) {
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+
+	meta := &QueueMetadata{
+		MsgMeta:      &module.MsgMetadata{ID: "msg"},
+		From:         "sender@example.org",
+		To:           []string{"pending@example.org"},
+		FirstAttempt: time.Now(),
+		LastAttempt:  time.Now(),
+		RcptErrs: map[string]*smtp.SMTPError{
+			"pending@example.org": {Code: 451, EnhancedCode: smtp.EnhancedCode{4, 0, 0}, Message: "try again later"},
+			"failed@example.org":  {Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "no such user"},
+		},
+		Delivered: map[string]module.DeliveryInfo{
+			"delivered@example.org": {},
+		},
+	}
+	if _, err := q.store.Create(meta, textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("body")}); err != nil {
+		t.Fatal(err)
+	}
+	q.msgAdded()
+	q.wheel.Add(time.Now().Add(100*time.Millisecond), queueSlot{ID: "msg"})
+
+	q.startDispatch("msg")
+	if _, err := q.Cancel("msg"); !errors.Is(err, ErrDeliveryInProgress) {
+		t.Fatalf("expected ErrDeliveryInProgress, got %v", err)
+	}
+	q.endDispatch("msg")
+
+	res, err := q.Cancel("msg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := CancelResult{
+		ID:        "msg",
+		Delivered: []string{"delivered@example.org"},
+		Failed:    []string{"failed@example.org"},
+		Cancelled: []string{"pending@example.org"},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("wrong result:\n%+v\nexpected:\n%+v", res, expected)
+	}
+	checkQueueDir(t, q, []string{})
+
+	if _, err := q.Cancel("msg"); !errors.Is(err, ErrNoSuchMessage) {
+		t.Errorf("expected ErrNoSuchMessage for the second Cancel, got %v", err)
+	}
+
+	// The scheduled attempt should be skipped.
+	select {
+	case msg := <-dt.committed:
+		t.Fatalf("cancelled message was delivered: %+v", msg)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	q.dispatchLck.Lock()
+	defer q.dispatchLck.Unlock()
+	if len(q.cancelled) != 0 {
+		t.Errorf("cancelled IDs are not cleaned up: %v", q.cancelled)
+	}
+}
+
+func TestQueueCancel_Active(t *testing.T) {
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+
+	meta := &QueueMetadata{
+		MsgMeta:      &module.MsgMetadata{ID: "cancel-active"},
+		From:         "sender@example.org",
+		To:           []string{"rcpt@example.org"},
+		FirstAttempt: time.Now(),
+		LastAttempt:  time.Now(),
+	}
+	if _, err := q.store.Create(meta, textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("body")}); err != nil {
+		t.Fatal(err)
+	}
+	q.msgAdded()
+	q.wheel.Add(time.Now().Add(time.Hour), queueSlot{ID: "cancel-active"})
+
+	if _, err := cancelActive("", "missing"); !errors.Is(err, ErrNoSuchMessage) {
+		t.Errorf("expected ErrNoSuchMessage, got %v", err)
+	}
+	if _, err := cancelActive("other", "cancel-active"); !errors.Is(err, ErrNoSuchMessage) {
+		t.Errorf("expected ErrNoSuchMessage for other queue name, got %v", err)
+	}
+	res, err := cancelActive("", "cancel-active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Cancelled, []string{"rcpt@example.org"}) {
+		t.Errorf("wrong cancelled recipients: %v", res.Cancelled)
+	}
+	checkQueueDir(t, q, []string{})
+}
@@ -27,7 +27,7 @@ Interfaces implemented:
 Implementation summary follows.
 
 All scheduled deliveries are attempted to the configured DeliveryTarget.
-All metadata is preserved on disk.
+All metadata is preserved in the persistent storage (see Store).
 
 Failure status is determined on per-recipient basis:
   - Delivery.Start fail handled as a failure for all recipients.
@@ -49,24 +49,26 @@ Last error for each recipient is saved for reporting in NDN. A NDN is generated
 if there are any failed recipients left after
 last attempt to deliver the message.
 
+If delay warnings are enabled, a DSN with "delayed" action is generated once
+for the recipients that are still retried after the configured delay.
+
 Amount of attempts for each message is limited to a certain configured number.
 After last attempt, all recipients that are still temporary failing are assumed
-to be permanently failed.
+to be permanently failed. The same happens if the message stays in the queue
+longer than the maximum lifetime configured for its class (see messageClass).
 */
 package queue
 
 import (
-	"bufio"
 	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"net"
 	"os"
 	"path/filepath"
-	"runtime"
 	"runtime/debug"
 	"runtime/trace"
 	"strconv"
@@ -76,6 +78,7 @@ import (
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
@@ -83,7 +86,9 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/dsn"
+	"github.com/foxcpp/maddy/internal/limits"
 	"github.com/foxcpp/maddy/internal/msgpipeline"
+	"github.com/foxcpp/maddy/internal/storagepath"
 	"github.com/foxcpp/maddy/internal/target"
 )
 
@@ -93,6 +98,9 @@ type partialError struct {
 	// Underlying error objects for each recipient.
 	Errs map[string]error
 
+	// Information about successful deliveries, if reported by the target.
+	Infos map[string]module.DeliveryInfo
+
 	// Fields can be accessed without holding this lock, but only after
 	// target.BodyNonAtomic/Body returns.
 	statusLock *sync.Mutex
@@ -110,6 +118,13 @@ func (pe *partialError) SetStatus(rcptTo string, err error) {
 	pe.Errs[rcptTo] = err
 }
 
+// SetDeliveryInfo implements module.DeliveryInfoCollector.
+func (pe *partialError) SetDeliveryInfo(rcptTo string, info module.DeliveryInfo) {
+	pe.statusLock.Lock()
+	defer pe.statusLock.Unlock()
+	pe.Infos[rcptTo] = info
+}
+
 func (pe partialError) Error() string {
 	return fmt.Sprintf("delivery failed for some recipients: %v", pe.Errs)
 }
@@ -121,11 +136,26 @@ var dontRecover = false
 type Queue struct {
 	name             string
 	location         string
+	quota            *storagepath.Quota
+	store            Store
 	hostname         string
 	autogenMsgDomain string
 	wheel            *TimeWheel
 
-	dsnPipeline module.DeliveryTarget
+	dsnPipeline  module.DeliveryTarget
+	dsnTemplates *dsn.Templates
+	// DSNs are not sent for messages with sender verification results
+	// listed here, see module.MsgMetadata.SenderAuth.
+	dsnSuppress map[module.SenderAuth]bool
+
+	// Quotas checked for new messages, see limits.Group.CheckQuota.
+	limits *limits.Group
+
+	// Checks executed on each delivery attempt, so decisions are made using
+	// the latest data even if the message spent a lot of time in the queue.
+	dispatchChecks []module.Check
+	// Target wrapped to run dispatchChecks, set in start.
+	checkedTarget module.DeliveryTarget
 
 	// Retry delay is calculated using the following formula:
 	// initialRetryTime * retryTimeScale ^ (TriesCount - 1)
@@ -134,6 +164,16 @@ type Queue struct {
 	retryTimeScale   float64
 	maxTries         int
 
+	// Maximum time messages are kept in the queue, zero means no limit.
+	maxLifetime     time.Duration
+	maxLifetimeBulk time.Duration
+	maxLifetimeDSN  time.Duration
+
+	// If the message is still retried after delayWarning since the first
+	// attempt, a DSN is generated to let the sender know. Zero disables
+	// these warnings.
+	delayWarning time.Duration
+
 	// If any delivery is scheduled in less than postInitDelay
 	// after Init, its delay will be increased by postInitDelay.
 	//
@@ -149,10 +189,29 @@ type Queue struct {
 	Log    log.Logger
 	Target module.DeliveryTarget
 
+	// Amount of messages in the queue and whether it is considered
+	// backlogged (see lengthChanged).
+	lengthLck        sync.Mutex
+	length           int
+	backlogThreshold int
+	inBacklog        bool
+
 	deliveryWg sync.WaitGroup
 	// Buffered channel used to restrict count of deliveries attempted
 	// in parallel.
 	deliverySemaphore chan struct{}
+
+	// Set once another instance took over the queue directory, see
+	// takeOver.
+	handoverLck sync.RWMutex
+	successor   *Queue
+
+	// IDs of messages with delivery attempts in progress and messages
+	// cancelled after leaving the time wheel but before the delivery
+	// attempt is started, see Cancel.
+	dispatchLck sync.Mutex
+	dispatching map[string]struct{}
+	cancelled   map[string]struct{}
 }
 
 type QueueMetadata struct {
@@ -176,6 +235,20 @@ type QueueMetadata struct {
 
 	FirstAttempt time.Time
 	LastAttempt  time.Time
+
+	// Whether the DSN about delayed delivery was already sent.
+	DelayWarningSent bool
+
+	// Recipients that already received the message and how it was
+	// delivered to them, if reported by the target.
+	Delivered map[string]module.DeliveryInfo `json:",omitempty"`
+
+	// Message class, see messageClass.
+	Class string
+
+	// RCPT TO arguments for recipients that specified them, notably DSN
+	// parameters (RFC 3461).
+	RcptOpts map[string]smtp.RcptOptions `json:",omitempty"`
 }
 
 type queueSlot struct {
@@ -194,7 +267,10 @@ func NewQueue(_, instName string, _, inlineArgs []string) (module.Module, error)
 		initialRetryTime: 15 * time.Minute,
 		retryTimeScale:   1.25,
 		postInitDelay:    10 * time.Second,
+		limits:           &limits.Group{},
 		Log:              log.Logger{Name: "queue"},
+		dispatching:      map[string]struct{}{},
+		cancelled:        map[string]struct{}{},
 	}
 	switch len(inlineArgs) {
 	case 0:
@@ -208,21 +284,67 @@ func NewQueue(_, instName string, _, inlineArgs []string) (module.Module, error)
 }
 
 func (q *Queue) Init(cfg *config.Map) error {
-	var maxParallelism int
+	var (
+		maxParallelism int
+		dsnSuppress    string
+		storeArgs      []string
+	)
 	cfg.Bool("debug", true, false, &q.Log.Debug)
 	cfg.Int("max_tries", false, false, 20, &q.maxTries)
 	cfg.Int("max_parallelism", false, false, 16, &maxParallelism)
 	cfg.String("location", false, false, q.location, &q.location)
+	cfg.StringList("storage", false, false, []string{"fs"}, &storeArgs)
+	cfg.Int("backlog_threshold", false, false, 0, &q.backlogThreshold)
+	cfg.Duration("delay_warning", false, false, 0, &q.delayWarning)
+	cfg.Duration("max_lifetime", false, false, 0, &q.maxLifetime)
+	// -1 is used to distinguish the missing directive from zero.
+	cfg.Duration("max_lifetime_bulk", false, false, -1, &q.maxLifetimeBulk)
+	cfg.Duration("max_lifetime_dsn", false, false, -1, &q.maxLifetimeDSN)
 	cfg.Custom("target", false, true, nil, modconfig.DeliveryDirective, &q.Target)
 	cfg.String("hostname", true, true, "", &q.hostname)
 	cfg.String("autogenerated_msg_domain", true, false, "", &q.autogenMsgDomain)
 	cfg.Custom("bounce", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
 		return msgpipeline.New(m.Globals, node.Children)
 	}, &q.dsnPipeline)
+	cfg.Custom("dsn_templates", false, false, nil, func(_ *config.Map, node config.Node) (interface{}, error) {
+		if len(node.Args) != 1 {
+			return nil, config.NodeErr(node, "expected exactly one argument")
+		}
+		templates, err := dsn.LoadTemplates(node.Args[0])
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		return templates, nil
+	}, &q.dsnTemplates)
+	cfg.Enum("dsn_suppress", false, false, []string{"off", "forged", "unverified"}, "forged", &dsnSuppress)
+	cfg.Custom("limits", false, false, func() (interface{}, error) {
+		return &limits.Group{}, nil
+	}, func(cfg *config.Map, n config.Node) (interface{}, error) {
+		var g *limits.Group
+		if err := modconfig.GroupFromNode("limits", n.Args, n, cfg.Globals, &g); err != nil {
+			return nil, err
+		}
+		return g, nil
+	}, &q.limits)
+	cfg.Custom("check", false, false, nil, msgpipeline.ChecksDirective, &q.dispatchChecks)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
+	switch dsnSuppress {
+	case "forged":
+		q.dsnSuppress = map[module.SenderAuth]bool{module.SenderAuthFail: true}
+	case "unverified":
+		q.dsnSuppress = map[module.SenderAuth]bool{module.SenderAuthFail: true, module.SenderAuthUnknown: true}
+	}
+
+	if q.maxLifetimeBulk < 0 {
+		q.maxLifetimeBulk = q.maxLifetime
+	}
+	if q.maxLifetimeDSN < 0 {
+		q.maxLifetimeDSN = q.maxLifetime
+	}
+
 	if q.dsnPipeline != nil {
 		if q.autogenMsgDomain == "" {
 			return errors.New("queue: autogenerated_msg_domain is required if bounce {} is specified")
@@ -231,11 +353,46 @@ func (q *Queue) Init(cfg *config.Map) error {
 		q.dsnPipeline.(*msgpipeline.MsgPipeline).Hostname = q.hostname
 		q.dsnPipeline.(*msgpipeline.MsgPipeline).Log = log.Logger{Name: "queue/pipeline", Debug: q.Log.Debug}
 	}
+	if len(storeArgs) == 0 {
+		return errors.New("queue: storage type is required")
+	}
+	switch storeArgs[0] {
+	case "fs":
+		if len(storeArgs) != 1 {
+			return errors.New("queue: storage fs: unexpected arguments")
+		}
+	case "sql":
+		if len(storeArgs) < 3 {
+			return errors.New("queue: storage sql: driver and DSN are required")
+		}
+		if q.name == "" {
+			return errors.New("queue: storage sql: can't be used for inline definitions")
+		}
+		store, err := newSQLStore(storeArgs[1], strings.Join(storeArgs[2:], " "), q.name, q.Log)
+		if err != nil {
+			return fmt.Errorf("queue: storage sql: %w", err)
+		}
+		q.store = store
+		// Used to identify the queue across reloads, see takeOver.
+		q.location = "sql:" + storeArgs[1] + "/" + q.name
+		return q.start(maxParallelism)
+	default:
+		return fmt.Errorf("queue: unknown storage type: %s", storeArgs[0])
+	}
+
 	if q.location == "" && q.name == "" {
 		return errors.New("queue: need explicit location directive or inline argument if defined inline")
 	}
 	if q.location == "" {
 		q.location = filepath.Join(config.StateDirectory, q.name)
+		if dir := storagepath.Dir(storagepath.Queue, ""); dir != "" {
+			oldLocation := q.location
+			q.location = filepath.Join(dir, q.name)
+			q.quota = storagepath.QuotaFor(storagepath.Queue)
+			if err := q.migrateLocation(oldLocation); err != nil {
+				return err
+			}
+		}
 	}
 
 	// TODO: Check location write permissions.
@@ -246,11 +403,49 @@ func (q *Queue) Init(cfg *config.Map) error {
 	return q.start(maxParallelism)
 }
 
+// migrateLocation moves messages from the old queue directory if it was
+// changed using storage_paths.
+func (q *Queue) migrateLocation(oldLocation string) error {
+	if oldLocation == q.location {
+		return nil
+	}
+	if _, err := os.Stat(oldLocation); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	moved, err := storagepath.MoveDir(oldLocation, q.location)
+	if err != nil {
+		return fmt.Errorf("queue: failed to move messages to the new location: %w", err)
+	}
+	if moved != 0 {
+		q.Log.Msg("moved queue files to the new location", "old", oldLocation, "new", q.location, "files", moved)
+	}
+	// Fails if there are files left, e.g. ones that already exist in the
+	// new location.
+	_ = os.Remove(oldLocation)
+	return nil
+}
+
 func (q *Queue) start(maxParallelism int) error {
+	if q.store == nil {
+		q.store = &fsStore{location: q.location, quota: q.quota, log: q.Log}
+	}
+
+	q.checkedTarget = q.Target
+	if len(q.dispatchChecks) != 0 {
+		p := msgpipeline.NewChecked(q.dispatchChecks, q.Target)
+		p.Hostname = q.hostname
+		p.Log = log.Logger{Name: "queue/check", Debug: q.Log.Debug}
+		q.checkedTarget = p
+	}
+
 	q.wheel = NewTimeWheel(q.dispatch)
 	q.deliverySemaphore = make(chan struct{}, maxParallelism)
 
-	if err := q.readDiskQueue(); err != nil {
+	if err := q.takeOver(); err != nil {
 		return err
 	}
 
@@ -260,22 +455,18 @@ func (q *Queue) start(maxParallelism int) error {
 }
 
 func (q *Queue) Close() error {
+	q.release()
 	q.wheel.Close()
 	q.deliveryWg.Wait()
 
-	return nil
+	return q.store.Close()
 }
 
-// discardBroken changes the name of metadata file to have .meta_broken
-// extension.
-//
-// Further attempts to deliver (due to a timewheel) it will fail due to
-// non-existent meta-data file.
+// discardBroken excludes the message from further delivery attempts.
 //
 // No error handling is done since this function is called from panic handler.
 func (q *Queue) discardBroken(id string) {
-	err := os.Rename(filepath.Join(q.location, id+".meta"), filepath.Join(q.location, id+".meta_broken"))
-	if err != nil {
+	if err := q.store.MarkBroken(id); err != nil {
 		// Note: Global logger is used in case there is something wrong with Queue.Log.
 		log.Printf("can't mark the queue message as broken: %v", err)
 	}
@@ -302,10 +493,17 @@ func (q *Queue) dispatch(value TimeSlot) {
 				stack := debug.Stack()
 				log.Printf("panic during queue dispatch %s: %v\n%s", slot.ID, err, stack)
 				q.discardBroken(slot.ID)
+				q.msgRemoved()
 			}
 		}()
 
 		q.Log.Debugln("delivery semaphore acquired for", slot.ID)
+		if !q.startDispatch(slot.ID) {
+			q.Log.Debugln("delivery cancelled for", slot.ID)
+			return
+		}
+		defer q.endDispatch(slot.ID)
+
 		var (
 			meta *QueueMetadata
 			hdr  textproto.Header
@@ -313,9 +511,10 @@ func (q *Queue) dispatch(value TimeSlot) {
 		)
 		if slot.Meta == nil {
 			var err error
-			meta, hdr, body, err = q.openMessage(slot.ID)
+			meta, hdr, body, err = q.store.Open(slot.ID)
 			if err != nil {
 				q.Log.Error("read message", err, slot.ID)
+				q.msgRemoved()
 				return
 			}
 			if meta == nil {
@@ -331,6 +530,24 @@ func (q *Queue) dispatch(value TimeSlot) {
 	}()
 }
 
+// withErrorID attaches the error ID to errors that will be reported in DSN
+// using the generic text so it can be matched with the log message.
+func withErrorID(err error) error {
+	if exterrors.IDOf(err) != "" {
+		return err
+	}
+	if _, ok := exterrors.Fields(err)["smtp_msg"]; ok {
+		return err
+	}
+	if _, ok := err.(*smtp.SMTPError); ok {
+		return err
+	}
+	if tErr := exterrors.Translate(err); tErr != nil {
+		return tErr
+	}
+	return exterrors.WithID(err, exterrors.IDQueueInternal)
+}
+
 func toSMTPErr(err error) *smtp.SMTPError {
 	if err == nil {
 		return nil
@@ -352,9 +569,9 @@ func toSMTPErr(err error) *smtp.SMTPError {
 	if ok {
 		res.Code = ctxCode
 	}
-	ctxEnchCode, ok := ctxInfo["smtp_enchcode"].(smtp.EnhancedCode)
+	ctxEnchCode, ok := ctxInfo["smtp_enchcode"].(exterrors.EnhancedCode)
 	if ok {
-		res.EnhancedCode = ctxEnchCode
+		res.EnhancedCode = smtp.EnhancedCode(ctxEnchCode)
 	}
 	ctxMsg, ok := ctxInfo["smtp_msg"].(string)
 	if ok {
@@ -368,6 +585,10 @@ func toSMTPErr(err error) *smtp.SMTPError {
 		res.Message = smtpErr.Message
 	}
 
+	if id := exterrors.IDOf(err); id != "" {
+		res.Message += " " + exterrors.ReplySuffix(id)
+	}
+
 	return res
 }
 
@@ -381,6 +602,8 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	// and use it to calculate the delay for the next attempt.
 	smallestTriesCount := 999999
 
+	expired := q.expired(meta)
+
 	if meta.TriesCount == nil {
 		meta.TriesCount = make(map[string]int)
 	}
@@ -390,14 +613,34 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	// and recipients DSN will be generated for.
 	newRcpts := make([]string, 0, len(partialErr.Errs))
 	failedRcpts := make([]string, 0, len(partialErr.Errs))
+	// Recipients that requested a DSN on success (NOTIFY=SUCCESS) and the
+	// target did not pass the request further.
+	var deliveredRcpts, relayedRcpts []string
 	for _, rcpt := range meta.To {
 		rcptErr, ok := partialErr.Errs[rcpt]
 		if !ok {
-			dl.Msg("delivered", "rcpt", rcpt, "attempt", meta.TriesCount[rcpt]+1)
+			fields := []interface{}{"rcpt", rcpt, "attempt", meta.TriesCount[rcpt] + 1}
+			if meta.Delivered == nil {
+				meta.Delivered = make(map[string]module.DeliveryInfo)
+			}
+			info, ok := partialErr.Infos[rcpt]
+			meta.Delivered[rcpt] = info
+			if ok {
+				fields = append(fields, deliveryInfoFields(info)...)
+			}
+			dl.Msg("delivered", fields...)
+			if notifyRequested(meta.RcptOpts[rcpt], smtp.DSNNotifySuccess) && !info.DSNPassed {
+				if info.RemoteServer != "" {
+					relayedRcpts = append(relayedRcpts, rcpt)
+				} else {
+					deliveredRcpts = append(deliveredRcpts, rcpt)
+				}
+			}
 			continue
 		}
 
 		// Save last error (either temporary or permanent) for reporting in the DSN.
+		rcptErr = withErrorID(rcptErr)
 		dl.Error("delivery attempt failed", rcptErr, "rcpt", rcpt)
 		meta.RcptErrs[rcpt] = toSMTPErr(rcptErr)
 
@@ -408,6 +651,12 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 			failedRcpts = append(failedRcpts, rcpt)
 			continue
 		}
+		if expired {
+			delete(meta.TriesCount, rcpt)
+			dl.Msg("not delivered, queue lifetime exceeded", "rcpt", rcpt, "class", meta.Class)
+			failedRcpts = append(failedRcpts, rcpt)
+			continue
+		}
 
 		// Temporary error, increase tries counter and requeue.
 		meta.TriesCount[rcpt]++
@@ -421,18 +670,32 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 
 	// Generate DSN for recipients that failed permanently this time.
 	if len(failedRcpts) != 0 {
-		q.emitDSN(meta, header, failedRcpts)
+		q.emitDSN(meta, header, body, failedRcpts, dsn.ActionFailed)
+	}
+	if len(deliveredRcpts) != 0 {
+		q.emitDSN(meta, header, body, deliveredRcpts, dsn.ActionDelivered)
+	}
+	if len(relayedRcpts) != 0 {
+		q.emitDSN(meta, header, body, relayedRcpts, dsn.ActionRelayed)
 	}
 	// No recipients to try, either all failed or all succeeded.
 	if len(newRcpts) == 0 {
 		q.removeFromDisk(meta.MsgMeta)
+		q.msgRemoved()
 		return
 	}
 
+	// Let the sender know the message is not lost if it takes too long
+	// to deliver it.
+	if q.delayWarning != 0 && !meta.DelayWarningSent && time.Since(meta.FirstAttempt) >= q.delayWarning {
+		q.emitDSN(meta, header, body, newRcpts, dsn.ActionDelayed)
+		meta.DelayWarningSent = true
+	}
+
 	meta.To = newRcpts
 	meta.LastAttempt = time.Now()
 
-	if err := q.updateMetadataOnDisk(meta); err != nil {
+	if err := q.store.UpdateMeta(meta); err != nil {
 		dl.Error("meta-data update", err)
 	}
 
@@ -442,6 +705,7 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	dl.Debugf("delay: %v * %v ^ (%v - 1)", q.initialRetryTime, q.retryTimeScale, smallestTriesCount)
 	scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
 	nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
+	nextTryTime = q.capRetryTime(meta, nextTryTime)
 	dl.Msg("will retry",
 		"attempts_count", meta.TriesCount,
 		"next_try_delay", time.Until(nextTryTime),
@@ -458,10 +722,93 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	})
 }
 
+// deliveryInfoFields returns log fields describing the delivery.
+func deliveryInfoFields(info module.DeliveryInfo) []interface{} {
+	fields := []interface{}{
+		"remote_server", info.RemoteServer,
+		"remote_addr", info.RemoteAddr,
+	}
+	if info.TLSVersion != "" {
+		fields = append(fields, "tls_version", info.TLSVersion, "tls_cipher", info.TLSCipher)
+	}
+	if info.TLSLevel != "" {
+		fields = append(fields, "tls_level", info.TLSLevel)
+	}
+	if info.TLSAuth != "" {
+		fields = append(fields, "tls_auth", info.TLSAuth)
+	}
+	if info.MXLevel != "" {
+		fields = append(fields, "mx_level", info.MXLevel)
+	}
+	return fields
+}
+
+// Message classes, see messageClass.
+const (
+	classTransactional = "transactional"
+	classBulk          = "bulk"
+	classDSN           = "dsn"
+)
+
+// messageClass returns the class of the message used to select the maximum
+// time it is kept in the queue.
+//
+// Messages with null return path are DSNs. Messages marked with the
+// Precedence field or containing mailing list fields (List-Id,
+// List-Unsubscribe) are bulk mail. All other messages are transactional.
+func messageClass(mailFrom string, header textproto.Header) string {
+	if mailFrom == "" {
+		return classDSN
+	}
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return classBulk
+	}
+	if header.Has("List-Id") || header.Has("List-Unsubscribe") {
+		return classBulk
+	}
+	return classTransactional
+}
+
+// maxLifetimeFor returns the maximum time the message can be kept in the
+// queue, zero means no limit.
+func (q *Queue) maxLifetimeFor(meta *QueueMetadata) time.Duration {
+	switch meta.Class {
+	case classBulk:
+		return q.maxLifetimeBulk
+	case classDSN:
+		return q.maxLifetimeDSN
+	default:
+		// Also used for messages queued by older versions.
+		return q.maxLifetime
+	}
+}
+
+// expired reports whether the message is kept in the queue longer than
+// allowed for its class.
+func (q *Queue) expired(meta *QueueMetadata) bool {
+	lifetime := q.maxLifetimeFor(meta)
+	return lifetime != 0 && time.Since(meta.FirstAttempt) >= lifetime
+}
+
+// capRetryTime makes sure the last attempt is done once the message lifetime
+// ends instead of keeping the message in the queue until the next retry.
+func (q *Queue) capRetryTime(meta *QueueMetadata, nextTryTime time.Time) time.Time {
+	lifetime := q.maxLifetimeFor(meta)
+	if lifetime == 0 {
+		return nextTryTime
+	}
+	if deadline := meta.FirstAttempt.Add(lifetime); nextTryTime.After(deadline) {
+		return deadline
+	}
+	return nextTryTime
+}
+
 func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) partialError {
 	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
 	perr := partialError{
 		Errs:       map[string]error{},
+		Infos:      map[string]module.DeliveryInfo{},
 		statusLock: new(sync.Mutex),
 	}
 
@@ -473,7 +820,7 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 	defer msgTask.End()
 
 	mailCtx, mailTask := trace.NewTask(msgCtx, "MAIL FROM")
-	delivery, err := q.Target.Start(mailCtx, msgMeta, meta.From)
+	delivery, err := q.checkedTarget.Start(mailCtx, msgMeta, meta.From)
 	mailTask.End()
 	if err != nil {
 		dl.Debugf("target.Start failed: %v", err)
@@ -487,7 +834,7 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 	var acceptedRcpts []string
 	for _, rcpt := range meta.To {
 		rcptCtx, rcptTask := trace.NewTask(msgCtx, "RCPT TO")
-		if err := delivery.AddRcpt(rcptCtx, rcpt, smtp.RcptOptions{} /* TODO: DSN support */); err != nil {
+		if err := delivery.AddRcpt(rcptCtx, rcpt, meta.RcptOpts[rcpt]); err != nil {
 			dl.Debugf("delivery.AddRcpt %s failed: %v", rcpt, err)
 			perr.Errs[rcpt] = err
 		} else {
@@ -554,21 +901,39 @@ type queueDelivery struct {
 	q    *Queue
 	meta *QueueMetadata
 
+	quotaSender limits.Sender
+
 	header textproto.Header
 	body   buffer.Buffer
 }
 
-func (qd *queueDelivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOptions) error {
+func (qd *queueDelivery) AddRcpt(ctx context.Context, rcptTo string, opts smtp.RcptOptions) error {
+	if err := qd.q.limits.CheckQuota(ctx, qd.quotaSender, len(qd.meta.To)+1); err != nil {
+		return err
+	}
 	qd.meta.To = append(qd.meta.To, rcptTo)
+	if len(opts.Notify) != 0 || opts.OriginalRecipient != "" {
+		if qd.meta.RcptOpts == nil {
+			qd.meta.RcptOpts = make(map[string]smtp.RcptOptions)
+		}
+		qd.meta.RcptOpts[rcptTo] = opts
+	}
 	return nil
 }
 
 func (qd *queueDelivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
 	defer trace.StartRegion(ctx, "queue/Body").End()
 
+	qd.meta.Class = messageClass(qd.meta.From, header)
+
 	// Body buffer initially passed to us may not be valid after "delivery" to queue completes.
-	// storeNewMessage returns a new buffer object created from message blob stored on disk.
-	storedBody, err := qd.q.storeNewMessage(qd.meta, header, body)
+	// Store.Create returns a new buffer object created from the stored message blob.
+	//
+	// The message is stored by the instance that is currently responsible
+	// for the queue directory, see takeOver.
+	qd.q = qd.q.lockActive()
+	storedBody, err := qd.q.store.Create(qd.meta, header, body)
+	qd.q.handoverLck.RUnlock()
 	if err != nil {
 		return err
 	}
@@ -594,12 +959,23 @@ func (qd *queueDelivery) Commit(ctx context.Context) error {
 		panic("queue: double Commit")
 	}
 
-	qd.q.wheel.Add(time.Time{}, queueSlot{
-		ID:   qd.meta.MsgMeta.ID,
-		Meta: qd.meta,
-		Hdr:  &qd.header,
-		Body: qd.body,
-	})
+	// meta is owned by the delivery goroutine once it is in the wheel.
+	msgID, rcpts := qd.meta.MsgMeta.ID, len(qd.meta.To)
+
+	qd.q.handoverLck.RLock()
+	// If the queue was taken over by another instance after the message
+	// was stored, the message is already loaded by it from disk.
+	if qd.q.successor == nil {
+		qd.q.msgAdded()
+		qd.q.wheel.Add(time.Time{}, queueSlot{
+			ID:   msgID,
+			Meta: qd.meta,
+			Hdr:  &qd.header,
+			Body: qd.body,
+		})
+	}
+	qd.q.handoverLck.RUnlock()
+	qd.q.limits.ConsumeQuota(msgID, qd.quotaSender, rcpts)
 	qd.meta = nil
 	qd.body = nil
 	return nil
@@ -613,77 +989,51 @@ func (q *Queue) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom
 		FirstAttempt: time.Now(),
 		LastAttempt:  time.Now(),
 	}
-	return &queueDelivery{q: q, meta: meta}, nil
+
+	sender := quotaSender(msgMeta, mailFrom)
+	if err := q.limits.CheckQuota(ctx, sender, 1); err != nil {
+		return nil, err
+	}
+
+	return &queueDelivery{q: q, meta: meta, quotaSender: sender}, nil
+}
+
+// quotaSender returns the message originator identity used for quota
+// accounting.
+func quotaSender(msgMeta *module.MsgMetadata, mailFrom string) limits.Sender {
+	var s limits.Sender
+	if mailFrom != "" {
+		_, domain, err := address.Split(mailFrom)
+		if err == nil {
+			s.Domain = domain
+		}
+	}
+	if msgMeta.Conn != nil {
+		s.User = msgMeta.Conn.AuthUser
+		if tcpAddr, ok := msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
+			s.IP = tcpAddr.IP
+		}
+	}
+	return s
 }
 
 func (q *Queue) removeFromDisk(msgMeta *module.MsgMetadata) {
-	id := msgMeta.ID
 	dl := target.DeliveryLogger(q.Log, msgMeta)
 
-	// Order is important.
-	// If we remove header and body but can't remove meta now - readDiskQueue
-	// will detect and report it.
-	headerPath := filepath.Join(q.location, id+".header")
-	if err := os.Remove(headerPath); err != nil {
-		dl.Error("failed to remove header from disk", err)
-	}
-	bodyPath := filepath.Join(q.location, id+".body")
-	if err := os.Remove(bodyPath); err != nil {
-		dl.Error("failed to remove body from disk", err)
-	}
-	metaPath := filepath.Join(q.location, id+".meta")
-	if err := os.Remove(metaPath); err != nil {
-		dl.Error("failed to remove meta-data from disk", err)
+	if err := q.store.Remove(msgMeta.ID); err != nil {
+		dl.Error("failed to remove message from storage", err)
 	}
-	dl.Debugf("removed message from disk")
+	dl.Debugf("removed message from storage")
 }
 
 func (q *Queue) readDiskQueue() error {
-	dirInfo, err := os.ReadDir(q.location)
+	metas, err := q.store.Load()
 	if err != nil {
 		return err
 	}
 
-	// TODO(GH #209): Rewrite this function to pass all sub-tests in TestQueueDelivery_DeserializationCleanUp/NoMeta.
-
-	loadedCount := 0
-	for _, entry := range dirInfo {
-		// We start loading from meta-data files and then check whether ID.header and ID.body exist.
-		// This allows us to properly detect dangling body files.
-		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta") {
-			continue
-		}
-		id := entry.Name()[:len(entry.Name())-5]
-
-		meta, err := q.readMessageMeta(id)
-		if err != nil {
-			q.Log.Printf("failed to read meta-data, skipping: %v (msg ID = %s)", err, id)
-			continue
-		}
-
-		// Check header file existence.
-		if _, err := os.Stat(filepath.Join(q.location, id+".header")); err != nil {
-			if os.IsNotExist(err) {
-				q.Log.Printf("header file doesn't exist for msg ID = %s", id)
-				q.tryRemoveDanglingFile(id + ".meta")
-				q.tryRemoveDanglingFile(id + ".body")
-			} else {
-				q.Log.Printf("skipping nonstat'able header file: %v (msg ID = %s)", err, id)
-			}
-			continue
-		}
-
-		// Check body file existence.
-		if _, err := os.Stat(filepath.Join(q.location, id+".body")); err != nil {
-			if os.IsNotExist(err) {
-				q.Log.Printf("body file doesn't exist for msg ID = %s", id)
-				q.tryRemoveDanglingFile(id + ".meta")
-				q.tryRemoveDanglingFile(id + ".header")
-			} else {
-				q.Log.Printf("skipping nonstat'able body file: %v (msg ID = %s)", err, id)
-			}
-			continue
-		}
+	for _, meta := range metas {
+		id := meta.MsgMeta.ID
 
 		smallestTriesCount := 999999
 		for _, count := range meta.TriesCount {
@@ -694,204 +1044,128 @@ func (q *Queue) readDiskQueue() error {
 		nextTryTime := meta.LastAttempt
 		scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
 		nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
+		nextTryTime = q.capRetryTime(meta, nextTryTime)
 
 		if time.Until(nextTryTime) < q.postInitDelay {
 			nextTryTime = time.Now().Add(q.postInitDelay)
 		}
 
 		q.Log.Debugf("will try to deliver (msg ID = %s) in %v (%v)", id, time.Until(nextTryTime), nextTryTime)
+		q.msgAdded()
 		q.wheel.Add(nextTryTime, queueSlot{
 			ID: id,
 		})
-		loadedCount++
 	}
 
-	if loadedCount != 0 {
-		q.Log.Printf("loaded %d saved queue entries", loadedCount)
+	if len(metas) != 0 {
+		q.Log.Printf("loaded %d saved queue entries", len(metas))
 	}
 
 	return nil
 }
 
-func (q *Queue) storeNewMessage(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
-	id := meta.MsgMeta.ID
-
-	headerPath := filepath.Join(q.location, id+".header")
-	headerFile, err := os.Create(headerPath)
-	if err != nil {
-		return nil, err
-	}
-	defer headerFile.Close()
-
-	if err := textproto.WriteHeader(headerFile, header); err != nil {
-		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
-	}
-
-	bodyReader, err := body.Open()
-	if err != nil {
-		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
-	}
-	defer bodyReader.Close()
-
-	bodyPath := filepath.Join(q.location, id+".body")
-	bodyFile, err := os.Create(bodyPath)
-	if err != nil {
-		return nil, err
-	}
-	defer bodyFile.Close()
-
-	if _, err := io.Copy(bodyFile, bodyReader); err != nil {
-		q.tryRemoveDanglingFile(id + ".body")
-		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
-	}
-
-	if err := q.updateMetadataOnDisk(meta); err != nil {
-		q.tryRemoveDanglingFile(id + ".body")
-		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
-	}
-
-	if err := headerFile.Sync(); err != nil {
-		return nil, err
-	}
-
-	if err := bodyFile.Sync(); err != nil {
-		return nil, err
-	}
-
-	return buffer.FileBuffer{Path: bodyPath, LenHint: body.Len()}, nil
+func (q *Queue) InstanceName() string {
+	return q.name
 }
 
-func (q *Queue) updateMetadataOnDisk(meta *QueueMetadata) error {
-	metaPath := filepath.Join(q.location, meta.MsgMeta.ID+".meta")
+func (q *Queue) Name() string {
+	return "queue"
+}
 
-	var file *os.File
-	var err error
-	if runtime.GOOS == "windows" {
-		file, err = os.Create(metaPath)
-		if err != nil {
-			return err
-		}
-	} else {
-		file, err = os.Create(metaPath + ".new")
-		if err != nil {
-			return err
-		}
+// dsnTemplate selects the template for the human-readable part of DSN.
+//
+// Templates for the sender domain are preferred, then for domains of failed
+// recipients. The language is selected based on the language of the
+// original message.
+func (q *Queue) dsnTemplate(meta *QueueMetadata, header textproto.Header, failedRcpts []string) *dsn.Template {
+	if q.dsnTemplates == nil {
+		return nil
 	}
-	defer file.Close()
-
-	metaCopy := *meta
-	metaCopy.MsgMeta = meta.MsgMeta.DeepCopy()
-	metaCopy.MsgMeta.Conn = nil
 
-	if err := json.NewEncoder(file).Encode(metaCopy); err != nil {
-		return err
+	domains := make([]string, 0, len(failedRcpts)+1)
+	if _, domain, err := address.Split(meta.MsgMeta.OriginalFrom); err == nil && domain != "" {
+		domains = append(domains, domain)
 	}
-
-	if err := file.Sync(); err != nil {
-		return err
+	for _, rcpt := range failedRcpts {
+		if _, domain, err := address.Split(rcpt); err == nil && domain != "" {
+			domains = append(domains, domain)
+		}
 	}
 
-	if runtime.GOOS != "windows" {
-		if err := os.Rename(metaPath+".new", metaPath); err != nil {
-			return err
+	langs := make([]string, 0, 2)
+	for _, field := range []string{"Accept-Language", "Content-Language"} {
+		if val := header.Get(field); val != "" {
+			langs = append(langs, val)
 		}
 	}
 
-	return nil
+	return q.dsnTemplates.Select(domains, langs)
 }
 
-func (q *Queue) readMessageMeta(id string) (*QueueMetadata, error) {
-	metaPath := filepath.Join(q.location, id+".meta")
-	file, err := os.Open(metaPath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	meta := &QueueMetadata{}
-
-	meta.MsgMeta = &module.MsgMetadata{}
+// maxReturnedBody is the maximum size of the original message that is
+// included in a failure DSN if the sender requested RET=FULL. Larger messages
+// are returned as headers only (RFC 3461, Section 4.3).
+const maxReturnedBody = 1024 * 1024
 
-	// There is a couple of problems we have to solve before we would be able to
-	// serialize ConnState.
-	// 1. future.Future can't be serialized.
-	// 2. net.Addr can't be deserialized because we don't know the concrete type.
-
-	if err := json.NewDecoder(file).Decode(meta); err != nil {
-		return nil, err
+// notifyRequested checks whether a DSN for the specified event should be
+// generated according to the NOTIFY parameter (RFC 3461, Section 4.1).
+//
+// If NOTIFY is absent, DSNs are generated for failures and delays only.
+func notifyRequested(opts smtp.RcptOptions, n smtp.DSNNotify) bool {
+	if len(opts.Notify) == 0 {
+		return n == smtp.DSNNotifyFailure || n == smtp.DSNNotifyDelayed
+	}
+	for _, val := range opts.Notify {
+		if val == n {
+			return true
+		}
 	}
-
-	return meta, nil
-}
-
-type BufferedReadCloser struct {
-	*bufio.Reader
-	io.Closer
+	return false
 }
 
-func (q *Queue) tryRemoveDanglingFile(name string) {
-	if err := os.Remove(filepath.Join(q.location, name)); err != nil {
-		q.Log.Error("dangling file remove failed", err)
+// emitDSN generates DSN for the specified recipients and sends it to the
+// message sender using the bounce pipeline. action should be one of
+// dsn.ActionFailed, dsn.ActionDelayed, dsn.ActionDelivered or
+// dsn.ActionRelayed.
+//
+// Recipients that did not request a notification of that kind via the NOTIFY
+// parameter are skipped.
+func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, body buffer.Buffer, rcpts []string, action dsn.Action) {
+	// If, apparently, we have no DSN msgpipeline configured - do nothing.
+	if q.dsnPipeline == nil {
 		return
 	}
-	q.Log.Printf("removed dangling file %s", name)
-}
 
-func (q *Queue) openMessage(id string) (*QueueMetadata, textproto.Header, buffer.Buffer, error) {
-	meta, err := q.readMessageMeta(id)
-	if err != nil {
-		return nil, textproto.Header{}, nil, err
+	// Null return-path, used in DSNs.
+	if meta.MsgMeta.OriginalFrom == "" {
+		return
 	}
 
-	bodyPath := filepath.Join(q.location, id+".body")
-	_, err = os.Stat(bodyPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			q.tryRemoveDanglingFile(id + ".meta")
-		}
-		return nil, textproto.Header{}, nil, err
+	notify := smtp.DSNNotifyFailure
+	switch action {
+	case dsn.ActionDelayed:
+		notify = smtp.DSNNotifyDelayed
+	case dsn.ActionDelivered, dsn.ActionRelayed:
+		notify = smtp.DSNNotifySuccess
 	}
-	body := buffer.FileBuffer{Path: bodyPath}
-
-	headerPath := filepath.Join(q.location, id+".header")
-	headerFile, err := os.Open(headerPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			q.tryRemoveDanglingFile(id + ".meta")
-			q.tryRemoveDanglingFile(id + ".body")
+	notifyRcpts := make([]string, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		if notifyRequested(meta.RcptOpts[rcpt], notify) {
+			notifyRcpts = append(notifyRcpts, rcpt)
 		}
-		return nil, textproto.Header{}, nil, err
-	}
-
-	bufferedHeader := bufio.NewReader(headerFile)
-	header, err := textproto.ReadHeader(bufferedHeader)
-	if err != nil {
-		return nil, textproto.Header{}, nil, err
 	}
-
-	return meta, header, body, nil
-}
-
-func (q *Queue) InstanceName() string {
-	return q.name
-}
-
-func (q *Queue) Name() string {
-	return "queue"
-}
-
-func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpts []string) {
-	// If, apparently, we have no DSN msgpipeline configured - do nothing.
-	if q.dsnPipeline == nil {
+	if len(notifyRcpts) == 0 {
 		return
 	}
+	rcpts = notifyRcpts
 
-	// Null return-path, used in DSNs.
-	if meta.MsgMeta.OriginalFrom == "" {
+	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
+
+	// Do not send DSNs to addresses that are likely forged (backscatter),
+	// the log message is the only record of the failure then.
+	if q.dsnSuppress[meta.MsgMeta.SenderAuth] {
+		dl.Msg("DSN suppressed, sender is not verified", "action", string(action),
+			"sender_auth", string(meta.MsgMeta.SenderAuth), "rcpts", rcpts)
 		return
 	}
 
@@ -912,35 +1186,64 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 		XMessageID:      meta.MsgMeta.ID,
 		ArrivalDate:     meta.FirstAttempt,
 		LastAttemptDate: meta.LastAttempt,
+		EnvelopeID:      meta.MsgMeta.SMTPOpts.EnvelopeID,
 	}
 	if !meta.MsgMeta.DontTraceSender && meta.MsgMeta.Conn != nil {
 		mtaInfo.ReceivedFromMTA = meta.MsgMeta.Conn.Hostname
 	}
 
+	var willRetryUntil time.Time
+	if lifetime := q.maxLifetimeFor(meta); action == dsn.ActionDelayed && lifetime != 0 {
+		willRetryUntil = meta.FirstAttempt.Add(lifetime)
+	}
+
 	rcptInfo := make([]dsn.RecipientInfo, 0, len(meta.RcptErrs))
-	for _, rcpt := range failedRcpts {
+	for _, rcpt := range rcpts {
+		// rcptErr and RcptOpts are stored using the effective recipient
+		// address, not the original one.
 		rcptErr := meta.RcptErrs[rcpt]
-		// rcptErr is stored in RcptErrs using the effective recipient address,
-		// not the original one.
+		rcptOpts := meta.RcptOpts[rcpt]
 
 		originalRcpt := meta.MsgMeta.OriginalRcpts[rcpt]
 		if originalRcpt != "" {
 			rcpt = originalRcpt
 		}
 
-		rcptInfo = append(rcptInfo, dsn.RecipientInfo{
-			FinalRecipient: rcpt,
-			Action:         dsn.ActionFailed,
-			Status:         rcptErr.EnhancedCode,
-			DiagnosticCode: rcptErr,
-		})
+		info := dsn.RecipientInfo{
+			FinalRecipient:        rcpt,
+			Action:                action,
+			WillRetryUntil:        willRetryUntil,
+			OriginalRecipientType: string(rcptOpts.OriginalRecipientType),
+			OriginalRecipient:     rcptOpts.OriginalRecipient,
+		}
+		if rcptErr != nil {
+			info.Status = rcptErr.EnhancedCode
+			info.DiagnosticCode = rcptErr
+		} else {
+			info.Status = smtp.EnhancedCode{2, 0, 0}
+		}
+		rcptInfo = append(rcptInfo, info)
+	}
+
+	// Return the original message only for failures and only if it is
+	// reasonably small, the headers are included regardless.
+	var returnBody io.Reader
+	if action == dsn.ActionFailed && meta.MsgMeta.SMTPOpts.Return == smtp.DSNReturnFull &&
+		body != nil && body.Len() <= maxReturnedBody {
+		r, err := body.Open()
+		if err != nil {
+			dl.Error("failed to open message body for DSN", err)
+		} else {
+			defer r.Close()
+			returnBody = r
+		}
 	}
 
 	var dsnBodyBlob bytes.Buffer
-	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
-	dsnHeader, err := dsn.GenerateDSN(meta.MsgMeta.SMTPOpts.UTF8, dsnEnvelope, mtaInfo, rcptInfo, header, &dsnBodyBlob)
+	tmpl := q.dsnTemplate(meta, header, rcpts)
+	dsnHeader, err := dsn.GenerateDSN(meta.MsgMeta.SMTPOpts.UTF8, dsnEnvelope, mtaInfo, rcptInfo, header, returnBody, tmpl, &dsnBodyBlob)
 	if err != nil {
-		dl.Error("failed to generate fail DSN", err)
+		dl.Error("failed to generate "+string(action)+" DSN", err)
 		return
 	}
 	dsnBody := buffer.MemoryBuffer{Slice: dsnBodyBlob.Bytes()}
@@ -952,7 +1255,7 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 			RequireTLS: meta.MsgMeta.SMTPOpts.RequireTLS,
 		},
 	}
-	dl.Msg("generated failed DSN", "dsn_id", dsnID)
+	dl.Msg("generated "+string(action)+" DSN", "dsn_id", dsnID)
 
 	msgCtx, msgTask := trace.NewTask(context.Background(), "DSN Delivery")
 	defer msgTask.End()
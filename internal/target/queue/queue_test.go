@@ -57,6 +57,12 @@ func cleanQueue(t *testing.T, q *Queue) {
 }
 
 func newTestQueueDir(t *testing.T, target module.DeliveryTarget, dir string) *Queue {
+	return newTestQueueConf(t, target, dir, nil)
+}
+
+// newTestQueueConf is similar to newTestQueueDir but allows to change the
+// Queue configuration before it is started.
+func newTestQueueConf(t *testing.T, target module.DeliveryTarget, dir string, conf func(q *Queue)) *Queue {
 	mod, _ := NewQueue("", "queue", nil, nil)
 	q := mod.(*Queue)
 	q.initialRetryTime = 0
@@ -65,6 +71,9 @@ func newTestQueueDir(t *testing.T, target module.DeliveryTarget, dir string) *Qu
 	q.maxTries = 5
 	q.location = dir
 	q.Target = target
+	if conf != nil {
+		conf(q)
+	}
 
 	if testing.Verbose() {
 		q.Log = testutils.Logger(t, "queue")
@@ -94,6 +103,9 @@ type unreliableTarget struct {
 	bodyFailures        []error
 	bodyFailuresPartial []map[string]error
 	rcptFailures        []map[string]error
+
+	// If set, reported for recipients delivered using BodyNonAtomic.
+	deliveryInfo *module.DeliveryInfo
 }
 
 type unreliableTargetDelivery struct {
@@ -136,10 +148,16 @@ func (utd *unreliableTargetDeliveryPartial) BodyNonAtomic(ctx context.Context, c
 	r, _ := body.Open()
 	utd.msg.Body, _ = io.ReadAll(r)
 
+	var failures map[string]error
 	if len(utd.ut.bodyFailuresPartial) > utd.ut.passedMessages {
-		for rcpt, err := range utd.ut.bodyFailuresPartial[utd.ut.passedMessages] {
-			c.SetStatus(rcpt, err)
+		failures = utd.ut.bodyFailuresPartial[utd.ut.passedMessages]
+	}
+	for _, rcpt := range utd.msg.RcptTo {
+		err := failures[rcpt]
+		if ic, ok := c.(module.DeliveryInfoCollector); ok && err == nil && utd.ut.deliveryInfo != nil {
+			ic.SetDeliveryInfo(rcpt, *utd.ut.deliveryInfo)
 		}
+		c.SetStatus(rcpt, err)
 	}
 }
 
@@ -360,6 +378,53 @@ func TestQueueDelivery_TemporaryFail_Partial(t *testing.T) {
 	checkQueueDir(t, q, []string{})
 }
 
+func TestQueueDelivery_DeliveryInfo(t *testing.T) {
+	t.Parallel()
+
+	info := module.DeliveryInfo{
+		RemoteServer: "mx.example.org.",
+		RemoteAddr:   "192.0.2.1:25",
+		TLSVersion:   "TLS 1.3",
+		TLSLevel:     "authenticated",
+		MXLevel:      "mtasts",
+		TLSAuth:      "pki",
+	}
+	dt := unreliableTarget{
+		bodyFailuresPartial: []map[string]error{
+			{
+				"tester2@example.org": exterrors.WithTemporary(errors.New("go away"), true),
+			},
+		},
+		deliveryInfo: &info,
+		committed:    make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	// Keep the message in the queue after the first attempt.
+	q.initialRetryTime = time.Hour
+	defer cleanQueue(t, q)
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		meta, err := q.store.ReadMeta(id)
+		if err == nil && len(meta.Delivered) != 0 {
+			if !reflect.DeepEqual(meta.Delivered, map[string]module.DeliveryInfo{"tester1@example.org": info}) {
+				t.Fatalf("Wrong delivery info: %+v", meta.Delivered)
+			}
+			if !reflect.DeepEqual(meta.To, []string{"tester2@example.org"}) {
+				t.Fatalf("Wrong recipients to retry: %v", meta.To)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Delivery info was not stored in the queue metadata")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestQueueDelivery_MultipleAttempts(t *testing.T) {
 	t.Parallel()
 
@@ -400,6 +465,77 @@ func TestQueueDelivery_MultipleAttempts(t *testing.T) {
 	checkQueueDir(t, q, []string{})
 }
 
+func TestQueueDelivery_MaxLifetime(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	dt := unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("try later 1"), true),
+			exterrors.WithTemporary(errors.New("try later 2"), true),
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.maxLifetime = 0
+	q.maxLifetimeDSN = time.Nanosecond
+	defer cleanQueue(t, q)
+
+	// DSN is not retried after the first failure.
+	// Subtests are used to get different message IDs.
+	t.Run("dsn", func(t *testing.T) {
+		testutils.DoTestDeliveryMeta(t, q, "", []string{"tester1@example.org"}, &module.MsgMetadata{})
+	})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	time.Sleep(500 * time.Millisecond)
+	if dt.passedMessages != 1 {
+		t.Fatalf("message is retried, %d attempts", dt.passedMessages)
+	}
+
+	// Other messages are retried as usual.
+	t.Run("transactional", func(t *testing.T) {
+		testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+
+	q.Close()
+	// No DSN for DSN.
+	if dsnTarget.passedMessages != 0 {
+		t.Errorf("dsnTarget accepted %d messages", dsnTarget.passedMessages)
+	}
+	checkQueueDir(t, q, []string{})
+}
+
+func TestMessageClass(t *testing.T) {
+	test := func(mailFrom string, fields map[string]string, expected string) {
+		t.Helper()
+		hdr := textproto.Header{}
+		for k, v := range fields {
+			hdr.Add(k, v)
+		}
+		if class := messageClass(mailFrom, hdr); class != expected {
+			t.Errorf("messageClass(%q, %v) = %v, want %v", mailFrom, fields, class, expected)
+		}
+	}
+
+	test("", nil, classDSN)
+	test("", map[string]string{"Precedence": "bulk"}, classDSN)
+	test("test@example.org", nil, classTransactional)
+	test("test@example.org", map[string]string{"Precedence": " Bulk"}, classBulk)
+	test("test@example.org", map[string]string{"Precedence": "list"}, classBulk)
+	test("test@example.org", map[string]string{"Precedence": "first-class"}, classTransactional)
+	test("test@example.org", map[string]string{"List-Id": "<list.example.org>"}, classBulk)
+	test("test@example.org", map[string]string{"List-Unsubscribe": "<mailto:unsub@example.org>"}, classBulk)
+}
+
 func TestQueueDelivery_PermanentRcptReject(t *testing.T) {
 	t.Parallel()
 
@@ -459,6 +595,50 @@ func TestQueueDelivery_TemporaryRcptReject(t *testing.T) {
 	checkQueueDir(t, q, []string{})
 }
 
+func TestQueueDelivery_DispatchChecks(t *testing.T) {
+	t.Parallel()
+
+	check := &testutils.Check{
+		BodyRes: module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Sender is suppressed",
+			},
+			Reject: true,
+		},
+	}
+	dt := unreliableTarget{
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueueConf(t, &dt, t.TempDir(), func(q *Queue) {
+		q.dispatchChecks = []module.Check{check}
+	})
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+
+	// Rejected by the check after the target delivery was started.
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	q.Close()
+
+	if check.BodyCalls != 1 {
+		t.Errorf("Expected 1 CheckBody call, got %d", check.BodyCalls)
+	}
+	if check.UnclosedStates != 0 {
+		t.Errorf("Check states are not closed: %d", check.UnclosedStates)
+	}
+	select {
+	case <-dt.committed:
+		t.Error("Rejected message was delivered")
+	default:
+	}
+
+	// Permanent rejection, no retries.
+	checkQueueDir(t, q, []string{})
+}
+
 func TestQueueDelivery_SerializationRoundtrip(t *testing.T) {
 	t.Parallel()
 
@@ -625,6 +805,42 @@ func TestQueueDelivery_AbortNoDangling(t *testing.T) {
 	checkQueueDir(t, q, []string{})
 }
 
+func TestQueueStore_FileBufferLinked(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+
+	spool := t.TempDir()
+	body, err := buffer.BufferInFile(strings.NewReader("foobar\r\n"), spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Remove()
+
+	meta := &QueueMetadata{MsgMeta: &module.MsgMetadata{ID: "linked"}}
+	stored, err := q.store.Create(meta, textproto.Header{}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spoolInfo, err := os.Stat(body.(buffer.FileBuffer).Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storedInfo, err := os.Stat(stored.(buffer.FileBuffer).Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(spoolInfo, storedInfo) {
+		t.Error("Queued body was copied instead of being linked")
+	}
+	if stored.Len() != len("foobar\r\n") {
+		t.Error("Wrong body length:", stored.Len())
+	}
+}
+
 func TestQueueDSN(t *testing.T) {
 	t.Parallel()
 
@@ -665,6 +881,109 @@ func TestQueueDSN(t *testing.T) {
 	}
 }
 
+func TestQueueDSN_Delayed(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+
+	dt := unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("try later 1"), true),
+			exterrors.WithTemporary(errors.New("try later 2"), true),
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.delayWarning = time.Nanosecond
+	q.maxLifetime = time.Hour
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+
+	// Two failed attempts, then the message is delivered.
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+
+	// Warning is sent only once.
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if msg.MailFrom != "" {
+		t.Fatalf("wrong MAIL FROM address in DSN: %v", msg.MailFrom)
+	}
+	if !reflect.DeepEqual(msg.RcptTo, []string{"tester@example.com"}) {
+		t.Fatalf("wrong RCPT TO address in DSN: %v", msg.RcptTo)
+	}
+	if !bytes.Contains(msg.Body, []byte("Action: delayed")) {
+		t.Errorf("DSN is not a delay warning:\n%s", msg.Body)
+	}
+	if !bytes.Contains(msg.Body, []byte("Will-Retry-Until: ")) {
+		t.Errorf("DSN does not include the retry deadline:\n%s", msg.Body)
+	}
+
+	q.Close()
+	if dsnTarget.passedMessages != 1 {
+		t.Errorf("dsnTarget accepted %d messages", dsnTarget.passedMessages)
+	}
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueDSN_Suppress(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	dt := unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("go away"), false),
+			exterrors.WithTemporary(errors.New("go away"), false),
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.dsnSuppress = map[module.SenderAuth]bool{module.SenderAuthFail: true}
+	defer cleanQueue(t, q)
+
+	// Subtests are used to get different message IDs.
+	t.Run("forged", func(t *testing.T) {
+		testutils.DoTestDeliveryMeta(t, q, "forged@example.com", []string{"tester1@example.org"}, &module.MsgMetadata{
+			OriginalFrom: "forged@example.com",
+			SenderAuth:   module.SenderAuthFail,
+		})
+	})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	t.Run("unknown", func(t *testing.T) {
+		testutils.DoTestDeliveryMeta(t, q, "tester@example.com", []string{"tester1@example.org"}, &module.MsgMetadata{
+			OriginalFrom: "tester@example.com",
+		})
+	})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	// DSN is sent only for the second message.
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !reflect.DeepEqual(msg.RcptTo, []string{"tester@example.com"}) {
+		t.Fatalf("wrong RCPT TO address in DSN: %v", msg.RcptTo)
+	}
+
+	q.Close()
+	if dsnTarget.passedMessages != 1 {
+		t.Errorf("dsnTarget accepted %d messages", dsnTarget.passedMessages)
+	}
+}
+
 func TestQueueDSN_FromEmptyAddr(t *testing.T) {
 	t.Parallel()
 
@@ -823,6 +1142,175 @@ func TestQueueDSN_RcptRewrite(t *testing.T) {
 	}
 }
 
+func doTestDeliveryOpts(t *testing.T, q *Queue, msgMeta *module.MsgMetadata, to []string, opts map[string]smtp.RcptOptions) {
+	t.Helper()
+
+	IDRaw := sha1.Sum([]byte(t.Name()))
+	msgMeta.ID = hex.EncodeToString(IDRaw[:])
+	msgMeta.DontTraceSender = true
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Hello")
+	body := buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}
+
+	delivery, err := q.Start(context.Background(), msgMeta, msgMeta.OriginalFrom)
+	if err != nil {
+		t.Fatalf("unexpected Start err: %v", err)
+	}
+	for _, rcpt := range to {
+		if err := delivery.AddRcpt(context.Background(), rcpt, opts[rcpt]); err != nil {
+			t.Fatalf("unexpected AddRcpt err for %s: %v", rcpt, err)
+		}
+	}
+	if err := delivery.Body(context.Background(), hdr, body); err != nil {
+		t.Fatalf("unexpected Body err: %v", err)
+	}
+	if err := delivery.Commit(context.Background()); err != nil {
+		t.Fatalf("unexpected Commit err: %v", err)
+	}
+}
+
+func TestQueueDSN_NotifyNever(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), false),
+				"tester2@example.org": exterrors.WithTemporary(errors.New("go away"), false),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	defer cleanQueue(t, q)
+
+	doTestDeliveryOpts(t, q, &module.MsgMetadata{OriginalFrom: "tester@example.com"},
+		[]string{"tester1@example.org", "tester2@example.org"},
+		map[string]smtp.RcptOptions{
+			"tester1@example.org": {Notify: []smtp.DSNNotify{smtp.DSNNotifyNever}},
+		})
+
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	// Only tester2 is reported.
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if bytes.Contains(msg.Body, []byte("tester1@example.org")) {
+		t.Errorf("DSN includes recipient with NOTIFY=NEVER:\n%s", msg.Body)
+	}
+	if !bytes.Contains(msg.Body, []byte("Final-Recipient: rfc822; tester2@example.org")) {
+		t.Errorf("DSN does not include the recipient:\n%s", msg.Body)
+	}
+
+	q.Close()
+	if dsnTarget.passedMessages != 1 {
+		t.Errorf("dsnTarget accepted %d messages", dsnTarget.passedMessages)
+	}
+}
+
+func TestQueueDSN_NotifySuccess(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	dt := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	defer cleanQueue(t, q)
+
+	doTestDeliveryOpts(t, q, &module.MsgMetadata{
+		OriginalFrom: "tester@example.com",
+		SMTPOpts:     smtp.MailOptions{EnvelopeID: "QQ314159"},
+	}, []string{"tester1@example.org", "tester2@example.org"},
+		map[string]smtp.RcptOptions{
+			"tester1@example.org": {
+				Notify:                []smtp.DSNNotify{smtp.DSNNotifySuccess, smtp.DSNNotifyFailure},
+				OriginalRecipientType: smtp.DSNAddressTypeRFC822,
+				OriginalRecipient:     "orig@example.org",
+			},
+		})
+
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !reflect.DeepEqual(msg.RcptTo, []string{"tester@example.com"}) {
+		t.Fatalf("wrong RCPT TO address in DSN: %v", msg.RcptTo)
+	}
+	for _, part := range []string{
+		"Original-Envelope-Id: QQ314159",
+		"Original-Recipient: rfc822; orig@example.org",
+		"Final-Recipient: rfc822; tester1@example.org",
+		"Action: delivered",
+		"Status: 2.0.0",
+	} {
+		if !bytes.Contains(msg.Body, []byte(part)) {
+			t.Errorf("DSN does not contain %q:\n%s", part, msg.Body)
+		}
+	}
+	if bytes.Contains(msg.Body, []byte("tester2@example.org")) {
+		t.Errorf("DSN includes recipient without NOTIFY=SUCCESS:\n%s", msg.Body)
+	}
+
+	q.Close()
+	if dsnTarget.passedMessages != 1 {
+		t.Errorf("dsnTarget accepted %d messages", dsnTarget.passedMessages)
+	}
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueDSN_ReturnFull(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), false),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	defer cleanQueue(t, q)
+
+	doTestDeliveryOpts(t, q, &module.MsgMetadata{
+		OriginalFrom: "tester@example.com",
+		SMTPOpts:     smtp.MailOptions{Return: smtp.DSNReturnFull},
+	}, []string{"tester1@example.org"}, nil)
+
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !bytes.Contains(msg.Body, []byte("Content-Type: message/rfc822")) {
+		t.Errorf("DSN does not include the original message:\n%s", msg.Body)
+	}
+	if !bytes.Contains(msg.Body, []byte("foobar")) {
+		t.Errorf("DSN does not include the original body:\n%s", msg.Body)
+	}
+}
+
 func init() {
 	dontRecover = true
 }
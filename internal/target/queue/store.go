@@ -0,0 +1,347 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/storagepath"
+)
+
+// Store is the persistent storage for queued messages.
+//
+// Methods returning the stored message report ErrNoSuchMessage if there is
+// no message with the specified ID.
+type Store interface {
+	// Create stores the new message. Body passed to Create may not be valid
+	// after it returns, the returned Buffer should be used instead.
+	Create(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, error)
+
+	// UpdateMeta replaces the meta-data of the stored message. It should
+	// be atomic: either old or new meta-data is seen after a crash.
+	UpdateMeta(meta *QueueMetadata) error
+
+	ReadMeta(id string) (*QueueMetadata, error)
+	Open(id string) (*QueueMetadata, textproto.Header, buffer.Buffer, error)
+
+	// Size returns the amount of space used by the message.
+	Size(id string) (int64, error)
+
+	Remove(id string) error
+
+	// MarkBroken excludes the message from further processing without
+	// removing it so it can be inspected manually.
+	MarkBroken(id string) error
+
+	// Load returns meta-data of all stored messages. It is called on start
+	// and may clean up messages left incomplete after a crash.
+	Load() ([]*QueueMetadata, error)
+
+	// Messages is similar to Load, but does not make any changes.
+	Messages() ([]*QueueMetadata, error)
+
+	Close() error
+}
+
+// fsStore keeps each message in the directory as ID.header, ID.body and
+// ID.meta files.
+type fsStore struct {
+	location string
+	quota    *storagepath.Quota
+	log      log.Logger
+}
+
+func (s *fsStore) Create(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	id := meta.MsgMeta.ID
+
+	if err := s.quota.Reserve(int64(body.Len())); err != nil {
+		return nil, err
+	}
+
+	headerPath := filepath.Join(s.location, id+".header")
+	headerFile, err := os.Create(headerPath)
+	if err != nil {
+		s.quota.Release(int64(body.Len()))
+		return nil, err
+	}
+	defer headerFile.Close()
+
+	if err := textproto.WriteHeader(headerFile, header); err != nil {
+		s.tryRemoveDanglingFile(id + ".header")
+		return nil, err
+	}
+
+	// Avoid copying the body if it is already on disk, the SMTP endpoint
+	// spools large messages to the file system.
+	bodyPath := filepath.Join(s.location, id+".body")
+	bodyBuf, err := buffer.StoreInFile(body, bodyPath)
+	if err != nil {
+		s.tryRemoveDanglingFile(id + ".header")
+		return nil, err
+	}
+
+	if err := s.UpdateMeta(meta); err != nil {
+		s.tryRemoveDanglingFile(id + ".body")
+		s.tryRemoveDanglingFile(id + ".header")
+		return nil, err
+	}
+
+	if err := headerFile.Sync(); err != nil {
+		return nil, err
+	}
+
+	return bodyBuf, nil
+}
+
+func (s *fsStore) UpdateMeta(meta *QueueMetadata) error {
+	metaPath := filepath.Join(s.location, meta.MsgMeta.ID+".meta")
+
+	var file *os.File
+	var err error
+	if runtime.GOOS == "windows" {
+		file, err = os.Create(metaPath)
+		if err != nil {
+			return err
+		}
+	} else {
+		file, err = os.Create(metaPath + ".new")
+		if err != nil {
+			return err
+		}
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(storedMeta(meta)); err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	if runtime.GOOS != "windows" {
+		if err := os.Rename(metaPath+".new", metaPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// storedMeta returns the copy of meta without fields that can't be
+// serialized.
+func storedMeta(meta *QueueMetadata) *QueueMetadata {
+	metaCopy := *meta
+	metaCopy.MsgMeta = meta.MsgMeta.DeepCopy()
+	// There is a couple of problems we have to solve before we would be able to
+	// serialize ConnState.
+	// 1. future.Future can't be serialized.
+	// 2. net.Addr can't be deserialized because we don't know the concrete type.
+	metaCopy.MsgMeta.Conn = nil
+	return &metaCopy
+}
+
+func (s *fsStore) ReadMeta(id string) (*QueueMetadata, error) {
+	metaPath := filepath.Join(s.location, id+".meta")
+	file, err := os.Open(metaPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoSuchMessage
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	meta := &QueueMetadata{}
+	meta.MsgMeta = &module.MsgMetadata{}
+	if err := json.NewDecoder(file).Decode(meta); err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+func (s *fsStore) tryRemoveDanglingFile(name string) {
+	if err := os.Remove(filepath.Join(s.location, name)); err != nil {
+		s.log.Error("dangling file remove failed", err)
+		return
+	}
+	s.log.Printf("removed dangling file %s", name)
+}
+
+func (s *fsStore) Open(id string) (*QueueMetadata, textproto.Header, buffer.Buffer, error) {
+	meta, err := s.ReadMeta(id)
+	if err != nil {
+		return nil, textproto.Header{}, nil, err
+	}
+
+	bodyPath := filepath.Join(s.location, id+".body")
+	_, err = os.Stat(bodyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.tryRemoveDanglingFile(id + ".meta")
+		}
+		return nil, textproto.Header{}, nil, err
+	}
+	body := buffer.FileBuffer{Path: bodyPath}
+
+	headerPath := filepath.Join(s.location, id+".header")
+	headerFile, err := os.Open(headerPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.tryRemoveDanglingFile(id + ".meta")
+			s.tryRemoveDanglingFile(id + ".body")
+		}
+		return nil, textproto.Header{}, nil, err
+	}
+	defer headerFile.Close()
+
+	bufferedHeader := bufio.NewReader(headerFile)
+	header, err := textproto.ReadHeader(bufferedHeader)
+	if err != nil {
+		return nil, textproto.Header{}, nil, err
+	}
+
+	return meta, header, body, nil
+}
+
+func (s *fsStore) Size(id string) (int64, error) {
+	var size int64
+	for _, suffix := range []string{".header", ".body"} {
+		stat, err := os.Stat(filepath.Join(s.location, id+suffix))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Delivered or discarded while we were reading it.
+				return 0, ErrNoSuchMessage
+			}
+			return 0, err
+		}
+		size += stat.Size()
+	}
+	return size, nil
+}
+
+func (s *fsStore) Remove(id string) error {
+	if s.quota != nil {
+		var size int64
+		for _, ext := range []string{".header", ".body", ".meta"} {
+			if info, err := os.Stat(filepath.Join(s.location, id+ext)); err == nil {
+				size += info.Size()
+			}
+		}
+		s.quota.Release(size)
+	}
+
+	// Order is important.
+	// If we remove header and body but can't remove meta now - Load
+	// will detect and report it.
+	var errs []error
+	for _, ext := range []string{".header", ".body", ".meta"} {
+		if err := os.Remove(filepath.Join(s.location, id+ext)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// MarkBroken changes the name of metadata file to have .meta_broken
+// extension.
+//
+// Further attempts to deliver (due to a timewheel) it will fail due to
+// non-existent meta-data file.
+func (s *fsStore) MarkBroken(id string) error {
+	return os.Rename(filepath.Join(s.location, id+".meta"), filepath.Join(s.location, id+".meta_broken"))
+}
+
+func (s *fsStore) Load() ([]*QueueMetadata, error) {
+	return s.list(true)
+}
+
+func (s *fsStore) Messages() ([]*QueueMetadata, error) {
+	return s.list(false)
+}
+
+func (s *fsStore) Close() error {
+	return nil
+}
+
+func (s *fsStore) list(cleanUp bool) ([]*QueueMetadata, error) {
+	dirInfo, err := os.ReadDir(s.location)
+	if err != nil {
+		return nil, err
+	}
+
+	// TODO(GH #209): Rewrite this function to pass all sub-tests in TestQueueDelivery_DeserializationCleanUp/NoMeta.
+
+	metas := make([]*QueueMetadata, 0, len(dirInfo)/3)
+	for _, entry := range dirInfo {
+		// We start loading from meta-data files and then check whether ID.header and ID.body exist.
+		// This allows us to properly detect dangling body files.
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta") {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".meta")
+
+		meta, err := s.ReadMeta(id)
+		if err != nil {
+			if !errors.Is(err, ErrNoSuchMessage) {
+				s.log.Printf("failed to read meta-data, skipping: %v (msg ID = %s)", err, id)
+			}
+			continue
+		}
+
+		// Check header file existence.
+		if _, err := os.Stat(filepath.Join(s.location, id+".header")); err != nil {
+			if os.IsNotExist(err) && cleanUp {
+				s.log.Printf("header file doesn't exist for msg ID = %s", id)
+				s.tryRemoveDanglingFile(id + ".meta")
+				s.tryRemoveDanglingFile(id + ".body")
+			} else if !os.IsNotExist(err) {
+				s.log.Printf("skipping nonstat'able header file: %v (msg ID = %s)", err, id)
+			}
+			continue
+		}
+
+		// Check body file existence.
+		if _, err := os.Stat(filepath.Join(s.location, id+".body")); err != nil {
+			if os.IsNotExist(err) && cleanUp {
+				s.log.Printf("body file doesn't exist for msg ID = %s", id)
+				s.tryRemoveDanglingFile(id + ".meta")
+				s.tryRemoveDanglingFile(id + ".header")
+			} else if !os.IsNotExist(err) {
+				s.log.Printf("skipping nonstat'able body file: %v (msg ID = %s)", err, id)
+			}
+			continue
+		}
+
+		metas = append(metas, meta)
+	}
+
+	return metas, nil
+}
@@ -0,0 +1,263 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	_ "github.com/lib/pq"
+)
+
+// sqlStore keeps messages in the SQL database. Rows are keyed by the queue
+// instance name so multiple queues can share the same database.
+//
+// Unlike fsStore, meta-data updates are atomic on all platforms and
+// messages are loaded without scanning the directory.
+type sqlStore struct {
+	db    *sql.DB
+	queue string
+	log   log.Logger
+}
+
+func newSQLStore(driver, dsn, queue string, l log.Logger) (*sqlStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS queue_messages (
+			queue TEXT NOT NULL,
+			id TEXT NOT NULL,
+			meta TEXT NOT NULL,
+			header BYTEA NOT NULL,
+			body BYTEA NOT NULL,
+			size BIGINT NOT NULL,
+			last_attempt BIGINT NOT NULL,
+			broken INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (queue, id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS queue_messages_attempt ON queue_messages (queue, broken, last_attempt)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &sqlStore{db: db, queue: queue, log: l}, nil
+}
+
+func (s *sqlStore) Create(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	metaBlob, err := json.Marshal(storedMeta(meta))
+	if err != nil {
+		return nil, err
+	}
+
+	var hdrBlob bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBlob, header); err != nil {
+		return nil, err
+	}
+
+	r, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	bodyBlob, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.Exec(`INSERT INTO queue_messages (queue, id, meta, header, body, size, last_attempt)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		s.queue, meta.MsgMeta.ID, string(metaBlob), hdrBlob.Bytes(), bodyBlob,
+		int64(hdrBlob.Len()+len(bodyBlob)), meta.LastAttempt.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	return sqlBody{s: s, id: meta.MsgMeta.ID, size: len(bodyBlob)}, nil
+}
+
+func (s *sqlStore) UpdateMeta(meta *QueueMetadata) error {
+	metaBlob, err := json.Marshal(storedMeta(meta))
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.Exec(`UPDATE queue_messages SET meta = $1, last_attempt = $2
+		WHERE queue = $3 AND id = $4 AND broken = 0`,
+		string(metaBlob), meta.LastAttempt.Unix(), s.queue, meta.MsgMeta.ID)
+	if err != nil {
+		return err
+	}
+	if updated, err := res.RowsAffected(); err == nil && updated == 0 {
+		return ErrNoSuchMessage
+	}
+	return nil
+}
+
+func decodeMeta(metaBlob string) (*QueueMetadata, error) {
+	meta := &QueueMetadata{}
+	meta.MsgMeta = &module.MsgMetadata{}
+	if err := json.Unmarshal([]byte(metaBlob), meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (s *sqlStore) ReadMeta(id string) (*QueueMetadata, error) {
+	var metaBlob string
+	err := s.db.QueryRow(`SELECT meta FROM queue_messages WHERE queue = $1 AND id = $2 AND broken = 0`,
+		s.queue, id).Scan(&metaBlob)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoSuchMessage
+		}
+		return nil, err
+	}
+	return decodeMeta(metaBlob)
+}
+
+func (s *sqlStore) Open(id string) (*QueueMetadata, textproto.Header, buffer.Buffer, error) {
+	var (
+		metaBlob string
+		hdrBlob  []byte
+		bodySize int
+	)
+	err := s.db.QueryRow(`SELECT meta, header, size FROM queue_messages WHERE queue = $1 AND id = $2 AND broken = 0`,
+		s.queue, id).Scan(&metaBlob, &hdrBlob, &bodySize)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, textproto.Header{}, nil, ErrNoSuchMessage
+		}
+		return nil, textproto.Header{}, nil, err
+	}
+
+	meta, err := decodeMeta(metaBlob)
+	if err != nil {
+		return nil, textproto.Header{}, nil, err
+	}
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(hdrBlob)))
+	if err != nil {
+		return nil, textproto.Header{}, nil, err
+	}
+
+	// The body is loaded lazily to not keep it in memory while the target
+	// is processing recipients.
+	return meta, header, sqlBody{s: s, id: id, size: bodySize - len(hdrBlob)}, nil
+}
+
+func (s *sqlStore) Size(id string) (int64, error) {
+	var size int64
+	err := s.db.QueryRow(`SELECT size FROM queue_messages WHERE queue = $1 AND id = $2 AND broken = 0`,
+		s.queue, id).Scan(&size)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoSuchMessage
+		}
+		return 0, err
+	}
+	return size, nil
+}
+
+func (s *sqlStore) Remove(id string) error {
+	_, err := s.db.Exec(`DELETE FROM queue_messages WHERE queue = $1 AND id = $2`, s.queue, id)
+	return err
+}
+
+// MarkBroken keeps the message in the table, but excludes it from all
+// queries.
+func (s *sqlStore) MarkBroken(id string) error {
+	_, err := s.db.Exec(`UPDATE queue_messages SET broken = 1 WHERE queue = $1 AND id = $2`, s.queue, id)
+	return err
+}
+
+// Load returns messages in the order of the last delivery attempt. There is
+// nothing to clean up since each message is stored atomically.
+func (s *sqlStore) Load() ([]*QueueMetadata, error) {
+	return s.Messages()
+}
+
+func (s *sqlStore) Messages() ([]*QueueMetadata, error) {
+	rows, err := s.db.Query(`SELECT id, meta FROM queue_messages WHERE queue = $1 AND broken = 0
+		ORDER BY last_attempt`, s.queue)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var metas []*QueueMetadata
+	for rows.Next() {
+		var id, metaBlob string
+		if err := rows.Scan(&id, &metaBlob); err != nil {
+			return nil, err
+		}
+		meta, err := decodeMeta(metaBlob)
+		if err != nil {
+			s.log.Printf("failed to read meta-data, skipping: %v (msg ID = %s)", err, id)
+			continue
+		}
+		metas = append(metas, meta)
+	}
+	return metas, rows.Err()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// sqlBody is the buffer.Buffer reading the message body from the database
+// on each Open call.
+type sqlBody struct {
+	s    *sqlStore
+	id   string
+	size int
+}
+
+func (b sqlBody) Open() (io.ReadCloser, error) {
+	var bodyBlob []byte
+	err := b.s.db.QueryRow(`SELECT body FROM queue_messages WHERE queue = $1 AND id = $2`,
+		b.s.queue, b.id).Scan(&bodyBlob)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoSuchMessage
+		}
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(bodyBlob)), nil
+}
+
+func (b sqlBody) Len() int {
+	return b.size
+}
+
+// Remove does nothing, the body is removed together with the message by
+// Store.Remove.
+func (b sqlBody) Remove() error {
+	return nil
+}
@@ -0,0 +1,143 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+package queue
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func newTestSQLStore(t *testing.T, path string) *sqlStore {
+	t.Helper()
+	s, err := newSQLStore("sqlite3", path, "queue", log.Logger{Out: log.NopOutput{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSQLStore(t *testing.T) {
+	s := newTestSQLStore(t, filepath.Join(t.TempDir(), "queue.db"))
+	defer s.Close()
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "test")
+	meta := &QueueMetadata{
+		MsgMeta:     &module.MsgMetadata{ID: "msg1"},
+		From:        "sender@example.org",
+		To:          []string{"rcpt@example.org"},
+		LastAttempt: time.Now(),
+	}
+	body, err := s.Create(meta, hdr, buffer.MemoryBuffer{Slice: []byte("body")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.Len() != 4 {
+		t.Fatal("Wrong body length:", body.Len())
+	}
+
+	meta.To = []string{"rcpt2@example.org"}
+	if err := s.UpdateMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+
+	storedMeta, storedHdr, storedBody, err := s.Open("msg1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(storedMeta.To) != 1 || storedMeta.To[0] != "rcpt2@example.org" {
+		t.Error("Meta-data update is not stored:", storedMeta.To)
+	}
+	if storedHdr.Get("Subject") != "test" {
+		t.Error("Wrong header:", storedHdr)
+	}
+	r, err := storedBody.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, _ := io.ReadAll(r)
+	if string(blob) != "body" || storedBody.Len() != 4 {
+		t.Errorf("Wrong body: %q (%d)", blob, storedBody.Len())
+	}
+
+	metas, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 1 || metas[0].MsgMeta.ID != "msg1" {
+		t.Fatal("Wrong Load result:", metas)
+	}
+
+	if err := s.MarkBroken("msg1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReadMeta("msg1"); !errors.Is(err, ErrNoSuchMessage) {
+		t.Error("Broken message is still visible:", err)
+	}
+	if err := s.UpdateMeta(meta); !errors.Is(err, ErrNoSuchMessage) {
+		t.Error("Broken message meta-data is updated:", err)
+	}
+
+	if err := s.Remove("msg1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Size("msg1"); !errors.Is(err, ErrNoSuchMessage) {
+		t.Error("Message is not removed:", err)
+	}
+}
+
+func TestQueueDelivery_SQLRoundtrip(t *testing.T) {
+	t.Parallel()
+
+	dbPath := filepath.Join(t.TempDir(), "queue.db")
+	useSQL := func(q *Queue) {
+		q.store = newTestSQLStore(t, dbPath)
+		q.location = "sql:sqlite3/" + dbPath
+	}
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), true),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueueConf(t, &dt, "", useSQL)
+	q.initialRetryTime = 1 * time.Second
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester2@example.org"}, "")
+
+	q.Close()
+
+	q = newTestQueueConf(t, &dt, "", useSQL)
+
+	msg = readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	q.Close()
+
+	s := newTestSQLStore(t, dbPath)
+	defer s.Close()
+	metas, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 0 {
+		t.Error("Messages left in the queue:", len(metas))
+	}
+}
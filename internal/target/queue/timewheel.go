@@ -70,6 +70,27 @@ func (tw *TimeWheel) Add(target time.Time, value interface{}) {
 	tw.updateNotify <- target
 }
 
+// Remove removes slots with values for which match returns true. Removed
+// slots are not dispatched. It returns the amount of removed slots.
+func (tw *TimeWheel) Remove(match func(value interface{}) bool) int {
+	tw.slotsLock.Lock()
+	defer tw.slotsLock.Unlock()
+
+	removed := 0
+	for e := tw.slots.Front(); e != nil; {
+		next := e.Next()
+		if match(e.Value.(TimeSlot).Value) {
+			// tick may hold a reference to the element, let it know the
+			// slot should not be dispatched.
+			e.Value = TimeSlot{}
+			tw.slots.Remove(e)
+			removed++
+		}
+		e = next
+	}
+	return removed
+}
+
 func (tw *TimeWheel) Close() {
 	atomic.StoreUint32(&tw.stopped, 1)
 
@@ -121,10 +142,13 @@ func (tw *TimeWheel) tick() {
 			select {
 			case <-timer.C:
 				tw.slotsLock.Lock()
+				removed := closestEl.Value.(TimeSlot).Value == nil
 				tw.slots.Remove(closestEl)
 				tw.slotsLock.Unlock()
 
-				tw.dispatch(closestSlot)
+				if !removed {
+					tw.dispatch(closestSlot)
+				}
 
 				break selectloop
 			case newTarget := <-tw.updateNotify:
@@ -125,3 +125,29 @@ func TestTimeWheelAdd_EmptyUpdWait(t *testing.T) {
 		t.Errorf("Wrong slot value: %v", slot.Value)
 	}
 }
+
+func TestTimeWheelRemove(t *testing.T) {
+	t.Parallel()
+
+	called := make(chan TimeSlot)
+
+	w := NewTimeWheel(func(slot TimeSlot) {
+		called <- slot
+	})
+	defer w.Close()
+
+	w.Add(time.Now().Add(500*time.Millisecond), 1)
+	w.Add(time.Now().Add(750*time.Millisecond), 2)
+
+	removed := w.Remove(func(value interface{}) bool {
+		return value.(int) == 1
+	})
+	if removed != 1 {
+		t.Errorf("Wrong amount of removed slots: %d", removed)
+	}
+
+	slot := <-called
+	if val, _ := slot.Value.(int); val != 2 {
+		t.Errorf("Wrong slot value: %v", slot.Value)
+	}
+}
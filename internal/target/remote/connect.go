@@ -53,6 +53,9 @@ type mxConn struct {
 	// MX/TLS security level established for this connection.
 	mxLevel  module.MXLevel
 	tlsLevel module.TLSLevel
+	// How the server certificate was authenticated, see
+	// module.DeliveryInfo.TLSAuth.
+	tlsAuth string
 }
 
 func (c *mxConn) Usable() bool {
@@ -70,6 +73,31 @@ func (c *mxConn) Close() error {
 	return c.C.Close()
 }
 
+// deliveryInfo returns information about the connection to be reported
+// for successful deliveries.
+func (c *mxConn) deliveryInfo() module.DeliveryInfo {
+	info := module.DeliveryInfo{
+		RemoteServer: c.ServerName(),
+		TLSLevel:     c.tlsLevel.String(),
+		MXLevel:      c.mxLevel.String(),
+		TLSAuth:      c.tlsAuth,
+		Time:         time.Now(),
+	}
+	if c.Client() != nil {
+		info.DSNPassed = c.SupportsDSN()
+	}
+	if addr := c.RemoteAddr(); addr != nil {
+		info.RemoteAddr = addr.String()
+	}
+	if c.Client() != nil {
+		if state, ok := c.Client().TLSConnectionState(); ok {
+			info.TLSVersion = tls.VersionName(state.Version)
+			info.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+		}
+	}
+	return info
+}
+
 func isVerifyError(err error) bool {
 	var e *tls.CertificateVerificationError
 	return errors.As(err, &e)
@@ -110,6 +138,9 @@ retry:
 			// rejecting STARTTLS (despite advertising STARTTLS).
 			// We err on the caution side here and do not perform any fallbacks.
 			conn.DirectClose()
+			if ctx.Err() == nil {
+				rd.rt.mxFailures.Put(host, "tls", err)
+			}
 			return module.TLSNone, nil, err
 		}
 
@@ -171,14 +202,24 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *n
 
 	tlsLevel, tlsErr, err := rd.connect(connCtx, *conn, record.Host, rd.rt.tlsConfig)
 	if err != nil {
+		// Do not cache timeouts caused by the delivery context expiring.
+		if reason := connFailureReason(err); reason != "" && ctx.Err() == nil {
+			rd.rt.mxFailures.Put(record.Host, reason, err)
+		}
 		return err
 	}
+	rd.rt.mxFailures.Remove(record.Host)
 
 	// Make decision based on the policy and connection state.
 	//
 	// Note: All policy errors are marked as temporary to give the local admin
 	// chance to troubleshoot them without losing messages.
 
+	tlsAuth := ""
+	if tlsLevel == module.TLSAuthenticated {
+		tlsAuth = "pki"
+	}
+
 	tlsState, _ := conn.Client().TLSConnectionState()
 	for _, p := range rd.policies {
 		policyLevel, err := p.CheckConn(connCtx, mxLevel, tlsLevel, conn.domain, record.Host, tlsState)
@@ -188,11 +229,18 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *n
 		}
 		if policyLevel > tlsLevel {
 			tlsLevel = policyLevel
+
+			// DANE is the only policy that can authenticate the server
+			// when X.509 verification fails.
+			if _, ok := p.(*daneDelivery); ok && tlsLevel == module.TLSAuthenticated {
+				tlsAuth = "dane"
+			}
 		}
 	}
 
 	conn.mxLevel = mxLevel
 	conn.tlsLevel = tlsLevel
+	conn.tlsAuth = tlsAuth
 
 	mxLevelCnt.WithLabelValues(rd.rt.Name(), mxLevel.String()).Inc()
 	tlsLevelCnt.WithLabelValues(rd.rt.Name(), tlsLevel.String()).Inc()
@@ -326,6 +374,13 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 			}
 		}
 
+		if f, ok := rd.rt.mxFailures.Get(record.Host); ok {
+			rd.Log.Msg("skipping MX due to a recent connection failure", "remote_server", record.Host,
+				"domain", domain, "reason", f.reason)
+			lastErr = skippedMXError(record.Host, f)
+			continue
+		}
+
 		if err := rd.attemptMX(ctx, &conn, record); err != nil {
 			if len(records) != 0 {
 				rd.Log.Error("cannot use MX", err, "remote_server", record.Host, "domain", domain)
@@ -21,23 +21,108 @@ package remote
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
+	miekgdns "github.com/miekg/dns"
 )
 
 // Used to override verification time for DANE-TA tests.
 var verifyDANETime time.Time
 
+// Used to override the system trust anchors for PKIX-TA and PKIX-EE tests.
+var verifyDANERoots *x509.CertPool
+
+// Certificate usage values, see RFC 6698 Section 2.1.1.
+const (
+	usagePKIXTA = 0
+	usagePKIXEE = 1
+	usageDANETA = 2
+	usageDANEEE = 3
+)
+
+var errTLSAMismatch = errors.New("no matching certificate")
+
+// matchTLSA checks whether the certificate matches the TLSA record.
+//
+// Unlike dns.TLSA.Verify, it compares the association data
+// case-insensitively since it is hex-encoded in the zone.
+func matchTLSA(rec dns.TLSA, cert *x509.Certificate) error {
+	data, err := miekgdns.CertificateToDANE(rec.Selector, rec.MatchingType, cert)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(data, rec.Certificate) {
+		return errTLSAMismatch
+	}
+	return nil
+}
+
+// tlsaCertificate returns the certificate contained in the "full
+// certificate" (selector 0, matching type 0) record.
+func tlsaCertificate(rec dns.TLSA) *x509.Certificate {
+	if rec.Selector != 0 || rec.MatchingType != 0 {
+		return nil
+	}
+	der, err := hex.DecodeString(rec.Certificate)
+	if err != nil {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil
+	}
+	return cert
+}
+
+// tlsaFailures collects per-record reasons for the verification failure.
+type tlsaFailures []string
+
+func (f *tlsaFailures) add(rec dns.TLSA, reason string) {
+	*f = append(*f, fmt.Sprintf("%d %d %d: %s", rec.Usage, rec.Selector, rec.MatchingType, reason))
+}
+
+// verifyChain runs X.509 verification for the server certificate against
+// roots and checks it against any of names.
+func verifyChain(connState tls.ConnectionState, roots *x509.CertPool, names []string) ([][]*x509.Certificate, error) {
+	opts := x509.VerifyOptions{
+		Intermediates: x509.NewCertPool(),
+		Roots:         roots,
+		CurrentTime:   verifyDANETime,
+	}
+	for _, cert := range connState.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	var lastErr error
+	for _, name := range names {
+		opts.DNSName = strings.TrimSuffix(name, ".")
+		chains, err := connState.PeerCertificates[0].Verify(opts)
+		if err == nil {
+			return chains, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
 // verifyDANE checks whether TLSA records require TLS use and match the
 // certificate and name used by the server.
 //
+// names are the acceptable reference identifiers for the server, see RFC
+// 7672 Section 3.2.3. They are used for DANE-TA, PKIX-TA and PKIX-EE
+// records. PKIX-TA and PKIX-EE records are ignored unless pkixUsages is set.
+//
 // overridePKIX result indicates whether DANE should make server authentication
 // succeed even if PKIX/X.509 verification fails. That is, if InsecureSkipVerify
 // is used and verifyDANE returns overridePKIX=true, the server certificate
 // should trusted.
-func verifyDANE(recs []dns.TLSA, connState tls.ConnectionState) (overridePKIX bool, err error) {
+func verifyDANE(recs []dns.TLSA, names []string, connState tls.ConnectionState, pkixUsages bool) (overridePKIX bool, err error) {
 	tlsErr := &exterrors.SMTPError{
 		Code:         550,
 		EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
@@ -63,8 +148,9 @@ func verifyDANE(recs []dns.TLSA, connState tls.ConnectionState) (overridePKIX bo
 
 	// Ignore invalid records.
 	var (
-		eeRecs []dns.TLSA
-		taRecs []dns.TLSA
+		eeRecs   []dns.TLSA
+		taRecs   []dns.TLSA
+		pkixRecs []dns.TLSA
 	)
 	for _, rec := range recs {
 		switch rec.MatchingType {
@@ -79,9 +165,13 @@ func verifyDANE(recs []dns.TLSA, connState tls.ConnectionState) (overridePKIX bo
 		}
 
 		switch rec.Usage {
-		case 2:
+		case usagePKIXTA, usagePKIXEE:
+			if pkixUsages {
+				pkixRecs = append(pkixRecs, rec)
+			}
+		case usageDANETA:
 			taRecs = append(taRecs, rec)
-		case 3:
+		case usageDANEEE:
 			eeRecs = append(eeRecs, rec)
 		default:
 			continue
@@ -90,61 +180,35 @@ func verifyDANE(recs []dns.TLSA, connState tls.ConnectionState) (overridePKIX bo
 
 	// Authentication is not required if all records are unusable, see
 	// RFC 7672 Section 2.1.1.
-	if len(eeRecs) == 0 && len(taRecs) == 0 {
+	if len(eeRecs) == 0 && len(taRecs) == 0 && len(pkixRecs) == 0 {
 		return false, nil
 	}
 
+	var failures tlsaFailures
+
 	for _, rec := range eeRecs {
-		if rec.Verify(connState.PeerCertificates[0]) == nil {
-			// https://tools.ietf.org/html/rfc7672#section-3.1.1
-			// - SAN/CN are not considered.
-			// - Expired certificates are fine too.
+		// https://tools.ietf.org/html/rfc7672#section-3.1.1
+		// - SAN/CN are not considered.
+		// - Expired certificates are fine too.
+		err := matchTLSA(rec, connState.PeerCertificates[0])
+		if err == nil {
 			return true, nil
 		}
+		failures.add(rec, "server certificate: "+err.Error())
 	}
 
-	// Don't bother building a temporary certificate pool if there are no
-	// records to check.
-	if len(taRecs) == 0 {
-		return true, &exterrors.SMTPError{
-			Code:         550,
-			EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
-			Message:      "No matching TLSA records",
-			TargetName:   "remote",
-			Misc: map[string]interface{}{
-				"remote_server": connState.ServerName,
-			},
+	if len(taRecs) != 0 {
+		if verifyDANETA(taRecs, names, connState, &failures) {
+			return true, nil
 		}
 	}
 
-	// Collect certificates presented by the server as possible intermediates.
-	// Add all certificates from the chain that match any record to the root
-	// pool.
-	opts := x509.VerifyOptions{
-		DNSName:       connState.ServerName,
-		Intermediates: x509.NewCertPool(),
-		Roots:         x509.NewCertPool(),
-		CurrentTime:   verifyDANETime,
-	}
-	for _, cert := range connState.PeerCertificates {
-		root := false
-		for _, rec := range taRecs {
-			if cert.IsCA && rec.Verify(cert) == nil {
-				opts.Roots.AddCert(cert)
-				root = true
-			}
-		}
-		if !root {
-			opts.Intermediates.AddCert(cert)
+	if len(pkixRecs) != 0 {
+		if verifyPKIXUsages(pkixRecs, names, connState, &failures) {
+			return true, nil
 		}
 	}
 
-	// ... then run the standard X.509 verification. This will verify that the
-	// server certificate chains to any of asserted TA certificates.
-	if _, err := connState.PeerCertificates[0].Verify(opts); err == nil {
-		return true, nil
-	}
-
 	// There are valid records, but none matched.
 	return false, &exterrors.SMTPError{
 		Code:         550,
@@ -153,6 +217,90 @@ func verifyDANE(recs []dns.TLSA, connState tls.ConnectionState) (overridePKIX bo
 		TargetName:   "remote",
 		Misc: map[string]interface{}{
 			"remote_server": connState.ServerName,
+			"tlsa_failures": []string(failures),
 		},
 	}
 }
+
+// verifyDANETA checks the server certificate against DANE-TA(2) records.
+//
+// The trust anchor is either a certificate presented by the server that
+// matches the record or the full certificate from the record itself. Per RFC
+// 7672 Section 3.1.2, the validity period of the trust anchor is not checked
+// but the server name is.
+func verifyDANETA(taRecs []dns.TLSA, names []string, connState tls.ConnectionState, failures *tlsaFailures) bool {
+	roots := x509.NewCertPool()
+	matched := make([]bool, len(taRecs))
+	for i, rec := range taRecs {
+		if cert := tlsaCertificate(rec); cert != nil {
+			roots.AddCert(cert)
+			matched[i] = true
+		}
+		for _, cert := range connState.PeerCertificates {
+			if cert.IsCA && matchTLSA(rec, cert) == nil {
+				roots.AddCert(cert)
+				matched[i] = true
+			}
+		}
+	}
+
+	anyMatched := false
+	for i, rec := range taRecs {
+		if !matched[i] {
+			failures.add(rec, "server chain: "+errTLSAMismatch.Error())
+			continue
+		}
+		anyMatched = true
+	}
+	if !anyMatched {
+		return false
+	}
+
+	// ... then run the standard X.509 verification. This will verify that the
+	// server certificate chains to any of asserted TA certificates.
+	_, err := verifyChain(connState, roots, names)
+	if err == nil {
+		return true
+	}
+	for i, rec := range taRecs {
+		if matched[i] {
+			failures.add(rec, "chain verification: "+err.Error())
+		}
+	}
+	return false
+}
+
+// verifyPKIXUsages checks the server certificate against PKIX-TA(0) and
+// PKIX-EE(1) records. In addition to matching the record, the certificate
+// should pass regular X.509 verification using system trust anchors.
+func verifyPKIXUsages(pkixRecs []dns.TLSA, names []string, connState tls.ConnectionState, failures *tlsaFailures) bool {
+	chains, err := verifyChain(connState, verifyDANERoots, names)
+	if err != nil {
+		for _, rec := range pkixRecs {
+			failures.add(rec, "PKIX verification: "+err.Error())
+		}
+		return false
+	}
+
+	for _, rec := range pkixRecs {
+		switch rec.Usage {
+		case usagePKIXEE:
+			err := matchTLSA(rec, connState.PeerCertificates[0])
+			if err == nil {
+				return true
+			}
+			failures.add(rec, "server certificate: "+err.Error())
+		case usagePKIXTA:
+			for _, chain := range chains {
+				// Leaf certificate cannot be a trust anchor.
+				for _, cert := range chain[1:] {
+					if matchTLSA(rec, cert) == nil {
+						return true
+					}
+				}
+			}
+			failures.add(rec, "verified chain: "+errTLSAMismatch.Error())
+		}
+	}
+	return false
+}
@@ -104,8 +104,19 @@ func TestRemoteDelivery_DANE_Ok(t *testing.T) {
 		},
 	)
 
-	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	c := &infoCollector{
+		infos: map[string]module.DeliveryInfo{},
+		errs:  map[string]error{},
+	}
+	testutils.DoTestDeliveryNonAtomic(t, c, tgt, "test@example.com", []string{"test@example.invalid"})
 	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+
+	if err := c.errs["test@example.invalid"]; err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if info := c.infos["test@example.invalid"]; info.TLSLevel != "authenticated" || info.TLSAuth != "dane" {
+		t.Error("Wrong TLS level:", info.TLSLevel, info.TLSAuth)
+	}
 }
 
 func TestRemoteDelivery_DANE_CNAMEd_1(t *testing.T) {
@@ -20,13 +20,17 @@ package remote
 
 import (
 	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/pem"
+	"errors"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/miekg/dns"
 )
 
@@ -117,13 +121,31 @@ func keySHA256(blob string) string {
 	return hex.EncodeToString(hash[:])
 }
 
+func keySHA512(blob string) string {
+	cert := parsePEMCert(blob)
+	hash := sha512.Sum512(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(hash[:])
+}
+
+func certFull(blob string) string {
+	return hex.EncodeToString(parsePEMCert(blob).Raw)
+}
+
+func certPool(blobs ...string) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, blob := range blobs {
+		pool.AddCert(parsePEMCert(blob))
+	}
+	return pool
+}
+
 func TestVerifyDANE(t *testing.T) {
 	verifyDANETime = time.Unix(1606600100, 0)
 	test := func(name string, recs []dns.TLSA, connState tls.ConnectionState, expectErr bool) {
 		t.Helper()
 		t.Run(name, func(t *testing.T) {
 			t.Helper()
-			_, err := verifyDANE(recs, connState)
+			_, err := verifyDANE(recs, []string{"maddy.test."}, connState, false)
 			if (err != nil) != expectErr {
 				t.Error("err:", err, "expectErr:", expectErr)
 			}
@@ -225,3 +247,150 @@ func TestVerifyDANE(t *testing.T) {
 		},
 	}, false)
 }
+
+func TestVerifyDANE_MatchingTypes(t *testing.T) {
+	verifyDANETime = time.Unix(1606600100, 0)
+	connState := tls.ConnectionState{
+		HandshakeComplete: true,
+		PeerCertificates:  []*x509.Certificate{parsePEMCert(leafA)},
+	}
+	test := func(name string, rec dns.TLSA, expectErr bool) {
+		t.Helper()
+		t.Run(name, func(t *testing.T) {
+			t.Helper()
+			_, err := verifyDANE([]dns.TLSA{rec}, []string{"maddy.test."}, connState, false)
+			if (err != nil) != expectErr {
+				t.Error("err:", err, "expectErr:", expectErr)
+			}
+		})
+	}
+
+	test("full certificate", singleTlsaRecord(3, 0, 0, certFull(leafA)), false)
+	test("SHA-256", singleTlsaRecord(3, 1, 1, keySHA256(leafA)), false)
+	test("SHA-512", singleTlsaRecord(3, 2, 1, keySHA512(leafA)), false)
+	test("SHA-512, mismatch", singleTlsaRecord(3, 2, 1, keySHA512(leafB)), true)
+	test("upper-case hex", singleTlsaRecord(3, 1, 1, strings.ToUpper(keySHA256(leafA))), false)
+}
+
+func TestVerifyDANE_TANames(t *testing.T) {
+	verifyDANETime = time.Unix(1606600100, 0)
+	chainA := tls.ConnectionState{
+		HandshakeComplete: true,
+		PeerCertificates: []*x509.Certificate{
+			parsePEMCert(leafA),
+			parsePEMCert(intermediateA),
+		},
+	}
+	test := func(name string, recs []dns.TLSA, names []string, expectErr bool) {
+		t.Helper()
+		t.Run(name, func(t *testing.T) {
+			t.Helper()
+			_, err := verifyDANE(recs, names, chainA, false)
+			if (err != nil) != expectErr {
+				t.Error("err:", err, "expectErr:", expectErr)
+			}
+		})
+	}
+
+	test("name mismatch", []dns.TLSA{
+		singleTlsaRecord(2, 1, 1, keySHA256(intermediateA)),
+	}, []string{"mx.example.invalid."}, true)
+	// RFC 7672, Section 3.2.3. Both the TLSA base domain and the MX hostname
+	// are accepted.
+	test("CNAME-expanded name", []dns.TLSA{
+		singleTlsaRecord(2, 1, 1, keySHA256(intermediateA)),
+	}, []string{"maddy.test.", "mx.example.invalid."}, false)
+	test("MX name", []dns.TLSA{
+		singleTlsaRecord(2, 1, 1, keySHA256(intermediateA)),
+	}, []string{"mx.example.invalid.", "maddy.test."}, false)
+	// The full TA certificate may be published in DNS instead of being sent
+	// by the server.
+	test("full TA certificate not in chain", []dns.TLSA{
+		singleTlsaRecord(2, 0, 0, certFull(rootA)),
+	}, []string{"maddy.test."}, false)
+	test("TA digest not in chain", []dns.TLSA{
+		singleTlsaRecord(2, 1, 1, keySHA256(rootA)),
+	}, []string{"maddy.test."}, true)
+	test("SHA-512 TA", []dns.TLSA{
+		singleTlsaRecord(2, 2, 1, keySHA512(intermediateA)),
+	}, []string{"maddy.test."}, false)
+}
+
+func TestVerifyDANE_PKIXUsages(t *testing.T) {
+	verifyDANETime = time.Unix(1606600100, 0)
+	defer func() { verifyDANERoots = nil }()
+
+	chainA := tls.ConnectionState{
+		HandshakeComplete: true,
+		PeerCertificates: []*x509.Certificate{
+			parsePEMCert(leafA),
+			parsePEMCert(intermediateA),
+		},
+	}
+	test := func(name string, recs []dns.TLSA, roots *x509.CertPool, pkixUsages, expectOverride, expectErr bool) {
+		t.Helper()
+		t.Run(name, func(t *testing.T) {
+			t.Helper()
+			verifyDANERoots = roots
+			override, err := verifyDANE(recs, []string{"maddy.test."}, chainA, pkixUsages)
+			if (err != nil) != expectErr {
+				t.Error("err:", err, "expectErr:", expectErr)
+			}
+			if override != expectOverride {
+				t.Error("override:", override, "expectOverride:", expectOverride)
+			}
+		})
+	}
+
+	test("PKIX-EE", []dns.TLSA{
+		singleTlsaRecord(1, 1, 1, keySHA256(leafA)),
+	}, certPool(rootA), true, true, false)
+	test("PKIX-EE, disabled", []dns.TLSA{
+		singleTlsaRecord(1, 1, 1, keySHA256(leafA)),
+	}, certPool(rootA), false, false, false)
+	test("PKIX-EE, mismatch", []dns.TLSA{
+		singleTlsaRecord(1, 1, 1, keySHA256(leafB)),
+	}, certPool(rootA), true, false, true)
+	test("PKIX-EE, untrusted", []dns.TLSA{
+		singleTlsaRecord(1, 1, 1, keySHA256(leafA)),
+	}, certPool(rootB), true, false, true)
+	test("PKIX-TA, root", []dns.TLSA{
+		singleTlsaRecord(0, 1, 1, keySHA256(rootA)),
+	}, certPool(rootA), true, true, false)
+	test("PKIX-TA, intermediate", []dns.TLSA{
+		singleTlsaRecord(0, 2, 1, keySHA512(intermediateA)),
+	}, certPool(rootA), true, true, false)
+	test("PKIX-TA, leaf", []dns.TLSA{
+		singleTlsaRecord(0, 1, 1, keySHA256(leafA)),
+	}, certPool(rootA), true, false, true)
+	test("PKIX-TA, untrusted", []dns.TLSA{
+		singleTlsaRecord(0, 1, 1, keySHA256(rootB)),
+	}, certPool(rootB), true, false, true)
+}
+
+func TestVerifyDANE_Diagnostics(t *testing.T) {
+	verifyDANETime = time.Unix(1606600100, 0)
+	_, err := verifyDANE([]dns.TLSA{
+		singleTlsaRecord(3, 1, 1, keySHA256(leafB)),
+		singleTlsaRecord(2, 1, 1, keySHA256(rootB)),
+	}, []string{"maddy.test."}, tls.ConnectionState{
+		HandshakeComplete: true,
+		PeerCertificates:  []*x509.Certificate{parsePEMCert(leafA)},
+	}, false)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) {
+		t.Fatal("Not an SMTPError:", err)
+	}
+	failures, _ := smtpErr.Misc["tlsa_failures"].([]string)
+	expected := []string{
+		"3 1 1: server certificate: no matching certificate",
+		"2 1 1: server chain: no matching certificate",
+	}
+	if strings.Join(failures, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Wrong tlsa_failures: %q", failures)
+	}
+}
@@ -40,7 +40,19 @@ var tlsLevelCnt = prometheus.NewCounterVec(
 	[]string{"module", "level"},
 )
 
+var deliveryDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "maddy",
+		Subsystem: "remote",
+		Name:      "delivery_duration_seconds",
+		Help:      "Time spent delivering a message to a destination domain, including connection establishment",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	},
+	[]string{"module", "result"},
+)
+
 func init() {
 	prometheus.MustRegister(mxLevelCnt)
 	prometheus.MustRegister(tlsLevelCnt)
+	prometheus.MustRegister(deliveryDuration)
 }
@@ -0,0 +1,381 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/go-mtasts"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/internal/redis"
+	_ "github.com/lib/pq"
+)
+
+// The go-mtasts stores do not allow removing cached policies so we wrap
+// them to support flushing via the control socket.
+
+// fsPolicyStore is the mtasts.Store that keeps policies in the directory,
+// using the same layout as mtasts.NewFSCache.
+type fsPolicyStore struct {
+	fs  mtasts.Store
+	dir string
+}
+
+func newFSPolicyStore(dir string) *fsPolicyStore {
+	return &fsPolicyStore{
+		fs:  mtasts.NewFSCache(dir).Store,
+		dir: dir,
+	}
+}
+
+func (s *fsPolicyStore) List() ([]string, error) {
+	return s.fs.List()
+}
+
+func (s *fsPolicyStore) Store(domain, id string, fetchTime time.Time, policy *mtasts.Policy) error {
+	return s.fs.Store(domain, id, fetchTime, policy)
+}
+
+func (s *fsPolicyStore) Load(domain string) (string, time.Time, *mtasts.Policy, error) {
+	return s.fs.Load(domain)
+}
+
+func (s *fsPolicyStore) FlushCache(domain string) int {
+	var names []string
+	if domain == "" {
+		var err error
+		names, err = s.fs.List()
+		if err != nil {
+			return 0
+		}
+	} else {
+		domain, err := dns.ForLookup(domain)
+		if err != nil || domain == "" || strings.ContainsAny(domain, `/\`) || strings.HasPrefix(domain, ".") {
+			return 0
+		}
+		names = []string{domain}
+	}
+
+	removed := 0
+	for _, name := range names {
+		if err := os.Remove(filepath.Join(s.dir, name)); err == nil {
+			removed++
+		}
+	}
+	return removed
+}
+
+type ramPolicy struct {
+	id        string
+	fetchTime time.Time
+	policy    *mtasts.Policy
+}
+
+// ramPolicyStore is the in-memory mtasts.Store.
+type ramPolicyStore struct {
+	lock     sync.RWMutex
+	policies map[string]ramPolicy
+}
+
+func newRAMPolicyStore() *ramPolicyStore {
+	return &ramPolicyStore{policies: make(map[string]ramPolicy)}
+}
+
+func (s *ramPolicyStore) List() ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	keys := make([]string, 0, len(s.policies))
+	for k := range s.policies {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (s *ramPolicyStore) Store(domain, id string, fetchTime time.Time, policy *mtasts.Policy) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.policies[domain] = ramPolicy{id: id, fetchTime: fetchTime, policy: policy}
+	return nil
+}
+
+func (s *ramPolicyStore) Load(domain string) (string, time.Time, *mtasts.Policy, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	p, ok := s.policies[domain]
+	if !ok {
+		return "", time.Time{}, nil, mtasts.ErrNoPolicy
+	}
+	return p.id, p.fetchTime, p.policy, nil
+}
+
+func (s *ramPolicyStore) FlushCache(domain string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if domain == "" {
+		removed := len(s.policies)
+		s.policies = make(map[string]ramPolicy)
+		return removed
+	}
+
+	domain, err := dns.ForLookup(domain)
+	if err != nil {
+		return 0
+	}
+	if _, ok := s.policies[domain]; !ok {
+		return 0
+	}
+	delete(s.policies, domain)
+	return 1
+}
+
+// storedPolicy is the serialized form of the cached policy, it matches the
+// format used by mtasts.NewFSCache.
+type storedPolicy struct {
+	ID        string
+	FetchTime time.Time
+	Policy    *mtasts.Policy
+}
+
+// sqlPolicyStore keeps policies in the SQL database so they can be shared
+// by multiple instances.
+type sqlPolicyStore struct {
+	db *sql.DB
+}
+
+func newSQLPolicyStore(driver, dsn string) (*sqlPolicyStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS mtasts_policies (
+		domain TEXT NOT NULL PRIMARY KEY,
+		id TEXT NOT NULL,
+		fetch_time BIGINT NOT NULL,
+		policy TEXT NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlPolicyStore{db: db}, nil
+}
+
+func (s *sqlPolicyStore) List() ([]string, error) {
+	rows, err := s.db.Query(`SELECT domain FROM mtasts_policies`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var domains []string
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+	return domains, rows.Err()
+}
+
+func (s *sqlPolicyStore) Store(domain, id string, fetchTime time.Time, policy *mtasts.Policy) error {
+	policyBlob, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO mtasts_policies (domain, id, fetch_time, policy)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (domain) DO UPDATE SET
+			id = excluded.id, fetch_time = excluded.fetch_time, policy = excluded.policy`,
+		domain, id, fetchTime.Unix(), string(policyBlob))
+	return err
+}
+
+func (s *sqlPolicyStore) Load(domain string) (string, time.Time, *mtasts.Policy, error) {
+	var (
+		id         string
+		fetchTime  int64
+		policyBlob string
+	)
+	err := s.db.QueryRow(`SELECT id, fetch_time, policy FROM mtasts_policies WHERE domain = $1`, domain).
+		Scan(&id, &fetchTime, &policyBlob)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", time.Time{}, nil, mtasts.ErrNoPolicy
+		}
+		return "", time.Time{}, nil, err
+	}
+
+	var policy mtasts.Policy
+	if err := json.Unmarshal([]byte(policyBlob), &policy); err != nil {
+		return "", time.Time{}, nil, err
+	}
+	return id, time.Unix(fetchTime, 0), &policy, nil
+}
+
+func (s *sqlPolicyStore) FlushCache(domain string) int {
+	var (
+		res sql.Result
+		err error
+	)
+	if domain == "" {
+		res, err = s.db.Exec(`DELETE FROM mtasts_policies`)
+	} else {
+		domain, err = dns.ForLookup(domain)
+		if err != nil {
+			return 0
+		}
+		res, err = s.db.Exec(`DELETE FROM mtasts_policies WHERE domain = $1`, domain)
+	}
+	if err != nil {
+		return 0
+	}
+	removed, _ := res.RowsAffected()
+	return int(removed)
+}
+
+func (s *sqlPolicyStore) Close() error {
+	return s.db.Close()
+}
+
+// redisPolicyStore keeps policies in Redis so they can be shared by multiple
+// instances. Keys expire together with policies.
+type redisPolicyStore struct {
+	c      *redis.Client
+	prefix string
+}
+
+func newRedisPolicyStore(redisURL, prefix string) (*redisPolicyStore, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	c, err := redis.NewClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &redisPolicyStore{c: c, prefix: prefix}, nil
+}
+
+func (s *redisPolicyStore) List() ([]string, error) {
+	pattern := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`).Replace(s.prefix) + "*"
+
+	var domains []string
+	cursor := "0"
+	for {
+		reply, err := s.c.Do("SCAN", cursor, "MATCH", pattern, "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return nil, fmt.Errorf("redis: unexpected SCAN reply: %v", reply)
+		}
+		cursor, _ = parts[0].(string)
+		keys, _ := parts[1].([]interface{})
+		for _, k := range keys {
+			key, _ := k.(string)
+			domains = append(domains, strings.TrimPrefix(key, s.prefix))
+		}
+		if cursor == "0" || cursor == "" {
+			return domains, nil
+		}
+	}
+}
+
+func (s *redisPolicyStore) Store(domain, id string, fetchTime time.Time, policy *mtasts.Policy) error {
+	blob, err := json.Marshal(storedPolicy{ID: id, FetchTime: fetchTime, Policy: policy})
+	if err != nil {
+		return err
+	}
+	args := []string{"SET", s.prefix + domain, string(blob)}
+	if policy.MaxAge > 0 {
+		args = append(args, "EX", strconv.Itoa(policy.MaxAge))
+	}
+	_, err = s.c.Do(args...)
+	return err
+}
+
+func (s *redisPolicyStore) Load(domain string) (string, time.Time, *mtasts.Policy, error) {
+	reply, err := s.c.Do("GET", s.prefix+domain)
+	if err != nil {
+		return "", time.Time{}, nil, err
+	}
+	blob, ok := reply.(string)
+	if !ok {
+		return "", time.Time{}, nil, mtasts.ErrNoPolicy
+	}
+
+	var p storedPolicy
+	if err := json.Unmarshal([]byte(blob), &p); err != nil {
+		return "", time.Time{}, nil, err
+	}
+	if p.Policy == nil {
+		return "", time.Time{}, nil, mtasts.ErrNoPolicy
+	}
+	return p.ID, p.FetchTime, p.Policy, nil
+}
+
+func (s *redisPolicyStore) FlushCache(domain string) int {
+	var domains []string
+	if domain == "" {
+		var err error
+		domains, err = s.List()
+		if err != nil {
+			return 0
+		}
+	} else {
+		domain, err := dns.ForLookup(domain)
+		if err != nil {
+			return 0
+		}
+		domains = []string{domain}
+	}
+	if len(domains) == 0 {
+		return 0
+	}
+
+	args := make([]string, 0, len(domains)+1)
+	args = append(args, "DEL")
+	for _, d := range domains {
+		args = append(args, s.prefix+d)
+	}
+	reply, err := s.c.Do(args...)
+	if err != nil {
+		return 0
+	}
+	removed, _ := reply.(int64)
+	return int(removed)
+}
+
+func (s *redisPolicyStore) Close() error {
+	return s.c.Close()
+}
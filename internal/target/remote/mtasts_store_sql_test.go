@@ -0,0 +1,19 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+package remote
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyStore_SQL(t *testing.T) {
+	store, err := newSQLPolicyStore("sqlite3", filepath.Join(t.TempDir(), "mtasts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	testPolicyStore(t, store)
+}
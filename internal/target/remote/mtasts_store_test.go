@@ -0,0 +1,90 @@
+package remote
+
+import (
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mtasts"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type flushableStore interface {
+	mtasts.Store
+	FlushCache(string) int
+}
+
+func testPolicyStore(t *testing.T, store flushableStore) {
+	t.Helper()
+
+	policy := &mtasts.Policy{Mode: mtasts.ModeEnforce, MX: []string{"mx.example.org"}, MaxAge: 3600}
+	fetchTime := time.Unix(1700000000, 0)
+	for _, domain := range []string{"example.org", "example.com"} {
+		if err := store.Store(domain, "id1", fetchTime, policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Replace existing entry.
+	if err := store.Store("example.com", "id2", fetchTime, policy); err != nil {
+		t.Fatal(err)
+	}
+
+	id, loadedTime, loaded, err := store.Load("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "id2" || !loadedTime.Equal(fetchTime) || loaded.Mode != mtasts.ModeEnforce ||
+		len(loaded.MX) != 1 || loaded.MX[0] != "mx.example.org" || loaded.MaxAge != 3600 {
+		t.Errorf("wrong policy loaded: %v %v %+v", id, loadedTime, loaded)
+	}
+
+	if removed := store.FlushCache("EXAMPLE.org."); removed != 1 {
+		t.Errorf("expected 1 policy removed, got %d", removed)
+	}
+	if _, _, _, err := store.Load("example.org"); err != mtasts.ErrNoPolicy {
+		t.Errorf("expected ErrNoPolicy, got %v", err)
+	}
+	if _, _, _, err := store.Load("example.com"); err != nil {
+		t.Errorf("unexpected error for example.com: %v", err)
+	}
+	if removed := store.FlushCache("../example.com"); removed != 0 {
+		t.Errorf("expected nothing removed, got %d", removed)
+	}
+
+	if removed := store.FlushCache(""); removed != 1 {
+		t.Errorf("expected 1 policy removed, got %d", removed)
+	}
+	list, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Errorf("policies left after flush: %v", list)
+	}
+}
+
+func TestPolicyStore(t *testing.T) {
+	t.Run("fs", func(t *testing.T) {
+		testPolicyStore(t, newFSPolicyStore(t.TempDir()))
+	})
+	t.Run("ram", func(t *testing.T) {
+		testPolicyStore(t, newRAMPolicyStore())
+	})
+	t.Run("redis", func(t *testing.T) {
+		srv := testutils.NewRedisServer(t, "")
+		store, err := newRedisPolicyStore(srv.URL(), "test.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+
+		if err := store.Store("example.net", "id", time.Now(), &mtasts.Policy{MaxAge: 600}); err != nil {
+			t.Fatal(err)
+		}
+		if ttl := srv.KeyTTL("test.example.net"); ttl != 600 {
+			t.Errorf("expected key to expire with the policy, got TTL %d", ttl)
+		}
+		store.FlushCache("")
+
+		testPolicyStore(t, store)
+	})
+}
@@ -0,0 +1,137 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/ttlcache"
+)
+
+// mxFailure is a recent connection failure for a particular MX host.
+type mxFailure struct {
+	reason string
+	err    error
+	until  time.Time
+}
+
+// maxMXFailureEntries limits the amount of MX hosts remembered by
+// mxFailureCache.
+const maxMXFailureEntries = 10000
+
+// mxFailureCache keeps track of MX hosts that recently failed to accept
+// connections so deliveries to other messages can skip them instead of
+// waiting for the same timeout again.
+//
+// nil *mxFailureCache is valid and does not cache anything.
+type mxFailureCache struct {
+	ttl     time.Duration
+	entries *ttlcache.Cache[string, mxFailure]
+}
+
+func newMXFailureCache(ttl time.Duration) *mxFailureCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &mxFailureCache{
+		ttl:     ttl,
+		entries: ttlcache.New[string, mxFailure](maxMXFailureEntries),
+	}
+}
+
+// Get returns the cached failure for the MX host, if any.
+func (c *mxFailureCache) Get(host string) (mxFailure, bool) {
+	if c == nil {
+		return mxFailure{}, false
+	}
+	return c.entries.Get(strings.ToLower(host))
+}
+
+func (c *mxFailureCache) Put(host, reason string, err error) {
+	if c == nil {
+		return
+	}
+	c.entries.Put(strings.ToLower(host), mxFailure{
+		reason: reason,
+		err:    err,
+		until:  time.Now().Add(c.ttl),
+	}, c.ttl)
+}
+
+func (c *mxFailureCache) Remove(host string) {
+	if c == nil {
+		return
+	}
+	c.entries.Remove(strings.ToLower(host))
+}
+
+// FlushCache implements cacheflush.Flusher. The key is the MX hostname.
+func (c *mxFailureCache) FlushCache(host string) int {
+	if c == nil {
+		return 0
+	}
+
+	if host == "" {
+		return c.entries.Clear()
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return c.entries.RemoveFunc(func(k string) bool {
+		return strings.TrimSuffix(k, ".") == host
+	})
+}
+
+// connFailureReason returns the short description of the connection-level
+// failure represented by err or an empty string if err is not such failure
+// (e.g. the server rejected the connection using an SMTP reply).
+func connFailureReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return ""
+}
+
+// skippedMXError is returned for MX hosts that are skipped because of
+// a recent connection failure.
+func skippedMXError(host string, f mxFailure) error {
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 4, 1},
+		Message:      "Recent connection failure, not retrying yet",
+		TargetName:   "remote",
+		Err:          f.err,
+		Misc: map[string]interface{}{
+			"remote_server":  host,
+			"failure_reason": f.reason,
+			"retry_after":    f.until,
+		},
+	}
+}
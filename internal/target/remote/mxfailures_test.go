@@ -0,0 +1,148 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMXFailureCache(t *testing.T) {
+	c := newMXFailureCache(50 * time.Millisecond)
+
+	if _, ok := c.Get("mx.example.invalid."); ok {
+		t.Fatal("Unexpected entry in the empty cache")
+	}
+
+	c.Put("MX.example.invalid.", "refused", errors.New("refused"))
+	f, ok := c.Get("mx.example.invalid.")
+	if !ok {
+		t.Fatal("Missing entry")
+	}
+	if f.reason != "refused" {
+		t.Error("Wrong reason:", f.reason)
+	}
+
+	c.Remove("mx.example.invalid.")
+	if _, ok := c.Get("mx.example.invalid."); ok {
+		t.Fatal("Entry not removed")
+	}
+
+	c.Put("mx.example.invalid.", "timeout", errors.New("timeout"))
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := c.Get("mx.example.invalid."); ok {
+		t.Fatal("Entry not expired")
+	}
+
+	if newMXFailureCache(0) != nil {
+		t.Fatal("Cache should be disabled for zero TTL")
+	}
+	var disabled *mxFailureCache
+	disabled.Put("mx.example.invalid.", "refused", errors.New("refused"))
+	if _, ok := disabled.Get("mx.example.invalid."); ok {
+		t.Fatal("nil cache returned an entry")
+	}
+}
+
+func TestMXFailureCache_Limit(t *testing.T) {
+	c := newMXFailureCache(time.Minute)
+	for i := 0; i < maxMXFailureEntries+10; i++ {
+		c.Put("mx"+strconv.Itoa(i)+".example.invalid.", "refused", errors.New("refused"))
+	}
+	if n := c.entries.Len(); n != maxMXFailureEntries {
+		t.Fatal("Cache size is not limited:", n)
+	}
+	if _, ok := c.Get("mx0.example.invalid."); ok {
+		t.Fatal("Oldest entry is not evicted")
+	}
+}
+
+func TestMXFailureCache_Flush(t *testing.T) {
+	c := newMXFailureCache(time.Minute)
+	c.Put("mx1.example.invalid.", "refused", errors.New("refused"))
+	c.Put("mx2.example.invalid.", "timeout", errors.New("timeout"))
+
+	if n := c.FlushCache("MX1.example.invalid"); n != 1 {
+		t.Fatal("Expected 1 entry to be removed, got", n)
+	}
+	if _, ok := c.Get("mx1.example.invalid."); ok {
+		t.Fatal("Entry not flushed")
+	}
+	if n := c.FlushCache(""); n != 1 {
+		t.Fatal("Expected 1 entry to be removed, got", n)
+	}
+	if _, ok := c.Get("mx2.example.invalid."); ok {
+		t.Fatal("Entry not flushed")
+	}
+}
+
+func TestConnFailureReason(t *testing.T) {
+	for _, c := range []struct {
+		err    error
+		reason string
+	}{
+		{&net.OpError{Op: "dial", Err: &net.DNSError{IsTimeout: true}}, "timeout"},
+		{context.DeadlineExceeded, "timeout"},
+		{&exterrors.SMTPError{Code: 450, Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, ""},
+		{&exterrors.SMTPError{Code: 554, Message: "Go away"}, ""},
+	} {
+		if reason := connFailureReason(c.err); reason != c.reason {
+			t.Errorf("%v: want %q, got %q", c.err, c.reason, reason)
+		}
+	}
+}
+
+func TestRemoteDelivery_DownMX_Cached(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{
+				{Host: "mx1.example.invalid.", Pref: 20},
+				{Host: "mx2.example.invalid.", Pref: 10},
+			},
+		},
+		"mx1.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+		"mx2.example.invalid.": {
+			A: []string{"127.0.0.2"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	defer tgt.Close()
+	tgt.mxFailures = newMXFailureCache(time.Minute)
+	// Do not reuse connections so each delivery has to pick the MX.
+	tgt.connReuseLimit = -1
+
+	var downDials int32
+	dial := tgt.dialer
+	tgt.dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if strings.HasPrefix(addr, "mx2.example.invalid") {
+			atomic.AddInt32(&downDials, 1)
+		}
+		return dial(ctx, network, addr)
+	}
+
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 1, "test@example.com", []string{"test@example.invalid"})
+
+	if n := atomic.LoadInt32(&downDials); n != 1 {
+		t.Fatal("Expected one connection attempt to the down MX, got", n)
+	}
+	if f, ok := tgt.mxFailures.Get("mx2.example.invalid."); !ok || f.reason != "refused" {
+		t.Fatal("Wrong cached failure:", f, ok)
+	}
+}
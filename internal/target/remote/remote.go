@@ -45,6 +45,8 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/cacheflush"
+	"github.com/foxcpp/maddy/internal/deststats"
 	"github.com/foxcpp/maddy/internal/limits"
 	"github.com/foxcpp/maddy/internal/smtpconn/pool"
 	"github.com/foxcpp/maddy/internal/target"
@@ -77,12 +79,17 @@ type Target struct {
 
 	pool           *pool.P
 	connReuseLimit int
+	mxFailures     *mxFailureCache
 
 	Log log.Logger
 
 	connectTimeout    time.Duration
 	commandTimeout    time.Duration
 	submissionTimeout time.Duration
+
+	stats          *deststats.Tracker
+	reportInterval time.Duration
+	stopReport     chan struct{}
 }
 
 var _ module.DeliveryTarget = &Target{}
@@ -97,11 +104,15 @@ func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 		resolver: dns.DefaultResolver(),
 		dialer:   (&net.Dialer{}).DialContext,
 		Log:      log.Logger{Name: "remote"},
+		stats:    deststats.NewTracker(instName),
 	}, nil
 }
 
 func (rt *Target) Init(cfg *config.Map) error {
-	var err error
+	var (
+		err          error
+		mxFailureTTL time.Duration
+	)
 	rt.extResolver, err = dns.NewExtResolver()
 	if err != nil {
 		rt.Log.Error("cannot initialize DNSSEC-aware resolver, DNSSEC and DANE are not available", err)
@@ -141,6 +152,8 @@ func (rt *Target) Init(cfg *config.Map) error {
 	cfg.Duration("connect_timeout", false, false, 5*time.Minute, &rt.connectTimeout)
 	cfg.Duration("command_timeout", false, false, 5*time.Minute, &rt.commandTimeout)
 	cfg.Duration("submission_timeout", false, false, 5*time.Minute, &rt.submissionTimeout)
+	cfg.Duration("destination_report_interval", false, false, 24*time.Hour, &rt.reportInterval)
+	cfg.Duration("mx_failure_ttl", false, false, 5*time.Minute, &mxFailureTTL)
 
 	poolCfg := pool.Config{
 		MaxKeys:             5000,
@@ -155,6 +168,10 @@ func (rt *Target) Init(cfg *config.Map) error {
 		return err
 	}
 	rt.pool = pool.New(poolCfg)
+	rt.mxFailures = newMXFailureCache(mxFailureTTL)
+	if rt.mxFailures != nil {
+		cacheflush.Register("mx_failures", rt.name, rt.mxFailures)
+	}
 
 	// INTERNATIONALIZATION: See RFC 6531 Section 3.7.1.
 	rt.hostname, err = idna.ToASCII(rt.hostname)
@@ -171,6 +188,9 @@ func (rt *Target) Init(cfg *config.Map) error {
 			LocalAddr: addr,
 		}).DialContext
 	}
+	if rt.extResolver != nil && dns.SharedCache() != nil {
+		rt.dialer = resolvingDialer(rt.extResolver, rt.dialer)
+	}
 	if rt.ipv4 {
 		dial := rt.dialer
 		rt.dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -181,10 +201,19 @@ func (rt *Target) Init(cfg *config.Map) error {
 		}
 	}
 
+	deststats.Register(rt.stats)
+	if rt.reportInterval != 0 {
+		rt.stopReport = make(chan struct{})
+		go rt.reportLoop()
+	}
+
 	return nil
 }
 
 func (rt *Target) Close() error {
+	if rt.stopReport != nil {
+		close(rt.stopReport)
+	}
 	rt.pool.Close()
 
 	return nil
@@ -206,6 +235,9 @@ type remoteDelivery struct {
 
 	recipients  []string
 	connections map[string]*mxConn
+	// Time when the delivery to the domain was started, used to measure
+	// the latency.
+	startedAt map[string]time.Time
 
 	policies []module.DeliveryMXAuthPolicy
 }
@@ -266,6 +298,7 @@ func (rt *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFr
 		msgMeta:     msgMeta,
 		Log:         target.DeliveryLogger(rt.Log, msgMeta),
 		connections: map[string]*mxConn{},
+		startedAt:   map[string]time.Time{},
 		policies:    policies,
 	}, nil
 }
@@ -307,8 +340,13 @@ func (rd *remoteDelivery) AddRcpt(ctx context.Context, to string, opts smtp.Rcpt
 		}
 	}
 
+	if _, ok := rd.startedAt[domain]; !ok {
+		rd.startedAt[domain] = time.Now()
+	}
 	conn, err := rd.connectionForDomain(ctx, domain)
 	if err != nil {
+		rd.rt.recordAttempt(domain, time.Since(rd.startedAt[domain]), err)
+		delete(rd.startedAt, domain)
 		return err
 	}
 
@@ -420,6 +458,13 @@ func (rd *remoteDelivery) BodyNonAtomic(ctx context.Context, c module.StatusColl
 			defer bodyR.Close()
 
 			err = conn.Data(ctx, header, bodyR)
+			rd.rt.recordAttempt(conn.domain, time.Since(rd.startedAt[conn.domain]), err)
+			if ic, ok := c.(module.DeliveryInfoCollector); ok && err == nil {
+				info := conn.deliveryInfo()
+				for _, rcpt := range conn.Rcpts() {
+					ic.SetDeliveryInfo(rcpt, info)
+				}
+			}
 			for _, rcpt := range conn.Rcpts() {
 				c.SetStatus(rcpt, err)
 			}
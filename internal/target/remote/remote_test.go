@@ -37,6 +37,7 @@ import (
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/deststats"
 	"github.com/foxcpp/maddy/internal/limits"
 	"github.com/foxcpp/maddy/internal/smtpconn/pool"
 	"github.com/foxcpp/maddy/internal/testutils"
@@ -60,6 +61,7 @@ func testTarget(t *testing.T, zones map[string]mockdns.Zone, extResolver *dns.Ex
 		Log:         testutils.Logger(t, "remote"),
 		policies:    extraPolicies,
 		limits:      &limits.Group{},
+		stats:       deststats.NewTracker("remote"),
 		pool: pool.New(pool.Config{
 			MaxKeys:             5000,
 			MaxConnsPerKey:      5,      // basically, max. amount of idle connections in cache
@@ -135,6 +137,45 @@ func TestRemoteDelivery(t *testing.T) {
 	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
 }
 
+func TestRemoteDelivery_Stats(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+		"example2.invalid.": {
+			MX: []net.MX{{Host: "mx.example2.invalid.", Pref: 10}},
+		},
+		"mx.example2.invalid.": {
+			A: []string{"127.0.0.2"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	defer tgt.Close()
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+	if _, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.com", []string{"test@example2.invalid"}); err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+
+	r := tgt.stats.Report()
+	if len(r.Domains) != 2 {
+		t.Fatalf("Expected stats for 2 domains, got %+v", r.Domains)
+	}
+	if d := r.Domains[0]; d.Domain != "example.invalid" || d.Attempts != 1 || d.Failures() != 0 || d.P50 == 0 {
+		t.Errorf("Wrong stats for the successful delivery: %+v", d)
+	}
+	if d := r.Domains[1]; d.Domain != "example2.invalid" || d.Attempts != 1 || d.TempFailures != 1 {
+		t.Errorf("Wrong stats for the failed delivery: %+v", d)
+	}
+}
+
 func TestRemoteDelivery_NoMXFallback(t *testing.T) {
 	tarpit := testutils.FailOnConn(t, "127.0.0.1:"+smtpPort)
 	defer tarpit.Close()
@@ -927,6 +968,70 @@ func TestRemoteDelivery_RequireTLS_Present(t *testing.T) {
 	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
 }
 
+type infoCollector struct {
+	infos map[string]module.DeliveryInfo
+	errs  map[string]error
+}
+
+func (c *infoCollector) SetStatus(rcpt string, err error) {
+	c.errs[rcpt] = err
+}
+
+func (c *infoCollector) SetDeliveryInfo(rcpt string, info module.DeliveryInfo) {
+	c.infos[rcpt] = info
+}
+
+func TestRemoteDelivery_DeliveryInfo(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.tlsConfig = clientCfg
+	defer tgt.Close()
+
+	c := &infoCollector{
+		infos: map[string]module.DeliveryInfo{},
+		errs:  map[string]error{},
+	}
+	testutils.DoTestDeliveryNonAtomic(t, c, tgt, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+
+	if err := c.errs["test@example.invalid"]; err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	info, ok := c.infos["test@example.invalid"]
+	if !ok {
+		t.Fatal("No delivery info reported")
+	}
+	if info.RemoteServer != "mx.example.invalid." {
+		t.Error("Wrong RemoteServer:", info.RemoteServer)
+	}
+	if info.RemoteAddr != "127.0.0.1:"+smtpPort {
+		t.Error("Wrong RemoteAddr:", info.RemoteAddr)
+	}
+	if info.TLSVersion == "" || info.TLSCipher == "" {
+		t.Error("Missing TLS version or cipher:", info.TLSVersion, info.TLSCipher)
+	}
+	if info.TLSLevel != "authenticated" || info.TLSAuth != "pki" {
+		t.Error("Wrong TLS level:", info.TLSLevel, info.TLSAuth)
+	}
+	if info.MXLevel != "none" {
+		t.Error("Wrong MX level:", info.MXLevel)
+	}
+	if info.Time.IsZero() {
+		t.Error("Delivery time is not set")
+	}
+}
+
 func TestRemoteDelivery_RequireTLS_NoErrFallback(t *testing.T) {
 	clientCfg, _, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+smtpPort)
 	defer srv.Close()
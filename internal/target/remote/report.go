@@ -0,0 +1,87 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/deststats"
+)
+
+// reportSize is the amount of domains included in each list of the
+// periodic destinations report.
+const reportSize = 10
+
+func (rt *Target) recordAttempt(domain string, latency time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		if exterrors.IsTemporaryOrUnspec(err) {
+			result = "temp_fail"
+		} else {
+			result = "perm_fail"
+		}
+	}
+	deliveryDuration.WithLabelValues(rt.name, result).Observe(latency.Seconds())
+	rt.stats.Record(domain, latency, err)
+}
+
+func (rt *Target) reportLoop() {
+	t := time.NewTicker(rt.reportInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			rt.logReport()
+		case <-rt.stopReport:
+			return
+		}
+	}
+}
+
+// logReport writes the slowest and the most failing destinations to the log
+// and starts a new statistics window.
+func (rt *Target) logReport() {
+	r := rt.stats.Report()
+	rt.stats.Reset()
+
+	if len(r.Domains) == 0 {
+		return
+	}
+
+	attempts, failures := 0, 0
+	for _, d := range r.Domains {
+		attempts += d.Attempts
+		failures += d.Failures()
+	}
+	rt.Log.Msg("destinations report", "since", r.Since, "domains", len(r.Domains),
+		"attempts", attempts, "failures", failures, "untracked", r.Untracked)
+
+	for _, d := range deststats.Slowest(r.Domains, reportSize) {
+		rt.Log.Msg("slow destination", "domain", d.Domain, "attempts", d.Attempts,
+			"p50", d.P50.Round(time.Millisecond).String(),
+			"p90", d.P90.Round(time.Millisecond).String(),
+			"p99", d.P99.Round(time.Millisecond).String())
+	}
+	for _, d := range deststats.MostFailing(r.Domains, reportSize) {
+		rt.Log.Msg("failing destination", "domain", d.Domain, "attempts", d.Attempts,
+			"temp_failures", d.TempFailures, "perm_failures", d.PermFailures)
+	}
+}
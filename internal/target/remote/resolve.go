@@ -0,0 +1,65 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+// resolvingDialer wraps dial to resolve MX host addresses using the
+// ExtResolver so they are served from the shared DNS cache instead of
+// being looked up by the system resolver for each connection.
+func resolvingDialer(r *dns.ExtResolver, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+
+		_, ipAddrs, err := r.AuthLookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+
+		var lastErr error
+		for _, ipAddr := range ipAddrs {
+			isV4 := ipAddr.IP.To4() != nil
+			if (network == "tcp4" && !isV4) || (network == "tcp6" && isV4) {
+				continue
+			}
+
+			conn, err := dial(ctx, network, net.JoinHostPort(ipAddr.IP.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		if lastErr == nil {
+			lastErr = &net.OpError{Op: "dial", Net: network, Err: errors.New("no suitable address found for " + host)}
+		}
+		return nil, lastErr
+	}
+}
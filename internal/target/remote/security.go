@@ -22,8 +22,11 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"runtime/debug"
+	"strings"
 	"time"
 
 	"github.com/foxcpp/go-mtasts"
@@ -33,12 +36,15 @@ import (
 	"github.com/foxcpp/maddy/framework/future"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/cacheflush"
+	"github.com/foxcpp/maddy/internal/storagepath"
 	"github.com/foxcpp/maddy/internal/target"
 )
 
 type (
 	mtastsPolicy struct {
 		cache       *mtasts.Cache
+		store       mtasts.Store
 		mtastsGet   func(context.Context, string) (*mtasts.Policy, error)
 		updaterStop chan struct{}
 		log         log.Logger
@@ -73,27 +79,68 @@ func (c *mtastsPolicy) Weight() int {
 
 func (c *mtastsPolicy) Init(cfg *config.Map) error {
 	var (
-		storeType string
+		storeArgs []string
 		storeDir  string
 	)
-	cfg.Enum("cache", false, false, []string{"ram", "fs"}, "fs", &storeType)
-	cfg.String("fs_dir", false, false, "mtasts_cache", &storeDir)
+	cfg.StringList("cache", false, false, []string{"fs"}, &storeArgs)
+	cfg.String("fs_dir", false, false, storagepath.Dir(storagepath.MTASTSCache, "mtasts_cache"), &storeDir)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
-	switch storeType {
+	var (
+		store interface {
+			mtasts.Store
+			cacheflush.Flusher
+		}
+		err error
+	)
+	if len(storeArgs) == 0 {
+		return fmt.Errorf("mx_auth.mtasts: cache type is required")
+	}
+	switch storeArgs[0] {
 	case "fs":
+		if len(storeArgs) != 1 {
+			return fmt.Errorf("mx_auth.mtasts: cache fs: unexpected arguments")
+		}
 		if err := os.MkdirAll(storeDir, os.ModePerm); err != nil {
 			return err
 		}
-		c.cache = mtasts.NewFSCache(storeDir)
+		store = newFSPolicyStore(storeDir)
 	case "ram":
-		c.cache = mtasts.NewRAMCache()
+		if len(storeArgs) != 1 {
+			return fmt.Errorf("mx_auth.mtasts: cache ram: unexpected arguments")
+		}
+		store = newRAMPolicyStore()
+	case "sql":
+		if len(storeArgs) < 3 {
+			return fmt.Errorf("mx_auth.mtasts: cache sql: driver and DSN are required")
+		}
+		store, err = newSQLPolicyStore(storeArgs[1], strings.Join(storeArgs[2:], " "))
+		if err != nil {
+			return fmt.Errorf("mx_auth.mtasts: cache sql: %w", err)
+		}
+	case "redis":
+		if len(storeArgs) != 2 && len(storeArgs) != 3 {
+			return fmt.Errorf("mx_auth.mtasts: cache redis: URL and optional key prefix are required")
+		}
+		prefix := "maddy.mtasts."
+		if len(storeArgs) == 3 {
+			prefix = storeArgs[2]
+		}
+		store, err = newRedisPolicyStore(storeArgs[1], prefix)
+		if err != nil {
+			return fmt.Errorf("mx_auth.mtasts: cache redis: %w", err)
+		}
 	default:
-		panic("mtasts policy init: unknown cache type")
+		return fmt.Errorf("mx_auth.mtasts: unknown cache type: %s", storeArgs[0])
 	}
-	c.cache.Resolver = dns.DefaultResolver()
+	c.store = store
+	c.cache = &mtasts.Cache{
+		Store:    store,
+		Resolver: dns.DefaultResolver(),
+	}
+	cacheflush.Register("mtasts", c.instName, store)
 	c.mtastsGet = c.cache.Get
 
 	return nil
@@ -155,6 +202,9 @@ func (c *mtastsPolicy) Close() error {
 		<-c.updaterStop
 		c.updaterStop = nil
 	}
+	if closer, ok := c.store.(io.Closer); ok {
+		return closer.Close()
+	}
 	return nil
 }
 
@@ -350,11 +400,19 @@ type (
 		extResolver *dns.ExtResolver
 		log         log.Logger
 		instName    string
+		pkixUsages  bool
 	}
 	daneDelivery struct {
 		c       *danePolicy
 		tlsaFut *future.Future
 	}
+
+	// tlsaRRset is the result of TLSA records discovery.
+	tlsaRRset struct {
+		recs []dns.TLSA
+		// TLSA base domain, either the MX name or its CNAME-expanded form.
+		base string
+	}
 )
 
 func NewDANEPolicy(_, instName string, _, _ []string) (module.Module, error) {
@@ -384,6 +442,7 @@ func (c *danePolicy) Init(cfg *config.Map) error {
 	}
 
 	cfg.Bool("debug", true, log.DefaultLogger.Debug, &c.log.Debug)
+	cfg.Bool("pkix_usages", false, true, &c.pkixUsages)
 
 	_, err = cfg.Process()
 	return err
@@ -399,19 +458,19 @@ func (c *danePolicy) Close() error {
 
 func (c *daneDelivery) PrepareDomain(ctx context.Context, domain string) {}
 
-func (c *daneDelivery) discoverTLSA(ctx context.Context, mx string) ([]dns.TLSA, error) {
+func (c *daneDelivery) discoverTLSA(ctx context.Context, mx string) (tlsaRRset, error) {
 	adA, rname, err := c.c.extResolver.CheckCNAMEAD(ctx, mx)
 	if err != nil {
 		// This may indicate a bogus DNSSEC signature or other lookup issue
 		// (including non-existing domain).
 		// Per RFC 7672, any I/O errors (including SERVFAIL) should
 		// cause delivery to be delayed.
-		return nil, err
+		return tlsaRRset{}, err
 	}
 	if rname == "" {
 		// No A/AAAA records, short-circuit discovery instead of doing useless
 		// queries.
-		return nil, errors.New("no address associated with the host")
+		return tlsaRRset{}, errors.New("no address associated with the host")
 	}
 	if !adA {
 		// If A lookup is not DNSSEC-authenticated we assume the server cannot
@@ -420,7 +479,7 @@ func (c *daneDelivery) discoverTLSA(ctx context.Context, mx string) ([]dns.TLSA,
 		// e.g. see https://github.com/foxcpp/maddy/issues/287
 		if rname == mx {
 			c.c.log.Debugln("skipping DANE for", mx, "due to non-authenticated A records")
-			return nil, nil
+			return tlsaRRset{}, nil
 		}
 
 		// But if it is CNAME'd then we may not want to skip it and actually
@@ -428,11 +487,11 @@ func (c *daneDelivery) discoverTLSA(ctx context.Context, mx string) ([]dns.TLSA,
 		// initial name is signed, do CNAME lookup.
 		cnameAD, _, err := c.c.extResolver.AuthLookupCNAME(ctx, mx)
 		if err != nil {
-			return nil, err
+			return tlsaRRset{}, err
 		}
 		if !cnameAD {
 			c.c.log.Debugln("skipping DANE for", mx, "due to non-authenticated CNAME record")
-			return nil, nil
+			return tlsaRRset{}, nil
 		}
 	}
 
@@ -440,13 +499,13 @@ func (c *daneDelivery) discoverTLSA(ctx context.Context, mx string) ([]dns.TLSA,
 	if rname != mx {
 		ad, recs, err := c.c.extResolver.AuthLookupTLSA(ctx, "25", "tcp", rname)
 		if err != nil && !dns.IsNotFound(err) {
-			return nil, err
+			return tlsaRRset{}, err
 		}
 		if ad && len(recs) != 0 {
 			// recs may be empty or contain only unusable records - this is
 			// okay per RFC 7672, no fallback to initial name is done.
 			c.c.log.Debugln("using", len(recs), "DANE records at", rname, "to authenticate", mx)
-			return recs, nil
+			return tlsaRRset{recs: recs, base: rname}, nil
 		}
 		// Per RFC 7672 Section 2.2 we interpret a non-authenticated RRset just
 		// like an empty RRset and fallback to trying original name.
@@ -457,15 +516,15 @@ func (c *daneDelivery) discoverTLSA(ctx context.Context, mx string) ([]dns.TLSA,
 	// - we consider TLSA under the initial name.
 	ad, recs, err := c.c.extResolver.AuthLookupTLSA(ctx, "25", "tcp", mx)
 	if err != nil && !dns.IsNotFound(err) {
-		return nil, err
+		return tlsaRRset{}, err
 	}
 	if !ad {
 		c.c.log.Debugln("ignoring non-authenticated TLSA records for", mx)
-		return nil, nil
+		return tlsaRRset{}, nil
 	}
 
 	c.c.log.Debugln("using", len(recs), "DANE records at original name to authenticate", mx)
-	return recs, nil
+	return tlsaRRset{recs: recs, base: mx}, nil
 }
 
 func (c *daneDelivery) PrepareConn(ctx context.Context, mx string) {
@@ -514,9 +573,16 @@ func (c *daneDelivery) CheckConn(ctx context.Context, mxLevel module.MXLevel, tl
 		// so we mark it as such.
 		return module.TLSNone, exterrors.WithTemporary(err, true)
 	}
-	recs := recsI.([]dns.TLSA)
+	rrset := recsI.(tlsaRRset)
+
+	// RFC 7672 Section 3.2.3: Both the TLSA base domain and the MX
+	// hostname are acceptable reference identifiers.
+	names := []string{dns.FQDN(mx)}
+	if rrset.base != "" && !strings.EqualFold(rrset.base, names[0]) {
+		names = append([]string{rrset.base}, names...)
+	}
 
-	overridePKIX, err := verifyDANE(recs, tlsState)
+	overridePKIX, err := verifyDANE(rrset.recs, names, tlsState, c.c.pkixUsages)
 	if err != nil {
 		return module.TLSNone, err
 	}
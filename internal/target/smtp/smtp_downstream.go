@@ -178,7 +178,8 @@ type delivery struct {
 	conn *smtpconn.C
 }
 
-// lmtpDelivery implements module.PartialDelivery
+// lmtpDelivery implements module.PartialDelivery using per-recipient
+// statuses reported by the LMTP server.
 type lmtpDelivery struct {
 	*delivery
 }
@@ -288,6 +289,29 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 	return d.u.moduleError(d.conn.Data(ctx, header, r))
 }
 
+// BodyNonAtomic is equivalent to Body with the same status set for all
+// recipients. It is implemented to report delivery information, so the
+// queue knows whether DSN parameters were passed to the downstream server.
+func (d *delivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+	if err := d.Body(ctx, header, body); err != nil {
+		for _, rcpt := range d.rcpts {
+			sc.SetStatus(rcpt, err)
+		}
+		return
+	}
+
+	for _, rcpt := range d.rcpts {
+		if ic, ok := sc.(module.DeliveryInfoCollector); ok {
+			ic.SetDeliveryInfo(rcpt, module.DeliveryInfo{
+				RemoteServer: d.conn.ServerName(),
+				Time:         time.Now(),
+				DSNPassed:    d.conn.SupportsDSN(),
+			})
+		}
+		sc.SetStatus(rcpt, nil)
+	}
+}
+
 func (d *lmtpDelivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollector, header textproto.Header, body buffer.Buffer) {
 	r, err := body.Open()
 	if err != nil {
@@ -301,6 +325,13 @@ func (d *lmtpDelivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollec
 	rcptIndx := 0
 	err = d.conn.LMTPData(ctx, header, r, func(rcpt string, err *smtp.SMTPError) {
 		if err == nil {
+			if ic, ok := sc.(module.DeliveryInfoCollector); ok {
+				ic.SetDeliveryInfo(rcpt, module.DeliveryInfo{
+					RemoteServer: d.conn.ServerName(),
+					Time:         time.Now(),
+					DSNPassed:    d.conn.SupportsDSN(),
+				})
+			}
 			sc.SetStatus(rcpt, nil)
 		} else {
 			sc.SetStatus(rcpt, &exterrors.SMTPError{
@@ -43,6 +43,12 @@ type Check struct {
 	UnclosedStates int
 
 	InstName string
+
+	// If set - the check declares itself header-only
+	// (module.HeaderOnlyCheck).
+	HeaderOnlyCheck bool
+	// Length of the body buffer passed to the last CheckBody call.
+	LastBodyLen int
 }
 
 func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
@@ -69,6 +75,10 @@ func (c *Check) InstanceName() string {
 	return "test_check"
 }
 
+func (c *Check) HeaderOnly() bool {
+	return c.HeaderOnlyCheck
+}
+
 func (c *Check) CheckConnection(ctx context.Context, state *module.ConnState) error {
 	return c.EarlyErr
 }
@@ -95,6 +105,7 @@ func (cs *checkState) CheckRcpt(ctx context.Context, to string) module.CheckResu
 
 func (cs *checkState) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
 	cs.check.BodyCalls++
+	cs.check.LastBodyLen = body.Len()
 	return cs.check.BodyRes
 }
 
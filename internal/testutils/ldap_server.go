@@ -0,0 +1,293 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package testutils
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPEntry is a directory entry served by LDAPServer.
+type LDAPEntry struct {
+	DN string
+	// Password used for simple bind as DN. Empty means binding as the entry
+	// is not allowed.
+	Password string
+	Attrs    map[string][]string
+}
+
+// LDAPSearch is a search request received by LDAPServer.
+type LDAPSearch struct {
+	// BindDN is the DN the connection was bound as when the request was
+	// received, empty for anonymous connections.
+	BindDN string
+	BaseDN string
+	// Filter is the string representation of the received filter.
+	Filter string
+}
+
+// LDAPServer implements the subset of LDAP used by maddy: simple binds,
+// unbind and searches with equality, presence and boolean filters. It is
+// enough to test connection handling and request construction.
+type LDAPServer struct {
+	l net.Listener
+
+	lck      sync.Mutex
+	entries  []LDAPEntry
+	conns    int
+	searches []LDAPSearch
+}
+
+// NewLDAPServer starts the server listening on a random local port. It is
+// stopped when the test ends.
+func NewLDAPServer(t *testing.T, entries ...LDAPEntry) *LDAPServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &LDAPServer{
+		l:       l,
+		entries: entries,
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			srv.lck.Lock()
+			srv.conns++
+			srv.lck.Unlock()
+			go srv.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return srv
+}
+
+// URL returns the ldap:// URL of the server.
+func (srv *LDAPServer) URL() string {
+	return "ldap://" + srv.l.Addr().String()
+}
+
+// Conns returns the amount of connections accepted by the server.
+func (srv *LDAPServer) Conns() int {
+	srv.lck.Lock()
+	defer srv.lck.Unlock()
+	return srv.conns
+}
+
+// Searches returns search requests received by the server so far.
+func (srv *LDAPServer) Searches() []LDAPSearch {
+	srv.lck.Lock()
+	defer srv.lck.Unlock()
+	return append([]LDAPSearch(nil), srv.searches...)
+}
+
+func (srv *LDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	boundDN := ""
+	for {
+		req, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		if len(req.Children) < 2 {
+			return
+		}
+		msgID, _ := req.Children[0].Value.(int64)
+		op := req.Children[1]
+
+		var resp []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			var code int
+			boundDN, code = srv.bind(op)
+			resp = append(resp, ldapResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationUnbindRequest:
+			return
+		case ldap.ApplicationSearchRequest:
+			resp = srv.search(boundDN, op)
+		default:
+			resp = append(resp, ldapResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultUnwillingToPerform))
+		}
+
+		for _, p := range resp {
+			msg := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, "Message ID"))
+			msg.AppendChild(p)
+			if _, err := conn.Write(msg.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// bind returns the DN the connection is bound as after the request and the
+// result code.
+func (srv *LDAPServer) bind(op *ber.Packet) (string, int) {
+	if len(op.Children) < 3 || op.Children[2].Tag != 0 {
+		return "", ldap.LDAPResultAuthMethodNotSupported
+	}
+	dn := op.Children[1].Data.String()
+	password := op.Children[2].Data.String()
+	if password == "" {
+		return "", ldap.LDAPResultSuccess
+	}
+
+	srv.lck.Lock()
+	defer srv.lck.Unlock()
+	for _, e := range srv.entries {
+		if e.DN == dn && e.Password != "" && e.Password == password {
+			return dn, ldap.LDAPResultSuccess
+		}
+	}
+	return "", ldap.LDAPResultInvalidCredentials
+}
+
+func (srv *LDAPServer) search(boundDN string, op *ber.Packet) []*ber.Packet {
+	if len(op.Children) < 8 {
+		return []*ber.Packet{ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError)}
+	}
+	baseDN := op.Children[0].Data.String()
+	scope, _ := op.Children[1].Value.(int64)
+	sizeLimit, _ := op.Children[3].Value.(int64)
+	filter := op.Children[6]
+	var attrs []string
+	for _, a := range op.Children[7].Children {
+		attrs = append(attrs, a.Data.String())
+	}
+
+	filterStr, err := ldap.DecompileFilter(filter)
+	if err != nil {
+		return []*ber.Packet{ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError)}
+	}
+
+	srv.lck.Lock()
+	defer srv.lck.Unlock()
+	srv.searches = append(srv.searches, LDAPSearch{
+		BindDN: boundDN,
+		BaseDN: baseDN,
+		Filter: filterStr,
+	})
+
+	var resp []*ber.Packet
+	for _, e := range srv.entries {
+		switch scope {
+		case ldap.ScopeBaseObject:
+			if !strings.EqualFold(e.DN, baseDN) {
+				continue
+			}
+		default:
+			if !strings.HasSuffix(strings.ToLower(e.DN), strings.ToLower(baseDN)) {
+				continue
+			}
+		}
+		if !matchFilter(filter, e) {
+			continue
+		}
+		if sizeLimit > 0 && int64(len(resp)) == sizeLimit {
+			return append(resp, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSizeLimitExceeded))
+		}
+		resp = append(resp, ldapEntry(e, attrs))
+	}
+	return append(resp, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+}
+
+func attrValues(e LDAPEntry, name string) []string {
+	for k, vals := range e.Attrs {
+		if strings.EqualFold(k, name) {
+			return vals
+		}
+	}
+	return nil
+}
+
+func matchFilter(f *ber.Packet, e LDAPEntry) bool {
+	switch f.Tag {
+	case ldap.FilterAnd:
+		for _, c := range f.Children {
+			if !matchFilter(c, e) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, c := range f.Children {
+			if matchFilter(c, e) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return len(f.Children) == 1 && !matchFilter(f.Children[0], e)
+	case ldap.FilterEqualityMatch:
+		if len(f.Children) != 2 {
+			return false
+		}
+		val := f.Children[1].Data.String()
+		for _, v := range attrValues(e, f.Children[0].Data.String()) {
+			if strings.EqualFold(v, val) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		name := f.Data.String()
+		return strings.EqualFold(name, "objectClass") || len(attrValues(e, name)) != 0
+	}
+	return false
+}
+
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return p
+}
+
+func ldapEntry(e LDAPEntry, attrs []string) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, "DN"))
+	attrsPkt := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, name := range attrs {
+		vals := attrValues(e, name)
+		if len(vals) == 0 {
+			continue
+		}
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		valsPkt := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, v := range vals {
+			valsPkt.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+		}
+		attr.AppendChild(valsPkt)
+		attrsPkt.AppendChild(attr)
+	}
+	p.AppendChild(attrsPkt)
+	return p
+}
@@ -0,0 +1,166 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package testutils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// WriteMMDB creates the MaxMind DB file with the specified records and
+// returns its path. Keys are IPv4 networks in CIDR notation, they should not
+// overlap. Values can contain strings, uints and nested maps.
+func WriteMMDB(t *testing.T, records map[string]map[string]interface{}) string {
+	t.Helper()
+
+	type record struct {
+		node int // child node index, 0 if not set
+		data int // index in the data section + 1, 0 if not set
+	}
+	nodes := [][2]record{{}}
+
+	var (
+		data    bytes.Buffer
+		offsets []int
+	)
+	nets := make([]string, 0, len(records))
+	for cidr := range records {
+		nets = append(nets, cidr)
+	}
+	sort.Strings(nets)
+
+	for _, cidr := range nets {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := ipNet.IP.To4()
+		ones, _ := ipNet.Mask.Size()
+		if ip == nil || ones == 0 {
+			t.Fatalf("unsupported network: %s", cidr)
+		}
+
+		offsets = append(offsets, data.Len())
+		data.Write(mmdbEncode(records[cidr]))
+
+		cur := 0
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> (7 - i%8)) & 1
+			if i == ones-1 {
+				nodes[cur][bit] = record{data: len(offsets)}
+				break
+			}
+			if nodes[cur][bit].node == 0 {
+				nodes = append(nodes, [2]record{})
+				nodes[cur][bit] = record{node: len(nodes) - 1}
+			}
+			cur = nodes[cur][bit].node
+		}
+	}
+
+	var db bytes.Buffer
+	nodeCount := uint32(len(nodes))
+	for _, n := range nodes {
+		for _, r := range n {
+			val := nodeCount
+			if r.node != 0 {
+				val = uint32(r.node)
+			} else if r.data != 0 {
+				val = nodeCount + 16 + uint32(offsets[r.data-1])
+			}
+			_ = binary.Write(&db, binary.BigEndian, val)
+		}
+	}
+	db.Write(make([]byte, 16))
+	db.Write(data.Bytes())
+	db.WriteString("\xab\xcd\xefMaxMind.com")
+	db.Write(mmdbEncode(map[string]interface{}{
+		"node_count":                  nodeCount,
+		"record_size":                 uint16(32),
+		"ip_version":                  uint16(4),
+		"database_type":               "Test",
+		"languages":                   []interface{}{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1700000000),
+		"description":                 map[string]interface{}{"en": "Test"},
+	}))
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, db.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// mmdbEncode encodes the value using the MaxMind DB data section format.
+// Only small values are supported.
+func mmdbEncode(v interface{}) []byte {
+	var b bytes.Buffer
+	ctrl := func(typ, size int) {
+		if typ > 7 {
+			b.WriteByte(byte(size))
+			b.WriteByte(byte(typ - 7))
+			return
+		}
+		b.WriteByte(byte(typ<<5 | size))
+	}
+
+	switch v := v.(type) {
+	case string:
+		ctrl(2, len(v))
+		b.WriteString(v)
+	case uint16:
+		ctrl(5, 2)
+		_ = binary.Write(&b, binary.BigEndian, v)
+	case uint32:
+		ctrl(6, 4)
+		_ = binary.Write(&b, binary.BigEndian, v)
+	case uint:
+		ctrl(6, 4)
+		_ = binary.Write(&b, binary.BigEndian, uint32(v))
+	case uint64:
+		ctrl(9, 8)
+		_ = binary.Write(&b, binary.BigEndian, v)
+	case []interface{}:
+		ctrl(11, len(v))
+		for _, item := range v {
+			b.Write(mmdbEncode(item))
+		}
+	case map[string]interface{}:
+		ctrl(7, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b.Write(mmdbEncode(k))
+			b.Write(mmdbEncode(v[k]))
+		}
+	default:
+		panic("mmdbEncode: unsupported type")
+	}
+	return b.Bytes()
+}
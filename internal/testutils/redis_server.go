@@ -0,0 +1,224 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package testutils
+
+import (
+	"bufio"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/redis"
+)
+
+// RedisServer implements the subset of Redis protocol used by maddy: AUTH,
+// SELECT, GET, SET, DEL, SCAN and pub/sub commands. Key expiration is not
+// implemented, TTLs set using SET EX are recorded and can be checked using
+// KeyTTL.
+type RedisServer struct {
+	Password string
+
+	l net.Listener
+
+	lck  sync.Mutex
+	kv   map[string]string
+	ttl  map[string]int
+	subs map[string]map[net.Conn]struct{}
+}
+
+// NewRedisServer starts the server listening on a random local port. It is
+// stopped when the test ends.
+func NewRedisServer(t *testing.T, password string) *RedisServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &RedisServer{
+		Password: password,
+		l:        l,
+		kv:       make(map[string]string),
+		ttl:      make(map[string]int),
+		subs:     make(map[string]map[net.Conn]struct{}),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return srv
+}
+
+// URL returns the redis:// URL of the server, including the password.
+func (srv *RedisServer) URL() string {
+	if srv.Password != "" {
+		return "redis://:" + srv.Password + "@" + srv.l.Addr().String()
+	}
+	return "redis://" + srv.l.Addr().String()
+}
+
+// Subscribers returns the amount of connections subscribed to the channel.
+func (srv *RedisServer) Subscribers(channel string) int {
+	srv.lck.Lock()
+	defer srv.lck.Unlock()
+	return len(srv.subs[channel])
+}
+
+// Get returns the value of the key.
+func (srv *RedisServer) Get(key string) (string, bool) {
+	srv.lck.Lock()
+	defer srv.lck.Unlock()
+	val, ok := srv.kv[key]
+	return val, ok
+}
+
+// KeyTTL returns the TTL set for the key, 0 if there is none.
+func (srv *RedisServer) KeyTTL(key string) int {
+	srv.lck.Lock()
+	defer srv.lck.Unlock()
+	return srv.ttl[key]
+}
+
+func (srv *RedisServer) serve(conn net.Conn) {
+	defer func() {
+		srv.lck.Lock()
+		for _, conns := range srv.subs {
+			delete(conns, conn)
+		}
+		srv.lck.Unlock()
+		conn.Close()
+	}()
+
+	c := &redis.Conn{Conn: conn}
+	br := bufio.NewReader(conn)
+	authed := srv.Password == ""
+	for {
+		val, err := redis.ReadReply(br)
+		if err != nil {
+			return
+		}
+		arr, ok := val.([]interface{})
+		if !ok || len(arr) == 0 {
+			return
+		}
+		args := make([]string, 0, len(arr))
+		for _, arg := range arr {
+			s, _ := arg.(string)
+			args = append(args, s)
+		}
+
+		srv.lck.Lock()
+		srv.handle(c, args, &authed)
+		srv.lck.Unlock()
+	}
+}
+
+func (srv *RedisServer) handle(c *redis.Conn, args []string, authed *bool) {
+	reply := func(s string) { c.Write([]byte(s + "\r\n")) }
+	bulk := func(s string) { reply("$" + strconv.Itoa(len(s)) + "\r\n" + s) }
+
+	cmd := strings.ToUpper(args[0])
+	switch {
+	case cmd == "AUTH":
+		if args[len(args)-1] == srv.Password {
+			*authed = true
+			reply("+OK")
+		} else {
+			reply("-WRONGPASS invalid password")
+		}
+	case !*authed:
+		reply("-NOAUTH Authentication required.")
+	case cmd == "SELECT":
+		reply("+OK")
+	case cmd == "GET" && len(args) == 2:
+		val, ok := srv.kv[args[1]]
+		if !ok {
+			reply("$-1")
+			return
+		}
+		bulk(val)
+	case cmd == "SET" && len(args) >= 3:
+		srv.kv[args[1]] = args[2]
+		delete(srv.ttl, args[1])
+		if len(args) == 5 && strings.ToUpper(args[3]) == "EX" {
+			srv.ttl[args[1]], _ = strconv.Atoi(args[4])
+		}
+		reply("+OK")
+	case cmd == "DEL":
+		removed := 0
+		for _, k := range args[1:] {
+			if _, ok := srv.kv[k]; ok {
+				delete(srv.kv, k)
+				delete(srv.ttl, k)
+				removed++
+			}
+		}
+		reply(":" + strconv.Itoa(removed))
+	case cmd == "SCAN":
+		// All keys are returned at once.
+		pattern := "*"
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		var keys []string
+		for k := range srv.kv {
+			if ok, _ := path.Match(pattern, k); ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		reply("*2")
+		bulk("0")
+		reply("*" + strconv.Itoa(len(keys)))
+		for _, k := range keys {
+			bulk(k)
+		}
+	case cmd == "SUBSCRIBE":
+		for _, ch := range args[1:] {
+			if srv.subs[ch] == nil {
+				srv.subs[ch] = make(map[net.Conn]struct{})
+			}
+			srv.subs[ch][c.Conn] = struct{}{}
+			c.Send("subscribe", ch)
+		}
+	case cmd == "UNSUBSCRIBE":
+		for _, ch := range args[1:] {
+			delete(srv.subs[ch], c.Conn)
+			c.Send("unsubscribe", ch)
+		}
+	case cmd == "PUBLISH" && len(args) == 3:
+		for sub := range srv.subs[args[1]] {
+			(&redis.Conn{Conn: sub}).Send("message", args[1], args[2])
+		}
+		reply(":" + strconv.Itoa(len(srv.subs[args[1]])))
+	default:
+		reply("-ERR unknown command")
+	}
+}
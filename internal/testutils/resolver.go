@@ -0,0 +1,73 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package testutils
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+// Resolver wraps dns.Resolver and counts queries made through it.
+type Resolver struct {
+	dns.Resolver
+
+	lck     sync.Mutex
+	Queries int
+}
+
+func (r *Resolver) count() {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	r.Queries++
+}
+
+// QueryCount returns the amount of queries made so far.
+func (r *Resolver) QueryCount() int {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	return r.Queries
+}
+
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.count()
+	return r.Resolver.LookupAddr(ctx, addr)
+}
+
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.count()
+	return r.Resolver.LookupHost(ctx, host)
+}
+
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	r.count()
+	return r.Resolver.LookupMX(ctx, name)
+}
+
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.count()
+	return r.Resolver.LookupTXT(ctx, name)
+}
+
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.count()
+	return r.Resolver.LookupIPAddr(ctx, host)
+}
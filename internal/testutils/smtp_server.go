@@ -39,6 +39,7 @@ type SMTPMessage struct {
 	From     string
 	Opts     smtp.MailOptions
 	To       []string
+	RcptOpts []smtp.RcptOptions
 	Data     []byte
 	Conn     *smtp.Conn
 	AuthUser string
@@ -149,12 +150,13 @@ func (s *session) Mail(from string, opts *smtp.MailOptions) error {
 	return nil
 }
 
-func (s *session) Rcpt(to string, _ *smtp.RcptOptions) error {
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
 	if err := s.backend.RcptErr[to]; err != nil {
 		return err
 	}
 
 	s.msg.To = append(s.msg.To, to)
+	s.msg.RcptOpts = append(s.msg.RcptOpts, *opts)
 	return nil
 }
 
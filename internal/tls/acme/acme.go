@@ -46,6 +46,7 @@ func (l *Loader) Init(cfg *config.Map) error {
 		testCAPath     string
 		email          string
 		agreed         bool
+		reuseKey       bool
 		challenge      string
 		overrideDomain string
 		provider       certmagic.DNSProvider
@@ -64,6 +65,7 @@ func (l *Loader) Init(cfg *config.Map) error {
 	cfg.String("override_domain", false, false,
 		"", &overrideDomain)
 	cfg.Bool("agreed", false, false, &agreed)
+	cfg.Bool("reuse_key", false, false, &reuseKey)
 	cfg.Enum("challenge", false, true,
 		[]string{"dns-01"}, "dns-01", &challenge)
 	cfg.Custom("dns", false, false, func() (interface{}, error) {
@@ -91,6 +93,8 @@ func (l *Loader) Init(cfg *config.Map) error {
 		Storage:           l.store, // not sure if it is necessary to set these twice
 		Logger:            cmLog,
 		DefaultServerName: hostname,
+		OnEvent:           l.onEvent,
+		ReusePrivateKeys:  reuseKey,
 	})
 	issuer := certmagic.NewACMEIssuer(l.cfg, certmagic.ACMEIssuer{
 		Logger: cmLog,
@@ -133,6 +137,22 @@ func (l *Loader) Init(cfg *config.Map) error {
 	return nil
 }
 
+// onEvent reports certificates obtained by certmagic as hooks.NotifyCertReload.
+func (l *Loader) onEvent(_ context.Context, event string, data map[string]any) error {
+	if event != "cert_obtained" {
+		return nil
+	}
+	name := l.instName
+	if name == "" {
+		name = modName
+	}
+	hooks.Notify(hooks.NotifyCertReload, map[string]string{
+		"module": name,
+		"domain": fmt.Sprint(data["identifier"]),
+	})
+	return nil
+}
+
 func (l *Loader) ConfigureTLS(c *tls.Config) error {
 	c.GetCertificate = l.cfg.GetCertificate
 	return nil
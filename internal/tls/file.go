@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package tls
 
 import (
+	"bytes"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -44,6 +45,10 @@ type FileLoader struct {
 
 	reloadTick *time.Ticker
 	stopTick   chan struct{}
+
+	// Serializes reloads so notifications are sent only on changes.
+	reloadLck    sync.Mutex
+	reloadFailed bool
 }
 
 func NewFileLoader(_, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -86,9 +91,7 @@ func (f *FileLoader) Init(cfg *config.Map) error {
 
 	hooks.AddHook(hooks.EventReload, func() {
 		f.log.Println("reloading certificates")
-		if err := f.loadCerts(); err != nil {
-			f.log.Error("reload failed", err)
-		}
+		f.reload()
 	})
 
 	f.reloadTick = time.NewTicker(time.Minute)
@@ -115,15 +118,73 @@ func (f *FileLoader) reloadTicker() {
 		select {
 		case <-f.reloadTick.C:
 			f.log.Debugln("reloading certs")
-			if err := f.loadCerts(); err != nil {
-				f.log.Error("reload failed", err)
-			}
+			f.reload()
 		case <-f.stopTick:
 			return
 		}
 	}
 }
 
+func (f *FileLoader) notifyName() string {
+	if f.instName != "" {
+		return f.instName
+	}
+	return f.Name()
+}
+
+// reload reads certificates from disk and sends notifications if they changed
+// or could not be loaded.
+func (f *FileLoader) reload() {
+	f.reloadLck.Lock()
+	defer f.reloadLck.Unlock()
+
+	f.certsLock.RLock()
+	oldCerts := f.certs
+	f.certsLock.RUnlock()
+
+	if err := f.loadCerts(); err != nil {
+		f.log.Error("reload failed", err)
+		// Do not repeat notification every time the ticker fires.
+		if !f.reloadFailed {
+			hooks.Notify(hooks.NotifyReloadFailed, map[string]string{
+				"module": f.notifyName(),
+				"error":  err.Error(),
+			})
+		}
+		f.reloadFailed = true
+		return
+	}
+	f.reloadFailed = false
+
+	f.certsLock.RLock()
+	newCerts := f.certs
+	f.certsLock.RUnlock()
+
+	if !sameCerts(oldCerts, newCerts) {
+		f.log.Println("certificates changed")
+		hooks.Notify(hooks.NotifyCertReload, map[string]string{
+			"module": f.notifyName(),
+		})
+	}
+}
+
+func sameCerts(a, b []tls.Certificate) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i].Certificate) != len(b[i].Certificate) {
+			return false
+		}
+		for j := range a[i].Certificate {
+			if !bytes.Equal(a[i].Certificate[j], b[i].Certificate[j]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func (f *FileLoader) loadCerts() error {
 	if len(f.certPaths) != len(f.keyPaths) {
 		return errors.New("mismatch in certs and keys count")
@@ -0,0 +1,201 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package tlsa implements computation of TLSA records (RFC 6698) for
+// certificates used by the server so they can be published in DNS to enable
+// DANE for inbound connections (RFC 7672).
+package tlsa
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Certificate usage values, see RFC 6698 Section 2.1.1.
+//
+// Only DANE-TA and DANE-EE are used for SMTP, see RFC 7672 Section 3.1.3.
+const (
+	UsageDANETA uint8 = 2
+	UsageDANEEE uint8 = 3
+)
+
+// Selector and matching type used for generated records. SPKI is used so
+// records stay valid if the certificate is renewed without changing the key.
+const (
+	selectorSPKI   uint8 = 1
+	matchingSHA256 uint8 = 1
+)
+
+// Record is the TLSA record for the service.
+type Record struct {
+	// Owner name, e.g. _25._tcp.mx.example.org.
+	Name         string
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	// Hex-encoded (lowercase) association data.
+	Data string
+}
+
+// Value returns the record data in the presentation format, e.g. "3 1 1 ABCD...".
+func (r Record) Value() string {
+	return fmt.Sprintf("%d %d %d %s", r.Usage, r.Selector, r.MatchingType, r.Data)
+}
+
+// String returns the record in the zone file format.
+func (r Record) String() string {
+	return r.Name + " IN TLSA " + r.Value()
+}
+
+// OwnerName returns the TLSA record owner name for the TCP service.
+func OwnerName(hostname string, port int) string {
+	return "_" + strconv.Itoa(port) + "._tcp." + dns.Fqdn(hostname)
+}
+
+// ForChain returns TLSA records for the certificate chain served for the
+// hostname.
+//
+// DANE-EE record matches the leaf certificate public key and DANE-TA
+// record matches the public key of the issuing CA. The latter remains valid
+// when the certificate is renewed using a new key, as long as the same CA is
+// used.
+func ForChain(hostname string, port int, chain []*x509.Certificate, usages []uint8) ([]Record, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("tlsa: empty certificate chain")
+	}
+
+	name := OwnerName(hostname, port)
+	recs := make([]Record, 0, len(usages))
+	for _, usage := range usages {
+		var cert *x509.Certificate
+		switch usage {
+		case UsageDANEEE:
+			cert = chain[0]
+		case UsageDANETA:
+			if len(chain) < 2 {
+				// Self-signed certificate, there is no issuer to use.
+				continue
+			}
+			cert = chain[1]
+		default:
+			return nil, fmt.Errorf("tlsa: unsupported usage: %d", usage)
+		}
+
+		data, err := dns.CertificateToDANE(selectorSPKI, matchingSHA256, cert)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, Record{
+			Name:         name,
+			Usage:        usage,
+			Selector:     selectorSPKI,
+			MatchingType: matchingSHA256,
+			Data:         data,
+		})
+	}
+	return recs, nil
+}
+
+// ParseChain parses DER-encoded certificates of tls.Certificate.
+func ParseChain(cert *tls.Certificate) ([]*x509.Certificate, error) {
+	chain := make([]*x509.Certificate, 0, len(cert.Certificate))
+	for _, der := range cert.Certificate {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, c)
+	}
+	return chain, nil
+}
+
+// ServedCertificate returns the certificate the TLS configuration will use
+// for connections with the specified SNI value.
+func ServedCertificate(cfg *tls.Config, hostname string) (*tls.Certificate, error) {
+	hello := &tls.ClientHelloInfo{ServerName: hostname}
+	if cfg.GetConfigForClient != nil {
+		clientCfg, err := cfg.GetConfigForClient(hello)
+		if err != nil {
+			return nil, err
+		}
+		if clientCfg != nil {
+			cfg = clientCfg
+		}
+	}
+
+	if cfg.GetCertificate != nil {
+		cert, err := cfg.GetCertificate(hello)
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil {
+			return cert, nil
+		}
+	}
+
+	if len(cfg.Certificates) == 0 {
+		return nil, errors.New("tlsa: no certificates configured")
+	}
+	for i := range cfg.Certificates {
+		chain, err := ParseChain(&cfg.Certificates[i])
+		if err != nil {
+			return nil, err
+		}
+		if len(chain) != 0 && chain[0].VerifyHostname(hostname) == nil {
+			return &cfg.Certificates[i], nil
+		}
+	}
+	// Same as crypto/tls, the first certificate is used if none match.
+	return &cfg.Certificates[0], nil
+}
+
+// Zone formats records in the zone file format. Records are sorted so
+// the output is stable.
+func Zone(recs []Record) string {
+	sorted := make([]Record, len(recs))
+	copy(sorted, recs)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].String() < sorted[j].String()
+	})
+
+	var sb strings.Builder
+	for _, rec := range sorted {
+		sb.WriteString(rec.String())
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// ParseUsage parses the certificate usage name used in configuration.
+func ParseUsage(name string) (uint8, error) {
+	switch strings.ToLower(name) {
+	case "dane-ee", "3":
+		return UsageDANEEE, nil
+	case "dane-ta", "2":
+		return UsageDANETA, nil
+	default:
+		return 0, fmt.Errorf("tlsa: unknown certificate usage: %s", name)
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tlsa
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func genCert(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	if !isCA {
+		tmpl.DNSNames = []string{name}
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestForChain(t *testing.T) {
+	ca, caKey := genCert(t, "Test CA", true, nil, nil)
+	leaf, _ := genCert(t, "mx.example.org", false, ca, caKey)
+
+	recs, err := ForChain("mx.example.org", 25, []*x509.Certificate{leaf, ca}, []uint8{UsageDANEEE, UsageDANETA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 {
+		t.Fatal("Wrong amount of records:", recs)
+	}
+
+	for i, cert := range []*x509.Certificate{leaf, ca} {
+		rec := recs[i]
+		if rec.Name != "_25._tcp.mx.example.org." {
+			t.Error("Wrong owner name:", rec.Name)
+		}
+		rr, err := dns.NewRR(rec.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rr.(*dns.TLSA).Verify(cert); err != nil {
+			t.Errorf("Record %v does not match the certificate: %v", rec, err)
+		}
+	}
+	if recs[0].Usage != UsageDANEEE || recs[1].Usage != UsageDANETA {
+		t.Error("Wrong usages:", recs)
+	}
+
+	// There is no issuer for self-signed certificates.
+	recs, err = ForChain("mx.example.org", 25, []*x509.Certificate{ca}, []uint8{UsageDANEEE, UsageDANETA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].Usage != UsageDANEEE {
+		t.Error("Wrong records for self-signed certificate:", recs)
+	}
+}
+
+func TestServedCertificate(t *testing.T) {
+	ca, caKey := genCert(t, "Test CA", true, nil, nil)
+	leaf1, _ := genCert(t, "mx1.example.org", false, ca, caKey)
+	leaf2, _ := genCert(t, "mx2.example.org", false, ca, caKey)
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{
+			{Certificate: [][]byte{leaf1.Raw, ca.Raw}},
+			{Certificate: [][]byte{leaf2.Raw, ca.Raw}},
+		},
+	}
+	wrapped := &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return cfg, nil
+		},
+	}
+
+	cert, err := ServedCertificate(wrapped, "mx2.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cert.Certificate[0]) != string(leaf2.Raw) {
+		t.Error("Wrong certificate selected")
+	}
+
+	cert, err = ServedCertificate(wrapped, "unknown.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cert.Certificate[0]) != string(leaf1.Raw) {
+		t.Error("First certificate is not used as a fallback")
+	}
+
+	if _, err := ServedCertificate(&tls.Config{}, "mx.example.org"); err == nil {
+		t.Error("Expected error for empty configuration")
+	}
+}
+
+func TestZone(t *testing.T) {
+	recs := []Record{
+		{Name: "_25._tcp.mx2.example.org.", Usage: 3, Selector: 1, MatchingType: 1, Data: "BB"},
+		{Name: "_25._tcp.mx1.example.org.", Usage: 3, Selector: 1, MatchingType: 1, Data: "AA"},
+	}
+	zone := Zone(recs)
+	expected := "_25._tcp.mx1.example.org. IN TLSA 3 1 1 AA\n" +
+		"_25._tcp.mx2.example.org. IN TLSA 3 1 1 BB\n"
+	if zone != expected {
+		t.Errorf("Wrong zone:\n%s", zone)
+	}
+	if !strings.HasPrefix(recs[0].Name, "_25._tcp.mx2") {
+		t.Error("Zone modified the passed slice")
+	}
+}
+
+func TestParseUsage(t *testing.T) {
+	for name, expected := range map[string]uint8{"dane-ee": 3, "DANE-TA": 2, "3": 3} {
+		usage, err := ParseUsage(name)
+		if err != nil {
+			t.Error(name, err)
+		}
+		if usage != expected {
+			t.Error(name, "wrong usage:", usage)
+		}
+	}
+	if _, err := ParseUsage("pkix-ee"); err == nil {
+		t.Error("Expected error for PKIX-EE")
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package transcript
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+)
+
+// Conn wraps the server side of the connection and records the data
+// sent over it.
+type Conn struct {
+	net.Conn
+	Recorder *Recorder
+
+	// If Passive is set, the data is not recorded and Recorder is only
+	// closed together with the connection. Used if the data is recorded
+	// at the higher level, e.g. via smtp.Client.DebugWriter.
+	Passive bool
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.Passive {
+		c.Recorder.Record(DirClient, b[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if !c.Passive {
+		c.Recorder.Record(DirServer, b[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Close() error {
+	err := c.Conn.Close()
+	c.Recorder.Close()
+	return err
+}
+
+// FromConn returns the Recorder used for the connection, if any.
+func FromConn(conn net.Conn) *Recorder {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if c, ok := conn.(*Conn); ok {
+		return c.Recorder
+	}
+	return nil
+}
+
+// Listener wraps accepted connections into Conn if recording is enabled.
+//
+// Implicit TLS connections are returned as is since servers rely on the
+// *tls.Conn type to detect them.
+type Listener struct {
+	net.Listener
+}
+
+func (l Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := conn.(*tls.Conn); ok {
+		return conn, nil
+	}
+
+	rec := Start("in", conn.RemoteAddr())
+	if rec == nil {
+		return conn, nil
+	}
+	return &Conn{Conn: conn, Recorder: rec}, nil
+}
+
+// TLSConfig returns the server TLS configuration that records handshake
+// parameters for connections wrapped into Conn.
+func TLSConfig(base *tls.Config) *tls.Config {
+	if base == nil {
+		return nil
+	}
+
+	cfg := base.Clone()
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		var (
+			connCfg *tls.Config
+			err     error
+		)
+		if base.GetConfigForClient != nil {
+			connCfg, err = base.GetConfigForClient(hello)
+		}
+
+		rec := FromConn(hello.Conn)
+		if rec == nil {
+			return connCfg, err
+		}
+
+		rec.Note("TLS ClientHello: server_name=%q versions=%s alpn=%q", hello.ServerName,
+			versionNames(hello.SupportedVersions), hello.SupportedProtos)
+		if err != nil {
+			rec.TLSCompleted(err)
+			return nil, err
+		}
+
+		if connCfg == nil {
+			connCfg = base
+		}
+		connCfg = connCfg.Clone()
+		verify := connCfg.VerifyConnection
+		connCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					rec.TLSCompleted(err)
+					return err
+				}
+			}
+			rec.Note("TLS established: version=%s cipher=%s", tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite))
+			rec.TLSCompleted(nil)
+			return nil
+		}
+		return connCfg, nil
+	}
+	return cfg
+}
+
+func versionNames(versions []uint16) string {
+	names := make([]string, 0, len(versions))
+	for _, v := range versions {
+		names = append(names, tls.VersionName(v))
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,149 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package transcript
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+)
+
+// Filter selects sessions to record.
+//
+// A session is recorded if any of the rules matches. Filter without rules
+// matches all sessions.
+type Filter struct {
+	nets    []net.IPNet
+	senders []string
+	domains []string
+}
+
+// ReadFilter parses the filter rules.
+//
+// Each line contains a rule type and a value:
+//
+//	ip 192.0.2.0/24
+//	sender user@example.org
+//	sender example.org
+//	domain example.com
+//
+// Empty lines and lines starting with '#' are ignored.
+func ReadFilter(r io.Reader) (*Filter, error) {
+	f := &Filter{}
+	scnr := bufio.NewScanner(r)
+	lineNum := 0
+	for scnr.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("transcript: line %d: expected rule type and value", lineNum)
+		}
+
+		switch parts[0] {
+		case "ip":
+			cidr := parts[1]
+			if !strings.Contains(cidr, "/") {
+				if strings.Contains(cidr, ":") {
+					cidr += "/128"
+				} else {
+					cidr += "/32"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("transcript: line %d: %w", lineNum, err)
+			}
+			f.nets = append(f.nets, *ipNet)
+		case "sender":
+			f.senders = append(f.senders, strings.ToLower(parts[1]))
+		case "domain":
+			f.domains = append(f.domains, strings.ToLower(parts[1]))
+		default:
+			return nil, fmt.Errorf("transcript: line %d: unknown rule type: %s", lineNum, parts[0])
+		}
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, fmt.Errorf("transcript: %w", err)
+	}
+
+	return f, nil
+}
+
+func (f *Filter) empty() bool {
+	return len(f.nets) == 0 && len(f.senders) == 0 && len(f.domains) == 0
+}
+
+func (f *Filter) matchAddr(addr net.Addr) bool {
+	if f.empty() {
+		return true
+	}
+
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return false
+	}
+
+	for _, n := range f.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) matchSender(from string) bool {
+	from = strings.ToLower(from)
+	_, domain, err := address.Split(from)
+	if err != nil {
+		return false
+	}
+	for _, s := range f.senders {
+		if s == from || s == domain {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) matchRcpt(to string) bool {
+	_, domain, err := address.Split(strings.ToLower(to))
+	if err != nil {
+		return false
+	}
+	for _, d := range f.domains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
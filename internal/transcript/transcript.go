@@ -0,0 +1,402 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package transcript implements the diagnostic mode that records SMTP
+// protocol transcripts to files.
+//
+// Recording is enabled by creating the filter file (see FilterPath) and
+// sending SIGUSR2 to the server. Removing the file and sending SIGUSR2
+// again disables it.
+//
+// Since sender and recipient filters can be evaluated only in the middle of
+// the session, transcripts are kept in memory until any filter rule matches.
+// Transcripts of sessions that never match are discarded.
+package transcript
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// MaxSize is the maximum size of a single transcript. Everything past
+// that is dropped.
+const MaxSize = 1024 * 1024
+
+// maxLine is the maximum length of a recorded line. Longer lines are split.
+const maxLine = 4096
+
+const (
+	// DirClient marks data sent by the SMTP client.
+	DirClient = "C: "
+	// DirServer marks data sent by the SMTP server.
+	DirServer = "S: "
+	// DirUnknown is used for data streams that mix both directions.
+	DirUnknown = ""
+)
+
+var filter atomic.Pointer[Filter]
+
+// FilterPath returns the path to the file with filter rules.
+func FilterPath() string {
+	return filepath.Join(config.RuntimeDirectory, "transcript_filter")
+}
+
+// Dir returns the path to the directory transcripts are written to.
+func Dir() string {
+	return filepath.Join(config.RuntimeDirectory, "transcripts")
+}
+
+// Init reads the filter file, if it exists, and installs the hook to reread
+// it on SIGUSR2.
+func Init() {
+	reload()
+	hooks.AddHook(hooks.EventReload, reload)
+}
+
+func reload() {
+	f, err := os.Open(FilterPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("transcript: %v", err)
+		}
+		if filter.Swap(nil) != nil {
+			log.Printf("transcript: SMTP session recording disabled")
+		}
+		return
+	}
+	defer f.Close()
+
+	flt, err := ReadFilter(f)
+	if err != nil {
+		// Keep the old filter so a typo does not silently disable recording.
+		log.Printf("%v", err)
+		return
+	}
+	if filter.Swap(flt) == nil {
+		log.Printf("transcript: SMTP session recording enabled, writing to %s", Dir())
+	}
+}
+
+// SetFilter replaces the currently used filter. nil disables recording.
+func SetFilter(f *Filter) {
+	filter.Store(f)
+}
+
+// Recorder accumulates the transcript of a single session.
+//
+// All methods are safe to call on nil Recorder and do nothing in this case.
+type Recorder struct {
+	mu     sync.Mutex
+	filter *Filter
+	kind   string
+
+	matched bool
+	pending bytes.Buffer
+	f       *os.File
+	size    int
+
+	partial map[string][]byte
+	inAuth  bool
+
+	// Set when STARTTLS is accepted, data recorded by Conn is ciphertext
+	// past that point.
+	startTLS   bool
+	tlsStarted bool
+	tlsDone    bool
+
+	closed bool
+}
+
+// Start creates the Recorder for the new session if recording is enabled.
+//
+// kind is used in the file name to distinguish incoming ("in") and outgoing
+// ("out") sessions.
+func Start(kind string, remote net.Addr) *Recorder {
+	flt := filter.Load()
+	if flt == nil {
+		return nil
+	}
+
+	r := &Recorder{
+		filter:  flt,
+		kind:    kind,
+		partial: make(map[string][]byte),
+	}
+	r.Note("session started at %s, remote address %v", time.Now().Format(time.RFC3339), remote)
+	if remote != nil && flt.matchAddr(remote) {
+		r.mu.Lock()
+		r.match()
+		r.mu.Unlock()
+	}
+	return r
+}
+
+func (r *Recorder) match() {
+	if r.matched {
+		return
+	}
+	r.matched = true
+
+	if err := os.MkdirAll(Dir(), 0o700); err != nil {
+		log.Printf("transcript: %v", err)
+		return
+	}
+
+	var rnd [4]byte
+	_, _ = rand.Read(rnd[:])
+	name := fmt.Sprintf("%s-%s-%s.txt", r.kind, time.Now().Format("20060102T150405"), hex.EncodeToString(rnd[:]))
+
+	f, err := os.OpenFile(filepath.Join(Dir(), name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("transcript: %v", err)
+		return
+	}
+	if _, err := r.pending.WriteTo(f); err != nil {
+		log.Printf("transcript: %v", err)
+	}
+	r.f = f
+}
+
+func (r *Recorder) emit(line string) {
+	if r.closed || r.size >= MaxSize {
+		return
+	}
+	r.size += len(line)
+	if r.size >= MaxSize {
+		line += "# transcript size limit reached, the rest is not recorded\n"
+	}
+
+	if !r.matched {
+		r.pending.WriteString(line)
+		return
+	}
+	if r.f == nil {
+		return
+	}
+	if _, err := io.WriteString(r.f, line); err != nil {
+		log.Printf("transcript: %v", err)
+		r.f.Close()
+		r.f = nil
+	}
+}
+
+// Note adds the annotation to the transcript.
+func (r *Recorder) Note(format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.emit("# " + fmt.Sprintf(format, args...) + "\n")
+}
+
+// Record adds data sent over the connection to the transcript.
+//
+// dir is one of DirClient, DirServer or DirUnknown.
+func (r *Recorder) Record(dir string, b []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.tlsStarted && dir != DirUnknown {
+		return
+	}
+
+	buf := append(r.partial[dir], b...)
+	for {
+		idx := bytes.IndexByte(buf, '\n')
+		if idx == -1 {
+			if len(buf) < maxLine {
+				break
+			}
+			idx = maxLine
+		}
+		r.line(dir, strings.TrimRight(string(buf[:idx]), "\r\n"))
+		if idx < len(buf) && buf[idx] == '\n' {
+			idx++
+		}
+		buf = buf[idx:]
+
+		if r.tlsStarted && dir != DirUnknown {
+			buf = nil
+			break
+		}
+	}
+	r.partial[dir] = append(r.partial[dir][:0], buf...)
+}
+
+func isReply(line string) bool {
+	if len(line) < 3 {
+		return false
+	}
+	for _, c := range line[:3] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(line) == 3 || line[3] == ' ' || line[3] == '-'
+}
+
+func (r *Recorder) line(dir, line string) {
+	fromServer := dir == DirServer || (dir == DirUnknown && isReply(line))
+	if fromServer {
+		if r.inAuth && !strings.HasPrefix(line, "334") {
+			r.inAuth = false
+		}
+		if r.startTLS {
+			r.startTLS = false
+			// Only the raw connection data becomes unreadable after
+			// STARTTLS. Unlabeled streams come from smtp.Client that
+			// continues to log the plaintext.
+			if strings.HasPrefix(line, "220") && dir != DirUnknown {
+				r.emit(dir + line + "\n")
+				r.tlsStarted = true
+				r.emit("# TLS handshake started, raw data is not recorded past this point\n")
+				return
+			}
+		}
+		r.emit(dir + line + "\n")
+		return
+	}
+
+	upper := strings.ToUpper(line)
+	switch {
+	case r.inAuth:
+		// SASL exchange, may contain credentials.
+		line = "[redacted]"
+	case strings.HasPrefix(upper, "AUTH "):
+		r.inAuth = true
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			line = fields[0] + " " + fields[1] + " [redacted]"
+		}
+	case upper == "STARTTLS":
+		r.startTLS = true
+	}
+	r.emit(dir + line + "\n")
+}
+
+// Writer returns the io.Writer that records data mixing both directions,
+// such as smtp.Client.DebugWriter output.
+func (r *Recorder) Writer() io.Writer {
+	if r == nil {
+		return nil
+	}
+	return writer{r}
+}
+
+type writer struct {
+	r *Recorder
+}
+
+func (w writer) Write(b []byte) (int, error) {
+	w.r.Record(DirUnknown, b)
+	return len(b), nil
+}
+
+// Sender checks the sender address against the filter.
+func (r *Recorder) Sender(from string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tlsStarted {
+		r.emit(fmt.Sprintf("# MAIL FROM:<%s>\n", from))
+	}
+	if r.filter.matchSender(from) {
+		r.match()
+	}
+}
+
+// Rcpt checks the recipient address against the filter.
+func (r *Recorder) Rcpt(to string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tlsStarted {
+		r.emit(fmt.Sprintf("# RCPT TO:<%s>\n", to))
+	}
+	if r.filter.matchRcpt(to) {
+		r.match()
+	}
+}
+
+// TLSCompleted records the result of the TLS handshake.
+func (r *Recorder) TLSCompleted(err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tlsDone = true
+	if err != nil {
+		r.emit(fmt.Sprintf("# TLS handshake failed: %v\n", err))
+	}
+}
+
+// Close writes the remaining data and closes the transcript file.
+func (r *Recorder) Close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	for dir, buf := range r.partial {
+		if len(buf) != 0 && !(r.tlsStarted && dir != DirUnknown) {
+			r.line(dir, string(buf))
+		}
+	}
+	r.partial = map[string][]byte{}
+	if r.tlsStarted && !r.tlsDone {
+		r.emit("# TLS handshake did not complete\n")
+	}
+	r.emit("# session closed at " + time.Now().Format(time.RFC3339) + "\n")
+	r.closed = true
+
+	if r.f != nil {
+		if err := r.f.Close(); err != nil {
+			log.Printf("transcript: %v", err)
+		}
+		r.f = nil
+	}
+	r.pending.Reset()
+}
@@ -0,0 +1,170 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package transcript
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func setup(t *testing.T, rules string) {
+	t.Helper()
+
+	config.RuntimeDirectory = testutils.Dir(t)
+	f, err := ReadFilter(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetFilter(f)
+	t.Cleanup(func() { SetFilter(nil) })
+}
+
+func transcripts(t *testing.T) []string {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(Dir(), "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make([]string, 0, len(files))
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, string(b))
+	}
+	return res
+}
+
+var remote = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2525}
+
+func TestRecorder_Redaction(t *testing.T) {
+	setup(t, "ip 192.0.2.0/24")
+
+	r := Start("in", remote)
+	r.Record(DirServer, []byte("220 mx.example.org ESMTP\r\n"))
+	r.Record(DirClient, []byte("AUTH PLAIN AHVzZXIAcGFzcw==\r\n"))
+	r.Record(DirServer, []byte("235 OK\r\n"))
+	r.Record(DirClient, []byte("AUTH LOGIN\r\n"))
+	r.Record(DirServer, []byte("334 VXNlcm5hbWU6\r\n"))
+	r.Record(DirClient, []byte("dXNlcg==\r"))
+	r.Record(DirClient, []byte("\n"))
+	r.Record(DirServer, []byte("334 UGFzc3dvcmQ6\r\n"))
+	r.Record(DirClient, []byte("cGFzcw==\r\n"))
+	r.Record(DirServer, []byte("235 OK\r\n"))
+	r.Record(DirClient, []byte("MAIL FROM:<a@example.org>\r\n"))
+	r.Close()
+
+	files := transcripts(t)
+	if len(files) != 1 {
+		t.Fatal("Expected one transcript, got", len(files))
+	}
+	data := files[0]
+	for _, secret := range []string{"AHVzZXIAcGFzcw==", "dXNlcg==", "cGFzcw=="} {
+		if strings.Contains(data, secret) {
+			t.Errorf("Transcript contains credentials (%s):\n%s", secret, data)
+		}
+	}
+	for _, line := range []string{
+		"C: AUTH PLAIN [redacted]\n",
+		"S: 334 VXNlcm5hbWU6\n",
+		"C: [redacted]\n",
+		"C: MAIL FROM:<a@example.org>\n",
+	} {
+		if !strings.Contains(data, line) {
+			t.Errorf("Transcript does not contain %q:\n%s", line, data)
+		}
+	}
+}
+
+func TestRecorder_DeferredMatch(t *testing.T) {
+	setup(t, "domain example.com")
+
+	r := Start("in", remote)
+	r.Record(DirClient, []byte("MAIL FROM:<a@example.org>\r\n"))
+	r.Sender("a@example.org")
+	r.Record(DirClient, []byte("RCPT TO:<b@example.org>\r\n"))
+	r.Rcpt("b@example.org")
+	r.Close()
+	if files := transcripts(t); len(files) != 0 {
+		t.Fatal("Non-matching session is recorded")
+	}
+
+	r = Start("in", remote)
+	r.Record(DirClient, []byte("MAIL FROM:<a@example.org>\r\n"))
+	r.Sender("a@example.org")
+	r.Record(DirClient, []byte("RCPT TO:<b@EXAMPLE.com>\r\n"))
+	r.Rcpt("b@EXAMPLE.com")
+	r.Record(DirClient, []byte("QUIT\r\n"))
+	r.Close()
+
+	files := transcripts(t)
+	if len(files) != 1 {
+		t.Fatal("Expected one transcript, got", len(files))
+	}
+	if !strings.Contains(files[0], "C: MAIL FROM:<a@example.org>\n") {
+		t.Error("Data recorded before the match is missing:\n", files[0])
+	}
+	if !strings.Contains(files[0], "C: QUIT\n") {
+		t.Error("Data recorded after the match is missing:\n", files[0])
+	}
+}
+
+func TestRecorder_STARTTLS(t *testing.T) {
+	setup(t, "")
+
+	r := Start("in", remote)
+	r.Record(DirClient, []byte("STARTTLS\r\n"))
+	r.Record(DirServer, []byte("220 Ready to start TLS\r\n\x16\x03\x01"))
+	r.Record(DirClient, []byte("\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03\r\n"))
+	r.Sender("a@example.org")
+	r.Close()
+
+	files := transcripts(t)
+	if len(files) != 1 {
+		t.Fatal("Expected one transcript, got", len(files))
+	}
+	data := files[0]
+	if strings.Contains(data, "\x16\x03") {
+		t.Errorf("Transcript contains TLS records:\n%q", data)
+	}
+	for _, line := range []string{
+		"S: 220 Ready to start TLS\n",
+		"# MAIL FROM:<a@example.org>\n",
+		"# TLS handshake did not complete\n",
+	} {
+		if !strings.Contains(data, line) {
+			t.Errorf("Transcript does not contain %q:\n%s", line, data)
+		}
+	}
+}
+
+func TestRecorder_Disabled(t *testing.T) {
+	SetFilter(nil)
+	if r := Start("in", remote); r != nil {
+		t.Fatal("Recorder created with recording disabled")
+	}
+}
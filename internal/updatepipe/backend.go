@@ -18,6 +18,12 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package updatepipe
 
+import (
+	"io"
+
+	mess "github.com/foxcpp/go-imap-mess"
+)
+
 type BackendMode int
 
 const (
@@ -43,3 +49,12 @@ type Backend interface {
 	// This method is idempotent. All calls after a successful one do nothing.
 	EnableUpdatePipe(mode BackendMode) error
 }
+
+// The Subscriber interface is implemented by storage backends that allow
+// other processes to follow updates made by the running server and the
+// maddy command.
+type Subscriber interface {
+	// SubscribeUpdates starts sending all updates passing through the
+	// update pipe to the channel until the returned Closer is closed.
+	SubscribeUpdates(upds chan<- mess.Update) (io.Closer, error)
+}
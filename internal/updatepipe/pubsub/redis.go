@@ -0,0 +1,225 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/redis"
+)
+
+const redisReconnectWait = 5 * time.Second
+
+// RedisPubSub implements PubSub using Redis PUBLISH/SUBSCRIBE commands.
+//
+// Two connections are used: one in the subscribe mode that receives
+// messages and one for publishing. Both are reestablished if lost, all
+// channels are resubscribed after the reconnection.
+type RedisPubSub struct {
+	Notify chan Msg
+
+	Log log.Logger
+
+	opts   redis.Options
+	prefix string
+
+	subLck   sync.Mutex
+	sub      *redis.Conn
+	channels map[string]struct{}
+
+	pub *redis.Client
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewRedis creates the RedisPubSub connected to the server specified by the
+// URL, see redis.ParseURL for supported formats.
+//
+// All channel names are prefixed with the prefix string to allow multiple
+// installations to share the same Redis server.
+func NewRedis(redisURL, prefix string) (*RedisPubSub, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: %w", err)
+	}
+
+	r := &RedisPubSub{
+		Notify:   make(chan Msg),
+		Log:      log.Logger{Name: "redispubsub"},
+		opts:     opts,
+		prefix:   prefix,
+		channels: make(map[string]struct{}),
+		closed:   make(chan struct{}),
+	}
+
+	// Check the server is reachable and credentials are correct
+	// right away instead of failing on the first update.
+	r.pub, err = redis.NewClient(opts)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: %w", err)
+	}
+	if err := r.reconnectSub(); err != nil {
+		r.pub.Close()
+		return nil, err
+	}
+
+	r.wg.Add(1)
+	go r.readLoop()
+
+	return r, nil
+}
+
+func (r *RedisPubSub) reconnectSub() error {
+	conn, err := redis.Dial(r.opts)
+	if err != nil {
+		return fmt.Errorf("pubsub: %w", err)
+	}
+
+	r.subLck.Lock()
+	defer r.subLck.Unlock()
+
+	select {
+	case <-r.closed:
+		conn.Close()
+		return errors.New("pubsub: closed")
+	default:
+	}
+
+	if len(r.channels) != 0 {
+		args := make([]string, 0, len(r.channels)+1)
+		args = append(args, "SUBSCRIBE")
+		for ch := range r.channels {
+			args = append(args, ch)
+		}
+		if err := conn.Send(args...); err != nil {
+			conn.Close()
+			return fmt.Errorf("pubsub: %w", err)
+		}
+	}
+
+	r.sub = conn
+	return nil
+}
+
+func (r *RedisPubSub) readLoop() {
+	defer r.wg.Done()
+	defer close(r.Notify)
+
+	for {
+		r.subLck.Lock()
+		conn := r.sub
+		r.subLck.Unlock()
+
+		err := r.readMessages(conn)
+
+		select {
+		case <-r.closed:
+			return
+		default:
+		}
+		conn.Close()
+		r.Log.Error("connection lost", err)
+
+		for {
+			select {
+			case <-r.closed:
+				return
+			case <-time.After(redisReconnectWait):
+			}
+			err := r.reconnectSub()
+			if err == nil {
+				r.Log.Msg("connection reestablished")
+				break
+			}
+			r.Log.Error("connection attempt failed", err)
+		}
+	}
+}
+
+func (r *RedisPubSub) readMessages(conn *redis.Conn) error {
+	for {
+		val, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		parts, ok := val.([]interface{})
+		if !ok || len(parts) < 3 {
+			continue
+		}
+		kind, _ := parts[0].(string)
+		if kind != "message" {
+			// Confirmations for SUBSCRIBE/UNSUBSCRIBE.
+			continue
+		}
+		channel, _ := parts[1].(string)
+		payload, _ := parts[2].(string)
+
+		select {
+		case r.Notify <- Msg{Key: strings.TrimPrefix(channel, r.prefix), Payload: payload}:
+		case <-r.closed:
+			return nil
+		}
+	}
+}
+
+func (r *RedisPubSub) subCommand(cmd, key string) error {
+	r.subLck.Lock()
+	defer r.subLck.Unlock()
+
+	channel := r.prefix + key
+	if cmd == "SUBSCRIBE" {
+		r.channels[channel] = struct{}{}
+	} else {
+		delete(r.channels, channel)
+	}
+
+	// If the connection is broken, the channel list is used after
+	// reconnection so there is no need to report the error.
+	if err := r.sub.SetWriteDeadline(time.Now().Add(30 * time.Second)); err != nil {
+		return nil
+	}
+	if err := r.sub.Send(cmd, channel); err != nil {
+		r.Log.DebugMsg("write failed, will resubscribe after reconnection", "reason", err)
+	}
+	return nil
+}
+
+func (r *RedisPubSub) Subscribe(_ context.Context, key string) error {
+	return r.subCommand("SUBSCRIBE", key)
+}
+
+func (r *RedisPubSub) Unsubscribe(_ context.Context, key string) error {
+	return r.subCommand("UNSUBSCRIBE", key)
+}
+
+func (r *RedisPubSub) Publish(key, payload string) error {
+	_, err := r.pub.Do("PUBLISH", r.prefix+key, payload)
+	return err
+}
+
+func (r *RedisPubSub) Listener() chan Msg {
+	return r.Notify
+}
+
+func (r *RedisPubSub) Close() error {
+	r.subLck.Lock()
+	select {
+	case <-r.closed:
+		r.subLck.Unlock()
+		return nil
+	default:
+	}
+	close(r.closed)
+	r.sub.Close()
+	r.subLck.Unlock()
+
+	r.pub.Close()
+
+	r.wg.Wait()
+	return nil
+}
@@ -0,0 +1,67 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/redis"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestRedisPubSub(t *testing.T) {
+	srv := testutils.NewRedisServer(t, "secret")
+
+	sub, err := NewRedis(srv.URL(), "test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	pub, err := NewRedis(srv.URL(), "test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	if err := sub.Subscribe(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; srv.Subscribers("test.key") == 0; i++ {
+		if i == 100 {
+			t.Fatal("subscription is not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := pub.Publish("key", "payload\r\nwith newline"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-sub.Listener():
+		if msg.Key != "key" {
+			t.Errorf("wrong key: %q", msg.Key)
+		}
+		if msg.Payload != "payload\r\nwith newline" {
+			t.Errorf("wrong payload: %q", msg.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+}
+
+func TestRedisPubSub_WrongPassword(t *testing.T) {
+	srv := testutils.NewRedisServer(t, "secret")
+	url := strings.Replace(srv.URL(), ":secret@", ":wrong@", 1)
+
+	_, err := NewRedis(url, "")
+	var redisErr redis.Error
+	if !errors.As(err, &redisErr) {
+		t.Fatalf("expected redis.Error, got %v", err)
+	}
+	if !strings.HasPrefix(string(redisErr), "WRONGPASS") {
+		t.Errorf("unexpected error: %v", redisErr)
+	}
+}
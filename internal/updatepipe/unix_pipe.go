@@ -20,15 +20,32 @@ package updatepipe
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"sync"
+	"syscall"
+	"time"
 
 	mess "github.com/foxcpp/go-imap-mess"
 	"github.com/foxcpp/maddy/framework/log"
 )
 
+const (
+	// subscribeCmd is sent by subscribers as the first line to receive all
+	// updates passing through the socket.
+	subscribeCmd = "SUBSCRIBE"
+
+	// subscriberQueue is the amount of updates buffered for a subscriber.
+	// Subscribers that do not keep up are disconnected.
+	subscriberQueue = 128
+
+	writeTimeout     = 5 * time.Second
+	reconnectBackoff = time.Second
+)
+
 // UnixSockPipe implements the UpdatePipe interface by serializating updates
 // to/from a Unix domain socket. Due to the way Unix sockets work, only one
 // Listen goroutine can be running.
@@ -40,6 +57,10 @@ import (
 // And SENDER_ID is Process ID and UnixSockPipe address concated as a string.
 // It is used to deduplicate updates sent to Push and recevied via Listen.
 //
+// A connection that starts with the SUBSCRIBE line receives all updates
+// sent to the socket by other connections in the same format, this allows
+// other processes to follow mailbox changes using Subscribe.
+//
 // The SockPath field specifies the socket path to use. The actual socket
 // is initialized on the first call to Listen or (Init)Push.
 type UnixSockPipe struct {
@@ -47,7 +68,20 @@ type UnixSockPipe struct {
 	Log      log.Logger
 
 	listener net.Listener
-	sender   net.Conn
+
+	senderLck sync.Mutex
+	sender    net.Conn
+
+	subsLck sync.Mutex
+	// Connections accepted by the listening socket.
+	accepted map[net.Conn]struct{}
+	// Connections of subscribers to the listening socket.
+	subs map[net.Conn]chan string
+	// Connections opened by Subscribe.
+	subConns map[net.Conn]struct{}
+
+	closed   chan struct{}
+	closeLck sync.Once
 }
 
 var _ P = &UnixSockPipe{}
@@ -56,14 +90,40 @@ func (usp *UnixSockPipe) myID() string {
 	return fmt.Sprintf("%d-%p", os.Getpid(), usp)
 }
 
+func (usp *UnixSockPipe) closedCh() chan struct{} {
+	usp.closeLck.Do(func() {
+		usp.closed = make(chan struct{})
+	})
+	return usp.closed
+}
+
 func (usp *UnixSockPipe) readUpdates(conn net.Conn, updCh chan<- mess.Update) {
+	defer func() {
+		usp.subsLck.Lock()
+		delete(usp.accepted, conn)
+		usp.subsLck.Unlock()
+		conn.Close()
+	}()
+
 	scnr := bufio.NewScanner(conn)
+	scnr.Buffer(nil, 1024*1024)
+	first := true
 	for scnr.Scan() {
-		id, upd, err := parseUpdate(scnr.Text())
+		line := scnr.Text()
+		if first && line == subscribeCmd {
+			usp.serveSubscriber(conn)
+			return
+		}
+		first = false
+
+		id, upd, err := parseUpdate(line)
 		if err != nil {
-			usp.Log.Error("malformed update received", err, "str", scnr.Text())
+			usp.Log.Error("malformed update received", err, "str", line)
+			continue
 		}
 
+		usp.broadcast(line+"\n", conn)
+
 		// It is our own update, skip.
 		if id == usp.myID() {
 			continue
@@ -73,8 +133,80 @@ func (usp *UnixSockPipe) readUpdates(conn net.Conn, updCh chan<- mess.Update) {
 	}
 }
 
-func (usp *UnixSockPipe) Listen(upd chan<- mess.Update) error {
+func (usp *UnixSockPipe) serveSubscriber(conn net.Conn) {
+	queue := make(chan string, subscriberQueue)
+	usp.subsLck.Lock()
+	if usp.subs == nil {
+		usp.subs = make(map[net.Conn]chan string)
+	}
+	usp.subs[conn] = queue
+	usp.subsLck.Unlock()
+
+	defer func() {
+		usp.subsLck.Lock()
+		delete(usp.subs, conn)
+		usp.subsLck.Unlock()
+	}()
+
+	// Detect disconnection of the subscriber, it is not supposed to send
+	// anything.
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		conn.Close()
+	}()
+
+	for updStr := range queue {
+		if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, updStr); err != nil {
+			usp.Log.DebugMsg("subscriber disconnected", "reason", err)
+			return
+		}
+	}
+}
+
+// broadcast sends the serialized update to all subscribers except the
+// connection it was received from.
+func (usp *UnixSockPipe) broadcast(updStr string, origin net.Conn) {
+	usp.subsLck.Lock()
+	defer usp.subsLck.Unlock()
+	for conn, queue := range usp.subs {
+		if conn == origin {
+			continue
+		}
+		select {
+		case queue <- updStr:
+		default:
+			usp.Log.Msg("subscriber is too slow, disconnecting")
+			close(queue)
+			delete(usp.subs, conn)
+		}
+	}
+}
+
+// listen creates the listening socket removing the stale socket file left
+// by a crashed process, if any.
+func (usp *UnixSockPipe) listen() (net.Listener, error) {
 	l, err := net.Listen("unix", usp.SockPath)
+	if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+		return l, err
+	}
+
+	conn, dialErr := net.Dial("unix", usp.SockPath)
+	if dialErr == nil {
+		conn.Close()
+		return nil, fmt.Errorf("updatepipe: socket is used by another process: %w", err)
+	}
+	usp.Log.Msg("removing stale socket", "path", usp.SockPath)
+	if err := os.Remove(usp.SockPath); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", usp.SockPath)
+}
+
+func (usp *UnixSockPipe) Listen(upd chan<- mess.Update) error {
+	l, err := usp.listen()
 	if err != nil {
 		return err
 	}
@@ -85,13 +217,126 @@ func (usp *UnixSockPipe) Listen(upd chan<- mess.Update) error {
 			if err != nil {
 				return
 			}
+			usp.subsLck.Lock()
+			if usp.accepted == nil {
+				usp.accepted = make(map[net.Conn]struct{})
+			}
+			usp.accepted[conn] = struct{}{}
+			usp.subsLck.Unlock()
 			go usp.readUpdates(conn, upd)
 		}
 	}()
 	return nil
 }
 
+// StopListening closes the listening socket so another UnixSockPipe with
+// the same SockPath can call Listen. Accepted connections are closed so
+// senders and subscribers reconnect to the new listener. The pipe can still
+// be used to push updates.
+func (usp *UnixSockPipe) StopListening() {
+	if usp.listener == nil {
+		return
+	}
+	usp.listener.Close()
+	usp.listener = nil
+
+	usp.subsLck.Lock()
+	defer usp.subsLck.Unlock()
+	for conn := range usp.accepted {
+		conn.Close()
+	}
+}
+
+// Subscribe connects to the socket of the process that called Listen and
+// starts the goroutine that sends all updates passing through it to the
+// channel. The connection is reestablished if it is lost (e.g. the server is
+// restarted) until Close is called.
+//
+// Updates sent using Push of the same UnixSockPipe are not sent to the
+// channel.
+func (usp *UnixSockPipe) Subscribe(upds chan<- mess.Update) error {
+	conn, err := usp.dialSubscriber()
+	if err != nil {
+		return err
+	}
+
+	closed := usp.closedCh()
+	go func() {
+		for {
+			usp.readSubscription(conn, upds)
+
+			for {
+				select {
+				case <-closed:
+					return
+				case <-time.After(reconnectBackoff):
+				}
+				conn, err = usp.dialSubscriber()
+				if err == nil {
+					select {
+					case <-closed:
+						conn.Close()
+						return
+					default:
+					}
+					break
+				}
+				usp.Log.DebugMsg("failed to reconnect", "reason", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (usp *UnixSockPipe) dialSubscriber() (net.Conn, error) {
+	conn, err := net.Dial("unix", usp.SockPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(conn, subscribeCmd+"\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	usp.subsLck.Lock()
+	if usp.subConns == nil {
+		usp.subConns = make(map[net.Conn]struct{})
+	}
+	usp.subConns[conn] = struct{}{}
+	usp.subsLck.Unlock()
+	return conn, nil
+}
+
+func (usp *UnixSockPipe) readSubscription(conn net.Conn, upds chan<- mess.Update) {
+	defer func() {
+		usp.subsLck.Lock()
+		delete(usp.subConns, conn)
+		usp.subsLck.Unlock()
+		conn.Close()
+	}()
+
+	scnr := bufio.NewScanner(conn)
+	scnr.Buffer(nil, 1024*1024)
+	for scnr.Scan() {
+		id, upd, err := parseUpdate(scnr.Text())
+		if err != nil {
+			usp.Log.Error("malformed update received", err, "str", scnr.Text())
+			continue
+		}
+		if id == usp.myID() {
+			continue
+		}
+		upds <- *upd
+	}
+}
+
 func (usp *UnixSockPipe) InitPush() error {
+	usp.senderLck.Lock()
+	defer usp.senderLck.Unlock()
+	return usp.initPush()
+}
+
+func (usp *UnixSockPipe) initPush() error {
 	sock, err := net.Dial("unix", usp.SockPath)
 	if err != nil {
 		return err
@@ -102,28 +347,61 @@ func (usp *UnixSockPipe) InitPush() error {
 }
 
 func (usp *UnixSockPipe) Push(upd mess.Update) error {
-	if usp.sender == nil {
-		if err := usp.InitPush(); err != nil {
-			return err
-		}
-	}
-
 	updStr, err := formatUpdate(usp.myID(), upd)
 	if err != nil {
 		return err
 	}
 
-	_, err = io.WriteString(usp.sender, updStr)
-	return err
+	usp.senderLck.Lock()
+	defer usp.senderLck.Unlock()
+
+	// The connection may be broken if the listening process was
+	// restarted, in this case reconnect and try again.
+	for attempt := 0; ; attempt++ {
+		if usp.sender == nil {
+			if err := usp.initPush(); err != nil {
+				return err
+			}
+		}
+
+		err = usp.sender.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err == nil {
+			_, err = io.WriteString(usp.sender, updStr)
+		}
+		if err == nil || attempt == 1 {
+			return err
+		}
+		usp.Log.DebugMsg("reconnecting to push the update", "reason", err)
+		usp.sender.Close()
+		usp.sender = nil
+	}
 }
 
 func (usp *UnixSockPipe) Close() error {
+	closed := usp.closedCh()
+	select {
+	case <-closed:
+	default:
+		close(closed)
+	}
+
+	usp.senderLck.Lock()
 	if usp.sender != nil {
 		usp.sender.Close()
 	}
+	usp.senderLck.Unlock()
 	if usp.listener != nil {
 		usp.listener.Close()
 		os.Remove(usp.SockPath)
 	}
+
+	usp.subsLck.Lock()
+	for conn := range usp.subs {
+		conn.Close()
+	}
+	for conn := range usp.subConns {
+		conn.Close()
+	}
+	usp.subsLck.Unlock()
 	return nil
 }
@@ -0,0 +1,130 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package updatepipe
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	mess "github.com/foxcpp/go-imap-mess"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestUnixSockPipe_Subscribe(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "upd.sock")
+
+	listener := &UnixSockPipe{SockPath: sockPath, Log: testutils.Logger(t, "listener")}
+	listenUpds := make(chan mess.Update, 1)
+	if err := listener.Listen(listenUpds); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	sub := &UnixSockPipe{SockPath: sockPath, Log: testutils.Logger(t, "subscriber")}
+	subUpds := make(chan mess.Update, 1)
+	if err := sub.Subscribe(subUpds); err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// Wait for the listener to register the subscriber.
+	for i := 0; ; i++ {
+		listener.subsLck.Lock()
+		n := len(listener.subs)
+		listener.subsLck.Unlock()
+		if n != 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("subscriber is not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pusher := &UnixSockPipe{SockPath: sockPath, Log: testutils.Logger(t, "pusher")}
+	defer pusher.Close()
+	upd := mess.Update{Key: "test", Type: mess.UpdNewMessage}
+	if err := pusher.Push(upd); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ch := range map[string]chan mess.Update{"listener": listenUpds, "subscriber": subUpds} {
+		select {
+		case got := <-ch:
+			if got.Type != upd.Type {
+				t.Errorf("%s: wrong update type received: %v", name, got.Type)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: update not received", name)
+		}
+	}
+}
+
+func TestUnixSockPipe_StopListening(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "upd.sock")
+
+	old := &UnixSockPipe{SockPath: sockPath, Log: testutils.Logger(t, "old")}
+	oldUpds := make(chan mess.Update, 1)
+	if err := old.Listen(oldUpds); err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+
+	pusher := &UnixSockPipe{SockPath: sockPath, Log: testutils.Logger(t, "pusher")}
+	defer pusher.Close()
+	upd := mess.Update{Key: "test", Type: mess.UpdNewMessage}
+	if err := pusher.Push(upd); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-oldUpds:
+	case <-time.After(5 * time.Second):
+		t.Fatal("update not received by the old listener")
+	}
+
+	old.StopListening()
+	newPipe := &UnixSockPipe{SockPath: sockPath, Log: testutils.Logger(t, "new")}
+	newUpds := make(chan mess.Update, 1)
+	if err := newPipe.Listen(newUpds); err != nil {
+		t.Fatal("Listen after StopListening:", err)
+	}
+	defer newPipe.Close()
+
+	// The pusher reconnects to the new listener.
+	if err := pusher.Push(upd); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-newUpds:
+	case <-time.After(5 * time.Second):
+		t.Fatal("update not received by the new listener")
+	}
+	select {
+	case <-oldUpds:
+		t.Fatal("update received by the old listener")
+	default:
+	}
+
+	// The old pipe should not remove the socket of the new listener.
+	old.Close()
+	if err := pusher.Push(upd); err != nil {
+		t.Fatal("Push after the old pipe is closed:", err)
+	}
+}
@@ -16,6 +16,11 @@ You should have received a copy of the GNU General Public License
 along with this program.  If not, see <https://www.gnu.org/licenses/>.
 */
 
+// Package maddy implements the server start-up and the command-line
+// interface.
+//
+// Start, StartReader and StartFile can be used to run the server as a
+// part of another Go program.
 package maddy
 
 import (
@@ -27,17 +32,24 @@ import (
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
+	"strconv"
+	"strings"
 
 	"github.com/caddyserver/certmagic"
 	parser "github.com/foxcpp/maddy/framework/cfgparser"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/activity"
 	"github.com/foxcpp/maddy/internal/authz"
 	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/dnscache"
+	"github.com/foxcpp/maddy/internal/exthook"
+	"github.com/foxcpp/maddy/internal/storagepath"
 	"github.com/urfave/cli/v2"
 
 	// Import packages for side-effect of module registration.
@@ -49,23 +61,41 @@ import (
 	_ "github.com/foxcpp/maddy/internal/auth/pass_table"
 	_ "github.com/foxcpp/maddy/internal/auth/plain_separate"
 	_ "github.com/foxcpp/maddy/internal/auth/shadow"
+	_ "github.com/foxcpp/maddy/internal/check/arc"
+	_ "github.com/foxcpp/maddy/internal/check/attachments"
 	_ "github.com/foxcpp/maddy/internal/check/authorize_sender"
+	_ "github.com/foxcpp/maddy/internal/check/authres"
 	_ "github.com/foxcpp/maddy/internal/check/command"
 	_ "github.com/foxcpp/maddy/internal/check/dkim"
 	_ "github.com/foxcpp/maddy/internal/check/dns"
 	_ "github.com/foxcpp/maddy/internal/check/dnsbl"
+	_ "github.com/foxcpp/maddy/internal/check/geoip"
+	_ "github.com/foxcpp/maddy/internal/check/greylist"
+	_ "github.com/foxcpp/maddy/internal/check/helo"
+	_ "github.com/foxcpp/maddy/internal/check/iprev"
 	_ "github.com/foxcpp/maddy/internal/check/milter"
 	_ "github.com/foxcpp/maddy/internal/check/requiretls"
 	_ "github.com/foxcpp/maddy/internal/check/rspamd"
 	_ "github.com/foxcpp/maddy/internal/check/spf"
+	_ "github.com/foxcpp/maddy/internal/check/verify_rcpt"
+	_ "github.com/foxcpp/maddy/internal/check/verify_sender_domain"
+	_ "github.com/foxcpp/maddy/internal/endpoint/api"
 	_ "github.com/foxcpp/maddy/internal/endpoint/dovecot_sasld"
 	_ "github.com/foxcpp/maddy/internal/endpoint/imap"
+	_ "github.com/foxcpp/maddy/internal/endpoint/login_notify"
+	_ "github.com/foxcpp/maddy/internal/endpoint/managesieve"
+	_ "github.com/foxcpp/maddy/internal/endpoint/mtasts"
 	_ "github.com/foxcpp/maddy/internal/endpoint/openmetrics"
+	_ "github.com/foxcpp/maddy/internal/endpoint/probe"
 	_ "github.com/foxcpp/maddy/internal/endpoint/smtp"
+	_ "github.com/foxcpp/maddy/internal/endpoint/system_mail"
+	_ "github.com/foxcpp/maddy/internal/endpoint/tlsa"
 	_ "github.com/foxcpp/maddy/internal/imap_filter"
 	_ "github.com/foxcpp/maddy/internal/imap_filter/command"
+	_ "github.com/foxcpp/maddy/internal/imap_filter/sieve"
 	_ "github.com/foxcpp/maddy/internal/libdns"
 	_ "github.com/foxcpp/maddy/internal/modify"
+	_ "github.com/foxcpp/maddy/internal/modify/arc"
 	_ "github.com/foxcpp/maddy/internal/modify/dkim"
 	_ "github.com/foxcpp/maddy/internal/storage/blob/fs"
 	_ "github.com/foxcpp/maddy/internal/storage/blob/s3"
@@ -204,7 +234,7 @@ func Run(c *cli.Context) error {
 
 	defer log.DefaultLogger.Out.Close()
 
-	if err := moduleMain(cfg); err != nil {
+	if err := moduleMain(cfg, c.Path("config")); err != nil {
 		systemdStatusErr(err)
 		return cli.Exit(err.Error(), 1)
 	}
@@ -288,11 +318,33 @@ func ensureDirectoryWritable(path string) error {
 }
 
 func ReadGlobals(cfg []config.Node) (map[string]interface{}, []config.Node, error) {
+	var (
+		extHooks []exthook.Hook
+		dnsCache *dns.Cache
+	)
+
+	// Locations should be known before log files are opened, which may
+	// happen before storage_paths is processed below.
+	for _, node := range cfg {
+		if node.Name != "storage_paths" {
+			continue
+		}
+		locs, err := storagepath.Directive(nil, node)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := storagepath.Validate(locs.(map[string]*storagepath.Location)); err != nil {
+			return nil, nil, err
+		}
+		storagepath.Set(locs.(map[string]*storagepath.Location))
+	}
+
 	globals := config.NewMap(nil, config.Node{Children: cfg})
 	globals.String("state_dir", false, false, DefaultStateDirectory, &config.StateDirectory)
 	globals.String("runtime_dir", false, false, DefaultRuntimeDirectory, &config.RuntimeDirectory)
 	globals.String("hostname", false, false, "", nil)
 	globals.String("autogenerated_msg_domain", false, false, "", nil)
+	globals.String("contact_url", false, false, "", nil)
 	globals.Custom("tls", false, false, nil, tls.TLSDirective, nil)
 	globals.Custom("tls_client", false, false, nil, tls.TLSClientBlock, nil)
 	globals.Bool("storage_perdomain", false, false, nil)
@@ -302,116 +354,207 @@ func ReadGlobals(cfg []config.Node) (map[string]interface{}, []config.Node, erro
 	globals.Bool("debug", false, log.DefaultLogger.Debug, &log.DefaultLogger.Debug)
 	config.EnumMapped(globals, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto, nil)
 	modconfig.Table(globals, "auth_map", true, false, nil, nil)
+	modconfig.Table(globals, "account_status", true, false, nil, nil)
+	modconfig.Table(globals, "auth_allowed_ips", true, false, nil, nil)
+	globals.Bool("activity_tracking", false, true, &activity.Enabled)
+	globals.Custom("dns_cache", false, false, dnscache.Default, dnscache.Directive, &dnsCache)
+	globals.Custom("storage_paths", false, false, nil, storagepath.Directive, nil)
+	config.EnumMapped(globals, "profile", false, false, module.Profiles, module.ProfileFull, &module.CurrentProfile)
+	globals.Callback("hook", func(_ *config.Map, node config.Node) error {
+		h, err := exthook.ParseHook(node)
+		if err != nil {
+			return err
+		}
+		extHooks = append(extHooks, h)
+		return nil
+	})
 	globals.AllowUnknown()
 	unknown, err := globals.Process()
-	return globals.Values, unknown, err
-}
-
-func moduleMain(cfg []config.Node) error {
-	globals, modBlocks, err := ReadGlobals(cfg)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	if err := InitDirs(); err != nil {
-		return err
+	dns.SetSharedCache(dnsCache)
+
+	if len(extHooks) != 0 {
+		hooks.AddNotifyHandler(exthook.NewRunner(extHooks).Handle)
 	}
 
-	hooks.AddHook(hooks.EventLogRotate, reinitLogging)
+	return globals.Values, unknown, nil
+}
 
-	endpoints, mods, err := RegisterModules(globals, modBlocks)
-	if err != nil {
-		return err
-	}
+func moduleMain(cfg []config.Node, configPath string) error {
+	hooks.AddHook(hooks.EventLogRotate, reinitLogging)
 
-	err = initModules(globals, endpoints, mods)
+	srv, err := Start(cfg)
 	if err != nil {
 		return err
 	}
+	srv.reload.configPath = configPath
 
 	systemdStatus(SDReady, "Listening for incoming connections...")
 
-	handleSignals()
+	handleSignals(func() {
+		if _, err := srv.ReloadFile(); err != nil {
+			log.DefaultLogger.Error("configuration reload failed", err)
+		}
+	})
 
 	systemdStatus(SDStopping, "Waiting for running transactions to complete...")
 
-	hooks.RunHooks(hooks.EventShutdown)
+	return srv.Close()
+}
 
-	return nil
+// PIDFile returns the path to the file containing the PID of the running
+// server process.
+func PIDFile() string {
+	return filepath.Join(config.RuntimeDirectory, "maddy.pid")
+}
+
+func writePIDFile() error {
+	return os.WriteFile(PIDFile(), []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644)
+}
+
+// readPIDFile returns the PID of the running server process.
+func readPIDFile() (int, error) {
+	blob, err := os.ReadFile(PIDFile())
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(blob)))
+	if err != nil {
+		return 0, fmt.Errorf("malformed PID file: %w", err)
+	}
+	return pid, nil
 }
 
 type ModInfo struct {
 	Instance module.Module
 	Cfg      config.Node
+	// Optional is set if the 'optional' directive is used for the module,
+	// see module.ParseOptional.
+	Optional bool
 }
 
 func RegisterModules(globals map[string]interface{}, nodes []config.Node) (endpoints, mods []ModInfo, err error) {
 	mods = make([]ModInfo, 0, len(nodes))
 
 	for _, block := range nodes {
-		var instName string
-		var modAliases []string
-		if len(block.Args) == 0 {
-			instName = block.Name
+		info, isEndpoint, err := registerModule(globals, block)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isEndpoint {
+			endpoints = append(endpoints, info)
 		} else {
-			instName = block.Args[0]
-			modAliases = block.Args[1:]
+			mods = append(mods, info)
 		}
+	}
 
-		modName := block.Name
+	if len(endpoints) == 0 {
+		return nil, nil, fmt.Errorf("at least one endpoint should be configured")
+	}
 
-		endpFactory := module.GetEndpoint(modName)
-		if endpFactory != nil {
-			inst, err := endpFactory(modName, block.Args)
-			if err != nil {
-				return nil, nil, err
-			}
+	return endpoints, mods, nil
+}
 
-			endpoints = append(endpoints, ModInfo{Instance: inst, Cfg: block})
-			continue
-		}
+// registerModule creates the module instance for the top-level configuration
+// block and adds it to the global registry. Endpoints are created but not
+// registered.
+func registerModule(globals map[string]interface{}, block config.Node) (info ModInfo, isEndpoint bool, err error) {
+	var instName string
+	var modAliases []string
+	if len(block.Args) == 0 {
+		instName = block.Name
+	} else {
+		instName = block.Args[0]
+		modAliases = block.Args[1:]
+	}
 
-		factory := module.Get(modName)
-		if factory == nil {
-			return nil, nil, config.NodeErr(block, "unknown module or global directive: %s", modName)
-		}
+	modName := block.Name
+
+	if err := module.CheckProfile(modName); err != nil {
+		return ModInfo{}, false, config.NodeErr(block, "%v", err)
+	}
+
+	block, optional, err := module.ParseOptional(block)
+	if err != nil {
+		return ModInfo{}, false, err
+	}
+	block, lazy, err := module.ParseLazy(block)
+	if err != nil {
+		return ModInfo{}, false, err
+	}
 
-		if module.HasInstance(instName) {
-			return nil, nil, config.NodeErr(block, "config block named %s already exists", instName)
+	endpFactory := module.GetEndpoint(modName)
+	if endpFactory != nil {
+		if lazy {
+			return ModInfo{}, false, config.NodeErr(block, "endpoints can't be initialized lazily")
 		}
 
-		inst, err := factory(modName, instName, modAliases, nil)
+		inst, err := endpFactory(modName, block.Args)
 		if err != nil {
-			return nil, nil, err
+			return ModInfo{}, false, err
 		}
 
-		module.RegisterInstance(inst, config.NewMap(globals, block))
-		for _, alias := range modAliases {
-			if module.HasInstance(alias) {
-				return nil, nil, config.NodeErr(block, "config block named %s already exists", alias)
-			}
-			module.RegisterAlias(alias, instName)
-		}
+		return ModInfo{Instance: inst, Cfg: block, Optional: optional}, true, nil
+	}
 
-		log.Debugf("%v:%v: register config block %v %v", block.File, block.Line, instName, modAliases)
-		mods = append(mods, ModInfo{Instance: inst, Cfg: block})
+	factory := module.Get(modName)
+	if factory == nil {
+		return ModInfo{}, false, config.NodeErr(block, "unknown module or global directive: %s", modName)
 	}
 
-	if len(endpoints) == 0 {
-		return nil, nil, fmt.Errorf("at least one endpoint should be configured")
+	if module.HasInstance(instName) {
+		return ModInfo{}, false, config.NodeErr(block, "config block named %s already exists", instName)
 	}
 
-	return endpoints, mods, nil
+	inst, err := factory(modName, instName, modAliases, nil)
+	if err != nil {
+		return ModInfo{}, false, err
+	}
+
+	module.RegisterInstance(inst, config.NewMap(globals, block))
+	if optional {
+		module.SetOptional(instName)
+	}
+	if lazy {
+		module.SetLazy(instName)
+	}
+	for _, alias := range modAliases {
+		if module.HasInstance(alias) {
+			return ModInfo{}, false, config.NodeErr(block, "config block named %s already exists", alias)
+		}
+		module.RegisterAlias(alias, instName)
+	}
+
+	log.Debugf("%v:%v: register config block %v %v", block.File, block.Line, instName, modAliases)
+	return ModInfo{Instance: inst, Cfg: block, Optional: optional}, false, nil
 }
 
 func initModules(globals map[string]interface{}, endpoints, mods []ModInfo) error {
 	for _, endp := range endpoints {
+		if err := initEndpoint(globals, endp); err != nil {
+			return err
+		}
+	}
+
+	return checkUnused(mods)
+}
+
+// initEndpoint initializes the endpoint and installs the hook to close it
+// on shutdown.
+func initEndpoint(globals map[string]interface{}, endp ModInfo) error {
+	return module.InitScoped(endp.Instance, func() error {
 		if err := endp.Instance.Init(config.NewMap(globals, endp.Cfg)); err != nil {
+			if endp.Optional {
+				_ = module.DisableOptional(endp.Instance, err)
+				return nil
+			}
 			return err
 		}
 
 		if closer, ok := endp.Instance.(io.Closer); ok {
-			endp := endp
 			hooks.AddHook(hooks.EventShutdown, func() {
 				log.Debugf("close %s (%s)", endp.Instance.Name(), endp.Instance.InstanceName())
 				if err := closer.Close(); err != nil {
@@ -419,10 +562,15 @@ func initModules(globals map[string]interface{}, endpoints, mods []ModInfo) erro
 				}
 			})
 		}
-	}
+		return nil
+	})
+}
 
+// checkUnused returns an error if any of the module instances is not used
+// by endpoints or other modules.
+func checkUnused(mods []ModInfo) error {
 	for _, inst := range mods {
-		if module.Initialized[inst.Instance.InstanceName()] {
+		if module.Initialized[inst.Instance.InstanceName()] || module.LazyReferenced(inst.Instance.InstanceName()) {
 			continue
 		}
 
@@ -0,0 +1,330 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package maddytest runs a complete maddy server inside the test process.
+//
+// The server has SMTP, Submission and IMAP endpoints listening on local
+// ephemeral ports and keeps all state in a temporary directory. Messages
+// accepted via SMTP or Submission are put into the queue and delivered to
+// the local storage:
+//
+//	srv := maddytest.New(t, maddytest.Options{})
+//	srv.CreateUser("user@maddy.test", "password")
+//	if err := srv.Send("sender@example.org", []string{"user@maddy.test"}, msg); err != nil {
+//		t.Fatal(err)
+//	}
+//	msgs := srv.WaitMessages("user@maddy.test", 1)
+//
+// Only one server can run in the process at a time (see maddy.Start), so
+// tests using the package must not be run in parallel.
+package maddytest
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Domain is the domain used for the server hostname and DSNs.
+const Domain = "maddy.test"
+
+// WaitTimeout is the maximum time WaitMessages waits for messages to be
+// delivered.
+var WaitTimeout = 10 * time.Second
+
+// Options control the server configuration.
+type Options struct {
+	// ExtraConfig is appended to the generated configuration. It can be
+	// used to define additional endpoints and modules.
+	//
+	// Available configuration blocks are local_authdb (credentials),
+	// local_mailboxes (storage) and local_queue (the queue delivering to
+	// local_mailboxes).
+	ExtraConfig string
+
+	// Debug enables debug log.
+	Debug bool
+}
+
+// Server is a maddy server running in the test process.
+type Server struct {
+	// Addresses of the endpoints in host:port form.
+	SMTPAddr       string
+	SubmissionAddr string
+	IMAPAddr       string
+
+	// StateDir is the state directory of the server.
+	StateDir string
+
+	t   testing.TB
+	srv *maddy.Server
+
+	passwordsLck sync.Mutex
+	passwords    map[string]string
+}
+
+// New starts the server. It is closed automatically when the test
+// completes.
+func New(t testing.TB, opts Options) *Server {
+	t.Helper()
+
+	s := &Server{
+		SMTPAddr:       freeAddr(t),
+		SubmissionAddr: freeAddr(t),
+		IMAPAddr:       freeAddr(t),
+		StateDir:       t.TempDir(),
+		t:              t,
+		passwords:      make(map[string]string),
+	}
+
+	srv, err := maddy.StartReader(strings.NewReader(s.config(opts)), "maddytest.conf")
+	if err != nil {
+		t.Fatal("maddytest: failed to start the server:", err)
+	}
+	s.srv = srv
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *Server) config(opts Options) string {
+	return `
+		hostname ` + Domain + `
+		state_dir ` + strconv.Quote(s.StateDir) + `
+		runtime_dir ` + strconv.Quote(s.StateDir) + `
+		tls off
+		debug ` + strconv.FormatBool(opts.Debug) + `
+
+		auth.pass_table local_authdb {
+			table sql_table {
+				driver sqlite3
+				dsn credentials.db
+				table_name passwords
+			}
+		}
+
+		storage.imapsql local_mailboxes {
+			driver sqlite3
+			dsn imapsql.db
+		}
+
+		target.queue local_queue {
+			target &local_mailboxes
+			autogenerated_msg_domain ` + Domain + `
+			bounce {
+				deliver_to &local_mailboxes
+			}
+		}
+
+		smtp tcp://` + s.SMTPAddr + ` {
+			# Default checks need DNS access.
+			check {
+			}
+			deliver_to &local_queue
+		}
+
+		submission tcp://` + s.SubmissionAddr + ` {
+			auth &local_authdb
+			# Let tests use arbitrary sender addresses.
+			check {
+			}
+			deliver_to &local_queue
+		}
+
+		imap tcp://` + s.IMAPAddr + ` {
+			auth &local_authdb
+			storage &local_mailboxes
+		}
+	` + opts.ExtraConfig
+}
+
+// Close stops the server. It is safe to call Close multiple times.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// CreateUser creates the account with the specified credentials and
+// mailbox.
+func (s *Server) CreateUser(username, password string) {
+	s.t.Helper()
+
+	authMod, err := module.GetInstance("local_authdb")
+	if err != nil {
+		s.t.Fatal("maddytest:", err)
+	}
+	if err := authMod.(module.PlainUserDB).CreateUser(username, password); err != nil {
+		s.t.Fatal("maddytest: failed to create credentials:", err)
+	}
+
+	storageMod, err := module.GetInstance("local_mailboxes")
+	if err != nil {
+		s.t.Fatal("maddytest:", err)
+	}
+	if err := storageMod.(module.ManageableStorage).CreateIMAPAcct(username); err != nil {
+		s.t.Fatal("maddytest: failed to create mailbox:", err)
+	}
+
+	s.passwordsLck.Lock()
+	s.passwords[username] = password
+	s.passwordsLck.Unlock()
+}
+
+func (s *Server) password(username string) string {
+	s.passwordsLck.Lock()
+	defer s.passwordsLck.Unlock()
+
+	pass, ok := s.passwords[username]
+	if !ok {
+		s.t.Fatalf("maddytest: user %s is not created using CreateUser", username)
+	}
+	return pass
+}
+
+// Send sends the message via the SMTP endpoint.
+//
+// Returned error is *smtp.SMTPError if the message is rejected.
+func (s *Server) Send(from string, to []string, msg []byte) error {
+	return sendMail(s.SMTPAddr, nil, from, to, msg)
+}
+
+// Submit sends the message via the Submission endpoint, authenticating as
+// the specified user.
+func (s *Server) Submit(username, from string, to []string, msg []byte) error {
+	s.t.Helper()
+	return sendMail(s.SubmissionAddr, sasl.NewPlainClient("", username, s.password(username)), from, to, msg)
+}
+
+func sendMail(addr string, auth sasl.Client, from string, to []string, msg []byte) error {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Hello("client." + Domain); err != nil {
+		return err
+	}
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.SendMail(from, to, bytes.NewReader(msg)); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Messages returns the contents of all messages in the INBOX of the user.
+func (s *Server) Messages(username string) [][]byte {
+	s.t.Helper()
+
+	msgs, err := s.fetch(username)
+	if err != nil {
+		s.t.Fatal("maddytest:", err)
+	}
+	return msgs
+}
+
+// WaitMessages waits until there are at least n messages in the INBOX of
+// the user and returns all of them.
+//
+// The test is failed if messages are not delivered within WaitTimeout.
+func (s *Server) WaitMessages(username string, n int) [][]byte {
+	s.t.Helper()
+
+	deadline := time.Now().Add(WaitTimeout)
+	for {
+		msgs, err := s.fetch(username)
+		if err != nil {
+			s.t.Fatal("maddytest:", err)
+		}
+		if len(msgs) >= n {
+			return msgs
+		}
+		if time.Now().After(deadline) {
+			s.t.Fatalf("maddytest: %d messages expected for %s, got %d", n, username, len(msgs))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (s *Server) fetch(username string) ([][]byte, error) {
+	c, err := imapclient.Dial(s.IMAPAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Logout()
+
+	if err := c.Login(username, s.password(username)); err != nil {
+		return nil, err
+	}
+	status, err := c.Select(imap.InboxName, true)
+	if err != nil {
+		return nil, err
+	}
+	if status.Messages == 0 {
+		return nil, nil
+	}
+
+	seq := new(imap.SeqSet)
+	seq.AddRange(1, status.Messages)
+	section := &imap.BodySectionName{Peek: true}
+
+	ch := make(chan *imap.Message, status.Messages)
+	if err := c.Fetch(seq, []imap.FetchItem{section.FetchItem()}, ch); err != nil {
+		return nil, err
+	}
+
+	msgs := make([][]byte, 0, status.Messages)
+	for msg := range ch {
+		body := msg.GetBody(section)
+		if body == nil {
+			return nil, fmt.Errorf("no body returned for message %d", msg.SeqNum)
+		}
+		buf := new(bytes.Buffer)
+		if _, err := buf.ReadFrom(body); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, buf.Bytes())
+	}
+	return msgs, nil
+}
+
+func freeAddr(t testing.TB) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("maddytest:", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
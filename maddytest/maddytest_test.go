@@ -0,0 +1,55 @@
+package maddytest
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+const testMsg = "From: <sender@example.org>\r\n" +
+	"To: <user@maddy.test>\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"Hello!\r\n"
+
+func TestServer_Send(t *testing.T) {
+	srv := New(t, Options{})
+	srv.CreateUser("user@maddy.test", "123")
+
+	if msgs := srv.Messages("user@maddy.test"); len(msgs) != 0 {
+		t.Fatal("Unexpected messages in a new mailbox:", len(msgs))
+	}
+
+	if err := srv.Send("sender@example.org", []string{"user@maddy.test"}, []byte(testMsg)); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := srv.WaitMessages("user@maddy.test", 1)
+	if len(msgs) != 1 {
+		t.Fatal("Wrong amount of messages:", len(msgs))
+	}
+	if !bytes.Contains(msgs[0], []byte("Subject: Hello\r\n")) || !bytes.HasSuffix(msgs[0], []byte("\r\nHello!\r\n")) {
+		t.Fatalf("Wrong message contents: %q", msgs[0])
+	}
+}
+
+func TestServer_Submit(t *testing.T) {
+	// Also checks that the server can be started again in the same
+	// process.
+	srv := New(t, Options{})
+	srv.CreateUser("user@maddy.test", "123")
+	srv.CreateUser("user2@maddy.test", "456")
+
+	if err := srv.Submit("user2@maddy.test", "user2@maddy.test", []string{"user@maddy.test"}, []byte(testMsg)); err != nil {
+		t.Fatal(err)
+	}
+	srv.WaitMessages("user@maddy.test", 1)
+
+	err := sendMail(srv.SubmissionAddr, nil, "user2@maddy.test", []string{"user@maddy.test"}, []byte(testMsg))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) {
+		t.Fatal("Expected SMTP error for unauthenticated submission, got", err)
+	}
+}
@@ -0,0 +1,482 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maddy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// ErrRestartRequired is returned by Server.Reload if global directives were
+// changed. They are used by all modules and cannot be changed without
+// restarting the server.
+var ErrRestartRequired = errors.New("maddy: global directives changed, restart is required")
+
+// reloadDrainTimeout is the maximum time replaced endpoints are allowed to
+// serve active sessions after the configuration reload.
+var reloadDrainTimeout = 5 * time.Minute
+
+// ReloadStatus describes changes applied by Server.Reload.
+type ReloadStatus struct {
+	// Restarted contains names of added or replaced configuration blocks.
+	Restarted []string `json:"restarted"`
+	// Removed contains names of removed configuration blocks.
+	Removed []string `json:"removed"`
+}
+
+// configBlock is the top-level configuration block of the running server.
+type configBlock struct {
+	node     config.Node
+	hash     string
+	info     ModInfo
+	endpoint bool
+}
+
+// reloadState is the part of Server used for configuration reload.
+type reloadState struct {
+	lck sync.Mutex
+	// closed is set by Server.Close.
+	closed     bool
+	configPath string
+
+	globals     map[string]interface{}
+	globalNodes []config.Node
+	blocks      map[string]configBlock
+
+	// Replaced modules are closed in background once endpoints that used
+	// them complete active sessions.
+	drainCtx  context.Context
+	stopDrain context.CancelFunc
+	drainWg   sync.WaitGroup
+}
+
+func (s *reloadState) init(globals map[string]interface{}, cfg []config.Node, endpoints, mods []ModInfo) {
+	s.globals = globals
+	s.drainCtx, s.stopDrain = context.WithCancel(context.Background())
+
+	globalNodes, modNodes := splitConfig(cfg)
+	s.globalNodes = globalNodes
+
+	nodes := make(map[string]config.Node, len(modNodes))
+	for _, node := range modNodes {
+		nodes[blockKey(node)] = node
+	}
+
+	s.blocks = make(map[string]configBlock, len(nodes))
+	for _, endp := range endpoints {
+		s.addBlock(nodes, endp, true)
+	}
+	for _, mod := range mods {
+		s.addBlock(nodes, mod, false)
+	}
+}
+
+func (s *reloadState) addBlock(nodes map[string]config.Node, info ModInfo, endpoint bool) {
+	// The 'optional' and 'lazy' directives are removed from ModInfo.Cfg,
+	// the original block is used to detect changes.
+	key := blockKey(info.Cfg)
+	node := nodes[key]
+	s.blocks[key] = configBlock{
+		node:     node,
+		hash:     hashNodes([]config.Node{node}),
+		info:     info,
+		endpoint: endpoint,
+	}
+}
+
+// stop waits for replaced modules to be closed. Endpoints that are still
+// draining are closed immediately.
+func (s *reloadState) stop() {
+	s.lck.Lock()
+	s.closed = true
+	s.lck.Unlock()
+
+	if s.stopDrain != nil {
+		s.stopDrain()
+	}
+	s.drainWg.Wait()
+}
+
+// ReloadFile is a variant of Reload that reads the configuration from the
+// file used to start the server.
+//
+// It is supported only for servers started using StartFile and by the
+// maddy executable.
+func (s *Server) ReloadFile() (ReloadStatus, error) {
+	s.reload.lck.Lock()
+	path := s.reload.configPath
+	s.reload.lck.Unlock()
+
+	if path == "" {
+		return ReloadStatus{}, errors.New("maddy: configuration file location is not known")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return ReloadStatus{}, err
+	}
+	defer f.Close()
+
+	cfg, err := parser.Read(f, path)
+	if err != nil {
+		return ReloadStatus{}, err
+	}
+	return s.Reload(cfg)
+}
+
+// Reload applies the new configuration to the running server.
+//
+// Only configuration blocks that were added, changed or removed are
+// replaced along with blocks that reference them. Replaced endpoints stop
+// accepting new connections immediately and continue serving active
+// sessions until they complete (but no longer than 5 minutes), then old
+// module instances are closed.
+//
+// If the new configuration cannot be applied, the server continues to run
+// with the old one and the error is returned. ErrRestartRequired is
+// returned if global directives were changed.
+func (s *Server) Reload(cfg []config.Node) (ReloadStatus, error) {
+	s.reload.lck.Lock()
+	defer s.reload.lck.Unlock()
+
+	if s.reload.closed {
+		return ReloadStatus{}, errors.New("maddy: server is closed")
+	}
+
+	globalNodes, modNodes := splitConfig(cfg)
+	if name, changed := changedGlobal(s.reload.globalNodes, globalNodes); changed {
+		return ReloadStatus{}, fmt.Errorf("%w: %s", ErrRestartRequired, name)
+	}
+
+	nodes := make(map[string]config.Node, len(modNodes))
+	var order []string
+	for _, node := range modNodes {
+		key := blockKey(node)
+		if _, ok := nodes[key]; ok {
+			return ReloadStatus{}, config.NodeErr(node, "config block named %s already exists", key)
+		}
+		nodes[key] = node
+		order = append(order, key)
+	}
+
+	replaced := s.reload.replacedBlocks(nodes)
+
+	var status ReloadStatus
+	for _, key := range order {
+		if _, ok := s.reload.blocks[key]; !ok || replaced[key] {
+			status.Restarted = append(status.Restarted, key)
+		}
+	}
+	for key := range replaced {
+		if _, ok := nodes[key]; !ok {
+			status.Removed = append(status.Removed, key)
+		}
+	}
+	sort.Strings(status.Removed)
+
+	if len(status.Restarted) == 0 && len(status.Removed) == 0 {
+		log.DefaultLogger.Msg("configuration reloaded, no changes")
+		return status, nil
+	}
+
+	module.LockRegistry()
+	defer module.UnlockRegistry()
+
+	old := make([]configBlock, 0, len(replaced))
+	for key := range replaced {
+		old = append(old, s.reload.blocks[key])
+	}
+	sort.Slice(old, func(i, j int) bool {
+		return blockKey(old[i].node) < blockKey(old[j].node)
+	})
+	s.reload.unregister(old)
+
+	restore := module.SaveRegistry()
+
+	created, err := s.reload.startBlocks(status.Restarted, nodes)
+	if err != nil {
+		closeBlocks(created)
+		restore()
+
+		// Old module instances might be already used by the new ones (e.g.
+		// queue hands over its messages to the new instance) so they are
+		// replaced using the old configuration instead.
+		oldKeys := make([]string, 0, len(old))
+		oldNodes := make(map[string]config.Node, len(old))
+		for _, b := range old {
+			key := blockKey(b.node)
+			oldKeys = append(oldKeys, key)
+			oldNodes[key] = b.node
+		}
+		recreated, restartErr := s.reload.startBlocks(oldKeys, oldNodes)
+		if restartErr != nil {
+			closeBlocks(recreated)
+			restore()
+			log.DefaultLogger.Error("failed to restart modules using the old configuration", restartErr)
+			return ReloadStatus{}, fmt.Errorf("%w (also failed to restart modules using the old configuration: %v)", err, restartErr)
+		}
+		s.reload.replace(old, recreated)
+		return ReloadStatus{}, err
+	}
+
+	s.reload.replace(old, created)
+	for _, key := range status.Removed {
+		delete(s.reload.blocks, key)
+	}
+
+	log.DefaultLogger.Msg("configuration reloaded",
+		"restarted", strings.Join(status.Restarted, ", "),
+		"removed", strings.Join(status.Removed, ", "))
+	return status, nil
+}
+
+// replacedBlocks returns keys of the running blocks that are changed or
+// removed in the new configuration, including blocks that reference
+// replaced module instances.
+func (s *reloadState) replacedBlocks(nodes map[string]config.Node) map[string]bool {
+	replaced := make(map[string]bool)
+	for key, b := range s.blocks {
+		node, ok := nodes[key]
+		if !ok || hashNodes([]config.Node{node}) != b.hash {
+			replaced[key] = true
+		}
+	}
+
+	// Dependencies are recorded using instance names.
+	replacedInst := make(map[string]bool)
+	for key := range replaced {
+		if b := s.blocks[key]; !b.endpoint {
+			replacedInst[b.info.Instance.InstanceName()] = true
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for key, b := range s.blocks {
+			if replaced[key] {
+				continue
+			}
+			for _, dep := range module.Dependencies(b.info.Instance) {
+				if replacedInst[dep] {
+					replaced[key] = true
+					if !b.endpoint {
+						replacedInst[b.info.Instance.InstanceName()] = true
+					}
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	return replaced
+}
+
+// unregister removes replaced module instances from the registry and stops
+// replaced endpoints from accepting new connections so new instances can
+// use the same addresses.
+func (s *reloadState) unregister(old []configBlock) {
+	for _, b := range old {
+		if !b.endpoint {
+			module.UnregisterInstance(b.info.Instance.InstanceName())
+			continue
+		}
+
+		if endp, ok := b.info.Instance.(module.DrainableEndpoint); ok {
+			if err := endp.StopListening(); err != nil {
+				log.DefaultLogger.Error("failed to stop listening", err, "endpoint", blockKey(b.node))
+			}
+			continue
+		}
+
+		// Endpoint cannot continue to serve active sessions without
+		// holding the listener.
+		closeBlocks([]configBlock{b})
+	}
+}
+
+// startBlocks creates and initializes module instances for specified
+// configuration blocks. Created blocks are returned even if the error
+// occurs so they can be closed.
+func (s *reloadState) startBlocks(keys []string, nodes map[string]config.Node) ([]configBlock, error) {
+	created := make([]configBlock, 0, len(keys))
+	for _, key := range keys {
+		info, endpoint, err := registerModule(s.globals, nodes[key])
+		if err != nil {
+			return created, err
+		}
+		created = append(created, configBlock{
+			node:     nodes[key],
+			hash:     hashNodes([]config.Node{nodes[key]}),
+			info:     info,
+			endpoint: endpoint,
+		})
+	}
+
+	var mods []ModInfo
+	for _, b := range created {
+		if !b.endpoint {
+			mods = append(mods, b.info)
+			continue
+		}
+		if err := initEndpoint(s.globals, b.info); err != nil {
+			return created, err
+		}
+	}
+
+	return created, checkUnused(mods)
+}
+
+// replace updates the running blocks and closes old module instances once
+// old endpoints complete active sessions.
+func (s *reloadState) replace(old, created []configBlock) {
+	for _, b := range created {
+		s.blocks[blockKey(b.node)] = b
+	}
+
+	var draining []module.DrainableEndpoint
+	owners := make([]interface{}, 0, len(old))
+	for _, b := range old {
+		owners = append(owners, b.info.Instance)
+		module.ForgetDependencies(b.info.Instance)
+		if endp, ok := b.info.Instance.(module.DrainableEndpoint); ok && b.endpoint {
+			draining = append(draining, endp)
+		}
+	}
+	closers := hooks.Detach(owners...)
+
+	s.drainWg.Add(1)
+	go func() {
+		defer s.drainWg.Done()
+
+		ctx, cancel := context.WithTimeout(s.drainCtx, reloadDrainTimeout)
+		defer cancel()
+
+		var wg sync.WaitGroup
+		for _, endp := range draining {
+			wg.Add(1)
+			go func(endp module.DrainableEndpoint) {
+				defer wg.Done()
+				if err := endp.Drain(ctx); err != nil {
+					log.DefaultLogger.Error("replaced endpoint did not complete active sessions", err)
+				}
+			}(endp)
+		}
+		wg.Wait()
+
+		for _, f := range closers {
+			f()
+		}
+	}()
+}
+
+// closeBlocks removes hooks installed by module instances and closes them.
+func closeBlocks(blocks []configBlock) {
+	owners := make([]interface{}, 0, len(blocks))
+	for _, b := range blocks {
+		owners = append(owners, b.info.Instance)
+		module.ForgetDependencies(b.info.Instance)
+	}
+	for _, f := range hooks.Detach(owners...) {
+		f()
+	}
+}
+
+// splitConfig separates global directives from module configuration
+// blocks.
+func splitConfig(cfg []config.Node) (globals, blocks []config.Node) {
+	for _, node := range cfg {
+		if module.GetEndpoint(node.Name) != nil || module.Get(node.Name) != nil {
+			blocks = append(blocks, node)
+		} else {
+			globals = append(globals, node)
+		}
+	}
+	return globals, blocks
+}
+
+// changedGlobal reports whether global directives are different and returns
+// the name of the first changed directive. Unknown directives are reported
+// the same way, they are rejected during the restart.
+func changedGlobal(prev, cur []config.Node) (string, bool) {
+	for i := 0; i < len(prev) || i < len(cur); i++ {
+		switch {
+		case i >= len(cur):
+			return prev[i].Name, true
+		case i >= len(prev):
+			return cur[i].Name, true
+		case hashNodes(prev[i:i+1]) != hashNodes(cur[i:i+1]):
+			return cur[i].Name, true
+		}
+	}
+	return "", false
+}
+
+// blockKey returns the name identifying the configuration block across
+// reloads: instance name for modules and module name with addresses for
+// endpoints.
+func blockKey(node config.Node) string {
+	if module.GetEndpoint(node.Name) != nil {
+		return strings.Join(append([]string{node.Name}, node.Args...), " ")
+	}
+	if len(node.Args) == 0 {
+		return node.Name
+	}
+	return node.Args[0]
+}
+
+// hashNodes returns the digest of configuration nodes contents. Locations
+// of nodes are not included so moving blocks around does not change it.
+func hashNodes(nodes []config.Node) string {
+	h := sha256.New()
+	writeNodes(h, nodes)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeNodes(h hash.Hash, nodes []config.Node) {
+	writeString := func(s string) {
+		_ = binary.Write(h, binary.BigEndian, uint64(len(s)))
+		h.Write([]byte(s))
+	}
+
+	_ = binary.Write(h, binary.BigEndian, uint64(len(nodes)))
+	for _, node := range nodes {
+		writeString(node.Name)
+		_ = binary.Write(h, binary.BigEndian, uint64(len(node.Args)))
+		for _, arg := range node.Args {
+			writeString(arg)
+		}
+		writeNodes(h, node.Children)
+	}
+}
@@ -22,8 +22,12 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package maddy
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
 	"github.com/foxcpp/maddy/framework/hooks"
@@ -33,34 +37,73 @@ import (
 // handleSignals function creates and listens on OS signals channel.
 //
 // OS-specific signals that correspond to the program termination
-// (SIGTERM, SIGHUP, SIGINT) will cause this function to return.
+// (SIGTERM, SIGINT) will cause this function to return.
 //
-// SIGUSR1 will call reinitLogging without returning.
-func handleSignals() os.Signal {
+// SIGUSR1 will call reinitLogging without returning. SIGHUP will call
+// reloadConfig, if it is nil, SIGHUP is handled as a termination signal.
+func handleSignals(reloadConfig func()) os.Signal {
 	sig := make(chan os.Signal, 5)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2)
 
 	for {
-		switch s := <-sig; s {
+		s := <-sig
+		switch s {
 		case syscall.SIGUSR1:
 			log.Printf("signal received (%s), rotating logs", s.String())
 			systemdStatus(SDReloading, "Reopening logs...")
 			hooks.RunHooks(hooks.EventLogRotate)
 			systemdStatus(SDReady, "Listening for incoming connections...")
+			continue
 		case syscall.SIGUSR2:
 			log.Printf("signal received (%s), reloading state", s.String())
 			systemdStatus(SDReloading, "Reloading state...")
 			hooks.RunHooks(hooks.EventReload)
 			systemdStatus(SDReady, "Listening for incoming connections...")
-		default:
-			go func() {
-				s := handleSignals()
-				log.Printf("forced shutdown due to signal (%v)!", s)
-				os.Exit(1)
-			}()
+			continue
+		case syscall.SIGHUP:
+			if reloadConfig != nil {
+				log.Printf("signal received (%s), reloading configuration", s.String())
+				systemdStatus(SDReloading, "Reloading configuration...")
+				reloadConfig()
+				systemdStatus(SDReady, "Listening for incoming connections...")
+				continue
+			}
+		}
+
+		go func() {
+			s := handleSignals(nil)
+			log.Printf("forced shutdown due to signal (%v)!", s)
+			os.Exit(1)
+		}()
+
+		log.Printf("signal received (%v), next signal will force immediate shutdown.", s)
+		return s
+	}
+}
+
+// SignalReload asks the running server process to reload its state (see
+// hooks.EventReload).
+//
+// os.ErrNotExist is returned if the server is not running.
+func SignalReload() error {
+	pid, err := readPIDFile()
+	if err != nil {
+		return err
+	}
+
+	// Make sure the PID file is not stale and the PID was not reused for an
+	// unrelated process since SIGUSR2 terminates processes that do not handle
+	// it.
+	cmdline, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline")
+	if err == nil && !bytes.Contains(cmdline, []byte("maddy")) {
+		return fmt.Errorf("stale PID file: %w", os.ErrNotExist)
+	}
 
-			log.Printf("signal received (%v), next signal will force immediate shutdown.", s)
-			return s
+	if err := syscall.Kill(pid, syscall.SIGUSR2); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("stale PID file: %w", os.ErrNotExist)
 		}
+		return err
 	}
+	return nil
 }
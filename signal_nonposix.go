@@ -22,6 +22,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package maddy
 
 import (
+	"errors"
 	"os"
 	"os/signal"
 	"syscall"
@@ -29,13 +30,13 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 )
 
-func handleSignals() os.Signal {
+func handleSignals(_ func()) os.Signal {
 	sig := make(chan os.Signal, 5)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT)
 
 	s := <-sig
 	go func() {
-		s := handleSignals()
+		s := handleSignals(nil)
 		log.Printf("forced shutdown due to signal (%v)!", s)
 		os.Exit(1)
 	}()
@@ -43,3 +44,8 @@ func handleSignals() os.Signal {
 	log.Printf("signal received (%v), next signal will force immediate shutdown.", s)
 	return s
 }
+
+// SignalReload is not supported on this platform.
+func SignalReload() error {
+	return errors.New("reload signal is not supported on this platform")
+}
@@ -188,6 +188,7 @@ func TestDovecotSASLClient(tt *testing.T) {
 		smtp tcp://127.0.0.1:{env:TEST_PORT_smtp} {
 			hostname mx.maddy.test
 			tls off
+			allow_auth yes
 			auth dovecot_sasl unix://{env:DOVECOT_SASL_SOCK}
 			deliver_to dummy
 		}`)
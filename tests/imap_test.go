@@ -4,6 +4,9 @@
 package tests_test
 
 import (
+	"fmt"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/foxcpp/maddy/tests"
@@ -94,3 +97,350 @@ func TestIMAPEndpointStorageMap(tt *testing.T) {
 	imapConn2.Expect(`* LIST (\HasNoChildren) "." "testbox"`)
 	imapConn2.ExpectPattern(". OK *")
 }
+
+func TestIMAPEndpointID(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+
+	t.DNS(nil)
+	t.Port("imap")
+	t.Config(`
+		storage.imapsql test_store {
+			driver sqlite3
+			dsn imapsql.db
+		}
+
+		imap tcp://127.0.0.1:{env:TEST_PORT_imap} {
+			tls off
+
+			auth_map email_localpart
+			auth pass_table static {
+				entry "user" "bcrypt:$2a$10$E.AuCH3oYbaRrETXfXwc0.4jRAQBbanpZiCfudsJz9bHzLr/qj6ti" # password: 123
+			}
+			storage &test_store
+		}
+	`)
+	t.Run(1)
+	defer t.Close()
+
+	imapConn := t.Conn("imap")
+	defer imapConn.Close()
+	imapConn.ExpectPattern(`\* OK *`)
+	imapConn.Writeln(`. ID ("name" "test-client" "version" "1.0")`)
+	imapConn.Expect(`* ID ("name" "maddy" "support-url" "https://maddy.email")`)
+	imapConn.ExpectPattern(". OK *")
+	imapConn.Writeln(". LOGIN user@example.org 123")
+	imapConn.ExpectPattern(". OK *")
+	imapConn.Writeln(". ID NIL")
+	imapConn.Expect(`* ID ("name" "maddy" "support-url" "https://maddy.email")`)
+	imapConn.ExpectPattern(". OK *")
+	imapConn.Writeln(". ID (\"name\")")
+	imapConn.ExpectPattern(". BAD *")
+}
+
+func TestIMAPEndpointCompatTable(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+
+	t.DNS(nil)
+	t.Port("imap")
+	t.Config(`
+		storage.imapsql test_store {
+			driver sqlite3
+			dsn imapsql.db
+		}
+
+		imap tcp://127.0.0.1:{env:TEST_PORT_imap} {
+			tls off
+
+			auth_map email_localpart
+			auth pass_table static {
+				entry "user" "bcrypt:$2a$10$E.AuCH3oYbaRrETXfXwc0.4jRAQBbanpZiCfudsJz9bHzLr/qj6ti" # password: 123
+			}
+			storage &test_store
+			compat_table static {
+				entry "test-client" "bodystructure_no_ext"
+			}
+		}
+	`)
+	t.Run(1)
+	defer t.Close()
+
+	msg := "Content-Type: text/plain\r\n" +
+		"Content-Disposition: inline\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+
+	fetch := func(id string, expected string) {
+		imapConn := t.Conn("imap")
+		defer imapConn.Close()
+		imapConn.ExpectPattern(`\* OK *`)
+		imapConn.Writeln(`. ID ("name" "` + id + `")`)
+		imapConn.Expect(`* ID ("name" "maddy" "support-url" "https://maddy.email")`)
+		imapConn.ExpectPattern(". OK *")
+		imapConn.Writeln(". LOGIN user@example.org 123")
+		imapConn.ExpectPattern(". OK *")
+		imapConn.Writeln(". EXAMINE INBOX")
+		for {
+			line, err := imapConn.Readln()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line[0] == '.' {
+				break
+			}
+		}
+		imapConn.Writeln(". FETCH 1 BODYSTRUCTURE")
+		imapConn.Expect(expected)
+		imapConn.ExpectPattern(". OK *")
+	}
+
+	imapConn := t.Conn("imap")
+	defer imapConn.Close()
+	imapConn.ExpectPattern(`\* OK *`)
+	imapConn.Writeln(". LOGIN user@example.org 123")
+	imapConn.ExpectPattern(". OK *")
+	imapConn.Writeln(fmt.Sprintf(". APPEND INBOX {%d+}", len(msg)))
+	imapConn.Write(msg)
+	imapConn.Writeln("")
+	imapConn.ExpectPattern(". OK *")
+
+	fetch("other-client", `* 1 FETCH (BODYSTRUCTURE ("text" "plain" () NIL NIL NIL 7 1 NIL ("inline" ()) NIL NIL))`)
+	fetch("test-client", `* 1 FETCH (BODYSTRUCTURE ("text" "plain" () NIL NIL NIL 7 1 NIL NIL NIL NIL))`)
+}
+
+func TestIMAPEndpointMultiAppend(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+
+	t.DNS(nil)
+	t.Port("imap")
+	t.Config(`
+		storage.imapsql test_store {
+			driver sqlite3
+			dsn imapsql.db
+			appendlimit 100b
+		}
+
+		imap tcp://127.0.0.1:{env:TEST_PORT_imap} {
+			tls off
+
+			auth_map email_localpart
+			auth pass_table static {
+				entry "user" "bcrypt:$2a$10$E.AuCH3oYbaRrETXfXwc0.4jRAQBbanpZiCfudsJz9bHzLr/qj6ti" # password: 123
+			}
+			storage &test_store
+		}
+	`)
+	t.Run(1)
+	defer t.Close()
+
+	msg := "Subject: Hello\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+	bigMsg := "Subject: Hello\r\n" +
+		"\r\n" +
+		strings.Repeat("Hello\r\n", 20)
+
+	imapConn := t.Conn("imap")
+	defer imapConn.Close()
+	imapConn.ExpectPattern(`\* OK \[CAPABILITY * APPENDLIMIT=100 * MULTIAPPEND *\] *`)
+	imapConn.Writeln(". LOGIN user@example.org 123")
+	imapConn.ExpectPattern(". OK *")
+
+	imapConn.Writeln(fmt.Sprintf(`. APPEND INBOX (\Seen) {%d+}`, len(msg)))
+	imapConn.Write(msg)
+	imapConn.Writeln(fmt.Sprintf(` {%d}`, len(msg)))
+	imapConn.ExpectPattern(`+ *`)
+	imapConn.Write(msg)
+	imapConn.Writeln("")
+	imapConn.ExpectPattern(". OK *")
+
+	imapConn.Writeln(fmt.Sprintf(`. APPEND INBOX {%d+}`, len(msg)))
+	imapConn.Write(msg)
+	imapConn.Writeln(fmt.Sprintf(` {%d+}`, len(bigMsg)))
+	imapConn.Write(bigMsg)
+	imapConn.Writeln("")
+	imapConn.Expect(". NO [TOOBIG] Message size exceeding limit")
+
+	imapConn.Writeln(`. STATUS INBOX (MESSAGES UNSEEN APPENDLIMIT)`)
+	// Order of items is not defined.
+	status := imapConn.ExpectPattern(`\* STATUS INBOX (*)`)
+	items := strings.Fields(strings.TrimSuffix(strings.TrimPrefix(status, "* STATUS INBOX ("), ")"))
+	sort.Strings(items)
+	if strings.Join(items, " ") != "1 100 2 APPENDLIMIT MESSAGES UNSEEN" {
+		t.Fatal("Unexpected STATUS response:", status)
+	}
+	imapConn.ExpectPattern(". OK *")
+}
+
+func TestIMAPEndpointKeywordLimits(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+
+	t.DNS(nil)
+	t.Port("imap")
+	t.Config(`
+		storage.imapsql test_store {
+			driver sqlite3
+			dsn imapsql.db
+		}
+
+		imap tcp://127.0.0.1:{env:TEST_PORT_imap} {
+			tls off
+
+			auth_map email_localpart
+			auth pass_table static {
+				entry "user" "bcrypt:$2a$10$E.AuCH3oYbaRrETXfXwc0.4jRAQBbanpZiCfudsJz9bHzLr/qj6ti" # password: 123
+			}
+			storage &test_store
+
+			max_keywords_per_mailbox 3
+			max_keywords_per_message 2
+		}
+	`)
+	t.Run(1)
+	defer t.Close()
+
+	msg := "Subject: Hello\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+
+	imapConn := t.Conn("imap")
+	defer imapConn.Close()
+	imapConn.ExpectPattern(`\* OK *`)
+	imapConn.Writeln(". LOGIN user@example.org 123")
+	imapConn.ExpectPattern(". OK *")
+
+	imapConn.Writeln(fmt.Sprintf(`. APPEND INBOX (\Seen a b c) {%d+}`, len(msg)))
+	imapConn.Write(msg)
+	imapConn.Writeln("")
+	imapConn.Expect(". NO [LIMIT] Too many keywords")
+
+	imapConn.Writeln(fmt.Sprintf(`. APPEND INBOX (\Seen a b) {%d+}`, len(msg)))
+	imapConn.Write(msg)
+	imapConn.Writeln("")
+	imapConn.ExpectPattern(". OK *")
+
+	imapConn.Writeln(". SELECT INBOX")
+	for {
+		line, err := imapConn.Readln()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, ". OK") {
+			break
+		}
+	}
+
+	imapConn.Writeln(". STORE 1 +FLAGS.SILENT (c)")
+	imapConn.Expect(". NO [LIMIT] Too many keywords")
+	imapConn.Writeln(". STORE 1 FLAGS.SILENT (\\Seen a c)")
+	imapConn.ExpectPattern(". OK *")
+	imapConn.Writeln(". STORE 1 +FLAGS.SILENT (d)")
+	imapConn.Expect(". NO [LIMIT] Too many keywords")
+	imapConn.Writeln(". STORE 1 -FLAGS.SILENT (c)")
+	imapConn.ExpectPattern(". OK *")
+
+	imapConn.Writeln(". FETCH 1 (FLAGS)")
+	imapConn.Expect(`* 1 FETCH (FLAGS (\Seen a \Recent))`)
+	imapConn.ExpectPattern(". OK *")
+}
+
+func TestIMAPEndpointMaintenance(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+
+	t.DNS(nil)
+	t.Port("imap")
+	t.Config(`
+		storage.imapsql test_store {
+			driver sqlite3
+			dsn imapsql.db
+		}
+
+		imap tcp://127.0.0.1:{env:TEST_PORT_imap} {
+			tls off
+
+			auth_map email_localpart
+			auth pass_table static {
+				entry "user" "bcrypt:$2a$10$E.AuCH3oYbaRrETXfXwc0.4jRAQBbanpZiCfudsJz9bHzLr/qj6ti" # password: 123
+			}
+			storage &test_store
+		}
+	`)
+	t.Run(1)
+	defer t.Close()
+
+	msg := "Subject: Hello\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+
+	imapConn := t.Conn("imap")
+	defer imapConn.Close()
+	imapConn.ExpectPattern(`\* OK *`)
+	imapConn.Writeln(". LOGIN user@example.org 123")
+	imapConn.ExpectPattern(". OK *")
+	imapConn.Writeln(fmt.Sprintf(`. APPEND INBOX {%d+}`, len(msg)))
+	imapConn.Write(msg)
+	imapConn.Writeln("")
+	imapConn.ExpectPattern(". OK *")
+
+	// Selected before the maintenance mode is enabled, so opened read-write.
+	imapConn.Writeln(". SELECT INBOX")
+	selectStatus := func() string {
+		for {
+			line, err := imapConn.Readln()
+			if err != nil {
+				t.Fatal("Unexpected error:", err)
+			}
+			if strings.HasPrefix(line, ". ") {
+				return line
+			}
+		}
+	}
+	if status := selectStatus(); !strings.HasPrefix(status, ". OK [READ-WRITE]") {
+		t.Fatal("Unexpected SELECT response:", status)
+	}
+
+	out := t.MustRunCLI("maintenance", "enable", "--reason", "test")
+	if !strings.Contains(out, "Maintenance mode is enabled") {
+		t.Fatal("Unexpected output:", out)
+	}
+
+	imapConn.Writeln(". STORE 1 +FLAGS (\\Flagged)")
+	imapConn.ExpectPattern(`. NO \[UNAVAILABLE\] *`)
+	imapConn.Writeln(". FETCH 1 (BODY[HEADER.FIELDS (Subject)])")
+	imapConn.ExpectPattern(`\* 1 FETCH (BODY\[HEADER.FIELDS (SUBJECT)\] *`)
+	imapConn.Expect("Subject: Hello")
+	imapConn.Expect("")
+	imapConn.Expect(")")
+	imapConn.ExpectPattern(". OK *")
+	imapConn.Writeln(". FETCH 1 (FLAGS)")
+	line, err := imapConn.Readln()
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if strings.Contains(line, `\Seen`) {
+		t.Fatal("Message is marked as seen in maintenance mode:", line)
+	}
+	imapConn.ExpectPattern(". OK *")
+
+	imapConn.Writeln(". CREATE testbox")
+	imapConn.ExpectPattern(`. NO \[UNAVAILABLE\] *`)
+	imapConn.Writeln(fmt.Sprintf(`. APPEND INBOX {%d+}`, len(msg)))
+	imapConn.Write(msg)
+	imapConn.Writeln("")
+	imapConn.ExpectPattern(`. NO \[UNAVAILABLE\] *`)
+	imapConn.Writeln(". SELECT INBOX")
+	if status := selectStatus(); !strings.HasPrefix(status, ". OK [READ-ONLY]") {
+		t.Fatal("Unexpected SELECT response:", status)
+	}
+	imapConn.Writeln(". EXPUNGE")
+	imapConn.ExpectPattern(". NO *")
+
+	t.MustRunCLI("maintenance", "disable")
+
+	imapConn.Writeln(". CREATE testbox")
+	imapConn.ExpectPattern(". OK *")
+}
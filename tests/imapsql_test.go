@@ -54,6 +54,9 @@ func TestImapsqlDelivery(tt *testing.T) {
 			hostname maddy.test
 			tls off
 
+			check {
+			}
+
 			deliver_to &test_store
 		}
 	`)
@@ -257,3 +260,69 @@ func TestImapsqlAuthMap(tt *testing.T) {
 	imapConn.ExpectPattern(`\* 1 RECENT`)
 	imapConn.ExpectPattern(". OK *")
 }
+
+func TestImapsqlDeliverySubaddressFolder(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+
+	t.DNS(nil)
+	t.Port("imap")
+	t.Port("smtp")
+	t.Config(`
+		storage.imapsql test_store {
+			delivery_map regexp "([^+@]+)([+][^@]*)?@maddy.test" "$1@maddy.test"
+			delivery_subaddress_folder create
+
+			driver sqlite3
+			dsn imapsql.db
+		}
+
+		imap tcp://127.0.0.1:{env:TEST_PORT_imap} {
+			tls off
+
+			auth dummy
+			storage &test_store
+		}
+
+		smtp tcp://127.0.0.1:{env:TEST_PORT_smtp} {
+			hostname maddy.test
+			tls off
+
+			deliver_to &test_store
+		}
+	`)
+	t.Run(2)
+	defer t.Close()
+
+	imapConn := t.Conn("imap")
+	defer imapConn.Close()
+	imapConn.ExpectPattern(`\* OK *`)
+	imapConn.Writeln(". LOGIN testusr@maddy.test 1234")
+	imapConn.ExpectPattern(". OK *")
+
+	smtpConn := t.Conn("smtp")
+	defer smtpConn.Close()
+	smtpConn.SMTPNegotation("localhost", nil, nil)
+	for _, rcpt := range []string{"testusr+lists", "testusr+Lists", "testusr+a.b", "testusr+INBOX"} {
+		smtpConn.Writeln("MAIL FROM:<sender@maddy.test>")
+		smtpConn.ExpectPattern("2*")
+		smtpConn.Writeln("RCPT TO:<" + rcpt + "@maddy.test>")
+		smtpConn.ExpectPattern("2*")
+		smtpConn.Writeln("DATA")
+		smtpConn.ExpectPattern("354 *")
+		smtpConn.Writeln("Subject: Hi!")
+		smtpConn.Writeln("")
+		smtpConn.Writeln("Hi!")
+		smtpConn.Writeln(".")
+		smtpConn.ExpectPattern("2*")
+	}
+
+	imapConn.Writeln(". STATUS lists (MESSAGES)")
+	imapConn.Expect(`* STATUS "lists" (MESSAGES 2)`)
+	imapConn.ExpectPattern(". OK *")
+	imapConn.Writeln(". STATUS INBOX (MESSAGES)")
+	imapConn.Expect(`* STATUS INBOX (MESSAGES 2)`)
+	imapConn.ExpectPattern(". OK *")
+	imapConn.Writeln(`. LIST "" "a*"`)
+	imapConn.ExpectPattern(". OK *")
+}
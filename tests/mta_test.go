@@ -24,6 +24,7 @@ package tests_test
 import (
 	"net"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/foxcpp/go-mockdns"
@@ -79,6 +80,11 @@ func TestMTA_Outbound(tt *testing.T) {
 	if be.SessionCounter != 1 {
 		t.Fatal("No actual connection made?", be.SessionCounter)
 	}
+
+	out := t.MustRunCLI("destinations")
+	if !strings.Contains(out, "example.invalid  1 ") {
+		t.Fatal("Delivery is not included in destinations statistics:", out)
+	}
 }
 
 func TestIssue321(tt *testing.T) {
@@ -56,6 +56,9 @@ func TestSMTPEndpoint_LargeMessage(tt *testing.T) {
 			hostname maddy.test
 			tls off
 
+			check {
+			}
+
 			deliver_to &test_store
 		}
 	`)
@@ -146,6 +149,9 @@ func TestSMTPEndpoint_FileBuffer(tt *testing.T) {
 			tls off
 			buffer ` + bufferOpt + `
 
+			check {
+			}
+
 			deliver_to &test_store
 		}
 	`)
@@ -235,6 +241,9 @@ func TestSMTPEndpoint_Autobuffer(tt *testing.T) {
 			tls off
 			buffer auto 5b
 
+			check {
+			}
+
 			deliver_to &test_store
 		}
 	`)
@@ -453,6 +453,7 @@ func TestCheckAuthorizeSender(tt *testing.T) {
 			hostname mx.maddy.test
 			tls off
 
+			allow_auth yes
 			auth dummy
 			defer_sender_reject off
 